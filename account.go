@@ -2,20 +2,31 @@ package mup
 
 import (
 	"database/sql"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
+	"gopkg.in/mup.v0/schema"
 	"gopkg.in/tomb.v2"
-	"strconv"
 )
 
 type accountManager struct {
 	tomb     tomb.Tomb
 	config   Config
 	db       *sql.DB
+	stmts    *stmtCache
 	clients  map[string]accountClient
 	requests chan interface{}
 	incoming chan *Message
+
+	statusMutex sync.Mutex
+	status      map[string]*accountStatus
+}
+
+type accountStatus struct {
+	AccountStatus
+	client accountClient
+	queue  *outQueue
 }
 
 type accountClient interface {
@@ -40,15 +51,22 @@ type accountInfo struct {
 	Identity    string
 	Password    string
 	LastId      int64
+	LogLevel    string
+	Config      string // JSON document
+	Bang        string
 
 	Channels []channelInfo
+
+	// Commands holds the visible commands of the plugins that target
+	// the account, for clients that can advertise them to users.
+	Commands []schema.Command
 }
 
-const accountColumns = "name,kind,endpoint,host,tls,tlsinsecure,nick,identity,password,lastid"
-const accountPlacers = "?,?,?,?,?,?,?,?,?,?"
+const accountColumns = "name,kind,endpoint,host,tls,tlsinsecure,nick,identity,password,lastid,loglevel,config,bang"
+const accountPlacers = "?,?,?,?,?,?,?,?,?,?,?,?,?"
 
 func (ai *accountInfo) refs() []interface{} {
-	return []interface{}{&ai.Name, &ai.Kind, &ai.Endpoint, &ai.Host, &ai.TLS, &ai.TLSInsecure, &ai.Nick, &ai.Identity, &ai.Password, &ai.LastId}
+	return []interface{}{&ai.Name, &ai.Kind, &ai.Endpoint, &ai.Host, &ai.TLS, &ai.TLSInsecure, &ai.Nick, &ai.Identity, &ai.Password, &ai.LastId, &ai.LogLevel, &ai.Config, &ai.Bang}
 }
 
 // NetworkTimeout's value is used as a timeout in a number of network-related activities.
@@ -59,13 +77,14 @@ type channelInfo struct {
 	Account string
 	Name    string
 	Key     string
+	Bang    string
 }
 
-const channelColumns = "account,name,key"
-const channelPlacers = "?,?,?"
+const channelColumns = "account,name,key,bang"
+const channelPlacers = "?,?,?,?"
 
 func (ci *channelInfo) refs() []interface{} {
-	return []interface{}{&ci.Account, &ci.Name, &ci.Key}
+	return []interface{}{&ci.Account, &ci.Name, &ci.Key, &ci.Bang}
 }
 
 func startAccountManager(config Config) (*accountManager, error) {
@@ -75,8 +94,10 @@ func startAccountManager(config Config) (*accountManager, error) {
 		clients:  make(map[string]accountClient),
 		requests: make(chan interface{}),
 		incoming: make(chan *Message),
+		status:   make(map[string]*accountStatus),
 	}
 	am.db = config.DB
+	am.stmts = newStmtCache(am.db)
 	am.tomb.Go(am.loop)
 	return am, nil
 }
@@ -87,6 +108,7 @@ func (am *accountManager) Stop() error {
 	logf("Account manager stop requested. Waiting...")
 	am.tomb.Kill(errStop)
 	err := am.tomb.Wait()
+	am.stmts.close()
 	logf("Account manager stopped (%v).", err)
 	if err != errStop {
 		return err
@@ -94,6 +116,37 @@ func (am *accountManager) Stop() error {
 	return nil
 }
 
+// drain waits until the outgoing messages queued for the accounts handled
+// were all confirmed as sent, or until the deadline is reached.
+func (am *accountManager) drain(deadline time.Time) {
+	am.statusMutex.Lock()
+	names := make([]string, 0, len(am.status))
+	for name := range am.status {
+		names = append(names, name)
+	}
+	am.statusMutex.Unlock()
+
+	logf("Waiting for accounts to send pending outgoing messages...")
+	for _, name := range names {
+		for am.tomb.Alive() {
+			var pending int
+			row := am.db.QueryRow("SELECT COUNT(*) FROM message, account WHERE account.name=? AND message.account=account.name AND message.lane=2 AND message.id>account.lastid", name)
+			if err := row.Scan(&pending); err != nil {
+				logf("Cannot count pending outgoing messages: %v", err)
+				return
+			}
+			if pending == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				logf("Account %q did not send %d pending outgoing messages in time. Stopping anyway.", name, pending)
+				return
+			}
+			time.Sleep(drainDelay)
+		}
+	}
+}
+
 type accountRequestRefresh struct{ done chan struct{} }
 
 // Refresh forces reloading all account information from the database.
@@ -103,6 +156,64 @@ func (am *accountManager) Refresh() {
 	<-req.done
 }
 
+// Status returns the state of all accounts currently handled, sorted by name.
+func (am *accountManager) Status() []AccountStatus {
+	am.statusMutex.Lock()
+	defer am.statusMutex.Unlock()
+	result := make([]AccountStatus, 0, len(am.status))
+	for _, s := range am.status {
+		status := s.AccountStatus
+		status.Connected = status.Connected && s.client.Alive()
+		status.Channels = append([]string(nil), status.Channels...)
+		if status.Support != nil {
+			support := *status.Support
+			status.Support = &support
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (am *accountManager) updateStatus(msg *Message) {
+	am.statusMutex.Lock()
+	defer am.statusMutex.Unlock()
+	s, ok := am.status[msg.Account]
+	if !ok {
+		return
+	}
+	// IRC clients only forward messages after being welcomed by the server.
+	s.Connected = true
+	s.LastMessage = time.Now()
+	if msg.AsNick != "" {
+		s.Nick = msg.AsNick
+	}
+	if msg.Command == cmdISupport {
+		if s.Support == nil {
+			s.Support = &ServerSupport{}
+		}
+		s.Support.update(msg)
+	}
+	if msg.Command == cmdJoin || msg.Command == cmdPart {
+		channel := changedChannel(msg)
+		if msg.Nick != msg.AsNick || channel == "" {
+			return
+		}
+		pos := -1
+		for i, ichannel := range s.Channels {
+			if ichannel == channel {
+				pos = i
+				break
+			}
+		}
+		if msg.Command == cmdJoin && pos == -1 {
+			s.Channels = append(s.Channels, channel)
+		} else if msg.Command == cmdPart && pos != -1 {
+			s.Channels = append(s.Channels[:pos], s.Channels[pos+1:]...)
+		}
+	}
+}
+
 func (am *accountManager) die() {
 	pending := len(am.clients)
 	stopped := make(chan bool, pending)
@@ -129,6 +240,7 @@ func (am *accountManager) die() {
 }
 
 func (am *accountManager) loop() error {
+	defer am.releaseLeases()
 	defer am.die()
 
 	if am.config.Accounts != nil && len(am.config.Accounts) == 0 {
@@ -146,7 +258,7 @@ func (am *accountManager) loop() error {
 	for am.tomb.Alive() {
 		select {
 		case msg := <-am.incoming:
-			am.handleIncoming(msg)
+			am.handleIncomingBatch(msg)
 		case req := <-am.requests:
 			switch r := req.(type) {
 			case accountRequestRefresh:
@@ -165,10 +277,16 @@ func (am *accountManager) loop() error {
 }
 
 func (am *accountManager) accountOn(name string) bool {
-	if am.config.Accounts == nil {
+	return accountIn(am.config.Accounts, name)
+}
+
+// accountIn returns whether the named account is handled by a server
+// configured with the provided Config.Accounts value.
+func accountIn(accounts []string, name string) bool {
+	if accounts == nil {
 		return true
 	}
-	for _, cname := range am.config.Accounts {
+	for _, cname := range accounts {
 		if name == cname {
 			return true
 		}
@@ -176,36 +294,106 @@ func (am *accountManager) accountOn(name string) bool {
 	return false
 }
 
-func (am *accountManager) handleIncoming(msg *Message) {
-	if msg.Command == cmdPong {
-		if strings.HasPrefix(msg.Text, "sent:") {
-			lastId, err := strconv.ParseInt(msg.Text[5:], 16, 64)
-			if err != nil || lastId < 0 {
-				logf("cannot extract message ID out of pong text: %q", msg.Text)
-				return
-			}
+// incomingBatchSize and incomingBatchDelay bound how many incoming messages
+// are collected, and for how long, before they're all inserted into the
+// database in a single transaction. This keeps the account manager from
+// falling behind on join floods and busy channels.
+var (
+	incomingBatchSize  = 100
+	incomingBatchDelay = 20 * time.Millisecond
+)
+
+// handleIncomingBatch handles first and any further incoming messages that
+// arrive within incomingBatchDelay, up to incomingBatchSize messages.
+func (am *accountManager) handleIncomingBatch(first *Message) {
+	batch := []*Message{first}
+	timer := time.NewTimer(incomingBatchDelay)
+	defer timer.Stop()
+Collect:
+	for len(batch) < incomingBatchSize {
+		select {
+		case msg := <-am.incoming:
+			batch = append(batch, msg)
+		case <-timer.C:
+			break Collect
+		case <-am.tomb.Dying():
+			break Collect
+		}
+	}
+	am.handleIncoming(batch...)
+}
 
-			_, err = am.db.Exec("UPDATE account SET lastid=? WHERE name=?", lastId, msg.Account)
+func (am *accountManager) handleIncoming(msgs ...*Message) {
+	tx, err := beginImmediate(am.db)
+	if err != nil {
+		logf("Cannot begin database transaction: %v", err)
+		am.tomb.Kill(err)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, msg := range msgs {
+		am.updateStatus(msg)
+		if msg.Command == cmdPong {
+			delivery, err := parseDeliveryPong(msg.Text)
 			if err != nil {
-				logf("Cannot update account with last sent message id: %v", err)
+				logf("%v", err)
+				continue
+			}
+			if delivery != nil {
+				lastId := delivery.Id
+				if queue := am.outQueue(msg.Account); queue != nil {
+					lastId = queue.sentId(lastId)
+				}
+				// Deliveries may be reported out of order, so never
+				// move lastid backwards.
+				_, err = tx.Exec("UPDATE account SET lastid=MAX(lastid,?) WHERE name=?", lastId, msg.Account)
+				if err != nil {
+					logf("Cannot update account with last sent message id: %v", err)
+					am.tomb.Kill(err)
+					return
+				}
+				if delivery.Status == DeliveryFailed {
+					accountLogf(msg.Account, "Cannot deliver message %d: %s", delivery.Id, delivery.Error)
+				}
+				if err := recordDelivery(tx, delivery); err != nil {
+					accountLogf(msg.Account, "%v", err)
+				}
+			}
+		} else {
+			_, err := tx.Exec("INSERT INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
+			if err != nil {
+				logf("Cannot insert incoming message: %v", err)
 				am.tomb.Kill(err)
+				return
+			}
+			if err := trackSession(tx, msg); err != nil {
+				accountLogf(msg.Account, "%v", err)
 			}
-		}
-	} else {
-		_, err := am.db.Exec("INSERT INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
-		if err != nil {
-			logf("Cannot insert incoming message: %v", err)
-			am.tomb.Kill(err)
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		logf("Cannot commit incoming messages: %v", err)
+		am.tomb.Kill(err)
+	}
 }
 
 func beginImmediate(db *sql.DB) (*sql.Tx, error) {
-	tx, err := db.Begin()
-	if err == nil {
+	for i := 0; ; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
 		_, err = tx.Exec("ROLLBACK; BEGIN IMMEDIATE")
+		if err == nil {
+			return tx, nil
+		}
+		tx.Rollback()
+		if !dbBusy(err) || i == len(dbRetryDelays) {
+			return nil, err
+		}
+		time.Sleep(dbRetryDelays[i])
 	}
-	return tx, err
 }
 
 func (am *accountManager) handleRefresh() {
@@ -215,6 +403,15 @@ func (am *accountManager) handleRefresh() {
 		return
 	}
 
+	var instances []shardInstance
+	if am.config.Sharding && (am.config.Accounts == nil || len(am.config.Accounts) > 0) {
+		instances, err = registerInstance(am.db, am.config, "account", am.config.Accounts)
+		if err != nil {
+			logf("Cannot register instance: %v", err)
+			return
+		}
+	}
+
 	// We need to use IMMEDIATE mode here, because inside the same
 	// transaction we SELECT and then UPDATE, and without IMMEDIATE
 	// sqlite will emit unretriable SQLITE_BUSY in that situation to
@@ -243,6 +440,13 @@ func (am *accountManager) handleRefresh() {
 			logf("Cannot parse database account information: %v", err)
 			return
 		}
+		if info.Password, err = decryptSecret(am.config.SecretKey, info.Password); err == nil {
+			info.Config, err = decryptSecret(am.config.SecretKey, info.Config)
+		}
+		if err != nil {
+			logf("Account %q has unusable secrets: %v", info.Name, err)
+			continue
+		}
 		infos = append(infos, info)
 	}
 	rows.Close()
@@ -264,16 +468,39 @@ func (am *accountManager) handleRefresh() {
 	}
 	rows.Close()
 
+	commands, err := accountCommands(tx)
+	if err != nil {
+		logf("Cannot fetch command schemas from the database: %v", err)
+		return
+	}
+
 	good := make(map[string]bool)
+	levels := make(map[string]LogLevel)
 	for i := range infos {
 		info := &infos[i]
 		if !am.accountOn(info.Name) {
 			continue
 		}
+		if am.config.Sharding && instanceOwner(info.Name, instances, accountIn) != am.config.Instance {
+			continue
+		}
 
 		info.Channels = cinfos[info.Name]
+		info.Commands = commands[info.Name]
 
 		good[info.Name] = true
+
+		level, err := ParseLogLevel(info.LogLevel)
+		if err != nil {
+			logf("Account %q has invalid log level: %v", info.Name, err)
+		}
+		levels[info.Name] = level
+	}
+	setLogLevels(levels, nil)
+
+	commit := false
+	if am.config.LeaseTimeout > 0 {
+		commit = am.renewLeases(tx, good)
 	}
 
 	// Drop clients for dead or deleted accounts.
@@ -287,10 +514,12 @@ func (am *accountManager) handleRefresh() {
 		}
 		client.Stop()
 		delete(am.clients, client.AccountName())
+		am.statusMutex.Lock()
+		delete(am.status, client.AccountName())
+		am.statusMutex.Unlock()
 	}
 
 	// Bring new clients up and update existing ones.
-	commit := false
 	for i := range infos {
 		info := &infos[i]
 		if !good[info.Name] {
@@ -309,35 +538,54 @@ func (am *accountManager) handleRefresh() {
 				info.LastId = latestId
 				_, err = tx.Exec("UPDATE account SET lastid=? WHERE name=?", info.LastId, info.Name)
 				if err != nil {
-					logf("Cannot update last ID for account %q: %#v", info.Name, err)
-					var v int
-					tx.QueryRow("PRAGMA busy_timeout").Scan(&v)
-					logf("Pragma: %#v", v)
-
-					println("Panic now:", err.Error())
-					time.Sleep(5 * time.Minute)
+					logf("Cannot update last ID for account %q: %v", info.Name, err)
 					continue
 				}
 				commit = true
 			}
 
+			queue := newOutQueue()
 			switch info.Kind {
 			case "irc", "":
-				client = startIrcClient(info, am.incoming)
+				client = startIrcClient(info, am.incoming, queue)
 			case "telegram":
 				client = startTgClient(info, am.incoming)
 			case "signal":
 				client = startSignalClient(info, am.incoming)
+			case "whatsapp":
+				client = startWhatsAppClient(info, am.incoming)
 			case "webhook":
 				client = startWebHookClient(info, am.incoming)
+			case "email":
+				client = startEmailClient(info, am.incoming)
+			case "console":
+				client = startConsoleClient(info, am.incoming)
 			default:
 				continue
 			}
 
 			am.clients[info.Name] = client
-			go am.tail(client)
+			am.statusMutex.Lock()
+			am.status[info.Name] = &accountStatus{
+				AccountStatus: AccountStatus{
+					Name:       info.Name,
+					Kind:       info.Kind,
+					ConfigNick: info.Nick,
+					// IRC accounts are connected once their first message arrives.
+					Connected: info.Kind != "irc" && info.Kind != "",
+				},
+				client: client,
+				queue:  queue,
+			}
+			am.statusMutex.Unlock()
+			go am.tail(client, queue)
 		} else {
 			client.UpdateInfo(info)
+			am.statusMutex.Lock()
+			if status, ok := am.status[info.Name]; ok {
+				status.ConfigNick = info.Nick
+			}
+			am.statusMutex.Unlock()
 		}
 	}
 
@@ -349,54 +597,154 @@ func (am *accountManager) handleRefresh() {
 	}
 }
 
-func (am *accountManager) tail(client accountClient) error {
+// accountCommands returns the visible commands of the enabled plugins,
+// indexed by the name of the accounts they target. Commands already
+// provided by another plugin targeting the same account are dropped.
+func accountCommands(tx *sql.Tx) (map[string][]schema.Command, error) {
+	byPlugin := make(map[string][]schema.Command)
+	rows, err := tx.Query("SELECT plugin,command,help FROM commandschema WHERE hide=FALSE ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var plugin string
+		var cmd schema.Command
+		if err := rows.Scan(&plugin, &cmd.Name, &cmd.Help); err != nil {
+			return nil, err
+		}
+		byPlugin[plugin] = append(byPlugin[plugin], cmd)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = tx.Query("SELECT DISTINCT target.plugin,target.account FROM target JOIN plugin ON plugin.name=target.plugin ORDER BY target.plugin")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	commands := make(map[string][]schema.Command)
+	seen := make(map[[2]string]bool)
+	for rows.Next() {
+		var plugin, account string
+		if err := rows.Scan(&plugin, &account); err != nil {
+			return nil, err
+		}
+		// Labeled plugins share the schema registered under the plugin
+		// name, unless they define one of their own.
+		cmds, ok := byPlugin[plugin]
+		if !ok {
+			cmds = byPlugin[pluginKey(plugin)]
+		}
+		for _, cmd := range cmds {
+			key := [2]string{account, cmd.Name}
+			if !seen[key] {
+				seen[key] = true
+				commands[account] = append(commands[account], cmd)
+			}
+		}
+	}
+	return commands, rows.Err()
+}
+
+// renewLeases acquires or renews the leases of the accounts in good, and
+// removes from good the accounts leased by other servers. It reports
+// whether the transaction holds changes to be committed.
+func (am *accountManager) renewLeases(tx *sql.Tx, good map[string]bool) bool {
+	now := time.Now().UTC()
+	changed := false
+	for name := range good {
+		var holder string
+		var expires time.Time
+		err := tx.QueryRow("SELECT holder,expires FROM lease WHERE account=?", name).Scan(&holder, &expires)
+		if err != nil && err != sql.ErrNoRows {
+			logf("Cannot fetch lease for account %q: %v", name, err)
+			delete(good, name)
+			continue
+		}
+		if err == nil && holder != am.config.Instance && expires.After(now) {
+			if _, running := am.clients[name]; running {
+				logf("Account %q was taken over by %s.", name, holder)
+			}
+			delete(good, name)
+			continue
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO lease (account,holder,expires) VALUES (?,?,?)", name, am.config.Instance, now.Add(am.config.LeaseTimeout))
+		if err != nil {
+			logf("Cannot renew lease for account %q: %v", name, err)
+			delete(good, name)
+			continue
+		}
+		if holder != "" && holder != am.config.Instance {
+			logf("Taking over account %q from %s.", name, holder)
+		}
+		changed = true
+	}
+	return changed
+}
+
+// releaseLeases releases the account leases held by this server, so that
+// other servers may take over its accounts right away.
+func (am *accountManager) releaseLeases() {
+	if am.config.LeaseTimeout <= 0 {
+		return
+	}
+	_, err := am.db.Exec("DELETE FROM lease WHERE holder=?", am.config.Instance)
+	if err != nil {
+		logf("Cannot release account leases: %v", err)
+	}
+}
+
+// outQueue returns the queue of outgoing messages for the named account,
+// or nil if the account is not running.
+func (am *accountManager) outQueue(name string) *outQueue {
+	am.statusMutex.Lock()
+	defer am.statusMutex.Unlock()
+	if status, ok := am.status[name]; ok {
+		return status.queue
+	}
+	return nil
+}
+
+// tail delivers the outgoing messages for the client account. Messages are
+// retrieved from the database into queue and handed to the client by order
+// of priority, so that replies to users are not stuck behind a long series
+// of broadcasts.
+func (am *accountManager) tail(client accountClient, queue *outQueue) error {
 	lastId := client.LastId()
+	var nextFetch time.Time
 
 	for am.tomb.Alive() && client.Alive() {
 
-		// TODO Prepare this statement.
-
-		// Fetch one message at a time to avoid locking down the database/sql
-		// connection (not the actual database) during the iteration.
-		// since this may be long lived and other
-		// parts of the code will need to
-		rows, err := am.db.Query("SELECT "+messageColumns+" FROM message WHERE id>? AND account=? AND lane=2 ORDER BY id", lastId, client.AccountName())
-		if err != nil {
-			logf("Error retrieving outgoing messages: %v", err)
-		} else {
-			for rows.Next() {
-				var msg Message
-				err := rows.Scan(msg.refs(0)...)
-				if err != nil {
-					logf("Error parsing outgoing messages: %v", err)
-				}
-				debugf("[%s] Tail iterator got outgoing message: %s", msg.Account, msg.String())
-				select {
-				case client.Outgoing() <- &msg:
-					// Send back to plugins for outgoing message handling.
-					// These messages may end up duped when an resend attempt is made for the
-					// outgoing message so that error needs to be ignored. Also, this logic
-					// means we must make sure IDs are unique across incoming and outgoing
-					// so the conflict is indeed for the exact same message, that was already
-					// attempted to be sent before.
-					_, err := am.db.Exec("INSERT OR IGNORE INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
-					if err != nil {
-						logf("[%s] Cannot insert outgoing message for plugin handling: %v", msg.Account, err)
-						am.tomb.Kill(err)
-					}
-					lastId = msg.Id
-				case <-client.Dying():
-					rows.Close()
-					return nil
-				}
-			}
-			err := rows.Close()
-			if err != nil && am.tomb.Alive() {
-				logf("Error iterating over outgoing collection: %v", err)
-			}
+		// Poll the database whenever the queue is empty, and at most
+		// every 100ms while it is being drained.
+		msg := queue.next()
+		if msg == nil || !time.Now().Before(nextFetch) {
+			lastId = am.fetchOutgoing(client, queue, lastId)
+			nextFetch = time.Now().Add(100 * time.Millisecond)
+			msg = queue.next()
 		}
 
+		var outgoing chan *Message
+		if msg != nil {
+			outgoing = client.Outgoing()
+		}
 		select {
+		case outgoing <- msg:
+			queue.done(msg)
+			// Send back to plugins for outgoing message handling.
+			// These messages may end up duped when an resend attempt is made for the
+			// outgoing message so that error needs to be ignored. Also, this logic
+			// means we must make sure IDs are unique across incoming and outgoing
+			// so the conflict is indeed for the exact same message, that was already
+			// attempted to be sent before.
+			_, err := dbExec(am.db, "INSERT OR IGNORE INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
+			if err != nil {
+				accountLogf(msg.Account, "Cannot insert outgoing message for plugin handling: %v", err)
+				am.tomb.Kill(err)
+			}
 		case <-time.After(100 * time.Millisecond):
 		case <-am.tomb.Dying():
 			return nil
@@ -406,3 +754,39 @@ func (am *accountManager) tail(client accountClient) error {
 	}
 	return nil
 }
+
+// fetchOutgoing adds to queue the outgoing messages for the client account
+// with ids above lastId, and returns the id of the last message added.
+func (am *accountManager) fetchOutgoing(client accountClient, queue *outQueue, lastId int64) int64 {
+	// Read all rows before queueing to avoid locking down the database/sql
+	// connection (not the actual database) for long.
+	var rows *sql.Rows
+	stmt, err := am.stmts.prepare("SELECT " + messageColumns + " FROM message WHERE id>? AND account=? AND lane=2 ORDER BY id")
+	if err == nil {
+		rows, err = stmt.Query(lastId, client.AccountName())
+	}
+	if err != nil {
+		logf("Error retrieving outgoing messages: %v", err)
+		return lastId
+	}
+	var msgs []*Message
+	for rows.Next() {
+		var msg Message
+		err := rows.Scan(msg.refs(0)...)
+		if err != nil {
+			logf("Error parsing outgoing messages: %v", err)
+			continue
+		}
+		accountDebugf(msg.Account, "Tail iterator got outgoing message: %s", msg.String())
+		msgs = append(msgs, &msg)
+	}
+	err = rows.Close()
+	if err != nil && am.tomb.Alive() {
+		logf("Error iterating over outgoing collection: %v", err)
+	}
+	for _, msg := range msgs {
+		queue.push(msg)
+		lastId = msg.Id
+	}
+	return lastId
+}
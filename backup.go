@@ -0,0 +1,165 @@
+package mup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// BackupDB writes a consistent snapshot of db into a new SQLite database
+// at filename, using the SQLite online backup API so that the database
+// may be in use while the backup is taken. The snapshot is first written
+// into a temporary file in the same directory and then renamed, so
+// filename never holds a partial backup.
+func BackupDB(db *sql.DB, filename string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return fmt.Errorf("cannot create backup file: %v", err)
+	}
+	tmpname := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpname)
+
+	if err := backupDB(db, tmpname); err != nil {
+		return fmt.Errorf("cannot backup database: %v", err)
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		return fmt.Errorf("cannot create backup file: %v", err)
+	}
+	return nil
+}
+
+func backupDB(db *sql.DB, filename string) error {
+	destDB, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	ctx := context.Background()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			dest, ok1 := destRaw.(*sqlite3.SQLiteConn)
+			src, ok2 := srcRaw.(*sqlite3.SQLiteConn)
+			if !ok1 || !ok2 {
+				return fmt.Errorf("database is not using the sqlite3 driver")
+			}
+			backup, err := dest.Backup("main", src, "main")
+			if err != nil {
+				return err
+			}
+			done, err := backup.Step(-1)
+			if err == nil && !done {
+				err = fmt.Errorf("backup did not complete")
+			}
+			if ferr := backup.Finish(); err == nil {
+				err = ferr
+			}
+			return err
+		})
+	})
+}
+
+// backupDelay defines how often the backup loop checks whether a new
+// automatic backup is due. See Config.BackupInterval.
+var backupDelay = time.Minute
+
+// backupPrefix and backupSuffix surround the time in the names of the
+// files holding automatic backups.
+const (
+	backupPrefix = "mup-"
+	backupSuffix = ".db"
+	backupLayout = "20060102-150405"
+)
+
+func (st *Server) backupLoop() {
+	defer close(st.backupDone)
+	for {
+		st.backup()
+		select {
+		case <-time.After(backupDelay):
+		case <-st.backupStop:
+			return
+		}
+	}
+}
+
+// backup writes a new automatic backup if the last one is older than the
+// configured interval, and removes the ones beyond the configured count.
+func (st *Server) backup() {
+	dir := st.config.BackupDir
+	names, err := backupNames(dir)
+	if err != nil {
+		logf("Cannot list backups: %v", err)
+		return
+	}
+	now := time.Now().UTC()
+	if len(names) > 0 {
+		last, err := time.Parse(backupLayout, strings.TrimSuffix(strings.TrimPrefix(names[len(names)-1], backupPrefix), backupSuffix))
+		if err == nil && now.Sub(last) < st.config.BackupInterval {
+			return
+		}
+	}
+	name := backupPrefix + now.Format(backupLayout) + backupSuffix
+	if err := BackupDB(st.config.DB, filepath.Join(dir, name)); err != nil {
+		logf("Cannot write automatic backup: %v", err)
+		return
+	}
+	logf("Database backed up into %s.", filepath.Join(dir, name))
+	names = append(names, name)
+	if st.config.BackupKeep <= 0 {
+		return
+	}
+	for len(names) > st.config.BackupKeep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			logf("Cannot remove old backup: %v", err)
+			return
+		}
+		debugf("Removed old backup %s.", names[0])
+		names = names[1:]
+	}
+}
+
+// backupNames returns the names of the automatic backups in dir, from
+// oldest to newest.
+func backupNames(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		if _, err := time.Parse(backupLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix)); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,64 @@
+package mup
+
+import (
+	"strings"
+	"sync"
+)
+
+// bangPrefixes holds the bang prefixes that address commands to mup in
+// an account and in each of its channels, as defined by the bang column
+// of the account and channel tables. The account kind's default prefix
+// is used where neither defines one.
+//
+// The prefixes are shared between an account client and its reader, so
+// that changes apply to incoming messages without reconnecting.
+type bangPrefixes struct {
+	mu       sync.Mutex
+	fallback string
+	account  string
+	channels map[string]string
+}
+
+func newBangPrefixes(fallback string, info *accountInfo) *bangPrefixes {
+	b := &bangPrefixes{fallback: fallback}
+	b.update(info)
+	return b
+}
+
+// update sets the prefixes defined by the account information.
+func (b *bangPrefixes) update(info *accountInfo) {
+	channels := make(map[string]string)
+	for _, ci := range info.Channels {
+		if ci.Bang != "" {
+			channels[strings.ToLower(ci.Name)] = ci.Bang
+		}
+	}
+	b.mu.Lock()
+	b.account = info.Bang
+	b.channels = channels
+	b.mu.Unlock()
+}
+
+// bang returns the bang prefix in use in channel, or the account one if
+// channel is empty or has no prefix of its own.
+func (b *bangPrefixes) bang(channel string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bang, ok := b.channels[strings.ToLower(channel)]; ok && channel != "" {
+		return bang
+	}
+	if b.account != "" {
+		return b.account
+	}
+	return b.fallback
+}
+
+// parseIncoming parses line as done by ParseIncoming, with the bang
+// prefix in use in the channel the message was received in.
+func (b *bangPrefixes) parseIncoming(account, asnick, line string) *Message {
+	msg := ParseIncoming(account, asnick, b.bang(""), line)
+	if bang := b.bang(msg.Channel); bang != msg.Bang && asnick != "" && msg.Command == cmdPrivMsg {
+		msg.setBang(bang)
+	}
+	return msg
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/mup.v0"
+)
+
+// dbName is the name of the database file in the data directory.
+const dbName = "mup.db"
+
+// sqliteHeader starts every SQLite database file, and allows restore to
+// tell apart the plain database files written by automatic backups from
+// the archives written by the backup command.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// backup writes into filename a gzipped tar archive holding a consistent
+// snapshot of the database, and the configuration file if there's one.
+func backup(filename string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tmpdir, err := ioutil.TempDir("", "mup-backup-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	files := []string{filepath.Join(tmpdir, dbName)}
+	if err := mup.BackupDB(db, files[0]); err != nil {
+		return err
+	}
+	configPath := filepath.Join(*dbdir, configName)
+	if _, err := os.Stat(configPath); err == nil {
+		files = append(files, configPath)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot read configuration: %v", err)
+	}
+	return writeArchive(filename, files)
+}
+
+// writeArchive writes the provided files into a gzipped tar archive at
+// filename, under their base names.
+func writeArchive(filename string, files []string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return fmt.Errorf("cannot create backup file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	for _, path := range files {
+		if err := addToArchive(tw, path); err != nil {
+			return fmt.Errorf("cannot write backup file: %v", err)
+		}
+	}
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write backup file: %v", err)
+	}
+	return nil
+}
+
+func addToArchive(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(path)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// restore replaces the database, and the configuration file if the backup
+// holds one, with the content of the backup at filename. The backup may
+// be either an archive written by the backup command, or a database file
+// written by the automatic backups of the server. No server may be using
+// the database while it's restored.
+func restore(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open backup file: %v", err)
+	}
+	defer f.Close()
+
+	dir := dataDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create data directory: %v", err)
+	}
+
+	// Extract everything next to the files being replaced first,
+	// so that a broken backup leaves the current ones untouched.
+	var restored []string
+	defer func() {
+		for _, name := range restored {
+			os.Remove(filepath.Join(dir, "."+name+".restore"))
+		}
+	}()
+	extract := func(name string, r io.Reader) error {
+		out, err := os.OpenFile(filepath.Join(dir, "."+name+".restore"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("cannot restore %s: %v", name, err)
+		}
+		restored = append(restored, name)
+		_, err = io.Copy(out, r)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("cannot restore %s: %v", name, err)
+		}
+		return nil
+	}
+
+	br := bufio.NewReader(f)
+	header, _ := br.Peek(len(sqliteHeader))
+	if bytes.Equal(header, sqliteHeader) {
+		if err := extract(dbName, br); err != nil {
+			return err
+		}
+	} else {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("cannot read backup file: %v", err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("cannot read backup file: %v", err)
+			}
+			if header.Name != dbName && header.Name != configName {
+				return fmt.Errorf("unexpected file in backup: %s", header.Name)
+			}
+			if err := extract(header.Name, tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	hasDB := false
+	for _, name := range restored {
+		hasDB = hasDB || name == dbName
+	}
+	if !hasDB {
+		return fmt.Errorf("backup file has no database")
+	}
+	if err := mup.WipeDB(dir); err != nil {
+		return fmt.Errorf("cannot remove current database: %v", err)
+	}
+	for _, name := range restored {
+		if err := os.Rename(filepath.Join(dir, "."+name+".restore"), filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("cannot restore %s: %v", name, err)
+		}
+	}
+
+	// Opening the database validates it and updates its schema.
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+)
+
+// configName is the name of the optional configuration file read from
+// the data directory at startup and again on SIGHUP.
+const configName = "mup.toml"
+
+// fileConfig holds the settings defined in the configuration file.
+// The file holds one "key = value" setting per line in the TOML syntax,
+// with string values quoted, lists of strings within brackets, integers
+// in decimal, and booleans as true or false:
+//
+//	loglevel = "debug"
+//	http = "localhost:8080"
+//	http-url = "https://mup.example.com"
+//	stream-token = "s3cr3t"
+//	refresh = "10s"
+//	stop-timeout = "5s"
+//	retention = "720h"
+//	instance = "host1"
+//	lease-timeout = "1m"
+//	sharding = true
+//	backup-dir = "/var/backups/mup"
+//	backup-interval = "24h"
+//	backup-keep = 7
+//	accounts = ["freenode", "telegram"]
+//	plugins = ["echo", "help"]
+//
+// Options provided in the command line take precedence over the file.
+type fileConfig struct {
+	LogLevel       mup.LogLevel
+	HTTPAddr       string
+	HTTPURL        string
+	StreamToken    string
+	Refresh        time.Duration
+	StopTimeout    time.Duration
+	Retention      time.Duration
+	Instance       string
+	LeaseTimeout   time.Duration
+	Sharding       bool
+	BackupDir      string
+	BackupInterval time.Duration
+	BackupKeep     int
+
+	// Accounts and Plugins are nil when the file does not limit them.
+	Accounts []string
+	Plugins  []string
+}
+
+// readConfig returns the settings in the configuration file at path,
+// or an empty configuration if the file does not exist.
+func readConfig(path string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &fileConfig{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read configuration: %v", err)
+	}
+	config, err := parseConfig(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return config, nil
+}
+
+// parseConfig returns the settings defined in data.
+// Errors are prefixed by the line number they refer to.
+func parseConfig(data string) (*fileConfig, error) {
+	p := &configParser{data: data, line: 1}
+	var config fileConfig
+	seen := make(map[string]bool)
+	for {
+		p.skip(true)
+		if p.pos == len(p.data) {
+			break
+		}
+		line := p.line
+		key := p.key()
+		if key == "" {
+			return nil, p.errorf("expected setting name")
+		}
+		p.skip(false)
+		if !p.consume('=') {
+			return nil, p.errorf("expected '=' after %s", key)
+		}
+		p.skip(false)
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		if p.pos < len(p.data) && p.data[p.pos] != '\n' {
+			return nil, p.errorf("unexpected content after %s value", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%d: %s defined more than once", line, key)
+		}
+		seen[key] = true
+		if err := config.set(key, value); err != nil {
+			return nil, fmt.Errorf("%d: %v", line, err)
+		}
+	}
+	return &config, nil
+}
+
+func (c *fileConfig) set(key string, value interface{}) error {
+	var err error
+	switch key {
+	case "loglevel":
+		var s string
+		if s, err = stringValue(key, value); err == nil {
+			c.LogLevel, err = mup.ParseLogLevel(s)
+		}
+	case "http":
+		c.HTTPAddr, err = stringValue(key, value)
+	case "http-url":
+		c.HTTPURL, err = stringValue(key, value)
+	case "stream-token":
+		c.StreamToken, err = stringValue(key, value)
+	case "refresh":
+		c.Refresh, err = durationValue(key, value)
+	case "stop-timeout":
+		c.StopTimeout, err = durationValue(key, value)
+	case "retention":
+		c.Retention, err = durationValue(key, value)
+	case "instance":
+		c.Instance, err = stringValue(key, value)
+	case "lease-timeout":
+		c.LeaseTimeout, err = durationValue(key, value)
+	case "sharding":
+		c.Sharding, err = boolValue(key, value)
+	case "backup-dir":
+		c.BackupDir, err = stringValue(key, value)
+	case "backup-interval":
+		c.BackupInterval, err = durationValue(key, value)
+	case "backup-keep":
+		c.BackupKeep, err = intValue(key, value)
+	case "accounts":
+		c.Accounts, err = listValue(key, value)
+	case "plugins":
+		c.Plugins, err = listValue(key, value)
+	default:
+		return fmt.Errorf("unknown setting: %s", key)
+	}
+	return err
+}
+
+func stringValue(key string, value interface{}) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return s, nil
+}
+
+func boolValue(key string, value interface{}) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s must be true or false", key)
+	}
+	return b, nil
+}
+
+func intValue(key string, value interface{}) (int, error) {
+	i, ok := value.(int)
+	if !ok {
+		return 0, fmt.Errorf("%s must be an integer", key)
+	}
+	return i, nil
+}
+
+func durationValue(key string, value interface{}) (time.Duration, error) {
+	s, err := stringValue(key, value)
+	if err != nil {
+		return 0, err
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s duration: %q", key, s)
+	}
+	return d, nil
+}
+
+func listValue(key string, value interface{}) ([]string, error) {
+	list, ok := value.([]string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of strings", key)
+	}
+	return list, nil
+}
+
+// configParser parses the subset of TOML that configuration files use.
+type configParser struct {
+	data string
+	pos  int
+	line int
+}
+
+func (p *configParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skip skips spaces and comments, and also line breaks if newlines is true.
+func (p *configParser) skip(newlines bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '\n' && newlines:
+			p.line++
+		case c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *configParser) consume(c byte) bool {
+	if p.pos < len(p.data) && p.data[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *configParser) key() string {
+	start := p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			break
+		}
+		p.pos++
+	}
+	return p.data[start:p.pos]
+}
+
+// value parses a string, a list of strings, an integer, or a boolean.
+func (p *configParser) value() (interface{}, error) {
+	for _, b := range []bool{true, false} {
+		word := strconv.FormatBool(b)
+		if strings.HasPrefix(p.data[p.pos:], word) {
+			p.pos += len(word)
+			return b, nil
+		}
+	}
+	start := p.pos
+	p.consume('-')
+	for p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos > start && p.data[p.pos-1] != '-' {
+		i, err := strconv.Atoi(p.data[start:p.pos])
+		if err != nil {
+			return nil, p.errorf("invalid integer: %s", p.data[start:p.pos])
+		}
+		return i, nil
+	}
+	p.pos = start
+	if p.consume('[') {
+		list := []string{}
+		for {
+			p.skip(true)
+			if p.consume(']') {
+				return list, nil
+			}
+			s, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, s)
+			p.skip(true)
+			if p.consume(']') {
+				return list, nil
+			}
+			if !p.consume(',') {
+				return nil, p.errorf("expected ',' or ']' in list")
+			}
+		}
+	}
+	return p.str()
+}
+
+// str parses a basic string in double quotes or a literal string in
+// single quotes.
+func (p *configParser) str() (string, error) {
+	if p.pos == len(p.data) || p.data[p.pos] != '"' && p.data[p.pos] != '\'' {
+		return "", p.errorf("expected quoted string, list of strings, integer, or boolean")
+	}
+	quote := p.data[p.pos]
+	start := p.pos
+	for p.pos++; p.pos < len(p.data); p.pos++ {
+		c := p.data[p.pos]
+		if c == '\n' {
+			break
+		}
+		if c == '\\' && quote == '"' {
+			p.pos++
+			continue
+		}
+		if c == quote {
+			p.pos++
+			if quote == '\'' {
+				return p.data[start+1 : p.pos-1], nil
+			}
+			s, err := strconv.Unquote(p.data[start:p.pos])
+			if err != nil {
+				return "", p.errorf("invalid string: %s", p.data[start:p.pos])
+			}
+			return s, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// mergeConfig returns the server configuration and log level defined by
+// the configuration file, with the options explicitly provided in the
+// command line taking precedence.
+func mergeConfig(fconfig *fileConfig, set map[string]bool) (mup.Config, mup.LogLevel) {
+	config := mup.Config{
+		Refresh:        fconfig.Refresh,
+		Accounts:       fconfig.Accounts,
+		Plugins:        fconfig.Plugins,
+		StopTimeout:    fconfig.StopTimeout,
+		HTTPAddr:       fconfig.HTTPAddr,
+		HTTPURL:        fconfig.HTTPURL,
+		StreamToken:    fconfig.StreamToken,
+		Retention:      fconfig.Retention,
+		Instance:       fconfig.Instance,
+		LeaseTimeout:   fconfig.LeaseTimeout,
+		Sharding:       fconfig.Sharding,
+		BackupDir:      fconfig.BackupDir,
+		BackupInterval: fconfig.BackupInterval,
+		BackupKeep:     fconfig.BackupKeep,
+	}
+	level := fconfig.LogLevel
+	if set["debug"] {
+		if *debug {
+			level = mup.LogDebug
+		} else {
+			level = mup.LogInfo
+		}
+	}
+	if set["accounts"] || set["no-accounts"] {
+		config.Accounts = splitList(*accounts)
+	}
+	if set["plugins"] || set["no-plugins"] {
+		config.Plugins = splitList(*plugins)
+	}
+	if set["http"] {
+		config.HTTPAddr = *httpaddr
+	}
+	if set["http-url"] {
+		config.HTTPURL = *httpurl
+	}
+	if set["stop-timeout"] {
+		config.StopTimeout = *stoptimeout
+	}
+	return config, level
+}
+
+// splitList returns the comma-separated names in list, or nil if list
+// is "*" for all names.
+func splitList(list string) []string {
+	if list == "*" {
+		return nil
+	}
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
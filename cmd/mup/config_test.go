@@ -0,0 +1,110 @@
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+var _ = Suite(&ConfigSuite{})
+
+type ConfigSuite struct{}
+
+var parseConfigTests = []struct {
+	data   string
+	config *fileConfig
+	err    string
+}{{
+	data:   "",
+	config: &fileConfig{},
+}, {
+	data: "# Comment.\n" +
+		"loglevel = \"debug\"\n" +
+		"http = 'localhost:8080' # Listener.\n" +
+		"http-url = \"https://example.com/\\u00e9\"\n" +
+		"stream-token = \"s3cr3t\"\n" +
+		"refresh = \"10s\"\n" +
+		"stop-timeout = \"5s\"\n" +
+		"retention = \"720h\"\n" +
+		"instance = \"host1\"\n" +
+		"lease-timeout = \"1m\"\n" +
+		"sharding = true\n" +
+		"backup-dir = \"/backups\"\n" +
+		"backup-interval = \"12h\"\n" +
+		"backup-keep = 7\n" +
+		"accounts = [\"one\", \"two\"]\n" +
+		"plugins = [\n\t\"echo\", # Comment.\n\t\"help\",\n]\n",
+	config: &fileConfig{
+		LogLevel:       mup.LogDebug,
+		HTTPAddr:       "localhost:8080",
+		HTTPURL:        "https://example.com/é",
+		StreamToken:    "s3cr3t",
+		Refresh:        10 * time.Second,
+		StopTimeout:    5 * time.Second,
+		Retention:      720 * time.Hour,
+		Instance:       "host1",
+		LeaseTimeout:   time.Minute,
+		Sharding:       true,
+		BackupDir:      "/backups",
+		BackupInterval: 12 * time.Hour,
+		BackupKeep:     7,
+		Accounts:       []string{"one", "two"},
+		Plugins:        []string{"echo", "help"},
+	},
+}, {
+	data:   "accounts = []",
+	config: &fileConfig{Accounts: []string{}},
+}, {
+	data: "\nunknown = \"value\"",
+	err:  `2: unknown setting: unknown`,
+}, {
+	data: "loglevel = \"loud\"",
+	err:  `1: unknown log level: "loud"`,
+}, {
+	data: "refresh = \"often\"",
+	err:  `1: invalid refresh duration: "often"`,
+}, {
+	data: "accounts = \"one\"",
+	err:  `1: accounts must be a list of strings`,
+}, {
+	data: "http = [\"a\"]",
+	err:  `1: http must be a string`,
+}, {
+	data: "http = localhost",
+	err:  `1: expected quoted string, list of strings, integer, or boolean`,
+}, {
+	data: "backup-keep = \"7\"",
+	err:  `1: backup-keep must be an integer`,
+}, {
+	data: "backup-keep = 99999999999999999999",
+	err:  `1: invalid integer: 99999999999999999999`,
+}, {
+	data: "sharding = \"yes\"",
+	err:  `1: sharding must be true or false`,
+}, {
+	data: "http = \"localhost",
+	err:  `1: unterminated string`,
+}, {
+	data: "http \"localhost\"",
+	err:  `1: expected '=' after http`,
+}, {
+	data: "http = \"a\" \"b\"",
+	err:  `1: unexpected content after http value`,
+}, {
+	data: "http = \"a\"\nhttp = \"b\"",
+	err:  `2: http defined more than once`,
+}}
+
+func (s *ConfigSuite) TestParseConfig(c *C) {
+	for _, test := range parseConfigTests {
+		c.Logf("Data: %q", test.data)
+		config, err := parseConfig(test.data)
+		if test.err != "" {
+			c.Assert(err, ErrorMatches, test.err)
+		} else {
+			c.Assert(err, IsNil)
+			c.Assert(config, DeepEquals, test.config)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
-	"strings"
+	"path/filepath"
+	"reflect"
 	"syscall"
 
 	"gopkg.in/mup.v0"
@@ -21,8 +24,55 @@ var noaccounts = flag.Bool("no-accounts", false, "Do not connect to accounts in
 var plugins = flag.String("plugins", "*", "Configured plugin names to run, comma-separated. Defaults to all.")
 var noplugins = flag.Bool("no-plugins", false, "Do not run plugins in this instance.")
 var debug = flag.Bool("debug", false, "Print debugging messages as well.")
+var httpaddr = flag.String("http", "", "Address for the HTTP server exposing /healthz, and all message content at /stream if stream-token is configured. Disabled if empty.")
+var httpurl = flag.String("http-url", "", "Public URL of the HTTP server, used in links to pasted content.")
+var stoptimeout = flag.Duration("stop-timeout", 0, "How long to wait on shutdown for queued messages to be handled and sent.")
+var keyfile = flag.String("key-file", "", "File holding the key for secrets encrypted in the database. Defaults to $MUPKEY.")
+var newkeyfile = flag.String("new-key-file", "", "File holding the new key for rotate-key. Defaults to $MUPNEWKEY.")
 
 var help = `Usage: mup [options]
+       mup [options] rotate-key
+       mup [options] wipe-plugin <name>
+       mup [options] backup <file>
+       mup [options] restore <file>
+       mup [options] replay -plugin <name> [-from <time>] [-to <time>] ...
+
+Settings may also be defined in the mup.toml file in the data directory,
+which is read at startup and again when SIGHUP is received. Options
+provided in the command line take precedence over the file. For example:
+
+    loglevel = "info"
+    http = "localhost:8080"
+    refresh = "10s"
+    retention = "720h"
+    backup-dir = "/var/backups/mup"
+    backup-interval = "24h"
+    backup-keep = 7
+    accounts = ["freenode"]
+    plugins = ["echo", "help"]
+
+The rotate-key command re-encrypts the secrets in the database, such as
+account passwords and plugin configurations, with the new key. Secrets
+still in plaintext are encrypted as well, and if no new key is provided
+all secrets are decrypted and stored in plaintext.
+
+Keys hold 32 bytes encoded in hexadecimal or base64.
+
+The wipe-plugin command drops the database tables owned by the named
+plugin, so that it starts afresh. The plugin should not be running.
+
+The backup command writes into file a consistent snapshot of the
+database, taken while mup may be running, along with the mup.toml file.
+The restore command replaces the database and mup.toml with the content
+of such a file, or of a database file written by the automatic backups
+enabled via backup-dir. Mup must not be running while restoring.
+
+The replay command feeds the incoming messages stored in the database
+through a sandboxed instance of the named plugin, and prints them along
+with the replies the plugin would send. Nothing is actually sent, and
+changes made by the plugin to the database are discarded. Times are in
+the "2006-01-02 15:04" format, or durations ago as in "24h". See
+"mup replay -h" for all replay options.
 
 Options:
 
@@ -36,12 +86,25 @@ func main() {
 
 	flag.Parse()
 
-	if len(flag.Args()) > 0 {
+	var err error
+	switch args := flag.Args(); {
+	case len(args) == 0:
+		err = run()
+	case len(args) == 1 && args[0] == "rotate-key":
+		err = rotateKey()
+	case len(args) == 2 && args[0] == "wipe-plugin":
+		err = wipePlugin(args[1])
+	case len(args) == 2 && args[0] == "backup":
+		err = backup(args[1])
+	case len(args) == 2 && args[0] == "restore":
+		err = restore(args[1])
+	case len(args) > 0 && args[0] == "replay":
+		err = replay(args[1:])
+	default:
 		flag.Usage()
 		os.Exit(1)
 	}
-
-	if err := run(); err != nil {
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
@@ -52,8 +115,6 @@ func run() error {
 	mup.SetLogger(logger)
 	mup.SetDebug(*debug)
 
-	var config mup.Config
-
 	if *noaccounts {
 		if *accounts != "*" {
 			return fmt.Errorf("cannot use -accounts and -no-accounts together")
@@ -66,33 +127,147 @@ func run() error {
 		}
 		*plugins = ""
 	}
-	if *accounts != "*" {
-		config.Accounts = strings.Split(*accounts, ",")
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	key, err := readKey(*keyfile, "MUPKEY")
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(*dbdir, configName)
+	fconfig, err := readConfig(configPath)
+	if err != nil {
+		return err
 	}
-	if *plugins != "*" {
-		config.Plugins = strings.Split(*plugins, ",")
+	config, level := mergeConfig(fconfig, set)
+	config.DB = db
+	config.SecretKey = key
+	setLogLevel(logger, level)
+
+	server, err := mup.Start(&config)
+	if err != nil {
+		return err
 	}
 
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		fconfig, err := readConfig(configPath)
+		if err != nil {
+			logger.Printf("Cannot reload configuration: %v", err)
+			continue
+		}
+		newConfig, level := mergeConfig(fconfig, set)
+		newConfig.DB = db
+		newConfig.SecretKey = key
+		setLogLevel(logger, level)
+		if reflect.DeepEqual(newConfig, config) {
+			logger.Printf("Configuration reloaded.")
+			continue
+		}
+		logger.Printf("Configuration reloaded. Restarting server.")
+		if err := server.Stop(); err != nil {
+			logger.Printf("Error stopping server: %v", err)
+		}
+		server, err = mup.Start(&newConfig)
+		if err != nil {
+			logger.Printf("Cannot start server with new configuration: %v", err)
+			server, err = mup.Start(&config)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		config = newConfig
+	}
+	return server.Stop()
+}
+
+// setLogLevel configures logging to happen via logger as verbosely
+// as defined by level.
+func setLogLevel(logger *log.Logger, level mup.LogLevel) {
+	if level == mup.LogQuiet {
+		mup.SetLogger(nil)
+	} else {
+		mup.SetLogger(logger)
+	}
+	mup.SetDebug(level == mup.LogDebug)
+}
+
+// dataDir returns the data directory, defined by the -db option
+// or by $MUPDB.
+func dataDir() string {
 	envdb := os.Getenv("MUPDB")
 	if *dbdir == defaultDir && envdb != "" {
 		*dbdir = envdb
 	}
+	return *dbdir
+}
 
-	db, err := mup.OpenDB(*dbdir)
+func openDB() (*sql.DB, error) {
+	dir := dataDir()
+	db, err := mup.OpenDB(dir)
 	if err != nil {
-		return fmt.Errorf("cannot open %q: %v", *dbdir, err)
+		return nil, fmt.Errorf("cannot open %q: %v", dir, err)
 	}
+	return db, nil
+}
 
-	config.DB = db
+// readKey returns the secret key held in the named file, or in the
+// provided environment variable if filename is empty. The result is
+// nil if neither is set.
+func readKey(filename, envname string) ([]byte, error) {
+	data := os.Getenv(envname)
+	if filename != "" {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key: %v", err)
+		}
+		data = string(content)
+	} else if data == "" {
+		return nil, nil
+	}
+	key, err := mup.ParseSecretKey(data)
+	if err != nil {
+		if filename != "" {
+			return nil, fmt.Errorf("invalid key in %s: %v", filename, err)
+		}
+		return nil, fmt.Errorf("invalid key in $%s: %v", envname, err)
+	}
+	return key, nil
+}
 
-	server, err := mup.Start(&config)
+func rotateKey() error {
+	oldKey, err := readKey(*keyfile, "MUPKEY")
+	if err != nil {
+		return err
+	}
+	newKey, err := readKey(*newkeyfile, "MUPNEWKEY")
+	if err != nil {
+		return err
+	}
+	db, err := openDB()
 	if err != nil {
 		return err
 	}
+	defer db.Close()
+	return mup.RotateSecretKey(db, oldKey, newKey)
+}
 
-	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Interrupt)
-	signal.Notify(ch, syscall.Signal(15)) // SIGTERM
-	<-ch
-	return server.Stop()
+func wipePlugin(name string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return mup.WipePluginDB(db, name)
 }
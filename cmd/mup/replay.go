@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/mup.v0"
+)
+
+// replay feeds stored messages through a sandboxed instance of a plugin,
+// as defined by the options in args. See mup.Replay for details.
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	plugin := fs.String("plugin", "", "Name of the plugin to replay messages through.")
+	from := fs.String("from", "", "Replay messages received since the given time or duration ago.")
+	to := fs.String("to", "", "Replay messages received before the given time or duration ago.")
+	account := fs.String("account", "", "Replay only messages received in the given account.")
+	channel := fs.String("channel", "", "Replay only messages received in the given channel.")
+	wait := fs.Duration("wait", 0, "How long to wait for asynchronous replies after each message.")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if *plugin == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: mup [options] replay -plugin <name> [-from <time>] [-to <time>] [-account <name>] [-channel <name>]")
+	}
+
+	now := time.Now()
+	opts := mup.ReplayOptions{
+		Plugin:  *plugin,
+		Account: *account,
+		Channel: *channel,
+		Wait:    *wait,
+	}
+	var err error
+	if opts.From, err = parseReplayTime(*from, now); err != nil {
+		return err
+	}
+	if opts.To, err = parseReplayTime(*to, now); err != nil {
+		return err
+	}
+	if opts.SecretKey, err = readKey(*keyfile, "MUPKEY"); err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return mup.Replay(db, &opts, os.Stdout)
+}
+
+// replayTimeLayouts holds the layouts accepted for times in replay options,
+// which are interpreted in the local timezone unless they define one.
+var replayTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseReplayTime parses s as a time in one of replayTimeLayouts, or as a
+// duration before now. The zero time is returned if s is empty.
+func parseReplayTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range replayTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time or duration: %q", s)
+}
@@ -0,0 +1,316 @@
+package mup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// consoleClient implements console accounts, which connect to nothing and
+// are meant for staging plugin configurations. Outgoing messages are logged
+// and written to the console instead of being sent anywhere, and incoming
+// messages are typed in the console, one per line, in the form:
+//
+//	[#channel] [<nick>] text
+//
+// A message without a channel is sent privately to the bot, and a message
+// without a nick is sent by the "console" nick. The console is the standard
+// input and output of the process if the account endpoint is empty or "-",
+// or connections to the UNIX socket at the endpoint path otherwise, as in:
+//
+//	socat - UNIX-CONNECT:/run/mup/console.sock
+//
+// Outgoing messages are written to all connections to the socket.
+type consoleClient struct {
+	accountName string
+
+	dying    <-chan struct{}
+	info     accountInfo
+	bangs    *bangPrefixes
+	tomb     tomb.Tomb
+	listener net.Listener
+
+	requests chan interface{}
+
+	lines    chan string
+	incoming chan *Message
+	outgoing chan *Message
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func (c *consoleClient) AccountName() string     { return c.accountName }
+func (c *consoleClient) Dying() <-chan struct{}  { return c.dying }
+func (c *consoleClient) Outgoing() chan *Message { return c.outgoing }
+func (c *consoleClient) LastId() int64           { return c.info.LastId }
+
+func startConsoleClient(info *accountInfo, incoming chan *Message) accountClient {
+	c := &consoleClient{
+		accountName: info.Name,
+
+		info:     *info,
+		bangs:    newBangPrefixes("!", info),
+		requests: make(chan interface{}, 1),
+		lines:    make(chan string),
+		incoming: incoming,
+		outgoing: make(chan *Message),
+		conns:    make(map[net.Conn]bool),
+	}
+	c.dying = c.tomb.Dying()
+	c.tomb.Go(c.run)
+	return c
+}
+
+func (c *consoleClient) Alive() bool {
+	return c.tomb.Alive()
+}
+
+func (c *consoleClient) Stop() error {
+	c.tomb.Kill(errStop)
+	err := c.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+// UpdateInfo updates the account information. Everything but
+// the account name may be updated.
+func (c *consoleClient) UpdateInfo(info *accountInfo) {
+	if info.Name != c.accountName {
+		panic("cannot change the account name")
+	}
+	// Make a copy as its use will continue after returning to the caller.
+	infoCopy := *info
+	select {
+	case c.requests <- ireqUpdateInfo(&infoCopy):
+	case <-c.dying:
+	}
+}
+
+func (c *consoleClient) stdin() bool {
+	return c.info.Endpoint == "" || c.info.Endpoint == "-"
+}
+
+// startInput starts reading lines from the console defined by the
+// account endpoint into c.lines.
+func (c *consoleClient) startInput() error {
+	if c.stdin() {
+		consoleStdinOnce.Do(func() { go readConsoleStdin() })
+		return nil
+	}
+	path := c.info.Endpoint
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("cannot listen on console socket: %v", err)
+	}
+	c.listener = l
+	c.tomb.Go(func() error {
+		c.accept(l)
+		return nil
+	})
+	return nil
+}
+
+// stopInput stops reading lines from the console socket, if any.
+func (c *consoleClient) stopInput() {
+	if c.listener == nil {
+		return
+	}
+	c.listener.Close()
+	os.Remove(c.listener.Addr().String())
+	c.listener = nil
+	c.mu.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mu.Unlock()
+}
+
+func (c *consoleClient) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		c.conns[conn] = true
+		c.mu.Unlock()
+		go func() {
+			c.readLines(conn, c.dying)
+			conn.Close()
+			c.mu.Lock()
+			delete(c.conns, conn)
+			c.mu.Unlock()
+		}()
+	}
+}
+
+func (c *consoleClient) readLines(r io.Reader, dying <-chan struct{}) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		select {
+		case c.lines <- scanner.Text():
+		case <-dying:
+			return
+		}
+	}
+}
+
+// consoleStdinLines holds the lines read from the standard input, which
+// is read by a single goroutine as it can't be interrupted, and is shared
+// by all console accounts reading from it.
+var (
+	consoleStdinOnce  sync.Once
+	consoleStdinLines = make(chan string)
+)
+
+func readConsoleStdin() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		consoleStdinLines <- scanner.Text()
+	}
+}
+
+// write writes line to the console.
+func (c *consoleClient) write(line string) {
+	if c.stdin() {
+		fmt.Fprintln(os.Stdout, line)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.SetWriteDeadline(time.Now().Add(NetworkTimeout))
+		if _, err := io.WriteString(conn, line+"\n"); err != nil {
+			conn.Close()
+		}
+	}
+}
+
+func (c *consoleClient) die() {
+	c.stopInput()
+	c.tomb.Kill(nil)
+	accountLogf(c.accountName, "Console client terminated (%v)", c.tomb.Err())
+}
+
+func (c *consoleClient) run() error {
+	defer c.die()
+
+	if err := c.startInput(); err != nil {
+		return err
+	}
+
+	// Pending holds the messages typed in the console and the delivery
+	// reports of outgoing messages, waiting to be handed over.
+	var pending []*Message
+	for {
+		var inMsg *Message
+		var inSend chan<- *Message
+		var inRecv, stdinRecv <-chan string
+		if len(pending) > 0 {
+			inMsg = pending[0]
+			inSend = c.incoming
+		} else if c.stdin() {
+			stdinRecv = consoleStdinLines
+		} else {
+			inRecv = c.lines
+		}
+
+		select {
+		case line := <-inRecv:
+			pending = c.appendLine(pending, line)
+		case line := <-stdinRecv:
+			pending = c.appendLine(pending, line)
+
+		case inSend <- inMsg:
+			pending = pending[1:]
+
+		case msg := <-c.outgoing:
+			if msg.Command == cmdQuit {
+				return errStop
+			}
+			accountLogf(c.accountName, "Would send: %s", msg.String())
+			c.write(consoleOutput(c.info.Nick, msg))
+			if msg.Id != 0 {
+				pending = append(pending, deliveryPong(c.accountName, msg.Id, nil))
+			}
+
+		case req := <-c.requests:
+			switch r := req.(type) {
+			case ireqUpdateInfo:
+				old := c.info
+				c.info = *r
+				c.bangs.update(&c.info)
+				if old.Endpoint != c.info.Endpoint {
+					accountLogf(c.accountName, "Console endpoint changed. Restarting input.")
+					c.stopInput()
+					if err := c.startInput(); err != nil {
+						return err
+					}
+				}
+			}
+
+		case <-c.dying:
+			return c.tomb.Err()
+		}
+	}
+	panic("unreachable")
+}
+
+// appendLine appends to pending the message typed in the console as line.
+func (c *consoleClient) appendLine(pending []*Message, line string) []*Message {
+	if strings.TrimSpace(line) == "" {
+		return pending
+	}
+	msg := c.bangs.parseIncoming(c.accountName, c.info.Nick, consoleLine(c.info.Nick, line))
+	return append(pending, msg)
+}
+
+// consoleLine returns the IRC protocol line for the console input line,
+// in the form "[#channel] [<nick>] text", received by the bot with nick.
+func consoleLine(nick, line string) string {
+	line = strings.TrimSpace(line)
+	target := nick
+	if strings.HasPrefix(line, "#") {
+		if i := strings.IndexAny(line, " \t"); i > 0 {
+			target, line = line[:i], strings.TrimSpace(line[i:])
+		} else {
+			target, line = line, ""
+		}
+	}
+	from := "console"
+	if strings.HasPrefix(line, "<") {
+		if i := strings.Index(line, ">"); i > 1 && !strings.ContainsAny(line[1:i], " \t") {
+			from, line = line[1:i], strings.TrimSpace(line[i+1:])
+		}
+	}
+	return fmt.Sprintf(":%s!~%s@console PRIVMSG %s :%s", from, from, target, line)
+}
+
+// consoleOutput returns the line written to the console for the message
+// sent by the bot with nick, in a form similar to the one of input lines.
+func consoleOutput(nick string, msg *Message) string {
+	target := msg.Channel
+	if target == "" {
+		target = "@" + msg.Nick
+	}
+	switch msg.Command {
+	case "", cmdPrivMsg:
+		return target + " <" + nick + "> " + StripFormatting(msg.Text)
+	case cmdNotice:
+		return target + " -notice- " + StripFormatting(msg.Text)
+	}
+	return msg.String()
+}
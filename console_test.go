@@ -0,0 +1,128 @@
+package mup_test
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+type ConsoleSuite struct {
+	config *mup.Config
+	server *mup.Server
+
+	db     *sql.DB
+	socket string
+}
+
+var _ = Suite(&ConsoleSuite{})
+
+func (s *ConsoleSuite) SetUpTest(c *C) {
+	mup.SetDebug(true)
+	mup.SetLogger(c)
+
+	var err error
+	s.db, err = mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+
+	s.socket = filepath.Join(c.MkDir(), "console.sock")
+	execSQL(c, s.db, fmt.Sprintf(`INSERT INTO account (name,kind,endpoint,nick) VALUES ('one','console','%s','mup')`, s.socket))
+
+	s.config = &mup.Config{
+		DB:      s.db,
+		Refresh: -1, // Manual refreshing for testing.
+	}
+	s.server, err = mup.Start(s.config)
+	c.Assert(err, IsNil)
+}
+
+func (s *ConsoleSuite) TearDownTest(c *C) {
+	mup.SetDebug(false)
+	mup.SetLogger(nil)
+
+	if s.server != nil {
+		s.server.Stop()
+		s.server = nil
+	}
+	s.db.Close()
+	s.db = nil
+}
+
+func (s *ConsoleSuite) dial(c *C) net.Conn {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("unix", s.socket)
+		if err == nil {
+			return conn
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Fatalf("cannot connect to console socket")
+	return nil
+}
+
+func (s *ConsoleSuite) TestConsole(c *C) {
+	conn := s.dial(c)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "#chan <joe> !hello world\n\nHi there.\n")
+
+	var msgs []mup.Message
+	for i := 0; i < 100; i++ {
+		msgs = nil
+		rows, err := s.db.Query("SELECT account,nick,channel,text,bottext FROM message WHERE lane=1 ORDER BY id")
+		c.Assert(err, IsNil)
+		for rows.Next() {
+			var msg mup.Message
+			c.Assert(rows.Scan(&msg.Account, &msg.Nick, &msg.Channel, &msg.Text, &msg.BotText), IsNil)
+			msgs = append(msgs, msg)
+		}
+		c.Assert(rows.Close(), IsNil)
+		if len(msgs) >= 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(msgs, DeepEquals, []mup.Message{{
+		Account: "one",
+		Nick:    "joe",
+		Channel: "#chan",
+		Text:    "!hello world",
+		BotText: "hello world",
+	}, {
+		Account: "one",
+		Nick:    "console",
+		Text:    "Hi there.",
+		BotText: "Hi there.",
+	}})
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','#chan','','Hello, joe.')`,
+		`INSERT INTO message (lane,account,channel,nick,command,text) VALUES (2,'one','','console','NOTICE','Hi.')`,
+	)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "#chan <mup> Hello, joe.\n")
+	line, err = r.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "@console -notice- Hi.\n")
+}
+
+func (s *ConsoleSuite) TestConsoleLine(c *C) {
+	for _, test := range []struct{ line, irc string }{
+		{"Hello", ":console!~console@console PRIVMSG mup :Hello"},
+		{"<joe> Hello", ":joe!~joe@console PRIVMSG mup :Hello"},
+		{"#chan Hello", ":console!~console@console PRIVMSG #chan :Hello"},
+		{"#chan <joe>  Hello ", ":joe!~joe@console PRIVMSG #chan :Hello"},
+		{"<j oe> Hello", ":console!~console@console PRIVMSG mup :<j oe> Hello"},
+	} {
+		c.Assert(mup.ConsoleLine("mup", test.line), Equals, test.irc)
+	}
+}
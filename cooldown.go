@@ -0,0 +1,66 @@
+package mup
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0/schema"
+)
+
+type cooldownKey struct {
+	command string
+	account string
+	channel string
+	nick    string
+}
+
+type cooldownEntry struct {
+	// until holds when the command may be run again.
+	until time.Time
+
+	// notified reports whether someone was told about the cooldown
+	// since it started.
+	notified bool
+}
+
+// cooldownFilter enforces the cooldowns declared in the command schemas
+// of a single plugin. Once a command with a cooldown is run, it may not be
+// run again by the same user, nor by anyone in the same channel, until
+// the cooldown elapses.
+type cooldownFilter struct {
+	recent map[cooldownKey]*cooldownEntry
+}
+
+func newCooldownFilter() *cooldownFilter {
+	return &cooldownFilter{recent: make(map[cooldownKey]*cooldownEntry)}
+}
+
+// allow reports whether the command in msg may be run now. When it's
+// refused, wait holds how long until the cooldown elapses, and notify
+// reports whether the sender should be told about it, which happens only
+// once per cooldown.
+func (f *cooldownFilter) allow(cmd *schema.Command, msg *Message) (ok bool, wait time.Duration, notify bool) {
+	if cmd.Cooldown <= 0 {
+		return true, 0, false
+	}
+	for key, entry := range f.recent {
+		if !msg.Time.Before(entry.until) {
+			delete(f.recent, key)
+		}
+	}
+	keys := []cooldownKey{{cmd.Name, msg.Account, "", strings.ToLower(msg.Nick)}}
+	if msg.Channel != "" {
+		keys = append(keys, cooldownKey{cmd.Name, msg.Account, strings.ToLower(msg.Channel), ""})
+	}
+	for _, key := range keys {
+		if entry, ok := f.recent[key]; ok {
+			notify = !entry.notified
+			entry.notified = true
+			return false, entry.until.Sub(msg.Time), notify
+		}
+	}
+	for _, key := range keys {
+		f.recent[key] = &cooldownEntry{until: msg.Time.Add(cmd.Cooldown)}
+	}
+	return true, 0, false
+}
@@ -1,11 +1,16 @@
 package mup
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 const dbName = "mup.db"
@@ -26,6 +31,92 @@ func OpenDB(dirpath string) (*sql.DB, error) {
 	return db, nil
 }
 
+// dbRetryDelays defines how long to wait before each new attempt at a
+// database write that failed because the database was busy or locked.
+// SQLite's own busy timeout covers most of these cases, but not those
+// where waiting could never succeed, such as a deferred transaction
+// that must be restarted to upgrade its lock.
+var dbRetryDelays = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// dbBusy returns whether err reports the database as busy or locked.
+func dbBusy(err error) bool {
+	if e, ok := err.(sqlite3.Error); ok {
+		return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// dbExec executes query on db, retrying with increasing delays while
+// the database reports being busy.
+func dbExec(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	return dbExecContext(context.Background(), db, query, args...)
+}
+
+// dbExecContext is like dbExec, but gives up once ctx is done.
+func dbExecContext(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	for i := 0; ; i++ {
+		result, err := db.ExecContext(ctx, query, args...)
+		if err == nil || !dbBusy(err) || i == len(dbRetryDelays) {
+			return result, err
+		}
+		select {
+		case <-time.After(dbRetryDelays[i]):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// stmtCache holds prepared statements for the queries that run on every
+// message or iteration, to avoid compiling them repeatedly. The statements
+// are kept until close is called, so the number of distinct queries must
+// be small and fixed, and the cache must be closed before its database.
+type stmtCache struct {
+	db    *sql.DB
+	mutex sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// prepare returns a prepared statement for query, preparing it on
+// first use and reusing it afterwards.
+func (c *stmtCache) prepare(query string) (*sql.Stmt, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stmts == nil {
+		return nil, fmt.Errorf("statement cache is closed")
+	}
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// close releases all statements prepared so far. Further calls to
+// prepare fail.
+func (c *stmtCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, stmt := range c.stmts {
+		stmt.Close()
+	}
+	c.stmts = nil
+}
+
 func WipeDB(dirpath string) error {
 	err1 := os.Remove(filepath.Join(dirpath, dbName))
 	err2 := os.Remove(filepath.Join(dirpath, dbName+"-wal"))
@@ -100,7 +191,7 @@ func updateSchema(db *sql.DB) error {
 	return tx.Commit()
 }
 
-const currentMajor, currentMinor = 1, 0
+const currentMajor, currentMinor = 1, 34
 
 var schemaPatches = []struct {
 	originMajor, originMinor int
@@ -108,6 +199,40 @@ var schemaPatches = []struct {
 	apply                    func(*sql.Tx) error
 }{
 	{0, 0, 1, 0, schemaCurrent},
+	{1, 0, 1, 1, schemaReminder},
+	{1, 1, 1, 2, schemaLogLevel},
+	{1, 2, 1, 3, schemaAccountConfig},
+	{1, 3, 1, 4, schemaAttachment},
+	{1, 4, 1, 5, schemaButtons},
+	{1, 5, 1, 6, schemaIgnored},
+	{1, 6, 1, 7, schemaLDAPPool},
+	{1, 7, 1, 8, schemaLDAPCache},
+	{1, 8, 1, 9, schemaDirectory},
+	{1, 9, 1, 10, schemaBugTask},
+	{1, 10, 1, 11, schemaPaste},
+	{1, 11, 1, 12, schemaMeeting},
+	{1, 12, 1, 13, schemaFactoid},
+	{1, 13, 1, 14, schemaTargetGroup},
+	{1, 14, 1, 15, schemaSession},
+	{1, 15, 1, 16, schemaPriority},
+	{1, 16, 1, 17, schemaDelivery},
+	{1, 17, 1, 18, schemaReplies},
+	{1, 18, 1, 19, schemaLease},
+	{1, 19, 1, 20, schemaInstance},
+	{1, 20, 1, 21, schemaMiddleware},
+	{1, 21, 1, 22, schemaTargetLocale},
+	{1, 22, 1, 23, schemaBang},
+	{1, 23, 1, 24, schemaEnumValues},
+	{1, 24, 1, 25, schemaOptions},
+	{1, 25, 1, 26, schemaThreads},
+	{1, 26, 1, 27, schemaPackageRelease},
+	{1, 27, 1, 28, schemaUnknownCommands},
+	{1, 28, 1, 29, schemaEvents},
+	{1, 29, 1, 30, schemaPluginMigration},
+	{1, 30, 1, 31, schemaTags},
+	{1, 31, 1, 32, schemaPlayback},
+	{1, 32, 1, 33, schemaPresence},
+	{1, 33, 1, 34, schemaPasteMimeType},
 }
 
 func execAll(tx *sql.Tx, stmts []string) error {
@@ -241,3 +366,360 @@ func schemaCurrent(tx *sql.Tx) error {
 	}
 	return execAll(tx, stmts)
 }
+
+func schemaReminder(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE reminder (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"plugin TEXT NOT NULL DEFAULT ''," +
+			"time DATETIME NOT NULL DEFAULT 0," +
+			"account TEXT NOT NULL DEFAULT ''," +
+			"channel TEXT NOT NULL DEFAULT ''," +
+			"nick TEXT NOT NULL DEFAULT ''," +
+			"sender TEXT NOT NULL DEFAULT ''," +
+			"text TEXT NOT NULL DEFAULT '')",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaLogLevel(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE account ADD COLUMN loglevel TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE plugin ADD COLUMN loglevel TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaAccountConfig(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE account ADD COLUMN config TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaAttachment(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN attachment TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE log ADD COLUMN attachment TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaButtons(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN buttons TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE log ADD COLUMN buttons TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaIgnored(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE ignored (" +
+			"account TEXT NOT NULL DEFAULT ''," +
+			"channel TEXT NOT NULL DEFAULT ''," +
+			"mask TEXT NOT NULL," +
+			"reason TEXT NOT NULL DEFAULT ''," +
+			"PRIMARY KEY (account,channel,mask))",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaLDAPPool(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE ldap ADD COLUMN poolsize INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE ldap ADD COLUMN idletimeout INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE ldap ADD COLUMN starttls BOOLEAN NOT NULL DEFAULT false",
+		"ALTER TABLE ldap ADD COLUMN cacert TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaLDAPCache(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE ldap ADD COLUMN cachettl INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE ldap ADD COLUMN cachesize INTEGER NOT NULL DEFAULT 0",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaDirectory(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE directory (" +
+			"name TEXT NOT NULL," +
+			"nick TEXT NOT NULL DEFAULT ''," +
+			"email TEXT NOT NULL DEFAULT ''," +
+			"attrs TEXT NOT NULL DEFAULT ''," +
+			"PRIMARY KEY (name,nick,email))",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaBugTask(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE bugtask (" +
+			"plugin TEXT NOT NULL," +
+			"bug INTEGER NOT NULL," +
+			"target TEXT NOT NULL," +
+			"status TEXT NOT NULL DEFAULT ''," +
+			"importance TEXT NOT NULL DEFAULT ''," +
+			"PRIMARY KEY (plugin,bug,target))",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaPaste(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE paste (" +
+			"id TEXT NOT NULL PRIMARY KEY," +
+			"plugin TEXT NOT NULL," +
+			"time DATETIME NOT NULL," +
+			"text TEXT NOT NULL)",
+		"CREATE INDEX paste_time ON paste (time)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaMeeting(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE meeting (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"plugin TEXT NOT NULL," +
+			"account TEXT NOT NULL," +
+			"channel TEXT NOT NULL," +
+			"title TEXT NOT NULL DEFAULT ''," +
+			"chair TEXT NOT NULL DEFAULT ''," +
+			"startid INTEGER NOT NULL DEFAULT 0," +
+			"starttime DATETIME NOT NULL DEFAULT 0," +
+			"endid INTEGER NOT NULL DEFAULT 0," +
+			"endtime DATETIME NOT NULL DEFAULT 0," +
+			"minutes TEXT NOT NULL DEFAULT '')",
+		"CREATE INDEX meeting_channel ON meeting (plugin,account,channel,endid)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaFactoid(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE factoid (" +
+			"plugin TEXT NOT NULL," +
+			"key TEXT NOT NULL," +
+			"value TEXT NOT NULL DEFAULT ''," +
+			"alias TEXT NOT NULL DEFAULT ''," +
+			"PRIMARY KEY (plugin,key))",
+		"CREATE TABLE factoidlog (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"plugin TEXT NOT NULL," +
+			"key TEXT NOT NULL," +
+			"action TEXT NOT NULL," +
+			"value TEXT NOT NULL DEFAULT ''," +
+			"alias TEXT NOT NULL DEFAULT ''," +
+			"nick TEXT NOT NULL DEFAULT ''," +
+			"time DATETIME NOT NULL)",
+		"CREATE INDEX factoidlog_key ON factoidlog (plugin,key)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaTargetGroup(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE target ADD COLUMN \"group\" TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaSession(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE session (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"account TEXT NOT NULL," +
+			"nick TEXT NOT NULL," +
+			"user TEXT NOT NULL DEFAULT ''," +
+			"host TEXT NOT NULL DEFAULT ''," +
+			"previd INTEGER NOT NULL DEFAULT 0," +
+			"active BOOLEAN NOT NULL DEFAULT 1," +
+			"starttime DATETIME NOT NULL," +
+			"endtime DATETIME NOT NULL DEFAULT 0," +
+			"quit TEXT NOT NULL DEFAULT '')",
+		"CREATE INDEX session_nick ON session (account,nick,active)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaPriority(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN priority INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE log ADD COLUMN priority INTEGER NOT NULL DEFAULT 0",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaDelivery(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN plugin TEXT NOT NULL DEFAULT ''",
+		"CREATE TABLE delivery (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"message INTEGER NOT NULL UNIQUE," +
+			"nonce BLOB NOT NULL," +
+			"account TEXT NOT NULL," +
+			"plugin TEXT NOT NULL," +
+			"status TEXT NOT NULL," +
+			"error TEXT NOT NULL DEFAULT ''," +
+			"time DATETIME NOT NULL)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaReplies(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN replyto TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE message ADD COLUMN forwardfrom TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE log ADD COLUMN replyto TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE log ADD COLUMN forwardfrom TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaLease(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE lease (" +
+			"account TEXT NOT NULL PRIMARY KEY REFERENCES account (name) ON UPDATE CASCADE ON DELETE CASCADE," +
+			"holder TEXT NOT NULL," +
+			"expires DATETIME NOT NULL)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaInstance(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE instance (" +
+			"name TEXT NOT NULL," +
+			"role TEXT NOT NULL," +
+			"filter TEXT," +
+			"expires DATETIME NOT NULL," +
+			"PRIMARY KEY (name,role))",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaMiddleware(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE middleware (" +
+			"name TEXT NOT NULL PRIMARY KEY," +
+			"position INTEGER NOT NULL DEFAULT 0," +
+			"config TEXT NOT NULL DEFAULT '')",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaTargetLocale(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE target ADD COLUMN timezone TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE target ADD COLUMN locale TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaBang(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE account ADD COLUMN bang TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE channel ADD COLUMN bang TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaEnumValues(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE argumentschema ADD COLUMN enumvalues TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaOptions(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE argumentschema ADD COLUMN short TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE argumentschema ADD COLUMN defaultvalue TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaThreads(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN threadid TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE log ADD COLUMN threadid TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaPackageRelease(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE packagerelease (" +
+			"plugin TEXT NOT NULL," +
+			"registry TEXT NOT NULL," +
+			"package TEXT NOT NULL," +
+			"version TEXT NOT NULL DEFAULT ''," +
+			"PRIMARY KEY (plugin,registry,package))",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaUnknownCommands(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE pluginschema ADD COLUMN unknowncommands BOOLEAN NOT NULL DEFAULT false",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaEvents(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE event (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"time DATETIME NOT NULL DEFAULT 0," +
+			"plugin TEXT NOT NULL DEFAULT ''," +
+			"topic TEXT NOT NULL DEFAULT ''," +
+			"payload TEXT NOT NULL DEFAULT '')",
+		"CREATE INDEX event_topic ON event (topic)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaPluginMigration(tx *sql.Tx) error {
+	var stmts = []string{
+		"CREATE TABLE pluginmigration (" +
+			"plugin TEXT NOT NULL PRIMARY KEY," +
+			"version INTEGER NOT NULL DEFAULT 0)",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaTags(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN tags TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE log ADD COLUMN tags TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaPlayback(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE message ADD COLUMN playback BOOLEAN NOT NULL DEFAULT false",
+		"ALTER TABLE log ADD COLUMN playback BOOLEAN NOT NULL DEFAULT false",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaPresence(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE session ADD COLUMN lastseen DATETIME NOT NULL DEFAULT 0",
+		"ALTER TABLE session ADD COLUMN away TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE session ADD COLUMN awaytime DATETIME NOT NULL DEFAULT 0",
+	}
+	return execAll(tx, stmts)
+}
+
+func schemaPasteMimeType(tx *sql.Tx) error {
+	var stmts = []string{
+		"ALTER TABLE paste ADD COLUMN mimetype TEXT NOT NULL DEFAULT ''",
+	}
+	return execAll(tx, stmts)
+}
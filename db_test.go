@@ -0,0 +1,109 @@
+package mup_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+var _ = Suite(&DBSuite{})
+
+type DBSuite struct{}
+
+func (s *DBSuite) TestExecRetriesWhenBusy(c *C) {
+	dir := c.MkDir()
+	db, err := mup.OpenDB(dir)
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	// A second handle that doesn't wait for locks by itself.
+	other, err := sql.Open("sqlite3", filepath.Join(dir, "mup.db")+"?_busy_timeout=0")
+	c.Assert(err, IsNil)
+	defer other.Close()
+
+	tx, err := db.Begin()
+	c.Assert(err, IsNil)
+	_, err = tx.Exec("INSERT INTO account (name) VALUES ('one')")
+	c.Assert(err, IsNil)
+
+	_, err = other.Exec("INSERT INTO account (name) VALUES ('two')")
+	c.Assert(err, ErrorMatches, "database is locked")
+
+	committed := make(chan error, 1)
+	time.AfterFunc(200*time.Millisecond, func() { committed <- tx.Commit() })
+
+	_, err = mup.DBExec(other, "INSERT INTO account (name) VALUES ('two')")
+	c.Assert(err, IsNil)
+	c.Assert(<-committed, IsNil)
+
+	var n int
+	c.Assert(db.QueryRow("SELECT COUNT(*) FROM account").Scan(&n), IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *DBSuite) TestStmtCache(c *C) {
+	db1, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db1.Close()
+	db2, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db2.Close()
+
+	cache1 := mup.NewStmtCache(db1)
+	cache2 := mup.NewStmtCache(db2)
+	defer cache2.Close()
+
+	const query = "SELECT COUNT(*) FROM account WHERE name!=?"
+	stmt1, err := cache1.Prepare(query)
+	c.Assert(err, IsNil)
+	again, err := cache1.Prepare(query)
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, stmt1)
+
+	stmt2, err := cache2.Prepare(query)
+	c.Assert(err, IsNil)
+	c.Assert(stmt2, Not(Equals), stmt1)
+
+	_, err = db2.Exec("INSERT INTO account (name) VALUES ('one')")
+	c.Assert(err, IsNil)
+	var n1, n2 int
+	c.Assert(stmt1.QueryRow("").Scan(&n1), IsNil)
+	c.Assert(stmt2.QueryRow("").Scan(&n2), IsNil)
+	c.Assert(n1, Equals, 0)
+	c.Assert(n2, Equals, 1)
+
+	_, err = cache1.Prepare("SELECT bogus FROM nowhere")
+	c.Assert(err, ErrorMatches, "no such table: nowhere")
+
+	// Closing releases the statements prepared so far.
+	cache1.Close()
+	c.Assert(stmt1.QueryRow("").Scan(&n1), ErrorMatches, "sql: statement is closed")
+	_, err = cache1.Prepare(query)
+	c.Assert(err, ErrorMatches, "statement cache is closed")
+
+	c.Assert(stmt2.QueryRow("").Scan(&n2), IsNil)
+}
+
+func (s *DBSuite) TestBackupDB(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO account (name) VALUES ('one')")
+	c.Assert(err, IsNil)
+
+	dir := c.MkDir()
+	c.Assert(mup.BackupDB(db, filepath.Join(dir, "mup.db")), IsNil)
+
+	backup, err := mup.OpenDB(dir)
+	c.Assert(err, IsNil)
+	defer backup.Close()
+	var name string
+	c.Assert(backup.QueryRow("SELECT name FROM account").Scan(&name), IsNil)
+	c.Assert(name, Equals, "one")
+
+	err = mup.BackupDB(db, filepath.Join(dir, "missing", "mup.db"))
+	c.Assert(err, ErrorMatches, "cannot create backup file: .*")
+}
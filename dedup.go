@@ -0,0 +1,78 @@
+package mup
+
+import (
+	"strings"
+	"time"
+)
+
+// dedupConfig holds the settings read from a target's configuration
+// document that control duplicate suppression for that target.
+type dedupConfig struct {
+	// Dedup is the window within which a repeated message is dropped.
+	Dedup DurationString `json:"dedup"`
+}
+
+type dedupKey struct {
+	nick string
+	text string
+}
+
+type dedupEntry struct {
+	account string
+	channel string
+	time    time.Time
+}
+
+// dedupFilter tracks recent incoming messages delivered to a single
+// plugin so that copies arriving via other bridged accounts are dropped.
+type dedupFilter struct {
+	windows map[Address]time.Duration
+	longest time.Duration
+	recent  map[dedupKey]dedupEntry
+}
+
+func newDedupFilter(targets []Target) *dedupFilter {
+	var f *dedupFilter
+	for _, target := range targets {
+		var config dedupConfig
+		if target.UnmarshalConfig(&config) != nil || config.Dedup.Duration <= 0 {
+			continue
+		}
+		if f == nil {
+			f = &dedupFilter{
+				windows: make(map[Address]time.Duration),
+				recent:  make(map[dedupKey]dedupEntry),
+			}
+		}
+		f.windows[target.Address()] = config.Dedup.Duration
+		if config.Dedup.Duration > f.longest {
+			f.longest = config.Dedup.Duration
+		}
+	}
+	return f
+}
+
+// duplicate reports whether msg, received via the provided target, repeats a
+// message recently delivered via a different account or channel. Messages that
+// are not duplicates are recorded so that later copies may be detected.
+func (f *dedupFilter) duplicate(target Target, msg *Message) bool {
+	if f == nil || msg.AsNick == "" || msg.Text == "" {
+		return false
+	}
+	window, ok := f.windows[target.Address()]
+	if !ok {
+		return false
+	}
+	for key, entry := range f.recent {
+		if msg.Time.Sub(entry.time) > f.longest {
+			delete(f.recent, key)
+		}
+	}
+	key := dedupKey{strings.ToLower(msg.Nick), strings.TrimSpace(msg.Text)}
+	entry, ok := f.recent[key]
+	if ok && (entry.account != msg.Account || entry.channel != msg.Channel) && msg.Time.Sub(entry.time) <= window {
+		return true
+	}
+	f.recent[key] = dedupEntry{msg.Account, msg.Channel, msg.Time}
+	return false
+}
@@ -0,0 +1,91 @@
+package mup
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeliveryStatus reports the outcome of an attempt to deliver an
+// outgoing message.
+type DeliveryStatus string
+
+const (
+	// DeliverySent means the message was accepted by the server.
+	DeliverySent DeliveryStatus = "sent"
+
+	// DeliveryFailed means the server refused the message, or the account
+	// gave up on delivering it. Failed messages are not retried.
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// Delivery holds the outcome of delivering an outgoing message sent by
+// a plugin that implements DeliveryHandler.
+type Delivery struct {
+	// Id is the id of the outgoing message, as observed by HandleOutgoing.
+	Id int64
+
+	// Nonce is the nonce of the outgoing message. Plugins may set the
+	// nonce of messages before sending them to identify their deliveries.
+	Nonce string
+
+	Account string
+	Status  DeliveryStatus
+
+	// Error holds the reason for failed deliveries, as reported by the server.
+	Error string
+
+	Time time.Time
+}
+
+const deliveryColumns = "id,message,nonce,account,plugin,status,error,time"
+
+// deliveryPong returns the message through which account clients report
+// the delivery of the outgoing message with the provided id. The account
+// manager records it as delivered, so it isn't sent again, and notifies
+// the plugin that sent it if that's desired.
+func deliveryPong(account string, id int64, err error) *Message {
+	text := "sent:" + strconv.FormatInt(id, 16)
+	if err != nil {
+		text = "failed:" + strconv.FormatInt(id, 16) + " " + err.Error()
+	}
+	return ParseIncoming(account, "mup", "/", "PONG :"+text)
+}
+
+// parseDeliveryPong returns the delivery reported via the text of a PONG
+// message, or a nil delivery if the text does not report one.
+func parseDeliveryPong(text string) (*Delivery, error) {
+	var status DeliveryStatus
+	switch {
+	case strings.HasPrefix(text, "sent:"):
+		status = DeliverySent
+	case strings.HasPrefix(text, "failed:"):
+		status = DeliveryFailed
+	default:
+		return nil, nil
+	}
+	text = text[len(status)+1:]
+	var reason string
+	if i := strings.Index(text, " "); i >= 0 && status == DeliveryFailed {
+		text, reason = text[:i], text[i+1:]
+	}
+	id, err := strconv.ParseInt(text, 16, 64)
+	if err != nil || id < 0 {
+		return nil, fmt.Errorf("cannot extract message ID out of pong text: %q", text)
+	}
+	return &Delivery{Id: id, Status: status, Error: reason}, nil
+}
+
+// recordDelivery records d for the plugin that sent the respective message,
+// if any. Only the first delivery recorded for a message is kept.
+func recordDelivery(tx *sql.Tx, d *Delivery) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO delivery (message,nonce,account,plugin,status,error,time) "+
+		"SELECT id,nonce,account,plugin,?,?,? FROM message WHERE id=? AND lane=2 AND plugin!=''",
+		d.Status, d.Error, time.Now(), d.Id)
+	if err != nil {
+		return fmt.Errorf("cannot record message delivery: %v", err)
+	}
+	return nil
+}
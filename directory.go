@@ -0,0 +1,235 @@
+package mup
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mup.v0/ldap"
+)
+
+// Directory provides information about people, such as their mobile
+// number or location, looked up by attributes such as their nick or email.
+//
+// Directories are either LDAP connections as registered in the ldap table,
+// or static entries held in the directory table. The latter allows plugins
+// depending on a directory to work in deployments without an LDAP server.
+type Directory interface {
+	// Search returns the entries having value for the attr attribute,
+	// including the provided attrs in each entry. Phone attributes such
+	// as "mobile" match regardless of punctuation and spacing.
+	Search(attr, value string, attrs ...string) ([]DirEntry, error)
+
+	// Close releases the directory. It must be called after its use.
+	Close() error
+}
+
+// Attribute names understood by all directories. Other attribute names are
+// used verbatim, so for LDAP directories they must match the LDAP schema.
+const (
+	DirNick  = "nick"
+	DirEmail = "email"
+)
+
+// DirEntry holds the attributes of a person found in a directory.
+type DirEntry struct {
+	Attrs map[string][]string
+}
+
+// Values returns all values of the named attribute.
+func (e *DirEntry) Values(name string) []string {
+	return e.Attrs[name]
+}
+
+// Value returns the first value of the named attribute, or an empty
+// string if the attribute has no values.
+func (e *DirEntry) Value(name string) string {
+	if values := e.Attrs[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Directory returns the named directory. If there is an LDAP connection with
+// the given name it is used, and otherwise the entries in the directory table
+// recorded under that name are used.
+//
+// The returned directory must be closed after its use.
+func (p *Plugger) Directory(name string) (Directory, error) {
+	if conn, err := p.ldap(name); err == nil {
+		return &ldapDirectory{conn}, nil
+	}
+	if p.db != nil {
+		var found bool
+		err := p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM directory WHERE name=?)", name).Scan(&found)
+		if err != nil {
+			return nil, fmt.Errorf("cannot query directory table: %v", err)
+		}
+		if found {
+			return &tableDirectory{p.db, name}, nil
+		}
+	}
+	return nil, fmt.Errorf("directory %q not found", name)
+}
+
+func isPhoneAttr(attr string) bool {
+	return attr == "mobile" || attr == "phone" || attr == "telephoneNumber"
+}
+
+func phoneDigits(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+var ldapDirAttrs = map[string]string{
+	DirNick:  "mozillaNickname",
+	DirEmail: "mail",
+}
+
+func ldapDirAttr(attr string) string {
+	if name, ok := ldapDirAttrs[attr]; ok {
+		return name
+	}
+	return attr
+}
+
+type ldapDirectory struct {
+	conn ldap.Conn
+}
+
+func (d *ldapDirectory) Close() error {
+	return d.conn.Close()
+}
+
+func (d *ldapDirectory) Search(attr, value string, attrs ...string) ([]DirEntry, error) {
+	var filter string
+	if isPhoneAttr(attr) {
+		// Match the digits in order with anything around them.
+		digits := phoneDigits(value)
+		query := make([]byte, len(digits)*2+1)
+		query[0] = '*'
+		for i := 0; i < len(digits); i++ {
+			query[i*2+1] = digits[i]
+			query[i*2+2] = '*'
+		}
+		filter = fmt.Sprintf("(%s=%s)", ldapDirAttr(attr), query)
+	} else {
+		filter = fmt.Sprintf("(%s=%s)", ldapDirAttr(attr), ldap.EscapeFilter(value))
+	}
+	search := &ldap.Search{Filter: filter, Attrs: make([]string, len(attrs))}
+	back := make(map[string]string, len(attrs))
+	for i, name := range attrs {
+		search.Attrs[i] = ldapDirAttr(name)
+		back[search.Attrs[i]] = name
+	}
+	results, err := d.conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DirEntry, len(results))
+	for i, result := range results {
+		entries[i].Attrs = make(map[string][]string, len(result.Attrs))
+		for _, a := range result.Attrs {
+			name := a.Name
+			if orig, ok := back[name]; ok {
+				name = orig
+			}
+			entries[i].Attrs[name] = a.Values
+		}
+	}
+	return entries, nil
+}
+
+// tableDirectory holds entries in the directory table. The attrs column of
+// each entry holds a JSON object mapping attribute names to either a single
+// string value or a list of them.
+type tableDirectory struct {
+	db   *sql.DB
+	name string
+}
+
+func (d *tableDirectory) Close() error {
+	return nil
+}
+
+func (d *tableDirectory) Search(attr, value string, attrs ...string) ([]DirEntry, error) {
+	rows, err := d.db.Query("SELECT nick,email,attrs FROM directory WHERE name=? ORDER BY nick,email", d.name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query directory table: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []DirEntry
+	for rows.Next() {
+		var nick, email, data string
+		if err := rows.Scan(&nick, &email, &data); err != nil {
+			return nil, fmt.Errorf("cannot parse directory entry: %v", err)
+		}
+		all, err := parseDirAttrs(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse attributes of directory entry for %q: %v", nick, err)
+		}
+		if nick != "" {
+			all[DirNick] = []string{nick}
+		}
+		if email != "" {
+			all[DirEmail] = []string{email}
+		}
+		if !dirMatch(attr, value, all[attr]) {
+			continue
+		}
+		entry := DirEntry{Attrs: make(map[string][]string, len(attrs))}
+		for _, name := range attrs {
+			if values, ok := all[name]; ok {
+				entry.Attrs[name] = values
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query directory table: %v", err)
+	}
+	return entries, nil
+}
+
+func dirMatch(attr, value string, values []string) bool {
+	for _, v := range values {
+		if isPhoneAttr(attr) {
+			if phoneDigits(v) == phoneDigits(value) {
+				return true
+			}
+		} else if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDirAttrs(data string) (map[string][]string, error) {
+	all := make(map[string][]string)
+	if data == "" {
+		return all, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+	for name, value := range raw {
+		var one string
+		if err := json.Unmarshal(value, &one); err == nil {
+			all[name] = []string{one}
+			continue
+		}
+		var many []string
+		if err := json.Unmarshal(value, &many); err != nil {
+			return nil, fmt.Errorf("attribute %q must be a string or a list of strings", name)
+		}
+		all[name] = many
+	}
+	return all, nil
+}
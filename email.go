@@ -0,0 +1,739 @@
+package mup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// emailClient implements email accounts. Messages are received by polling
+// an IMAP mailbox at the account host for unseen mails, and sent via SMTP.
+//
+// Received mails are delivered with the sender address as the nick, and
+// the subject and plain text body as the message text. Mails posted to a
+// mailing list, as advertised by their List-Post header, are delivered to
+// the channel named after the list address, as in "#list@example.com".
+// Other mails are delivered to the sender, as in "@joe@example.com".
+// Outgoing messages are sent to the address in their channel name.
+type emailClient struct {
+	accountName string
+
+	dying  <-chan struct{}
+	info   accountInfo
+	bangs  *bangPrefixes
+	tomb   tomb.Tomb
+	emailR *emailReader
+	emailW *emailWriter
+
+	requests chan interface{}
+
+	incoming chan *Message
+	outgoing chan *Message
+}
+
+func (c *emailClient) AccountName() string     { return c.accountName }
+func (c *emailClient) Dying() <-chan struct{}  { return c.dying }
+func (c *emailClient) Outgoing() chan *Message { return c.outgoing }
+func (c *emailClient) LastId() int64           { return c.info.LastId }
+
+func startEmailClient(info *accountInfo, incoming chan *Message) accountClient {
+	c := &emailClient{
+		accountName: info.Name,
+
+		info:     *info,
+		bangs:    newBangPrefixes("/", info),
+		requests: make(chan interface{}, 1),
+		incoming: incoming,
+		outgoing: make(chan *Message),
+	}
+	c.dying = c.tomb.Dying()
+	c.tomb.Go(c.run)
+	return c
+}
+
+func (c *emailClient) Alive() bool {
+	return c.tomb.Alive()
+}
+
+func (c *emailClient) Stop() error {
+	// Try to disconnect gracefully.
+	timeout := time.After(NetworkTimeout)
+	select {
+	case c.outgoing <- &Message{Command: cmdQuit}:
+		select {
+		case <-c.dying:
+		case <-timeout:
+		}
+	case <-c.dying:
+	case <-timeout:
+	}
+	c.tomb.Kill(errStop)
+	err := c.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+// UpdateInfo updates the account information. Everything but
+// the account name may be updated.
+func (c *emailClient) UpdateInfo(info *accountInfo) {
+	if info.Name != c.accountName {
+		panic("cannot change the account name")
+	}
+	// Make a copy as its use will continue after returning to the caller.
+	infoCopy := *info
+	select {
+	case c.requests <- ireqUpdateInfo(&infoCopy):
+	case <-c.dying:
+	}
+}
+
+// emailConfig holds the email-specific settings that may be provided
+// in the account configuration document.
+type emailConfig struct {
+	// SMTP is the address of the server used for sending mails, as in
+	// "smtp.example.com:587". Outgoing messages are dropped when empty.
+	SMTP string `json:"smtp"`
+
+	// From is the sender address of outgoing mails. Defaults to the
+	// account identity.
+	From string `json:"from"`
+
+	// Mailbox is the IMAP mailbox polled for new mails. Defaults to INBOX.
+	Mailbox string `json:"mailbox"`
+
+	// Poll is the interval between mailbox checks. Defaults to one minute.
+	Poll DurationString `json:"poll"`
+}
+
+const emailDefaultPoll = time.Minute
+
+func (c *emailClient) config() emailConfig {
+	var config emailConfig
+	if c.info.Config != "" {
+		err := json.Unmarshal([]byte(c.info.Config), &config)
+		if err != nil {
+			accountLogf(c.accountName, "Cannot parse account configuration: %v", err)
+		}
+	}
+	if config.From == "" {
+		config.From = c.info.Identity
+	}
+	if config.Mailbox == "" {
+		config.Mailbox = "INBOX"
+	}
+	if config.Poll.Duration <= 0 {
+		config.Poll.Duration = emailDefaultPoll
+	}
+	return config
+}
+
+// emailRestartNeeded returns whether the reader and writer must be restarted
+// for the changes between the old and new account information to apply.
+func emailRestartNeeded(old, new *accountInfo) bool {
+	return old.Host != new.Host || old.TLS != new.TLS || old.TLSInsecure != new.TLSInsecure ||
+		old.Identity != new.Identity || old.Password != new.Password || old.Nick != new.Nick ||
+		old.Config != new.Config
+}
+
+func (c *emailClient) startReaderWriter() {
+	config := c.config()
+	c.emailR = startEmailReader(&c.info, config, c.bangs)
+	c.emailW = startEmailWriter(&c.info, config, c.emailR)
+}
+
+func (c *emailClient) stopReaderWriter() {
+	err := c.emailW.Stop()
+	if err != nil {
+		accountLogf(c.accountName, "Email writer failure: %s", err)
+	}
+	err = c.emailR.Stop()
+	if err != nil {
+		accountLogf(c.accountName, "Email reader failure: %s", err)
+	}
+}
+
+func (c *emailClient) die() {
+	accountLogf(c.accountName, "Cleaning email connection resources")
+
+	if c.emailW != nil {
+		c.stopReaderWriter()
+	}
+
+	c.tomb.Kill(nil)
+	accountLogf(c.accountName, "Email client terminated (%v)", c.tomb.Err())
+}
+
+func (c *emailClient) run() error {
+	defer c.die()
+
+	c.startReaderWriter()
+
+	var inMsg, outMsg *Message
+	var inRecv, outRecv <-chan *Message
+	var inSend, outSend chan<- *Message
+
+	inRecv = c.emailR.Incoming
+	outRecv = c.outgoing
+
+	quitting := false
+	for {
+		select {
+		case inMsg = <-inRecv:
+			inRecv = nil
+			inSend = c.incoming
+
+		case inSend <- inMsg:
+			inMsg = nil
+			inRecv = c.emailR.Incoming
+			inSend = nil
+
+		case outMsg = <-outRecv:
+			if outMsg.Command == cmdQuit {
+				quitting = true
+			}
+			outRecv = nil
+			outSend = c.emailW.Outgoing
+
+		case outSend <- outMsg:
+			outMsg = nil
+			outRecv = c.outgoing
+			outSend = nil
+
+		case req := <-c.requests:
+			switch r := req.(type) {
+			case ireqUpdateInfo:
+				old := c.info
+				c.info = *r
+				c.bangs.update(&c.info)
+				if !emailRestartNeeded(&old, &c.info) {
+					break
+				}
+				accountLogf(c.accountName, "Email account settings changed. Restarting reader and writer.")
+				c.stopReaderWriter()
+				c.startReaderWriter()
+				if inMsg == nil {
+					inRecv = c.emailR.Incoming
+				}
+				if outMsg != nil {
+					outSend = c.emailW.Outgoing
+				}
+			}
+
+		case <-c.dying:
+			return c.tomb.Err()
+		case <-c.emailR.Dying:
+			if quitting {
+				return errStop
+			}
+			return c.emailR.Err()
+		case <-c.emailW.Dying:
+			if quitting {
+				return errStop
+			}
+			return c.emailW.Err()
+		}
+	}
+	panic("unreachable")
+}
+
+// ---------------------------------------------------------------------------
+// emailWriter
+
+// An emailWriter reads messages from the Outgoing channel and mails them.
+type emailWriter struct {
+	accountName string
+	identity    string
+	password    string
+	config      emailConfig
+	r           *emailReader
+	tomb        tomb.Tomb
+
+	Dying    <-chan struct{}
+	Outgoing chan *Message
+}
+
+func startEmailWriter(info *accountInfo, config emailConfig, r *emailReader) *emailWriter {
+	w := &emailWriter{
+		accountName: info.Name,
+		identity:    info.Identity,
+		password:    info.Password,
+		config:      config,
+		r:           r,
+		Outgoing:    make(chan *Message, 1),
+	}
+	w.Dying = w.tomb.Dying()
+	w.tomb.Go(w.loop)
+	return w
+}
+
+func (w *emailWriter) Err() error {
+	return w.tomb.Err()
+}
+
+func (w *emailWriter) Stop() error {
+	accountDebugf(w.accountName, "Requesting writer to stop...")
+	w.tomb.Kill(errStop)
+	err := w.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+func (w *emailWriter) die() {
+	accountDebugf(w.accountName, "Writer is dead (%v)", w.tomb.Err())
+}
+
+func (w *emailWriter) loop() error {
+	defer w.die()
+
+loop:
+	for {
+		var msg *Message
+		select {
+		case msg = <-w.Outgoing:
+		case <-w.Dying:
+			break loop
+		}
+		switch msg.Command {
+		case cmdQuit:
+			break loop
+		case "", cmdPrivMsg, cmdNotice:
+			break
+		default:
+			continue
+		}
+
+		accountLogf(w.accountName, "Sending: %s", msg.String())
+
+		to := strings.TrimLeft(msg.Channel, "#@")
+		if to == "" {
+			to = msg.Nick
+		}
+		var err error
+		if w.config.SMTP == "" {
+			err = fmt.Errorf("no SMTP server configured")
+		} else if !strings.Contains(to, "@") {
+			err = fmt.Errorf("not an email address: %q", to)
+		} else {
+			err = w.send(to, msg.ThreadId, StripFormatting(msg.Text))
+			if err != nil && !smtpPermanent(err) {
+				w.tomb.Killf("cannot send mail: %v", err)
+				break
+			}
+		}
+
+		// Notify the account manager that the message was delivered,
+		// or that it never will be so it isn't retried.
+		select {
+		case w.r.Incoming <- deliveryPong(w.accountName, msg.Id, err):
+		case <-w.Dying:
+		case <-w.r.Dying:
+		}
+	}
+
+	return nil
+}
+
+// smtpPermanent returns whether err is an SMTP server reply reporting
+// a permanent failure, which retrying the delivery won't fix.
+func smtpPermanent(err error) bool {
+	terr, ok := err.(*textproto.Error)
+	return ok && terr.Code >= 500
+}
+
+// emailSubjectLen is the length after which the first line of an
+// outgoing message is truncated to form the mail subject.
+const emailSubjectLen = 72
+
+// send sends text by mail to the to address. If set, threadId holds the
+// Message-ID of the mail being replied to.
+func (w *emailWriter) send(to, threadId, text string) error {
+	subject := text
+	if i := strings.IndexByte(subject, '\n'); i >= 0 {
+		subject = subject[:i]
+	}
+	if runes := []rune(subject); len(runes) > emailSubjectLen {
+		subject = string(runes[:emailSubjectLen-3]) + "..."
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", w.config.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if threadId != "" {
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\n", threadId)
+		fmt.Fprintf(&buf, "References: %s\r\n", threadId)
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n%s\r\n", text)
+
+	var auth smtp.Auth
+	if w.password != "" {
+		host, _, err := net.SplitHostPort(w.config.SMTP)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", w.identity, w.password, host)
+	}
+	return smtp.SendMail(w.config.SMTP, auth, w.config.From, []string{to}, buf.Bytes())
+}
+
+// ---------------------------------------------------------------------------
+// emailReader
+
+// An emailReader polls the IMAP mailbox and injects new mails in the Incoming channel.
+type emailReader struct {
+	accountName string
+	info        accountInfo
+	config      emailConfig
+	bangs       *bangPrefixes
+	tomb        tomb.Tomb
+
+	Dying    <-chan struct{}
+	Incoming chan *Message
+}
+
+func startEmailReader(info *accountInfo, config emailConfig, bangs *bangPrefixes) *emailReader {
+	r := &emailReader{
+		accountName: info.Name,
+		info:        *info,
+		config:      config,
+		bangs:       bangs,
+		Incoming:    make(chan *Message, 1),
+	}
+	r.Dying = r.tomb.Dying()
+	r.tomb.Go(r.loop)
+	return r
+}
+
+func (r *emailReader) Err() error {
+	return r.tomb.Err()
+}
+
+func (r *emailReader) Stop() error {
+	accountDebugf(r.accountName, "Requesting email reader to stop...")
+	r.tomb.Kill(errStop)
+	err := r.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+func (r *emailReader) die() {
+	accountDebugf(r.accountName, "Reader is dead (%v)", r.tomb.Err())
+}
+
+func (r *emailReader) loop() error {
+	defer r.die()
+
+	if r.info.Host == "" {
+		accountLogf(r.accountName, "No IMAP host configured. Mails will only be sent.")
+		<-r.Dying
+		return nil
+	}
+
+	for {
+		err := r.poll()
+		if err != nil {
+			accountLogf(r.accountName, "Cannot poll IMAP mailbox: %v", err)
+		}
+		select {
+		case <-time.After(r.config.Poll.Duration):
+		case <-r.Dying:
+			return nil
+		}
+	}
+}
+
+// poll delivers all unseen mails in the mailbox and flags them as seen.
+func (r *emailReader) poll() error {
+	c, err := dialIMAP(&r.info)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.Command("LOGIN %s %s", imapQuote(r.info.Identity), imapQuote(r.info.Password))
+	if err != nil {
+		return err
+	}
+	_, err = c.Command("SELECT %s", imapQuote(r.config.Mailbox))
+	if err != nil {
+		return err
+	}
+	resps, err := c.Command("UID SEARCH UNSEEN")
+	if err != nil {
+		return err
+	}
+	var uids []string
+	for _, resp := range resps {
+		if strings.HasPrefix(resp.line, "* SEARCH") {
+			uids = append(uids, strings.Fields(resp.line[len("* SEARCH"):])...)
+		}
+	}
+
+	for _, uid := range uids {
+		if _, err := strconv.ParseUint(uid, 10, 32); err != nil {
+			return fmt.Errorf("invalid message UID in search result: %q", uid)
+		}
+		resps, err := c.Command("UID FETCH %s BODY.PEEK[]", uid)
+		if err != nil {
+			return err
+		}
+		for _, resp := range resps {
+			if !strings.Contains(resp.line, " FETCH ") || len(resp.literals) == 0 {
+				continue
+			}
+			msg, err := r.message(resp.literals[0])
+			if err != nil {
+				accountLogf(r.accountName, "Cannot parse mail with UID %s: %v", uid, err)
+				break
+			}
+			accountLogf(r.accountName, "Received: mail from %s to %s", msg.Nick, msg.Channel)
+			select {
+			case r.Incoming <- msg:
+			case <-r.Dying:
+				return nil
+			}
+		}
+		_, err = c.Command("UID STORE %s +FLAGS.SILENT (\\Seen)", uid)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = c.Command("LOGOUT")
+	return err
+}
+
+// message returns the incoming message for the provided raw mail.
+func (r *emailReader) message(data []byte) (*Message, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		subject = m.Header.Get("Subject")
+	}
+	body, err := emailText(m.Header, m.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimSpace(subject)
+	if body != "" {
+		if text != "" {
+			text += "\n\n"
+		}
+		text += body
+	}
+
+	channel := "@" + from.Address
+	if list := emailListAddress(m.Header.Get("List-Post")); list != "" {
+		channel = "#" + list
+	}
+
+	// The address cannot go into the line prefix, as its @ would be taken
+	// as the host separator, so the nick is set afterwards.
+	msg := r.bangs.parseIncoming(r.accountName, r.info.Nick, fmt.Sprintf(":-!~user@email PRIVMSG %s :%s", channel, text))
+	msg.Nick = from.Address
+	msg.ThreadId = strings.TrimSpace(m.Header.Get("Message-Id"))
+	if date, err := m.Header.Date(); err == nil {
+		msg.Time = date
+	}
+	return msg, nil
+}
+
+type emailHeader interface {
+	Get(key string) string
+}
+
+// emailText returns the plain text content of a mail body, picking the
+// first text/plain part of multipart bodies.
+func emailText(header emailHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := emailText(part.Header, part)
+			if err != nil || text != "" {
+				return text, err
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.Replace(string(data), "\r\n", "\n", -1)), nil
+}
+
+// emailListAddress returns the posting address in a List-Post header value,
+// as in "<mailto:list@example.com>", or the empty string if there's none.
+func emailListAddress(listPost string) string {
+	listPost = strings.TrimSpace(listPost)
+	if !strings.HasPrefix(listPost, "<mailto:") {
+		return ""
+	}
+	address := strings.TrimPrefix(listPost, "<mailto:")
+	if i := strings.IndexAny(address, "?>"); i >= 0 {
+		address = address[:i]
+	}
+	return address
+}
+
+// ---------------------------------------------------------------------------
+// IMAP
+
+// imapConn is a minimal IMAP client supporting the few commands needed
+// to poll a mailbox.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is a single IMAP response, with the content of any literals
+// it holds taken out of the line and stored apart.
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+func dialIMAP(info *accountInfo) (*imapConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: NetworkTimeout}
+	if info.TLS {
+		var config tls.Config
+		if info.TLSInsecure {
+			config.InsecureSkipVerify = true
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", info.Host, &config)
+	} else {
+		conn, err = dialer.Dial("tcp", info.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(NetworkTimeout))
+	greeting, err := c.readResponse()
+	if err == nil && !strings.HasPrefix(greeting.line, "* OK") {
+		err = fmt.Errorf("unexpected IMAP server greeting: %q", greeting.line)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *imapConn) Close() error {
+	return c.conn.Close()
+}
+
+// Command sends a command to the server and returns the untagged responses
+// received before its completion, or an error if it did not succeed.
+func (c *imapConn) Command(format string, args ...interface{}) ([]*imapResponse, error) {
+	c.tag++
+	tag := "m" + strconv.Itoa(c.tag)
+	c.conn.SetDeadline(time.Now().Add(NetworkTimeout))
+	_, err := fmt.Fprintf(c.conn, tag+" "+format+"\r\n", args...)
+	if err != nil {
+		return nil, err
+	}
+	var resps []*imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(resp.line, tag+" ") {
+			status := resp.line[len(tag)+1:]
+			if !strings.HasPrefix(status, "OK") {
+				return nil, fmt.Errorf("IMAP command failed: %s", status)
+			}
+			return resps, nil
+		}
+		resps = append(resps, resp)
+	}
+}
+
+func (c *imapConn) readResponse() (*imapResponse, error) {
+	resp := &imapResponse{}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasSuffix(line, "}") {
+			if i := strings.LastIndexByte(line, '{'); i >= 0 {
+				if n, err := strconv.Atoi(line[i+1 : len(line)-1]); err == nil && n >= 0 {
+					literal := make([]byte, n)
+					_, err := io.ReadFull(c.r, literal)
+					if err != nil {
+						return nil, err
+					}
+					resp.literals = append(resp.literals, literal)
+					resp.line += line[:i]
+					continue
+				}
+			}
+		}
+		resp.line += line
+		return resp, nil
+	}
+}
+
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,423 @@
+package mup_test
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+type EmailSuite struct {
+	config *mup.Config
+	server *mup.Server
+
+	dbdir string
+	db    *sql.DB
+
+	imap *fakeIMAP
+	smtp *fakeSMTP
+}
+
+var _ = Suite(&EmailSuite{})
+
+func (s *EmailSuite) SetUpTest(c *C) {
+	mup.SetDebug(true)
+	mup.SetLogger(c)
+
+	s.dbdir = c.MkDir()
+
+	var err error
+	s.db, err = mup.OpenDB(s.dbdir)
+	c.Assert(err, IsNil)
+
+	s.config = &mup.Config{
+		DB:      s.db,
+		Refresh: -1, // Manual refreshing for testing.
+	}
+
+	s.imap = startFakeIMAP(c)
+	s.smtp = startFakeSMTP(c)
+}
+
+func (s *EmailSuite) TearDownTest(c *C) {
+	mup.SetDebug(false)
+	mup.SetLogger(nil)
+
+	if s.server != nil {
+		s.server.Stop()
+		s.server = nil
+	}
+	s.imap.Close()
+	s.smtp.Close()
+
+	s.db.Close()
+	s.db = nil
+}
+
+func (s *EmailSuite) Start(c *C, host string, config mup.Map) {
+	data, err := json.Marshal(config)
+	c.Assert(err, IsNil)
+	_, err = s.db.Exec(`INSERT INTO account (name,kind,host,nick,identity,password,config) VALUES ('one','email',?,'mup','mup@example.com','sec"ret',?)`,
+		host, string(data))
+	c.Assert(err, IsNil)
+
+	s.server, err = mup.Start(s.config)
+	c.Assert(err, IsNil)
+}
+
+const emailPlain = "From: Joe <joe@example.com>\r\n" +
+	"To: mup@example.com\r\n" +
+	"Subject: Hello mup!\r\n" +
+	"Date: Wed, 08 Apr 2020 21:58:14 +0000\r\n" +
+	"Message-Id: <1234@example.com>\r\n" +
+	"\r\n" +
+	"How are you?\r\n"
+
+const emailList = "From: ann@example.com\r\n" +
+	"To: list@example.com\r\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+	"List-Post: <mailto:list@example.com?subject=help>\r\n" +
+	"Date: Wed, 08 Apr 2020 21:58:15 +0000\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=XYZ\r\n" +
+	"\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Ignored</p>\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Anyone up for a caf=C3=A9?\r\n" +
+	"--XYZ--\r\n"
+
+func (s *EmailSuite) TestIncoming(c *C) {
+	s.imap.Add(7, emailPlain)
+	s.imap.Add(9, emailList)
+
+	s.Start(c, s.imap.Addr(), mup.Map{"poll": "50ms"})
+
+	var msgs []mup.Message
+	for i := 0; i < 100; i++ {
+		msgs = nil
+		rows, err := s.db.Query("SELECT lane,account,nick,host,command,channel,text,bottext,asnick,threadid,time FROM message ORDER BY id")
+		c.Assert(err, IsNil)
+		for rows.Next() {
+			var msg mup.Message
+			err = rows.Scan(&msg.Lane, &msg.Account, &msg.Nick, &msg.Host, &msg.Command, &msg.Channel, &msg.Text, &msg.BotText, &msg.AsNick, &msg.ThreadId, &msg.Time)
+			c.Assert(err, IsNil)
+			msgs = append(msgs, msg)
+		}
+		c.Assert(rows.Close(), IsNil)
+		if len(msgs) >= 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(msgs, HasLen, 2)
+
+	c.Assert(msgs[0].Time.UTC().String(), Equals, "2020-04-08 21:58:14 +0000 UTC")
+	c.Assert(msgs[1].Time.UTC().String(), Equals, "2020-04-08 21:58:15 +0000 UTC")
+	msgs[0].Time = time.Time{}
+	msgs[1].Time = time.Time{}
+
+	c.Assert(msgs[0], DeepEquals, mup.Message{
+		Lane:     1,
+		Account:  "one",
+		Nick:     "joe@example.com",
+		Host:     "email",
+		Command:  "PRIVMSG",
+		Channel:  "@joe@example.com",
+		Text:     "Hello mup!\n\nHow are you?",
+		BotText:  "Hello mup!\n\nHow are you?",
+		AsNick:   "mup",
+		ThreadId: "<1234@example.com>",
+	})
+	c.Assert(msgs[1], DeepEquals, mup.Message{
+		Lane:    1,
+		Account: "one",
+		Nick:    "ann@example.com",
+		Host:    "email",
+		Command: "PRIVMSG",
+		Channel: "#list@example.com",
+		Text:    "Café\n\nAnyone up for a café?",
+		AsNick:  "mup",
+	})
+
+	// Mails are flagged as seen once delivered, and not delivered again.
+	for i := 0; i < 100 && len(s.imap.Unseen()) > 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(s.imap.Unseen(), HasLen, 0)
+	time.Sleep(150 * time.Millisecond)
+
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM message").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+
+	commands := s.imap.Commands()
+	c.Assert(commands[0], Equals, `LOGIN "mup@example.com" "sec\"ret"`)
+	c.Assert(commands[1], Equals, `SELECT "INBOX"`)
+	c.Assert(commands[2], Equals, `UID SEARCH UNSEEN`)
+	c.Assert(commands[3], Equals, `UID FETCH 7 BODY.PEEK[]`)
+	c.Assert(commands[4], Equals, `UID STORE 7 +FLAGS.SILENT (\Seen)`)
+}
+
+func (s *EmailSuite) TestOutgoing(c *C) {
+	s.Start(c, "", mup.Map{"smtp": s.smtp.Addr(), "from": "bot@example.com"})
+
+	// Ensure messages are only inserted after the account is running.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','#list@example.com','','Build failed.')`,
+		`INSERT INTO message (lane,account,channel,nick,text,threadid) VALUES (2,'one','@joe@example.com','','Hello Joe.','<1234@example.com>')`,
+	)
+
+	var mails []fakeMail
+	for i := 0; i < 100; i++ {
+		mails = s.smtp.Mails()
+		if len(mails) == 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(mails, HasLen, 2)
+
+	c.Assert(mails[0].auth, Equals, "AUTH PLAIN AG11cEBleGFtcGxlLmNvbQBzZWMicmV0")
+	c.Assert(mails[0].from, Equals, "<bot@example.com>")
+	c.Assert(mails[0].to, Equals, "<list@example.com>")
+	c.Assert(mails[0].data, Matches, `(?s)From: bot@example.com\r\nTo: list@example.com\r\nSubject: Build failed.\r\n.*\r\n\r\nBuild failed.\r\n`)
+	c.Assert(mails[1].to, Equals, "<joe@example.com>")
+	c.Assert(mails[1].data, Matches, `(?s).*\r\nIn-Reply-To: <1234@example.com>\r\nReferences: <1234@example.com>\r\n.*\r\n\r\nHello Joe.\r\n`)
+}
+
+func (s *EmailSuite) TestOutgoingFailure(c *C) {
+	s.Start(c, "", mup.Map{"smtp": s.smtp.Addr(), "from": "bot@example.com"})
+
+	// Ensure messages are only inserted after the account is running.
+	s.server.RefreshAccounts()
+
+	// Mails that can never be delivered are reported as failed, and the
+	// account moves on without retrying them.
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@nobody@example.com','','Rejected.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@joe','','Not an address.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@joe@example.com','','Hello Joe.')`,
+	)
+
+	var mails []fakeMail
+	for i := 0; i < 100; i++ {
+		mails = s.smtp.Mails()
+		if len(mails) == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(mails, HasLen, 1)
+	c.Assert(mails[0].to, Equals, "<joe@example.com>")
+
+	for _, failed := range []string{
+		`Cannot deliver message 1: 550 "No such user"`,
+		`Cannot deliver message 2: not an email address: "joe"`,
+	} {
+		waitFor(func() bool { return strings.Contains(c.GetTestLog(), failed) })
+		c.Assert(strings.Contains(c.GetTestLog(), failed), Equals, true, Commentf("Missing log: %s", failed))
+	}
+}
+
+type fakeIMAP struct {
+	l        net.Listener
+	mu       sync.Mutex
+	mails    map[int]string
+	seen     map[int]bool
+	commands []string
+}
+
+func startFakeIMAP(c *C) *fakeIMAP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s := &fakeIMAP{l: l, mails: make(map[int]string), seen: make(map[int]bool)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeIMAP) Addr() string { return s.l.Addr().String() }
+func (s *fakeIMAP) Close()       { s.l.Close() }
+
+func (s *fakeIMAP) Add(uid int, mail string) {
+	s.mu.Lock()
+	s.mails[uid] = mail
+	s.mu.Unlock()
+}
+
+func (s *fakeIMAP) Unseen() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unseen []int
+	for uid := range s.mails {
+		if !s.seen[uid] {
+			unseen = append(unseen, uid)
+		}
+	}
+	return unseen
+}
+
+func (s *fakeIMAP) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *fakeIMAP) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeIMAP) handle(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "* OK Fake IMAP ready\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
+		tag, command := fields[0], fields[1]
+
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		switch {
+		case command == "UID SEARCH UNSEEN":
+			fmt.Fprintf(conn, "* SEARCH")
+			for uid := 1; uid < 100; uid++ {
+				if _, ok := s.mails[uid]; ok && !s.seen[uid] {
+					fmt.Fprintf(conn, " %d", uid)
+				}
+			}
+			fmt.Fprintf(conn, "\r\n")
+		case strings.HasPrefix(command, "UID FETCH "):
+			var uid int
+			fmt.Sscanf(command, "UID FETCH %d", &uid)
+			mail := s.mails[uid]
+			fmt.Fprintf(conn, "* 1 FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", uid, len(mail), mail)
+		case strings.HasPrefix(command, "UID STORE "):
+			var uid int
+			fmt.Sscanf(command, "UID STORE %d", &uid)
+			s.seen[uid] = true
+		case command == "LOGOUT":
+			fmt.Fprintf(conn, "* BYE\r\n%s OK LOGOUT completed\r\n", tag)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		fmt.Fprintf(conn, "%s OK Done\r\n", tag)
+	}
+}
+
+type fakeMail struct {
+	auth string
+	from string
+	to   string
+	data string
+}
+
+type fakeSMTP struct {
+	l     net.Listener
+	mu    sync.Mutex
+	mails []fakeMail
+}
+
+func startFakeSMTP(c *C) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	s := &fakeSMTP{l: l}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) Addr() string { return s.l.Addr().String() }
+func (s *fakeSMTP) Close()       { s.l.Close() }
+
+func (s *fakeSMTP) Mails() []fakeMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMail(nil), s.mails...)
+}
+
+func (s *fakeSMTP) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTP) handle(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "220 localhost Fake SMTP\r\n")
+	r := bufio.NewReader(conn)
+	var mail fakeMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "EHLO "):
+			fmt.Fprintf(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+		case strings.HasPrefix(line, "AUTH "):
+			mail.auth = line
+			fmt.Fprintf(conn, "235 Authenticated\r\n")
+		case strings.HasPrefix(line, "MAIL FROM:"):
+			mail.from = strings.Fields(line[len("MAIL FROM:"):])[0]
+			fmt.Fprintf(conn, "250 OK\r\n")
+		case strings.HasPrefix(line, "RCPT TO:"):
+			mail.to = line[len("RCPT TO:"):]
+			if strings.HasPrefix(mail.to, "<nobody@") {
+				fmt.Fprintf(conn, "550 No such user\r\n")
+			} else {
+				fmt.Fprintf(conn, "250 OK\r\n")
+			}
+		case line == "DATA":
+			fmt.Fprintf(conn, "354 Go ahead\r\n")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				mail.data += line
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, mail)
+			s.mu.Unlock()
+			fmt.Fprintf(conn, "250 Queued\r\n")
+		case line == "QUIT":
+			fmt.Fprintf(conn, "221 Bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "250 OK\r\n")
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package mup
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event holds a payload published by a plugin under a topic, so that
+// other plugins may consume it without going through chat messages.
+//
+// See Plugger.Publish, Plugger.Event, Plugger.Subscribe, and EventHandler.
+type Event struct {
+	// Id is the sequentially assigned id of events recorded in the
+	// database via Plugger.Event, and zero for events only published.
+	Id int64
+
+	// Topic is the topic the event was published under, such as
+	// "github.push".
+	Topic string
+
+	// Plugin is the name of the plugin that published the event.
+	Plugin string
+
+	Time time.Time
+
+	payload json.RawMessage
+}
+
+// Payload unmarshals into result the event payload.
+// The unmarshaling is performed by the json package.
+func (e *Event) Payload(result interface{}) error {
+	err := json.Unmarshal(e.payload, result)
+	if err != nil {
+		return fmt.Errorf("cannot parse %q event payload: %v", e.Topic, err)
+	}
+	return nil
+}
+
+// topicMatches returns whether the subscription pattern matches topic.
+// Patterns ending in "*" match all topics with the preceding prefix.
+func topicMatches(pattern, topic string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(topic, pattern[:len(pattern)-1])
+	}
+	return pattern == topic
+}
+
+// Publish delivers an event with the provided topic and payload to all
+// running plugins that subscribed to the topic. The payload is marshaled
+// with the json package, so publishers and subscribers need not share
+// any types. Publish does not wait for the event to be handled.
+func (p *Plugger) Publish(topic string, payload interface{}) error {
+	ev, err := p.newEvent(topic, payload)
+	if err != nil {
+		return err
+	}
+	if p.publish == nil {
+		return fmt.Errorf("cannot publish %q event: no event bus available", topic)
+	}
+	return p.publish(ev)
+}
+
+// Event records an event with the provided topic and payload in the
+// event table of the database, and then publishes it as done by Publish.
+// Recorded events remain available to consumers that aren't running
+// plugins, such as clients of the /events endpoint of the HTTP server,
+// for as long as messages are retained.
+//
+// Announcements made via Announce are recorded as events with a topic
+// made of the plugin name and the announced event, as in "ciwatch.failed",
+// and the announcement itself as the payload.
+func (p *Plugger) Event(topic string, payload interface{}) error {
+	ev, err := p.newEvent(topic, payload)
+	if err != nil {
+		return err
+	}
+	if p.db != nil {
+		result, err := p.db.Exec("INSERT INTO event (time,plugin,topic,payload) VALUES (?,?,?,?)",
+			ev.Time, ev.Plugin, ev.Topic, string(ev.payload))
+		if err == nil {
+			ev.Id, err = result.LastInsertId()
+		}
+		if err != nil {
+			return fmt.Errorf("cannot record %q event: %v", topic, err)
+		}
+	}
+	if p.publish == nil {
+		return nil
+	}
+	return p.publish(ev)
+}
+
+func (p *Plugger) newEvent(topic string, payload interface{}) (*Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal %q event payload: %v", topic, err)
+	}
+	return &Event{
+		Topic:   topic,
+		Plugin:  p.name,
+		Time:    time.Now(),
+		payload: data,
+	}, nil
+}
+
+// Subscribe makes the plugin receive events published under topic via
+// its HandleEvent method, which it must implement as per EventHandler.
+// A topic ending in "*" subscribes to all topics with that prefix, so
+// "github.*" receives both "github.push" and "github.issue" events.
+//
+// Subscriptions are usually made when the plugin starts, and last until
+// it's stopped. Events published by the plugin itself are also delivered
+// to it if it subscribes to their topic.
+func (p *Plugger) Subscribe(topic string) {
+	p.topicsMutex.Lock()
+	p.topics = append(p.topics, topic)
+	p.topicsMutex.Unlock()
+}
+
+// subscribed returns whether the plugin subscribed to topic.
+func (p *Plugger) subscribed(topic string) bool {
+	p.topicsMutex.Lock()
+	defer p.topicsMutex.Unlock()
+	for _, pattern := range p.topics {
+		if topicMatches(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plugger) setPublisher(publish func(ev *Event) error) {
+	p.publish = publish
+}
+
+// publishEvent queues ev for delivery by the manager loop. It must not
+// block, as plugins may publish events while handling messages in the
+// loop itself.
+func (m *pluginManager) publishEvent(ev *Event) error {
+	if !m.tomb.Alive() {
+		panic("plugin attempted to publish event after its Stop method returned")
+	}
+	m.eventsMutex.Lock()
+	m.events = append(m.events, ev)
+	m.eventsMutex.Unlock()
+	select {
+	case m.eventReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// handleEvents delivers all queued events to the subscribed plugins.
+func (m *pluginManager) handleEvents() {
+	m.eventsMutex.Lock()
+	events := m.events
+	m.events = nil
+	m.eventsMutex.Unlock()
+	for _, ev := range events {
+		for _, state := range m.plugins {
+			if !state.plugger.subscribed(ev.Topic) {
+				continue
+			}
+			if err := state.safeEvent(ev, m.config.HandlerTimeout); err != nil {
+				m.restartPlugin(state, err)
+			}
+		}
+	}
+}
+
+// eventBatch is the maximum number of events served at once.
+const eventBatch = 100
+
+// eventDoc is the JSON document representing an event served over HTTP.
+type eventDoc struct {
+	Id      int64           `json:"id"`
+	Time    time.Time       `json:"time"`
+	Plugin  string          `json:"plugin"`
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// fetchEvents returns up to eventBatch recorded events with ids above
+// after, optionally restricted to the provided topic pattern and plugin.
+func fetchEvents(db *sql.DB, topic, plugin string, after int64) ([]eventDoc, error) {
+	query := "SELECT id,time,plugin,topic,payload FROM event WHERE id>?"
+	args := []interface{}{after}
+	if strings.HasSuffix(topic, "*") {
+		query += " AND substr(topic,1,?)=?"
+		args = append(args, len(topic)-1, topic[:len(topic)-1])
+	} else if topic != "" {
+		query += " AND topic=?"
+		args = append(args, topic)
+	}
+	if plugin != "" {
+		query += " AND plugin=?"
+		args = append(args, plugin)
+	}
+	query += " ORDER BY id LIMIT " + strconv.Itoa(eventBatch)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	docs := []eventDoc{}
+	for rows.Next() {
+		var doc eventDoc
+		var payload string
+		if err := rows.Scan(&doc.Id, &doc.Time, &doc.Plugin, &doc.Topic, &payload); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		doc.Payload = json.RawMessage(payload)
+		docs = append(docs, doc)
+	}
+	return docs, rows.Close()
+}
+
+// serveEvents reports recorded events as a JSON list, oldest first. The
+// list may be filtered by providing a topic parameter, which may end in
+// "*" to match a topic prefix, and a plugin parameter. Clients page
+// through events by providing the id of the last event seen in the after
+// parameter.
+func (st *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var after int64
+	if s := query.Get("after"); s != "" {
+		var err error
+		after, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || after < 0 {
+			http.Error(w, fmt.Sprintf("invalid event id in after parameter: %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	docs, err := fetchEvents(st.config.DB, query.Get("topic"), query.Get("plugin"), after)
+	var data []byte
+	if err == nil {
+		data, err = json.MarshalIndent(docs, "", "\t")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
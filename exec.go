@@ -0,0 +1,372 @@
+package mup
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var execPluginSpec = PluginSpec{
+	Name: "exec",
+	Help: `Runs a plugin implemented by an external program.
+
+	The "command" setting names the program to run and "args" its
+	arguments. The program speaks JSON-RPC 2.0 over its standard input
+	and output, one document per line, and is restarted if it exits.
+	Use plugin labels (exec/name) to run several programs.
+
+	Once started the program is asked for its help and commands via a
+	"start" request, with the plugin name, config, and targets as
+	parameters. The result must hold "help" and "commands", the latter
+	encoded as schema.Commands. It is then notified of "message",
+	"outgoing", and "command" events, and may issue "send", "reply",
+	"handle", "getstate", "setstate", and "log" requests.
+	`,
+	Start: startExecPlugin,
+}
+
+func init() {
+	RegisterPlugin(&execPluginSpec)
+}
+
+// dynamicSpecer is implemented by plugins that only learn their help and
+// commands once started, such as plugins implemented by external programs.
+type dynamicSpecer interface {
+	dynamicSpec() *PluginSpec
+}
+
+// execRestartDelay is how long to wait before restarting a plugin
+// program that terminated.
+var execRestartDelay = 5 * time.Second
+
+// execStopTimeout is how long a plugin program has to exit after its
+// input is closed before it is killed.
+const execStopTimeout = 3 * time.Second
+
+// execStartTimeout is how long a plugin program has to reply to the
+// start request before it is killed.
+var execStartTimeout = 10 * time.Second
+
+type execConfig struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+type execPlugin struct {
+	plugger *Plugger
+	config  execConfig
+	tomb    tomb.Tomb
+
+	mu   sync.Mutex
+	rpc  *jsonRPC
+	spec *PluginSpec
+}
+
+func startExecPlugin(plugger *Plugger) Stopper {
+	p := &execPlugin{plugger: plugger}
+	p.spec = &PluginSpec{Name: plugger.Name(), Start: startExecPlugin}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Command == "" {
+		plugger.Logf("Plugin has no command configured.")
+		p.tomb.Go(func() error {
+			<-p.tomb.Dying()
+			return nil
+		})
+		return p
+	}
+
+	// Wait for the program to report its commands, so that they are
+	// known by the time the plugin manager handles messages.
+	var once sync.Once
+	started := make(chan struct{})
+	ready := func() { once.Do(func() { close(started) }) }
+	p.tomb.Go(func() error {
+		p.supervise(ready)
+		return nil
+	})
+	<-started
+	return p
+}
+
+func (p *execPlugin) Stop() error {
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+// dynamicSpec returns the help and commands reported by the plugin program
+// when last started. The returned spec is never modified, and a new one is
+// returned after the program is restarted.
+func (p *execPlugin) dynamicSpec() *PluginSpec {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.spec
+}
+
+func (p *execPlugin) HandleMessage(msg *Message) {
+	p.notify("message", &execMessageParams{Message: msg})
+}
+
+func (p *execPlugin) HandleOutgoing(msg *Message) {
+	p.notify("outgoing", &execMessageParams{Message: msg})
+}
+
+func (p *execPlugin) HandleCommand(cmd *Command) {
+	var args json.RawMessage
+	err := cmd.Args(&args)
+	if err != nil {
+		p.plugger.Logf("%v", err)
+		return
+	}
+	p.notify("command", &execCommandParams{Name: cmd.Name(), Args: args, Message: cmd.Message})
+}
+
+func (p *execPlugin) notify(method string, params interface{}) {
+	p.mu.Lock()
+	rpc := p.rpc
+	p.mu.Unlock()
+	if rpc == nil {
+		p.plugger.Debugf("Plugin program not running; dropping %s notification.", method)
+		return
+	}
+	err := rpc.notify(method, params)
+	if err != nil {
+		p.plugger.Logf("Cannot notify plugin program: %v", err)
+	}
+}
+
+type execStartParams struct {
+	Name    string          `json:"name"`
+	Config  json.RawMessage `json:"config"`
+	Targets []Target        `json:"targets"`
+}
+
+type execStartResult struct {
+	Help     string          `json:"help"`
+	Commands schema.Commands `json:"commands"`
+}
+
+type execMessageParams struct {
+	Message *Message `json:"message"`
+}
+
+type execCommandParams struct {
+	Name    string          `json:"name"`
+	Args    json.RawMessage `json:"args"`
+	Message *Message        `json:"message"`
+}
+
+type execReplyParams struct {
+	To   *Message `json:"to"`
+	Text string   `json:"text"`
+}
+
+type execLogParams struct {
+	Text string `json:"text"`
+}
+
+// supervise runs the plugin program until the plugin is stopped,
+// restarting it whenever it terminates.
+func (p *execPlugin) supervise(ready func()) {
+	defer ready()
+	for {
+		err := p.run(ready)
+		if !p.tomb.Alive() {
+			return
+		}
+		p.plugger.Logf("Plugin program terminated: %v", err)
+		ready()
+		select {
+		case <-time.After(execRestartDelay):
+		case <-p.tomb.Dying():
+			return
+		}
+	}
+}
+
+func (p *execPlugin) run(ready func()) error {
+	cmd := exec.Command(p.config.Command, p.config.Args...)
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("cannot open plugin program input pipe: %v", err)
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cannot open plugin program output pipe: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("cannot open plugin program error pipe: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("cannot start plugin program: %v", err)
+	}
+	p.plugger.Debugf("Started plugin program: %s", p.config.Command)
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			p.plugger.Logf("%s", scanner.Text())
+		}
+	}()
+
+	exited := make(chan struct{})
+	rpc := newJSONRPC("plugin program", exited)
+	rpc.start(input)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.read(rpc, output)
+		close(exited)
+	}()
+
+	var result execStartResult
+	ctx, cancel := context.WithTimeout(p.tomb.Context(nil), execStartTimeout)
+	err = rpc.call(ctx.Done(), "start", &execStartParams{
+		Name:    p.plugger.Name(),
+		Config:  p.plugger.config,
+		Targets: p.plugger.Targets(),
+	}, &result)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("no reply to start request after %v", execStartTimeout)
+	}
+	cancel()
+	if err == nil {
+		p.mu.Lock()
+		spec := *p.spec
+		spec.Help = result.Help
+		spec.Commands = result.Commands
+		p.spec = &spec
+		p.rpc = rpc
+		p.mu.Unlock()
+	} else {
+		err = fmt.Errorf("cannot start plugin program: %v", err)
+		cmd.Process.Kill()
+	}
+	ready()
+
+	if err == nil {
+		select {
+		case err = <-done:
+		case <-p.tomb.Dying():
+			// Closing the input asks the program to exit.
+			input.Close()
+			select {
+			case <-done:
+			case <-time.After(execStopTimeout):
+				cmd.Process.Kill()
+				<-done
+			}
+		}
+	} else {
+		<-done
+	}
+
+	p.mu.Lock()
+	p.rpc = nil
+	p.mu.Unlock()
+	cmd.Process.Kill()
+	cmd.Wait()
+	return err
+}
+
+// read handles the responses and requests sent by the plugin program
+// until its output is closed.
+func (p *execPlugin) read(rpc *jsonRPC, output io.Reader) error {
+	decoder := json.NewDecoder(output)
+	for {
+		var msg jsonRPCMessage
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			return fmt.Errorf("program exited")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot decode plugin program payload: %v", err)
+		}
+		switch {
+		case msg.Method != "":
+			result, err := p.request(msg.Method, msg.Params)
+			if msg.Id != nil {
+				err = rpc.reply(*msg.Id, result, err)
+			}
+			if err != nil {
+				p.plugger.Logf("Cannot handle plugin program %s request: %v", msg.Method, err)
+			}
+		case msg.Id != nil:
+			rpc.dispatch(&msg)
+		}
+	}
+}
+
+var errExecNoDB = fmt.Errorf("plugin state is not available without a database")
+
+// request performs the request made by the plugin program.
+func (p *execPlugin) request(method string, params json.RawMessage) (result interface{}, err error) {
+	switch method {
+	case "send", "handle":
+		var args execMessageParams
+		err = json.Unmarshal(params, &args)
+		if err == nil && args.Message == nil {
+			err = fmt.Errorf("missing message")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if method == "send" {
+			return nil, p.plugger.Send(args.Message)
+		}
+		return nil, p.plugger.Handle(args.Message)
+	case "reply":
+		var args execReplyParams
+		err = json.Unmarshal(params, &args)
+		if err == nil && args.To == nil {
+			err = fmt.Errorf("missing message to reply to")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, p.plugger.Sendf(args.To, "%s", args.Text)
+	case "getstate":
+		db := p.plugger.DB()
+		if db == nil {
+			return nil, errExecNoDB
+		}
+		var state string
+		err = db.QueryRow("SELECT state FROM plugin WHERE name=?", p.plugger.Name()).Scan(&state)
+		if err == sql.ErrNoRows || err == nil && state == "" {
+			return json.RawMessage("null"), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(state), nil
+	case "setstate":
+		db := p.plugger.DB()
+		if db == nil {
+			return nil, errExecNoDB
+		}
+		_, err = dbExec(db, "UPDATE plugin SET state=? WHERE name=?", string(params), p.plugger.Name())
+		return nil, err
+	case "log":
+		var args execLogParams
+		err = json.Unmarshal(params, &args)
+		if err != nil {
+			return nil, err
+		}
+		p.plugger.Logf("%s", args.Text)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown method: %q", method)
+}
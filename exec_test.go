@@ -0,0 +1,263 @@
+package mup_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+type ExecSuite struct {
+	restore func()
+}
+
+var _ = Suite(&ExecSuite{})
+
+func (s *ExecSuite) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+	os.Setenv("MUP_EXEC_PLUGIN_HELPER", "1")
+	s.restore = mup.SetExecRestartDelay(50 * time.Millisecond)
+}
+
+func (s *ExecSuite) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+	os.Unsetenv("MUP_EXEC_PLUGIN_HELPER")
+	s.restore()
+}
+
+func (s *ExecSuite) startTester(db *sql.DB) *mup.PluginTester {
+	tester := mup.NewPluginTester("exec/helper")
+	tester.SetConfig(mup.Map{
+		"command": os.Args[0],
+		"args":    []string{"-test.run=TestExecPluginHelper"},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test"}})
+	if db != nil {
+		tester.SetDB(db)
+	}
+	tester.Start()
+	return tester
+}
+
+func (s *ExecSuite) TestMessages(c *C) {
+	tester := s.startTester(nil)
+	defer tester.Stop()
+
+	tester.Sendf("[#chan] ping")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :pong")
+	tester.Sendf("[#chan] something else")
+	tester.Sendf("[#chan] mup: hello Joe")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: Hello, Joe!")
+	tester.Sendf("hello")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Oops: missing input for argument: name")
+	tester.Sendf("[#chan] handle")
+	c.Assert(tester.RecvIncoming(), Equals, "PRIVMSG #chan :handled")
+}
+
+func (s *ExecSuite) TestState(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO plugin (name) VALUES ('exec/helper')")
+	c.Assert(err, IsNil)
+
+	tester := s.startTester(db)
+	tester.Sendf("count")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :1")
+	tester.Sendf("count")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :2")
+	tester.Stop()
+
+	var state string
+	err = db.QueryRow("SELECT state FROM plugin WHERE name='exec/helper'").Scan(&state)
+	c.Assert(err, IsNil)
+	c.Assert(state, Equals, "2")
+}
+
+func (s *ExecSuite) TestRestart(c *C) {
+	tester := s.startTester(nil)
+	defer tester.Stop()
+
+	tester.Sendf("[#chan] crash")
+	var replies []string
+	waitFor(func() bool {
+		tester.Sendf("[#chan] ping")
+		time.Sleep(20 * time.Millisecond)
+		replies = tester.RecvAll()
+		return len(replies) > 0
+	})
+	c.Assert(replies, DeepEquals, []string{"PRIVMSG #chan :pong"})
+}
+
+func (s *ExecSuite) TestStartTimeout(c *C) {
+	defer mup.SetExecStartTimeout(100 * time.Millisecond)()
+	os.Setenv("MUP_EXEC_PLUGIN_HELPER", "hang")
+
+	tester := s.startTester(nil)
+	defer tester.Stop()
+	waitFor(func() bool {
+		return strings.Contains(c.GetTestLog(), "Plugin program terminated: cannot start plugin program: no reply to start request after 100ms")
+	})
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Plugin program terminated: cannot start plugin program: no reply to start request after 100ms.*`)
+
+	// The program is killed and started again.
+	os.Setenv("MUP_EXEC_PLUGIN_HELPER", "1")
+	var replies []string
+	waitFor(func() bool {
+		tester.Sendf("[#chan] ping")
+		time.Sleep(20 * time.Millisecond)
+		replies = tester.RecvAll()
+		return len(replies) > 0
+	})
+	c.Assert(replies, DeepEquals, []string{"PRIVMSG #chan :pong"})
+}
+
+func (s *ExecSuite) TestRestartCommands(c *C) {
+	tester := s.startTester(nil)
+	defer tester.Stop()
+
+	tester.Sendf("extra")
+	tester.Sendf("[#chan] ping")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :pong")
+
+	// Commands reported by the restarted program are handled.
+	os.Setenv("MUP_EXEC_PLUGIN_HELPER", "extra")
+	tester.Sendf("[#chan] crash")
+	var replies []string
+	waitFor(func() bool {
+		tester.Sendf("extra")
+		time.Sleep(20 * time.Millisecond)
+		replies = tester.RecvAll()
+		return len(replies) > 0
+	})
+	c.Assert(replies, DeepEquals, []string{"PRIVMSG nick :Extra!"})
+}
+
+func (s *ExecSuite) TestHelp(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	config := &mup.Config{DB: db, Refresh: -1}
+	execSQL(c, db,
+		`INSERT INTO account (name,kind) VALUES ('none','none')`,
+		fmt.Sprintf(`INSERT INTO plugin (name,config) VALUES ('exec/helper','{"command": %q, "args": ["-test.run=TestExecPluginHelper"]}')`, os.Args[0]),
+	)
+	server, err := mup.Start(config)
+	c.Assert(err, IsNil)
+	defer server.Stop()
+
+	var help string
+	waitFor(func() bool {
+		err = db.QueryRow("SELECT help FROM commandschema WHERE plugin='exec/helper' AND command='hello'").Scan(&help)
+		return err == nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(help, Equals, "Says hello.")
+}
+
+// TestExecPluginHelper is not a real test. It acts as the external plugin
+// program when the test binary is run by the exec plugin.
+func TestExecPluginHelper(t *testing.T) {
+	switch os.Getenv("MUP_EXEC_PLUGIN_HELPER") {
+	case "1", "hang", "extra":
+	default:
+		return
+	}
+	runExecPluginHelper()
+	os.Exit(0)
+}
+
+type helperRequest struct {
+	Id     *int64          `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+func runExecPluginHelper() {
+	encoder := json.NewEncoder(os.Stdout)
+	decoder := json.NewDecoder(os.Stdin)
+
+	var lastId int64
+	call := func(method string, params interface{}) json.RawMessage {
+		lastId++
+		encoder.Encode(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": lastId})
+		for {
+			var resp helperRequest
+			if decoder.Decode(&resp) != nil {
+				os.Exit(1)
+			}
+			if resp.Method == "" && resp.Id != nil && *resp.Id == lastId {
+				return resp.Result
+			}
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Helper plugin running.\n")
+	for {
+		var req helperRequest
+		if decoder.Decode(&req) != nil {
+			return
+		}
+		switch req.Method {
+		case "start":
+			mode := os.Getenv("MUP_EXEC_PLUGIN_HELPER")
+			if mode == "hang" {
+				continue
+			}
+			commands := []interface{}{
+				map[string]interface{}{"name": "hello", "help": "Says hello.", "args": []interface{}{
+					map[string]interface{}{"name": "name", "flag": 1},
+				}},
+				map[string]interface{}{"name": "count"},
+			}
+			if mode == "extra" {
+				commands = append(commands, map[string]interface{}{"name": "extra"})
+			}
+			encoder.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": *req.Id, "result": map[string]interface{}{
+				"help":     "Test plugin.",
+				"commands": commands,
+			}})
+		case "message":
+			var params struct{ Message mup.Message }
+			json.Unmarshal(req.Params, &params)
+			msg := params.Message
+			switch msg.Text {
+			case "ping":
+				call("send", map[string]interface{}{"message": mup.Message{Account: msg.Account, Channel: msg.Channel, Text: "pong"}})
+			case "handle":
+				call("handle", map[string]interface{}{"message": mup.Message{Account: msg.Account, Channel: msg.Channel, Text: "handled"}})
+			case "crash":
+				os.Exit(1)
+			}
+		case "command":
+			var params struct {
+				Name    string
+				Args    map[string]interface{}
+				Message mup.Message
+			}
+			json.Unmarshal(req.Params, &params)
+			switch params.Name {
+			case "hello":
+				call("reply", map[string]interface{}{"to": params.Message, "text": fmt.Sprintf("Hello, %v!", params.Args["name"])})
+			case "extra":
+				call("reply", map[string]interface{}{"to": params.Message, "text": "Extra!"})
+			case "count":
+				var count int
+				json.Unmarshal(call("getstate", nil), &count)
+				count++
+				call("setstate", count)
+				call("reply", map[string]interface{}{"to": params.Message, "text": fmt.Sprint(count)})
+			}
+		}
+	}
+}
@@ -1,15 +1,104 @@
 package mup
 
 import (
+	"context"
 	"database/sql"
+	"io"
+	"time"
 
 	"gopkg.in/mup.v0/ldap"
 )
 
 func NewPlugger(name string, db *sql.DB, send, handle func(msg *Message) error, ldap func(name string) (ldap.Conn, error), config map[string]interface{}, targets []Target) *Plugger {
-	p := newPlugger(name, send, handle, ldap)
-	p.setDatabase(db)
+	withCtx := func(f func(msg *Message) error) func(ctx context.Context, msg *Message) error {
+		if f == nil {
+			return nil
+		}
+		return func(ctx context.Context, msg *Message) error { return f(msg) }
+	}
+	p := newPlugger(name, withCtx(send), withCtx(handle), ldap)
+	if db != nil {
+		p.setDatabase(db, newStmtCache(db))
+	}
 	p.setConfig(marshalRaw(config))
 	p.setTargets(targets)
 	return p
 }
+
+func SetHTTPURL(p *Plugger, url string) {
+	p.setHTTPURL(url)
+}
+
+func SetHTTPClientConfig(p *Plugger, config HTTPClientConfig) {
+	p.setHTTPClientConfig(config)
+}
+
+func WriteMetrics(w io.Writer) error {
+	return metrics.write(w)
+}
+
+func ShardOwner(name string, instances []string) string {
+	return shardOwner(name, instances)
+}
+
+func SetExecRestartDelay(delay time.Duration) (restore func()) {
+	old := execRestartDelay
+	execRestartDelay = delay
+	return func() { execRestartDelay = old }
+}
+
+func SetExecStartTimeout(timeout time.Duration) (restore func()) {
+	old := execStartTimeout
+	execStartTimeout = timeout
+	return func() { execStartTimeout = old }
+}
+
+func DBExec(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	return dbExec(db, query, args...)
+}
+
+type StmtCache struct {
+	c *stmtCache
+}
+
+func NewStmtCache(db *sql.DB) StmtCache {
+	return StmtCache{newStmtCache(db)}
+}
+
+func (c StmtCache) Prepare(query string) (*sql.Stmt, error) {
+	return c.c.prepare(query)
+}
+
+func (c StmtCache) Close() {
+	c.c.close()
+}
+
+func SetJoinTimeout(timeout time.Duration) (restore func()) {
+	old := joinTimeout
+	joinTimeout = timeout
+	return func() { joinTimeout = old }
+}
+
+func ConsoleLine(nick, line string) string {
+	return consoleLine(nick, line)
+}
+
+type TgClient struct {
+	info   accountInfo
+	client accountClient
+}
+
+func StartTgClient(name, host, password string, incoming chan *Message) *TgClient {
+	c := &TgClient{info: accountInfo{Name: name, Kind: "telegram", Host: host, Password: password}}
+	c.client = startTgClient(&c.info, incoming)
+	return c
+}
+
+func (c *TgClient) SetConfig(config string) {
+	c.info.Config = config
+	c.client.UpdateInfo(&c.info)
+}
+
+func (c *TgClient) Stop() error {
+	return c.client.Stop()
+}
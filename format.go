@@ -0,0 +1,262 @@
+package mup
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// The functions below produce text with the mIRC formatting codes, which
+// are sent as they are to IRC accounts. For other account kinds the codes
+// are translated into the equivalent formatting where possible, such as
+// HTML for Telegram, or stripped out.
+
+// Color is one of the standard mIRC text colors.
+type Color int
+
+const (
+	ColorWhite Color = iota
+	ColorBlack
+	ColorBlue
+	ColorGreen
+	ColorRed
+	ColorBrown
+	ColorPurple
+	ColorOrange
+	ColorYellow
+	ColorLightGreen
+	ColorCyan
+	ColorLightCyan
+	ColorLightBlue
+	ColorPink
+	ColorGrey
+	ColorLightGrey
+)
+
+const (
+	codeBold      = '\x02'
+	codeColor     = '\x03'
+	codeHexColor  = '\x04'
+	codeReset     = '\x0f'
+	codeMonospace = '\x11'
+	codeReverse   = '\x16'
+	codeItalic    = '\x1d'
+	codeStrike    = '\x1e'
+	codeUnderline = '\x1f'
+
+	formattingCodes = "\x02\x03\x04\x0f\x11\x16\x1d\x1e\x1f"
+)
+
+// Bold returns text formatted in bold.
+func Bold(text string) string {
+	return string(codeBold) + text + string(codeBold)
+}
+
+// Italic returns text formatted in italics.
+func Italic(text string) string {
+	return string(codeItalic) + text + string(codeItalic)
+}
+
+// Underline returns text formatted as underlined.
+func Underline(text string) string {
+	return string(codeUnderline) + text + string(codeUnderline)
+}
+
+// Strike returns text formatted as struck through.
+func Strike(text string) string {
+	return string(codeStrike) + text + string(codeStrike)
+}
+
+// Monospace returns text formatted in a monospace font.
+func Monospace(text string) string {
+	return string(codeMonospace) + text + string(codeMonospace)
+}
+
+// Colored returns text in the fg color. Colors are dropped by accounts
+// that do not support them.
+func Colored(fg Color, text string) string {
+	return fmt.Sprintf("%c%02d%s%c", codeColor, fg, text, codeColor)
+}
+
+// ColoredOn returns text in the fg color on a bg background.
+func ColoredOn(fg, bg Color, text string) string {
+	return fmt.Sprintf("%c%02d,%02d%s%c", codeColor, fg, bg, text, codeColor)
+}
+
+// StripFormatting returns text with all mIRC formatting codes removed.
+func StripFormatting(text string) string {
+	if !strings.ContainsAny(text, formattingCodes) {
+		return text
+	}
+	var buf bytes.Buffer
+	for _, span := range parseFormatting(text) {
+		buf.WriteString(span.text)
+	}
+	return buf.String()
+}
+
+// textStyle holds the formatting applied to a span of text, as a
+// combination of the style flags below.
+type textStyle uint8
+
+const (
+	styleBold textStyle = 1 << iota
+	styleItalic
+	styleUnderline
+	styleStrike
+	styleMonospace
+
+	styleCount = iota
+)
+
+type formatSpan struct {
+	text  string
+	style textStyle
+}
+
+// parseFormatting splits text into spans with the same style. Colors
+// have no equivalent style and are dropped.
+func parseFormatting(text string) []formatSpan {
+	var spans []formatSpan
+	var style textStyle
+	start := 0
+	flush := func(end int) {
+		if end > start {
+			spans = append(spans, formatSpan{text[start:end], style})
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		var toggle textStyle
+		end := i + 1
+		switch text[i] {
+		case codeBold:
+			toggle = styleBold
+		case codeItalic:
+			toggle = styleItalic
+		case codeUnderline:
+			toggle = styleUnderline
+		case codeStrike:
+			toggle = styleStrike
+		case codeMonospace:
+			toggle = styleMonospace
+		case codeReset, codeReverse:
+		case codeColor:
+			// Foreground and optional background, of up to two digits each.
+			end += digits(text, end)
+			if end > i+1 && end+1 < len(text) && text[end] == ',' && digits(text, end+1) > 0 {
+				end += 1 + digits(text, end+1)
+			}
+		case codeHexColor:
+			// Hexadecimal RGB foreground and optional background.
+			if isHexColor(text, end) {
+				end += 6
+				if end+1 < len(text) && text[end] == ',' && isHexColor(text, end+1) {
+					end += 7
+				}
+			}
+		default:
+			continue
+		}
+		flush(i)
+		if text[i] == codeReset {
+			style = 0
+		}
+		style ^= toggle
+		start = end
+		i = end - 1
+	}
+	flush(len(text))
+	return spans
+}
+
+// digits returns the number of decimal digits, up to two, at text[i:].
+func digits(text string, i int) int {
+	n := 0
+	for n < 2 && i+n < len(text) && text[i+n] >= '0' && text[i+n] <= '9' {
+		n++
+	}
+	return n
+}
+
+func isHexColor(text string, i int) bool {
+	if i+6 > len(text) {
+		return false
+	}
+	for _, c := range text[i : i+6] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// markupTags holds the opening and closing tags of each text style in a
+// markup language, indexed by the style bit. Styles the language has no
+// tags for are dropped.
+type markupTags [styleCount][2]string
+
+var (
+	htmlTags       = markupTags{{"<b>", "</b>"}, {"<i>", "</i>"}, {"<u>", "</u>"}, {"<s>", "</s>"}, {"<code>", "</code>"}}
+	markdownTags   = markupTags{{"*", "*"}, {"_", "_"}, {"", ""}, {"", ""}, {"`", "`"}}
+	markdownV2Tags = markupTags{{"*", "*"}, {"_", "_"}, {"__", "__"}, {"~", "~"}, {"`", "`"}}
+)
+
+// formatMarkup returns text with its formatting codes replaced by the
+// provided markup tags, and the plain text escaped via escape, if set.
+// Tags are always closed and reopened so they're properly nested.
+func formatMarkup(text string, tags *markupTags, escape func(string) string) string {
+	var buf bytes.Buffer
+	var open []int
+	var style textStyle
+	for _, span := range parseFormatting(text) {
+		if span.style == style {
+			writeEscaped(&buf, span.text, escape)
+			continue
+		}
+		style = span.style
+		for i := len(open) - 1; i >= 0; i-- {
+			buf.WriteString(tags[open[i]][1])
+		}
+		open = open[:0]
+		for i := 0; i < styleCount; i++ {
+			if span.style&(1<<uint(i)) != 0 && tags[i][0] != "" {
+				buf.WriteString(tags[i][0])
+				open = append(open, i)
+			}
+		}
+		writeEscaped(&buf, span.text, escape)
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString(tags[open[i]][1])
+	}
+	return buf.String()
+}
+
+func writeEscaped(buf *bytes.Buffer, text string, escape func(string) string) {
+	if escape != nil {
+		text = escape(text)
+	}
+	buf.WriteString(text)
+}
+
+// tgFormat returns text with its formatting codes translated into the
+// provided Telegram parse mode, and the parse mode to send it with.
+// Text without formatting codes is returned unchanged. Text meant to
+// be sent as plain is escaped and sent as HTML.
+func tgFormat(text, parseMode string) (string, string) {
+	if !strings.ContainsAny(text, formattingCodes) {
+		return text, parseMode
+	}
+	switch parseMode {
+	case "":
+		return formatMarkup(text, &htmlTags, html.EscapeString), "HTML"
+	case "HTML":
+		return formatMarkup(text, &htmlTags, nil), parseMode
+	case "Markdown":
+		return formatMarkup(text, &markdownTags, nil), parseMode
+	case "MarkdownV2":
+		return formatMarkup(text, &markdownV2Tags, nil), parseMode
+	}
+	return StripFormatting(text), parseMode
+}
@@ -0,0 +1,38 @@
+package mup_test
+
+import (
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+var _ = Suite(&FormatSuite{})
+
+type FormatSuite struct{}
+
+func (s *FormatSuite) TestFormatting(c *C) {
+	c.Assert(mup.Bold("text"), Equals, "\x02text\x02")
+	c.Assert(mup.Italic("text"), Equals, "\x1dtext\x1d")
+	c.Assert(mup.Underline("text"), Equals, "\x1ftext\x1f")
+	c.Assert(mup.Strike("text"), Equals, "\x1etext\x1e")
+	c.Assert(mup.Monospace("text"), Equals, "\x11text\x11")
+	c.Assert(mup.Colored(mup.ColorRed, "1 text"), Equals, "\x03041 text\x03")
+	c.Assert(mup.ColoredOn(mup.ColorWhite, mup.ColorLightGrey, "text"), Equals, "\x0300,15text\x03")
+}
+
+var stripFormattingTests = []struct {
+	text, stripped string
+}{
+	{"plain", "plain"},
+	{"\x02bold\x02 \x1ditalic\x1d \x1funder\x1f \x1estrike\x1e \x11mono\x11", "bold italic under strike mono"},
+	{"\x0304red\x03 \x034,12on blue\x03 \x03,5comma", "red on blue ,5comma"},
+	{"\x03123", "3"},
+	{"\x04ff0000hex\x04 \x04FF0000,00ff00both\x04 \x04bad", "hex both bad"},
+	{"\x16reverse\x0f reset", "reverse reset"},
+	{"\x03", ""},
+}
+
+func (s *FormatSuite) TestStripFormatting(c *C) {
+	for _, test := range stripFormattingTests {
+		c.Assert(mup.StripFormatting(test.text), Equals, test.stripped, Commentf("Text: %q", test.text))
+	}
+}
@@ -0,0 +1,122 @@
+package mup
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// httpServer is the embedded HTTP server that exposes
+// introspection endpoints about a running mup server.
+type httpServer struct {
+	tomb     tomb.Tomb
+	mu       sync.Mutex
+	addr     string
+	mux      *http.ServeMux
+	listener net.Listener
+}
+
+func startHTTPServer(addr string, st *Server) *httpServer {
+	logf("Starting HTTP server...")
+	s := &httpServer{
+		addr: addr,
+		mux:  http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/healthz", st.serveHealth)
+	s.mux.HandleFunc("/commands", st.serveCommands)
+	s.mux.HandleFunc("/events", st.serveEvents)
+	s.mux.HandleFunc("/metrics", serveMetrics)
+	s.mux.HandleFunc("/paste/", st.servePaste)
+	s.mux.Handle("/stream", st.streamHandler(s.tomb.Dying()))
+	s.tomb.Go(s.loop)
+	return s
+}
+
+func (s *httpServer) Stop() error {
+	s.tomb.Kill(errStop)
+	s.mu.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Unlock()
+	err := s.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+func (s *httpServer) loop() error {
+	first := true
+	for s.tomb.Alive() {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			if first {
+				first = false
+				logf("HTTP server cannot listen on %s (%v). Will keep retrying.", s.addr, err)
+			}
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-s.tomb.Dying():
+			}
+			continue
+		}
+		logf("HTTP server listening on %s.", s.addr)
+
+		s.mu.Lock()
+		s.listener = l
+		s.mu.Unlock()
+
+		server := &http.Server{
+			Addr:         s.addr,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			Handler:      s.mux,
+		}
+		err = server.Serve(l)
+		if s.tomb.Alive() {
+			logf("HTTP server failed: %v", err)
+		}
+		l.Close()
+	}
+	return nil
+}
+
+// serveHealth reports the server status as a JSON document, with a
+// 503 Service Unavailable status code if any account or plugin is unhealthy.
+func (st *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	status := st.Status()
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
+
+// serveCommands reports the schemas of the commands offered by enabled
+// plugins as a JSON document, for use in command completion.
+func (st *Server) serveCommands(w http.ResponseWriter, r *http.Request) {
+	schemas, err := CommandSchemas(st.config.DB)
+	if err == nil && schemas == nil {
+		schemas = []PluginSchema{}
+	}
+	var data []byte
+	if err == nil {
+		data, err = json.MarshalIndent(schemas, "", "\t")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
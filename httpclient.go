@@ -0,0 +1,212 @@
+package mup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPClientConfig holds the settings of the HTTP clients that plugins
+// obtain via Plugger.HTTPClient. Plugins may override these settings
+// individually via an "http" object in their configuration, holding
+// any of the fields below.
+type HTTPClientConfig struct {
+	// Proxy is the URL of the proxy that requests are sent through.
+	// Defaults to the proxy defined via the HTTP_PROXY, HTTPS_PROXY,
+	// and NO_PROXY environment variables.
+	Proxy string `json:"proxy"`
+
+	// Timeout limits how long requests may take, including reading
+	// the response body. Defaults to NetworkTimeout.
+	Timeout DurationString `json:"timeout"`
+
+	// UserAgent is sent with requests that do not define one.
+	// Defaults to "mup".
+	UserAgent string `json:"useragent"`
+
+	// Cache defines for how long successful responses to GET requests
+	// are reused for identical requests. Responses are not cached by default.
+	Cache DurationString `json:"cache"`
+}
+
+const defaultUserAgent = "mup"
+
+// override returns the settings in c with the ones defined in o replacing them.
+func (c HTTPClientConfig) override(o HTTPClientConfig) HTTPClientConfig {
+	if o.Proxy != "" {
+		c.Proxy = o.Proxy
+	}
+	if o.Timeout.Duration != 0 {
+		c.Timeout = o.Timeout
+	}
+	if o.UserAgent != "" {
+		c.UserAgent = o.UserAgent
+	}
+	if o.Cache.Duration != 0 {
+		c.Cache = o.Cache
+	}
+	return c
+}
+
+// newHTTPClient returns a new HTTP client that behaves as defined by
+// config. Problems with the settings are reported via logf, and the
+// respective defaults are used instead.
+func newHTTPClient(config HTTPClientConfig, logf func(format string, args ...interface{})) *http.Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: NetworkTimeout,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if config.Proxy != "" {
+		proxy, err := url.Parse(config.Proxy)
+		if err != nil || proxy.Host == "" {
+			logf("Invalid HTTP proxy URL %q. Using proxy defined in the environment, if any.", config.Proxy)
+		} else {
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+	}
+	if config.Timeout.Duration <= 0 {
+		config.Timeout.Duration = NetworkTimeout
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = defaultUserAgent
+	}
+	var rt http.RoundTripper = &userAgentTransport{transport, config.UserAgent}
+	if config.Cache.Duration > 0 {
+		rt = &cachingTransport{
+			transport: rt,
+			ttl:       config.Cache.Duration,
+			entries:   make(map[string]*cachedResponse),
+		}
+	}
+	return &http.Client{Transport: rt, Timeout: config.Timeout.Duration}
+}
+
+// userAgentTransport sets the User-Agent header of requests that lack one.
+type userAgentTransport struct {
+	transport http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// Round trippers must not modify the provided request.
+		copy := *req
+		copy.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			copy.Header[k] = v
+		}
+		copy.Header.Set("User-Agent", t.userAgent)
+		req = &copy
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// cacheMaxEntries and cacheMaxBody limit the memory used for caching
+// the responses of a single client.
+const (
+	cacheMaxEntries = 256
+	cacheMaxBody    = 1024 * 1024
+)
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (e *cachedResponse) response(req *http.Request) *http.Response {
+	header := make(http.Header, len(e.header))
+	for k, v := range e.header {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// cachingTransport reuses successful responses to GET requests for
+// the configured time to live.
+type cachingTransport struct {
+	transport http.RoundTripper
+	ttl       time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "" {
+		return t.transport.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	now := time.Now()
+
+	t.mu.Lock()
+	entry, ok := t.entries[key]
+	if ok && entry.expires.Before(now) {
+		delete(t.entries, key)
+		ok = false
+	}
+	t.mu.Unlock()
+	if ok {
+		return entry.response(req), nil
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.ContentLength > cacheMaxBody {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, cacheMaxBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if len(body) > cacheMaxBody {
+		// Too large to cache. Hand it over with what was read put back.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	entry = &cachedResponse{resp.StatusCode, resp.Header, body, now.Add(t.ttl)}
+
+	t.mu.Lock()
+	if len(t.entries) >= cacheMaxEntries {
+		for k, e := range t.entries {
+			if e.expires.Before(now) {
+				delete(t.entries, k)
+			}
+		}
+	}
+	if len(t.entries) < cacheMaxEntries {
+		t.entries[key] = entry
+	}
+	t.mu.Unlock()
+	return entry.response(req), nil
+}
+
+// cacheKey returns the key that identifies req in the cache. Requests for
+// the same URL with different headers, such as distinct credentials, are
+// cached separately.
+func cacheKey(req *http.Request) string {
+	header, _ := json.Marshal(req.Header)
+	return req.URL.String() + " " + string(header)
+}
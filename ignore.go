@@ -0,0 +1,77 @@
+package mup
+
+import (
+	"strings"
+)
+
+// ignored reports whether msg was sent by a user that matches an entry in
+// the ignore list for the account and channel the message was observed on.
+// Messages from ignored users are not dispatched to any plugin.
+//
+// The list is consulted on every message rather than cached, so that changes
+// made to the ignored table take effect immediately.
+func (m *pluginManager) ignored(msg *Message) bool {
+	if msg.Nick == "" || msg.AsNick == "" {
+		return false
+	}
+	rows, err := m.db.Query("SELECT mask FROM ignored WHERE (account='' OR account=?) AND (channel='' OR channel=?)", msg.Account, msg.Channel)
+	if err != nil {
+		logf("Cannot query ignore list: %v", err)
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mask string
+		err := rows.Scan(&mask)
+		if err != nil {
+			logf("Cannot parse ignore list entry: %v", err)
+			return false
+		}
+		if MaskMatch(mask, msg) {
+			return true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logf("Cannot query ignore list: %v", err)
+	}
+	return false
+}
+
+// MaskMatch reports whether the sender of msg matches mask, as done for
+// the ignore list. Masks holding a "!" or "@" are matched against the full
+// nick!user@host of the sender, and others against the nick alone. The
+// wildcards "*" and "?" match any sequence of characters and any single
+// character, respectively, and the match is case-insensitive.
+func MaskMatch(mask string, msg *Message) bool {
+	subject := msg.Nick
+	if strings.ContainsAny(mask, "!@") {
+		subject = msg.Nick + "!" + msg.User + "@" + msg.Host
+	}
+	return globMatch(strings.ToLower(mask), strings.ToLower(subject))
+}
+
+func globMatch(pattern, s string) bool {
+	// Classic backtracking match that only ever revisits the last star.
+	var p, i, star, mark = 0, 0, -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star = p
+			mark = i
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
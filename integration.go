@@ -0,0 +1,242 @@
+package mup
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// IntegrationTester runs several registered plugins together for testing
+// purposes, delivering messages to them through the same dispatching logic
+// used by a real server. No accounts are connected: messages sent via
+// Sendf are enqueued as if they had been received by an account, and
+// messages sent by the plugins are collected for inspection via Recv and
+// RecvAll rather than delivered.
+//
+// Each tester uses its own temporary database, which is removed on Stop.
+type IntegrationTester struct {
+	mu      sync.Mutex
+	dir     string
+	db      *sql.DB
+	manager *pluginManager
+	plugins []string
+	lastId  int64
+	pending []string
+	stopped bool
+}
+
+// NewIntegrationTester creates a new tester for running the named plugins
+// together. By default each plugin has a single target for the "test" account.
+func NewIntegrationTester(pluginNames ...string) *IntegrationTester {
+	dir, err := ioutil.TempDir("", "mup-integration-")
+	if err != nil {
+		panic("cannot create temporary database directory: " + err.Error())
+	}
+	db, err := OpenDB(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		panic("cannot open temporary database: " + err.Error())
+	}
+	t := &IntegrationTester{dir: dir, db: db, plugins: pluginNames}
+	t.exec("INSERT INTO account (name) VALUES ('test')")
+	for _, name := range pluginNames {
+		if _, ok := registeredPlugins[pluginKey(name)]; !ok {
+			t.cleanup()
+			panic(fmt.Sprintf("plugin %q not registered", pluginKey(name)))
+		}
+		t.exec("INSERT INTO plugin (name) VALUES (?)", name)
+		t.exec("INSERT INTO target (plugin,account) VALUES (?,'test')", name)
+	}
+	return t
+}
+
+func (t *IntegrationTester) exec(query string, args ...interface{}) {
+	_, err := t.db.Exec(query, args...)
+	if err != nil {
+		panic("IntegrationTester cannot change database: " + err.Error())
+	}
+}
+
+func (t *IntegrationTester) cleanup() {
+	t.db.Close()
+	os.RemoveAll(t.dir)
+}
+
+// DB returns the database shared by the plugins being tested.
+func (t *IntegrationTester) DB() *sql.DB {
+	return t.db
+}
+
+// SetConfig changes the configuration of the named plugin.
+func (t *IntegrationTester) SetConfig(pluginName string, value map[string]interface{}) {
+	if t.manager != nil {
+		panic("IntegrationTester.SetConfig called after Start")
+	}
+	t.exec("UPDATE plugin SET config=? WHERE name=?", string(marshalRaw(value)), pluginName)
+}
+
+// SetTargets replaces the targets of the named plugin.
+func (t *IntegrationTester) SetTargets(pluginName string, targets []Target) {
+	if t.manager != nil {
+		panic("IntegrationTester.SetTargets called after Start")
+	}
+	t.exec("DELETE FROM target WHERE plugin=?", pluginName)
+	for _, target := range targets {
+		target.Plugin = pluginName
+		if target.Account != "" {
+			t.exec("INSERT OR IGNORE INTO account (name) VALUES (?)", target.Account)
+		}
+		t.exec("INSERT INTO target ("+targetColumns+") VALUES ("+targetPlacers+")", target.refs()...)
+	}
+}
+
+// Start starts all the plugins being tested.
+func (t *IntegrationTester) Start() error {
+	if t.manager != nil {
+		panic("IntegrationTester.Start called more than once")
+	}
+	var err error
+	t.manager, err = startPluginManager(Config{
+		DB:             t.db,
+		Refresh:        -1,
+		Plugins:        t.plugins,
+		HandlerTimeout: time.Minute,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	// Messages sent before the manager starts tailing would be taken
+	// as already handled.
+	select {
+	case <-t.manager.tailing:
+	case <-t.manager.tomb.Dying():
+		return t.manager.tomb.Err()
+	}
+	return nil
+}
+
+// Stop waits until the plugins have handled all messages sent so far,
+// stops them, and removes the temporary database. Messages sent by the
+// plugins may still be received after Stop returns.
+func (t *IntegrationTester) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return nil
+	}
+	t.stopped = true
+	var err error
+	if t.manager != nil {
+		t.manager.drain(time.Now().Add(3 * time.Second))
+		err = t.manager.Stop()
+	}
+	t.collect()
+	t.cleanup()
+	return err
+}
+
+// collect moves messages sent by the plugins into the pending list, and
+// enqueues them back as incoming for observation by outgoing handlers, as
+// done by accounts once the messages are delivered.
+func (t *IntegrationTester) collect() {
+	rows, err := t.db.Query("SELECT "+messageColumns+" FROM message WHERE id>? AND lane=2 ORDER BY id", t.lastId)
+	if err != nil {
+		panic("IntegrationTester cannot query outgoing messages: " + err.Error())
+	}
+	var msgs []*Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(msg.refs(0)...); err != nil {
+			rows.Close()
+			panic("IntegrationTester cannot parse outgoing message: " + err.Error())
+		}
+		msgs = append(msgs, &msg)
+	}
+	rows.Close()
+	for _, msg := range msgs {
+		t.lastId = msg.Id
+		t.pending = append(t.pending, testerString(msg))
+		if !t.stopped {
+			t.exec("INSERT OR IGNORE INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
+		}
+	}
+}
+
+// Sendf formats a PRIVMSG coming from "nick!~user@host" and enqueues it as
+// an incoming message, to be dispatched to the plugins with matching targets.
+//
+// The formatted message may be prefixed by "[<target>@<account>,<option>] ".
+// See PluginTester.Sendf for details.
+func (t *IntegrationTester) Sendf(format string, args ...interface{}) {
+	account, target, raw, text := parseSendfText(fmt.Sprintf(format, args...))
+	if !raw {
+		if target == "" {
+			target = "mup"
+		}
+		text = ":nick!~user@host PRIVMSG " + target + " :" + text
+	}
+	msg := ParseIncoming(account, "mup", "!", text)
+	if msg.Command == cmdNick && msg.Text == "" {
+		msg.Text = msg.Param0
+	}
+	tx, err := t.db.Begin()
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
+		if err == nil {
+			err = trackSession(tx, msg)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		panic("IntegrationTester cannot change database: " + err.Error())
+	}
+}
+
+// Recv receives the next message sent by the plugins, waiting up to a few
+// seconds for one to arrive. If no messages arrive even then, an empty
+// string is returned. The message is formatted as done by PluginTester.Recv.
+//
+// Recv may be used after the tester is stopped.
+func (t *IntegrationTester) Recv() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timeout := time.Now().Add(3 * time.Second)
+	for {
+		if !t.stopped {
+			t.collect()
+		}
+		if len(t.pending) > 0 {
+			reply := t.pending[0]
+			t.pending = t.pending[1:]
+			return reply
+		}
+		if t.stopped || time.Now().After(timeout) {
+			return ""
+		}
+		t.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		t.mu.Lock()
+	}
+}
+
+// RecvAll receives all messages sent by the plugins so far. Calling Stop
+// first ensures the plugins handled all messages sent to them.
+//
+// RecvAll may be used after the tester is stopped.
+func (t *IntegrationTester) RecvAll() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.stopped {
+		t.collect()
+	}
+	replies := t.pending
+	t.pending = nil
+	return replies
+}
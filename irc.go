@@ -3,16 +3,126 @@ package mup
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"gopkg.in/tomb.v2"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// nickChangeDelay is how long to wait by default between attempts to take
+// the configured nick while the server has the bot using another one.
 const nickChangeDelay = 30 * time.Second
 
+// ircConfig holds the IRC-specific settings that may be provided
+// in the account configuration document.
+type ircConfig struct {
+	// NickDelay is how long to wait between attempts to take the
+	// configured nick while another one is in use. Defaults to 30s.
+	NickDelay DurationString `json:"nickdelay"`
+
+	// Regain defines how the configured nick is taken back from another
+	// connection holding it, when the account has an identity: "ghost"
+	// asks NickServ to disconnect the other connection with the GHOST
+	// command before changing the nick, "regain" asks NickServ to change
+	// the nick with the REGAIN command, and "none" only changes the nick.
+	// Defaults to "ghost".
+	Regain string `json:"regain"`
+
+	// Playback defines how messages played back by bouncers such as ZNC
+	// when the bot connects are handled: "record" stores them without
+	// handing them to plugins, so old commands are not run again,
+	// "dispatch" handles them as any other message, and "drop" discards
+	// them altogether. Defaults to "record".
+	Playback string `json:"playback"`
+
+	// PlaybackAge is how old the server time of a PRIVMSG or NOTICE must
+	// be for it to be taken as played back, even if not sent within a
+	// playback batch. Defaults to 1m.
+	PlaybackAge DurationString `json:"playbackage"`
+}
+
+const (
+	regainGhost  = "ghost"
+	regainRegain = "regain"
+	regainNone   = "none"
+)
+
+const (
+	playbackRecord   = "record"
+	playbackDispatch = "dispatch"
+	playbackDrop     = "drop"
+)
+
+// playbackAge is how old the server time of a message must be by default
+// for it to be taken as played back.
+const playbackAge = time.Minute
+
+// playbackBatches holds the IRCv3 batch types used to play back messages.
+var playbackBatches = map[string]bool{
+	"znc.in/playback": true,
+	"chathistory":     true,
+}
+
+func (c *ircClient) config() ircConfig {
+	var config ircConfig
+	if c.info.Config != "" {
+		err := json.Unmarshal([]byte(c.info.Config), &config)
+		if err != nil {
+			accountLogf(c.accountName, "Cannot parse account configuration: %v", err)
+		}
+	}
+	if config.NickDelay.Duration <= 0 {
+		config.NickDelay.Duration = nickChangeDelay
+	}
+	switch config.Regain {
+	case regainGhost, regainRegain, regainNone:
+	case "":
+		config.Regain = regainGhost
+	default:
+		accountLogf(c.accountName, "Unknown nick regain strategy %q; using %q.", config.Regain, regainGhost)
+		config.Regain = regainGhost
+	}
+	switch config.Playback {
+	case playbackRecord, playbackDispatch, playbackDrop:
+	case "":
+		config.Playback = playbackRecord
+	default:
+		accountLogf(c.accountName, "Unknown playback policy %q; using %q.", config.Playback, playbackRecord)
+		config.Playback = playbackRecord
+	}
+	if config.PlaybackAge.Duration <= 0 {
+		config.PlaybackAge.Duration = playbackAge
+	}
+	return config
+}
+
+// joinTimeout is how long outgoing messages to a channel are held while
+// waiting for the server to confirm that the bot joined it.
+var joinTimeout = 30 * time.Second
+
+// joinErrors holds the replies sent by servers when joining a channel fails.
+var joinErrors = map[string]bool{
+	"403": true, // ERR_NOSUCHCHANNEL
+	"405": true, // ERR_TOOMANYCHANNELS
+	"471": true, // ERR_CHANNELISFULL
+	"473": true, // ERR_INVITEONLYCHAN
+	"474": true, // ERR_BANNEDFROMCHAN
+	"475": true, // ERR_BADCHANNELKEY
+	"477": true, // ERR_NEEDREGGEDNICK
+}
+
+// sendErrors holds the replies sent by servers when a PRIVMSG or NOTICE
+// could not be delivered to its target.
+var sendErrors = map[string]bool{
+	"401": true, // ERR_NOSUCHNICK
+	"403": true, // ERR_NOSUCHCHANNEL
+	"404": true, // ERR_CANNOTSENDTOCHAN
+}
+
 type ircClient struct {
 	info accountInfo
 	conn net.Conn
@@ -23,6 +133,30 @@ type ircClient struct {
 	activeChannels []string
 	activeNick     string
 	nextNickChange time.Time
+	support        ServerSupport
+	bangs          *bangPrefixes
+	playback       string
+	playbackAge    time.Duration
+
+	// batches holds the type of the IRCv3 batches opened by the server
+	// and not yet closed, by reference tag.
+	batches map[string]string
+
+	// joining holds the channels with a JOIN not yet confirmed by the
+	// server and the time it was sent, and held the outgoing messages to
+	// these channels. Once released, held messages move to ready. Held
+	// messages are recorded in queue so that they aren't considered sent
+	// while later messages are.
+	joining map[string]time.Time
+	held    map[string][]*Message
+	ready   []*Message
+	queue   *outQueue
+
+	// unconfirmed holds the messages written to the server but not yet
+	// confirmed via a PONG, and reports the delivery failures that are
+	// yet to be handed to the account manager.
+	unconfirmed []*Message
+	reports     []*Message
 
 	requests chan interface{}
 	stopAuth chan bool
@@ -38,13 +172,18 @@ func (c *ircClient) Dying() <-chan struct{}  { return c.dying }
 func (c *ircClient) Outgoing() chan *Message { return c.outgoing }
 func (c *ircClient) LastId() int64           { return c.info.LastId }
 
-func startIrcClient(info *accountInfo, incoming chan *Message) accountClient {
+func startIrcClient(info *accountInfo, incoming chan *Message, queue *outQueue) accountClient {
 	c := &ircClient{
 		accountName: info.Name,
 
 		info:     *info,
+		bangs:    newBangPrefixes("!", info),
 		requests: make(chan interface{}, 1),
 		stopAuth: make(chan bool),
+		joining:  make(map[string]time.Time),
+		held:     make(map[string][]*Message),
+		queue:    queue,
+		batches:  make(map[string]string),
 		incoming: incoming,
 		outgoing: make(chan *Message),
 	}
@@ -99,21 +238,21 @@ func (c *ircClient) run() error {
 
 	err := c.connect()
 	if err != nil {
-		logf("[%s] While connecting to IRC server: %v", c.accountName, err)
+		accountLogf(c.accountName, "While connecting to IRC server: %v", err)
 		c.tomb.Killf("%s: cannot connect to IRC server: %v", c.accountName, err)
 		return nil
 	}
 
 	err = c.auth()
 	if err != nil {
-		logf("[%s] While authenticating on IRC server: %v", c.accountName, err)
+		accountLogf(c.accountName, "While authenticating on IRC server: %v", err)
 		c.tomb.Killf("%s: cannot authenticate on IRC server: %v", c.accountName, err)
 		return nil
 	}
 
 	err = c.forward()
 	if err != nil {
-		logf("[%s] While talking to IRC server: %v", c.accountName, err)
+		accountLogf(c.accountName, "While talking to IRC server: %v", err)
 		c.tomb.Killf("%s: while talking to IRC server: %v", c.accountName, err)
 		return nil
 	}
@@ -122,23 +261,23 @@ func (c *ircClient) run() error {
 }
 
 func (c *ircClient) die() {
-	logf("[%s] Cleaning IRC connection resources", c.accountName)
+	accountLogf(c.accountName, "Cleaning IRC connection resources")
 
 	// Stop the writer before closing the connection, so that
 	// in progress writes are politely finished.
 	if c.ircW != nil {
 		err := c.ircW.Stop()
 		if err != nil {
-			logf("[%s] IRC writer failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "IRC writer failure: %s", err)
 		}
 	}
 	// Close the connection before stopping the reader, as the
 	// reader is likely blocked attempting to get more data.
 	if c.conn != nil {
-		debugf("[%s] Closing connection", c.accountName)
+		accountDebugf(c.accountName, "Closing connection")
 		err := c.conn.Close()
 		if err != nil {
-			logf("[%s] Failure closing IRC server connection: %s", c.accountName, err)
+			accountLogf(c.accountName, "Failure closing IRC server connection: %s", err)
 		}
 		c.conn = nil
 	}
@@ -146,16 +285,16 @@ func (c *ircClient) die() {
 	if c.ircR != nil {
 		err := c.ircR.Stop()
 		if err != nil {
-			logf("[%s] IRC reader failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "IRC reader failure: %s", err)
 		}
 	}
 
 	c.tomb.Kill(nil)
-	logf("[%s] IRC client terminated (%v)", c.accountName, c.tomb.Err())
+	accountLogf(c.accountName, "IRC client terminated (%v)", c.tomb.Err())
 }
 
 func (c *ircClient) connect() (err error) {
-	logf("[%s] Connecting with nick %q to IRC server %q (tls=%v)", c.accountName, c.info.Nick, c.info.Host, c.info.TLS)
+	accountLogf(c.accountName, "Connecting with nick %q to IRC server %q (tls=%v)", c.info.Nick, c.info.Host, c.info.TLS)
 	dialer := &net.Dialer{Timeout: NetworkTimeout}
 	if c.info.TLS {
 		var config tls.Config
@@ -170,14 +309,24 @@ func (c *ircClient) connect() (err error) {
 		c.conn = nil
 		return err
 	}
-	logf("[%s] Connected to %q", c.accountName, c.info.Host)
+	accountLogf(c.accountName, "Connected to %q", c.info.Host)
 
-	c.ircR = startIrcReader(c.accountName, c.conn)
+	c.ircR = startIrcReader(c.accountName, c.conn, c.bangs)
 	c.ircW = startIrcWriter(c.accountName, c.conn)
 	return nil
 }
 
+// ircCaps holds the IRCv3 capabilities requested from servers that
+// offer them.
+var ircCaps = []string{"server-time", "message-tags", "account-tag", "batch", "away-notify"}
+
 func (c *ircClient) auth() (err error) {
+	// Servers without capability negotiation ignore or refuse CAP, and
+	// registration goes on as usual.
+	err = c.ircW.Sendf("CAP LS 302")
+	if err != nil {
+		return err
+	}
 	if c.info.Password != "" {
 		err = c.ircW.Sendf("PASS %s", c.info.Password)
 		if err != nil {
@@ -193,6 +342,7 @@ func (c *ircClient) auth() (err error) {
 		return err
 	}
 	nick := c.info.Nick
+	var offered []string
 	for {
 		var msg *Message
 		select {
@@ -208,7 +358,7 @@ func (c *ircClient) auth() (err error) {
 		}
 
 		if msg.Command == cmdNickInUse {
-			logf("[%s] Nick %q is in use. Trying with %q.", c.accountName, nick, nick+"_")
+			accountLogf(c.accountName, "Nick %q is in use. Trying with %q.", nick, nick+"_")
 			nick += "_"
 			err = c.ircW.Sendf("NICK %s", nick)
 			if err != nil {
@@ -223,9 +373,16 @@ func (c *ircClient) auth() (err error) {
 			}
 			continue
 		}
+		if msg.Command == cmdCap {
+			offered, err = c.negotiateCaps(msg, offered)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		if msg.Command == cmdWelcome {
 			c.activeNick = msg.AsNick
-			logf("[%s] Got welcome notice.", c.accountName)
+			accountLogf(c.accountName, "Got welcome notice.")
 			err = c.identify()
 			if err != nil {
 				return err
@@ -236,6 +393,47 @@ func (c *ircClient) auth() (err error) {
 	return nil
 }
 
+// negotiateCaps handles a CAP reply received during registration. The
+// capabilities offered by the server are accumulated over continued LS
+// replies, and the ones in ircCaps are then requested. Negotiation ends
+// once the server acknowledges or refuses them, or if it offers none.
+func (c *ircClient) negotiateCaps(msg *Message, offered []string) ([]string, error) {
+	// The first parameter is the bot nick, or "*" before registration.
+	switch strings.ToUpper(msg.Param1) {
+	case "LS":
+		for _, capab := range strings.Fields(msg.Text) {
+			if i := strings.IndexByte(capab, '='); i >= 0 {
+				capab = capab[:i]
+			}
+			offered = append(offered, capab)
+		}
+		if msg.Param2 == "*" {
+			// More to come.
+			return offered, nil
+		}
+		var request []string
+		for _, capab := range ircCaps {
+			for _, o := range offered {
+				if o == capab {
+					request = append(request, capab)
+					break
+				}
+			}
+		}
+		if len(request) == 0 {
+			return nil, c.ircW.Sendf("CAP END")
+		}
+		return nil, c.ircW.Sendf("CAP REQ :%s", strings.Join(request, " "))
+	case "ACK":
+		accountLogf(c.accountName, "Enabled capabilities: %s", strings.TrimSpace(msg.Text))
+		return nil, c.ircW.Sendf("CAP END")
+	case "NAK":
+		accountLogf(c.accountName, "Server refused capabilities: %s", strings.TrimSpace(msg.Text))
+		return nil, c.ircW.Sendf("CAP END")
+	}
+	return offered, nil
+}
+
 func (c *ircClient) forward() error {
 	// Join initial channels before forwarding any outgoing messages.
 	if err := c.handleUpdateInfo(&c.info); err != nil {
@@ -249,8 +447,24 @@ func (c *ircClient) forward() error {
 	inRecv = c.ircR.Incoming
 	outRecv = c.outgoing
 
+	joinCheck := time.NewTicker(joinTimeout / 4)
+	defer joinCheck.Stop()
+
 	quitting := false
 	for {
+		if outMsg == nil && len(c.ready) > 0 {
+			outMsg = c.ready[0]
+			c.ready = c.ready[1:]
+			outRecv = nil
+			outSend = c.ircW.Outgoing
+		}
+		if inMsg == nil && len(c.reports) > 0 {
+			inMsg = c.reports[0]
+			c.reports = c.reports[1:]
+			inRecv = nil
+			inSend = c.incoming
+		}
+
 		select {
 		case inMsg = <-inRecv:
 			skip, err := c.handleMessage(inMsg)
@@ -273,10 +487,17 @@ func (c *ircClient) forward() error {
 			if outMsg.Command == cmdQuit {
 				quitting = true
 			}
+			if c.hold(outMsg) {
+				outMsg = nil
+				continue
+			}
 			outRecv = nil
 			outSend = c.ircW.Outgoing
 
 		case outSend <- outMsg:
+			if outMsg.Id > 0 && (outMsg.Command == cmdPrivMsg || outMsg.Command == cmdNotice || outMsg.Command == "") {
+				c.unconfirmed = append(c.unconfirmed, outMsg)
+			}
 			outMsg = nil
 			outRecv = c.outgoing
 			outSend = nil
@@ -290,6 +511,9 @@ func (c *ircClient) forward() error {
 				}
 			}
 
+		case <-joinCheck.C:
+			c.expireJoins()
+
 		case <-c.dying:
 			return c.tomb.Err()
 		case <-c.ircR.Dying:
@@ -317,16 +541,72 @@ func changedChannel(msg *Message) string {
 	return ""
 }
 
+// hold queues msg if it is to be delivered to a channel that the bot is
+// still joining, and reports whether it did so. Otherwise the server would
+// most likely refuse it with a "not on channel" error.
+func (c *ircClient) hold(msg *Message) bool {
+	if msg.Channel == "" || msg.Command != "" && msg.Command != cmdPrivMsg && msg.Command != cmdNotice {
+		return false
+	}
+	channel := strings.ToLower(msg.Channel)
+	if _, ok := c.joining[channel]; !ok {
+		return false
+	}
+	c.held[channel] = append(c.held[channel], msg)
+	if msg.Id > 0 {
+		c.queue.hold(msg.Id)
+	}
+	return true
+}
+
+// release stops holding messages to channel, and moves the ones held so
+// far to be sent next.
+func (c *ircClient) release(channel string) {
+	delete(c.joining, channel)
+	c.ready = append(c.ready, c.held[channel]...)
+	delete(c.held, channel)
+}
+
+// expireJoins releases the messages held for channels that the server did
+// not confirm joining within joinTimeout. They're sent anyway, as the JOIN
+// confirmation might have been missed, or the channel may accept messages
+// from outside.
+func (c *ircClient) expireJoins() {
+	now := time.Now()
+	for channel, sent := range c.joining {
+		if now.Sub(sent) >= joinTimeout {
+			accountLogf(c.accountName, "Server did not confirm joining channel %q. Sending %d held messages anyway.", channel, len(c.held[channel]))
+			c.release(channel)
+		}
+	}
+}
+
 func (c *ircClient) identify() error {
 	if c.info.Identity == "" {
 		return nil
 	}
-	logf("[%s] Identifying as %q to nickserv.", c.accountName, c.info.Nick)
+	accountLogf(c.accountName, "Identifying as %q to nickserv.", c.info.Nick)
 	return c.ircW.Sendf("PRIVMSG nickserv :IDENTIFY %s %s", c.info.Nick, c.info.Identity)
 }
 
 func (c *ircClient) handleMessage(msg *Message) (skip bool, err error) {
+	if c.isPlayback(msg) {
+		switch c.playback {
+		case playbackDrop:
+			accountDebugf(c.accountName, "Dropping played back message: %s", msg.String())
+			return true, nil
+		case playbackRecord:
+			msg.Playback = true
+		}
+	}
 	switch msg.Command {
+	case cmdBatch:
+		// As in "BATCH +ref type [params]" and "BATCH -ref".
+		if ref := msg.Param0; strings.HasPrefix(ref, "+") {
+			c.batches[ref[1:]] = msg.Param1
+		} else if strings.HasPrefix(ref, "-") {
+			delete(c.batches, ref[1:])
+		}
 	case cmdNick:
 		c.activeNick = msg.AsNick
 		err = c.identify()
@@ -339,6 +619,9 @@ func (c *ircClient) handleMessage(msg *Message) (skip bool, err error) {
 			return false, err
 		}
 		return true, nil
+	case cmdISupport:
+		c.support.update(msg)
+		c.ircW.setLineLen(c.support.lineLen())
 	case cmdJoin, cmdPart:
 		if msg.Nick != c.activeNick {
 			break
@@ -357,19 +640,81 @@ func (c *ircClient) handleMessage(msg *Message) (skip bool, err error) {
 		if msg.Command == cmdJoin {
 			if pos == -1 {
 				c.activeChannels = append(c.activeChannels, channel)
-				logf("[%s] Joined channel %q.", c.accountName, channel)
+				accountLogf(c.accountName, "Joined channel %q.", channel)
 			}
+			c.release(channel)
 		} else {
 			if pos != -1 {
 				copy(c.activeChannels[pos:], c.activeChannels[pos+1:])
 				c.activeChannels = c.activeChannels[:len(c.activeChannels)-1]
-				logf("[%s] Left channel %q.", c.accountName, channel)
+				accountLogf(c.accountName, "Left channel %q.", channel)
 			}
 		}
+	case cmdPong:
+		c.confirm(msg)
+	}
+	if sendErrors[msg.Command] {
+		c.sendFailed(msg)
+	}
+	if joinErrors[msg.Command] {
+		// The first parameter is the bot nick.
+		channel := strings.ToLower(msg.Param1)
+		if _, ok := c.joining[channel]; ok {
+			accountLogf(c.accountName, "Cannot join channel %q: %s. Dropping %d held messages.", channel, msg.Text, len(c.held[channel]))
+			for _, held := range c.held[channel] {
+				c.reports = append(c.reports, deliveryPong(c.accountName, held.Id, fmt.Errorf("cannot join channel: %s", msg.Text)))
+			}
+			delete(c.joining, channel)
+			delete(c.held, channel)
+		}
 	}
 	return false, nil
 }
 
+// isPlayback reports whether msg is a PRIVMSG or NOTICE played back by a
+// bouncer, either within a playback batch or holding a server time older
+// than the configured playback age.
+func (c *ircClient) isPlayback(msg *Message) bool {
+	if msg.Command != cmdPrivMsg && msg.Command != cmdNotice || msg.Tags == nil {
+		return false
+	}
+	if ref, ok := msg.Tags["batch"]; ok && playbackBatches[c.batches[ref]] {
+		return true
+	}
+	_, ok := msg.Tags["time"]
+	return ok && time.Since(msg.Time) > c.playbackAge
+}
+
+// confirm drops from the unconfirmed list the messages up to the one
+// acknowledged by the provided PONG, as the server handles messages in
+// order and would have refused them before replying to the PING.
+func (c *ircClient) confirm(pong *Message) {
+	d, err := parseDeliveryPong(pong.Text)
+	if err != nil || d == nil {
+		return
+	}
+	for i, msg := range c.unconfirmed {
+		if msg.Id == d.Id {
+			c.unconfirmed = c.unconfirmed[i+1:]
+			return
+		}
+	}
+}
+
+// sendFailed reports the failure described by the msg error reply for the
+// earliest unconfirmed message sent to the target the reply refers to.
+func (c *ircClient) sendFailed(msg *Message) {
+	// The first parameter is the bot nick.
+	target := msg.Param1
+	for i, sent := range c.unconfirmed {
+		if strings.EqualFold(sent.Channel, target) || sent.Channel == "" && strings.EqualFold(sent.Nick, target) {
+			c.reports = append(c.reports, deliveryPong(c.accountName, sent.Id, fmt.Errorf("%s", msg.Text)))
+			c.unconfirmed = append(c.unconfirmed[:i], c.unconfirmed[i+1:]...)
+			return
+		}
+	}
+}
+
 func (c *ircClient) handleUpdateInfo(info *accountInfo) error {
 	var joins []string
 	var parts []string
@@ -389,16 +734,31 @@ Outer2:
 				continue Outer2
 			}
 		}
+		if !c.support.isChannel(ci.Name) {
+			accountLogf(c.accountName, "Server does not support channel name %q. Not joining it.", ci.Name)
+			continue
+		}
 		joins = append(joins, ci.Name)
 	}
 	activeIdentity := c.info.Identity
 	c.info = *info
+	c.bangs.update(info)
+	config := c.config()
+	c.playback = config.Playback
+	c.playbackAge = config.PlaybackAge.Duration
 	if len(joins) > 0 {
 		// TODO Handle channel keys.
 		err := c.ircW.Sendf("JOIN %s", strings.Join(joins, ","))
 		if err != nil {
 			return err
 		}
+		now := time.Now()
+		for _, channel := range joins {
+			// Retried joins do not extend how long messages are held.
+			if _, ok := c.joining[strings.ToLower(channel)]; !ok {
+				c.joining[strings.ToLower(channel)] = now
+			}
+		}
 	}
 	if len(parts) > 0 {
 		err := c.ircW.Sendf("PART %s", strings.Join(parts, ","))
@@ -412,17 +772,30 @@ Outer2:
 			return err
 		}
 	}
-	if c.activeNick != c.info.Nick {
+	nick := c.info.Nick
+	if c.support.NickLen > 0 && len(nick) > c.support.NickLen {
+		nick = nick[:c.support.NickLen]
+	}
+	if c.activeNick != nick {
 		now := time.Now()
 		if c.nextNickChange.Before(now) {
-			c.nextNickChange = now.Add(nickChangeDelay)
-			if c.info.Identity != "" {
-				err := c.ircW.Sendf("PRIVMSG nickserv :GHOST %s %s", c.info.Nick, c.info.Identity)
+			config := c.config()
+			c.nextNickChange = now.Add(config.NickDelay.Duration)
+			regain := config.Regain
+			if c.info.Identity == "" {
+				regain = regainNone
+			}
+			switch regain {
+			case regainGhost:
+				err := c.ircW.Sendf("PRIVMSG nickserv :GHOST %s %s", nick, c.info.Identity)
 				if err != nil {
 					return err
 				}
+			case regainRegain:
+				// NickServ changes the nick itself.
+				return c.ircW.Sendf("PRIVMSG nickserv :REGAIN %s %s", nick, c.info.Identity)
 			}
-			err := c.ircW.Sendf("NICK %s", c.info.Nick)
+			err := c.ircW.Sendf("NICK %s", nick)
 			if err != nil {
 				return err
 			}
@@ -440,6 +813,7 @@ type ircWriter struct {
 	conn        net.Conn
 	buf         *bufio.Writer
 	tomb        tomb.Tomb
+	lineLen     int64
 
 	Dying    <-chan struct{}
 	Outgoing chan *Message
@@ -450,6 +824,7 @@ func startIrcWriter(accountName string, conn net.Conn) *ircWriter {
 		accountName: accountName,
 		conn:        conn,
 		buf:         bufio.NewWriter(conn),
+		lineLen:     defaultLineLen,
 		Outgoing:    make(chan *Message, 1),
 	}
 	w.Dying = w.tomb.Dying()
@@ -462,7 +837,7 @@ func (w *ircWriter) Err() error {
 }
 
 func (w *ircWriter) Stop() error {
-	debugf("[%s] Requesting writer to stop...", w.accountName)
+	accountDebugf(w.accountName, "Requesting writer to stop...")
 	w.tomb.Kill(errStop)
 	err := w.tomb.Wait()
 	if err != errStop {
@@ -484,8 +859,36 @@ func (w *ircWriter) Sendf(format string, args ...interface{}) error {
 	return w.Send(ParseOutgoing(w.accountName, fmt.Sprintf(format, args...)))
 }
 
+// setLineLen sets the maximum length of lines accepted by the server,
+// including the trailing CR-LF.
+func (w *ircWriter) setLineLen(n int) {
+	atomic.StoreInt64(&w.lineLen, int64(n))
+}
+
+// lines returns the lines that deliver msg to the server. The text of
+// messages is broken into several lines if necessary to respect the
+// server limits.
+func (w *ircWriter) lines(msg *Message) []string {
+	line := msg.String()
+	max := int(atomic.LoadInt64(&w.lineLen)) - 2 - linePrefixReserve
+	if len(line) <= max || msg.Text == "" || msg.Command != cmdPrivMsg && msg.Command != cmdNotice && msg.Command != "" {
+		return []string{line}
+	}
+	room := max - (len(line) - len(msg.Text))
+	if room < minTextLen {
+		return []string{line}
+	}
+	var lines []string
+	copy := *msg
+	for _, text := range splitText(msg.Text, room) {
+		copy.Text = text
+		lines = append(lines, copy.String())
+	}
+	return lines
+}
+
 func (w *ircWriter) die() {
-	debugf("[%s] Writer is dead (%v)", w.accountName, w.tomb.Err())
+	accountDebugf(w.accountName, "Writer is dead (%v)", w.tomb.Err())
 }
 
 func (w *ircWriter) loop() error {
@@ -500,15 +903,15 @@ loop:
 		var send []string
 		select {
 		case msg := <-w.Outgoing:
-			line := msg.String()
-			if msg.Command != cmdPong {
-				logf("[%s] Sending: %s", w.accountName, line)
+			for _, line := range w.lines(msg) {
+				if msg.Command != cmdPong {
+					accountLogf(w.accountName, "Sending: %s", line)
+				}
+				send = append(send, line, "\r\n")
 			}
 			if (msg.Command == cmdPrivMsg || msg.Command == cmdNotice || msg.Command == "") && msg.Id > 0 {
-				send = []string{line, "\r\nPING :sent:", strconv.FormatInt(msg.Id, 16), "\r\n"}
+				send = append(send, "PING :sent:", strconv.FormatInt(msg.Id, 16), "\r\n")
 				lastPing = time.Now()
-			} else {
-				send = []string{line, "\r\n"}
 			}
 		case t := <-pinger.C:
 			if t.Before(lastPing.Add(pingDelay)) {
@@ -544,6 +947,7 @@ type ircReader struct {
 	accountName string
 	conn        net.Conn
 	activeNick  string
+	bangs       *bangPrefixes
 	buf         *bufio.Reader
 	tomb        tomb.Tomb
 
@@ -551,10 +955,11 @@ type ircReader struct {
 	Incoming chan *Message
 }
 
-func startIrcReader(accountName string, conn net.Conn) *ircReader {
+func startIrcReader(accountName string, conn net.Conn, bangs *bangPrefixes) *ircReader {
 	r := &ircReader{
 		accountName: accountName,
 		conn:        conn,
+		bangs:       bangs,
 		buf:         bufio.NewReader(conn),
 		Incoming:    make(chan *Message, 1),
 	}
@@ -570,7 +975,7 @@ func (r *ircReader) Err() error {
 var errStop = fmt.Errorf("stop requested")
 
 func (r *ircReader) Stop() error {
-	debugf("[%s] Requesting reader to stop...", r.accountName)
+	accountDebugf(r.accountName, "Requesting reader to stop...")
 	r.tomb.Kill(errStop)
 	err := r.tomb.Wait()
 	if err != errStop {
@@ -580,7 +985,7 @@ func (r *ircReader) Stop() error {
 }
 
 func (r *ircReader) die() {
-	debugf("[%s] Reader is dead (%v)", r.accountName, r.tomb.Err())
+	accountDebugf(r.accountName, "Reader is dead (%v)", r.tomb.Err())
 }
 
 func (r *ircReader) loop() error {
@@ -597,12 +1002,17 @@ func (r *ircReader) loop() error {
 			r.tomb.Killf("line is too long")
 			break
 		}
-		msg := ParseIncoming(r.accountName, r.activeNick, "!", string(line))
+		msg := r.bangs.parseIncoming(r.accountName, r.activeNick, string(line))
 		if msg.Command != cmdPong && msg.Command != cmdPing {
-			logf("[%s] Received: %s", r.accountName, line)
+			accountLogf(r.accountName, "Received: %s", line)
 		}
 		switch msg.Command {
 		case cmdNick:
+			// Servers may send the new nick as a middle parameter or as
+			// the trailing one. Plugins always find it in Text.
+			if msg.Text == "" {
+				msg.Text = msg.Param0
+			}
 			if r.activeNick == "" || r.activeNick == msg.Nick {
 				if msg.Param0 != "" {
 					r.activeNick = msg.Param0
@@ -610,13 +1020,13 @@ func (r *ircReader) loop() error {
 					r.activeNick = msg.Text
 				}
 				msg.AsNick = r.activeNick
-				logf("[%s] Nick %q accepted by server.", r.accountName, r.activeNick)
+				accountLogf(r.accountName, "Nick %q accepted by server.", r.activeNick)
 			}
 		case cmdWelcome:
 			if msg.Param0 != "" {
 				r.activeNick = msg.Param0
 				msg.AsNick = r.activeNick
-				logf("[%s] Nick %q accepted by server.", r.accountName, r.activeNick)
+				accountLogf(r.accountName, "Nick %q accepted by server.", r.activeNick)
 			}
 		}
 		select {
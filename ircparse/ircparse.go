@@ -0,0 +1,221 @@
+// Package ircparse parses and formats IRC protocol lines, including the
+// message tags defined by IRCv3.
+//
+// The parser accepts any input without failing, as lines come straight
+// from the network and may be malformed. Whatever can be made sense of is
+// reported, and the rest is ignored. A line parsed and then formatted via
+// Line.String parses back into the same Line.
+package ircparse
+
+import (
+	"sort"
+	"strings"
+)
+
+// Line holds the parts of an IRC protocol line, as in:
+//
+//	@time=2024-01-31T15:04:05.000Z :nick!user@host PRIVMSG #channel :Hello there
+type Line struct {
+	// Tags holds the IRCv3 message tags, with their values unescaped.
+	// Tags without a value map to an empty string. Tags is nil if the
+	// line has no tags section at all.
+	Tags map[string]string
+
+	// Nick, User, and Host hold the parts of the line prefix, if any.
+	// A prefix with neither user nor host that holds a dot names a
+	// server, and is reported in Host.
+	Nick string
+	User string
+	Host string
+
+	// Command holds the command name or numeric reply code.
+	Command string
+
+	// Params holds the parameters that precede the trailing one.
+	Params []string
+
+	// Trailing holds the last parameter when introduced by ":", in
+	// which case it may hold spaces. HasTrailing reports whether
+	// the line has it at all, as it may be empty.
+	Trailing    string
+	HasTrailing bool
+}
+
+// Parse parses line as an IRC protocol line. The line must not hold the
+// terminating line break, which is up to the reader of the network stream
+// to strip. Any carriage returns or line feeds left in it are taken as
+// content, so the trailing parameter may hold multiline text.
+func Parse(line string) *Line {
+	l := &Line{}
+	line = skipSpaces(line)
+
+	if strings.HasPrefix(line, "@") {
+		var tags string
+		tags, line = token(line[1:])
+		l.Tags = ParseTags(tags)
+		line = skipSpaces(line)
+	}
+
+	if strings.HasPrefix(line, ":") {
+		var prefix string
+		prefix, line = token(line[1:])
+		l.Nick, l.User, l.Host = parsePrefix(prefix)
+		line = skipSpaces(line)
+	}
+
+	l.Command, line = token(line)
+	for {
+		line = skipSpaces(line)
+		if line == "" {
+			break
+		}
+		if line[0] == ':' {
+			l.Trailing = line[1:]
+			l.HasTrailing = true
+			break
+		}
+		var param string
+		param, line = token(line)
+		l.Params = append(l.Params, param)
+	}
+	return l
+}
+
+func skipSpaces(s string) string {
+	return strings.TrimLeft(s, " ")
+}
+
+// token returns the content of s up to the first space, and the rest.
+func token(s string) (tok, rest string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+func parsePrefix(prefix string) (nick, user, host string) {
+	nick = prefix
+	if i := strings.IndexAny(nick, "!@"); i >= 0 {
+		nick, prefix = nick[:i], nick[i:]
+		if prefix[0] == '!' {
+			user = prefix[1:]
+			if j := strings.IndexByte(user, '@'); j >= 0 {
+				user, host = user[:j], user[j+1:]
+			}
+		} else {
+			host = prefix[1:]
+		}
+	}
+	if user == "" && host == "" && strings.Contains(nick, ".") {
+		nick, host = "", nick
+	}
+	return nick, user, host
+}
+
+// ParseTags parses the tags section of a line, without the leading "@",
+// as in "time=2024-01-31T15:04:05.000Z;msgid=abc". Tag values are
+// unescaped, and tags without a value map to an empty string. When a
+// tag is repeated the last value wins.
+func ParseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], UnescapeTagValue(tag[i+1:])
+		}
+		if key != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// UnescapeTagValue reverts the escaping of a tag value done by
+// EscapeTagValue. Unknown escapes stand for the escaped character,
+// and a trailing backslash is dropped.
+func UnescapeTagValue(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			break
+		}
+		switch s[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+var tagEscaper = strings.NewReplacer(";", `\:`, " ", `\s`, `\`, `\\`, "\r", `\r`, "\n", `\n`)
+
+// EscapeTagValue escapes s for use as a tag value.
+func EscapeTagValue(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+// String returns l formatted as an IRC protocol line, without the
+// terminating line break. Tags are sorted by key.
+func (l *Line) String() string {
+	var b strings.Builder
+	if l.Tags != nil {
+		keys := make([]string, 0, len(l.Tags))
+		for key := range l.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(key)
+			if value := l.Tags[key]; value != "" {
+				b.WriteByte('=')
+				b.WriteString(EscapeTagValue(value))
+			}
+		}
+		b.WriteByte(' ')
+	}
+	switch {
+	case l.Nick == "" && l.User == "" && strings.Contains(l.Host, ".") && !strings.ContainsAny(l.Host, "!@"):
+		b.WriteString(":" + l.Host + " ")
+	case l.Nick != "" || l.User != "" || l.Host != "":
+		b.WriteString(":" + l.Nick)
+		if l.User != "" {
+			b.WriteString("!" + l.User)
+		}
+		if l.Host != "" {
+			b.WriteString("@" + l.Host)
+		}
+		b.WriteByte(' ')
+	case strings.HasPrefix(l.Command, ":") || l.Tags == nil && strings.HasPrefix(l.Command, "@"):
+		// An empty prefix keeps the command from being taken as one.
+		b.WriteString(": ")
+	}
+	b.WriteString(l.Command)
+	for _, param := range l.Params {
+		b.WriteString(" " + param)
+	}
+	if l.HasTrailing {
+		b.WriteString(" :" + l.Trailing)
+	}
+	return b.String()
+}
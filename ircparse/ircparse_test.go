@@ -0,0 +1,108 @@
+package ircparse_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0/ircparse"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+var parseTests = []struct {
+	line   string
+	parsed ircparse.Line
+	format string
+}{{
+	line:   "",
+	parsed: ircparse.Line{},
+}, {
+	line:   "CMD",
+	parsed: ircparse.Line{Command: "CMD"},
+}, {
+	line:   "  CMD  p0   p1 :Some  text",
+	parsed: ircparse.Line{Command: "CMD", Params: []string{"p0", "p1"}, Trailing: "Some  text", HasTrailing: true},
+	format: "CMD p0 p1 :Some  text",
+}, {
+	line:   "CMD :",
+	parsed: ircparse.Line{Command: "CMD", HasTrailing: true},
+}, {
+	line:   "CMD some:param :",
+	parsed: ircparse.Line{Command: "CMD", Params: []string{"some:param"}, HasTrailing: true},
+}, {
+	line:   ":nick!user@host PRIVMSG #chan :Hello",
+	parsed: ircparse.Line{Nick: "nick", User: "user", Host: "host", Command: "PRIVMSG", Params: []string{"#chan"}, Trailing: "Hello", HasTrailing: true},
+}, {
+	line:   ":nick@host CMD",
+	parsed: ircparse.Line{Nick: "nick", Host: "host", Command: "CMD"},
+}, {
+	line:   ":host.com 001 mup :Welcome!",
+	parsed: ircparse.Line{Host: "host.com", Command: "001", Params: []string{"mup"}, Trailing: "Welcome!", HasTrailing: true},
+}, {
+	line:   ": CMD",
+	parsed: ircparse.Line{Command: "CMD"},
+	format: "CMD",
+}, {
+	line:   ": :CMD",
+	parsed: ircparse.Line{Command: ":CMD"},
+}, {
+	line: `@time=2024-01-31T15:04:05.000Z;msgid=a\sb\:c\\d\r\n\x;+draft/flag;e= :nick!user@host PRIVMSG #chan :Hi`,
+	parsed: ircparse.Line{
+		Tags: map[string]string{
+			"time":        "2024-01-31T15:04:05.000Z",
+			"msgid":       "a b;c\\d\r\nx",
+			"+draft/flag": "",
+			"e":           "",
+		},
+		Nick: "nick", User: "user", Host: "host", Command: "PRIVMSG", Params: []string{"#chan"}, Trailing: "Hi", HasTrailing: true,
+	},
+	format: `@+draft/flag;e;msgid=a\sb\:c\\d\r\nx;time=2024-01-31T15:04:05.000Z :nick!user@host PRIVMSG #chan :Hi`,
+}, {
+	line:   `@a=1;a=2;=3;b=trailing\ CMD`,
+	parsed: ircparse.Line{Tags: map[string]string{"a": "2", "b": "trailing"}, Command: "CMD"},
+	format: `@a=2;b=trailing CMD`,
+}, {
+	line:   "@ CMD",
+	parsed: ircparse.Line{Tags: map[string]string{}, Command: "CMD"},
+}, {
+	line:   "CMD :first\nSECOND :line",
+	parsed: ircparse.Line{Command: "CMD", Trailing: "first\nSECOND :line", HasTrailing: true},
+}}
+
+func (s *S) TestParse(c *C) {
+	for _, test := range parseTests {
+		c.Logf("Line: %q", test.line)
+		parsed := ircparse.Parse(test.line)
+		c.Assert(*parsed, DeepEquals, test.parsed)
+		format := test.format
+		if format == "" {
+			format = test.line
+		}
+		c.Assert(parsed.String(), Equals, format)
+	}
+}
+
+func (s *S) TestEscapeTagValue(c *C) {
+	c.Assert(ircparse.EscapeTagValue("a b;c\\d\r\n"), Equals, `a\sb\:c\\d\r\n`)
+	c.Assert(ircparse.UnescapeTagValue(`a\sb\:c\\d\r\n\`), Equals, "a b;c\\d\r\n")
+}
+
+func FuzzParse(f *testing.F) {
+	for _, test := range parseTests {
+		f.Add(test.line)
+	}
+	f.Add(":@a!b.c CMD")
+	f.Add(": @CMD")
+	f.Fuzz(func(t *testing.T, line string) {
+		parsed := ircparse.Parse(line)
+		again := ircparse.Parse(parsed.String())
+		if !reflect.DeepEqual(parsed, again) {
+			t.Fatalf("%q parsed as %#v, formatted as %q, and parsed back as %#v", line, parsed, parsed.String(), again)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package mup
+
+import (
+	"strconv"
+	"strings"
+)
+
+const cmdISupport = "005"
+
+// defaultLineLen is the maximum length of IRC lines, including the
+// trailing CR-LF, unless the server advertises otherwise via LINELEN.
+const defaultLineLen = 512
+
+// linePrefixReserve is the room left on outgoing lines for the prefix
+// the server adds when relaying them, such as ":nick!~user@host ".
+const linePrefixReserve = 100
+
+// ServerSupport holds the features advertised by an IRC server via
+// RPL_ISUPPORT (005) replies. Zero values mean the server did not
+// advertise the respective feature.
+type ServerSupport struct {
+	Network    string `json:"network,omitempty"`
+	NickLen    int    `json:"nicklen,omitempty"`
+	ChannelLen int    `json:"channellen,omitempty"`
+	TopicLen   int    `json:"topiclen,omitempty"`
+	LineLen    int    `json:"linelen,omitempty"`
+
+	// ChanTypes holds the prefixes the server accepts on channel names.
+	ChanTypes string `json:"chantypes,omitempty"`
+
+	// PrefixModes and PrefixSymbols hold the channel membership modes
+	// and the respective nick prefixes shown in NAMES replies, such as
+	// "ov" and "@+".
+	PrefixModes   string `json:"prefixmodes,omitempty"`
+	PrefixSymbols string `json:"prefixsymbols,omitempty"`
+}
+
+// update adds to s the features advertised by an RPL_ISUPPORT message.
+// The first parameter of such messages is the bot nick, and the trailing
+// text is a human readable note, so both are ignored.
+func (s *ServerSupport) update(msg *Message) {
+	params := strings.Fields(strings.Join([]string{msg.Param1, msg.Param2, msg.Param3}, " "))
+	for _, param := range params {
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		switch name {
+		case "NETWORK":
+			s.Network = value
+		case "NICKLEN", "MAXNICKLEN":
+			s.NickLen = supportInt(value, s.NickLen)
+		case "CHANNELLEN":
+			s.ChannelLen = supportInt(value, s.ChannelLen)
+		case "TOPICLEN":
+			s.TopicLen = supportInt(value, s.TopicLen)
+		case "LINELEN":
+			s.LineLen = supportInt(value, s.LineLen)
+		case "CHANTYPES":
+			s.ChanTypes = value
+		case "PREFIX":
+			// For example: (ov)@+
+			if i := strings.Index(value, ")"); strings.HasPrefix(value, "(") && i > 0 {
+				s.PrefixModes = value[1:i]
+				s.PrefixSymbols = value[i+1:]
+			}
+		}
+	}
+}
+
+func supportInt(value string, old int) int {
+	if n, err := strconv.Atoi(value); err == nil && n > 0 {
+		return n
+	}
+	return old
+}
+
+// lineLen returns the maximum length of lines accepted by the server,
+// including the trailing CR-LF.
+func (s *ServerSupport) lineLen() int {
+	if s.LineLen > 0 {
+		return s.LineLen
+	}
+	return defaultLineLen
+}
+
+// isChannel returns whether name is a channel name according to the
+// channel prefixes supported by the server.
+func (s *ServerSupport) isChannel(name string) bool {
+	if s.ChanTypes == "" || name == "" {
+		return isChannel(name)
+	}
+	return strings.IndexByte(s.ChanTypes, name[0]) >= 0 && !strings.ContainsAny(name, " ,\x07")
+}
+
+// splitText breaks text in pieces with at most max bytes each, preferably
+// at spaces and never within a UTF-8 sequence.
+func splitText(text string, max int) []string {
+	var pieces []string
+	for len(text) > max {
+		split := max
+		for split > 0 && text[split]&0xC0 == 0x80 {
+			split--
+		}
+		if i := strings.LastIndex(text[:split], " "); i > max/2 {
+			split = i
+		}
+		if split == 0 {
+			split = max
+		}
+		pieces = append(pieces, text[:split])
+		text = strings.TrimLeft(text[split:], " ")
+	}
+	return append(pieces, text)
+}
@@ -0,0 +1,170 @@
+package mup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// jsonRPC issues JSON-RPC requests to a helper process, such as a signal-cli
+// daemon, over its standard input. Responses are read from the process output
+// by the reader that owns it and dispatched back here.
+type jsonRPC struct {
+	name    string
+	mu      sync.Mutex
+	input   io.Writer
+	lastId  int64
+	pending map[int64]chan *jsonRPCMessage
+	started chan struct{}
+	dying   <-chan struct{}
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+	Id      int64       `json:"id"`
+}
+
+type jsonRPCNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Result  interface{}   `json:"result,omitempty"`
+	Error   *jsonRPCError `json:"error,omitempty"`
+	Id      int64         `json:"id"`
+}
+
+type jsonRPCMessage struct {
+	Id     *int64          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *jsonRPCError   `json:"error"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error returns the failure reported by the peer. Errors of this type
+// mean the peer handled and refused the request, so retrying it is
+// unlikely to help.
+func (e *jsonRPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+func newJSONRPC(name string, dying <-chan struct{}) *jsonRPC {
+	return &jsonRPC{
+		name:    name,
+		pending: make(map[int64]chan *jsonRPCMessage),
+		started: make(chan struct{}),
+		dying:   dying,
+	}
+}
+
+// start enables requests to be written into input.
+func (rpc *jsonRPC) start(input io.Writer) {
+	rpc.mu.Lock()
+	rpc.input = input
+	rpc.mu.Unlock()
+	close(rpc.started)
+}
+
+func (rpc *jsonRPC) dispatch(msg *jsonRPCMessage) {
+	rpc.mu.Lock()
+	reply, ok := rpc.pending[*msg.Id]
+	rpc.mu.Unlock()
+	if ok {
+		reply <- msg
+	}
+}
+
+// call sends a request to the process and waits for its response, which is
+// unmarshalled into result if that's not nil.
+func (rpc *jsonRPC) call(dying <-chan struct{}, method string, params, result interface{}) error {
+	select {
+	case <-rpc.started:
+	case <-rpc.dying:
+		return fmt.Errorf("%s not running", rpc.name)
+	case <-dying:
+		return errStop
+	}
+
+	reply := make(chan *jsonRPCMessage, 1)
+	rpc.mu.Lock()
+	rpc.lastId++
+	id := rpc.lastId
+	rpc.pending[id] = reply
+	err := rpc.writeLocked(&jsonRPCRequest{"2.0", method, params, id})
+	rpc.mu.Unlock()
+
+	defer func() {
+		rpc.mu.Lock()
+		delete(rpc.pending, id)
+		rpc.mu.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			return json.Unmarshal(msg.Result, result)
+		}
+		return nil
+	case <-time.After(NetworkTimeout):
+		return fmt.Errorf("timeout waiting for %s response", method)
+	case <-rpc.dying:
+		return fmt.Errorf("%s terminated", rpc.name)
+	case <-dying:
+		return errStop
+	}
+}
+
+// notify sends a notification to the process, which is not answered.
+func (rpc *jsonRPC) notify(method string, params interface{}) error {
+	select {
+	case <-rpc.started:
+	default:
+		return fmt.Errorf("%s not running", rpc.name)
+	}
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+	return rpc.writeLocked(&jsonRPCNotification{"2.0", method, params})
+}
+
+// reply answers a request made by the process with either result or err.
+func (rpc *jsonRPC) reply(id int64, result interface{}, err error) error {
+	resp := &jsonRPCResponse{JSONRPC: "2.0", Id: id}
+	if err != nil {
+		resp.Error = &jsonRPCError{Code: -32000, Message: err.Error()}
+	} else if result != nil {
+		resp.Result = result
+	} else {
+		resp.Result = struct{}{}
+	}
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+	return rpc.writeLocked(resp)
+}
+
+func (rpc *jsonRPC) writeLocked(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = rpc.input.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,74 @@
+package ldap
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 1000
+
+// searchCache holds recent search results, dropping the least recently
+// used ones once it grows beyond its size.
+type searchCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type cacheEntry struct {
+	key     string
+	results []Result
+	expires time.Time
+}
+
+func newSearchCache(ttl time.Duration, size int) *searchCache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &searchCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func cacheKey(s *Search) string {
+	return s.Filter + "\x00" + strings.Join(s.Attrs, "\x00")
+}
+
+func (c *searchCache) get(s *Search) ([]Result, bool) {
+	key := cacheKey(s)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.results, true
+}
+
+func (c *searchCache) put(s *Search, results []Result) {
+	key := cacheKey(s)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, results, time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.entries, elem.Value.(*cacheEntry).key)
+	}
+}
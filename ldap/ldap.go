@@ -1,8 +1,12 @@
 package ldap
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
 	"gopkg.in/ldap.v0"
 )
@@ -12,6 +16,30 @@ type Config struct {
 	BaseDN   string
 	BindDN   string
 	BindPass string
+
+	// PoolSize is the maximum number of connections kept open by
+	// a managed connection. It defaults to one.
+	PoolSize int
+
+	// IdleTimeout is how long pooled connections beyond the first one
+	// may remain unused before being closed. Zero means never.
+	IdleTimeout time.Duration
+
+	// StartTLS upgrades plain ldap:// connections to TLS before binding.
+	// Connections to ldaps:// URLs use TLS from the start.
+	StartTLS bool
+
+	// CACert holds PEM-encoded certificates that TLS connections must be
+	// signed by, in place of the system roots.
+	CACert string
+
+	// CacheTTL is how long results of managed connection searches are
+	// reused for identical searches. Zero disables caching.
+	CacheTTL time.Duration
+
+	// CacheSize is the maximum number of distinct searches cached.
+	// It defaults to 1000.
+	CacheSize int
 }
 
 type Conn interface {
@@ -65,11 +93,26 @@ func Dial(config *Config) (Conn, error) {
 	var conn *ldap.Conn
 	var err error
 	if strings.HasPrefix(config.URL, "ldaps://") {
-		conn, err = ldap.DialTLS("tcp", config.URL[8:], nil)
-	} else if strings.HasPrefix(config.URL, "ldap://") {
-		conn, err = ldap.Dial("tcp", config.URL[7:])
+		var tlsConfig *tls.Config
+		tlsConfig, err = config.tlsConfig(config.URL[8:])
+		if err != nil {
+			return nil, err
+		}
+		conn, err = ldap.DialTLS("tcp", config.URL[8:], tlsConfig)
 	} else {
-		conn, err = ldap.Dial("tcp", config.URL)
+		addr := strings.TrimPrefix(config.URL, "ldap://")
+		conn, err = ldap.Dial("tcp", addr)
+		if err == nil && config.StartTLS {
+			var tlsConfig *tls.Config
+			tlsConfig, err = config.tlsConfig(addr)
+			if err == nil {
+				err = conn.StartTLS(tlsConfig)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("cannot start TLS with LDAP server: %v", err)
+			}
+		}
 	}
 	if err != nil {
 		return nil, fmt.Errorf("cannot dial LDAP server: %v", err)
@@ -82,6 +125,21 @@ func Dial(config *Config) (Conn, error) {
 	return &ldapConn{conn, config.BaseDN}, nil
 }
 
+func (config *Config) tlsConfig(addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if config.CACert != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, fmt.Errorf("cannot parse LDAP CA certificate")
+		}
+	}
+	return tlsConfig, nil
+}
+
 func (c *ldapConn) Close() error {
 	c.conn.Close()
 	return nil
@@ -2,7 +2,9 @@ package ldap_test
 
 import (
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/mup.v0/ldap"
@@ -138,6 +140,127 @@ func (s *S) TestManaged(c *C) {
 	c.Assert(conns[1].search.Filter, Equals, "test-filter2")
 }
 
+type blockingConn struct {
+	ldapConn
+	unblock chan bool
+}
+
+func (c *blockingConn) Search(s *ldap.Search) ([]ldap.Result, error) {
+	<-c.unblock
+	return c.ldapConn.Search(s)
+}
+
+func (s *S) TestManagedPool(c *C) {
+	var mu sync.Mutex
+	var conns []*blockingConn
+	ldap.TestDial = func(c *ldap.Config) (ldap.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		conn := &blockingConn{ldapConn{config: c}, make(chan bool)}
+		if len(conns) > 0 {
+			close(conn.unblock)
+		}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	defer func() {
+		ldap.TestDial = nil
+	}()
+
+	poolConfig := *config
+	poolConfig.PoolSize = 2
+	mconn := ldap.DialManaged(&poolConfig)
+	defer mconn.Close()
+
+	// The first connection hangs, so the second one must serve the search.
+	blocked := make(chan error, 1)
+	go func() {
+		conn := mconn.Conn()
+		defer conn.Close()
+		_, err := conn.Search(&ldap.Search{Filter: "test-filter1"})
+		blocked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	conn := mconn.Conn()
+	defer conn.Close()
+	res, err := conn.Search(&ldap.Search{Filter: "test-filter2"})
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 1)
+
+	mu.Lock()
+	c.Assert(conns, HasLen, 2)
+	c.Assert(conns[1].search.Filter, Equals, "test-filter2")
+	close(conns[0].unblock)
+	mu.Unlock()
+
+	c.Assert(<-blocked, IsNil)
+}
+
+type searchLog struct {
+	mu       sync.Mutex
+	searches []string
+}
+
+type countingConn struct {
+	ldapConn
+	log *searchLog
+}
+
+func (c *countingConn) Search(s *ldap.Search) ([]ldap.Result, error) {
+	c.log.mu.Lock()
+	c.log.searches = append(c.log.searches, s.Filter)
+	c.log.mu.Unlock()
+	if s.Filter == "fail" {
+		return nil, fmt.Errorf("test-error")
+	}
+	return []ldap.Result{{DN: s.Filter}}, nil
+}
+
+func (s *S) TestManagedCache(c *C) {
+	log := &searchLog{}
+	ldap.TestDial = func(c *ldap.Config) (ldap.Conn, error) {
+		return &countingConn{log: log}, nil
+	}
+	defer func() {
+		ldap.TestDial = nil
+	}()
+
+	cacheConfig := *config
+	cacheConfig.CacheTTL = 200 * time.Millisecond
+	cacheConfig.CacheSize = 2
+	mconn := ldap.DialManaged(&cacheConfig)
+	defer mconn.Close()
+
+	search := func(filter string) {
+		mc := mconn.Conn()
+		defer mc.Close()
+		res, err := mc.Search(&ldap.Search{Filter: filter})
+		if filter == "fail" {
+			c.Assert(err, ErrorMatches, "test-error")
+		} else {
+			c.Assert(err, IsNil)
+			c.Assert(res, DeepEquals, []ldap.Result{{DN: filter}})
+		}
+	}
+
+	search("a")
+	search("a")
+	search("b")
+	search("fail")
+	search("fail")
+	search("a")
+	search("c") // Evicts b, the least recently used.
+	search("a")
+	search("b")
+	time.Sleep(250 * time.Millisecond)
+	search("a")
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	c.Assert(log.searches, DeepEquals, []string{"a", "b", "fail", "fail", "c", "b", "a"})
+}
+
 func (s *S) TestEscapeFilter(c *C) {
 	c.Assert(ldap.EscapeFilter("a\x00b(c)d*e\\f"), Equals, `a\00b\28c\29d\2ae\5cf`)
 	c.Assert(ldap.EscapeFilter("Lučić"), Equals, `Lu\c4\8di\c4\87`)
@@ -11,29 +11,41 @@ import (
 type ManagedConn struct {
 	tomb     tomb.Tomb
 	config   Config
-	searches chan *Search
-	results  chan managedResults
+	searches chan *managedSearch
+	overflow chan *managedSearch
 	open     chan bool
 	close    chan bool
+	cache    *searchCache
 
 	mu     sync.Mutex
 	err    error
 	closed bool
 }
 
+type managedSearch struct {
+	search  *Search
+	results chan managedResults
+}
+
 type managedResults struct {
 	results []Result
 	err     error
 }
 
+// DialManaged returns a connection manager that keeps up to config.PoolSize
+// connections to the LDAP server, redialing them when they fail and checking
+// periodically that they remain healthy.
 func DialManaged(config *Config) *ManagedConn {
 	mconn := &ManagedConn{
 		config:   *config,
-		searches: make(chan *Search),
-		results:  make(chan managedResults),
+		searches: make(chan *managedSearch),
+		overflow: make(chan *managedSearch),
 		open:     make(chan bool),
 		close:    make(chan bool),
 	}
+	if config.CacheTTL > 0 {
+		mconn.cache = newSearchCache(config.CacheTTL, config.CacheSize)
+	}
 	mconn.tomb.Go(mconn.loop)
 	return mconn
 }
@@ -63,45 +75,125 @@ var pingSearch = Search{
 const managedTimeout = 5 * time.Second
 
 func (mconn *ManagedConn) loop() error {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	poolSize := mconn.config.PoolSize
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	for i := 0; i < poolSize; i++ {
+		eager := i == 0
+		mconn.tomb.Go(func() error { return mconn.worker(eager) })
+	}
 	refs := 1
 	for refs > 0 {
-		conn, err := Dial(&mconn.config)
-		if err != nil {
-			mconn.setError(err)
-			select {
-			case <-time.After(managedTimeout):
-			case <-mconn.open:
-				refs++
-			case <-mconn.close:
-				refs--
+		select {
+		case <-mconn.open:
+			refs++
+		case <-mconn.close:
+			refs--
+		}
+	}
+	mconn.tomb.Kill(nil)
+	return nil
+}
+
+// worker serves searches over its own connection to the server. An eager
+// worker keeps its connection open at all times, while the others dial on
+// demand and hang up after being idle for config.IdleTimeout.
+func (mconn *ManagedConn) worker(eager bool) error {
+	var conn Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(managedTimeout)
+	defer ticker.Stop()
+
+	var retry <-chan time.Time
+	var lastUse time.Time
+	for {
+		if conn == nil && eager && retry == nil {
+			if conn, _ = mconn.dial(); conn == nil {
+				retry = time.After(managedTimeout)
+			}
+		}
+
+		// Searches go to open connections first, and only overflow
+		// into dialing new ones when those are all busy.
+		searches, overflow := mconn.searches, mconn.overflow
+		if conn != nil {
+			overflow = nil
+		} else if !eager {
+			searches = nil
+		}
+
+		var s *managedSearch
+		select {
+		case s = <-searches:
+		case s = <-overflow:
+		case <-retry:
+			retry = nil
+		case <-ticker.C:
+			if conn == nil {
+				continue
+			}
+			if !eager && mconn.config.IdleTimeout > 0 && time.Since(lastUse) > mconn.config.IdleTimeout {
+				conn.Close()
+				conn = nil
+				continue
 			}
-			continue
+			if _, err := mconn.search(conn, &pingSearch); err != nil {
+				mconn.setError(err)
+				conn.Close()
+				conn = nil
+			}
+		case <-mconn.tomb.Dying():
+			return nil
 		}
-		mconn.setError(nil)
-
-		var results []Result
-		for refs > 0 && err == nil {
-			select {
-			case s := <-mconn.searches:
-				results, err = conn.Search(s)
-				select {
-				case mconn.results <- managedResults{results, err}:
-				case <-time.After(500 * time.Millisecond):
+		if s != nil {
+			if conn == nil {
+				var err error
+				if conn, err = mconn.dial(); err != nil {
+					s.results <- managedResults{nil, err}
+					continue
 				}
-			case <-ticker.C:
-				_, err = conn.Search(&pingSearch)
-			case <-mconn.open:
-				refs++
-			case <-mconn.close:
-				refs--
 			}
+			results, err := mconn.search(conn, s.search)
+			s.results <- managedResults{results, err}
+			if err != nil {
+				mconn.setError(err)
+				conn.Close()
+				conn = nil
+			}
+			lastUse = time.Now()
 		}
-		mconn.setError(err)
-		conn.Close()
 	}
-	return nil
+}
+
+func (mconn *ManagedConn) dial() (Conn, error) {
+	conn, err := Dial(&mconn.config)
+	mconn.setError(err)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// search runs s on conn, giving up if the server doesn't answer in time
+// so that a dead connection doesn't block the worker indefinitely.
+func (mconn *ManagedConn) search(conn Conn, s *Search) ([]Result, error) {
+	done := make(chan managedResults, 1)
+	go func() {
+		results, err := conn.Search(s)
+		done <- managedResults{results, err}
+	}()
+	select {
+	case r := <-done:
+		return r.results, r.err
+	case <-time.After(managedTimeout):
+		return nil, fmt.Errorf("LDAP server did not respond in %v", managedTimeout)
+	}
 }
 
 func (mconn *ManagedConn) Conn() Conn {
@@ -137,15 +229,33 @@ func (conn *managedConn) Search(s *Search) ([]Result, error) {
 	if closed {
 		return nil, fmt.Errorf("LDAP connection already closed")
 	}
+	cache := conn.mconn.cache
+	if cache != nil {
+		if results, ok := cache.get(s); ok {
+			return results, nil
+		}
+	}
+	req := &managedSearch{s, make(chan managedResults, 1)}
 	timeout := time.After(managedTimeout)
 	select {
-	case conn.mconn.searches <- s:
+	case conn.mconn.searches <- req:
+	default:
 		select {
-		case r := <-conn.mconn.results:
+		case conn.mconn.searches <- req:
+		case conn.mconn.overflow <- req:
+		case <-timeout:
+			req = nil
+		}
+	}
+	if req != nil {
+		select {
+		case r := <-req.results:
+			if cache != nil && r.err == nil {
+				cache.put(s, r.results)
+			}
 			return r.results, r.err
 		case <-timeout:
 		}
-	case <-timeout:
 	}
 	conn.mconn.mu.Lock()
 	err := conn.mconn.err
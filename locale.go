@@ -0,0 +1,103 @@
+package mup
+
+import (
+	"bytes"
+	"strings"
+	"time"
+)
+
+// localeNames holds the month and weekday names of a language,
+// in full and abbreviated. Weekdays start on Sunday.
+type localeNames struct {
+	months, shortMonths     [12]string
+	weekdays, shortWeekdays [7]string
+}
+
+// locales holds the names for the languages FormatTime knows about,
+// indexed by the language code that locales such as "pt_BR" start with.
+var locales = map[string]*localeNames{
+	"de": {
+		[12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		[12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		[7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		[7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+	},
+	"es": {
+		[12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		[12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		[7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		[7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+	},
+	"fr": {
+		[12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		[12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		[7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		[7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+	},
+	"it": {
+		[12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		[12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		[7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		[7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+	},
+	"nl": {
+		[12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		[12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		[7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		[7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+	},
+	"pt": {
+		[12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		[12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		[7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		[7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+	},
+}
+
+// localeLanguage returns the language code that locale starts with,
+// such as "pt" for "pt_BR" or "pt-BR".
+func localeLanguage(locale string) string {
+	if i := strings.IndexAny(locale, "_-."); i >= 0 {
+		locale = locale[:i]
+	}
+	return strings.ToLower(locale)
+}
+
+// formatTimeLocale returns t formatted according to layout, with month
+// and weekday names in the language of locale, if known.
+func formatTimeLocale(t time.Time, layout, locale string) string {
+	names := locales[localeLanguage(locale)]
+	if names == nil {
+		return t.Format(layout)
+	}
+
+	// The layout is formatted in pieces around the names, so that the
+	// translated names are never taken as layout elements themselves.
+	var buf bytes.Buffer
+	for layout != "" {
+		i := strings.Index(layout, "Jan")
+		if j := strings.Index(layout, "Mon"); j >= 0 && (i < 0 || j < i) {
+			i = j
+		}
+		if i < 0 {
+			buf.WriteString(t.Format(layout))
+			break
+		}
+		var name string
+		var n int
+		switch rest := layout[i:]; {
+		case strings.HasPrefix(rest, "January"):
+			name, n = names.months[t.Month()-1], len("January")
+		case strings.HasPrefix(rest, "Jan"):
+			name, n = names.shortMonths[t.Month()-1], len("Jan")
+		case strings.HasPrefix(rest, "Monday"):
+			name, n = names.weekdays[t.Weekday()], len("Monday")
+		default:
+			name, n = names.shortWeekdays[t.Weekday()], len("Mon")
+		}
+		buf.WriteString(t.Format(layout[:i]))
+		buf.WriteString(name)
+		layout = layout[i+n:]
+	}
+	return buf.String()
+}
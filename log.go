@@ -15,12 +15,91 @@ type log_Logger interface {
 	Output(calldepth int, s string) error
 }
 
+// LogLevel defines how verbose logging is.
+type LogLevel int
+
+const (
+	// LogUnset means the level is inherited from the outer scope.
+	LogUnset LogLevel = iota
+
+	// LogQuiet disables all logging.
+	LogQuiet
+
+	// LogInfo enables informational messages. This is the default.
+	LogInfo
+
+	// LogDebug enables informational and debug messages.
+	LogDebug
+)
+
+var logLevelNames = []string{"", "quiet", "info", "debug"}
+
+// String returns the name of the log level as stored in the database.
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel returns the log level with the provided name. The
+// empty string is parsed as LogUnset.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, lname := range logLevelNames {
+		if name == lname {
+			return LogLevel(i), nil
+		}
+	}
+	return LogUnset, fmt.Errorf("unknown log level: %q", name)
+}
+
+// LogFields holds the context a log message refers to.
+// Fields that do not apply to a given message are empty.
+type LogFields struct {
+	Account string
+	Plugin  string
+	Command string
+}
+
+// StructuredLogger is implemented by loggers that take log messages
+// with their context provided separately from the message text.
+type StructuredLogger interface {
+	Log(level LogLevel, fields LogFields, message string)
+}
+
+// textLogger adapts a traditional logger into a StructuredLogger by
+// prefixing the message with the plugin or account name under brackets.
+type textLogger struct {
+	logger log_Logger
+}
+
+func (l textLogger) Log(level LogLevel, fields LogFields, message string) {
+	if fields.Plugin != "" {
+		message = "[" + fields.Plugin + "] " + message
+	} else if fields.Account != "" {
+		message = "[" + fields.Account + "] " + message
+	}
+	l.logger.Output(4, message)
+}
+
 var globalLoggerLock sync.Mutex
-var globalLogger log_Logger
+var globalLogger StructuredLogger
 var globalDebug bool
+var accountLevels map[string]LogLevel
+var pluginLevels map[string]LogLevel
 
 // Specify the *log.Logger object where log messages should be sent to.
 func SetLogger(logger log_Logger) {
+	if logger == nil {
+		SetStructuredLogger(nil)
+	} else {
+		SetStructuredLogger(textLogger{logger})
+	}
+}
+
+// SetStructuredLogger specifies the logger that log messages should be
+// sent to, with their context provided as separate fields.
+func SetStructuredLogger(logger StructuredLogger) {
 	globalLoggerLock.Lock()
 	globalLogger = logger
 	globalLoggerLock.Unlock()
@@ -34,23 +113,68 @@ func SetDebug(debug bool) {
 	globalLoggerLock.Unlock()
 }
 
-// logf sends to the logger registered via SetLogger the string resulting
-// from running format and args through Sprintf.
-func logf(format string, args ...interface{}) {
+// setLogLevels replaces the per-account and per-plugin log level overrides.
+// Levels set for a plugin take precedence over levels set for an account.
+func setLogLevels(accounts, plugins map[string]LogLevel) {
+	globalLoggerLock.Lock()
+	if accounts != nil {
+		accountLevels = accounts
+	}
+	if plugins != nil {
+		pluginLevels = plugins
+	}
+	globalLoggerLock.Unlock()
+}
+
+// logLevel returns the log level in effect for messages with the provided
+// fields. It must be called with globalLoggerLock held.
+func logLevel(fields *LogFields) LogLevel {
+	if fields.Plugin != "" {
+		if level := pluginLevels[fields.Plugin]; level != LogUnset {
+			return level
+		}
+	}
+	if fields.Account != "" {
+		if level := accountLevels[fields.Account]; level != LogUnset {
+			return level
+		}
+	}
+	if globalDebug {
+		return LogDebug
+	}
+	return LogInfo
+}
+
+// logAt sends to the logger registered via SetLogger or SetStructuredLogger
+// the string resulting from running format and args through Sprintf, if
+// level is enabled for the provided fields.
+func logAt(level LogLevel, fields LogFields, format string, args ...interface{}) {
 	globalLoggerLock.Lock()
 	defer globalLoggerLock.Unlock()
-	if globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintf(format, args...))
+	if globalLogger != nil && level <= logLevel(&fields) {
+		globalLogger.Log(level, fields, fmt.Sprintf(format, args...))
 	}
 }
 
+// logf sends to the logger registered via SetLogger the string resulting
+// from running format and args through Sprintf.
+func logf(format string, args ...interface{}) {
+	logAt(LogInfo, LogFields{}, format, args...)
+}
+
 // debugf sends to the logger registered via SetLogger the string resulting
 // from running format and args through Sprintf, but only if debugging was
 // enabled via SetDebug.
 func debugf(format string, args ...interface{}) {
-	globalLoggerLock.Lock()
-	defer globalLoggerLock.Unlock()
-	if globalDebug && globalLogger != nil {
-		globalLogger.Output(2, fmt.Sprintf(format, args...))
-	}
+	logAt(LogDebug, LogFields{}, format, args...)
+}
+
+// accountLogf logs a message about the named account.
+func accountLogf(account string, format string, args ...interface{}) {
+	logAt(LogInfo, LogFields{Account: account}, format, args...)
+}
+
+// accountDebugf logs a debug message about the named account.
+func accountDebugf(account string, format string, args ...interface{}) {
+	logAt(LogDebug, LogFields{Account: account}, format, args...)
 }
@@ -1,12 +1,17 @@
 package mup
 
 import (
+	"database/sql/driver"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"math/rand"
 	"strings"
 	"sync"
 	"time"
 	"unicode"
+
+	"gopkg.in/mup.v0/ircparse"
 )
 
 const (
@@ -15,11 +20,19 @@ const (
 	cmdPrivMsg   = "PRIVMSG"
 	cmdNotice    = "NOTICE"
 	cmdNick      = "NICK"
+	cmdCap       = "CAP"
+	cmdBatch     = "BATCH"
+	cmdAway      = "AWAY"
+	cmdAwayReply = "301"
 	cmdPing      = "PING"
 	cmdPong      = "PONG"
 	cmdJoin      = "JOIN"
 	cmdPart      = "PART"
 	cmdQuit      = "QUIT"
+	cmdCallback  = "CALLBACK"
+	cmdEditMsg   = "EDITMSG"
+	cmdDeleteMsg = "DELMSG"
+	cmdReact     = "REACT"
 )
 
 type LaneType int
@@ -54,6 +67,14 @@ type Message struct {
 
 	// Raw parameters when not a PRIVMSG or NOTICE, and excluding Text.
 	// All exceeding parameters on IRC go together with Param3.
+	//
+	// Messages received from Telegram hold their Telegram message id
+	// in Param0, including PRIVMSGs. Edits are delivered with the EDITMSG
+	// command and deletions with the DELMSG command, both holding in
+	// Param0 the id of the message changed and the Channel it was sent to,
+	// as in "EDITMSG #chan 42 :new text". Reactions sent via Plugger.React
+	// go out with the REACT command in the same form, holding the emoji
+	// in Text, as in "REACT #chan 42 :👍".
 	Param0 string
 	Param1 string
 	Param2 string
@@ -73,9 +94,169 @@ type Message struct {
 
 	// The bot nick that was in place when the message was received.
 	AsNick string
+
+	// The file attached to the message, if any.
+	Attachment Attachment
+
+	// The id of the message this one is a reply to, and the nick of
+	// the original author of a forwarded message, for transports that
+	// support these (Telegram). Messages replying to the bot are taken
+	// as addressed to it, and have their BotText set accordingly.
+	ReplyTo     string
+	ForwardFrom string
+
+	// The id of the thread the message belongs to, for transports that
+	// support threads (Telegram, email). Incoming messages hold the id
+	// that replies must refer to for joining the conversation, which is
+	// the Telegram message id or the mail Message-ID. Outgoing messages
+	// holding it are delivered as replies within that thread.
+	ThreadId string
+
+	// Buttons offered alongside an outgoing message, for transports that
+	// support them natively. Pressing a button on Telegram delivers an
+	// incoming message with the CALLBACK command, the button data as
+	// its Text, and the callback query id in Param0.
+	Buttons Buttons
+
+	// Priority defines the order in which pending outgoing messages are
+	// delivered. Messages with higher priority go out first, with lower
+	// priority ones interleaved now and then so that they still progress.
+	Priority Priority
+
+	// The IRCv3 message tags the server sent with the message, if any,
+	// such as "msgid", or "account" with the account-tag capability.
+	// The "time" tag sent with the server-time capability, which notably
+	// bouncers use to timestamp playback, is also reflected in Time.
+	Tags Tags
+
+	// Whether the message was played back by a bouncer, such as the
+	// buffer ZNC sends when the bot connects. Played back messages are
+	// recorded but not handed to plugins.
+	Playback bool
+}
+
+// Tags holds IRCv3 message tags and their unescaped values.
+type Tags map[string]string
+
+// Value implements driver.Valuer so tags may be stored in the database.
+func (t Tags) Value() (driver.Value, error) {
+	if len(t) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(t)
+	return string(data), err
 }
 
-const messageColumns = "id,nonce,lane,time,account,channel,nick,user,host,command,param0,param1,param2,param3,text,bottext,bang,asnick"
+// Scan implements sql.Scanner so tags may be loaded from the database.
+func (t *Tags) Scan(src interface{}) error {
+	data, err := scanBytes(src, "tags")
+	*t = nil
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	return json.Unmarshal(data, t)
+}
+
+// Priority defines how urgently an outgoing message should be delivered.
+type Priority int
+
+const (
+	// PriorityLow is used for broadcasts, such as notifications sent by
+	// watcher plugins, which may wait behind interactive replies.
+	PriorityLow Priority = -1
+
+	// PriorityNormal is used when no priority is defined.
+	PriorityNormal Priority = 0
+
+	// PriorityHigh is used for replies to incoming messages, which
+	// someone is likely waiting on.
+	PriorityHigh Priority = 1
+)
+
+// Button is an option offered with an outgoing message that people may
+// press to reply with the button data instead of typing a response.
+type Button struct {
+	Text string `json:"text"`
+	Data string `json:"data"`
+}
+
+// Buttons holds rows of buttons to be shown with a message.
+type Buttons [][]Button
+
+// Value implements driver.Valuer so buttons may be stored in the database.
+func (b Buttons) Value() (driver.Value, error) {
+	if len(b) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(b)
+	return string(data), err
+}
+
+// Scan implements sql.Scanner so buttons may be loaded from the database.
+func (b *Buttons) Scan(src interface{}) error {
+	data, err := scanBytes(src, "buttons")
+	*b = nil
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	return json.Unmarshal(data, b)
+}
+
+func scanBytes(src interface{}, what string) ([]byte, error) {
+	switch src := src.(type) {
+	case string:
+		return []byte(src), nil
+	case []byte:
+		return src, nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot scan %T into %s", src, what)
+}
+
+// Attachment describes a file attached to a message, such as a photo or
+// document sent on Telegram. The file content itself is not held.
+type Attachment struct {
+	// The kind of attachment, such as "photo", "document", or "sticker".
+	// Empty when there is no attachment.
+	Kind string `json:"kind"`
+
+	// The transport-specific identifier of the file.
+	Id string `json:"id,omitempty"`
+
+	Name     string `json:"name,omitempty"`
+	MimeType string `json:"mimetype,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+
+	// The local path of the file, for transports that download it.
+	Path string `json:"path,omitempty"`
+
+	// The content of "text" attachments, which hold the lines following
+	// the first one in multi-line messages when accounts are set to
+	// handle them that way.
+	Text string `json:"text,omitempty"`
+}
+
+// Value implements driver.Valuer so attachments may be stored in the database.
+func (a Attachment) Value() (driver.Value, error) {
+	if a.Kind == "" {
+		return "", nil
+	}
+	data, err := json.Marshal(a)
+	return string(data), err
+}
+
+// Scan implements sql.Scanner so attachments may be loaded from the database.
+func (a *Attachment) Scan(src interface{}) error {
+	data, err := scanBytes(src, "attachment")
+	*a = Attachment{}
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	return json.Unmarshal(data, a)
+}
+
+const messageColumns = "id,nonce,lane,time,account,channel,nick,user,host,command,param0,param1,param2,param3,text,bottext,bang,asnick,attachment,buttons,priority,replyto,forwardfrom,threadid,tags,playback"
 
 var messagePlacers = placers(messageColumns)
 
@@ -94,11 +275,11 @@ func (m *Message) refs(lane LaneType) []interface{} {
 			m.Nonce = hex.EncodeToString(buf[:])
 		}
 	}
-	return []interface{}{idRef, &m.Nonce, laneRef, &m.Time, &m.Account, &m.Channel, &m.Nick, &m.User, &m.Host, &m.Command, &m.Param0, &m.Param1, &m.Param2, &m.Param3, &m.Text, &m.BotText, &m.Bang, &m.AsNick}
+	return []interface{}{idRef, &m.Nonce, laneRef, &m.Time, &m.Account, &m.Channel, &m.Nick, &m.User, &m.Host, &m.Command, &m.Param0, &m.Param1, &m.Param2, &m.Param3, &m.Text, &m.BotText, &m.Bang, &m.AsNick, &m.Attachment, &m.Buttons, &m.Priority, &m.ReplyTo, &m.ForwardFrom, &m.ThreadId, &m.Tags, &m.Playback}
 }
 
 func (m *Message) refsNoId() []interface{} {
-	return []interface{}{nil, &m.Nonce, &m.Lane, &m.Time, &m.Account, &m.Channel, &m.Nick, &m.User, &m.Host, &m.Command, &m.Param0, &m.Param1, &m.Param2, &m.Param3, &m.Text, &m.BotText, &m.Bang, &m.AsNick}
+	return []interface{}{nil, &m.Nonce, &m.Lane, &m.Time, &m.Account, &m.Channel, &m.Nick, &m.User, &m.Host, &m.Command, &m.Param0, &m.Param1, &m.Param2, &m.Param3, &m.Text, &m.BotText, &m.Bang, &m.AsNick, &m.Attachment, &m.Buttons, &m.Priority, &m.ReplyTo, &m.ForwardFrom, &m.ThreadId, &m.Tags, &m.Playback}
 }
 
 // Address holds the fully qualified address of an incoming or outgoing message.
@@ -179,6 +360,10 @@ func (m *Message) String() string {
 		line = append(line, ' ')
 		line = append(line, target...)
 	} else {
+		if cmd == cmdEditMsg || cmd == cmdDeleteMsg || cmd == cmdReact {
+			line = append(line, ' ')
+			line = append(line, m.Channel...)
+		}
 		for _, param := range []string{m.Param0, m.Param1, m.Param2, m.Param3} {
 			if param != "" {
 				line = append(line, ' ')
@@ -201,10 +386,47 @@ func (m *Message) String() string {
 	return linestr
 }
 
+// botText returns the part of text that is addressed at the bot with the
+// provided nick, with the nick and the bang prefix stripped out, or the empty
+// string if none. All of text is addressed at the bot when direct is true.
+// Formatting codes are stripped out so they don't get in the way of commands.
+func botText(text, asnick, bang string, direct bool) string {
+	text = StripFormatting(text)
+	var bottext string
+	t1 := text
+	t2 := text
+	if len(t1) > 0 && t1[0] == '@' {
+		t1 = t1[1:]
+	}
+	nl := len(asnick)
+	if nl > 0 && len(t1) > nl+1 && (t1[nl] == ':' || t1[nl] == ',' || t1[nl] == ' ' && text[0] == '@') && (t1[:nl] == asnick || strings.TrimPrefix(t1[:nl], "bot") == asnick) {
+		bottext = strings.TrimSpace(t1[nl+1:])
+		t2 = bottext
+	} else if direct {
+		bottext = strings.TrimSpace(text)
+		t2 = bottext
+	}
+
+	// Bang
+	bl := len(bang)
+	if bl > 0 && len(t2) >= bl && t2[:bl] == bang && (len(t2) == bl || unicode.IsLetter(rune(t2[bl]))) {
+		bottext = t2[bl:]
+	}
+	return bottext
+}
+
+// setBang sets the bang prefix in use when the incoming PRIVMSG was
+// received, and updates its BotText accordingly.
+func (m *Message) setBang(bang string) {
+	m.Bang = bang
+	m.BotText = botText(m.Text, m.AsNick, bang, m.Channel == "" || m.Channel[0] == '@')
+}
+
 func isChannel(name string) bool {
 	// Channels prefixed with @ are used to handle one-to-one conversations in
 	// systems that have a different concept for user identities and user nicks.
-	return name != "" && (name[0] == '#' || name[0] == '&' || name[0] == '@') && !strings.ContainsAny(name, " ,\x07")
+	// The + and ! prefixes are for modeless and safe IRC channels.
+	return name != "" && strings.IndexByte("#&@+!", name[0]) >= 0 && !strings.ContainsAny(name, " ,\x07")
 }
 
 // ParseIncoming parses line as an incoming IRC protocol message line.
@@ -223,133 +445,48 @@ func ParseOutgoing(account, line string) *Message {
 
 func parse(account, asnick, bang, line string) *Message {
 	m := &Message{Account: account, AsNick: asnick, Bang: bang, Time: time.Now()}
-	i := 0
-	l := len(line)
-	for i < l && line[i] == ' ' {
-		i++
+	l := ircparse.Parse(line)
+	if asnick != "" {
+		m.Nick, m.User, m.Host = l.Nick, l.User, l.Host
 	}
-
-	// Nick, User, Host
-	if i < l && line[i] == ':' {
-		mark := i
-		for i++; i < l; i++ {
-			c := line[i]
-			if c == ' ' || c == '!' || c == '@' {
-				break
-			}
-		}
-		if asnick != "" {
-			m.Nick = line[mark+1 : i]
-		}
-		if i < l && line[i] == '!' {
-			mark := i
-			for i++; i < l; i++ {
-				c := line[i]
-				if c == ' ' || c == '@' {
-					break
-				}
-			}
-			if asnick != "" {
-				m.User = line[mark+1 : i]
-			}
-		}
-		if i < l && line[i] == '@' {
-			mark := i
-			for i++; i < l; i++ {
-				c := line[i]
-				if c == ' ' {
-					break
-				}
-			}
-			if asnick != "" {
-				m.Host = line[mark+1 : i]
-			}
-		}
-		if m.User == "" && m.Host == "" && strings.Contains(m.Nick, ".") {
-			m.Host = m.Nick
-			m.Nick = ""
+	if len(l.Tags) > 0 {
+		m.Tags = l.Tags
+		if t, err := time.Parse(time.RFC3339, l.Tags["time"]); err == nil {
+			m.Time = t
 		}
 	}
-	for i < l && line[i] == ' ' {
-		i++
-	}
-
-	// Command
-	mark := i
-	for i < l && line[i] != ' ' {
-		i++
-	}
-	m.Command = line[mark:i]
-	for i < l && line[i] == ' ' {
-		i++
-	}
+	m.Command = l.Command
 
 	if m.Command == cmdPrivMsg || m.Command == cmdNotice {
-		// Target
-		mark = i
-		for i < l && line[i] != ' ' {
-			i++
+		var target string
+		if len(l.Params) > 0 {
+			target = l.Params[0]
 		}
-		target := line[mark:i]
 		if isChannel(target) {
 			m.Channel = target
 		} else if asnick == "" {
 			m.Nick = target
 		}
-
-		// Text
-		for i < l && line[i] == ' ' {
-			i++
-		}
-		if i < l && line[i] == ':' {
-			m.Text = line[i+1:]
-		}
+		m.Text = l.Trailing
 
 		if asnick != "" && m.Command == cmdPrivMsg {
-			// BotText
-			t1 := m.Text
-			t2 := m.Text
-			if len(t1) > 0 && t1[0] == '@' {
-				t1 = t1[1:]
-			}
-			nl := len(m.AsNick)
-			if nl > 0 && len(t1) > nl+1 && (t1[nl] == ':' || t1[nl] == ',' || t1[nl] == ' ' && m.Text[0] == '@') && (t1[:nl] == m.AsNick || strings.TrimPrefix(t1[:nl], "bot") == m.AsNick) {
-				m.BotText = strings.TrimSpace(t1[nl+1:])
-				t2 = m.BotText
-			} else if m.Channel == "" || m.Channel[0] == '@' {
-				m.BotText = strings.TrimSpace(m.Text)
-				t2 = m.BotText
-			}
-
-			// Bang
-			bl := len(m.Bang)
-			if bl > 0 && len(t2) >= bl && t2[:bl] == m.Bang && (len(t2) == bl || unicode.IsLetter(rune(t2[bl]))) {
-				m.BotText = t2[bl:]
-			}
+			m.setBang(bang)
 		}
 	} else {
-		// ParamN, Text
-		p := 0
 		params := []*string{&m.Param0, &m.Param1, &m.Param2, &m.Param3}
-		for i < l {
-			if line[i] == ':' {
-				m.Text = line[i+1:]
-				break
-			}
-			mark = i
-			for i < l && line[i] != ' ' {
-				i++
-			}
+		for p, param := range l.Params {
 			if p < 4 {
-				*params[p] = line[mark:i]
+				*params[p] = param
 			} else {
-				m.Param3 += " " + line[mark:i]
-			}
-			p++
-			for i < l && line[i] == ' ' {
-				i++
+				m.Param3 += " " + param
 			}
 		}
+		m.Text = l.Trailing
+		if m.Command == cmdEditMsg || m.Command == cmdDeleteMsg || m.Command == cmdReact {
+			// The channel comes first, as in PRIVMSG.
+			m.Channel, m.Param0, m.Param1, m.Param2 = m.Param0, m.Param1, m.Param2, m.Param3
+			m.Param3 = ""
+		}
 	}
 
 	return m
@@ -216,6 +216,27 @@ var parseIncomingTests = []parseTest{
 		},
 	},
 
+	// Formatting codes do not get in the way of commands.
+	{
+		"PRIVMSG #channel :\x0304!\x02Hello\x02 there\x03",
+		mup.Message{
+			Command: "PRIVMSG",
+			Channel: "#channel",
+			Text:    "\x0304!\x02Hello\x02 there\x03",
+			BotText: "Hello there",
+			Bang:    "!",
+		},
+	}, {
+		"PRIVMSG #channel :\x02mup\x02: Hello there",
+		mup.Message{
+			Command: "PRIVMSG",
+			Channel: "#channel",
+			Text:    "\x02mup\x02: Hello there",
+			BotText: "Hello there",
+			AsNick:  "mup",
+		},
+	},
+
 	// @ prefix also qualifies message as personal.
 	{
 		"PRIVMSG #chan :@mup Hello there",
@@ -291,6 +312,73 @@ var parseIncomingTests = []parseTest{
 			AsNick:  "mup",
 		},
 	},
+
+	// Edited, deleted, and reacted to messages (Telegram).
+	{
+		"EDITMSG #channel 42 :New text",
+		mup.Message{
+			Command: "EDITMSG",
+			Channel: "#channel",
+			Param0:  "42",
+			Text:    "New text",
+		},
+	}, {
+		"DELMSG @user:chat 42",
+		mup.Message{
+			Command: "DELMSG",
+			Channel: "@user:chat",
+			Param0:  "42",
+		},
+	}, {
+		"REACT #channel 42 :👍",
+		mup.Message{
+			Command: "REACT",
+			Channel: "#channel",
+			Param0:  "42",
+			Text:    "👍",
+		},
+	},
+}
+
+// parseIncomingOnlyTests holds lines that parse into messages which
+// do not format back into the same line.
+var parseIncomingOnlyTests = []parseTest{
+	// Message tags are not formatted.
+	{
+		"@msgid=a\\sb;account=joe :nick!user@host PRIVMSG #channel :Some text",
+		mup.Message{
+			Nick:    "nick",
+			User:    "user",
+			Host:    "host",
+			Command: "PRIVMSG",
+			Channel: "#channel",
+			Text:    "Some text",
+			Tags:    mup.Tags{"msgid": "a b", "account": "joe"},
+		},
+	},
+
+	// Empty prefixes.
+	{
+		": CMD p0 :Some text",
+		mup.Message{
+			Command: "CMD",
+			Param0:  "p0",
+			Text:    "Some text",
+		},
+	},
+
+	// Multiline text is kept whole.
+	{
+		":nick!user@host PRIVMSG #channel :Some\nmore text",
+		mup.Message{
+			Nick:    "nick",
+			User:    "user",
+			Host:    "host",
+			Command: "PRIVMSG",
+			Channel: "#channel",
+			Text:    "Some\nmore text",
+		},
+	},
 }
 
 var parseOutgoingTests = []parseTest{
@@ -305,7 +393,8 @@ var parseOutgoingTests = []parseTest{
 }
 
 func (s *MessageSuite) TestParseIncoming(c *C) {
-	for _, test := range parseIncomingTests {
+	tests := append(append([]parseTest(nil), parseIncomingTests...), parseIncomingOnlyTests...)
+	for _, test := range tests {
 		c.Logf("Parsing incoming line: %s", test.line)
 		before := time.Now().Add(-1 * time.Second)
 		msg := mup.ParseIncoming("", "mup", "!", test.line)
@@ -332,6 +421,16 @@ func (s *MessageSuite) TestParseOutgoing(c *C) {
 	}
 }
 
+func (s *MessageSuite) TestParseIncomingServerTime(c *C) {
+	msg := mup.ParseIncoming("", "mup", "!", "@time=2024-01-31T15:04:05.123Z :nick!user@host PRIVMSG #channel :Hello")
+	c.Assert(msg.Time.Equal(time.Date(2024, 1, 31, 15, 4, 5, 123e6, time.UTC)), Equals, true)
+	c.Assert(msg.Tags, DeepEquals, mup.Tags{"time": "2024-01-31T15:04:05.123Z"})
+
+	before := time.Now()
+	msg = mup.ParseIncoming("", "mup", "!", "@time=bogus :nick!user@host PRIVMSG #channel :Hello")
+	c.Assert(msg.Time.Before(before), Equals, false)
+}
+
 func (s *MessageSuite) TestParseIncomingAccount(c *C) {
 	msg := mup.ParseIncoming("account", "", "", "CMD")
 	c.Assert(msg.Account, Equals, "account")
@@ -0,0 +1,165 @@
+package mup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric accumulates measurements reported by a plugin, such as poll
+// failures or API latencies. Metrics are exposed by the embedded HTTP
+// server at /metrics in the Prometheus text format, with the plugin name
+// as a label.
+//
+// Values added via Inc and Add are exposed as a counter named
+// mup_plugin_<name>_total, and values provided via Observe are exposed
+// as a summary named mup_plugin_<name>, with the sum and count of all
+// observations.
+type Metric struct {
+	mu       sync.Mutex
+	total    float64
+	counted  bool
+	sum      float64
+	count    uint64
+	observed bool
+}
+
+// Inc increments the metric counter by one.
+func (m *Metric) Inc() {
+	m.Add(1)
+}
+
+// Add adds delta to the metric counter. Counters only go up, so
+// negative deltas are ignored.
+func (m *Metric) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	m.mu.Lock()
+	m.total += delta
+	m.counted = true
+	m.mu.Unlock()
+}
+
+// Observe records a single observation of the measured value,
+// such as how long an API request took, in seconds.
+func (m *Metric) Observe(value float64) {
+	m.mu.Lock()
+	m.sum += value
+	m.count++
+	m.observed = true
+	m.mu.Unlock()
+}
+
+type metricKey struct {
+	name, plugin string
+}
+
+// metricRegistry holds the metrics reported by all plugins running
+// in the process.
+type metricRegistry struct {
+	mu      sync.Mutex
+	metrics map[metricKey]*Metric
+}
+
+var metrics = &metricRegistry{metrics: make(map[metricKey]*Metric)}
+
+// metric returns the metric with the provided name for plugin,
+// creating it if necessary.
+func (r *metricRegistry) metric(plugin, name string) *Metric {
+	key := metricKey{metricName(name), plugin}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.metrics[key]
+	if !ok {
+		m = &Metric{}
+		r.metrics[key] = m
+	}
+	return m
+}
+
+// metricName returns name with all characters not allowed in
+// Prometheus metric names replaced by underscores.
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// write writes all metrics to w in the Prometheus text format.
+func (r *metricRegistry) write(w io.Writer) error {
+	type entry struct {
+		metricKey
+		metric *Metric
+	}
+	r.mu.Lock()
+	entries := make([]entry, 0, len(r.metrics))
+	for key, m := range r.metrics {
+		entries = append(entries, entry{key, m})
+	}
+	r.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].name != entries[j].name {
+			return entries[i].name < entries[j].name
+		}
+		return entries[i].plugin < entries[j].plugin
+	})
+
+	// Counters and summaries are written in separate passes, so that
+	// the samples of each family are grouped under a single TYPE line
+	// as the format requires.
+	buf := bufio.NewWriter(w)
+	for _, counters := range []bool{true, false} {
+		var family string
+		for _, e := range entries {
+			m := e.metric
+			m.mu.Lock()
+			total, counted, sum, count, observed := m.total, m.counted, m.sum, m.count, m.observed
+			m.mu.Unlock()
+
+			name := "mup_plugin_" + e.name
+			label := `{plugin="` + labelValue(e.plugin) + `"}`
+			if counters && counted {
+				if family != name {
+					family = name
+					fmt.Fprintf(buf, "# TYPE %s_total counter\n", name)
+				}
+				fmt.Fprintf(buf, "%s_total%s %s\n", name, label, formatFloat(total))
+			}
+			if !counters && observed {
+				if family != name {
+					family = name
+					fmt.Fprintf(buf, "# TYPE %s summary\n", name)
+				}
+				fmt.Fprintf(buf, "%s_sum%s %s\n", name, label, formatFloat(sum))
+				fmt.Fprintf(buf, "%s_count%s %d\n", name, label, count)
+			}
+		}
+	}
+	return buf.Flush()
+}
+
+func labelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// serveMetrics reports the metrics of all plugins in the Prometheus
+// text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+}
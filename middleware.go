@@ -0,0 +1,234 @@
+package mup
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// MiddlewareSpec holds the specification of a middleware that may be
+// registered with mup to transform or drop messages on their way
+// between accounts and plugins.
+//
+// Middlewares are enabled and ordered via the middleware table, where
+// each entry holds the middleware name, its position in the chain, and
+// its configuration as a JSON document. As with plugins, a label may be
+// appended to the name after a slash, as in "redact/tokens", for running
+// several instances of the same middleware with different settings.
+type MiddlewareSpec struct {
+	Name string
+	Help string
+
+	// Start returns a new middleware with the provided configuration,
+	// which holds a JSON document or is empty.
+	Start func(config []byte) (Middleware, error)
+}
+
+// Middleware is implemented by types that transform or drop messages.
+//
+// FilterIncoming is called with each incoming message before it's handled
+// by plugins, and FilterOutgoing is called with each message sent by
+// plugins before it's queued for sending. Both may modify the message in
+// place, and must return false for messages that should be dropped.
+type Middleware interface {
+	FilterIncoming(msg *Message) bool
+	FilterOutgoing(msg *Message) bool
+}
+
+var registeredMiddlewares = make(map[string]*MiddlewareSpec)
+
+// RegisterMiddleware registers with mup the middleware defined via the
+// provided specification, so that it may be used when configured to be.
+func RegisterMiddleware(spec *MiddlewareSpec) {
+	if spec.Name == "" {
+		panic("cannot register middleware with an empty name")
+	}
+	if _, ok := registeredMiddlewares[spec.Name]; ok {
+		panic("middleware already registered: " + spec.Name)
+	}
+	registeredMiddlewares[spec.Name] = spec
+}
+
+type middlewareInfo struct {
+	Name     string
+	Position int
+	Config   string
+}
+
+const middlewareColumns = "name,position,config"
+
+func (mi *middlewareInfo) refs() []interface{} {
+	return []interface{}{&mi.Name, &mi.Position, &mi.Config}
+}
+
+type middlewareState struct {
+	info       middlewareInfo
+	middleware Middleware
+}
+
+// refreshMiddlewares reloads the middleware chain from the database.
+// Middlewares with an unchanged configuration are preserved.
+func (m *pluginManager) refreshMiddlewares() {
+	rows, err := m.db.Query("SELECT " + middlewareColumns + " FROM middleware ORDER BY position,name")
+	if err != nil {
+		logf("Cannot fetch middleware information from database: %v", err)
+		return
+	}
+	defer rows.Close()
+	var infos []middlewareInfo
+	for rows.Next() {
+		var info middlewareInfo
+		if err := rows.Scan(info.refs()...); err != nil {
+			logf("Cannot parse database middleware information: %v", err)
+			return
+		}
+		infos = append(infos, info)
+	}
+	if err := rows.Err(); err != nil {
+		logf("Cannot fetch middleware information from database: %v", err)
+		return
+	}
+
+	m.middlewareMutex.Lock()
+	old := m.middlewares
+	m.middlewareMutex.Unlock()
+
+	var chain []*middlewareState
+NextInfo:
+	for _, info := range infos {
+		for _, state := range old {
+			if state.info.Name == info.Name && state.info.Config == info.Config {
+				state.info = info
+				chain = append(chain, state)
+				continue NextInfo
+			}
+		}
+		spec, ok := registeredMiddlewares[pluginKey(info.Name)]
+		if !ok {
+			logf("Middleware is not registered: %s", pluginKey(info.Name))
+			continue
+		}
+		middleware, err := spec.Start([]byte(info.Config))
+		if err != nil {
+			logf("Middleware %q has an invalid configuration: %v", info.Name, err)
+			continue
+		}
+		logf("Middleware %q enabled.", info.Name)
+		chain = append(chain, &middlewareState{info, middleware})
+	}
+
+	m.middlewareMutex.Lock()
+	m.middlewares = chain
+	m.middlewareMutex.Unlock()
+}
+
+// filterIncoming runs msg through the middleware chain, and reports
+// whether it should still be handled by plugins.
+func (m *pluginManager) filterIncoming(msg *Message) bool {
+	m.middlewareMutex.Lock()
+	chain := m.middlewares
+	m.middlewareMutex.Unlock()
+	for _, state := range chain {
+		if !state.middleware.FilterIncoming(msg) {
+			accountDebugf(msg.Account, "Middleware %q dropped incoming message: %s", state.info.Name, msg.String())
+			return false
+		}
+	}
+	return true
+}
+
+// filterOutgoing runs msg through the middleware chain, and reports
+// whether it should still be queued for sending.
+func (m *pluginManager) filterOutgoing(msg *Message) bool {
+	m.middlewareMutex.Lock()
+	chain := m.middlewares
+	m.middlewareMutex.Unlock()
+	for _, state := range chain {
+		if !state.middleware.FilterOutgoing(msg) {
+			accountDebugf(msg.Account, "Middleware %q dropped outgoing message: %s", state.info.Name, msg.String())
+			return false
+		}
+	}
+	return true
+}
+
+// unmarshalMiddlewareConfig unmarshals config into result, unless empty.
+func unmarshalMiddlewareConfig(config []byte, result interface{}) error {
+	if len(config) == 0 {
+		return nil
+	}
+	return json.Unmarshal(config, result)
+}
+
+func init() {
+	RegisterMiddleware(&MiddlewareSpec{
+		Name: "stripcolors",
+		Help: "Removes IRC color and formatting codes from incoming messages.",
+		Start: func(config []byte) (Middleware, error) {
+			return stripColorsMiddleware{}, nil
+		},
+	})
+	RegisterMiddleware(&MiddlewareSpec{
+		Name: "redact",
+		Help: `Replaces text matching the configured regular expressions in incoming and outgoing messages.
+
+		The "patterns" option holds the list of regular expressions, and the
+		optional "replacement" option holds the text they are replaced with,
+		defaulting to "[redacted]".
+		`,
+		Start: startRedactMiddleware,
+	})
+}
+
+type stripColorsMiddleware struct{}
+
+func (stripColorsMiddleware) FilterIncoming(msg *Message) bool {
+	msg.Text = StripFormatting(msg.Text)
+	msg.BotText = StripFormatting(msg.BotText)
+	return true
+}
+
+func (stripColorsMiddleware) FilterOutgoing(msg *Message) bool {
+	return true
+}
+
+type redactMiddleware struct {
+	patterns    []*regexp.Regexp
+	replacement string
+}
+
+func startRedactMiddleware(config []byte) (Middleware, error) {
+	var settings struct {
+		Patterns    []string
+		Replacement *string
+	}
+	if err := unmarshalMiddlewareConfig(config, &settings); err != nil {
+		return nil, err
+	}
+	if len(settings.Patterns) == 0 {
+		return nil, fmt.Errorf("no patterns configured")
+	}
+	m := &redactMiddleware{replacement: "[redacted]"}
+	if settings.Replacement != nil {
+		m.replacement = *settings.Replacement
+	}
+	for _, pattern := range settings.Patterns {
+		exp, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		m.patterns = append(m.patterns, exp)
+	}
+	return m, nil
+}
+
+func (m *redactMiddleware) redact(msg *Message) bool {
+	for _, exp := range m.patterns {
+		msg.Text = exp.ReplaceAllLiteralString(msg.Text, m.replacement)
+		msg.BotText = exp.ReplaceAllLiteralString(msg.BotText, m.replacement)
+	}
+	return true
+}
+
+func (m *redactMiddleware) FilterIncoming(msg *Message) bool { return m.redact(msg) }
+func (m *redactMiddleware) FilterOutgoing(msg *Message) bool { return m.redact(msg) }
@@ -0,0 +1,65 @@
+package mup
+
+import (
+	"strings"
+)
+
+// Modes for handling incoming messages with several lines of text,
+// as set via the "multiline" option of Telegram and Signal accounts.
+const (
+	// multilineKeep delivers the whole text in a single message.
+	multilineKeep = ""
+
+	// multilineSplit delivers each non-blank line as its own message,
+	// so that every line may hold a command.
+	multilineSplit = "split"
+
+	// multilineFirst delivers a single message with only the first line
+	// as its text, and the remaining lines in an attachment of kind "text".
+	// Only the first line is then considered for BotText and commands.
+	multilineFirst = "first"
+)
+
+func validMultiline(mode string) bool {
+	return mode == multilineKeep || mode == multilineSplit || mode == multilineFirst
+}
+
+// parseMultiline parses the provided incoming line, which must end with
+// the text of a PRIVMSG, as done by ParseIncoming. If text holds several
+// lines, they are handled according to mode. The file attachment, if any,
+// is set on the last message returned. Messages with a file attachment
+// in multilineFirst mode have their remaining lines delivered as in
+// multilineSplit mode, since they can't hold both attachments.
+func parseMultiline(mode, account, asnick string, bangs *bangPrefixes, prefix, text string, attachment Attachment) []*Message {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if mode == multilineKeep || !strings.Contains(text, "\n") {
+		msg := bangs.parseIncoming(account, asnick, prefix+text)
+		msg.Attachment = attachment
+		return []*Message{msg}
+	}
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	var msgs []*Message
+	if mode == multilineFirst && attachment.Kind == "" {
+		msg := bangs.parseIncoming(account, asnick, prefix+lines[0])
+		if len(lines) > 1 {
+			rest := strings.Join(lines[1:], "\n")
+			msg.Attachment = Attachment{Kind: "text", MimeType: "text/plain", Size: int64(len(rest)), Text: rest}
+		}
+		return append(msgs, msg)
+	}
+	for _, line := range lines {
+		msgs = append(msgs, bangs.parseIncoming(account, asnick, prefix+line))
+	}
+	msgs[len(msgs)-1].Attachment = attachment
+	return msgs
+}
@@ -0,0 +1,159 @@
+package muptest
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+)
+
+// A Behavior scripts how a LineServer reacts to the lines received from
+// the client. Behaviors see each received line in the order they were
+// added, until one of them consumes it. Lines consumed are not seen by
+// later behaviors nor returned by ReadLine.
+//
+// Behaviors are run by the goroutine reading from the connection, one
+// line at a time, so they need no locking for their own state as long
+// as they are not shared across line servers.
+type Behavior interface {
+	Handle(lserver *LineServer, line string) (consumed bool)
+}
+
+// BehaviorFunc adapts a function into a Behavior.
+type BehaviorFunc func(lserver *LineServer, line string) (consumed bool)
+
+// Handle calls f(lserver, line).
+func (f BehaviorFunc) Handle(lserver *LineServer, line string) bool {
+	return f(lserver, line)
+}
+
+// ServerName is the name the fake server uses as the prefix of its own
+// messages.
+const ServerName = "n.muptest"
+
+// command returns the command and parameters in line, which must not
+// hold a prefix as it was sent by a client.
+func command(line string) (cmd string, params []string) {
+	i := strings.Index(line, " :")
+	if i < 0 {
+		i = len(line)
+	}
+	fields := strings.Fields(line[:i])
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params = fields[1:]
+	if i < len(line) {
+		params = append(params, line[i+2:])
+	}
+	return strings.ToUpper(fields[0]), params
+}
+
+// AutoPong answers the PING messages sent by the client with the
+// respective PONG, and consumes them. These include the PINGs that mup
+// sends after each message to confirm its delivery.
+func AutoPong() Behavior {
+	return BehaviorFunc(func(lserver *LineServer, line string) bool {
+		if cmd, params := command(line); cmd == "PING" && len(params) > 0 {
+			lserver.SendLine("PONG :" + params[len(params)-1])
+			return true
+		}
+		return false
+	})
+}
+
+// NickInUse answers the next n NICK commands with the 433 error reporting
+// the nick as already in use, simulating a collision storm, and consumes
+// them. Later NICK commands are left alone.
+func NickInUse(n int) Behavior {
+	return BehaviorFunc(func(lserver *LineServer, line string) bool {
+		cmd, params := command(line)
+		if cmd != "NICK" || len(params) == 0 || n == 0 {
+			return false
+		}
+		n--
+		lserver.SendLine(":" + ServerName + " 433 * " + params[0] + " :Nickname is already in use.")
+		return true
+	})
+}
+
+// Welcome sends the 001 welcome message once the client registered by
+// sending both its NICK and USER commands, addressed to the last nick
+// seen. Welcome must come after behaviors that consume refused NICK
+// commands, such as NickInUse.
+func Welcome() Behavior {
+	var nick string
+	var user, done bool
+	return BehaviorFunc(func(lserver *LineServer, line string) bool {
+		if done {
+			return false
+		}
+		switch cmd, params := command(line); {
+		case cmd == "NICK" && len(params) > 0:
+			nick = params[0]
+		case cmd == "USER":
+			user = true
+		}
+		if nick != "" && user {
+			done = true
+			lserver.SendLine(":" + ServerName + " 001 " + nick + " :Welcome!")
+		}
+		return false
+	})
+}
+
+// SASL negotiates the sasl capability and authenticates the client via
+// the SASL PLAIN mechanism, accepting only the provided credentials. The
+// CAP and AUTHENTICATE commands are consumed, while NICK and USER are
+// observed but left alone.
+func SASL(user, password string) Behavior {
+	nick := "*"
+	return BehaviorFunc(func(lserver *LineServer, line string) bool {
+		cmd, params := command(line)
+		reply := func(numeric int, text string) {
+			lserver.SendLine(":" + ServerName + " " + strconv.Itoa(numeric) + " " + nick + " " + text)
+		}
+		switch cmd {
+		case "NICK":
+			if len(params) > 0 {
+				nick = params[0]
+			}
+			return false
+		case "CAP":
+			if len(params) == 0 {
+				return true
+			}
+			switch strings.ToUpper(params[0]) {
+			case "LS":
+				lserver.SendLine(":" + ServerName + " CAP " + nick + " LS :sasl")
+			case "REQ":
+				if len(params) > 1 && strings.TrimSpace(params[len(params)-1]) == "sasl" {
+					lserver.SendLine(":" + ServerName + " CAP " + nick + " ACK :sasl")
+				} else {
+					lserver.SendLine(":" + ServerName + " CAP " + nick + " NAK :" + params[len(params)-1])
+				}
+			}
+			return true
+		case "AUTHENTICATE":
+			if len(params) == 0 {
+				return true
+			}
+			switch params[0] {
+			case "PLAIN":
+				lserver.SendLine("AUTHENTICATE +")
+			case "*":
+				reply(906, ":SASL authentication aborted")
+			default:
+				data, err := base64.StdEncoding.DecodeString(params[0])
+				parts := strings.Split(string(data), "\x00")
+				if err != nil || len(parts) != 3 || parts[1] != user || parts[2] != password {
+					reply(904, ":SASL authentication failed")
+					break
+				}
+				reply(900, nick+"!~"+user+"@host "+user+" :You are now logged in as "+user)
+				reply(903, ":SASL authentication successful")
+			}
+			return true
+		}
+		return false
+	})
+}
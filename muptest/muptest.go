@@ -0,0 +1,440 @@
+// Package muptest offers fake IRC servers for running end-to-end tests
+// of mup and its plugins.
+//
+// A Listener accepts the connections established by the IRC accounts
+// under test, and hands each of them to a LineServer, which allows tests
+// to read the lines sent by the client and to send lines back. Scripted
+// server behaviors, such as nick collisions and SASL authentication, may
+// be installed via Behavior values, and more elaborate exchanges may be
+// run via LineServer.Script:
+//
+//	l, err := muptest.Listen()
+//	...
+//	l.SetBehaviors(func() []muptest.Behavior {
+//		return []muptest.Behavior{muptest.NickInUse(2), muptest.Welcome(), muptest.AutoPong()}
+//	})
+//	// Start mup with an account connecting to l.Addr().
+//	server, err := l.LineServer(0)
+//	...
+//	err = server.Script(`
+//		> :nick!~user@host PRIVMSG mup :echo Hello
+//		< PRIVMSG nick :Hello
+//	`)
+package muptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// Timeout defines how long to wait for connections to be established
+// and for lines to be received before giving up.
+var Timeout = 5 * time.Second
+
+// Listener accepts connections on a local TCP port and hands each of
+// them to a new LineServer.
+type Listener struct {
+	l    *net.TCPListener
+	tomb tomb.Tomb
+
+	mu        sync.Mutex
+	servers   []*LineServer
+	behaviors func() []Behavior
+}
+
+// Listen returns a new Listener on a random local TCP port.
+func Listen() (*Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener := &Listener{l: l}
+	listener.tomb.Go(listener.loop)
+	return listener, nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (l *Listener) Addr() *net.TCPAddr {
+	return l.l.Addr().(*net.TCPAddr)
+}
+
+// Err returns the error that terminated the listener, or
+// tomb.ErrStillAlive while it's still running.
+func (l *Listener) Err() error {
+	return l.tomb.Err()
+}
+
+// Close stops accepting connections and closes all line servers.
+func (l *Listener) Close() error {
+	l.tomb.Kill(nil)
+	l.l.Close()
+	l.Reset()
+	err := l.tomb.Wait()
+	if _, ok := err.(*net.OpError); ok {
+		// Accept failed due to the listener being closed.
+		return nil
+	}
+	return err
+}
+
+// SetBehaviors defines the function called for every new connection to
+// obtain the behaviors of its line server. A function is used rather
+// than a list so that each server gets behaviors with their own state.
+func (l *Listener) SetBehaviors(f func() []Behavior) {
+	l.mu.Lock()
+	l.behaviors = f
+	l.mu.Unlock()
+}
+
+func (l *Listener) loop() error {
+	for l.tomb.Alive() {
+		conn, err := l.l.Accept()
+		if err != nil {
+			return err
+		}
+		l.mu.Lock()
+		var behaviors []Behavior
+		if l.behaviors != nil {
+			behaviors = l.behaviors()
+		}
+		l.servers = append(l.servers, NewLineServer(conn, behaviors...))
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+// Count returns the number of connections accepted so far, which is also
+// the index of the line server for the next connection.
+func (l *Listener) Count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.servers)
+}
+
+// LineServer returns the line server handling the connection with the
+// provided index, counting from zero, waiting up to Timeout for it to be
+// established.
+func (l *Listener) LineServer(index int) (*LineServer, error) {
+	deadline := time.Now().Add(Timeout)
+	for {
+		l.mu.Lock()
+		if len(l.servers) > index {
+			server := l.servers[index]
+			l.mu.Unlock()
+			return server, nil
+		}
+		l.mu.Unlock()
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout waiting for connection %d to be established", index)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// CloseLineServers closes the connections of all line servers.
+func (l *Listener) CloseLineServers() {
+	l.mu.Lock()
+	for _, server := range l.servers {
+		server.Close()
+	}
+	l.mu.Unlock()
+}
+
+// Reset closes all line servers and forgets them, so that the next
+// connection gets index zero.
+func (l *Listener) Reset() {
+	l.mu.Lock()
+	for _, server := range l.servers {
+		server.Close()
+	}
+	l.servers = nil
+	l.mu.Unlock()
+}
+
+// LineServer exchanges lines with an IRC client through a connection.
+type LineServer struct {
+	conn net.Conn
+	tomb tomb.Tomb
+	lbuf chan string
+
+	mu        sync.Mutex
+	behaviors []Behavior
+
+	wmu   sync.Mutex
+	lag   time.Duration
+	queue []queuedLine
+}
+
+type queuedLine struct {
+	line string
+	due  time.Time
+}
+
+// NewLineServer returns a line server exchanging lines through conn,
+// with the lines received being handled by the provided behaviors before
+// being made available to ReadLine.
+func NewLineServer(conn net.Conn, behaviors ...Behavior) *LineServer {
+	lserver := &LineServer{
+		conn:      conn,
+		lbuf:      make(chan string, 64),
+		behaviors: behaviors,
+	}
+	lserver.tomb.Go(lserver.loop)
+	return lserver
+}
+
+func (lserver *LineServer) loop() error {
+	scanner := bufio.NewScanner(lserver.conn)
+	for scanner.Scan() && lserver.tomb.Alive() {
+		line := scanner.Text()
+		if lserver.handle(line) {
+			continue
+		}
+		select {
+		case lserver.lbuf <- line:
+		default:
+			panic("too many lines received without being processed by test")
+		}
+	}
+	return scanner.Err()
+}
+
+// handle hands line to the behaviors in order until one consumes it,
+// and reports whether that happened.
+func (lserver *LineServer) handle(line string) bool {
+	lserver.mu.Lock()
+	behaviors := append([]Behavior(nil), lserver.behaviors...)
+	lserver.mu.Unlock()
+	for _, b := range behaviors {
+		if b.Handle(lserver, line) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddBehavior adds b to the behaviors that handle the lines received
+// from now on, after the existing ones.
+func (lserver *LineServer) AddBehavior(b Behavior) {
+	lserver.mu.Lock()
+	lserver.behaviors = append(lserver.behaviors, b)
+	lserver.mu.Unlock()
+}
+
+// Close closes the connection.
+func (lserver *LineServer) Close() error {
+	lserver.tomb.Kill(nil)
+	lserver.conn.Close()
+	return lserver.tomb.Wait()
+}
+
+// Err returns the error that terminated the connection, or
+// tomb.ErrStillAlive while it's still open.
+func (lserver *LineServer) Err() error {
+	return lserver.tomb.Err()
+}
+
+// ReadLine returns the next line received from the client and not
+// consumed by a behavior, waiting for as long as necessary. If the
+// connection is closed meanwhile, a line describing the reason
+// is returned instead.
+func (lserver *LineServer) ReadLine() string {
+	select {
+	case line := <-lserver.lbuf:
+		return line
+	case <-lserver.tomb.Dead():
+		select {
+		case line := <-lserver.lbuf:
+			return line
+		default:
+		}
+		return fmt.Sprintf("<LineServer closed: %v>", lserver.tomb.Err())
+	}
+}
+
+// ReadLineTimeout is like ReadLine, but gives up with an error if no line
+// is received within timeout.
+func (lserver *LineServer) ReadLineTimeout(timeout time.Duration) (string, error) {
+	select {
+	case line := <-lserver.lbuf:
+		return line, nil
+	case <-lserver.tomb.Dead():
+		select {
+		case line := <-lserver.lbuf:
+			return line, nil
+		default:
+		}
+		return "", fmt.Errorf("connection closed: %v", lserver.tomb.Err())
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timeout waiting for line")
+	}
+}
+
+// ExpectLine reads the next line within Timeout and returns an error if
+// it's not the expected one.
+func (lserver *LineServer) ExpectLine(expected string) error {
+	line, err := lserver.ReadLineTimeout(Timeout)
+	if err != nil {
+		return fmt.Errorf("expected line %q: %v", expected, err)
+	}
+	if line != expected {
+		return fmt.Errorf("expected line %q, got %q", expected, line)
+	}
+	return nil
+}
+
+// SendLine sends line to the client, after the lag set via SetLag.
+func (lserver *LineServer) SendLine(line string) {
+	lserver.wmu.Lock()
+	defer lserver.wmu.Unlock()
+	if lserver.lag == 0 && len(lserver.queue) == 0 {
+		if err := lserver.write(line); err != nil {
+			panic(fmt.Sprintf("LineServer cannot SendLine: %v", err))
+		}
+		return
+	}
+	lserver.queue = append(lserver.queue, queuedLine{line, time.Now().Add(lserver.lag)})
+	if len(lserver.queue) == 1 {
+		go lserver.flush()
+	}
+}
+
+// SetLag delays by lag the delivery of all lines sent from now on,
+// simulating a slow connection. Lines are still delivered in order.
+func (lserver *LineServer) SetLag(lag time.Duration) {
+	lserver.wmu.Lock()
+	lserver.lag = lag
+	lserver.wmu.Unlock()
+}
+
+func (lserver *LineServer) write(line string) error {
+	n, err := lserver.conn.Write([]byte(line + "\r\n"))
+	if err == nil && n < len(line)+2 {
+		err = fmt.Errorf("short write")
+	}
+	return err
+}
+
+// flush writes the queued lines as they become due.
+func (lserver *LineServer) flush() {
+	for {
+		lserver.wmu.Lock()
+		if len(lserver.queue) == 0 {
+			lserver.wmu.Unlock()
+			return
+		}
+		due := lserver.queue[0].due
+		lserver.wmu.Unlock()
+
+		select {
+		case <-time.After(time.Until(due)):
+		case <-lserver.tomb.Dying():
+			lserver.wmu.Lock()
+			lserver.queue = nil
+			lserver.wmu.Unlock()
+			return
+		}
+
+		lserver.wmu.Lock()
+		err := lserver.write(lserver.queue[0].line)
+		lserver.queue = lserver.queue[1:]
+		if err != nil {
+			lserver.queue = nil
+			lserver.tomb.Kill(fmt.Errorf("cannot send line: %v", err))
+		}
+		lserver.wmu.Unlock()
+	}
+}
+
+// Netsplit simulates a netsplit by sending a QUIT for each of the nicks,
+// with the names of the split servers as the reason, as done by real
+// IRC servers.
+func (lserver *LineServer) Netsplit(nicks ...string) {
+	for _, nick := range nicks {
+		lserver.SendLine(":" + nick + "!~" + nick + "@host QUIT :hub.muptest leaf.muptest")
+	}
+}
+
+// Netjoin simulates nicks rejoining channel once a netsplit is over.
+func (lserver *LineServer) Netjoin(channel string, nicks ...string) {
+	for _, nick := range nicks {
+		lserver.SendLine(":" + nick + "!~" + nick + "@host JOIN " + channel)
+	}
+}
+
+// Script runs a scripted exchange with the client, with one step per
+// line of script. Steps are one of:
+//
+//	> LINE         Send LINE to the client.
+//	< LINE         Expect LINE as the next line received.
+//	~ REGEXP       Expect the next line received to match REGEXP.
+//	sleep DURATION Wait for DURATION, as in "sleep 500ms".
+//	lag DURATION   Set the lag of lines sent from now on. See SetLag.
+//	close          Close the connection.
+//
+// Leading spaces, empty lines, and lines starting with "#" are ignored.
+// Script stops at the first step that fails, such as when a line isn't
+// received within Timeout, and returns an error reporting the step.
+func (lserver *LineServer) Script(script string) error {
+	for i, step := range strings.Split(script, "\n") {
+		step = strings.TrimSpace(step)
+		if step == "" || strings.HasPrefix(step, "#") {
+			continue
+		}
+		if err := lserver.step(step); err != nil {
+			return fmt.Errorf("script line %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (lserver *LineServer) step(step string) error {
+	op, arg := step, ""
+	if i := strings.Index(step, " "); i >= 0 {
+		op, arg = step[:i], strings.TrimSpace(step[i+1:])
+	}
+	switch op {
+	case ">":
+		lserver.SendLine(arg)
+	case "<":
+		return lserver.ExpectLine(arg)
+	case "~":
+		re, err := regexp.Compile("^(?:" + arg + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid expression: %v", err)
+		}
+		line, err := lserver.ReadLineTimeout(Timeout)
+		if err != nil {
+			return fmt.Errorf("expected line matching %q: %v", arg, err)
+		}
+		if !re.MatchString(line) {
+			return fmt.Errorf("expected line matching %q, got %q", arg, line)
+		}
+	case "sleep", "lag":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return fmt.Errorf("invalid %s duration: %q", op, arg)
+		}
+		if op == "sleep" {
+			time.Sleep(d)
+		} else {
+			lserver.SetLag(d)
+		}
+	case "close":
+		lserver.Close()
+	default:
+		return fmt.Errorf("unknown step: %s", step)
+	}
+	return nil
+}
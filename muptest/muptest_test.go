@@ -0,0 +1,179 @@
+package muptest_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0/muptest"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct {
+	l *muptest.Listener
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	var err error
+	s.l, err = muptest.Listen()
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TearDownTest(c *C) {
+	c.Assert(s.l.Close(), IsNil)
+}
+
+type client struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func (s *S) dial(c *C) *client {
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	c.Assert(err, IsNil)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &client{conn, bufio.NewScanner(conn)}
+}
+
+func (cl *client) send(lines ...string) {
+	for _, line := range lines {
+		fmt.Fprintf(cl.conn, "%s\r\n", line)
+	}
+}
+
+func (cl *client) read(c *C) string {
+	c.Assert(cl.scanner.Scan(), Equals, true, Commentf("error: %v", cl.scanner.Err()))
+	return cl.scanner.Text()
+}
+
+func (s *S) TestLineServer(c *C) {
+	cl := s.dial(c)
+	defer cl.conn.Close()
+
+	server, err := s.l.LineServer(0)
+	c.Assert(err, IsNil)
+	c.Assert(s.l.Count(), Equals, 1)
+
+	cl.send("NICK mup")
+	c.Assert(server.ReadLine(), Equals, "NICK mup")
+	server.SendLine(":n.net 001 mup :Welcome!")
+	c.Assert(cl.read(c), Equals, ":n.net 001 mup :Welcome!")
+
+	_, err = server.ReadLineTimeout(50 * time.Millisecond)
+	c.Assert(err, ErrorMatches, "timeout waiting for line")
+
+	defer func(old time.Duration) { muptest.Timeout = old }(muptest.Timeout)
+	muptest.Timeout = 100 * time.Millisecond
+	_, err = s.l.LineServer(1)
+	c.Assert(err, ErrorMatches, "timeout waiting for connection 1 to be established")
+}
+
+func (s *S) TestScript(c *C) {
+	cl := s.dial(c)
+	defer cl.conn.Close()
+	server, err := s.l.LineServer(0)
+	c.Assert(err, IsNil)
+
+	cl.send("USER mup 0 0 :Mup Pet", "PRIVMSG #chan :Hello")
+	err = server.Script(`
+		# Comment.
+		< USER mup 0 0 :Mup Pet
+		~ PRIVMSG #\w+ :.*
+		> :nick!~user@host PRIVMSG #chan :Hi
+	`)
+	c.Assert(err, IsNil)
+	c.Assert(cl.read(c), Equals, ":nick!~user@host PRIVMSG #chan :Hi")
+
+	cl.send("QUIT")
+	err = server.Script("< PART #chan")
+	c.Assert(err, ErrorMatches, `script line 1: expected line "PART #chan", got "QUIT"`)
+	err = server.Script("\nbogus")
+	c.Assert(err, ErrorMatches, `script line 2: unknown step: bogus`)
+}
+
+func (s *S) TestLag(c *C) {
+	cl := s.dial(c)
+	defer cl.conn.Close()
+	server, err := s.l.LineServer(0)
+	c.Assert(err, IsNil)
+
+	server.SetLag(200 * time.Millisecond)
+	start := time.Now()
+	server.SendLine("PING :1")
+	server.SetLag(0)
+	server.SendLine("PING :2")
+	c.Assert(cl.read(c), Equals, "PING :1")
+	c.Assert(cl.read(c), Equals, "PING :2")
+	c.Assert(time.Since(start) >= 200*time.Millisecond, Equals, true)
+}
+
+func (s *S) TestNetsplit(c *C) {
+	cl := s.dial(c)
+	defer cl.conn.Close()
+	server, err := s.l.LineServer(0)
+	c.Assert(err, IsNil)
+
+	server.Netsplit("ann", "bob")
+	server.Netjoin("#chan", "ann")
+	c.Assert(cl.read(c), Equals, ":ann!~ann@host QUIT :hub.muptest leaf.muptest")
+	c.Assert(cl.read(c), Equals, ":bob!~bob@host QUIT :hub.muptest leaf.muptest")
+	c.Assert(cl.read(c), Equals, ":ann!~ann@host JOIN #chan")
+}
+
+func (s *S) TestNickInUse(c *C) {
+	s.l.SetBehaviors(func() []muptest.Behavior {
+		return []muptest.Behavior{muptest.NickInUse(2), muptest.Welcome(), muptest.AutoPong()}
+	})
+	cl := s.dial(c)
+	defer cl.conn.Close()
+	server, err := s.l.LineServer(0)
+	c.Assert(err, IsNil)
+
+	cl.send("NICK mup", "USER mup 0 0 :Mup Pet")
+	c.Assert(cl.read(c), Equals, ":n.muptest 433 * mup :Nickname is already in use.")
+	cl.send("NICK mup_")
+	c.Assert(cl.read(c), Equals, ":n.muptest 433 * mup_ :Nickname is already in use.")
+	cl.send("NICK mup__")
+	c.Assert(cl.read(c), Equals, ":n.muptest 001 mup__ :Welcome!")
+	cl.send("PING :sent:1")
+	c.Assert(cl.read(c), Equals, "PONG :sent:1")
+
+	c.Assert(server.ReadLine(), Equals, "USER mup 0 0 :Mup Pet")
+	c.Assert(server.ReadLine(), Equals, "NICK mup__")
+}
+
+func (s *S) TestSASL(c *C) {
+	s.l.SetBehaviors(func() []muptest.Behavior {
+		return []muptest.Behavior{muptest.SASL("joe", "secret")}
+	})
+	cl := s.dial(c)
+	defer cl.conn.Close()
+	server, err := s.l.LineServer(0)
+	c.Assert(err, IsNil)
+
+	cl.send("CAP LS 302", "NICK mup")
+	c.Assert(cl.read(c), Equals, ":n.muptest CAP * LS :sasl")
+	cl.send("CAP REQ :sasl")
+	c.Assert(cl.read(c), Equals, ":n.muptest CAP mup ACK :sasl")
+	cl.send("AUTHENTICATE PLAIN")
+	c.Assert(cl.read(c), Equals, "AUTHENTICATE +")
+	cl.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00joe\x00wrong")))
+	c.Assert(cl.read(c), Equals, ":n.muptest 904 mup :SASL authentication failed")
+	cl.send("AUTHENTICATE PLAIN")
+	c.Assert(cl.read(c), Equals, "AUTHENTICATE +")
+	cl.send("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00joe\x00secret")))
+	c.Assert(cl.read(c), Equals, ":n.muptest 900 mup mup!~joe@host joe :You are now logged in as joe")
+	c.Assert(cl.read(c), Equals, ":n.muptest 903 mup :SASL authentication successful")
+	cl.send("CAP END")
+
+	c.Assert(server.ReadLine(), Equals, "NICK mup")
+	_, err = server.ReadLineTimeout(50 * time.Millisecond)
+	c.Assert(err, NotNil)
+}
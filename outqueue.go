@@ -0,0 +1,114 @@
+package mup
+
+import (
+	"sort"
+	"sync"
+)
+
+// fairBurst is how many messages with higher priority may be sent in a row
+// while messages with lower priority are waiting, before one of those is
+// sent too.
+const fairBurst = 4
+
+// outQueue holds the outgoing messages of an account that were retrieved
+// from the database but not yet handed to the account client, ordered by
+// their priority and then by their id. It also tracks the ids of messages
+// that the client holds back after taking them, until their delivery is
+// reported.
+type outQueue struct {
+	mu      sync.Mutex
+	queues  map[Priority][]*Message
+	pending map[int64]bool
+	held    map[int64]bool
+	burst   int
+
+	// reported is the highest id whose delivery was reported.
+	reported int64
+}
+
+func newOutQueue() *outQueue {
+	return &outQueue{
+		queues:  make(map[Priority][]*Message),
+		pending: make(map[int64]bool),
+		held:    make(map[int64]bool),
+	}
+}
+
+func (q *outQueue) push(msg *Message) {
+	q.mu.Lock()
+	q.queues[msg.Priority] = append(q.queues[msg.Priority], msg)
+	q.pending[msg.Id] = true
+	q.mu.Unlock()
+}
+
+// next returns the message that should be sent next, or nil if there
+// are none. The message remains queued until done is called with it.
+func (q *outQueue) next() *Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var prios []Priority
+	for prio, msgs := range q.queues {
+		if len(msgs) > 0 {
+			prios = append(prios, prio)
+		}
+	}
+	if len(prios) == 0 {
+		return nil
+	}
+	sort.Slice(prios, func(i, j int) bool { return prios[i] > prios[j] })
+	if len(prios) > 1 && q.burst >= fairBurst {
+		return q.queues[prios[len(prios)-1]][0]
+	}
+	return q.queues[prios[0]][0]
+}
+
+// done removes msg, previously returned by next, from the queue.
+func (q *outQueue) done(msg *Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := false
+	for prio, msgs := range q.queues {
+		if prio < msg.Priority && len(msgs) > 0 {
+			waiting = true
+		}
+	}
+	if waiting {
+		q.burst++
+	} else {
+		q.burst = 0
+	}
+	q.queues[msg.Priority] = q.queues[msg.Priority][1:]
+	delete(q.pending, msg.Id)
+}
+
+// hold records that the client took the message with the provided id
+// but delayed sending it, so it's still considered pending until its
+// delivery is reported via sentId.
+func (q *outQueue) hold(id int64) {
+	q.mu.Lock()
+	q.held[id] = true
+	q.mu.Unlock()
+}
+
+// sentId returns the id that may be recorded as the last one sent after
+// the delivery of the message with the provided id was reported. As
+// messages may be sent out of order, that's the highest id reported so
+// far, but lower than any message still queued or held, so that these
+// aren't lost if the account is restarted.
+func (q *outQueue) sentId(id int64) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.held, id)
+	if id > q.reported {
+		q.reported = id
+	}
+	id = q.reported
+	for _, ids := range []map[int64]bool{q.pending, q.held} {
+		for pending := range ids {
+			if pending <= id {
+				id = pending - 1
+			}
+		}
+	}
+	return id
+}
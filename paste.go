@@ -0,0 +1,193 @@
+package mup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultPasteLines is the number of lines SendLong sends as messages
+// before resorting to a paste, unless the "pastelines" plugin option
+// says otherwise.
+const defaultPasteLines = 5
+
+// pasteExpiry defines for how long pastes stored in the database are
+// served by the embedded HTTP server.
+const pasteExpiry = 30 * 24 * time.Hour
+
+var pasteClient = http.Client{Timeout: NetworkTimeout}
+
+// SendLong sends text to the address obtained from the provided addressable,
+// one message per line, as done by Sendf. If text holds more lines than
+// defined by the "pastelines" plugin option (5 by default), the content is
+// instead uploaded to a paste service and a link to it is sent.
+//
+// The paste service is defined by the "pasteurl" plugin option. The text is
+// POSTed to that URL, and the first line of the response must hold the link
+// to the uploaded content. Without that option, the text is stored in the
+// database and served by the embedded HTTP server, if Config.HTTPURL is set.
+// If neither option is available, or if the upload fails, only the first lines
+// of text are sent.
+func (p *Plugger) SendLong(to Addressable, text string) error {
+	var config struct {
+		PasteLines int
+		PasteURL   string
+	}
+	if err := p.UnmarshalConfig(&config); err != nil {
+		p.Logf("%v", err)
+	}
+	if config.PasteLines == 0 {
+		config.PasteLines = defaultPasteLines
+	}
+
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) <= config.PasteLines {
+		for _, line := range lines {
+			if err := p.Sendf(to, "%s", line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	link, err := p.paste(config.PasteURL, []byte(text), textMimeType)
+	if err == nil {
+		return p.Sendf(to, "Output is %d lines long: %s", len(lines), link)
+	}
+	p.Logf("Cannot paste long output: %v", err)
+	for _, line := range lines[:config.PasteLines-1] {
+		if err := p.Sendf(to, "%s", line); err != nil {
+			return err
+		}
+	}
+	return p.Sendf(to, "(%d more lines omitted)", len(lines)-config.PasteLines+1)
+}
+
+// SendImage sends a message to the address obtained from the provided
+// addressable, as done by Sendf, with the provided text followed by a link
+// to the image in data. The image is uploaded as SendLong does with long
+// text, and an error is returned without sending anything if that fails.
+//
+// The link is also provided as a "photo" attachment of the message, so
+// transports that support it, such as Telegram, deliver the image itself
+// with the text as its caption.
+//
+// Only raster image types are accepted, as other types such as SVG may
+// hold scripts that would run under the origin the pastes are served from.
+func (p *Plugger) SendImage(to Addressable, text string, data []byte, mimeType string) error {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil || !imageMimeTypes[mediaType] {
+		p.Logf("Cannot upload image of type %q.", mimeType)
+		return fmt.Errorf("unsupported image type %q", mimeType)
+	}
+	mimeType = mediaType
+	var config struct{ PasteURL string }
+	if err := p.UnmarshalConfig(&config); err != nil {
+		p.Logf("%v", err)
+	}
+	link, err := p.paste(config.PasteURL, data, mimeType)
+	if err != nil {
+		p.Logf("Cannot upload image: %v", err)
+		return err
+	}
+	if text != "" {
+		text += " "
+	}
+	a := to.Address()
+	msg := &Message{
+		Account:    a.Account,
+		Channel:    a.Channel,
+		Nick:       a.Nick,
+		Text:       p.replyText(a, text+link),
+		Priority:   replyPriority(to),
+		Attachment: Attachment{Kind: "photo", Id: link, MimeType: mimeType, Size: int64(len(data))},
+	}
+	return p.Send(msg)
+}
+
+// imageMimeTypes holds the image types accepted by SendImage.
+var imageMimeTypes = map[string]bool{
+	"image/png":  true,
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+}
+
+// textMimeType is the type of pastes holding text, and of those stored
+// before pastes had a type.
+const textMimeType = "text/plain; charset=utf-8"
+
+func (p *Plugger) paste(pasteURL string, data []byte, mimeType string) (link string, err error) {
+	if pasteURL != "" {
+		return uploadPaste(pasteURL, data, mimeType)
+	}
+	if p.httpURL == "" || p.db == nil {
+		return "", fmt.Errorf("no paste service available")
+	}
+	var buf [16]byte
+	rand.Read(buf[:])
+	id := hex.EncodeToString(buf[:])
+	now := time.Now()
+	_, err = p.db.Exec("DELETE FROM paste WHERE time<?", now.Add(-pasteExpiry))
+	if err == nil {
+		// Text is stored as such so the table remains readable.
+		var content interface{} = data
+		if mimeType == textMimeType {
+			content = string(data)
+		}
+		_, err = p.db.Exec("INSERT INTO paste (id,plugin,time,text,mimetype) VALUES (?,?,?,?,?)", id, p.name, now, content, mimeType)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot store paste: %v", err)
+	}
+	return strings.TrimRight(p.httpURL, "/") + "/paste/" + id, nil
+}
+
+func uploadPaste(pasteURL string, data []byte, mimeType string) (link string, err error) {
+	resp, err := pasteClient.Post(pasteURL, mimeType, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("cannot upload paste: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("cannot upload paste: %s", resp.Status)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	link = strings.TrimSpace(line)
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		if err != nil {
+			return "", fmt.Errorf("cannot read paste link: %v", err)
+		}
+		return "", fmt.Errorf("paste service returned an invalid link: %q", link)
+	}
+	return link, nil
+}
+
+// servePaste serves the content stored in the database by SendLong.
+func (st *Server) servePaste(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/paste/")
+	var data []byte
+	var mimeType string
+	var created time.Time
+	err := st.config.DB.QueryRow("SELECT text,mimetype,time FROM paste WHERE id=?", id).Scan(&data, &mimeType, &created)
+	if err == sql.ErrNoRows || err == nil && time.Since(created) > pasteExpiry {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mimeType == "" {
+		mimeType = textMimeType
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Write(data)
+}
@@ -1,10 +1,15 @@
 package mup
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"gopkg.in/mup.v0/ldap"
@@ -13,12 +18,29 @@ import (
 // Plugger provides the interface between a plugin and the bot infrastructure.
 type Plugger struct {
 	name    string
-	send    func(msg *Message) error
-	handle  func(msg *Message) error
+	send    func(ctx context.Context, msg *Message) error
+	handle  func(ctx context.Context, msg *Message) error
 	ldap    func(name string) (ldap.Conn, error)
 	config  json.RawMessage
 	targets []Target
+	tmpls   []*template.Template
+	locs    []*time.Location
 	db      *sql.DB
+	stmts   *stmtCache
+	ctx     context.Context
+	cancel  context.CancelFunc
+	clock   *testClock
+	httpURL string
+
+	accounts func() []AccountStatus
+	publish  func(ev *Event) error
+
+	topicsMutex sync.Mutex
+	topics      []string
+
+	httpMutex  sync.Mutex
+	httpConfig HTTPClientConfig
+	httpClient *http.Client
 }
 
 // Target defines an Account, Channel, and/or Nick that the given
@@ -29,19 +51,51 @@ type Plugger struct {
 // A Target may also include configuration options that when
 // understood by the plugin will only be considered for this
 // particular target.
+//
+// The "dedup" option is understood by mup itself for any plugin. It holds
+// a duration such as "10s", and when set incoming messages repeating the
+// nick and text of one delivered to the plugin via another account or
+// channel within that window are dropped, which avoids duplicate answers
+// when the same channel is bridged via several accounts.
+//
+// The "throttle" option is also understood by mup itself. It holds the
+// number of commands a single user may run via the target within the
+// window defined by "throttlewindow" (one minute by default). Further
+// commands are dropped, and the user is politely told to wait once.
+//
+// The "template" option is also understood by mup itself. It holds a
+// text/template applied to the text of every message the plugin sends
+// to the target, so that for example a Telegram target may format
+// replies with Markdown while an IRC target keeps them plain. The
+// template is executed with a value holding the Text being sent and its
+// Account, Channel, and Nick.
+//
+// The "templates" option is understood by mup for plugins that report
+// events via Plugger.Announce. It maps event names to text/templates
+// that format the announcement of such events to the target, replacing
+// the ones defined under the same option in the plugin configuration.
+//
+// The Group field optionally names a set of targets of the same plugin,
+// so that BroadcastGroup may deliver some messages only to that set.
 type Target struct {
 	Plugin  string
 	Account string
 	Channel string
 	Nick    string
+	Group   string
 	Config  string // JSON document
+
+	// Timezone and Locale define how times are presented to the target
+	// via Plugger.FormatTime, such as "Europe/Berlin" and "de".
+	Timezone string
+	Locale   string
 }
 
-const targetColumns = "plugin,account,channel,nick,config"
-const targetPlacers = "?,?,?,?,?"
+const targetColumns = `plugin,account,channel,nick,"group",config,timezone,locale`
+const targetPlacers = "?,?,?,?,?,?,?,?"
 
 func (t *Target) refs() []interface{} {
-	return []interface{}{&t.Plugin, &t.Account, &t.Channel, &t.Nick, &t.Config}
+	return []interface{}{&t.Plugin, &t.Account, &t.Channel, &t.Nick, &t.Group, &t.Config, &t.Timezone, &t.Locale}
 }
 
 // Address returns the address for the plugin target.
@@ -86,26 +140,48 @@ func (t Target) String() string {
 
 var emptyDoc = json.RawMessage("{}")
 
-func newPlugger(name string, send, handle func(msg *Message) error, ldap func(name string) (ldap.Conn, error)) *Plugger {
+func newPlugger(name string, send, handle func(ctx context.Context, msg *Message) error, ldap func(name string) (ldap.Conn, error)) *Plugger {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Plugger{
 		name:   name,
 		send:   send,
 		handle: handle,
 		ldap:   ldap,
 		config: emptyDoc,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
-func (p *Plugger) setDatabase(db *sql.DB) {
+func (p *Plugger) setDatabase(db *sql.DB, stmts *stmtCache) {
 	p.db = db
+	p.stmts = stmts
+}
+
+func (p *Plugger) setHTTPURL(url string) {
+	p.httpURL = url
+}
+
+func (p *Plugger) setAccountStatus(accounts func() []AccountStatus) {
+	p.accounts = accounts
+}
+
+func (p *Plugger) setHTTPClientConfig(config HTTPClientConfig) {
+	p.httpMutex.Lock()
+	p.httpConfig = config
+	p.httpClient = nil
+	p.httpMutex.Unlock()
 }
 
 func (p *Plugger) setConfig(config json.RawMessage) {
+	p.httpMutex.Lock()
+	defer p.httpMutex.Unlock()
 	if len(config) == 0 || string(config) == "null" {
 		p.config = emptyDoc
 	} else {
 		p.config = config
 	}
+	p.httpClient = nil
 }
 
 func (p *Plugger) setTargets(targets []Target) {
@@ -118,6 +194,105 @@ func (p *Plugger) setTargets(targets []Target) {
 		}
 	}
 	p.targets = targets
+	p.tmpls = make([]*template.Template, len(targets))
+	p.locs = make([]*time.Location, len(targets))
+	for i := range targets {
+		if tz := targets[i].Timezone; tz != "" {
+			loc, err := time.LoadLocation(tz)
+			if err != nil {
+				p.Logf("Cannot load timezone %q for %s: %v", tz, targets[i], err)
+			} else {
+				p.locs[i] = loc
+			}
+		}
+		var config struct{ Template string }
+		if err := targets[i].UnmarshalConfig(&config); err != nil {
+			p.Logf("%v", err)
+			continue
+		}
+		if config.Template == "" {
+			continue
+		}
+		tmpl, err := template.New("").Parse(config.Template)
+		if err != nil {
+			p.Logf("Cannot parse template for %s: %v", targets[i], err)
+			continue
+		}
+		p.tmpls[i] = tmpl
+	}
+}
+
+// templateData is the value provided to target templates when executed.
+type templateData struct {
+	Account string
+	Channel string
+	Nick    string
+	Text    string
+}
+
+// applyTemplate returns the text of msg formatted by the template of the
+// plugin target that msg is addressed to, or the original text if there's
+// no such template.
+func (p *Plugger) applyTemplate(msg *Message) string {
+	if msg.Text == "" || msg.Command != "" && msg.Command != cmdPrivMsg && msg.Command != cmdNotice {
+		return msg.Text
+	}
+	addr := msg.Address()
+	for i := range p.targets {
+		if !p.targets[i].Address().Contains(addr) {
+			continue
+		}
+		tmpl := p.tmpls[i]
+		if tmpl == nil {
+			break
+		}
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, &templateData{
+			Account: msg.Account,
+			Channel: msg.Channel,
+			Nick:    msg.Nick,
+			Text:    msg.Text,
+		})
+		if err != nil {
+			p.Logf("Cannot execute template for %s: %v", p.targets[i], err)
+			break
+		}
+		return buf.String()
+	}
+	return msg.Text
+}
+
+// Context returns a context that is cancelled when the plugin is being
+// stopped, right before its Stop method is called. Plugins may use it for
+// requests that might block for a while, such as HTTP requests, so that
+// they're interrupted promptly. Work that must still be completed by Stop
+// should not depend on it.
+func (p *Plugger) Context() context.Context {
+	return p.ctx
+}
+
+// Ticker holds a channel that delivers ticks at intervals.
+// See Plugger.NewTicker.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns off the ticker. No more ticks are delivered after Stop returns.
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// NewTicker returns a ticker that delivers the current time on its channel
+// at intervals of d. Plugins that poll external services should use it
+// rather than the time package, so that tests may drive the polling
+// deterministically via PluginTester.AdvanceTime and TriggerPoll.
+func (p *Plugger) NewTicker(d time.Duration) *Ticker {
+	if p.clock != nil {
+		return p.clock.newTicker(d)
+	}
+	ticker := time.NewTicker(d)
+	return &Ticker{C: ticker.C, stop: ticker.Stop}
 }
 
 // Name returns the plugin name including the label, if any ("name/label").
@@ -127,12 +302,12 @@ func (p *Plugger) Name() string {
 
 // Logf logs a message assembled by providing format and args to fmt.Sprintf.
 func (p *Plugger) Logf(format string, args ...interface{}) {
-	logf("["+p.name+"] "+format, args...)
+	logAt(LogInfo, LogFields{Plugin: p.name}, format, args...)
 }
 
 // Debugf logs a debug message assembled by providing format and args to fmt.Sprintf.
 func (p *Plugger) Debugf(format string, args ...interface{}) {
-	debugf("["+p.name+"] "+format, args...)
+	logAt(LogDebug, LogFields{Plugin: p.name}, format, args...)
 }
 
 // UnmarshalConfig unmarshals into result the plugin configuration using the json package.
@@ -146,13 +321,61 @@ func (p *Plugger) UnmarshalConfig(result interface{}) error {
 	return err
 }
 
+// HTTPClient returns the client plugins should use for performing
+// outbound HTTP requests. Its proxy, timeout, user agent, and caching of
+// responses are defined by the server configuration, and may be overridden
+// via an "http" object in the plugin configuration. See HTTPClientConfig.
+//
+// The same client is returned until the plugin configuration changes.
+func (p *Plugger) HTTPClient() *http.Client {
+	p.httpMutex.Lock()
+	defer p.httpMutex.Unlock()
+	if p.httpClient == nil {
+		var config struct {
+			HTTP HTTPClientConfig
+		}
+		if err := json.Unmarshal(p.config, &config); err != nil {
+			p.Logf("Cannot parse HTTP settings in plugin config: %v", err)
+		}
+		p.httpClient = newHTTPClient(p.httpConfig.override(config.HTTP), p.Logf)
+	}
+	return p.httpClient
+}
+
+// Metric returns the metric with the provided name for the plugin, which
+// is created on first use. Plugins may use metrics to report events such
+// as poll failures and measurements such as API latencies, exposed by the
+// embedded HTTP server at /metrics. See the Metric type for details.
+func (p *Plugger) Metric(name string) *Metric {
+	return metrics.metric(p.name, name)
+}
+
 // DB returns a reference to the underlying database.
 func (p *Plugger) DB() *sql.DB {
 	return p.db
 }
 
+// AccountStatus returns the current state of the accounts handled by the
+// same server as the plugin, sorted by name. Accounts handled by other
+// servers of a distributed mup instance are not included.
+func (p *Plugger) AccountStatus() []AccountStatus {
+	if p.accounts == nil {
+		return nil
+	}
+	return p.accounts()
+}
+
 // Handle inserts the provided message on the incoming queue for processing.
 func (p *Plugger) Handle(msg *Message) error {
+	return p.HandleCtx(context.Background(), msg)
+}
+
+// HandleCtx inserts the provided message on the incoming queue for processing,
+// unless ctx is done first.
+func (p *Plugger) HandleCtx(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("cannot put message in incoming queue: %v", err)
+	}
 	copy := *msg
 	for _, target := range p.Targets() {
 		if msg.Account == "" {
@@ -161,7 +384,7 @@ func (p *Plugger) Handle(msg *Message) error {
 		if target.Account == "" || !target.Address().Contains(copy.Address()) {
 			continue
 		}
-		if err := p.handle(&copy); err != nil {
+		if err := p.handle(ctx, &copy); err != nil {
 			logf("Cannot put message in incoming queue: %v", err)
 			return fmt.Errorf("cannot put message in incoming queue: %v", err)
 		}
@@ -177,16 +400,73 @@ func (p *Plugger) Targets() []Target {
 // Target returns the plugin target that matches the provided message.
 // All messages provided to the plugin for handling are guaranteed
 // to have a matching target.
+//
+// NICK, QUIT, and AWAY messages and RPL_AWAY (301) replies aren't bound
+// to a channel, so they match any target in the same account that isn't
+// bound to a different nick. JOIN and PART messages match the target of
+// the channel joined or left.
 func (p *Plugger) Target(msg *Message) Target {
 	addr := msg.Address()
+	if msg.Command == cmdJoin || msg.Command == cmdPart {
+		// The channel is a parameter, as in "JOIN #chan" or "JOIN :#chan".
+		addr.Channel = msg.Param0
+		if addr.Channel == "" {
+			addr.Channel = msg.Text
+		}
+	}
 	for i := range p.targets {
 		if p.targets[i].Address().Contains(addr) {
 			return p.targets[i]
 		}
 	}
+	switch msg.Command {
+	case cmdNick, cmdQuit, cmdAway, cmdAwayReply:
+		if msg.Command == cmdAwayReply {
+			// The away nick is in the reply, as in ":server 301 mup nick :Gone".
+			addr.Nick = msg.Param1
+		}
+		for i := range p.targets {
+			t := &p.targets[i]
+			if (t.Account == "" || t.Account == addr.Account) && (t.Nick == "" || t.Nick == addr.Nick) {
+				return *t
+			}
+		}
+	}
 	return Target{}
 }
 
+// targetIndex returns the index of the plugin target that contains the
+// provided address, or -1 if there's none.
+func (p *Plugger) targetIndex(addr Address) int {
+	for i := range p.targets {
+		if p.targets[i].Address().Contains(addr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Localize returns t in the timezone of the plugin target that contains
+// the provided address, or t unchanged if the target has no timezone set.
+func (p *Plugger) Localize(to Addressable, t time.Time) time.Time {
+	if i := p.targetIndex(to.Address()); i >= 0 && p.locs[i] != nil {
+		return t.In(p.locs[i])
+	}
+	return t
+}
+
+// FormatTime returns t formatted according to layout, as done by time.Format,
+// in the timezone of the plugin target that contains the provided address.
+// Month and weekday names are translated into the target locale, when known.
+func (p *Plugger) FormatTime(to Addressable, t time.Time, layout string) string {
+	addr := to.Address()
+	t = p.Localize(addr, t)
+	if i := p.targetIndex(addr); i >= 0 {
+		return formatTimeLocale(t, layout, p.targets[i].Locale)
+	}
+	return t.Format(layout)
+}
+
 // LDAP returns the LDAP connection with the given name from the pool.
 // The returned connection must be closed after its use.
 func (p *Plugger) LDAP(name string) (ldap.Conn, error) {
@@ -196,23 +476,61 @@ func (p *Plugger) LDAP(name string) (ldap.Conn, error) {
 // Sendf sends a message to the address obtained from the provided addressable.
 // The message text is formed by providing format and args to fmt.Sprintf, and by
 // prefixing the result with "nick: " if the message is addressed to a nick in
-// a channel.
+// a channel. Replies to incoming messages are sent with PriorityHigh.
 func (p *Plugger) Sendf(to Addressable, format string, args ...interface{}) error {
 	text := fmt.Sprintf(format, args...)
 	a := to.Address()
-	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: p.replyText(a, text)}
+	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: p.replyText(a, text), Priority: replyPriority(to)}
+	return p.Send(msg)
+}
+
+// SendThreadf sends a message as done by Sendf, attaching it as a reply to
+// the provided message or command in transports that support threads.
+// Elsewhere it's delivered exactly as Sendf would.
+func (p *Plugger) SendThreadf(to Addressable, format string, args ...interface{}) error {
+	text := fmt.Sprintf(format, args...)
+	a := to.Address()
+	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: p.replyText(a, text), Priority: replyPriority(to)}
+	switch to := to.(type) {
+	case *Message:
+		msg.ThreadId = to.ThreadId
+	case *Command:
+		msg.ThreadId = to.ThreadId
+	}
 	return p.Send(msg)
 }
 
+// React acknowledges msg with the provided emoji. Telegram messages get
+// the emoji as a native reaction, while on other transports it is sent as
+// a short notice replying to the message author.
+func (p *Plugger) React(msg *Message, emoji string) error {
+	a := msg.Address()
+	if a.Host == "telegram" && msg.Param0 != "" && (msg.Command == "" || msg.Command == cmdPrivMsg) {
+		return p.Send(&Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Command: cmdReact, Param0: msg.Param0, Text: emoji, Priority: PriorityHigh})
+	}
+	return p.Send(&Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Command: cmdNotice, Text: p.replyText(a, emoji), Priority: PriorityHigh})
+}
+
+// replyPriority returns the priority for messages sent to the provided
+// addressable, which is high when replying to an incoming message.
+func replyPriority(to Addressable) Priority {
+	switch to.(type) {
+	case *Message, *Command:
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
 func (p *Plugger) replyText(a Address, text string) string {
 	if a.Nick != "" {
 		if p.db != nil {
 			var moniker string
-			row := p.db.QueryRow("SELECT name FROM moniker "+
-				" WHERE account=? AND nick=? AND name!='' AND (channel='' OR channel=?)"+
-				" ORDER BY channel DESC",
-				a.Account, a.Nick, a.Channel)
-			err := row.Scan(&moniker)
+			stmt, err := p.stmts.prepare("SELECT name FROM moniker " +
+				" WHERE account=? AND nick=? AND name!='' AND (channel='' OR channel=?)" +
+				" ORDER BY channel DESC")
+			if err == nil {
+				err = stmt.QueryRow(a.Account, a.Nick, a.Channel).Scan(&moniker)
+			}
 			if err == nil {
 				a.Nick = moniker
 			} else if err != sql.ErrNoRows {
@@ -238,7 +556,7 @@ func (p *Plugger) SendDirectf(to Addressable, format string, args ...interface{}
 	if a.Nick != "" {
 		a.Channel = ""
 	}
-	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: fmt.Sprintf(format, args...)}
+	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: fmt.Sprintf(format, args...), Priority: replyPriority(to)}
 	return p.Send(msg)
 }
 
@@ -250,7 +568,7 @@ func (p *Plugger) SendChannelf(to Addressable, format string, args ...interface{
 	if a.Channel != "" {
 		a.Nick = ""
 	}
-	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: fmt.Sprintf(format, args...)}
+	msg := &Message{Account: a.Account, Channel: a.Channel, Nick: a.Nick, Text: fmt.Sprintf(format, args...), Priority: replyPriority(to)}
 	return p.Send(msg)
 }
 
@@ -265,18 +583,120 @@ func (p *Plugger) Broadcastf(format string, args ...interface{}) error {
 
 // Broadcast sends a message to all configured plugin targets.
 // The message text is prefixed by "nick: " if the message is addressed to
-// a nick in a channel.
+// a nick in a channel. Unless the message defines a priority, it is sent
+// with PriorityLow so that it doesn't delay replies to people.
 func (p *Plugger) Broadcast(msg *Message) error {
+	return p.broadcast(msg, false, "")
+}
+
+// BroadcastGroupf sends a message to all configured plugin targets in group.
+// The message text is formed as done by Broadcastf.
+func (p *Plugger) BroadcastGroupf(group, format string, args ...interface{}) error {
+	msg := &Message{Text: fmt.Sprintf(format, args...)}
+	return p.BroadcastGroup(group, msg)
+}
+
+// BroadcastGroup sends a message to all configured plugin targets in group.
+// The message text is prefixed by "nick: " if the message is addressed to
+// a nick in a channel.
+func (p *Plugger) BroadcastGroup(group string, msg *Message) error {
+	return p.broadcast(msg, true, group)
+}
+
+// Announcement holds the details of an event reported by a watcher plugin,
+// such as a bug being opened or a build failing. Its fields are provided
+// to the templates that operators may configure to format announcements,
+// as in "{{.Title}} by {{.Author}}: {{.URL}}".
+type Announcement struct {
+	// Event names the kind of event reported, such as "opened", and
+	// selects the template used to format the announcement.
+	Event string `json:"event"`
+
+	// Text is the announcement as formatted by the plugin itself,
+	// which is used when there is no template for the event.
+	Text string `json:"text"`
+
+	Id      string `json:"id,omitempty"`
+	Title   string `json:"title,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Project string `json:"project,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Author  string `json:"author,omitempty"`
+	State   string `json:"state,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+}
+
+// Announce broadcasts a to all configured plugin targets. The text sent
+// to each target is the result of executing the template defined for
+// a.Event in the "templates" option of the target or, if missing, of the
+// plugin configuration, or a.Text if there is no such template.
+//
+// The announcement is also recorded as an event, as documented in Event.
+func (p *Plugger) Announce(a *Announcement) error {
+	var config struct{ Templates map[string]string }
+	if err := p.UnmarshalConfig(&config); err != nil {
+		p.Logf("%v", err)
+	}
+	if err := p.Event(pluginKey(p.name)+"."+a.Event, a); err != nil {
+		p.Logf("%v", err)
+	}
+	return p.broadcastText(&Message{}, false, "", func(t *Target) string {
+		var tconfig struct{ Templates map[string]string }
+		if err := t.UnmarshalConfig(&tconfig); err != nil {
+			p.Logf("%v", err)
+		}
+		text, ok := tconfig.Templates[a.Event]
+		if !ok {
+			text, ok = config.Templates[a.Event]
+		}
+		if !ok {
+			return a.Text
+		}
+		tmpl, err := template.New("").Parse(text)
+		if err != nil {
+			p.Logf("Cannot parse %q announcement template for %s: %v", a.Event, t, err)
+			return a.Text
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, a); err != nil {
+			p.Logf("Cannot execute %q announcement template for %s: %v", a.Event, t, err)
+			return a.Text
+		}
+		return buf.String()
+	})
+}
+
+func (p *Plugger) broadcast(msg *Message, grouped bool, group string) error {
+	return p.broadcastText(msg, grouped, group, nil)
+}
+
+// broadcastText sends a copy of msg to the targets selected as done by
+// broadcast, with the text of each copy obtained from text, if set.
+func (p *Plugger) broadcastText(msg *Message, grouped bool, group string, text func(t *Target) string) error {
 	var first error
+	var sent = make(map[Address]bool)
 	for i := range p.targets {
 		t := &p.targets[i]
-		if !t.CanSend() {
+		if !t.CanSend() || grouped && t.Group != group {
+			continue
+		}
+		// Several targets may share an address, for example when they
+		// differ only in configuration, so deliver just once to each.
+		addr := t.Address()
+		if sent[addr] {
 			continue
 		}
+		sent[addr] = true
 		copy := *msg
 		copy.Account = t.Account
 		copy.Channel = t.Channel
 		copy.Nick = t.Nick
+		if copy.Priority == PriorityNormal {
+			copy.Priority = PriorityLow
+		}
+		if text != nil {
+			copy.Text = text(t)
+		}
 		copy.Text = p.replyText(t.Address(), copy.Text)
 		err := p.Send(&copy)
 		if err != nil && first == nil {
@@ -298,13 +718,31 @@ const MaxTextLen = 300
 // algorithm takes place to enforce MaxTextLen.
 const minTextLen = 50
 
-// Send sends msg to its defined address.
+// Send sends msg to its defined address. The text is formatted by the
+// template of the matching plugin target, if any.
 func (p *Plugger) Send(msg *Message) error {
+	return p.SendCtx(context.Background(), msg)
+}
+
+// SendCtx sends msg to its defined address as done by Send, unless ctx
+// is done first.
+func (p *Plugger) SendCtx(ctx context.Context, msg *Message) error {
+	copy := *msg
+	copy.Text = p.applyTemplate(msg)
+	return p.sendSplit(ctx, &copy)
+}
+
+// sendSplit sends msg to its defined address, breaking its text into
+// several messages if it's longer than MaxTextLen.
+func (p *Plugger) sendSplit(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("cannot put message in outgoing queue: %v", err)
+	}
 	copy := *msg
 	copy.Time = time.Now()
 	copy.Text = strings.TrimRight(copy.Text, " \t")
 	if len(copy.Text) <= MaxTextLen {
-		if err := p.send(&copy); err != nil {
+		if err := p.send(ctx, &copy); err != nil {
 			logf("Cannot put message in outgoing queue: %v", err)
 			return fmt.Errorf("cannot put message in outgoing queue: %v", err)
 		}
@@ -325,15 +763,18 @@ func (p *Plugger) Send(msg *Message) error {
 		} else if len(text)-MaxTextLen < minTextLen {
 			split = (len(text) + 1) / 2
 		}
-		copy.Text = strings.TrimRight(text[:split], " ")
+		// The attachment goes only with the last part.
+		part := copy
+		part.Text = strings.TrimRight(text[:split], " ")
+		part.Attachment = Attachment{}
 		text = strings.TrimLeft(text[split:], " ")
-		if err := p.Send(&copy); err != nil {
+		if err := p.sendSplit(ctx, &part); err != nil {
 			return err
 		}
 	}
 	if len(text) > 0 {
 		copy.Text = text
-		return p.Send(&copy)
+		return p.sendSplit(ctx, &copy)
 	}
 	return nil
 }
@@ -1,8 +1,13 @@
 package mup_test
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"time"
 
@@ -49,6 +54,7 @@ func (s *PluggerSuite) TearDownTest(c *C) {
 func (s *PluggerSuite) plugger(db *sql.DB, config map[string]interface{}, targets []mup.Target) *mup.Plugger {
 	s.sent = nil
 	s.msgs = nil
+	s.handled = nil
 	s.ldap = make(map[string]ldap.Conn)
 	send := func(msg *mup.Message) error {
 		s.sent = append(s.sent, "[@"+msg.Account+"] "+msg.String())
@@ -115,6 +121,45 @@ func (s *PluggerSuite) TestHandle(c *C) {
 	c.Assert(s.handled, HasLen, 2)
 }
 
+func (s *PluggerSuite) TestHandleCtx(c *C) {
+	p := s.plugger(nil, nil, []mup.Target{{Account: "one"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := p.HandleCtx(ctx, mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG mup :first"))
+	c.Assert(err, IsNil)
+	cancel()
+	err = p.HandleCtx(ctx, mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PRIVMSG mup :second"))
+	c.Assert(err, ErrorMatches, "cannot put message in incoming queue: context canceled")
+
+	c.Assert(s.handled, DeepEquals, []string{"[@one] :nick!~user@host PRIVMSG mup :first"})
+}
+
+func (s *PluggerSuite) TestSendCtx(c *C) {
+	p := s.plugger(nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := p.SendCtx(ctx, &mup.Message{Account: "one", Nick: "nick", Text: "first"})
+	c.Assert(err, IsNil)
+	cancel()
+	err = p.SendCtx(ctx, &mup.Message{Account: "one", Nick: "nick", Text: "second"})
+	c.Assert(err, ErrorMatches, "cannot put message in outgoing queue: context canceled")
+
+	c.Assert(s.sent, DeepEquals, []string{"[@one] PRIVMSG nick :first"})
+
+	// Long messages stop being sent once ctx is done.
+	ctx, cancel = context.WithCancel(context.Background())
+	var parts []string
+	send := func(msg *mup.Message) error {
+		parts = append(parts, msg.Text)
+		cancel()
+		return nil
+	}
+	p = mup.NewPlugger("theplugin", nil, send, nil, nil, nil, nil)
+	err = p.SendCtx(ctx, &mup.Message{Account: "one", Nick: "nick", Text: strings.Repeat("word ", 150)})
+	c.Assert(err, ErrorMatches, "cannot put message in outgoing queue: context canceled")
+	c.Assert(parts, HasLen, 1)
+}
+
 func (s *PluggerSuite) TestSendfPrivate(c *C) {
 	p := s.plugger(nil, nil, nil)
 	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@host PRIVMSG mup :query")
@@ -150,6 +195,30 @@ func (s *PluggerSuite) TestSendfUserChannel(c *C) {
 	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG @user:123 :<reply>"})
 }
 
+func (s *PluggerSuite) TestSendThreadf(c *C) {
+	p := s.plugger(nil, nil, nil)
+	msg := mup.ParseIncoming("origin", "mup", "!", ":nick!~user@telegram PRIVMSG #channel :mup: query")
+	msg.ThreadId = "42"
+	p.SendThreadf(msg, "<%s>", "reply")
+	p.SendThreadf(mup.Address{Account: "origin", Channel: "#channel"}, "<%s>", "unthreaded")
+	c.Assert(s.sent, DeepEquals, []string{"[@origin] PRIVMSG #channel :@nick <reply>", "[@origin] PRIVMSG #channel :<unthreaded>"})
+	c.Assert(s.msgs[0].ThreadId, Equals, "42")
+	c.Assert(s.msgs[1].ThreadId, Equals, "")
+}
+
+func (s *PluggerSuite) TestReact(c *C) {
+	p := s.plugger(nil, nil, nil)
+	msg := mup.ParseIncoming("origin", "mup", "/", ":nick!~user@telegram PRIVMSG #channel :mup: deploy")
+	msg.Param0 = "42"
+	p.React(msg, "👍")
+	msg = mup.ParseIncoming("origin", "mup", "!", ":nick!~user@host PRIVMSG #channel :mup: deploy")
+	p.React(msg, "👍")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@origin] REACT #channel 42 :👍",
+		"[@origin] NOTICE #channel :nick: 👍",
+	})
+}
+
 func (s *PluggerSuite) TestSend(c *C) {
 	p := s.plugger(nil, nil, nil)
 	msg := &mup.Message{Account: "myaccount", Command: "TEST", Param0: "some", Param1: "params"}
@@ -245,6 +314,55 @@ func (s *PluggerSuite) TestTargets(c *C) {
 	c.Assert(config.Key, Equals, "value")
 }
 
+func (s *PluggerSuite) TestTargetPresence(c *C) {
+	p := s.plugger(nil, nil, []mup.Target{
+		{Account: "one", Channel: "#chan"},
+		{Account: "two", Channel: "#chan", Nick: "nick"},
+	})
+	targets := p.Targets()
+	for _, line := range []string{":nick!~user@host NICK other", ":nick!~user@host QUIT :Bye", ":nick!~user@host AWAY :Gone", ":n.net 301 mup nick :Gone"} {
+		c.Assert(p.Target(mup.ParseIncoming("one", "mup", "!", line)), Equals, targets[0])
+		c.Assert(p.Target(mup.ParseIncoming("two", "mup", "!", line)), Equals, targets[1])
+		c.Assert(p.Target(mup.ParseIncoming("three", "mup", "!", line)), Equals, mup.Target{})
+	}
+	c.Assert(p.Target(mup.ParseIncoming("two", "mup", "!", ":other!~user@host AWAY :Gone")), Equals, mup.Target{})
+	c.Assert(p.Target(mup.ParseIncoming("two", "mup", "!", ":n.net 301 mup other :Gone")), Equals, mup.Target{})
+}
+
+func (s *PluggerSuite) TestTargetJoin(c *C) {
+	p := s.plugger(nil, nil, []mup.Target{
+		{Account: "one", Channel: "#chan"},
+		{Account: "one", Channel: "#other"},
+	})
+	targets := p.Targets()
+	c.Assert(p.Target(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host JOIN #chan")), Equals, targets[0])
+	c.Assert(p.Target(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host JOIN :#other")), Equals, targets[1])
+	c.Assert(p.Target(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host PART #other :Bye")), Equals, targets[1])
+	c.Assert(p.Target(mup.ParseIncoming("one", "mup", "!", ":nick!~user@host JOIN #unknown")), Equals, mup.Target{})
+	c.Assert(p.Target(mup.ParseIncoming("two", "mup", "!", ":nick!~user@host JOIN #chan")), Equals, mup.Target{})
+}
+
+func (s *PluggerSuite) TestFormatTime(c *C) {
+	p := s.plugger(nil, nil, []mup.Target{
+		{Account: "one", Channel: "#chan", Timezone: "Asia/Tokyo", Locale: "de_DE"},
+		{Account: "two", Locale: "xx"},
+		{Account: "three", Timezone: "Bad/Zone"},
+	})
+	t := time.Date(2015, 12, 31, 20, 30, 0, 0, time.UTC)
+	chan1 := &mup.Message{Account: "one", Channel: "#chan"}
+	layout := "Monday, Jan 2 (January) 15:04 MST"
+
+	c.Assert(p.Localize(chan1, t).Location().String(), Equals, "Asia/Tokyo")
+	c.Assert(p.Localize(chan1, t).Hour(), Equals, 5)
+	c.Assert(p.FormatTime(chan1, t, layout), Equals, "Freitag, Jan 1 (Januar) 05:30 JST")
+	c.Assert(p.FormatTime(chan1, t, "Mon Jan 2"), Equals, "Fr Jan 1")
+	c.Assert(p.FormatTime(chan1, t.AddDate(0, 0, 60), "Mon Jan 2"), Equals, "Di Mär 1")
+	c.Assert(p.FormatTime(&mup.Message{Account: "two", Nick: "nick"}, t, layout), Equals, "Thursday, Dec 31 (December) 20:30 UTC")
+	c.Assert(p.FormatTime(&mup.Message{Account: "three", Nick: "nick"}, t, layout), Equals, "Thursday, Dec 31 (December) 20:30 UTC")
+	c.Assert(p.FormatTime(&mup.Message{Account: "four", Nick: "nick"}, t, layout), Equals, "Thursday, Dec 31 (December) 20:30 UTC")
+	c.Assert(p.Localize(&mup.Message{Account: "four", Nick: "nick"}, t), Equals, t)
+}
+
 func (s *PluggerSuite) TestBroadcastf(c *C) {
 	p := s.plugger(nil, nil, []mup.Target{
 		{Account: "one", Channel: "#chan"},
@@ -273,6 +391,159 @@ func (s *PluggerSuite) TestBroadcast(c *C) {
 	c.Assert(s.sent, DeepEquals, []string{"[@one] TEST some params", "[@two] TEST some params"})
 }
 
+func (s *PluggerSuite) TestBroadcastGroupf(c *C) {
+	p := s.plugger(nil, nil, []mup.Target{
+		{Account: "one", Channel: "#chan"},
+		{Account: "one", Channel: "#fail", Group: "failures"},
+		{Account: "two", Nick: "nick", Group: "failures"},
+		{Account: "two", Nick: "nick", Group: "failures", Config: `{"key": "value"}`},
+	})
+	p.BroadcastGroupf("failures", "<%s>", "text")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #fail :<text>",
+		"[@two] PRIVMSG nick :<text>",
+	})
+	s.sent = nil
+	p.BroadcastGroupf("successes", "<%s>", "text")
+	c.Assert(s.sent, HasLen, 0)
+	p.Broadcastf("<%s>", "text")
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :<text>",
+		"[@one] PRIVMSG #fail :<text>",
+		"[@two] PRIVMSG nick :<text>",
+	})
+}
+
+func (s *PluggerSuite) TestTargetTemplate(c *C) {
+	p := s.plugger(nil, nil, []mup.Target{
+		{Account: "one", Channel: "#chan", Config: `{"template": "*{{.Text}}*"}`},
+		{Account: "two", Config: `{"template": "[{{.Channel}}] {{.Text}}"}`},
+		{Account: "three", Channel: "#chan"},
+		{Account: "four", Channel: "#chan", Config: `{"template": "{{.Bad"}`},
+	})
+	p.Broadcastf("<%s>", "text")
+	p.Sendf(mup.Address{Account: "two", Channel: "#other", Nick: "nick"}, "reply")
+	p.Send(&mup.Message{Account: "one", Channel: "#chan", Command: "TEST", Param0: "param"})
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :*<text>*",
+		"[@three] PRIVMSG #chan :<text>",
+		"[@four] PRIVMSG #chan :<text>",
+		"[@two] PRIVMSG #other :[#other] nick: reply",
+		"[@one] TEST param",
+	})
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Cannot parse template for account "four", channel "#chan": .*`)
+}
+
+func (s *PluggerSuite) TestAnnounce(c *C) {
+	config := map[string]interface{}{
+		"templates": map[string]string{"opened": "{{.Title}} by {{.Author}} <{{.URL}}>"},
+	}
+	p := s.plugger(nil, config, []mup.Target{
+		{Account: "one", Channel: "#chan"},
+		{Account: "two", Channel: "#chan", Config: `{"templates": {"opened": "#{{.Id}} opened", "closed": "{{.Bad"}}`},
+	})
+	a := &mup.Announcement{Event: "opened", Text: "Issue #1 opened", Id: "1", Title: "Broken", Author: "joe", URL: "https://example.com/1"}
+	p.Announce(a)
+	a = &mup.Announcement{Event: "closed", Text: "Issue #1 closed", Id: "1"}
+	p.Announce(a)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :Broken by joe <https://example.com/1>",
+		"[@two] PRIVMSG #chan :#1 opened",
+		"[@one] PRIVMSG #chan :Issue #1 closed",
+		"[@two] PRIVMSG #chan :Issue #1 closed",
+	})
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Cannot parse "closed" announcement template for account "two", channel "#chan": .*`)
+}
+
+func (s *PluggerSuite) TestEvent(c *C) {
+	p := s.plugger(s.db, nil, nil)
+	c.Assert(p.Event("theplugin.custom", map[string]int{"n": 1}), IsNil)
+	p.Announce(&mup.Announcement{Event: "opened", Text: "Issue #1 opened", Id: "1"})
+
+	rows, err := s.db.Query("SELECT plugin,topic,payload FROM event ORDER BY id")
+	c.Assert(err, IsNil)
+	defer rows.Close()
+	var events []string
+	for rows.Next() {
+		var plugin, topic, payload string
+		c.Assert(rows.Scan(&plugin, &topic, &payload), IsNil)
+		events = append(events, plugin+" "+topic+" "+payload)
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(events, DeepEquals, []string{
+		`theplugin/label theplugin.custom {"n":1}`,
+		`theplugin/label theplugin.opened {"event":"opened","text":"Issue #1 opened","id":"1"}`,
+	})
+
+	// Events may only be published via a running plugin.
+	c.Assert(p.Publish("theplugin.custom", nil), ErrorMatches, `cannot publish "theplugin.custom" event: no event bus available`)
+}
+
+func (s *PluggerSuite) TestMigrateDB(c *C) {
+	p := s.plugger(s.db, nil, nil)
+	c.Assert(p.Table("quote"), Equals, "plugin_theplugin__quote")
+
+	// Migrations refer to the tables of the plugger being migrated.
+	var ran []int
+	migrations := func(p *mup.Plugger) []mup.DBMigration {
+		return []mup.DBMigration{
+			func(tx *sql.Tx) error {
+				ran = append(ran, 1)
+				_, err := tx.Exec("CREATE TABLE " + p.Table("quote") + " (text TEXT)")
+				return err
+			},
+			func(tx *sql.Tx) error {
+				ran = append(ran, 2)
+				_, err := tx.Exec("ALTER TABLE " + p.Table("quote") + " ADD COLUMN author TEXT")
+				return err
+			},
+			func(tx *sql.Tx) error {
+				ran = append(ran, 3)
+				return fmt.Errorf("boom")
+			},
+		}
+	}
+	c.Assert(p.MigrateDB(migrations(p)[0]), IsNil)
+	c.Assert(p.MigrateDB(migrations(p)[0]), IsNil)
+	c.Assert(p.MigrateDB(migrations(p)[:2]...), IsNil)
+	c.Assert(ran, DeepEquals, []int{1, 2})
+	execSQL(c, s.db, "INSERT INTO plugin_theplugin__quote (text,author) VALUES ('Hello','joe')")
+
+	// Failing migrations are rolled back as a whole.
+	c.Assert(p.MigrateDB(migrations(p)...), ErrorMatches, "cannot migrate plugin tables to version 3: boom")
+	c.Assert(p.MigrateDB(), ErrorMatches, "plugin tables are at version 2, but only 0 migrations are known")
+
+	// Plugin names map to distinct tables, and wiping a plugin leaves
+	// alone the tables of plugins with names that extend its own.
+	for _, name := range []string{"theplugin_", "theplugin-other", "theplugin_other", "thePlugin/label"} {
+		other := mup.NewPlugger(name, s.db, nil, nil, nil, nil, nil)
+		c.Assert(other.MigrateDB(migrations(other)[0]), IsNil)
+	}
+	c.Assert(mup.NewPlugger("theplugin_other/label", nil, nil, nil, nil, nil, nil).Table("quote"), Equals, "plugin_theplugin_5fother__quote")
+
+	c.Assert(mup.WipePluginDB(s.db, "theplugin"), IsNil)
+	var tables []string
+	rows, err := s.db.Query("SELECT name FROM sqlite_master WHERE substr(name,1,7)='plugin_' ORDER BY name")
+	c.Assert(err, IsNil)
+	for rows.Next() {
+		var name string
+		c.Assert(rows.Scan(&name), IsNil)
+		tables = append(tables, name)
+	}
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(tables, DeepEquals, []string{
+		"plugin_the_50lugin__quote",
+		"plugin_theplugin_2dother__quote",
+		"plugin_theplugin_5f__quote",
+		"plugin_theplugin_5fother__quote",
+	})
+
+	// Migrations run again once wiped.
+	ran = nil
+	c.Assert(p.MigrateDB(migrations(p)[:2]...), IsNil)
+	c.Assert(ran, DeepEquals, []int{1, 2})
+}
+
 func (s *PluggerSuite) TestMoniker(c *C) {
 	execSQL(c, s.db,
 		`INSERT INTO account (name) VALUES ('one')`,
@@ -325,6 +596,78 @@ func (c *ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
 	return []ldap.Result{{DN: "test-dn"}}, nil
 }
 
+type dirConn struct {
+	searches []ldap.Search
+}
+
+func (c *dirConn) Close() error { return nil }
+
+func (c *dirConn) Search(s *ldap.Search) ([]ldap.Result, error) {
+	c.searches = append(c.searches, *s)
+	return []ldap.Result{{DN: "test-dn", Attrs: []ldap.Attr{
+		{Name: "mozillaNickname", Values: []string{"tesla"}},
+		{Name: "mobile", Values: []string{"+11 22", "+33"}},
+	}}}, nil
+}
+
+func (s *PluggerSuite) TestDirectoryLDAP(c *C) {
+	p := s.plugger(s.db, nil, nil)
+	conn := &dirConn{}
+	s.ldap["test"] = conn
+
+	dir, err := p.Directory("test")
+	c.Assert(err, IsNil)
+	defer dir.Close()
+
+	entries, err := dir.Search(mup.DirNick, "t(e)sla", mup.DirNick, "mobile")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Value(mup.DirNick), Equals, "tesla")
+	c.Assert(entries[0].Values("mobile"), DeepEquals, []string{"+11 22", "+33"})
+
+	_, err = dir.Search("mobile", "+55 (66)", mup.DirEmail)
+	c.Assert(err, IsNil)
+
+	c.Assert(conn.searches, DeepEquals, []ldap.Search{{
+		Filter: `(mozillaNickname=t\28e\29sla)`,
+		Attrs:  []string{"mozillaNickname", "mobile"},
+	}, {
+		Filter: "(mobile=*5*5*6*6*)",
+		Attrs:  []string{"mail"},
+	}})
+}
+
+func (s *PluggerSuite) TestDirectoryTable(c *C) {
+	execSQL(c, s.db,
+		`INSERT INTO directory (name,nick,email,attrs) VALUES ('test','tesla','tesla@example.com','{"mobile": ["+11 22", "+33"], "l": "Smiljan"}')`,
+		`INSERT INTO directory (name,nick,attrs) VALUES ('test','einstein','{"mobile": "+44"}')`,
+		`INSERT INTO directory (name,nick) VALUES ('other','tesla')`,
+	)
+	p := s.plugger(s.db, nil, nil)
+
+	dir, err := p.Directory("test")
+	c.Assert(err, IsNil)
+	defer dir.Close()
+
+	entries, err := dir.Search(mup.DirNick, "Tesla", mup.DirEmail, "l", "c")
+	c.Assert(err, IsNil)
+	c.Assert(entries, DeepEquals, []mup.DirEntry{{Attrs: map[string][]string{
+		"email": {"tesla@example.com"},
+		"l":     {"Smiljan"},
+	}}})
+
+	entries, err = dir.Search("mobile", "+3-3", mup.DirNick)
+	c.Assert(err, IsNil)
+	c.Assert(entries, DeepEquals, []mup.DirEntry{{Attrs: map[string][]string{"nick": {"tesla"}}}})
+
+	entries, err = dir.Search(mup.DirEmail, "einstein@example.com")
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	_, err = p.Directory("unknown")
+	c.Assert(err, ErrorMatches, `directory "unknown" not found`)
+}
+
 var lineBreakTests = []struct {
 	text string
 	sent []string
@@ -362,3 +705,170 @@ func (s *PluggerSuite) TestTextLineBreak(c *C) {
 		s.sent = nil
 	}
 }
+
+func (s *PluggerSuite) TestSendLong(c *C) {
+	p := s.plugger(nil, nil, nil)
+	err := p.SendLong(&mup.Message{Account: "one", Channel: "#chan", Nick: "nick"}, "a\nb\nc\n")
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG #chan :nick: a",
+		"[@one] PRIVMSG #chan :nick: b",
+		"[@one] PRIVMSG #chan :nick: c",
+	})
+}
+
+func (s *PluggerSuite) TestSendLongNoPaste(c *C) {
+	p := s.plugger(nil, map[string]interface{}{"pastelines": 3}, nil)
+	err := p.SendLong(&mup.Message{Account: "one", Nick: "nick"}, "a\nb\nc\nd\ne")
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{
+		"[@one] PRIVMSG nick :a",
+		"[@one] PRIVMSG nick :b",
+		"[@one] PRIVMSG nick :(3 more lines omitted)",
+	})
+}
+
+func (s *PluggerSuite) TestSendLongPasteURL(c *C) {
+	var pasted string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		pasted = string(data)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("https://paste.example.com/xyz\n"))
+	}))
+	defer server.Close()
+
+	p := s.plugger(nil, map[string]interface{}{"pasteurl": server.URL}, nil)
+	text := strings.Repeat("line\n", 10)
+	err := p.SendLong(&mup.Message{Account: "one", Nick: "nick"}, text)
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, DeepEquals, []string{"[@one] PRIVMSG nick :Output is 10 lines long: https://paste.example.com/xyz"})
+	c.Assert(pasted, Equals, text)
+}
+
+func (s *PluggerSuite) TestSendLongBuiltin(c *C) {
+	p := s.plugger(s.db, nil, nil)
+	mup.SetHTTPURL(p, "https://mup.example.com/")
+	text := strings.Repeat("line\n", 10)
+	err := p.SendLong(&mup.Message{Account: "one", Nick: "nick"}, text)
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 1)
+	c.Assert(s.sent[0], Matches, `\[@one\] PRIVMSG nick :Output is 10 lines long: https://mup.example.com/paste/[0-9a-f]{32}`)
+
+	id := s.sent[0][strings.LastIndex(s.sent[0], "/")+1:]
+	var plugin, pasted string
+	err = s.db.QueryRow("SELECT plugin,text FROM paste WHERE id=?", id).Scan(&plugin, &pasted)
+	c.Assert(err, IsNil)
+	c.Assert(plugin, Equals, "theplugin/label")
+	c.Assert(pasted, Equals, text)
+}
+
+func (s *PluggerSuite) TestSendImage(c *C) {
+	p := s.plugger(s.db, nil, nil)
+	mup.SetHTTPURL(p, "https://mup.example.com/")
+	image := []byte("GIF89a\x00\x01")
+	err := p.SendImage(&mup.Message{Account: "one", Channel: "#chan", Nick: "nick"}, "Plot:", image, "image/gif")
+	c.Assert(err, IsNil)
+	c.Assert(s.sent, HasLen, 1)
+	c.Assert(s.sent[0], Matches, `\[@one\] PRIVMSG #chan :nick: Plot: https://mup.example.com/paste/[0-9a-f]{32}`)
+
+	link := s.sent[0][strings.LastIndex(s.sent[0], " ")+1:]
+	c.Assert(s.msgs[0].Attachment, Equals, mup.Attachment{Kind: "photo", Id: link, MimeType: "image/gif", Size: int64(len(image))})
+
+	id := link[strings.LastIndex(link, "/")+1:]
+	var pasted []byte
+	var mimeType string
+	err = s.db.QueryRow("SELECT text,mimetype FROM paste WHERE id=?", id).Scan(&pasted, &mimeType)
+	c.Assert(err, IsNil)
+	c.Assert(pasted, DeepEquals, image)
+	c.Assert(mimeType, Equals, "image/gif")
+}
+
+func (s *PluggerSuite) TestSendImageNoPaste(c *C) {
+	p := s.plugger(nil, nil, nil)
+	err := p.SendImage(&mup.Message{Account: "one", Nick: "nick"}, "Plot:", []byte("GIF89a"), "image/gif")
+	c.Assert(err, ErrorMatches, "no paste service available")
+	c.Assert(s.sent, HasLen, 0)
+}
+
+func (s *PluggerSuite) TestSendImageType(c *C) {
+	p := s.plugger(s.db, nil, nil)
+	mup.SetHTTPURL(p, "https://mup.example.com/")
+	err := p.SendImage(&mup.Message{Account: "one", Nick: "nick"}, "Plot:", []byte("<svg/>"), "image/svg+xml")
+	c.Assert(err, ErrorMatches, `unsupported image type "image/svg\+xml"`)
+	c.Assert(s.sent, HasLen, 0)
+
+	err = p.SendImage(&mup.Message{Account: "one", Nick: "nick"}, "Plot:", []byte("\x89PNG"), "image/PNG; charset=binary")
+	c.Assert(err, IsNil)
+	c.Assert(s.msgs[0].Attachment.MimeType, Equals, "image/png")
+}
+
+func (s *PluggerSuite) TestHTTPClient(c *C) {
+	var agents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		fmt.Fprintf(w, "response %d", len(agents))
+	}))
+	defer server.Close()
+
+	get := func(client *http.Client, agent string) string {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		c.Assert(err, IsNil)
+		if agent != "" {
+			req.Header.Set("User-Agent", agent)
+		}
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// Defaults.
+	p := s.plugger(nil, nil, nil)
+	client := p.HTTPClient()
+	c.Assert(client.Timeout, Equals, mup.NetworkTimeout)
+	c.Assert(p.HTTPClient(), Equals, client)
+	c.Assert(get(client, ""), Equals, "response 1")
+	c.Assert(get(client, ""), Equals, "response 2")
+	c.Assert(agents, DeepEquals, []string{"mup", "mup"})
+
+	// Server settings, with caching overridden by the plugin.
+	agents = nil
+	p = s.plugger(nil, map[string]interface{}{"http": map[string]interface{}{"cache": "1m"}}, nil)
+	mup.SetHTTPClientConfig(p, mup.HTTPClientConfig{
+		Timeout:   mup.DurationString{Duration: 5 * time.Second},
+		UserAgent: "agent/1.0",
+	})
+	client = p.HTTPClient()
+	c.Assert(client.Timeout, Equals, 5*time.Second)
+	c.Assert(get(client, ""), Equals, "response 1")
+	c.Assert(get(client, ""), Equals, "response 1")
+	c.Assert(get(client, "other"), Equals, "response 2")
+	c.Assert(agents, DeepEquals, []string{"agent/1.0", "other"})
+}
+
+func (s *PluggerSuite) TestMetric(c *C) {
+	p := s.plugger(nil, nil, nil)
+	p.Metric("poll failures").Inc()
+	p.Metric("poll failures").Add(2)
+	p.Metric("poll failures").Add(-1)
+	p.Metric("api_latency").Observe(0.5)
+	p.Metric("api_latency").Observe(0.25)
+
+	other := mup.NewPlugger("other", nil, nil, nil, nil, nil, nil)
+	other.Metric("api_latency").Observe(1)
+
+	var buf bytes.Buffer
+	c.Assert(mup.WriteMetrics(&buf), IsNil)
+	c.Assert(buf.String(), Matches, `(?s).*`+
+		`# TYPE mup_plugin_poll_failures_total counter\n`+
+		`mup_plugin_poll_failures_total\{plugin="theplugin/label"\} 3\n`+
+		`.*`+
+		`# TYPE mup_plugin_api_latency summary\n`+
+		`mup_plugin_api_latency_sum\{plugin="other"\} 1\n`+
+		`mup_plugin_api_latency_count\{plugin="other"\} 1\n`+
+		`mup_plugin_api_latency_sum\{plugin="theplugin/label"\} 0.75\n`+
+		`mup_plugin_api_latency_count\{plugin="theplugin/label"\} 2\n.*`)
+}
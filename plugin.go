@@ -2,9 +2,12 @@ package mup
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +23,19 @@ type PluginSpec struct {
 	Help     string
 	Start    func(p *Plugger) Stopper
 	Commands schema.Commands
+
+	// ConfigSchema optionally holds a value of the type the plugin
+	// unmarshals its configuration into. When set, configurations with
+	// unknown options or values of the wrong type are rejected.
+	ConfigSchema interface{}
+
+	// Validate optionally checks the configuration and targets made
+	// available by the provided plugger before the plugin is started.
+	//
+	// A plugin with a rejected configuration is not started. If an
+	// instance of it is already running, that instance is kept running
+	// with its previous configuration and targets.
+	Validate func(p *Plugger) error
 }
 
 // Stopper is implemented by types that can run arbitrary background
@@ -41,11 +57,46 @@ type OutgoingHandler interface {
 	HandleOutgoing(msg *Message)
 }
 
+// DeliveryHandler is implemented by plugins that want to know whether the
+// messages they sent were delivered. HandleDelivery is called once for
+// each outgoing message sent by the plugin, when the account reports that
+// the message was sent or that it failed.
+type DeliveryHandler interface {
+	HandleDelivery(d *Delivery)
+}
+
+// ConfigUpdater is implemented by plugins that can take changes to their
+// configuration and targets in place, without being stopped and started
+// again. UpdateConfig is called with a new plugger holding the updated
+// settings, which the plugin must use from then on. If it returns an
+// error the plugin is stopped and started again with the new settings.
+type ConfigUpdater interface {
+	UpdateConfig(p *Plugger) error
+}
+
 // CommandHandler is implemented by plugins that can handle commands.
 type CommandHandler interface {
 	HandleCommand(cmd *Command)
 }
 
+// EventHandler is implemented by plugins that consume events published
+// by other plugins. HandleEvent is called for every event published under
+// a topic the plugin subscribed to via Plugger.Subscribe.
+type EventHandler interface {
+	HandleEvent(ev *Event)
+}
+
+// UnknownCommandHandler is implemented by plugins that want to handle
+// commands that no running plugin knows about, such as a factoid lookup
+// or a search. HandleUnknownCommand is called with the message and the
+// command name it starts with, for messages addressed to the bot in a
+// target of the plugin, including those using the bang prefix. The help
+// plugin does not complain about unknown commands where such a plugin is
+// enabled.
+type UnknownCommandHandler interface {
+	HandleUnknownCommand(msg *Message, cmdName string)
+}
+
 // Command holds a message that was properly parsed as an existing command.
 type Command struct {
 	*Message
@@ -90,38 +141,48 @@ func RegisterPlugin(spec *PluginSpec) {
 }
 
 type pluginInfo struct {
-	Name   string
-	LastId int64
-	Config []byte
-	State  []byte
+	Name     string
+	LastId   int64
+	Config   []byte
+	State    []byte
+	LogLevel string
 
 	Targets []Target
 }
 
-const pluginColumns = "name,lastid,config,state"
-const pluginPlacers = "?,?,?,?"
+const pluginColumns = "name,lastid,config,state,loglevel"
+const pluginPlacers = "?,?,?,?,?"
 
 func (pi *pluginInfo) refs() []interface{} {
-	return []interface{}{&pi.Name, &pi.LastId, &pi.Config, &pi.State}
+	return []interface{}{&pi.Name, &pi.LastId, &pi.Config, &pi.State, &pi.LogLevel}
 }
 
 type pluginState struct {
-	info    pluginInfo
-	spec    *PluginSpec
-	plugger *Plugger
-	plugin  Stopper
+	info     pluginInfo
+	spec     *PluginSpec
+	plugger  *Plugger
+	plugin   Stopper
+	dedup    *dedupFilter
+	throttle *throttleFilter
+	cooldown *cooldownFilter
 }
 
 type ldapInfo struct {
 	Name   string
 	Config ldap.Config
+
+	// IdleTimeout and CacheTTL are the respective Config fields
+	// in seconds, as stored in the database.
+	IdleTimeout int
+	CacheTTL    int
 }
 
-const ldapColumns = "name,url,basedn,binddn,bindpass"
-const ldapPlacers = "?,?,?,?,?"
+const ldapColumns = "name,url,basedn,binddn,bindpass,poolsize,idletimeout,starttls,cacert,cachettl,cachesize"
+const ldapPlacers = "?,?,?,?,?,?,?,?,?,?,?"
 
 func (li *ldapInfo) refs() []interface{} {
-	return []interface{}{&li.Name, &li.Config.URL, &li.Config.BaseDN, &li.Config.BindDN, &li.Config.BindPass}
+	return []interface{}{&li.Name, &li.Config.URL, &li.Config.BaseDN, &li.Config.BindDN, &li.Config.BindPass,
+		&li.Config.PoolSize, &li.IdleTimeout, &li.Config.StartTLS, &li.Config.CACert, &li.CacheTTL, &li.Config.CacheSize}
 }
 
 type ldapState struct {
@@ -133,30 +194,52 @@ type pluginManager struct {
 	tomb     tomb.Tomb
 	config   Config
 	db       *sql.DB
+	stmts    *stmtCache
+	accounts func() []AccountStatus
 	requests chan interface{}
 	incoming chan *Message
 	rollback chan int64
+	tailing  chan struct{}
+	delivery chan *pluginDelivery
 	plugins  map[string]*pluginState
 	ldaps    map[string]*ldapState
 
 	ldapConns      map[string]*ldap.ManagedConn
 	ldapConnsMutex sync.Mutex
+
+	statusMutex sync.Mutex
+	status      map[string]*PluginStatus
+	handledId   int64
+
+	middlewareMutex sync.Mutex
+	middlewares     []*middlewareState
+
+	eventsMutex sync.Mutex
+	events      []*Event
+	eventReady  chan struct{}
 }
 
-func startPluginManager(config Config) (*pluginManager, error) {
+func startPluginManager(config Config, accounts func() []AccountStatus) (*pluginManager, error) {
 	logf("Starting plugins...")
 	m := &pluginManager{
 		config:   config,
+		accounts: accounts,
 		plugins:  make(map[string]*pluginState),
 		ldaps:    make(map[string]*ldapState),
+		status:   make(map[string]*PluginStatus),
 		requests: make(chan interface{}),
 		incoming: make(chan *Message),
 		rollback: make(chan int64),
+		tailing:  make(chan struct{}),
+		delivery: make(chan *pluginDelivery),
+
+		eventReady: make(chan struct{}, 1),
 	}
 	if config.DB == nil {
 		panic("config.DB is NIL")
 	}
 	m.db = config.DB
+	m.stmts = newStmtCache(m.db)
 	m.tomb.Go(m.loop)
 	return m, nil
 }
@@ -164,6 +247,7 @@ func startPluginManager(config Config) (*pluginManager, error) {
 type pluginRequestStop struct{}
 
 func (m *pluginManager) Stop() error {
+	defer m.stmts.close()
 	if !m.tomb.Alive() {
 		return m.tomb.Err()
 	}
@@ -180,6 +264,44 @@ func (m *pluginManager) Stop() error {
 	return nil
 }
 
+// drain waits until the plugins have handled all incoming messages queued
+// so far, or until the deadline is reached.
+func (m *pluginManager) drain(deadline time.Time) {
+	if m.config.Plugins != nil && len(m.config.Plugins) == 0 {
+		return
+	}
+	var targetId int64
+	row := m.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM message WHERE lane=1")
+	if err := row.Scan(&targetId); err != nil {
+		logf("Cannot fetch latest incoming message ID from database: %v", err)
+		return
+	}
+	logf("Waiting for plugins to handle queued incoming messages...")
+	for m.tomb.Alive() && m.handled() < targetId {
+		if time.Now().After(deadline) {
+			logf("Plugins did not handle queued incoming messages in time. Stopping them anyway.")
+			return
+		}
+		time.Sleep(drainDelay)
+	}
+}
+
+// setHandled records that all incoming messages up to id were dispatched to plugins.
+func (m *pluginManager) setHandled(id int64) {
+	m.statusMutex.Lock()
+	if id > m.handledId {
+		m.handledId = id
+	}
+	m.statusMutex.Unlock()
+}
+
+// handled returns the id of the last incoming message dispatched to plugins.
+func (m *pluginManager) handled() int64 {
+	m.statusMutex.Lock()
+	defer m.statusMutex.Unlock()
+	return m.handledId
+}
+
 type pluginRequestRefresh struct {
 	done chan struct{}
 }
@@ -194,11 +316,34 @@ func (m *pluginManager) Refresh() {
 	}
 }
 
+// Status returns the state of all plugins currently handled.
+func (m *pluginManager) Status() []PluginStatus {
+	m.statusMutex.Lock()
+	defer m.statusMutex.Unlock()
+	result := make([]PluginStatus, 0, len(m.status))
+	for _, s := range m.status {
+		result = append(result, *s)
+	}
+	return result
+}
+
+// setStatus runs f with the status of the named plugin, creating it if necessary.
+func (m *pluginManager) setStatus(name string, f func(s *PluginStatus)) {
+	m.statusMutex.Lock()
+	s, ok := m.status[name]
+	if !ok {
+		s = &PluginStatus{Name: name}
+		m.status[name] = s
+	}
+	f(s)
+	m.statusMutex.Unlock()
+}
+
 func (m *pluginManager) die() {
 	var wg sync.WaitGroup
 	wg.Add(len(m.plugins))
 	for _, state := range m.plugins {
-		stop := state.plugin.Stop
+		stop := state.stop
 		go func() {
 			stop()
 			wg.Done()
@@ -240,8 +385,8 @@ func setSchema(tx *sql.Tx, plugin, help string, cmds schema.Commands) error {
 			return fmt.Errorf("cannot add schema for %q plugin, %q command: %v", plugin, cmd.Name, err)
 		}
 		for _, arg := range cmd.Args {
-			_, err := tx.Exec("INSERT INTO argumentschema (plugin,command,argument,hint,type,flag) VALUES (?,?,?,?,?,?)",
-				plugin, cmd.Name, arg.Name, arg.Hint, arg.Type, arg.Flag)
+			_, err := tx.Exec("INSERT INTO argumentschema (plugin,command,argument,hint,type,flag,enumvalues,short,defaultvalue) VALUES (?,?,?,?,?,?,?,?,?)",
+				plugin, cmd.Name, arg.Name, arg.Hint, arg.Type, arg.Flag, strings.Join(arg.Values, " "), arg.Short, arg.Default)
 			if err != nil {
 				return fmt.Errorf("cannot add schema for %q plugin, %q command, %q argument: %v", plugin, cmd.Name, arg.Name, err)
 			}
@@ -250,8 +395,84 @@ func setSchema(tx *sql.Tx, plugin, help string, cmds schema.Commands) error {
 	return nil
 }
 
+// PluginSchema holds the help and the command schemas of a plugin.
+type PluginSchema struct {
+	Plugin   string          `json:"plugin"`
+	Help     string          `json:"help,omitempty"`
+	Commands schema.Commands `json:"commands"`
+}
+
+// CommandSchemas returns the schemas of the visible commands offered by
+// the plugins enabled in the mup servers using db, ordered by plugin name.
+// External interfaces may use these to offer command completion.
+func CommandSchemas(db *sql.DB) ([]PluginSchema, error) {
+	var result []PluginSchema
+	byName := make(map[string]*PluginSchema)
+	rows, err := db.Query("SELECT plugin,help FROM pluginschema ORDER BY plugin")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ps PluginSchema
+		if err := rows.Scan(&ps.Plugin, &ps.Help); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, ps)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range result {
+		byName[result[i].Plugin] = &result[i]
+	}
+
+	rows, err = db.Query("SELECT plugin,command,help FROM commandschema WHERE hide=FALSE ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var plugin string
+		var cmd schema.Command
+		if err := rows.Scan(&plugin, &cmd.Name, &cmd.Help); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if ps, ok := byName[plugin]; ok {
+			ps.Commands = append(ps.Commands, cmd)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT plugin,command,argument,hint,type,flag,enumvalues,short,defaultvalue FROM argumentschema ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var plugin, command, values string
+		var arg schema.Arg
+		if err := rows.Scan(&plugin, &command, &arg.Name, &arg.Hint, &arg.Type, &arg.Flag, &values, &arg.Short, &arg.Default); err != nil {
+			return nil, err
+		}
+		arg.Values = strings.Fields(values)
+		if ps, ok := byName[plugin]; ok {
+			for i := range ps.Commands {
+				if ps.Commands[i].Name == command {
+					ps.Commands[i].Args = append(ps.Commands[i].Args, arg)
+				}
+			}
+		}
+	}
+	return result, rows.Err()
+}
+
 func (m *pluginManager) updateSchema() {
-	tx, err := m.db.Begin()
+	tx, err := beginImmediate(m.db)
 	if err != nil {
 		logf("Cannot begin database transaction: %v", err)
 		return
@@ -275,17 +496,89 @@ func (m *pluginManager) updateSchema() {
 	}
 }
 
+// updateDynamicSchema records the schema of a plugin that only reports its
+// commands once started, under the full plugin name.
+func (m *pluginManager) updateDynamicSchema(name string, spec *PluginSpec) {
+	tx, err := beginImmediate(m.db)
+	if err != nil {
+		logf("Cannot begin database transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	err = setSchema(tx, name, spec.Help, spec.Commands)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logf("Cannot update schema for plugin %q: %v", name, err)
+	}
+}
+
+// updateUnknownCommands records whether the plugin with the named schema
+// handles unknown commands, so the help plugin may stay quiet about them.
+func (m *pluginManager) updateUnknownCommands(name string, unknown bool) {
+	_, err := dbExec(m.db, "UPDATE pluginschema SET unknowncommands=? WHERE plugin=?", unknown, name)
+	if err != nil {
+		logf("Cannot update schema for plugin %q: %v", name, err)
+	}
+}
+
+// refreshDynamicSpecs updates the spec of plugins that reported new help
+// and commands since last checked, as plugin programs do when restarted.
+func (m *pluginManager) refreshDynamicSpecs() {
+	for name, state := range m.plugins {
+		d, ok := state.plugin.(dynamicSpecer)
+		if !ok {
+			continue
+		}
+		if spec := d.dynamicSpec(); spec != state.spec {
+			state.spec = spec
+			m.updateDynamicSchema(name, spec)
+			_, unknown := state.plugin.(UnknownCommandHandler)
+			m.updateUnknownCommands(name, unknown)
+		}
+	}
+}
+
+// commandKnown returns whether any running plugin has a command named
+// cmdName. Messages that aren't commands count as known.
+func (m *pluginManager) commandKnown(cmdName string) bool {
+	if cmdName == "" {
+		return true
+	}
+	for _, state := range m.plugins {
+		if state.spec.Commands.Command(cmdName) != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *pluginManager) loop() error {
 	defer m.die()
 
 	if m.config.Plugins != nil && len(m.config.Plugins) == 0 {
-		<-m.tomb.Dying()
-		return nil
+		// Nothing to run, but Stop and Refresh still wait on requests.
+		for {
+			select {
+			case req := <-m.requests:
+				switch req := req.(type) {
+				case pluginRequestStop:
+					return nil
+				case pluginRequestRefresh:
+					close(req.done)
+				}
+			case <-m.tomb.Dying():
+				return nil
+			}
+		}
 	}
 
 	m.updateSchema()
 
 	m.tomb.Go(m.tail)
+	m.tomb.Go(m.tailDeliveries)
 
 	m.handleRefresh()
 	var refresh <-chan time.Time
@@ -297,23 +590,58 @@ func (m *pluginManager) loop() error {
 	for {
 		select {
 		case msg := <-m.incoming:
-			if msg.Command == cmdPong {
+			if msg.Command == cmdPong || !m.filterIncoming(msg) {
+				m.setHandled(msg.Id)
 				continue
 			}
+			m.refreshDynamicSpecs()
 			cmdName := schema.CommandName(msg.BotText)
+			known := m.commandKnown(cmdName)
+			ignored := m.ignored(msg)
+			if ignored {
+				accountDebugf(msg.Account, "Ignoring message from %s!%s@%s: %s", msg.Nick, msg.User, msg.Host, msg.String())
+			}
 			for name, state := range m.plugins {
-				if state.info.LastId >= msg.Id || state.plugger.Target(msg).Account == "" {
+				if state.info.LastId >= msg.Id {
+					continue
+				}
+				target := state.plugger.Target(msg)
+				if target.Account == "" {
 					continue
 				}
 				state.info.LastId = msg.Id
-				state.handle(msg, cmdName)
-				_, err := m.db.Exec("UPDATE plugin SET lastid=? WHERE name=?", msg.Id, name)
+				switch {
+				case ignored:
+					// Recorded as seen below, but not handled.
+				case state.dedup.duplicate(target, msg):
+					accountDebugf(msg.Account, "Plugin %q ignoring duplicate message: %s", name, msg.String())
+				default:
+					if err := state.safeHandle(msg, cmdName, known, m.config.HandlerTimeout); err != nil {
+						m.restartPlugin(state, err)
+					}
+				}
+				_, err := dbExec(m.db, "UPDATE plugin SET lastid=? WHERE name=?", msg.Id, name)
+				m.setStatus(name, func(s *PluginStatus) {
+					s.LastId = msg.Id
+					if err != nil {
+						s.LastError = err.Error()
+					}
+				})
 				if err != nil {
 					logf("Cannot update plugin with last sent message id: %v", err)
 					// TODO How to recover properly from this?
 					//m.tomb.Kill(err)
 				}
 			}
+			m.setHandled(msg.Id)
+		case d := <-m.delivery:
+			if state, ok := m.plugins[d.plugin]; ok {
+				if err := state.safeDeliver(&d.Delivery, m.config.HandlerTimeout); err != nil {
+					m.restartPlugin(state, err)
+				}
+			}
+		case <-m.eventReady:
+			m.handleEvents()
 		case req := <-m.requests:
 			switch req := req.(type) {
 			case pluginRequestStop:
@@ -333,6 +661,7 @@ func (m *pluginManager) loop() error {
 
 func (m *pluginManager) handleRefresh() {
 	m.refreshLdaps()
+	m.refreshMiddlewares()
 	m.refreshPlugins()
 }
 
@@ -376,6 +705,13 @@ func (m *pluginManager) refreshLdaps() {
 			logf("Cannot parse database LDAP information: %v", err)
 			return
 		}
+		info.Config.BindPass, err = decryptSecret(m.config.SecretKey, info.Config.BindPass)
+		if err != nil {
+			logf("LDAP connection %q has unusable secrets: %v", info.Name, err)
+			continue
+		}
+		info.Config.IdleTimeout = time.Duration(info.IdleTimeout) * time.Second
+		info.Config.CacheTTL = time.Duration(info.CacheTTL) * time.Second
 		infos = append(infos, info)
 	}
 	if rows.Err() != nil {
@@ -445,10 +781,16 @@ func pluginChanged(a, b *pluginInfo) bool {
 }
 
 func (m *pluginManager) pluginOn(name string) bool {
-	if m.config.Plugins == nil {
+	return pluginIn(m.config.Plugins, name)
+}
+
+// pluginIn returns whether the named plugin is handled by a server
+// configured with the provided Config.Plugins value.
+func pluginIn(plugins []string, name string) bool {
+	if plugins == nil {
 		return true
 	}
-	for _, cname := range m.config.Plugins {
+	for _, cname := range plugins {
 		if name == cname || len(name) > len(cname) && name[len(cname)] == '/' && name[:len(cname)] == cname {
 			return true
 		}
@@ -468,6 +810,15 @@ func (m *pluginManager) refreshPlugins() {
 		return
 	}
 
+	var instances []shardInstance
+	if m.config.Sharding && (m.config.Plugins == nil || len(m.config.Plugins) > 0) {
+		instances, err = registerInstance(m.db, m.config, "plugin", m.config.Plugins)
+		if err != nil {
+			logf("Cannot register instance: %v", err)
+			return
+		}
+	}
+
 	tx, err := m.db.Begin()
 	if err != nil {
 		logf("Cannot begin database transaction: %v", err)
@@ -491,6 +842,12 @@ func (m *pluginManager) refreshPlugins() {
 			logf("Cannot parse database plugin information: %v", err)
 			return
 		}
+		config, err := decryptSecret(m.config.SecretKey, string(info.Config))
+		if err != nil {
+			logf("Plugin %q has unusable secrets: %v", info.Name, err)
+			continue
+		}
+		info.Config = []byte(config)
 		infos = append(infos, info)
 	}
 	if rows.Err() != nil {
@@ -518,10 +875,18 @@ func (m *pluginManager) refreshPlugins() {
 		return
 	}
 
+	levels := make(map[string]LogLevel)
 	for i := range infos {
 		info := &infos[i]
 		info.Targets = targets[info.Name]
+
+		level, err := ParseLogLevel(info.LogLevel)
+		if err != nil {
+			logf("Plugin %q has invalid log level: %v", info.Name, err)
+		}
+		levels[info.Name] = level
 	}
+	setLogLevels(nil, levels)
 
 	// Start new plugins, and stop/restart updated ones.
 	var known = len(m.plugins)
@@ -534,26 +899,50 @@ func (m *pluginManager) refreshPlugins() {
 		if !m.pluginOn(info.Name) {
 			continue
 		}
+		if m.config.Sharding && instanceOwner(info.Name, instances, pluginIn) != m.config.Instance {
+			continue
+		}
 		seen[info.Name] = true
 		if state, ok := m.plugins[info.Name]; ok {
 			found++
 			if !pluginChanged(&state.info, info) {
 				continue
 			}
+			if err := m.validatePlugin(info); err != nil {
+				m.rejectPlugin(info.Name, err, true)
+				continue
+			}
+			if m.updatePlugin(state, info) {
+				continue
+			}
 			changed = true
 			logf("Plugin %q config or targets changed. Stopping and restarting it.", info.Name)
-			err := state.plugin.Stop()
+			err := state.stop()
 			if err != nil {
 				logf("Plugin %q stopped with an error: %v", info.Name, err)
 			}
 			delete(m.plugins, info.Name)
+			m.setStatus(info.Name, func(s *PluginStatus) {
+				s.Running = false
+				if err != nil {
+					s.LastError = err.Error()
+				}
+			})
 		} else {
+			if err := m.validatePlugin(info); err != nil {
+				m.rejectPlugin(info.Name, err, false)
+				continue
+			}
 			logf("Plugin %q starting.", info.Name)
 		}
 
 		state, err := m.startPlugin(info)
 		if err != nil {
 			logf("Plugin %q failed to start: %v", info.Name, err)
+			m.setStatus(info.Name, func(s *PluginStatus) {
+				s.Running = false
+				s.LastError = err.Error()
+			})
 			continue
 		}
 
@@ -569,6 +958,10 @@ func (m *pluginManager) refreshPlugins() {
 		}
 
 		m.plugins[info.Name] = state
+		m.setStatus(info.Name, func(s *PluginStatus) {
+			s.Running = true
+			s.LastId = state.info.LastId
+		})
 	}
 
 	// If there are known plugins that were not observed in the current
@@ -580,7 +973,7 @@ func (m *pluginManager) refreshPlugins() {
 				continue
 			}
 			logf("Plugin %q removed. Stopping it.", state.info.Name)
-			err := state.plugin.Stop()
+			err := state.stop()
 			if err != nil {
 				logf("Plugin %q stopped with an error: %v", state.info.Name, err)
 			}
@@ -588,6 +981,14 @@ func (m *pluginManager) refreshPlugins() {
 		}
 	}
 
+	m.statusMutex.Lock()
+	for name := range m.status {
+		if !seen[name] {
+			delete(m.status, name)
+		}
+	}
+	m.statusMutex.Unlock()
+
 	// If the last id observed by a plugin is older than the current
 	// position of the tail iterator, the iterator must be restarted
 	// at a previous position to avoid losing messages, so that plugins
@@ -634,33 +1035,223 @@ func (m *pluginManager) startPlugin(info *pluginInfo) (*pluginState, error) {
 		logf("Plugin is not registered: %s", pluginKey(info.Name))
 		return nil, fmt.Errorf("plugin %q not registered", pluginKey(info.Name))
 	}
-	plugger := newPlugger(info.Name, m.sendMessage, m.handleMessage, m.ldapConn)
-	plugger.setDatabase(m.db)
-	plugger.setConfig(info.Config)
-	plugger.setTargets(info.Targets)
+	plugger := m.newPlugger(info)
 	plugin := spec.Start(plugger)
+	schemaName := spec.Name
+	if d, ok := plugin.(dynamicSpecer); ok {
+		spec = d.dynamicSpec()
+		schemaName = info.Name
+		m.updateDynamicSchema(info.Name, spec)
+	}
+	_, unknown := plugin.(UnknownCommandHandler)
+	m.updateUnknownCommands(schemaName, unknown)
 	state := &pluginState{
-		info:    *info,
-		spec:    spec,
-		plugger: plugger,
-		plugin:  plugin,
+		info:     *info,
+		spec:     spec,
+		plugger:  plugger,
+		plugin:   plugin,
+		dedup:    newDedupFilter(info.Targets),
+		throttle: newThrottleFilter(info.Targets),
+		cooldown: newCooldownFilter(),
 	}
 	return state, nil
 }
 
-func (m *pluginManager) sendMessage(msg *Message) error {
+// coreConfigOptions holds the plugin configuration options that are
+// understood by mup itself, and thus are valid for every plugin.
+var coreConfigOptions = []string{"pastelines", "pasteurl"}
+
+// validatePlugin checks info against the ConfigSchema and Validate
+// fields of the respective plugin specification.
+func (m *pluginManager) validatePlugin(info *pluginInfo) error {
+	spec, ok := registeredPlugins[pluginKey(info.Name)]
+	if !ok {
+		// Reported when starting it.
+		return nil
+	}
+	if spec.ConfigSchema != nil && len(info.Config) > 0 {
+		if err := checkConfigSchema(spec.ConfigSchema, info.Config); err != nil {
+			return err
+		}
+	}
+	if spec.Validate != nil {
+		plugger := m.newPlugger(info)
+		defer plugger.cancel()
+		if err := spec.Validate(plugger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkConfigSchema returns an error if config has options that are
+// not understood by mup nor present in the type of the schema value,
+// or if any of its values cannot be unmarshaled into that type.
+func checkConfigSchema(schema interface{}, config []byte) error {
+	var options map[string]json.RawMessage
+	if err := json.Unmarshal(config, &options); err != nil {
+		return fmt.Errorf("cannot parse config: %v", err)
+	}
+	for name := range options {
+		for _, core := range coreConfigOptions {
+			if strings.EqualFold(name, core) {
+				delete(options, name)
+			}
+		}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("cannot parse config: %v", err)
+	}
+	t := reflect.TypeOf(schema)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(reflect.New(t).Interface()); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	return nil
+}
+
+// rejectPlugin records that the plugin configuration was rejected with err.
+// The problem is only logged the first time it is observed, so that it
+// isn't repeated on every refresh.
+func (m *pluginManager) rejectPlugin(name string, err error, running bool) {
+	var known bool
+	m.setStatus(name, func(s *PluginStatus) {
+		known = s.LastError == err.Error()
+		s.LastError = err.Error()
+	})
+	if known {
+		return
+	}
+	if running {
+		logf("Plugin %q has an invalid configuration: %v. Keeping the running instance.", name, err)
+	} else {
+		logf("Plugin %q has an invalid configuration: %v. Not starting it.", name, err)
+	}
+}
+
+func (m *pluginManager) newPlugger(info *pluginInfo) *Plugger {
+	send := func(ctx context.Context, msg *Message) error { return m.sendMessage(ctx, info.Name, msg) }
+	plugger := newPlugger(info.Name, send, m.handleMessage, m.ldapConn)
+	plugger.setDatabase(m.db, m.stmts)
+	plugger.setHTTPURL(m.config.HTTPURL)
+	plugger.setAccountStatus(m.accounts)
+	plugger.setPublisher(m.publishEvent)
+	plugger.setHTTPClientConfig(m.config.HTTPClient)
+	plugger.setConfig(info.Config)
+	plugger.setTargets(info.Targets)
+	return plugger
+}
+
+// updatePlugin hands the settings in info to the running plugin in state,
+// if it implements ConfigUpdater, and reports whether it took them.
+func (m *pluginManager) updatePlugin(state *pluginState, info *pluginInfo) bool {
+	updater, ok := state.plugin.(ConfigUpdater)
+	if !ok {
+		return false
+	}
+	plugger := m.newPlugger(info)
+
+	// The plugin is still the same, so in-flight work started under
+	// the old plugger context must not be interrupted.
+	plugger.cancel()
+	plugger.ctx, plugger.cancel = state.plugger.ctx, state.plugger.cancel
+
+	// Subscriptions are made by the plugin itself, usually when started.
+	state.plugger.topicsMutex.Lock()
+	plugger.topics = state.plugger.topics
+	state.plugger.topicsMutex.Unlock()
+
+	if err := updater.UpdateConfig(plugger); err != nil {
+		logf("Plugin %q cannot update its config or targets in place: %v", info.Name, err)
+		return false
+	}
+	logf("Plugin %q config or targets changed. Updated it in place.", info.Name)
+
+	lastId := state.info.LastId
+	state.info = *info
+	state.info.LastId = lastId
+	state.plugger = plugger
+	state.dedup = newDedupFilter(info.Targets)
+	state.throttle = newThrottleFilter(info.Targets)
+	if d, ok := state.plugin.(dynamicSpecer); ok {
+		state.spec = d.dynamicSpec()
+		m.updateDynamicSchema(info.Name, state.spec)
+		_, unknown := state.plugin.(UnknownCommandHandler)
+		m.updateUnknownCommands(info.Name, unknown)
+	}
+	return true
+}
+
+// restartPlugin stops the plugin in state after it failed to handle a
+// message, and starts it again with the same settings. The last message id
+// observed is preserved, so the offending message isn't delivered again.
+func (m *pluginManager) restartPlugin(state *pluginState, reason error) {
+	name := state.info.Name
+	logf("Plugin %q is unhealthy: %v. Restarting it.", name, reason)
+	delete(m.plugins, name)
+	m.setStatus(name, func(s *PluginStatus) {
+		s.Running = false
+		s.LastError = reason.Error()
+		s.Restarts++
+	})
+
+	// A hung plugin may never return from Stop, so don't wait on it for
+	// longer than it was allowed to take handling the message.
+	stopped := make(chan error, 1)
+	go func() { stopped <- state.stop() }()
+	var timeout <-chan time.Time
+	if m.config.HandlerTimeout > 0 {
+		timer := time.NewTimer(m.config.HandlerTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			logf("Plugin %q stopped with an error: %v", name, err)
+		}
+	case <-timeout:
+		logf("Plugin %q is taking too long to stop. Starting it again anyway.", name)
+	}
+
+	info := state.info
+	newState, err := m.startPlugin(&info)
+	if err != nil {
+		logf("Plugin %q failed to start: %v", name, err)
+		m.setStatus(name, func(s *PluginStatus) {
+			s.LastError = err.Error()
+		})
+		return
+	}
+	m.plugins[name] = newState
+	m.setStatus(name, func(s *PluginStatus) {
+		s.Running = true
+	})
+}
+
+func (m *pluginManager) sendMessage(ctx context.Context, plugin string, msg *Message) error {
 	if !m.tomb.Alive() {
 		panic("plugin attempted to send message after its Stop method returned")
 	}
-	_, err := m.db.Exec("INSERT INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Outgoing)...)
+	if !m.filterOutgoing(msg) {
+		return nil
+	}
+	// The plugin is recorded so that deliveries are reported back to it.
+	args := append(msg.refs(Outgoing), plugin)
+	_, err := dbExecContext(ctx, m.db, "INSERT INTO message ("+messageColumns+",plugin) VALUES ("+messagePlacers+",?)", args...)
 	return err
 }
 
-func (m *pluginManager) handleMessage(msg *Message) error {
+func (m *pluginManager) handleMessage(ctx context.Context, msg *Message) error {
 	if !m.tomb.Alive() {
 		panic("plugin attempted to enqueue incoming message after its Stop method returned")
 	}
-	_, err := m.db.Exec("INSERT INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
+	_, err := dbExecContext(ctx, m.db, "INSERT INTO message ("+messageColumns+") VALUES ("+messagePlacers+")", msg.refs(Incoming)...)
 	return err
 }
 
@@ -708,6 +1299,8 @@ func (m *pluginManager) tail() error {
 	if err != nil {
 		return err
 	}
+	m.setHandled(lastId)
+	close(m.tailing)
 
 NextTail:
 	for m.tomb.Alive() {
@@ -723,7 +1316,11 @@ NextTail:
 		default:
 		}
 
-		rows, err := m.db.Query("SELECT "+messageColumns+" FROM message WHERE id>? AND lane=1 ORDER BY id", lastId)
+		var rows *sql.Rows
+		stmt, err := m.stmts.prepare("SELECT " + messageColumns + " FROM message WHERE id>? AND lane=1 ORDER BY id")
+		if err == nil {
+			rows, err = stmt.Query(lastId)
+		}
 		if err != nil {
 			logf("Error selecting incoming messages: %v", err)
 		} else {
@@ -733,7 +1330,12 @@ NextTail:
 				if err != nil {
 					logf("Error parsing incoming messages: %v", err)
 				}
-				debugf("[%s] Iterator got incoming message: %s", msg.Account, msg.String())
+				accountDebugf(msg.Account, "Iterator got incoming message: %s", msg.String())
+				if msg.Playback {
+					// Recorded, but not to be handled again.
+					lastId = msg.Id
+					continue
+				}
 			DeliverMsg:
 				select {
 				case m.incoming <- &msg:
@@ -765,11 +1367,128 @@ NextTail:
 	return nil
 }
 
-func (state *pluginState) handle(msg *Message, cmdName string) {
+type pluginDelivery struct {
+	Delivery
+	plugin string
+}
+
+// tailDeliveries hands to the main loop the deliveries recorded for
+// messages sent by plugins since the plugin manager started.
+func (m *pluginManager) tailDeliveries() error {
+	var lastId int64
+	err := m.db.QueryRow("SELECT COALESCE(MAX(id),0) FROM delivery").Scan(&lastId)
+	if err != nil {
+		logf("Cannot fetch latest delivery ID from database: %v", err)
+		return err
+	}
+	for m.tomb.Alive() {
+		var deliveries []*pluginDelivery
+		rows, err := m.db.Query("SELECT "+deliveryColumns+" FROM delivery WHERE id>? ORDER BY id", lastId)
+		if err != nil {
+			logf("Error selecting message deliveries: %v", err)
+		} else {
+			for rows.Next() {
+				var d pluginDelivery
+				err := rows.Scan(&lastId, &d.Id, &d.Nonce, &d.Account, &d.plugin, &d.Status, &d.Error, &d.Time)
+				if err != nil {
+					logf("Error parsing message deliveries: %v", err)
+					continue
+				}
+				deliveries = append(deliveries, &d)
+			}
+			err = rows.Close()
+			if err != nil && m.tomb.Alive() {
+				logf("Error iterating over message deliveries: %v", err)
+			}
+		}
+		for _, d := range deliveries {
+			select {
+			case m.delivery <- d:
+			case <-m.tomb.Dying():
+				return nil
+			}
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-m.tomb.Dying():
+			return nil
+		}
+	}
+	return nil
+}
+
+// stop cancels the plugin context and stops the plugin.
+func (state *pluginState) stop() error {
+	state.plugger.cancel()
+	return state.plugin.Stop()
+}
+
+// safeHandle delivers msg to the plugin, recovering from any panics in its
+// handlers, and giving up on waiting for it after timeout if that's positive.
+// The returned error reports why the plugin failed to handle the message.
+func (state *pluginState) safeHandle(msg *Message, cmdName string, known bool, timeout time.Duration) error {
+	return state.safeRun("message", msg.String(), timeout, func() { state.handle(msg, cmdName, known) })
+}
+
+// safeDeliver is like safeHandle, but reports a message delivery to the plugin.
+func (state *pluginState) safeDeliver(d *Delivery, timeout time.Duration) error {
+	handler, ok := state.plugin.(DeliveryHandler)
+	if !ok {
+		return nil
+	}
+	return state.safeRun("delivery", fmt.Sprintf("%d %s", d.Id, d.Status), timeout, func() { handler.HandleDelivery(d) })
+}
+
+// safeEvent is like safeHandle, but delivers a published event to the plugin.
+func (state *pluginState) safeEvent(ev *Event, timeout time.Duration) error {
+	handler, ok := state.plugin.(EventHandler)
+	if !ok {
+		return nil
+	}
+	return state.safeRun("event", ev.Topic+" from "+ev.Plugin, timeout, func() { handler.HandleEvent(ev) })
+}
+
+func (state *pluginState) safeRun(kind, desc string, timeout time.Duration, f func()) error {
+	if timeout <= 0 {
+		return state.recoverRun(kind, desc, f)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- state.recoverRun(kind, desc, f)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		logf("Plugin %q took more than %v handling %s: %s", state.info.Name, timeout, kind, desc)
+		return fmt.Errorf("timed out handling %s after %v", kind, timeout)
+	}
+}
+
+func (state *pluginState) recoverRun(kind, desc string, f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logf("Plugin %q panicked handling %s: %s\n%v\n%s", state.info.Name, kind, desc, r, debug.Stack())
+			err = fmt.Errorf("panic handling %s: %v", kind, r)
+		}
+	}()
+	f()
+	return nil
+}
+
+// handle delivers msg to the plugin. The known flag reports whether any
+// running plugin has a command named cmdName.
+func (state *pluginState) handle(msg *Message, cmdName string, known bool) {
 	if msg.AsNick == "" {
 		state.handleOutgoing(msg)
 	} else {
-		state.handleCommand(msg, cmdName)
+		if known {
+			state.handleCommand(msg, cmdName)
+		} else {
+			state.handleUnknownCommand(msg, cmdName)
+		}
 		state.handleMessage(msg)
 	}
 }
@@ -798,20 +1517,54 @@ func (state *pluginState) handleCommand(msg *Message, cmdName string) {
 	if cmdSchema == nil {
 		return
 	}
+	if ok, wait, notify := state.throttle.allow(state.plugger.Target(msg), msg); !ok {
+		accountDebugf(msg.Account, "Plugin %q throttling command from %q: %s", state.info.Name, msg.Nick, cmdName)
+		if notify {
+			state.plugger.Sendf(msg, "Easy there. Please wait %s before running more commands.", wait.Round(time.Second))
+		}
+		return
+	}
 	args, err := cmdSchema.Parse(msg.BotText)
 	if err != nil {
 		state.plugger.Sendf(msg, "Oops: %v", err)
 		return
 	}
+	if ok, wait, notify := state.cooldown.allow(cmdSchema, msg); !ok {
+		accountDebugf(msg.Account, "Plugin %q refusing command from %q during cooldown: %s", state.info.Name, msg.Nick, cmdName)
+		if notify {
+			state.plugger.Sendf(msg, "Please wait %s before running %s again.", wait.Round(time.Second), cmdName)
+		}
+		return
+	}
 	cmd := &Command{
 		Message: msg,
 		name:    cmdName,
 		schema:  cmdSchema,
 		args:    marshalRaw(args),
 	}
+	logAt(LogDebug, LogFields{Account: msg.Account, Plugin: state.info.Name, Command: cmdName}, "Running command: %s", cmdName)
 	handler.HandleCommand(cmd)
 }
 
+func (state *pluginState) handleUnknownCommand(msg *Message, cmdName string) {
+	if cmdName == "" {
+		return
+	}
+	handler, ok := state.plugin.(UnknownCommandHandler)
+	if !ok {
+		return
+	}
+	if ok, wait, notify := state.throttle.allow(state.plugger.Target(msg), msg); !ok {
+		accountDebugf(msg.Account, "Plugin %q throttling unknown command from %q: %s", state.info.Name, msg.Nick, cmdName)
+		if notify {
+			state.plugger.Sendf(msg, "Easy there. Please wait %s before running more commands.", wait.Round(time.Second))
+		}
+		return
+	}
+	logAt(LogDebug, LogFields{Account: msg.Account, Plugin: state.info.Name, Command: cmdName}, "Running unknown command: %s", cmdName)
+	handler.HandleUnknownCommand(msg, cmdName)
+}
+
 // DurationString represents a time.Duration that marshals and unmarshals
 // using the standard string representation for that type.
 type DurationString struct {
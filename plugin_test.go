@@ -1,8 +1,10 @@
 package mup_test
 
 import (
+	"bytes"
 	"fmt"
 	"strings"
+	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/mup.v0"
@@ -105,6 +107,74 @@ func (s *PluginSuite) TestPlugin(c *C) {
 	}
 }
 
+func (s *PluginSuite) TestCooldown(c *C) {
+	tester := mup.NewPluginTester("echoCooldown")
+	tester.Start()
+	tester.Sendf("[#chan] mup: echoCooldowncmd A")
+	tester.Sendf("[,raw] :other!~other@host PRIVMSG #chan :mup: echoCooldowncmd B")
+	tester.Sendf("[,raw] :other!~other@host PRIVMSG #chan :mup: echoCooldowncmd B")
+	tester.Sendf("[,raw] :other!~other@host PRIVMSG mup :echoCooldowncmd C")
+	tester.Sendf("echoCooldowncmd D")
+	tester.Sendf("[#other] mup: echoCooldowncmd E")
+	tester.Sendf("[@acct] echoCooldowncmd F")
+	tester.Stop()
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG #chan :nick: [cmd] A",
+		"PRIVMSG #chan :other: Please wait 1h0m0s before running echoCooldowncmd again.",
+		"PRIVMSG other :[cmd] C",
+		"PRIVMSG nick :Please wait 1h0m0s before running echoCooldowncmd again.",
+		"[@acct] PRIVMSG nick :[cmd] F",
+	})
+}
+
+func (s *PluginSuite) TestReplay(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	now := time.Now()
+	execSQL(c, db,
+		`INSERT INTO account (name) VALUES ('one')`,
+		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "[p] "}')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+	)
+	for _, m := range []struct {
+		time          time.Time
+		account, text string
+	}{
+		{now.Add(-3 * time.Hour), "one", "echoAcmd Old"},
+		{now.Add(-time.Hour), "one", "echoAcmd A"},
+		{now.Add(-time.Hour), "two", "echoAcmd B"},
+		{now.Add(-time.Hour), "one", "echoAmsg C"},
+	} {
+		_, err := db.Exec("INSERT INTO message (lane,time,account,nick,user,host,text,bottext,asnick) VALUES (1,?,?,'nick','~user','host',?,?,'mup')",
+			m.time, m.account, m.text, m.text)
+		c.Assert(err, IsNil)
+	}
+
+	var buf bytes.Buffer
+	err = mup.Replay(db, &mup.ReplayOptions{Plugin: "echoA", From: now.Add(-2 * time.Hour)}, &buf)
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Matches, ``+
+		`\S+ \S+ \[one\] :nick!~user@host PRIVMSG mup :echoAcmd A\n`+
+		`\t-> PRIVMSG nick :\[cmd\] \[p\] A\n`+
+		`\S+ \S+ \[one\] :nick!~user@host PRIVMSG mup :echoAmsg C\n`+
+		`\t-> PRIVMSG nick :\[msg\] \[p\] C\n`+
+		`Replayed 2 of 3 messages through plugin "echoA".\n`)
+
+	// Replies were not sent, and the database was left untouched.
+	var n int
+	c.Assert(db.QueryRow("SELECT COUNT(*) FROM message WHERE lane=2").Scan(&n), IsNil)
+	c.Assert(n, Equals, 0)
+	c.Assert(db.QueryRow("SELECT COUNT(*) FROM commandschema").Scan(&n), IsNil)
+	c.Assert(n, Equals, 0)
+
+	err = mup.Replay(db, &mup.ReplayOptions{Plugin: "echoB"}, &buf)
+	c.Assert(err, ErrorMatches, `plugin "echoB" not found in the database`)
+	err = mup.Replay(db, &mup.ReplayOptions{Plugin: "unknown"}, &buf)
+	c.Assert(err, ErrorMatches, `plugin "unknown" not registered`)
+}
+
 func pluginSpec(name string) *mup.PluginSpec {
 	return &mup.PluginSpec{
 		Name:     name,
@@ -128,6 +198,9 @@ func init() {
 	for _, c := range "ABCD" {
 		mup.RegisterPlugin(pluginSpec("echo" + string(c)))
 	}
+	spec := pluginSpec("echoCooldown")
+	spec.Commands[0].Cooldown = time.Hour
+	mup.RegisterPlugin(spec)
 }
 
 type testPlugin struct {
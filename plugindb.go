@@ -0,0 +1,138 @@
+package mup
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// DBMigration changes the database tables of a plugin from one version
+// to the next one. See Plugger.MigrateDB.
+type DBMigration func(tx *sql.Tx) error
+
+// pluginTablePrefix returns the prefix of the names of all tables owned
+// by the named plugin. Labels are dropped, so all instances of a plugin
+// share its tables.
+//
+// Characters other than lowercase letters and digits are escaped as an
+// underscore followed by their hexadecimal byte values, as in "_2d" for
+// "-". Distinct plugins thus have distinct prefixes, and as the escaped
+// name never holds two underscores in a row, no prefix is a prefix of the
+// table names of another plugin.
+func pluginTablePrefix(plugin string) string {
+	key := pluginKey(plugin)
+	var b strings.Builder
+	b.WriteString("plugin_")
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	b.WriteString("__")
+	return b.String()
+}
+
+// Table returns the name under which the plugin should keep the database
+// table called name, as in "plugin_quotes__quote" for a "quote" table of
+// the quotes plugin, or "plugin_my_2dquotes__quote" for the my-quotes
+// one. Tables named this way are owned by the plugin, and are all
+// dropped by WipePluginDB. Tables are shared by all instances of the
+// plugin, so instances that must keep their data apart may use a column
+// holding the plugin name with the label.
+func (p *Plugger) Table(name string) string {
+	return pluginTablePrefix(p.name) + name
+}
+
+// MigrateDB brings the database tables of the plugin up to date by running,
+// in order and within a single transaction, the migrations that were not
+// yet run for it. Plugins should call it when started, with the complete
+// list of migrations they ever had, and only ever append to that list,
+// as the number of migrations run so far is recorded in the database.
+// Migrations should refer to tables via Plugger.Table, as in:
+//
+//	err := plugger.MigrateDB(func(tx *sql.Tx) error {
+//		_, err := tx.Exec("CREATE TABLE " + plugger.Table("quote") + " (...)")
+//		return err
+//	})
+func (p *Plugger) MigrateDB(migrations ...DBMigration) error {
+	if p.db == nil {
+		return fmt.Errorf("cannot migrate plugin tables: no database available")
+	}
+	tx, err := beginImmediate(p.db)
+	if err != nil {
+		return fmt.Errorf("cannot begin database transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	plugin := pluginKey(p.name)
+	var version int
+	err = tx.QueryRow("SELECT version FROM pluginmigration WHERE plugin=?", plugin).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("cannot obtain version of plugin tables: %v", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("plugin tables are at version %d, but only %d migrations are known", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+	for i := version; i < len(migrations); i++ {
+		p.Logf("Migrating plugin tables to version %d.", i+1)
+		if err := migrations[i](tx); err != nil {
+			return fmt.Errorf("cannot migrate plugin tables to version %d: %v", i+1, err)
+		}
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO pluginmigration (plugin,version) VALUES (?,?)", plugin, len(migrations))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot record version of plugin tables: %v", err)
+	}
+	return nil
+}
+
+// WipePluginDB drops all the database tables owned by the named plugin,
+// as named by Plugger.Table, and forgets the migrations run for them, so
+// the plugin starts afresh next time. The plugin should not be running.
+func WipePluginDB(db *sql.DB, plugin string) error {
+	tx, err := beginImmediate(db)
+	if err != nil {
+		return fmt.Errorf("cannot begin database transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	prefix := pluginTablePrefix(plugin)
+	rows, err := tx.Query("SELECT name FROM sqlite_master WHERE type='table' AND substr(name,1,?)=?", len(prefix), prefix)
+	if err != nil {
+		return fmt.Errorf("cannot list plugin tables: %v", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot list plugin tables: %v", err)
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("cannot list plugin tables: %v", err)
+	}
+	for _, name := range tables {
+		if _, err := tx.Exec(`DROP TABLE "` + name + `"`); err != nil {
+			return fmt.Errorf("cannot drop plugin table %s: %v", name, err)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM pluginmigration WHERE plugin=?", pluginKey(plugin))
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot forget plugin table migrations: %v", err)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"strings"
 	"time"
 
 	"gopkg.in/mup.v0"
@@ -50,6 +51,48 @@ var Commands = schema.Commands{{
 		Name: "text",
 		Flag: schema.Required | schema.Trailing,
 	}},
+}, {
+	Name: "ignore",
+	Help: `Ignores all messages from users matching the provided mask.
+
+	The mask is either a nick or a nick!user@host pattern, and may contain
+	the * and ? wildcards. Users are ignored in the current account unless
+	another one is provided, or in all accounts if the account is "*".
+	If a channel is provided, users are only ignored in that channel.
+	`,
+	Args: schema.Args{{
+		Name: "-account",
+	}, {
+		Name: "-channel",
+	}, {
+		Name: "mask",
+		Flag: schema.Required,
+	}, {
+		Name: "reason",
+		Flag: schema.Trailing,
+	}},
+}, {
+	Name: "unignore",
+	Help: "Removes the provided mask from the ignore list.",
+	Args: schema.Args{{
+		Name: "-account",
+	}, {
+		Name: "-channel",
+	}, {
+		Name: "mask",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "ignores",
+	Help: "Lists the masks in the ignore list.",
+}, {
+	Name: "accounts",
+	Help: `Reports the state of the accounts handled by the bot.
+
+	For each account it reports whether it is connected, the nick in use
+	when it differs from the configured one, and how long ago anything
+	was last received from it.
+	`,
 }}
 
 func init() {
@@ -98,6 +141,14 @@ func (p *adminPlugin) HandleCommand(cmd *mup.Command) {
 		p.login(cmd)
 	case "sendraw":
 		p.sendraw(cmd)
+	case "ignore":
+		p.ignore(cmd)
+	case "unignore":
+		p.unignore(cmd)
+	case "ignores":
+		p.ignores(cmd)
+	case "accounts":
+		p.accounts(cmd)
 	default:
 		p.plugger.Sendf(cmd, "I have a bug. Command %q exists and I don't know how to handle it.", cmd.Name())
 	}
@@ -288,3 +339,132 @@ func (p *adminPlugin) sendraw(cmd *mup.Command) {
 	p.plugger.Send(mup.ParseOutgoing(args.Account, args.Text))
 	p.plugger.Sendf(cmd, "Done.")
 }
+
+// ignoreAccount returns the account name to store in the ignore list
+// for the provided -account argument. All accounts are stored as "".
+func ignoreAccount(cmd *mup.Command, account string) string {
+	switch account {
+	case "":
+		return cmd.Account
+	case "*":
+		return ""
+	}
+	return account
+}
+
+func (p *adminPlugin) ignore(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Account, Channel, Mask, Reason string }
+	cmd.Args(&args)
+	account := ignoreAccount(cmd, args.Account)
+	_, err := p.plugger.DB().Exec("INSERT OR REPLACE INTO ignored (account,channel,mask,reason) VALUES (?,?,?,?)",
+		account, args.Channel, args.Mask, args.Reason)
+	if err != nil {
+		p.plugger.Logf("Cannot add mask %q to ignore list: %v", args.Mask, err)
+		p.plugger.Sendf(cmd, "Oops: cannot add mask to ignore list: %v", err)
+		return
+	}
+	p.plugger.Logf("Nick %q at account %s added mask %q to ignore list (account=%q, channel=%q).", cmd.Nick, cmd.Account, args.Mask, account, args.Channel)
+	p.plugger.Sendf(cmd, "Done.")
+}
+
+func (p *adminPlugin) unignore(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	var args struct{ Account, Channel, Mask string }
+	cmd.Args(&args)
+	account := ignoreAccount(cmd, args.Account)
+	result, err := p.plugger.DB().Exec("DELETE FROM ignored WHERE account=? AND channel=? AND mask=?", account, args.Channel, args.Mask)
+	var n int64
+	if err == nil {
+		n, err = result.RowsAffected()
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot remove mask %q from ignore list: %v", args.Mask, err)
+		p.plugger.Sendf(cmd, "Oops: cannot remove mask from ignore list: %v", err)
+		return
+	}
+	if n == 0 {
+		p.plugger.Sendf(cmd, "Mask not found in the ignore list.")
+		return
+	}
+	p.plugger.Sendf(cmd, "Done.")
+}
+
+func (p *adminPlugin) ignores(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	rows, err := p.plugger.DB().Query("SELECT account,channel,mask,reason FROM ignored ORDER BY account,channel,mask")
+	if err != nil {
+		p.plugger.Logf("Cannot list ignore list: %v", err)
+		p.plugger.Sendf(cmd, "Oops: cannot list ignore list: %v", err)
+		return
+	}
+	defer rows.Close()
+	var entries []string
+	for rows.Next() {
+		var account, channel, mask, reason string
+		err = rows.Scan(&account, &channel, &mask, &reason)
+		if err != nil {
+			p.plugger.Logf("Cannot list ignore list: %v", err)
+			p.plugger.Sendf(cmd, "Oops: cannot list ignore list: %v", err)
+			return
+		}
+		if account == "" {
+			account = "*"
+		}
+		entry := mask + " on " + account
+		if channel != "" {
+			entry += " " + channel
+		}
+		if reason != "" {
+			entry += " (" + reason + ")"
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		p.plugger.Sendf(cmd, "The ignore list is empty.")
+		return
+	}
+	p.plugger.Sendf(cmd, "Ignoring: %s", strings.Join(entries, ", "))
+}
+
+func (p *adminPlugin) accounts(cmd *mup.Command) {
+	if !p.checkLogin(cmd, adminUser) {
+		return
+	}
+
+	accounts := p.plugger.AccountStatus()
+	if len(accounts) == 0 {
+		p.plugger.Sendf(cmd, "No accounts are being handled.")
+		return
+	}
+	var entries []string
+	for _, account := range accounts {
+		entry := account.Name + " (" + account.Kind + ")"
+		if !account.Connected {
+			entry += " disconnected"
+		} else if account.Nick != "" {
+			entry += " connected as " + account.Nick
+			if account.ConfigNick != "" && account.Nick != account.ConfigNick {
+				entry += " instead of " + account.ConfigNick
+			}
+		} else {
+			entry += " connected"
+		}
+		if account.LastMessage.IsZero() {
+			entry += ", nothing received yet"
+		} else {
+			entry += ", last received " + time.Since(account.LastMessage).Truncate(time.Second).String() + " ago"
+		}
+		entries = append(entries, entry)
+	}
+	p.plugger.Sendf(cmd, "Accounts: %s.", strings.Join(entries, "; "))
+}
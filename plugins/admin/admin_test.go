@@ -221,6 +221,36 @@ var adminTests = []adminTest{
 		send:  []string{"sendraw -account=other PRIVMSG bar :text"},
 		recv:  []string{"[@other] PRIVMSG bar :text", "PRIVMSG nick :Done."},
 	},
+
+	// Ignore list.
+	{
+		send: []string{"ignore spammer"},
+		recv: []string{"PRIVMSG nick :Must login for that."},
+	}, {
+		login: true,
+		send: []string{
+			"ignores",
+			"ignore spammer Too noisy.",
+			"ignore -account=* -channel=#chan *!*@bad.host",
+			"ignore -account=other bot*",
+			"ignores",
+			"unignore spammer",
+			"unignore spammer",
+			"unignore -account=* -channel=#chan *!*@bad.host",
+			"ignores",
+		},
+		recv: []string{
+			"PRIVMSG nick :The ignore list is empty.",
+			"PRIVMSG nick :Done.",
+			"PRIVMSG nick :Done.",
+			"PRIVMSG nick :Done.",
+			"PRIVMSG nick :Ignoring: *!*@bad.host on * #chan, bot* on other, spammer on test (Too noisy.)",
+			"PRIVMSG nick :Done.",
+			"PRIVMSG nick :Mask not found in the ignore list.",
+			"PRIVMSG nick :Done.",
+			"PRIVMSG nick :Ignoring: bot* on other",
+		},
+	},
 }
 
 // Data for "thesecret"
@@ -294,3 +324,49 @@ func (s *AdminSuite) testAdmin(c *C, test *adminTest) {
 	tester.Stop()
 	c.Assert(tester.RecvAll(), DeepEquals, test.recv)
 }
+
+func (s *AdminSuite) TestAccounts(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO account (name) VALUES ('test')")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO user (account,nick,passwordhash,passwordsalt,admin) VALUES (?,?,?,?,?)",
+		testUser.Account, testUser.Nick, testHash, testSalt, true)
+	c.Assert(err, IsNil)
+
+	tester := mup.NewPluginTester("admin")
+	tester.SetDB(db)
+	tester.SetAccountStatus([]mup.AccountStatus{{
+		Name:        "one",
+		Kind:        "irc",
+		Connected:   true,
+		Nick:        "mup_",
+		ConfigNick:  "mup",
+		LastMessage: time.Now().Add(-90 * time.Second),
+	}, {
+		Name:       "test",
+		Kind:       "telegram",
+		Connected:  true,
+		Nick:       "mup",
+		ConfigNick: "mup",
+	}, {
+		Name: "two",
+		Kind: "irc",
+	}})
+	tester.Start()
+
+	tester.Sendf("accounts")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Must login for that.")
+
+	tester.Sendf("login thesecret")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Okay.")
+
+	tester.Sendf("accounts")
+	tester.Stop()
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG nick :Accounts: one (irc) connected as mup_ instead of mup, last received 1m30s ago; " +
+			"test (telegram) connected as mup, nothing received yet; two (irc) disconnected, nothing received yet.",
+	})
+}
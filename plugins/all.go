@@ -3,16 +3,32 @@ package plugins
 
 import (
 	_ "gopkg.in/mup.v0/plugins/admin"
-	_ "gopkg.in/mup.v0/plugins/aql"
+	_ "gopkg.in/mup.v0/plugins/bridge"
+	_ "gopkg.in/mup.v0/plugins/ciwatch"
+	_ "gopkg.in/mup.v0/plugins/cve"
 	_ "gopkg.in/mup.v0/plugins/echo"
+	_ "gopkg.in/mup.v0/plugins/factoids"
 	_ "gopkg.in/mup.v0/plugins/github"
+	_ "gopkg.in/mup.v0/plugins/gitlab"
 	_ "gopkg.in/mup.v0/plugins/help"
+	_ "gopkg.in/mup.v0/plugins/incident"
 	_ "gopkg.in/mup.v0/plugins/launchpad"
 	_ "gopkg.in/mup.v0/plugins/ldap"
 	_ "gopkg.in/mup.v0/plugins/log"
+	_ "gopkg.in/mup.v0/plugins/logger"
+	_ "gopkg.in/mup.v0/plugins/net"
+	_ "gopkg.in/mup.v0/plugins/notify"
 	_ "gopkg.in/mup.v0/plugins/phonenick"
 	_ "gopkg.in/mup.v0/plugins/playground"
 	_ "gopkg.in/mup.v0/plugins/publishbot"
+	_ "gopkg.in/mup.v0/plugins/releasewatch"
+	_ "gopkg.in/mup.v0/plugins/remind"
+	_ "gopkg.in/mup.v0/plugins/runner"
+	_ "gopkg.in/mup.v0/plugins/script"
+	_ "gopkg.in/mup.v0/plugins/sms"
+	_ "gopkg.in/mup.v0/plugins/snap"
+	_ "gopkg.in/mup.v0/plugins/standup"
+	_ "gopkg.in/mup.v0/plugins/urltitle"
 	_ "gopkg.in/mup.v0/plugins/webhook"
 	_ "gopkg.in/mup.v0/plugins/wolframalpha"
 )
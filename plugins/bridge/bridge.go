@@ -0,0 +1,103 @@
+package bridge
+
+import (
+	"gopkg.in/mup.v0"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "bridge",
+	Help: `Relays messages between all channels the plugin is targeted at.
+
+	Messages observed in any of the plugin targets are sent to all the
+	other targets as "<nick> text", so a channel on one account may be
+	joined with a channel or group on another account. Use plugin labels
+	(bridge/name) to run independent bridges.
+
+	The "joins" setting also relays when people join and leave.
+	`,
+	Start: start,
+}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type bridgePlugin struct {
+	plugger *mup.Plugger
+	config  struct {
+		Joins bool
+	}
+}
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &bridgePlugin{plugger: plugger}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	return p
+}
+
+func (p *bridgePlugin) Stop() error {
+	return nil
+}
+
+func (p *bridgePlugin) HandleMessage(msg *mup.Message) {
+	if msg.Nick == msg.AsNick {
+		// Messages sent by the bot itself are never relayed, which
+		// includes the ones the bridge sent on the other side.
+		return
+	}
+
+	var text string
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		if msg.Text == "" {
+			return
+		}
+		text = "<" + msg.Nick + "> " + msg.Text
+	case "EDITMSG":
+		// The other side cannot edit the message relayed earlier,
+		// so relay the new text instead.
+		if msg.Text == "" {
+			return
+		}
+		text = "* " + msg.Nick + " edited: " + msg.Text
+	case "JOIN", "PART":
+		if !p.config.Joins {
+			return
+		}
+		// The channel joined or left is a parameter rather than the
+		// message channel, so handle it as if sent to the channel.
+		joined := *msg
+		joined.Channel = msg.Param0
+		if joined.Channel == "" {
+			joined.Channel = msg.Text
+		}
+		msg = &joined
+		if msg.Command == "JOIN" {
+			text = "* " + msg.Nick + " joined " + msg.Channel
+		} else {
+			text = "* " + msg.Nick + " left " + msg.Channel
+		}
+	default:
+		return
+	}
+
+	if msg.Channel == "" {
+		return
+	}
+	from := p.plugger.Target(msg)
+	if from.Account == "" {
+		return
+	}
+	for _, target := range p.plugger.Targets() {
+		if target.Address() == from.Address() || target.Channel == "" {
+			continue
+		}
+		err := p.plugger.Send(&mup.Message{Account: target.Account, Channel: target.Channel, Text: text})
+		if err != nil {
+			p.plugger.Logf("Cannot relay message to %s: %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package bridge_test
+
+import (
+	"testing"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/bridge"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&BridgeSuite{})
+
+type BridgeSuite struct{}
+
+type bridgeTest struct {
+	send   []string
+	recv   []string
+	config mup.Map
+}
+
+var bridgeTargets = []mup.Target{
+	{Account: "test", Channel: "#chan"},
+	{Account: "tg", Channel: "#group:-42"},
+	{Account: "other", Channel: "#other"},
+}
+
+var bridgeTests = []bridgeTest{{
+	send: []string{"[#chan] Hello there."},
+	recv: []string{
+		"[@tg] PRIVMSG #group:-42 :<nick> Hello there.",
+		"[@other] PRIVMSG #other :<nick> Hello there.",
+	},
+}, {
+	send: []string{"[#group:-42@tg] mup: help"},
+	recv: []string{
+		"PRIVMSG #chan :<nick> mup: help",
+		"[@other] PRIVMSG #other :<nick> mup: help",
+	},
+}, {
+	// Channels that are not targeted are not relayed.
+	send: []string{"[#unknown] Hello there."},
+}, {
+	// Neither are private messages.
+	send: []string{"Hello there."},
+}, {
+	// Nor messages from the bot itself.
+	send: []string{"[@tg,raw] :mup!~user@host PRIVMSG #group:-42 :<nick> Hello there."},
+}, {
+	// Edits are relayed with the new text, and deletions are not relayed.
+	send: []string{"[@tg,raw] :nick!~user@telegram EDITMSG #group:-42 34 :Hello here.", "[@tg,raw] DELMSG #group:-42 34"},
+	recv: []string{
+		"PRIVMSG #chan :* nick edited: Hello here.",
+		"[@other] PRIVMSG #other :* nick edited: Hello here.",
+	},
+}, {
+	// Joins and parts are only relayed if enabled.
+	send: []string{"[,raw] :nick!~user@host JOIN #chan", "[,raw] :nick!~user@host PART #chan"},
+}, {
+	send:   []string{"[@other,raw] :nick!~user@host JOIN #other", "[@other,raw] :nick!~user@host PART #other"},
+	config: mup.Map{"joins": true},
+	recv: []string{
+		"PRIVMSG #chan :* nick joined #other",
+		"[@tg] PRIVMSG #group:-42 :* nick joined #other",
+		"PRIVMSG #chan :* nick left #other",
+		"[@tg] PRIVMSG #group:-42 :* nick left #other",
+	},
+}}
+
+func (s *BridgeSuite) TestBridge(c *C) {
+	for i, test := range bridgeTests {
+		c.Logf("Testing messages #%d: %v", i, test.send)
+		tester := mup.NewPluginTester("bridge")
+		tester.SetConfig(test.config)
+		tester.SetTargets(bridgeTargets)
+		tester.Start()
+		tester.SendAll(test.send)
+		tester.Stop()
+		c.Assert(tester.RecvAll(), DeepEquals, test.recv)
+	}
+}
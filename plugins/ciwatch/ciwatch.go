@@ -0,0 +1,295 @@
+// Package ciwatch implements plugins announcing pass/fail transitions of
+// builds on continuous integration services.
+//
+// All plugins share the same logic for tracking the state of builds, for
+// filtering branches, and for honoring "<skip notify>" in commit messages.
+// Each supported service is a backend that only knows how to fetch the
+// completed builds of a branch and parse them.
+package ciwatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugins = []mup.PluginSpec{{
+	Name: "ghactionswatch",
+	Help: `Announces pass/fail transitions of GitHub Actions workflow runs.
+
+	The "repos" configuration option holds a list of repositories to watch,
+	each with a "name" in the "<organization>/<repository>" form and an optional
+	"branches" list. When no branches are listed, only the "main" and "master"
+	branches are watched.
+
+	Only transitions are announced: a failing run after a passing one, a
+	passing run after a failing one, and further failures of a run that is
+	already failing. Runs for commits with "<skip notify>" in their message
+	are never announced.
+	` + templatesHelp,
+	Start: startWatch(func() backend { return &ghActionsBackend{} }),
+}, {
+	Name: "travisciwatch",
+	Help: `Announces pass/fail transitions of Travis CI builds.
+
+	The "repos" configuration option holds a list of repositories to watch,
+	each with a "name" in the "<organization>/<repository>" form and an optional
+	"branches" list. When no branches are listed, only the "main" and "master"
+	branches are watched. The "token" option holds the Travis API token.
+
+	Only transitions are announced, and builds for commits with "<skip notify>"
+	in their message are never announced.
+	` + templatesHelp,
+	Start: startWatch(func() backend { return &travisBackend{} }),
+}, {
+	Name: "jenkinswatch",
+	Help: `Announces pass/fail transitions of Jenkins builds.
+
+	The "repos" configuration option holds a list of multibranch pipeline jobs
+	to watch, each with a "name" holding the job path as in "folder/job", and an
+	optional "branches" list. When no branches are listed, only the "main" and
+	"master" branches are watched. The "token" option holds "<user>:<api token>".
+
+	Only transitions are announced, and builds for commits with "<skip notify>"
+	in their message are never announced. Unstable builds count as failures.
+	` + templatesHelp,
+	Start: startWatch(func() backend { return &jenkinsBackend{} }),
+}, {
+	Name: "gitlabciwatch",
+	Help: `Announces pass/fail transitions of GitLab CI pipelines.
+
+	The "repos" configuration option holds a list of projects to watch, each
+	with a "name" in the "<group>/<project>" form and an optional "branches"
+	list. When no branches are listed, only the "main" and "master" branches
+	are watched. The "token" option holds a GitLab access token, and the
+	"endpoint" option may point to a self-hosted GitLab instance.
+
+	Only transitions are announced, and pipelines for commits with
+	"<skip notify>" in their message are never announced.
+	` + templatesHelp,
+	Start: startWatch(func() backend { return &gitlabBackend{} }),
+}}
+
+const templatesHelp = `
+	Announcements may be customized via the "templates" configuration option,
+	mapping the "failed", "failing", and "fixed" events to templates such as
+	"{{.Project}} broke on {{.Branch}}: {{.URL}}". Templates may refer to the
+	build .Id, .Title, .URL, .Project, .Branch, and .State.
+	`
+
+func init() {
+	for i := range Plugins {
+		mup.RegisterPlugin(&Plugins[i])
+	}
+}
+
+// backend fetches builds from a continuous integration service.
+type backend interface {
+	// defaultEndpoint returns the API endpoint used when the plugin
+	// configuration doesn't provide one.
+	defaultEndpoint() string
+
+	// builds returns the latest completed builds for branch in repo, in
+	// any order.
+	builds(p *watchPlugin, repo, branch string) ([]*build, error)
+}
+
+type buildState int
+
+const (
+	buildOther buildState = iota
+	buildPassed
+	buildFailed
+)
+
+// build holds the details of a build as parsed by a backend.
+type build struct {
+	// Id orders builds of the same branch and job chronologically.
+	Id int64
+
+	// Job tells apart independent builds of the same branch, such as
+	// distinct GitHub Actions workflows. Name is its display name.
+	Job  string
+	Name string
+
+	Number  string
+	Branch  string
+	State   buildState
+	URL     string
+	Message string
+}
+
+type watchPlugin struct {
+	tomb    tomb.Tomb
+	plugger *mup.Plugger
+	backend backend
+	config  struct {
+		Token     string
+		Endpoint  string
+		PollDelay mup.DurationString
+		Repos     []struct {
+			Name     string
+			Branches []string
+		}
+
+		// OAuthAccessToken is an obsolete alias for Token.
+		OAuthAccessToken string
+	}
+}
+
+const defaultPollDelay = 3 * time.Minute
+
+var defaultBranches = []string{"main", "master"}
+
+const skipNotify = "<skip notify>"
+
+func startWatch(newBackend func() backend) func(plugger *mup.Plugger) mup.Stopper {
+	return func(plugger *mup.Plugger) mup.Stopper {
+		b := newBackend()
+		p := &watchPlugin{
+			plugger: plugger,
+			backend: b,
+		}
+		err := plugger.UnmarshalConfig(&p.config)
+		if err != nil {
+			plugger.Logf("%v", err)
+		}
+		if p.config.Token == "" {
+			p.config.Token = p.config.OAuthAccessToken
+		}
+		if p.config.Endpoint == "" {
+			p.config.Endpoint = b.defaultEndpoint()
+		}
+		if p.config.PollDelay.Duration == 0 {
+			p.config.PollDelay.Duration = defaultPollDelay
+		}
+		for i := range p.config.Repos {
+			if len(p.config.Repos[i].Branches) == 0 {
+				p.config.Repos[i].Branches = defaultBranches
+			}
+		}
+		p.tomb.Go(p.loop)
+		return p
+	}
+}
+
+func (p *watchPlugin) Stop() error {
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+type buildKey struct {
+	repo   string
+	branch string
+	job    string
+}
+
+func (p *watchPlugin) loop() error {
+	last := make(map[buildKey]*build)
+	first := true
+	for {
+		for _, repo := range p.config.Repos {
+			for _, branch := range repo.Branches {
+				builds, err := p.backend.builds(p, repo.Name, branch)
+				if err != nil {
+					continue
+				}
+				sort.Slice(builds, func(i, j int) bool { return builds[i].Id < builds[j].Id })
+				for _, b := range builds {
+					if b.State == buildOther || b.Branch != "" && b.Branch != branch {
+						continue
+					}
+					if b.Branch == "" {
+						b.Branch = branch
+					}
+					key := buildKey{repo.Name, branch, b.Job}
+					old := last[key]
+					if old != nil && old.Id >= b.Id {
+						continue
+					}
+					last[key] = b
+					if !first && !strings.Contains(b.Message, skipNotify) {
+						p.announce(repo.Name, old, b)
+					}
+				}
+			}
+		}
+		first = false
+
+		select {
+		case <-time.After(p.config.PollDelay.Duration):
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (p *watchPlugin) announce(repo string, old, b *build) {
+	var event, state string
+	switch {
+	case b.State == buildFailed && (old == nil || old.State == buildPassed):
+		event, state = "failed", "failed"
+	case b.State == buildFailed:
+		event, state = "failing", "is still failing"
+	case b.State == buildPassed && old != nil && old.State == buildFailed:
+		event, state = "fixed", "is fixed"
+	default:
+		return
+	}
+	name := repo
+	if b.Name != "" {
+		name += " (" + b.Name + ")"
+	}
+	p.plugger.Announce(&mup.Announcement{
+		Event:   event,
+		Text:    fmt.Sprintf("Build #%s of %s on branch %s %s: %s", b.Number, name, b.Branch, state, b.URL),
+		Id:      b.Number,
+		Title:   name,
+		URL:     b.URL,
+		Project: repo,
+		Branch:  b.Branch,
+		State:   state,
+	})
+}
+
+// request performs a GET request for path under the configured endpoint,
+// with the provided headers, and decodes the JSON response into result.
+func (p *watchPlugin) request(path string, header http.Header, result interface{}) error {
+	url := strings.TrimRight(p.config.Endpoint, "/") + "/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		p.plugger.Logf("Cannot perform CI request: %v", err)
+		return fmt.Errorf("cannot perform CI request: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot perform CI request: %v", err)
+		return fmt.Errorf("cannot perform CI request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		p.plugger.Logf("Cannot read CI response: %v", err)
+		return fmt.Errorf("cannot read CI response: %v", err)
+	}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode CI response: %v\n-----\n%s\n-----", err, body)
+		return fmt.Errorf("cannot decode CI response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+package ciwatch_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/ciwatch"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+type run struct {
+	Id         int64  `json:"id"`
+	Name       string `json:"name"`
+	RunNumber  int    `json:"run_number"`
+	HeadBranch string `json:"head_branch"`
+	Conclusion string `json:"conclusion"`
+	HTMLURL    string `json:"html_url"`
+	WorkflowId int64  `json:"workflow_id"`
+	HeadCommit struct {
+		Message string `json:"message"`
+	} `json:"head_commit"`
+}
+
+func newRun(id int64, conclusion string) run {
+	return run{
+		Id:         id,
+		Name:       "CI",
+		RunNumber:  int(id),
+		HeadBranch: "main",
+		Conclusion: conclusion,
+		HTMLURL:    "https://github.com/org/repo/actions/runs/" + strconv.FormatInt(id, 10),
+		WorkflowId: 1,
+	}
+}
+
+type actionsServer struct {
+	mu       sync.Mutex
+	runs     []run
+	served   int
+	branches []string
+}
+
+func (s *actionsServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.URL.Path != "/repos/org/repo/actions/runs" {
+		panic("got unexpected request for " + req.URL.Path + " in test actionsServer")
+	}
+	s.branches = append(s.branches, req.URL.Query().Get("branch"))
+	if s.served < len(s.runs) {
+		s.served++
+	}
+	var result struct {
+		WorkflowRuns []run `json:"workflow_runs"`
+	}
+	for i := s.served - 1; i >= 0; i-- {
+		result.WorkflowRuns = append(result.WorkflowRuns, s.runs[i])
+	}
+	json.NewEncoder(w).Encode(&result)
+}
+
+func (s *S) TestWatch(c *C) {
+	server := &actionsServer{runs: []run{
+		newRun(1, "success"),
+		newRun(2, "failure"),
+		newRun(3, "cancelled"),
+		newRun(4, "failure"),
+		newRun(5, "success"),
+		newRun(6, "success"),
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("ghactionswatch")
+	tester.SetConfig(mup.Map{
+		"endpoint":  httpServer.URL,
+		"polldelay": "20ms",
+		"repos":     []mup.Map{{"name": "org/repo", "branches": []string{"main"}}},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Build #2 of org/repo (CI) on branch main failed: https://github.com/org/repo/actions/runs/2")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Build #4 of org/repo (CI) on branch main is still failing: https://github.com/org/repo/actions/runs/4")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Build #5 of org/repo (CI) on branch main is fixed: https://github.com/org/repo/actions/runs/5")
+
+	for {
+		server.mu.Lock()
+		served := server.served
+		server.mu.Unlock()
+		if served == len(server.runs) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tester.Stop()
+	c.Assert(tester.RecvAll(), HasLen, 0)
+	c.Assert(server.branches[0], Equals, "main")
+}
+
+func (s *S) TestWatchSkipNotify(c *C) {
+	skipped := newRun(2, "failure")
+	skipped.HeadCommit.Message = "Break things on purpose.\n\n<skip notify>"
+	server := &actionsServer{runs: []run{
+		newRun(1, "success"),
+		skipped,
+		newRun(3, "failure"),
+		newRun(4, "success"),
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("ghactionswatch")
+	tester.SetConfig(mup.Map{
+		"endpoint":  httpServer.URL,
+		"polldelay": "20ms",
+		"repos":     []mup.Map{{"name": "org/repo", "branches": []string{"main"}}},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	// The skipped failure still counts as the previous state.
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Build #3 of org/repo (CI) on branch main is still failing: https://github.com/org/repo/actions/runs/3")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Build #4 of org/repo (CI) on branch main is fixed: https://github.com/org/repo/actions/runs/4")
+	tester.Stop()
+}
+
+func (s *S) TestWatchTemplates(c *C) {
+	server := &actionsServer{runs: []run{
+		newRun(1, "success"),
+		newRun(2, "failure"),
+		newRun(3, "success"),
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("ghactionswatch")
+	tester.SetConfig(mup.Map{
+		"endpoint":  httpServer.URL,
+		"polldelay": "20ms",
+		"repos":     []mup.Map{{"name": "org/repo", "branches": []string{"main"}}},
+		"templates": mup.Map{"failed": "{{.Project}} broke on {{.Branch}}: {{.URL}}"},
+	})
+	tester.SetTargets([]mup.Target{
+		{Account: "test", Channel: "#chan"},
+		{Account: "test", Channel: "#other", Config: `{"templates": {"failed": "[{{.State}}] {{.Title}} #{{.Id}}"}}`},
+	})
+	tester.Start()
+
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :org/repo broke on main: https://github.com/org/repo/actions/runs/2")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #other :[failed] org/repo (CI) #2")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Build #3 of org/repo (CI) on branch main is fixed: https://github.com/org/repo/actions/runs/3")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #other :Build #3 of org/repo (CI) on branch main is fixed: https://github.com/org/repo/actions/runs/3")
+	tester.Stop()
+}
+
+type backendTest struct {
+	plugin string
+	path   string
+	header string
+	value  string
+	config mup.Map
+	build  func(id int, passed bool) string
+	list   func(builds []string) string
+	recv   []string
+}
+
+var backendTests = []backendTest{{
+	plugin: "travisciwatch",
+	path:   "/repo/org%2Frepo/builds",
+	header: "Travis-API-Version",
+	value:  "3",
+	build: func(id int, passed bool) string {
+		state := "failed"
+		if passed {
+			state = "passed"
+		}
+		return fmt.Sprintf(`{"id": %d, "number": "%d", "state": %q, "branch": {"name": "main"}, "commit": {"message": "Commit %d."}}`, id, id, state, id)
+	},
+	list: func(builds []string) string {
+		return `{"builds": [` + strings.Join(builds, ",") + `]}`
+	},
+	recv: []string{
+		"PRIVMSG #chan :Build #2 of org/repo on branch main failed: https://app.travis-ci.com/github/org/repo/builds/2",
+		"PRIVMSG #chan :Build #3 of org/repo on branch main is fixed: https://app.travis-ci.com/github/org/repo/builds/3",
+	},
+}, {
+	plugin: "jenkinswatch",
+	path:   "/job/org/job/repo/job/main/api/json",
+	header: "Authorization",
+	value:  "Basic dXNlcjpzZWNyZXQ=",
+	config: mup.Map{"token": "user:secret"},
+	build: func(id int, passed bool) string {
+		result := "UNSTABLE"
+		if passed {
+			result = "SUCCESS"
+		}
+		return fmt.Sprintf(`{"number": %d, "result": %q, "url": "http://jenkins/job/org/job/repo/job/main/%d/", "changeSets": [{"items": [{"msg": "Commit %d."}]}]}`, id, result, id, id)
+	},
+	list: func(builds []string) string {
+		return `{"builds": [` + strings.Join(builds, ",") + `]}`
+	},
+	recv: []string{
+		"PRIVMSG #chan :Build #2 of org/repo on branch main failed: http://jenkins/job/org/job/repo/job/main/2/",
+		"PRIVMSG #chan :Build #3 of org/repo on branch main is fixed: http://jenkins/job/org/job/repo/job/main/3/",
+	},
+}, {
+	plugin: "gitlabciwatch",
+	path:   "/api/v4/projects/org%2Frepo/pipelines",
+	header: "Private-Token",
+	value:  "secret",
+	config: mup.Map{"token": "secret"},
+	build: func(id int, passed bool) string {
+		status := "failed"
+		if passed {
+			status = "success"
+		}
+		return fmt.Sprintf(`{"id": %d, "iid": %d, "status": %q, "ref": "main", "sha": "sha%d", "web_url": "https://gitlab.com/org/repo/-/pipelines/%d"}`, id+100, id, status, id, id+100)
+	},
+	list: func(builds []string) string {
+		return `[` + strings.Join(builds, ",") + `]`
+	},
+	recv: []string{
+		"PRIVMSG #chan :Build #2 of org/repo on branch main failed: https://gitlab.com/org/repo/-/pipelines/102",
+		"PRIVMSG #chan :Build #3 of org/repo on branch main is fixed: https://gitlab.com/org/repo/-/pipelines/103",
+	},
+}}
+
+type backendServer struct {
+	mu     sync.Mutex
+	test   *backendTest
+	passed []bool
+	served int
+	header string
+}
+
+func (s *backendServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.Contains(req.URL.Path, "/repository/commits/") {
+		fmt.Fprintf(w, `{"message": "Commit of %s."}`, req.URL.Path)
+		return
+	}
+	if req.URL.EscapedPath() != s.test.path {
+		panic("got unexpected request for " + req.URL.EscapedPath() + " in test backendServer")
+	}
+	s.header = req.Header.Get(s.test.header)
+	if s.served < len(s.passed) {
+		s.served++
+	}
+	var builds []string
+	for i := s.served - 1; i >= 0; i-- {
+		builds = append(builds, s.test.build(i+1, s.passed[i]))
+	}
+	w.Write([]byte(s.test.list(builds)))
+}
+
+func (s *S) TestBackends(c *C) {
+	for i := range backendTests {
+		test := &backendTests[i]
+		c.Logf("Testing backend of %s", test.plugin)
+		server := &backendServer{test: test, passed: []bool{true, false, true, true}}
+		httpServer := httptest.NewServer(server)
+
+		config := mup.Map{
+			"endpoint":  httpServer.URL,
+			"polldelay": "20ms",
+			"repos":     []mup.Map{{"name": "org/repo", "branches": []string{"main"}}},
+		}
+		for k, v := range test.config {
+			config[k] = v
+		}
+		tester := mup.NewPluginTester(test.plugin)
+		tester.SetConfig(config)
+		tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+		tester.Start()
+		for _, recv := range test.recv {
+			c.Assert(tester.Recv(), Equals, recv)
+		}
+		tester.Stop()
+		httpServer.Close()
+
+		c.Assert(tester.RecvAll(), HasLen, 0)
+		c.Assert(server.header, Equals, test.value)
+	}
+}
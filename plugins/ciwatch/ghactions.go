@@ -0,0 +1,60 @@
+package ciwatch
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type ghActionsBackend struct{}
+
+func (b *ghActionsBackend) defaultEndpoint() string {
+	return "https://api.github.com/"
+}
+
+type ghWorkflowRun struct {
+	Id         int64
+	Name       string
+	RunNumber  int    `json:"run_number"`
+	HeadBranch string `json:"head_branch"`
+	Conclusion string
+	HTMLURL    string `json:"html_url"`
+	WorkflowId int64  `json:"workflow_id"`
+	HeadCommit struct {
+		Message string
+	} `json:"head_commit"`
+}
+
+func (b *ghActionsBackend) builds(p *watchPlugin, repo, branch string) ([]*build, error) {
+	var result struct {
+		WorkflowRuns []*ghWorkflowRun `json:"workflow_runs"`
+	}
+	header := http.Header{"Accept": {"application/vnd.github+json"}}
+	if p.config.Token != "" {
+		header.Set("Authorization", "token "+p.config.Token)
+	}
+	path := "/repos/" + repo + "/actions/runs?status=completed&per_page=30&branch=" + url.QueryEscape(branch)
+	err := p.request(path, header, &result)
+	if err != nil {
+		return nil, err
+	}
+	builds := make([]*build, len(result.WorkflowRuns))
+	for i, run := range result.WorkflowRuns {
+		builds[i] = &build{
+			Id:      run.Id,
+			Job:     strconv.FormatInt(run.WorkflowId, 10),
+			Name:    run.Name,
+			Number:  strconv.Itoa(run.RunNumber),
+			Branch:  run.HeadBranch,
+			URL:     run.HTMLURL,
+			Message: run.HeadCommit.Message,
+		}
+		switch run.Conclusion {
+		case "success":
+			builds[i].State = buildPassed
+		case "failure", "timed_out", "startup_failure":
+			builds[i].State = buildFailed
+		}
+	}
+	return builds, nil
+}
@@ -0,0 +1,67 @@
+package ciwatch
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type gitlabBackend struct {
+	// messages caches commit messages by sha, as pipelines don't include them.
+	messages map[string]string
+}
+
+func (b *gitlabBackend) defaultEndpoint() string {
+	return "https://gitlab.com/"
+}
+
+type gitlabPipeline struct {
+	Id     int64
+	IId    int64 `json:"iid"`
+	Status string
+	Ref    string
+	WebURL string `json:"web_url"`
+	Sha    string
+}
+
+func (b *gitlabBackend) builds(p *watchPlugin, repo, branch string) ([]*build, error) {
+	var pipelines []*gitlabPipeline
+	header := http.Header{}
+	if p.config.Token != "" {
+		header.Set("Private-Token", p.config.Token)
+	}
+	project := "/api/v4/projects/" + url.PathEscape(repo)
+	err := p.request(project+"/pipelines?scope=finished&per_page=30&ref="+url.QueryEscape(branch), header, &pipelines)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(map[string]string)
+	builds := make([]*build, len(pipelines))
+	for i, pipeline := range pipelines {
+		message, ok := b.messages[pipeline.Sha]
+		if !ok && pipeline.Sha != "" {
+			var commit struct{ Message string }
+			err := p.request(project+"/repository/commits/"+pipeline.Sha, header, &commit)
+			if err != nil {
+				return nil, err
+			}
+			message = commit.Message
+		}
+		messages[pipeline.Sha] = message
+		builds[i] = &build{
+			Id:      pipeline.Id,
+			Number:  strconv.FormatInt(pipeline.IId, 10),
+			Branch:  pipeline.Ref,
+			URL:     pipeline.WebURL,
+			Message: message,
+		}
+		switch pipeline.Status {
+		case "success":
+			builds[i].State = buildPassed
+		case "failed":
+			builds[i].State = buildFailed
+		}
+	}
+	b.messages = messages
+	return builds, nil
+}
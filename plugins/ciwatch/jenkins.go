@@ -0,0 +1,69 @@
+package ciwatch
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type jenkinsBackend struct{}
+
+func (b *jenkinsBackend) defaultEndpoint() string {
+	return "http://localhost:8080/"
+}
+
+type jenkinsBuild struct {
+	Number     int64
+	Result     string
+	URL        string
+	ChangeSets []struct {
+		Items []struct {
+			Msg string
+		}
+	}
+}
+
+const jenkinsTree = "builds[number,result,url,changeSets[items[msg]]]{0,30}"
+
+func (b *jenkinsBackend) builds(p *watchPlugin, repo, branch string) ([]*build, error) {
+	var result struct {
+		Builds []*jenkinsBuild
+	}
+	header := http.Header{}
+	if p.config.Token != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(p.config.Token)))
+	}
+	var path []string
+	for _, name := range strings.Split(repo, "/") {
+		path = append(path, "job", url.PathEscape(name))
+	}
+	path = append(path, "job", url.PathEscape(branch), "api", "json")
+	err := p.request(strings.Join(path, "/")+"?tree="+url.QueryEscape(jenkinsTree), header, &result)
+	if err != nil {
+		return nil, err
+	}
+	builds := make([]*build, len(result.Builds))
+	for i, jb := range result.Builds {
+		var msgs []string
+		for _, cs := range jb.ChangeSets {
+			for _, item := range cs.Items {
+				msgs = append(msgs, item.Msg)
+			}
+		}
+		builds[i] = &build{
+			Id:      jb.Number,
+			Number:  strconv.FormatInt(jb.Number, 10),
+			URL:     jb.URL,
+			Message: strings.Join(msgs, "\n"),
+		}
+		switch jb.Result {
+		case "SUCCESS":
+			builds[i].State = buildPassed
+		case "FAILURE", "UNSTABLE":
+			builds[i].State = buildFailed
+		}
+	}
+	return builds, nil
+}
@@ -0,0 +1,57 @@
+package ciwatch
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type travisBackend struct{}
+
+func (b *travisBackend) defaultEndpoint() string {
+	return "https://api.travis-ci.com/"
+}
+
+type travisBuild struct {
+	Id     int64
+	Number string
+	State  string
+	Branch struct {
+		Name string
+	}
+	Commit struct {
+		Message string
+	}
+}
+
+func (b *travisBackend) builds(p *watchPlugin, repo, branch string) ([]*build, error) {
+	var result struct {
+		Builds []*travisBuild
+	}
+	header := http.Header{"Travis-API-Version": {"3"}}
+	if p.config.Token != "" {
+		header.Set("Authorization", "token "+p.config.Token)
+	}
+	path := "/repo/" + url.QueryEscape(repo) + "/builds?sort_by=id:desc&limit=30&branch.name=" + url.QueryEscape(branch)
+	err := p.request(path, header, &result)
+	if err != nil {
+		return nil, err
+	}
+	builds := make([]*build, len(result.Builds))
+	for i, tb := range result.Builds {
+		builds[i] = &build{
+			Id:      tb.Id,
+			Number:  tb.Number,
+			Branch:  tb.Branch.Name,
+			URL:     "https://app.travis-ci.com/github/" + repo + "/builds/" + strconv.FormatInt(tb.Id, 10),
+			Message: tb.Commit.Message,
+		}
+		switch tb.State {
+		case "passed":
+			builds[i].State = buildPassed
+		case "failed", "errored":
+			builds[i].State = buildFailed
+		}
+	}
+	return builds, nil
+}
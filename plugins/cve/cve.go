@@ -0,0 +1,310 @@
+// Package cve implements a plugin reporting the status of CVEs in the
+// Ubuntu CVE tracker.
+package cve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "cve",
+	Help: `Reports the status of CVEs in the Ubuntu CVE tracker.
+
+	Besides the "cve" command, CVE identifiers mentioned in third-party
+	conversations are also reported when the "overhear" option is set in the
+	plugin or target configuration. The "endpoint" option may point to an
+	alternative tracker serving the same JSON API.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "cve",
+	Help: `Displays the priority and the status per package and release of the provided CVEs.`,
+	Args: schema.Args{{
+		Name: "ids",
+		Flag: schema.Trailing | schema.Required,
+	}},
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type cvePlugin struct {
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	messages chan *cveMessage
+	config   struct {
+		Endpoint         string
+		Overhear         bool
+		JustShownTimeout mup.DurationString
+	}
+
+	overhear map[mup.Address]bool
+
+	justShownList [30]justShownCVE
+	justShownNext int
+}
+
+type justShownCVE struct {
+	id   string
+	addr mup.Address
+	when time.Time
+}
+
+type cveMessage struct {
+	msg *mup.Message
+	ids []string
+}
+
+const (
+	defaultEndpoint         = "https://ubuntu.com/security/cves/"
+	defaultJustShownTimeout = 1 * time.Minute
+)
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &cvePlugin{
+		plugger:  plugger,
+		messages: make(chan *cveMessage, 10),
+		overhear: make(map[mup.Address]bool),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Endpoint == "" {
+		p.config.Endpoint = defaultEndpoint
+	}
+	if p.config.JustShownTimeout.Duration == 0 {
+		p.config.JustShownTimeout.Duration = defaultJustShownTimeout
+	}
+	targets := plugger.Targets()
+	for i := range targets {
+		var tconfig struct{ Overhear bool }
+		target := &targets[i]
+		err := target.UnmarshalConfig(&tconfig)
+		if err != nil {
+			plugger.Logf("%v", err)
+		}
+		if p.config.Overhear || tconfig.Overhear {
+			p.overhear[target.Address()] = true
+		}
+	}
+	p.tomb.Go(p.loop)
+	return p
+}
+
+func (p *cvePlugin) Stop() error {
+	close(p.messages)
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+var cveChat = regexp.MustCompile(`(?i)\bCVE-[0-9]{4}-[0-9]{4,}\b`)
+
+// parseCVEs returns the distinct CVE identifiers in text, in upper case.
+func parseCVEs(text string) []string {
+	var ids []string
+	for _, id := range cveChat.FindAllString(text, -1) {
+		id = strings.ToUpper(id)
+		if !contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *cvePlugin) HandleMessage(msg *mup.Message) {
+	if msg.BotText != "" || !p.overhear[p.plugger.Target(msg).Address()] {
+		return
+	}
+	ids := parseCVEs(msg.Text)
+	if len(ids) == 0 {
+		return
+	}
+	p.handleMessage(&cveMessage{msg, ids}, false)
+}
+
+func (p *cvePlugin) HandleCommand(cmd *mup.Command) {
+	var args struct{ Ids string }
+	cmd.Args(&args)
+	var ids []string
+	for _, arg := range strings.Fields(args.Ids) {
+		found := parseCVEs(arg)
+		if len(found) != 1 {
+			p.plugger.Sendf(cmd, "Oops: cannot parse CVE id from argument: %s", arg)
+			return
+		}
+		if !contains(ids, found[0]) {
+			ids = append(ids, found[0])
+		}
+	}
+	p.handleMessage(&cveMessage{cmd.Message, ids}, true)
+}
+
+func (p *cvePlugin) handleMessage(cmsg *cveMessage, reportError bool) {
+	select {
+	case p.messages <- cmsg:
+	default:
+		p.plugger.Logf("Message queue is full. Dropping message: %s", cmsg.msg.String())
+		if reportError {
+			p.plugger.Sendf(cmsg.msg, "The CVE tracker seems a bit sluggish right now. Please try again soon.")
+		}
+	}
+}
+
+func (p *cvePlugin) loop() error {
+	for {
+		cmsg, ok := <-p.messages
+		if !ok {
+			break
+		}
+		overheard := cmsg.msg.BotText == ""
+		addr := cmsg.msg.Address()
+		for _, id := range cmsg.ids {
+			if overheard && p.justShown(addr, id) {
+				continue
+			}
+			p.showCVE(cmsg.msg, id)
+		}
+	}
+	return nil
+}
+
+func (p *cvePlugin) justShown(addr mup.Address, id string) bool {
+	oldest := time.Now().Add(-p.config.JustShownTimeout.Duration)
+	for _, shown := range p.justShownList {
+		if shown.id == id && shown.when.After(oldest) && shown.addr.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type cveInfo struct {
+	Id       string       `json:"id"`
+	Priority string       `json:"priority"`
+	Packages []cvePackage `json:"packages"`
+}
+
+type cvePackage struct {
+	Name     string      `json:"name"`
+	Statuses []cveStatus `json:"statuses"`
+}
+
+type cveStatus struct {
+	Release string `json:"release_codename"`
+	Status  string `json:"status"`
+}
+
+var errNotFound = fmt.Errorf("CVE not found")
+
+func (p *cvePlugin) showCVE(msg *mup.Message, id string) {
+	var info cveInfo
+	err := p.request(id, &info)
+	if err != nil {
+		if msg.BotText != "" {
+			if err == errNotFound {
+				p.plugger.Sendf(msg, "CVE not found.")
+			} else {
+				p.plugger.Sendf(msg, "Oops: %v", err)
+			}
+		}
+		return
+	}
+	var notes []string
+	if info.Priority != "" {
+		notes = append(notes, "<"+info.Priority+">")
+	}
+	for _, pkg := range info.Packages {
+		if note := pkg.formatStatuses(); note != "" {
+			notes = append(notes, note)
+		}
+	}
+	notes = append(notes, "<https://ubuntu.com/security/"+id+">")
+	if msg.BotText != "" {
+		p.plugger.Sendf(msg, "%s: %s", id, strings.Join(notes, " "))
+		return
+	}
+	p.plugger.SendChannelf(msg, "%s: %s", id, strings.Join(notes, " "))
+	addr := msg.Address()
+	if addr.Channel != "" {
+		addr.Nick = ""
+	}
+	p.justShownList[p.justShownNext] = justShownCVE{id, addr, time.Now()}
+	p.justShownNext = (p.justShownNext + 1) % len(p.justShownList)
+}
+
+// formatStatuses returns the releases of pkg grouped by status, as
+// in "<openssl: released in jammy, noble; needed in focal>". Releases the
+// package does not exist in are left out.
+func (pkg *cvePackage) formatStatuses() string {
+	var order []string
+	releases := make(map[string][]string)
+	for _, s := range pkg.Statuses {
+		if s.Status == "DNE" || s.Release == "" {
+			continue
+		}
+		if _, ok := releases[s.Status]; !ok {
+			order = append(order, s.Status)
+		}
+		releases[s.Status] = append(releases[s.Status], s.Release)
+	}
+	if len(order) == 0 {
+		return ""
+	}
+	parts := make([]string, len(order))
+	for i, status := range order {
+		parts[i] = status + " in " + strings.Join(releases[status], ", ")
+	}
+	return "<" + pkg.Name + ": " + strings.Join(parts, "; ") + ">"
+}
+
+func (p *cvePlugin) request(id string, result interface{}) error {
+	url := strings.TrimRight(p.config.Endpoint, "/") + "/" + id + ".json"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		p.plugger.Logf("Cannot perform CVE tracker request: %v", err)
+		return fmt.Errorf("cannot perform CVE tracker request: %v", err)
+	}
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err == nil && resp.StatusCode == 404 {
+		resp.Body.Close()
+		return errNotFound
+	}
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot perform CVE tracker request: %v", err)
+		return fmt.Errorf("cannot perform CVE tracker request: %v", err)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode CVE tracker response: %v", err)
+		return fmt.Errorf("cannot decode CVE tracker response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package cve_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/cve"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+type cveTest struct {
+	send    []string
+	recv    []string
+	config  mup.Map
+	targets []mup.Target
+	status  int
+}
+
+var cveTests = []cveTest{
+	{
+		send: []string{"cve foo"},
+		recv: []string{"PRIVMSG nick :Oops: cannot parse CVE id from argument: foo"},
+	}, {
+		send: []string{"cve cve-2024-1234"},
+		recv: []string{"PRIVMSG nick :CVE-2024-1234: <medium> <openssl: released in jammy, noble; needed in focal> <curl: not-affected in jammy> <https://ubuntu.com/security/CVE-2024-1234>"},
+	}, {
+		send: []string{"cve CVE-2024-0404"},
+		recv: []string{"PRIVMSG nick :CVE not found."},
+	}, {
+		status: 500,
+		send:   []string{"cve CVE-2024-1234"},
+		recv:   []string{"PRIVMSG nick :Oops: cannot perform CVE tracker request: 500 Internal Server Error"},
+	}, {
+		// Overhearing is disabled by default.
+		send: []string{"[#chan] Is CVE-2024-1234 fixed?"},
+	}, {
+		// Overheard CVEs are reported once within the timeout, and errors are not reported.
+		config:  mup.Map{"overhear": true},
+		targets: []mup.Target{{Account: ""}},
+		send: []string{
+			"[#chan] Is CVE-2024-1234 fixed?",
+			"[#chan] Yes, CVE-2024-1234 was fixed. CVE-2024-0404 too.",
+			"[#chan] mup: cve CVE-2024-1234",
+		},
+		recv: []string{
+			"PRIVMSG #chan :CVE-2024-1234: <medium> <openssl: released in jammy, noble; needed in focal> <curl: not-affected in jammy> <https://ubuntu.com/security/CVE-2024-1234>",
+			"PRIVMSG #chan :nick: CVE-2024-1234: <medium> <openssl: released in jammy, noble; needed in focal> <curl: not-affected in jammy> <https://ubuntu.com/security/CVE-2024-1234>",
+		},
+	}, {
+		// Overhearing may be enabled per target.
+		targets: []mup.Target{
+			{Account: "test", Channel: "#chan", Config: `{"overhear": true}`},
+			{Account: "test", Channel: "#other"},
+		},
+		send: []string{"[#other] CVE-2024-1234", "[#chan] CVE-2024-1234"},
+		recv: []string{"PRIVMSG #chan :CVE-2024-1234: <medium> <openssl: released in jammy, noble; needed in focal> <curl: not-affected in jammy> <https://ubuntu.com/security/CVE-2024-1234>"},
+	},
+}
+
+func (s *S) TestCVE(c *C) {
+	for i, test := range cveTests {
+		c.Logf("Testing message #%d: %s", i, test.send)
+		server := httptest.NewServer(&cveServer{test.status})
+		if test.config == nil {
+			test.config = mup.Map{}
+		}
+		test.config["endpoint"] = server.URL
+		tester := mup.NewPluginTester("cve")
+		tester.SetConfig(test.config)
+		tester.SetTargets(test.targets)
+		tester.Start()
+		tester.SendAll(test.send)
+		tester.Stop()
+		server.Close()
+		c.Assert(tester.RecvAll(), DeepEquals, test.recv)
+	}
+}
+
+type cveServer struct {
+	status int
+}
+
+func (s *cveServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	switch req.URL.Path {
+	case "/CVE-2024-1234.json":
+		w.Write([]byte(strings.TrimSpace(`
+		{
+			"id": "CVE-2024-1234",
+			"priority": "medium",
+			"packages": [{
+				"name": "openssl",
+				"statuses": [
+					{"release_codename": "jammy", "status": "released"},
+					{"release_codename": "noble", "status": "released"},
+					{"release_codename": "focal", "status": "needed"},
+					{"release_codename": "trusty", "status": "DNE"}
+				]
+			}, {
+				"name": "curl",
+				"statuses": [{"release_codename": "jammy", "status": "not-affected"}]
+			}, {
+				"name": "gone",
+				"statuses": [{"release_codename": "jammy", "status": "DNE"}]
+			}]
+		}`)))
+	case "/CVE-2024-0404.json":
+		w.WriteHeader(404)
+	default:
+		panic("got unexpected request for " + req.URL.Path + " in test cveServer")
+	}
+}
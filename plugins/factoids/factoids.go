@@ -0,0 +1,438 @@
+// Package factoids implements a plugin that learns and recalls short
+// pieces of knowledge taught by users.
+package factoids
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "factoids",
+	Help: `Learns and recalls factoids taught by users.
+
+	Factoids are taught by telling the bot "<key> is <value>", and recalled by
+	asking it "what is <key>" or just "<key>?". An existing factoid is replaced
+	by saying "no, <key> is <value>". Keys are matched loosely, so small typos
+	still find the intended factoid. Values starting with "<reply>" are sent
+	verbatim rather than as "<key> is <value>".
+
+	Teaching, aliasing, and forgetting factoids is disabled in targets with the
+	"readonly" option set, or everywhere if the option is set for the plugin.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "forget",
+	Help: "Forgets the factoid with the provided key.",
+	Args: schema.Args{{
+		Name: "key",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}, {
+	Name: "alias",
+	Help: "Makes the alias key recall the same factoid as an existing key.",
+	Args: schema.Args{{
+		Name: "alias",
+		Flag: schema.Required,
+	}, {
+		Name: "key",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}, {
+	Name: "factoidlog",
+	Help: "Shows the most recent changes made to the factoid with the provided key.",
+	Args: schema.Args{{
+		Name: "key",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type factoidsPlugin struct {
+	plugger *mup.Plugger
+	config  struct {
+		ReadOnly bool
+	}
+	readonly map[mup.Address]bool
+}
+
+const (
+	maxKeyLen   = 64
+	maxValueLen = 400
+	maxLogLines = 5
+)
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &factoidsPlugin{
+		plugger:  plugger,
+		readonly: make(map[mup.Address]bool),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	targets := plugger.Targets()
+	for i := range targets {
+		var tconfig struct{ ReadOnly bool }
+		target := &targets[i]
+		err := target.UnmarshalConfig(&tconfig)
+		if err != nil {
+			plugger.Logf("%v", err)
+		}
+		if p.config.ReadOnly || tconfig.ReadOnly {
+			p.readonly[target.Address()] = true
+		}
+	}
+	return p
+}
+
+func (p *factoidsPlugin) Stop() error {
+	return nil
+}
+
+func (p *factoidsPlugin) canChange(msg *mup.Message) bool {
+	if p.config.ReadOnly || p.readonly[p.plugger.Target(msg).Address()] {
+		p.plugger.Sendf(msg, "Sorry, factoids can't be changed here.")
+		return false
+	}
+	return true
+}
+
+var (
+	teachExp = regexp.MustCompile(`(?i)^(no, *)?(.+?) +(?:is|are) +(.+)$`)
+	queryExp = regexp.MustCompile(`(?i)^(?:what|who|where) +(?:is|are) +(.+?)\??$`)
+)
+
+func (p *factoidsPlugin) HandleMessage(msg *mup.Message) {
+	text := strings.TrimSpace(msg.BotText)
+	if text == "" || isCommand(text) {
+		return
+	}
+	if m := queryExp.FindStringSubmatch(text); m != nil {
+		p.recall(msg, m[1], true)
+	} else if m := teachExp.FindStringSubmatch(text); m != nil {
+		p.teach(msg, m[2], m[3], m[1] != "")
+	} else if strings.HasSuffix(text, "?") {
+		p.recall(msg, strings.TrimSuffix(text, "?"), false)
+	}
+}
+
+func isCommand(text string) bool {
+	name := strings.ToLower(strings.Fields(text)[0])
+	for _, cmd := range Commands {
+		if cmd.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *factoidsPlugin) HandleCommand(cmd *mup.Command) {
+	switch cmd.Name() {
+	case "forget":
+		var args struct{ Key string }
+		cmd.Args(&args)
+		p.forget(cmd.Message, args.Key)
+	case "alias":
+		var args struct{ Alias, Key string }
+		cmd.Args(&args)
+		p.alias(cmd.Message, args.Alias, args.Key)
+	case "factoidlog":
+		var args struct{ Key string }
+		cmd.Args(&args)
+		p.showLog(cmd.Message, args.Key)
+	}
+}
+
+// normalizeKey returns the canonical form of key used for lookups, with
+// letters lowercased, spacing collapsed, and trailing punctuation removed.
+func normalizeKey(key string) string {
+	key = strings.ToLower(strings.Join(strings.Fields(key), " "))
+	return strings.TrimRight(key, "?!.,:;")
+}
+
+type factoid struct {
+	key   string
+	value string
+	alias string
+}
+
+func (p *factoidsPlugin) get(key string) (*factoid, error) {
+	f := &factoid{key: key}
+	row := p.plugger.DB().QueryRow("SELECT value,alias FROM factoid WHERE plugin=? AND key=?", p.plugger.Name(), key)
+	err := row.Scan(&f.value, &f.alias)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot query factoid table: %v", err)
+	}
+	return f, nil
+}
+
+// find returns the factoid for key, following aliases and falling back
+// to the closest key when there's no exact match.
+func (p *factoidsPlugin) find(key string) (*factoid, error) {
+	f, err := p.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		closest, err := p.closest(key)
+		if err != nil || closest == "" {
+			return nil, err
+		}
+		if f, err = p.get(closest); err != nil || f == nil {
+			return nil, err
+		}
+	}
+	if f.alias != "" {
+		target, err := p.get(f.alias)
+		if err != nil || target == nil {
+			return nil, err
+		}
+		return target, nil
+	}
+	return f, nil
+}
+
+// closest returns the known key closest to key, if it's close enough
+// to be taken as a typo.
+func (p *factoidsPlugin) closest(key string) (string, error) {
+	rows, err := p.plugger.DB().Query("SELECT key FROM factoid WHERE plugin=? ORDER BY key", p.plugger.Name())
+	if err != nil {
+		return "", fmt.Errorf("cannot query factoid table: %v", err)
+	}
+	defer rows.Close()
+	// Allow one typo for every four characters.
+	best, bestDist := "", len(key)/4+1
+	for rows.Next() {
+		var candidate string
+		if err := rows.Scan(&candidate); err != nil {
+			return "", fmt.Errorf("cannot query factoid table: %v", err)
+		}
+		if d := distance(key, candidate); d < bestDist {
+			best, bestDist = candidate, d
+		}
+	}
+	return best, rows.Err()
+}
+
+// distance returns the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < curr[j] {
+				curr[j] = d
+			}
+			if d := curr[j-1] + 1; d < curr[j] {
+				curr[j] = d
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func (p *factoidsPlugin) recall(msg *mup.Message, key string, explicit bool) {
+	key = normalizeKey(key)
+	if key == "" {
+		return
+	}
+	f, err := p.find(key)
+	if err != nil {
+		p.plugger.Logf("%v", err)
+		p.plugger.Sendf(msg, "Oops: %v", err)
+		return
+	}
+	if f == nil {
+		if explicit {
+			p.plugger.Sendf(msg, "I don't know what %s is.", key)
+		}
+		return
+	}
+	if strings.HasPrefix(f.value, "<reply>") {
+		p.plugger.Sendf(msg, "%s", strings.TrimSpace(strings.TrimPrefix(f.value, "<reply>")))
+	} else {
+		p.plugger.Sendf(msg, "%s is %s", f.key, f.value)
+	}
+}
+
+func (p *factoidsPlugin) teach(msg *mup.Message, key, value string, replace bool) {
+	key = normalizeKey(key)
+	value = strings.TrimSpace(value)
+	if key == "" || value == "" || !p.canChange(msg) {
+		return
+	}
+	if len(key) > maxKeyLen || len(value) > maxValueLen {
+		p.plugger.Sendf(msg, "Sorry, that's too long for me to remember.")
+		return
+	}
+	old, err := p.get(key)
+	if err != nil {
+		p.plugger.Logf("%v", err)
+		p.plugger.Sendf(msg, "Oops: %v", err)
+		return
+	}
+	if old != nil && old.alias != "" {
+		key = old.alias
+		if old, err = p.get(key); err != nil {
+			p.plugger.Logf("%v", err)
+			p.plugger.Sendf(msg, "Oops: %v", err)
+			return
+		}
+	}
+	if old != nil && !replace {
+		if old.value == value {
+			p.plugger.Sendf(msg, "I already know that.")
+		} else {
+			p.plugger.Sendf(msg, "But %s is %s. Say \"no, %s is ...\" to replace it.", key, old.value, key)
+		}
+		return
+	}
+	if err := p.change(msg, "set", &factoid{key: key, value: value}); err != nil {
+		return
+	}
+	p.plugger.Sendf(msg, "Okay.")
+}
+
+func (p *factoidsPlugin) alias(msg *mup.Message, alias, key string) {
+	alias = normalizeKey(alias)
+	key = normalizeKey(key)
+	if !p.canChange(msg) {
+		return
+	}
+	if alias == key || len(alias) > maxKeyLen {
+		p.plugger.Sendf(msg, "Oops: invalid alias.")
+		return
+	}
+	target, err := p.get(key)
+	if err == nil && target == nil {
+		err = fmt.Errorf("I don't know what %s is", key)
+	}
+	if err != nil {
+		p.plugger.Sendf(msg, "Oops: %v.", strings.TrimRight(err.Error(), "."))
+		return
+	}
+	if target.alias != "" {
+		key = target.alias
+	}
+	if err := p.change(msg, "alias", &factoid{key: alias, alias: key}); err != nil {
+		return
+	}
+	p.plugger.Sendf(msg, "Okay.")
+}
+
+func (p *factoidsPlugin) forget(msg *mup.Message, key string) {
+	key = normalizeKey(key)
+	if !p.canChange(msg) {
+		return
+	}
+	f, err := p.get(key)
+	if err == nil && f == nil {
+		p.plugger.Sendf(msg, "I don't know what %s is.", key)
+		return
+	}
+	if err != nil {
+		p.plugger.Sendf(msg, "Oops: %v", err)
+		return
+	}
+	if err := p.change(msg, "forget", &factoid{key: key}); err != nil {
+		return
+	}
+	p.plugger.Sendf(msg, "Okay, I forgot about %s.", key)
+}
+
+// change applies the action to the factoid table, and records it in
+// the factoidlog table.
+func (p *factoidsPlugin) change(msg *mup.Message, action string, f *factoid) (err error) {
+	defer func() {
+		if err != nil {
+			p.plugger.Logf("Cannot change factoid %q: %v", f.key, err)
+			p.plugger.Sendf(msg, "Oops: cannot change factoid: %v", err)
+		}
+	}()
+	tx, err := p.plugger.DB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	name := p.plugger.Name()
+	if action == "forget" {
+		_, err = tx.Exec("DELETE FROM factoid WHERE plugin=? AND (key=? OR alias=?)", name, f.key, f.key)
+	} else {
+		_, err = tx.Exec("INSERT OR REPLACE INTO factoid (plugin,key,value,alias) VALUES (?,?,?,?)", name, f.key, f.value, f.alias)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO factoidlog (plugin,key,action,value,alias,nick,time) VALUES (?,?,?,?,?,?,?)",
+		name, f.key, action, f.value, f.alias, msg.Nick, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *factoidsPlugin) showLog(msg *mup.Message, key string) {
+	key = normalizeKey(key)
+	rows, err := p.plugger.DB().Query("SELECT action,value,alias,nick,time FROM factoidlog WHERE plugin=? AND key=? ORDER BY id DESC LIMIT ?",
+		p.plugger.Name(), key, maxLogLines)
+	if err != nil {
+		p.plugger.Logf("Cannot query factoidlog table: %v", err)
+		p.plugger.Sendf(msg, "Oops: cannot query factoid history: %v", err)
+		return
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var action, value, alias, nick string
+		var when time.Time
+		if err := rows.Scan(&action, &value, &alias, &nick, &when); err != nil {
+			p.plugger.Logf("Cannot parse factoidlog entry: %v", err)
+			p.plugger.Sendf(msg, "Oops: cannot parse factoid history: %v", err)
+			return
+		}
+		line := when.UTC().Format("2006-01-02 15:04") + " " + nick
+		switch action {
+		case "set":
+			line += " set it to: " + value
+		case "alias":
+			line += " made it an alias of " + alias
+		case "forget":
+			line += " forgot it"
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		p.plugger.Sendf(msg, "There's no history for %s.", key)
+		return
+	}
+	for _, line := range lines {
+		p.plugger.Sendf(msg, "%s", line)
+	}
+}
@@ -0,0 +1,140 @@
+package factoids_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/factoids"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct {
+	db *sql.DB
+}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	s.db = db
+}
+
+func (s *S) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+	s.db.Close()
+}
+
+var factoidTests = []struct {
+	send []string
+	recv []string
+}{{
+	send: []string{"what is mup?", "mup?"},
+	recv: []string{"PRIVMSG nick :I don't know what mup is."},
+}, {
+	send: []string{"Mup  is a bot", "what is mup", "MUP?", "[#chan] mup: what is mup?"},
+	recv: []string{
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :mup is a bot",
+		"PRIVMSG nick :mup is a bot",
+		"PRIVMSG #chan :nick: mup is a bot",
+	},
+}, {
+	// Overheard messages are ignored.
+	send: []string{"[#chan] mup is a bot", "[#chan] what is mup?"},
+	recv: []string(nil),
+}, {
+	send: []string{"mup is a bot", "mup is a plugin host", "no, mup is a plugin host", "mup?"},
+	recv: []string{
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :But mup is a bot. Say \"no, mup is ...\" to replace it.",
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :mup is a plugin host",
+	},
+}, {
+	// Fuzzy matching.
+	send: []string{"launchpad is a forge", "what is lanchpad?", "what is lunch?", "launchpd?"},
+	recv: []string{
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :launchpad is a forge",
+		"PRIVMSG nick :I don't know what lunch is.",
+		"PRIVMSG nick :launchpad is a forge",
+	},
+}, {
+	// Aliases and verbatim replies.
+	send: []string{"lp is <reply>See https://launchpad.net", "alias launchpad lp", "what is launchpad?", "no, launchpad is <reply>Gone.", "lp?", "alias foo bar"},
+	recv: []string{
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :See https://launchpad.net",
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :Gone.",
+		"PRIVMSG nick :Oops: I don't know what bar is.",
+	},
+}, {
+	// Forgetting drops aliases as well.
+	send: []string{"lp is a forge", "alias launchpad lp", "forget lp", "lp?", "what is launchpad?", "forget lp"},
+	recv: []string{
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :Okay.",
+		"PRIVMSG nick :Okay, I forgot about lp.",
+		"PRIVMSG nick :I don't know what launchpad is.",
+		"PRIVMSG nick :I don't know what lp is.",
+	},
+}}
+
+func (s *S) TestFactoids(c *C) {
+	for i, test := range factoidTests {
+		c.Logf("Test #%d: %q", i, test.send)
+		s.db.Exec("DELETE FROM factoid")
+		tester := mup.NewPluginTester("factoids")
+		tester.SetDB(s.db)
+		tester.Start()
+		tester.SendAll(test.send)
+		tester.Stop()
+		c.Assert(tester.RecvAll(), DeepEquals, test.recv)
+	}
+}
+
+func (s *S) TestReadOnly(c *C) {
+	tester := mup.NewPluginTester("factoids")
+	tester.SetDB(s.db)
+	tester.SetTargets([]mup.Target{
+		{Account: "test", Channel: "#ro", Config: `{"readonly": true}`},
+		{Account: "test"},
+	})
+	tester.Start()
+	tester.Sendf("[#ro] mup: mup is a bot")
+	tester.Sendf("[#rw] mup: mup is a bot")
+	tester.Sendf("[#ro] mup: forget mup")
+	tester.Sendf("[#ro] mup: mup?")
+	tester.Stop()
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG #ro :nick: Sorry, factoids can't be changed here.",
+		"PRIVMSG #rw :nick: Okay.",
+		"PRIVMSG #ro :nick: Sorry, factoids can't be changed here.",
+		"PRIVMSG #ro :nick: mup is a bot",
+	})
+}
+
+func (s *S) TestHistory(c *C) {
+	tester := mup.NewPluginTester("factoids")
+	tester.SetDB(s.db)
+	tester.Start()
+	tester.SendAll([]string{"mup is a bot", "no, mup is a plugin host", "forget mup", "factoidlog mup", "factoidlog other"})
+	tester.Stop()
+	recv := tester.RecvAll()
+	c.Assert(recv, HasLen, 7)
+	c.Assert(recv[3], Matches, `PRIVMSG nick :[-0-9]{10} [0-9:]{5} nick forgot it`)
+	c.Assert(recv[4], Matches, `PRIVMSG nick :[-0-9]{10} [0-9:]{5} nick set it to: a plugin host`)
+	c.Assert(recv[5], Matches, `PRIVMSG nick :[-0-9]{10} [0-9:]{5} nick set it to: a bot`)
+	c.Assert(recv[6], Equals, "PRIVMSG nick :There's no history for other.")
+}
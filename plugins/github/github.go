@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -27,12 +28,21 @@ var Plugins = []mup.PluginSpec{{
 	bot will also search third-party conversations for text similar to "#123", or "repo#123",
 	or "org/repo#123". The simpler syntax only works if the "project" configuration option is
 	set to "<organization>" or "<organization>/<repository>".
+
+	The "repo" and "ghsearch" commands report details about a repository and the top hits
+	of a code search, respectively. Code search requires the "oauthaccesstoken" option.
 	`,
 	Start:    startIssueData,
 	Commands: BugDataCommands,
 }, {
-	Name:  "ghissuewatch",
-	Help:  "Shows status changes on issues and pull requests for a selected GitHub repository.",
+	Name: "ghissuewatch",
+	Help: `Shows status changes on issues and pull requests for a selected GitHub repository.
+
+	Announcements may be customized via the "templates" configuration option, mapping the
+	"issue-opened", "issue-closed", "pull-opened", and "pull-closed" events to templates
+	such as "{{.Title}} by {{.Author}} <{{.URL}}>". Templates may refer to the issue .Id,
+	.Title, .URL, .Project, .Author, .State, and .Notes holding labels and assignees.
+	`,
 	Start: startIssueWatch,
 }}
 
@@ -48,6 +58,28 @@ var BugDataCommands = schema.Commands{{
 		Name: "issues",
 		Flag: schema.Trailing,
 	}},
+}, {
+	Name: "repo",
+	Help: `Displays details of the provided GitHub repository.
+
+	The repository may be provided as <org>/<repo>, or as just <repo> if the
+	"project" configuration option is set to the organization.
+	`,
+	Args: schema.Args{{
+		Name: "repo",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "ghsearch",
+	Help: `Searches code on GitHub and displays the top hits.
+
+	The query follows the GitHub code search syntax, so qualifiers such as
+	"repo:org/repo" or "language:go" may be used to narrow the results.
+	`,
+	Args: schema.Args{{
+		Name: "query",
+		Flag: schema.Required | schema.Trailing,
+	}},
 }}
 
 func init() {
@@ -56,8 +88,6 @@ func init() {
 	}
 }
 
-var httpClient = http.Client{Timeout: mup.NetworkTimeout}
-
 type pluginMode int
 
 const (
@@ -89,8 +119,15 @@ type ghPlugin struct {
 
 		JustShownTimeout mup.DurationString
 		PollDelay        mup.DurationString
+
+		RateLimitReserve int
 	}
 
+	rateRemaining int
+	rateReset     time.Time
+
+	etags map[string]ghCached
+
 	overhear map[mup.Address]bool
 
 	justShownList [30]justShownIssue
@@ -115,6 +152,7 @@ const (
 	defaultPrefixOldIssue   = "Issue %v closed"
 	defaultPrefixNewPull    = "PR %v opened"
 	defaultPrefixOldPull    = "PR %v closed"
+	defaultRateLimitReserve = 20
 )
 
 func startIssueData(plugger *mup.Plugger) mup.Stopper {
@@ -134,6 +172,7 @@ func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 		plugger:  plugger,
 		messages: make(chan *ghMessage, 10),
 		overhear: make(map[mup.Address]bool),
+		etags:    make(map[string]ghCached),
 		rand:     rand.New(rand.NewSource(time.Now().Unix())),
 	}
 	err := plugger.UnmarshalConfig(&p.config)
@@ -149,6 +188,9 @@ func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 	if p.config.Endpoint == "" {
 		p.config.Endpoint = defaultEndpoint
 	}
+	if p.config.RateLimitReserve == 0 {
+		p.config.RateLimitReserve = defaultRateLimitReserve
+	}
 	if p.config.TrimProject == "" {
 		p.config.TrimProject = p.config.Project
 	}
@@ -216,7 +258,7 @@ func (p *ghPlugin) HandleMessage(msg *mup.Message) {
 
 func (p *ghPlugin) HandleCommand(cmd *mup.Command) {
 	var issues []*ghIssue
-	if p.mode == issueData {
+	if p.mode == issueData && cmd.Name() == "issue" {
 		var args struct{ Issues string }
 		var err error
 		cmd.Args(&args)
@@ -252,6 +294,16 @@ func (p *ghPlugin) loop() error {
 }
 
 func (p *ghPlugin) handle(ghmsg *ghMessage) {
+	if ghmsg.cmd != nil {
+		switch ghmsg.cmd.Name() {
+		case "repo":
+			p.showRepo(ghmsg.cmd)
+			return
+		case "ghsearch":
+			p.showSearch(ghmsg.cmd)
+			return
+		}
+	}
 	if p.mode == issueData {
 		overheard := ghmsg.msg.BotText == ""
 		addr := ghmsg.msg.Address()
@@ -259,7 +311,7 @@ func (p *ghPlugin) handle(ghmsg *ghMessage) {
 			if overheard && p.justShown(addr, issue) {
 				continue
 			}
-			p.showIssue(ghmsg.msg, issue, "")
+			p.showIssue(ghmsg.msg, issue, "", "")
 		}
 	}
 }
@@ -313,7 +365,9 @@ func (issue *ghIssue) isPull() bool {
 	return issue.Pull.HTMLURL != ""
 }
 
-func (p *ghPlugin) showIssue(msg *mup.Message, issue *ghIssue, prefix string) {
+// showIssue reports issue to msg, or announces it as the given event
+// to all targets if msg is nil.
+func (p *ghPlugin) showIssue(msg *mup.Message, issue *ghIssue, prefix, event string) {
 	err := p.request("/repos/"+issue.org+"/"+issue.repo+"/issues/"+strconv.Itoa(issue.Number), &issue)
 	if err != nil {
 		if msg != nil && msg.BotText != "" {
@@ -342,11 +396,23 @@ func (p *ghPlugin) showIssue(msg *mup.Message, issue *ghIssue, prefix string) {
 		prefix = defaultPrefix
 	}
 	issue.Title = strings.TrimRight(issue.Title, ".")
-	format := prefix + ": %s%s <https://github.com/%s/%s/%s/%d>"
-	args := []interface{}{p.issueKey(issue), issue.Title, p.formatNotes(issue), issue.org, issue.repo, what, issue.Number}
+	notes := p.formatNotes(issue)
+	link := fmt.Sprintf("https://github.com/%s/%s/%s/%d", issue.org, issue.repo, what, issue.Number)
+	format := prefix + ": %s%s <%s>"
+	args := []interface{}{p.issueKey(issue), issue.Title, notes, link}
 	switch {
 	case msg == nil:
-		p.plugger.Broadcastf(format, args...)
+		p.plugger.Announce(&mup.Announcement{
+			Event:   event,
+			Text:    fmt.Sprintf(format, args...),
+			Id:      p.issueKey(issue),
+			Title:   issue.Title,
+			URL:     link,
+			Project: issue.org + "/" + issue.repo,
+			Author:  issue.User.Login,
+			State:   issue.State,
+			Notes:   strings.TrimSpace(notes),
+		})
 	case msg.BotText == "":
 		p.plugger.SendChannelf(msg, format, args...)
 		addr := msg.Address()
@@ -389,9 +455,126 @@ func (p *ghPlugin) formatNotes(issue *ghIssue) string {
 	return buf.String()
 }
 
+type ghRepo struct {
+	FullName    string `json:"full_name"`
+	Description string `json:"description"`
+	Language    string `json:"language"`
+	Stars       int    `json:"stargazers_count"`
+	Forks       int    `json:"forks_count"`
+	OpenIssues  int    `json:"open_issues_count"`
+	Fork        bool   `json:"fork"`
+	Archived    bool   `json:"archived"`
+}
+
+var repoArg = regexp.MustCompile(`^(?:([a-zA-Z0-9][-.a-zA-Z0-9]*)/)?([a-zA-Z0-9_][-_.a-zA-Z0-9]*)$`)
+
+func (p *ghPlugin) showRepo(cmd *mup.Command) {
+	var args struct{ Repo string }
+	cmd.Args(&args)
+	match := repoArg.FindStringSubmatch(args.Repo)
+	if match == nil {
+		p.plugger.Sendf(cmd, "Oops: cannot parse repository from argument: %s", args.Repo)
+		return
+	}
+	org, repo, ok := p.repository(match[1], match[2])
+	if !ok {
+		p.plugger.Sendf(cmd, "Oops: argument must be formatted as <org>/<repo>")
+		return
+	}
+	var info ghRepo
+	err := p.request("/repos/"+org+"/"+repo, &info)
+	if err == errNotFound {
+		p.plugger.Sendf(cmd, "Repository not found.")
+		return
+	}
+	if err != nil {
+		p.plugger.Sendf(cmd, "Oops: %v", err)
+		return
+	}
+	if info.FullName == "" {
+		info.FullName = org + "/" + repo
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Repository %s", info.FullName)
+	if info.Description != "" {
+		fmt.Fprintf(&buf, ": %s", strings.TrimRight(info.Description, "."))
+	}
+	if info.Language != "" {
+		fmt.Fprintf(&buf, " <%s>", info.Language)
+	}
+	fmt.Fprintf(&buf, " <%d stars> <%d forks> <%d open issues>", info.Stars, info.Forks, info.OpenIssues)
+	if info.Fork {
+		buf.WriteString(" <Fork>")
+	}
+	if info.Archived {
+		buf.WriteString(" <Archived>")
+	}
+	fmt.Fprintf(&buf, " <https://github.com/%s>", info.FullName)
+	p.plugger.Sendf(cmd, "%s", buf.String())
+}
+
+type ghCodeSearch struct {
+	TotalCount int `json:"total_count"`
+	Items      []struct {
+		Path       string `json:"path"`
+		HTMLURL    string `json:"html_url"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	} `json:"items"`
+}
+
+const searchHits = 3
+
+func (p *ghPlugin) showSearch(cmd *mup.Command) {
+	var args struct{ Query string }
+	cmd.Args(&args)
+	if p.config.OAuthAccessToken == "" {
+		p.plugger.Sendf(cmd, "Oops: GitHub code search requires the oauthaccesstoken option to be set.")
+		return
+	}
+	var result ghCodeSearch
+	err := p.request("/search/code?per_page="+strconv.Itoa(searchHits)+"&q="+url.QueryEscape(args.Query), &result)
+	if err != nil {
+		p.plugger.Sendf(cmd, "Oops: %v", err)
+		return
+	}
+	if len(result.Items) == 0 {
+		p.plugger.Sendf(cmd, "No code found.")
+		return
+	}
+	if len(result.Items) > searchHits {
+		result.Items = result.Items[:searchHits]
+	}
+	for _, item := range result.Items {
+		p.plugger.Sendf(cmd, "%s: %s <%s>", item.Repository.FullName, item.Path, item.HTMLURL)
+	}
+	if result.TotalCount > len(result.Items) {
+		p.plugger.Sendf(cmd, "Showing %d of %d results.", len(result.Items), result.TotalCount)
+	}
+}
+
 var errNotFound = fmt.Errorf("resource not found")
 
+// ghCached holds the last response obtained for a conditional request.
+type ghCached struct {
+	etag string
+	body []byte
+}
+
 func (p *ghPlugin) request(url string, result interface{}) error {
+	return p.doRequest(url, result, false)
+}
+
+// requestCached works like request, but remembers the ETag of the response
+// and sends it along on later requests for the same url. Responses reporting
+// the resource was not modified don't count against the rate limit, and
+// the previously obtained content is used instead.
+func (p *ghPlugin) requestCached(url string, result interface{}) error {
+	return p.doRequest(url, result, true)
+}
+
+func (p *ghPlugin) doRequest(url string, result interface{}, cached bool) error {
 	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
 		endpoint := p.config.Endpoint
 		url = strings.TrimRight(endpoint, "/") + "/" + strings.TrimLeft(url, "/")
@@ -403,6 +586,9 @@ func (p *ghPlugin) request(url string, result interface{}) error {
 			url += "?" + p.config.Options
 		}
 	}
+	if wait := p.rateLimitWait(0); wait > 0 {
+		return fmt.Errorf("GitHub API rate limit exceeded; resets in %v", wait)
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		p.plugger.Logf("Cannot perform GitHub request: %v", err)
@@ -411,11 +597,29 @@ func (p *ghPlugin) request(url string, result interface{}) error {
 	if p.config.OAuthAccessToken != "" {
 		req.Header.Add("Authorization", "token "+p.config.OAuthAccessToken)
 	}
-	resp, err := httpClient.Do(req)
+	entry, hasEntry := p.etags[url]
+	if cached && hasEntry {
+		req.Header.Add("If-None-Match", entry.etag)
+	}
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err == nil {
+		p.updateRateLimit(resp)
+	}
 	if err == nil && resp.StatusCode == 404 {
 		resp.Body.Close()
 		return errNotFound
 	}
+	if err == nil && resp.StatusCode == 304 && cached && hasEntry {
+		resp.Body.Close()
+		return p.decode(url, entry.body, result)
+	}
+	if err == nil && (resp.StatusCode == 403 || resp.StatusCode == 429) {
+		if wait := p.rateLimitWait(0); wait > 0 {
+			resp.Body.Close()
+			p.plugger.Logf("GitHub API rate limit exceeded; resets in %v", wait)
+			return fmt.Errorf("GitHub API rate limit exceeded; resets in %v", wait)
+		}
+	}
 	if err == nil && resp.StatusCode != 200 {
 		err = fmt.Errorf("%s", resp.Status)
 	}
@@ -438,7 +642,18 @@ func (p *ghPlugin) request(url string, result interface{}) error {
 		p.plugger.Logf("Cannot read GitHub response: %v", err)
 		return fmt.Errorf("cannot read GitHub response: %v", err)
 	}
-	err = json.Unmarshal(body, result)
+	if cached {
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			p.etags[url] = ghCached{etag, body}
+		} else {
+			delete(p.etags, url)
+		}
+	}
+	return p.decode(url, body, result)
+}
+
+func (p *ghPlugin) decode(url string, body []byte, result interface{}) error {
+	err := json.Unmarshal(body, result)
 	if err != nil {
 		p.plugger.Logf("Cannot decode GitHub response: %v\n-----\n%s\n-----", err, body)
 		return fmt.Errorf("cannot decode GitHub response: %v", err)
@@ -450,6 +665,42 @@ func (p *ghPlugin) request(url string, result interface{}) error {
 	return nil
 }
 
+// updateRateLimit records the rate limit state reported by GitHub in resp.
+func (p *ghPlugin) updateRateLimit(resp *http.Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if after, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		p.rateRemaining = 0
+		p.rateReset = time.Now().Add(time.Duration(after) * time.Second)
+		return
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+	p.rateRemaining = remaining
+	p.rateReset = time.Unix(reset, 0)
+}
+
+// rateLimitWait returns how long to wait for the rate limit to reset if
+// no more than reserve requests remain before that, or zero otherwise.
+func (p *ghPlugin) rateLimitWait(reserve int) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rateReset.IsZero() || p.rateRemaining > reserve {
+		return 0
+	}
+	wait := p.rateReset.Sub(time.Now())
+	if wait <= 0 {
+		return 0
+	}
+	return wait.Round(time.Second)
+}
+
 func parseOrgRepo(result interface{}) bool {
 	issues, ok := result.(*[]*ghIssue)
 	if !ok {
@@ -567,8 +818,15 @@ func (p *ghPlugin) pollIssues() error {
 	var first = true
 NextPoll:
 	for {
+		// Back off while the quota is nearly exhausted, leaving the
+		// remaining requests for commands.
+		delay := p.config.PollDelay.Duration
+		if wait := p.rateLimitWait(p.config.RateLimitReserve); wait > delay {
+			p.plugger.Logf("GitHub API rate limit nearly exhausted; delaying poll for %v", wait)
+			delay = wait
+		}
 		select {
-		case <-time.After(p.config.PollDelay.Duration):
+		case <-time.After(delay):
 		case <-p.tomb.Dying():
 			return nil
 		}
@@ -576,7 +834,7 @@ NextPoll:
 		var newIssues []*ghIssue
 		for page := 1; page <= 10; page++ {
 			var pageIssues []*ghIssue
-			err := p.request("/repos/"+p.config.Project+"/issues?direction=asc&per_page=100&page="+strconv.Itoa(page), &pageIssues)
+			err := p.requestCached("/repos/"+p.config.Project+"/issues?direction=asc&per_page=100&page="+strconv.Itoa(page), &pageIssues)
 			if err != nil {
 				continue NextPoll
 			}
@@ -621,22 +879,22 @@ NextPoll:
 				continue
 			}
 		}
-		p.showIssues(showOldIssues, p.config.PrefixOldIssue)
-		p.showIssues(showNewIssues, p.config.PrefixNewIssue)
-		p.showIssues(showOldPulls, p.config.PrefixOldPull)
-		p.showIssues(showNewPulls, p.config.PrefixNewPull)
+		p.showIssues(showOldIssues, p.config.PrefixOldIssue, "issue-closed")
+		p.showIssues(showNewIssues, p.config.PrefixNewIssue, "issue-opened")
+		p.showIssues(showOldPulls, p.config.PrefixOldPull, "pull-closed")
+		p.showIssues(showNewPulls, p.config.PrefixNewPull, "pull-opened")
 
 		oldIssues = newIssues
 	}
 	return nil
 }
 
-func (p *ghPlugin) showIssues(issues []*ghIssue, prefix string) {
+func (p *ghPlugin) showIssues(issues []*ghIssue, prefix, event string) {
 	if len(issues) > 3 {
 		p.showIssueList(issues, prefix)
 	} else {
 		for _, issue := range issues {
-			p.showIssue(nil, issue, prefix)
+			p.showIssue(nil, issue, prefix, event)
 		}
 	}
 }
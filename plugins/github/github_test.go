@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,6 +34,7 @@ type ghTest struct {
 	bugsForm url.Values
 	status   int
 	headers  map[string]mup.Map
+	query    string
 }
 
 var lpTests = []ghTest{
@@ -144,6 +146,55 @@ var lpTests = []ghTest{
 			"PRIVMSG #chan :Issue other#2: Title of 2 <Created by joe> <https://github.com/org/other/issues/2>",
 			"PRIVMSG #chan :Issue other/repo#3: Title of 3 <Created by joe> <https://github.com/other/repo/issues/3>",
 		},
+	}, {
+		// Repository details.
+		plugin: "ghissuedata",
+		send:   []string{"repo org/repo", "repo org/old", "repo org/missing"},
+		recv: []string{
+			"PRIVMSG nick :Repository org/repo: Description of org/repo <Go> <42 stars> <7 forks> <3 open issues> <https://github.com/org/repo>",
+			"PRIVMSG nick :Repository org/old: Description of org/old <Go> <42 stars> <7 forks> <3 open issues> <Archived> <https://github.com/org/old>",
+			"PRIVMSG nick :Repository not found.",
+		},
+	}, {
+		// Repository with project configured to org.
+		plugin: "ghissuedata",
+		config: mup.Map{"project": "org"},
+		send:   []string{"repo repo", "repo a/b/c"},
+		recv: []string{
+			"PRIVMSG nick :Repository org/repo: Description of org/repo <Go> <42 stars> <7 forks> <3 open issues> <https://github.com/org/repo>",
+			"PRIVMSG nick :Oops: cannot parse repository from argument: a/b/c",
+		},
+	}, {
+		// Repository name must include the org without a project.
+		plugin: "ghissuedata",
+		send:   []string{"repo repo"},
+		recv:   []string{"PRIVMSG nick :Oops: argument must be formatted as <org>/<repo>"},
+	}, {
+		// Code search.
+		plugin: "ghissuedata",
+		config: mup.Map{"oauthaccesstoken": "secret"},
+		send:   []string{"ghsearch func main language:go"},
+		query:  "func main language:go",
+		recv: []string{
+			"PRIVMSG nick :org/repo: dir/file1.go <https://github.com/org/repo/blob/master/dir/file1.go>",
+			"PRIVMSG nick :org/repo: dir/file2.go <https://github.com/org/repo/blob/master/dir/file2.go>",
+			"PRIVMSG nick :org/repo: dir/file3.go <https://github.com/org/repo/blob/master/dir/file3.go>",
+			"PRIVMSG nick :Showing 3 of 10 results.",
+		},
+		headers: map[string]mup.Map{
+			"/search/code": {"Authorization": "token secret"},
+		},
+	}, {
+		// Code search without results.
+		plugin: "ghissuedata",
+		config: mup.Map{"oauthaccesstoken": "secret"},
+		send:   []string{"ghsearch nothing"},
+		recv:   []string{"PRIVMSG nick :No code found."},
+	}, {
+		// Code search requires authentication.
+		plugin: "ghissuedata",
+		send:   []string{"ghsearch foo"},
+		recv:   []string{"PRIVMSG nick :Oops: GitHub code search requires the oauthaccesstoken option to be set."},
 	},
 }
 
@@ -181,6 +232,9 @@ func (s *S) TestGitHub(c *C) {
 		server.Stop()
 		c.Assert(tester.RecvAll(), DeepEquals, test.recv)
 
+		if test.query != "" {
+			c.Assert(server.searchQuery, Equals, test.query)
+		}
 		if test.bugsForm != nil {
 			c.Assert(server.bugsForm, DeepEquals, test.bugsForm)
 		}
@@ -209,6 +263,8 @@ type ghServer struct {
 
 	mergesResp int
 
+	searchQuery string
+
 	headers map[string]http.Header
 }
 
@@ -235,6 +291,10 @@ func (s *ghServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch {
 	case strings.HasPrefix(req.URL.Path, "/repos/") && strings.Contains(req.URL.Path, "/issues/"):
 		s.serveIssue(w, req)
+	case strings.HasPrefix(req.URL.Path, "/repos/"):
+		s.serveRepo(w, req)
+	case req.URL.Path == "/search/code":
+		s.serveSearch(w, req)
 	default:
 		panic("got unexpected request for " + req.URL.Path + " in test ghServer")
 	}
@@ -277,3 +337,128 @@ func (s *ghServer) serveIssue(w http.ResponseWriter, req *http.Request) {
 	}
 	w.Write([]byte(res))
 }
+
+func (s *ghServer) serveRepo(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/repos/")
+	if name == "org/missing" {
+		w.WriteHeader(404)
+		return
+	}
+	fmt.Fprintf(w, `{
+		"full_name": %q,
+		"description": "Description of %s.",
+		"language": "Go",
+		"stargazers_count": 42,
+		"forks_count": 7,
+		"open_issues_count": 3,
+		"archived": %v
+	}`, name, name, name == "org/old")
+}
+
+func (s *ghServer) serveSearch(w http.ResponseWriter, req *http.Request) {
+	s.searchQuery = req.Form.Get("q")
+	if s.searchQuery == "nothing" {
+		w.Write([]byte(`{"total_count": 0, "items": []}`))
+		return
+	}
+	var items []string
+	for i := 1; i <= 3; i++ {
+		items = append(items, fmt.Sprintf(`{
+			"path": "dir/file%d.go",
+			"html_url": "https://github.com/org/repo/blob/master/dir/file%d.go",
+			"repository": {"full_name": "org/repo"}
+		}`, i, i))
+	}
+	fmt.Fprintf(w, `{"total_count": 10, "items": [%s]}`, strings.Join(items, ","))
+}
+
+type pollServer struct {
+	server    *httptest.Server
+	mu        sync.Mutex
+	requests  int
+	matched   int
+	remaining int
+	reset     time.Time
+}
+
+func (s *pollServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.remaining > 0 {
+		s.remaining--
+	}
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(s.remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(s.reset.Unix(), 10))
+	if s.remaining == 0 && strings.Contains(req.URL.Path, "/issues/") {
+		w.WriteHeader(403)
+		return
+	}
+	if req.Header.Get("If-None-Match") == `"v1"` {
+		s.matched++
+		w.WriteHeader(304)
+		return
+	}
+	w.Header().Set("ETag", `"v1"`)
+	w.Write([]byte(`[{"number": 1, "title": "Title of 1", "repository_url": "https://api.github.com/repos/org/repo", "user": {"login": "joe"}}]`))
+}
+
+func (s *S) TestPollConditional(c *C) {
+	server := &pollServer{remaining: 5000, reset: time.Now().Add(time.Hour)}
+	server.server = httptest.NewServer(server)
+	defer server.server.Close()
+
+	tester := mup.NewPluginTester("ghissuewatch")
+	tester.SetConfig(mup.Map{"endpoint": server.server.URL, "project": "org/repo", "polldelay": "50ms"})
+	tester.Start()
+	time.Sleep(300 * time.Millisecond)
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), HasLen, 0)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c.Assert(server.requests > 2, Equals, true)
+	c.Assert(server.matched, Equals, server.requests-1)
+}
+
+func (s *S) TestPollRateLimit(c *C) {
+	server := &pollServer{remaining: 22, reset: time.Now().Add(time.Hour)}
+	server.server = httptest.NewServer(server)
+	defer server.server.Close()
+
+	tester := mup.NewPluginTester("ghissuewatch")
+	tester.SetConfig(mup.Map{"endpoint": server.server.URL, "project": "org/repo", "polldelay": "50ms"})
+	tester.Start()
+	time.Sleep(300 * time.Millisecond)
+	tester.Stop()
+
+	// Polls stop once only the reserved requests remain.
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c.Assert(server.requests, Equals, 2)
+	c.Assert(tester.RecvAll(), HasLen, 0)
+}
+
+func (s *S) TestRateLimitExceeded(c *C) {
+	server := &pollServer{remaining: 1, reset: time.Now().Add(time.Hour)}
+	server.server = httptest.NewServer(server)
+	defer server.server.Close()
+
+	tester := mup.NewPluginTester("ghissuedata")
+	tester.SetConfig(mup.Map{"endpoint": server.server.URL})
+	tester.Start()
+	tester.Sendf("issue org/repo#1")
+	tester.Sendf("issue org/repo#2")
+	tester.Stop()
+
+	recv := tester.RecvAll()
+	c.Assert(recv, HasLen, 2)
+	for _, msg := range recv {
+		c.Assert(msg, Matches, `PRIVMSG nick :Oops: GitHub API rate limit exceeded; resets in (59m5\ds|1h0m0s)`)
+	}
+
+	// The second command must not hit the server.
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c.Assert(server.requests, Equals, 1)
+}
@@ -0,0 +1,484 @@
+package gitlab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugins = []mup.PluginSpec{{
+	Name: "glissuedata",
+	Help: `Reports metadata about GitLab issues and merge requests via a command or overhearing conversations.
+
+	By default the plugin only provides metadata via the "issue" command. If the "overhear"
+	configuration option is true for the whole plugin or for a specific plugin target, the
+	bot will also search third-party conversations for text similar to "#123", "!42",
+	or "group/project!42". The simpler syntax only works if the "project" configuration
+	option is set to "<group>/<project>".
+
+	The "endpoint" configuration option may point to a self-hosted GitLab instance,
+	and defaults to https://gitlab.com/.
+	`,
+	Start:    startIssueData,
+	Commands: IssueDataCommands,
+}, {
+	Name:  "glmrwatch",
+	Help:  "Shows merge requests opened and closed on a selected GitLab project.",
+	Start: startMRWatch,
+}}
+
+var IssueDataCommands = schema.Commands{{
+	Name: "issue",
+	Help: `Displays details of the provided GitLab issues and merge requests.
+
+	Issues are referenced as "#123" and merge requests as "!42", optionally
+	prefixed by the project path as in "group/project!42". The plugin it is
+	part of (glissuedata) can also overhear third-party conversations for such
+	references and report the ones mentioned.
+	`,
+	Args: schema.Args{{
+		Name: "issues",
+		Flag: schema.Trailing,
+	}},
+}}
+
+func init() {
+	for i := range Plugins {
+		mup.RegisterPlugin(&Plugins[i])
+	}
+}
+
+type pluginMode int
+
+const (
+	issueData pluginMode = iota + 1
+	mrWatch
+)
+
+type glPlugin struct {
+	mode pluginMode
+
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	messages chan *glMessage
+	config   struct {
+		Endpoint     string
+		PrivateToken string
+
+		Project     string
+		Overhear    bool
+		TrimProject string
+
+		PrefixNewMR string
+		PrefixOldMR string
+
+		JustShownTimeout mup.DurationString
+		PollDelay        mup.DurationString
+	}
+
+	overhear map[mup.Address]bool
+
+	justShownList [30]justShownIssue
+	justShownNext int
+}
+
+type justShownIssue struct {
+	ref  glRef
+	addr mup.Address
+	when time.Time
+}
+
+const (
+	defaultEndpoint         = "https://gitlab.com/"
+	defaultPollDelay        = 3 * time.Minute
+	defaultJustShownTimeout = 1 * time.Minute
+	defaultPrefixNewMR      = "MR %v opened"
+	defaultPrefixOldMR      = "MR %v closed"
+)
+
+func startIssueData(plugger *mup.Plugger) mup.Stopper {
+	return startPlugin(issueData, plugger)
+}
+
+func startMRWatch(plugger *mup.Plugger) mup.Stopper {
+	return startPlugin(mrWatch, plugger)
+}
+
+func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
+	p := &glPlugin{
+		mode:     mode,
+		plugger:  plugger,
+		messages: make(chan *glMessage, 10),
+		overhear: make(map[mup.Address]bool),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Endpoint == "" {
+		p.config.Endpoint = defaultEndpoint
+	}
+	if p.config.PollDelay.Duration == 0 {
+		p.config.PollDelay.Duration = defaultPollDelay
+	}
+	if p.config.JustShownTimeout.Duration == 0 {
+		p.config.JustShownTimeout.Duration = defaultJustShownTimeout
+	}
+	if p.config.TrimProject == "" {
+		p.config.TrimProject = p.config.Project
+	}
+	if p.config.PrefixNewMR == "" {
+		p.config.PrefixNewMR = defaultPrefixNewMR
+	}
+	if p.config.PrefixOldMR == "" {
+		p.config.PrefixOldMR = defaultPrefixOldMR
+	}
+	if p.mode == issueData {
+		targets := plugger.Targets()
+		for i := range targets {
+			var tconfig struct{ Overhear bool }
+			target := &targets[i]
+			err := target.UnmarshalConfig(&tconfig)
+			if err != nil {
+				plugger.Logf("%v", err)
+			}
+			if p.config.Overhear || tconfig.Overhear {
+				p.overhear[target.Address()] = true
+			}
+		}
+	}
+	switch p.mode {
+	case issueData:
+		p.tomb.Go(p.loop)
+	case mrWatch:
+		p.tomb.Go(p.pollMRs)
+	default:
+		panic("internal error: unknown gitlab plugin mode")
+	}
+	return p
+}
+
+func (p *glPlugin) Stop() error {
+	close(p.messages)
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+type glMessage struct {
+	msg  *mup.Message
+	refs []glRef
+}
+
+// glRef references an issue ('#') or a merge request ('!') in a project.
+type glRef struct {
+	project string
+	kind    byte
+	iid     int
+}
+
+func (p *glPlugin) HandleMessage(msg *mup.Message) {
+	if p.mode != issueData || msg.BotText != "" || !p.overhear[p.plugger.Target(msg).Address()] {
+		return
+	}
+	refs := p.parseChat(msg.Text)
+	if len(refs) == 0 {
+		return
+	}
+	p.handleMessage(&glMessage{msg, refs}, false)
+}
+
+func (p *glPlugin) HandleCommand(cmd *mup.Command) {
+	if p.mode != issueData {
+		return
+	}
+	var args struct{ Issues string }
+	cmd.Args(&args)
+	refs, err := p.parseArgs(args.Issues)
+	if err != nil {
+		p.plugger.Sendf(cmd, "Oops: %v", err)
+		return
+	}
+	p.handleMessage(&glMessage{cmd.Message, refs}, true)
+}
+
+func (p *glPlugin) handleMessage(glmsg *glMessage, reportError bool) {
+	select {
+	case p.messages <- glmsg:
+	default:
+		p.plugger.Logf("Message queue is full. Dropping message: %s", glmsg.msg.String())
+		if reportError {
+			p.plugger.Sendf(glmsg.msg, "The GitLab server seems a bit sluggish right now. Please try again soon.")
+		}
+	}
+}
+
+func (p *glPlugin) loop() error {
+	for glmsg := range p.messages {
+		overheard := glmsg.msg.BotText == ""
+		addr := glmsg.msg.Address()
+		for _, ref := range glmsg.refs {
+			if overheard && p.justShown(addr, ref) {
+				continue
+			}
+			p.show(glmsg.msg, ref, "")
+		}
+	}
+	return nil
+}
+
+func (p *glPlugin) justShown(addr mup.Address, ref glRef) bool {
+	oldest := time.Now().Add(-p.config.JustShownTimeout.Duration)
+	for _, shown := range p.justShownList {
+		if shown.ref == ref && shown.when.After(oldest) && shown.addr.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type glIssue struct {
+	IID      int      `json:"iid"`
+	Title    string   `json:"title"`
+	State    string   `json:"state"`
+	Labels   []string `json:"labels"`
+	WebURL   string   `json:"web_url"`
+	Author   glUser   `json:"author"`
+	ClosedBy *glUser  `json:"closed_by"`
+	MergedBy *glUser  `json:"merged_by"`
+}
+
+type glUser struct {
+	Username string `json:"username"`
+}
+
+func (ref glRef) path() string {
+	what := "issues"
+	if ref.kind == '!' {
+		what = "merge_requests"
+	}
+	return "/api/v4/projects/" + url.PathEscape(ref.project) + "/" + what + "/" + strconv.Itoa(ref.iid)
+}
+
+func (p *glPlugin) show(msg *mup.Message, ref glRef, prefix string) {
+	var issue glIssue
+	err := p.request(ref.path(), &issue)
+	if err != nil {
+		if msg != nil && msg.BotText != "" {
+			if err == errNotFound {
+				p.plugger.Sendf(msg, "Issue not found.")
+			} else {
+				p.plugger.Sendf(msg, "Oops: %v", err)
+			}
+		}
+		return
+	}
+	defaultPrefix := "Issue %v"
+	if ref.kind == '!' {
+		defaultPrefix = "MR %v"
+	}
+	if !strings.Contains(prefix, "%v") || strings.Count(prefix, "%") > 1 {
+		prefix = defaultPrefix
+	}
+	title := strings.TrimRight(issue.Title, ".")
+	format := prefix + ": %s%s <%s>"
+	args := []interface{}{p.refKey(ref), title, formatNotes(&issue), issue.WebURL}
+	switch {
+	case msg == nil:
+		p.plugger.Broadcastf(format, args...)
+	case msg.BotText == "":
+		p.plugger.SendChannelf(msg, format, args...)
+		addr := msg.Address()
+		if addr.Channel != "" {
+			addr.Nick = ""
+		}
+		p.justShownList[p.justShownNext] = justShownIssue{ref, addr, time.Now()}
+		p.justShownNext = (p.justShownNext + 1) % len(p.justShownList)
+	default:
+		p.plugger.Sendf(msg, format, args...)
+	}
+}
+
+func (p *glPlugin) refKey(ref glRef) string {
+	if ref.project == p.config.TrimProject {
+		return fmt.Sprintf("%c%d", ref.kind, ref.iid)
+	}
+	return fmt.Sprintf("%s%c%d", ref.project, ref.kind, ref.iid)
+}
+
+func formatNotes(issue *glIssue) string {
+	var buf bytes.Buffer
+	buf.Grow(256)
+	for _, label := range issue.Labels {
+		buf.WriteString(" <")
+		buf.WriteString(label)
+		buf.WriteString(">")
+	}
+	fmt.Fprintf(&buf, " <Created by %s>", issue.Author.Username)
+	switch {
+	case issue.State == "merged" && issue.MergedBy != nil:
+		fmt.Fprintf(&buf, " <Merged by %s>", issue.MergedBy.Username)
+	case issue.State == "closed" && issue.ClosedBy != nil:
+		fmt.Fprintf(&buf, " <Closed by %s>", issue.ClosedBy.Username)
+	}
+	return buf.String()
+}
+
+var errNotFound = fmt.Errorf("resource not found")
+
+func (p *glPlugin) request(path string, result interface{}) error {
+	url := strings.TrimRight(p.config.Endpoint, "/") + "/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		p.plugger.Logf("Cannot perform GitLab request: %v", err)
+		return fmt.Errorf("cannot perform GitLab request: %v", err)
+	}
+	if p.config.PrivateToken != "" {
+		req.Header.Add("PRIVATE-TOKEN", p.config.PrivateToken)
+	}
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err == nil && resp.StatusCode == 404 {
+		resp.Body.Close()
+		return errNotFound
+	}
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot perform GitLab request: %v", err)
+		return fmt.Errorf("cannot perform GitLab request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		p.plugger.Logf("Cannot read GitLab response: %v", err)
+		return fmt.Errorf("cannot read GitLab response: %v", err)
+	}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode GitLab response: %v\n-----\n%s\n-----", err, body)
+		return fmt.Errorf("cannot decode GitLab response: %v", err)
+	}
+	return nil
+}
+
+const projectExp = `[a-zA-Z0-9][-a-zA-Z0-9_.]*(?:/[a-zA-Z0-9][-a-zA-Z0-9_.]*)+`
+
+var refChat = regexp.MustCompile(`(?:^|[\s(])(` + projectExp + `)?([#!])([0-9]+)\b`)
+var refArg = regexp.MustCompile(`^(` + projectExp + `)?([#!])([0-9]+)$`)
+
+func (p *glPlugin) parseChat(text string) []glRef {
+	var refs []glRef
+	for _, match := range refChat.FindAllStringSubmatch(text, -1) {
+		project := match[1]
+		if project == "" {
+			project = p.config.Project
+		}
+		if project == "" {
+			continue
+		}
+		iid, err := strconv.Atoi(match[3])
+		if err != nil {
+			panic("issue number not an int, which must never happen (regexp is broken)")
+		}
+		refs = appendRef(refs, glRef{project, match[2][0], iid})
+	}
+	return refs
+}
+
+func (p *glPlugin) parseArgs(text string) ([]glRef, error) {
+	var refs []glRef
+	for _, s := range strings.Fields(text) {
+		match := refArg.FindStringSubmatch(s)
+		if match == nil {
+			return nil, fmt.Errorf("cannot parse issue or merge request from argument: %s", s)
+		}
+		project := match[1]
+		if project == "" {
+			project = p.config.Project
+		}
+		if project == "" {
+			return nil, fmt.Errorf("argument must be formatted as <group>/<project>%s%s", match[2], match[3])
+		}
+		iid, err := strconv.Atoi(match[3])
+		if err != nil {
+			panic("issue number not an int, which must never happen (regexp is broken)")
+		}
+		refs = appendRef(refs, glRef{project, match[2][0], iid})
+	}
+	return refs, nil
+}
+
+func appendRef(refs []glRef, ref glRef) []glRef {
+	for _, r := range refs {
+		if r == ref {
+			return refs
+		}
+	}
+	return append(refs, ref)
+}
+
+func (p *glPlugin) pollMRs() error {
+	var oldMRs []*glIssue
+	var first = true
+	path := "/api/v4/projects/" + url.PathEscape(p.config.Project) + "/merge_requests?state=opened&order_by=created_at&sort=asc&per_page=100&page="
+NextPoll:
+	for {
+		select {
+		case <-time.After(p.config.PollDelay.Duration):
+		case <-p.tomb.Dying():
+			return nil
+		}
+
+		var newMRs []*glIssue
+		for page := 1; page <= 10; page++ {
+			var pageMRs []*glIssue
+			err := p.request(path+strconv.Itoa(page), &pageMRs)
+			if err != nil {
+				continue NextPoll
+			}
+			// Cut out potential dups due to in-between activity.
+			for len(newMRs) > 0 && len(pageMRs) > 0 && newMRs[len(newMRs)-1].IID >= pageMRs[0].IID {
+				newMRs = newMRs[:len(newMRs)-1]
+			}
+			newMRs = append(newMRs, pageMRs...)
+			if len(pageMRs) < 100 {
+				break
+			}
+		}
+
+		if first {
+			first = false
+			oldMRs = newMRs
+			continue
+		}
+
+		var o, n int
+		for o < len(oldMRs) || n < len(newMRs) {
+			switch {
+			case o == len(oldMRs) || n < len(newMRs) && newMRs[n].IID < oldMRs[o].IID:
+				p.show(nil, glRef{p.config.Project, '!', newMRs[n].IID}, p.config.PrefixNewMR)
+				n++
+			case n == len(newMRs) || o < len(oldMRs) && oldMRs[o].IID < newMRs[n].IID:
+				p.show(nil, glRef{p.config.Project, '!', oldMRs[o].IID}, p.config.PrefixOldMR)
+				o++
+			default:
+				o++
+				n++
+			}
+		}
+		oldMRs = newMRs
+	}
+	return nil
+}
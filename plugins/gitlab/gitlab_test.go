@@ -0,0 +1,245 @@
+package gitlab_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/gitlab"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+type glTest struct {
+	plugin  string
+	send    []string
+	recv    []string
+	config  mup.Map
+	targets []mup.Target
+	status  int
+	mrs     [][]int
+}
+
+var glTests = []glTest{
+	{
+		// Arguments must be references.
+		plugin: "glissuedata",
+		send:   []string{"issue foo"},
+		recv:   []string{"PRIVMSG nick :Oops: cannot parse issue or merge request from argument: foo"},
+	}, {
+		// Project is required without a default.
+		plugin: "glissuedata",
+		send:   []string{"issue !42"},
+		recv:   []string{"PRIVMSG nick :Oops: argument must be formatted as <group>/<project>!42"},
+	}, {
+		// The issue command reports errors.
+		plugin: "glissuedata",
+		status: 500,
+		send:   []string{"issue group/proj#123"},
+		recv:   []string{"PRIVMSG nick :Oops: cannot perform GitLab request: 500 Internal Server Error"},
+	}, {
+		// Not found.
+		plugin: "glissuedata",
+		send:   []string{"issue group/proj#404"},
+		recv:   []string{"PRIVMSG nick :Issue not found."},
+	}, {
+		// Issues and merge requests.
+		plugin: "glissuedata",
+		send:   []string{"issue group/proj#123 group/sub/proj!42"},
+		recv: []string{
+			"PRIVMSG nick :Issue group/proj#123: Title of 123 <bug> <Created by joe> <https://gitlab.example.com/group/proj/-/issues/123>",
+			"PRIVMSG nick :MR group/sub/proj!42: Title of 42 <Created by joe> <Merged by ann> <https://gitlab.example.com/group/sub/proj/-/merge_requests/42>",
+		},
+	}, {
+		// Default project is trimmed.
+		plugin: "glissuedata",
+		config: mup.Map{"project": "group/proj"},
+		send:   []string{"issue #123 !42"},
+		recv: []string{
+			"PRIVMSG nick :Issue #123: Title of 123 <bug> <Created by joe> <https://gitlab.example.com/group/proj/-/issues/123>",
+			"PRIVMSG nick :MR !42: Title of 42 <Created by joe> <Merged by ann> <https://gitlab.example.com/group/proj/-/merge_requests/42>",
+		},
+	}, {
+		// Overhearing is disabled by default.
+		plugin:  "glissuedata",
+		config:  mup.Map{"project": "group/proj"},
+		targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+		send:    []string{"[#chan] See !42."},
+	}, {
+		// Overhearing, with a repeated reference shown only once.
+		plugin:  "glissuedata",
+		config:  mup.Map{"project": "group/proj", "overhear": true},
+		targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+		send:    []string{"[#chan] See !42 and other/proj#123.", "[#chan] Again !42.", "[#chan] Not wow!42."},
+		recv: []string{
+			"PRIVMSG #chan :MR !42: Title of 42 <Created by joe> <Merged by ann> <https://gitlab.example.com/group/proj/-/merge_requests/42>",
+			"PRIVMSG #chan :Issue other/proj#123: Title of 123 <bug> <Created by joe> <https://gitlab.example.com/other/proj/-/issues/123>",
+		},
+	}, {
+		// Overhearing per target.
+		plugin: "glissuedata",
+		config: mup.Map{"project": "group/proj"},
+		targets: []mup.Target{
+			{Account: "test", Channel: "#chan1"},
+			{Account: "test", Channel: "#chan2", Config: `{"overhear": true}`},
+		},
+		send: []string{"[#chan1] See !42.", "[#chan2] See #123."},
+		recv: []string{
+			"PRIVMSG #chan2 :Issue #123: Title of 123 <bug> <Created by joe> <https://gitlab.example.com/group/proj/-/issues/123>",
+		},
+	}, {
+		// Merge request watching.
+		plugin:  "glmrwatch",
+		config:  mup.Map{"project": "group/proj", "polldelay": "50ms"},
+		targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+		mrs:     [][]int{{42, 43}, {42, 43}, {43, 44}},
+		recv: []string{
+			"PRIVMSG #chan :MR !42 closed: Title of 42 <Created by joe> <Merged by ann> <https://gitlab.example.com/group/proj/-/merge_requests/42>",
+			"PRIVMSG #chan :MR !44 opened: Title of 44 <Created by joe> <https://gitlab.example.com/group/proj/-/merge_requests/44>",
+		},
+	},
+}
+
+func (s *S) TestGitLab(c *C) {
+	for i, test := range glTests {
+		c.Logf("Starting test %d with messages: %v", i, test.send)
+		server := glServer{status: test.status, mrs: test.mrs}
+		server.Start()
+
+		tester := mup.NewPluginTester(test.plugin)
+		config := mup.Map{"endpoint": server.URL()}
+		for k, v := range test.config {
+			config[k] = v
+		}
+		tester.SetConfig(config)
+		tester.SetTargets(test.targets)
+		tester.Start()
+		tester.SendAll(test.send)
+
+		if test.mrs != nil {
+			for {
+				server.mu.Lock()
+				served := server.mrsServed
+				server.mu.Unlock()
+				if served > len(test.mrs) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		var recv []string
+		for len(recv) < len(test.recv) {
+			msg := tester.Recv()
+			if msg == "" {
+				break
+			}
+			recv = append(recv, msg)
+		}
+		tester.Stop()
+		server.Stop()
+		recv = append(recv, tester.RecvAll()...)
+		c.Assert(recv, DeepEquals, test.recv)
+	}
+}
+
+type glServer struct {
+	mu        sync.Mutex
+	server    *httptest.Server
+	status    int
+	mrs       [][]int
+	mrsServed int
+}
+
+func (s *glServer) Start() {
+	s.server = httptest.NewServer(s)
+}
+
+func (s *glServer) Stop() {
+	s.server.Close()
+}
+
+func (s *glServer) URL() string {
+	return s.server.URL
+}
+
+func (s *glServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), "/api/v4/projects/"), "/")
+	if len(path) < 2 {
+		panic("got unexpected request for " + req.URL.Path + " in test glServer")
+	}
+	project := strings.Replace(path[0], "%2F", "/", -1)
+	if len(path) == 2 && path[1] == "merge_requests" {
+		s.serveMRList(w, req)
+		return
+	}
+	if len(path) != 3 {
+		panic("got unexpected request for " + req.URL.Path + " in test glServer")
+	}
+	iid, err := strconv.Atoi(path[2])
+	if err != nil {
+		panic("invalid issue URL: " + req.URL.Path)
+	}
+	if iid == 404 {
+		w.WriteHeader(404)
+		return
+	}
+	switch path[1] {
+	case "issues":
+		fmt.Fprintf(w, `{"iid": %d, "title": "Title of %d.", "state": "opened", "labels": ["bug"], "author": {"username": "joe"},
+			"web_url": "https://gitlab.example.com/%s/-/issues/%d"}`, iid, iid, project, iid)
+	case "merge_requests":
+		if iid == 42 {
+			fmt.Fprintf(w, `{"iid": %d, "title": "Title of %d", "state": "merged", "author": {"username": "joe"}, "merged_by": {"username": "ann"},
+				"web_url": "https://gitlab.example.com/%s/-/merge_requests/%d"}`, iid, iid, project, iid)
+		} else {
+			fmt.Fprintf(w, `{"iid": %d, "title": "Title of %d", "state": "opened", "author": {"username": "joe"},
+				"web_url": "https://gitlab.example.com/%s/-/merge_requests/%d"}`, iid, iid, project, iid)
+		}
+	default:
+		panic("got unexpected request for " + req.URL.Path + " in test glServer")
+	}
+}
+
+func (s *glServer) serveMRList(w http.ResponseWriter, req *http.Request) {
+	if req.FormValue("state") != "opened" {
+		panic("merge requests listed without state=opened")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.mrsServed
+	if i >= len(s.mrs) {
+		i = len(s.mrs) - 1
+	}
+	s.mrsServed++
+	var items []string
+	for _, iid := range s.mrs[i] {
+		items = append(items, fmt.Sprintf(`{"iid": %d}`, iid))
+	}
+	fmt.Fprintf(w, "[%s]", strings.Join(items, ","))
+}
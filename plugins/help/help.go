@@ -3,8 +3,10 @@ package help
 import (
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 
 	"gopkg.in/mup.v0"
@@ -20,14 +22,34 @@ var Plugin = mup.PluginSpec{
 
 var Commands = schema.Commands{{
 	Name: "help",
-	Help: "Displays available commands or details for a specific command.",
+	Help: `Displays available commands or details for a specific command.
+
+	When a plugin name is provided only the commands of that plugin are
+	listed. Long command lists are split in pages, which may be selected
+	with a page number as in "help 2" or "help <plugin> 2".
+	`,
 	Args: schema.Args{{
-		Name: "cmdname",
+		Name: "topic",
+		Hint: "cmdname|plugin|page",
+	}, {
+		Name: "page",
+		Type: schema.Int,
 	}},
 }, {
 	Name: "start",
 	Help: "Displays available commands.",
 	Hide: true,
+}, {
+	Name: "commands",
+	Help: `Displays available commands.
+
+	If -json is provided, the schemas of all available commands are
+	displayed as a JSON document instead, for use in command completion.
+	`,
+	Args: schema.Args{{
+		Name: "-json",
+		Type: schema.Bool,
+	}},
 }}
 
 func init() {
@@ -38,10 +60,15 @@ type helpPlugin struct {
 	plugger *mup.Plugger
 	rand    *rand.Rand
 	config  struct {
-		Boring bool
+		Boring   bool
+		PageSize int
 	}
 }
 
+// defaultPageSize is the number of bytes of command listings sent in
+// each page, leaving room for the rest of the line within IRC limits.
+const defaultPageSize = 300
+
 func start(plugger *mup.Plugger) mup.Stopper {
 	p := &helpPlugin{
 		plugger: plugger,
@@ -51,6 +78,9 @@ func start(plugger *mup.Plugger) mup.Stopper {
 	if err != nil {
 		plugger.Logf("%v", err)
 	}
+	if p.config.PageSize <= 0 {
+		p.config.PageSize = defaultPageSize
+	}
 	return p
 }
 
@@ -80,6 +110,13 @@ func (p *helpPlugin) HandleMessage(msg *mup.Message) {
 			return
 		}
 		if !anyRunning(infos) {
+			handled, err := p.unknownHandled(msg)
+			if err != nil {
+				p.plugger.Logf("Cannot list unknown command handlers: %v", err)
+			}
+			if handled {
+				return
+			}
 			if len(infos) == 0 {
 				p.sendNotKnown(msg, cmdname)
 			} else {
@@ -136,9 +173,24 @@ func (p *helpPlugin) sendNotUsable(msg *mup.Message, info *pluginInfo, what, whe
 }
 
 func (p *helpPlugin) HandleCommand(cmd *mup.Command) {
-	var args struct{ CmdName string }
+	var args struct {
+		Topic string
+		Page  int
+		JSON  bool
+	}
 	cmd.Args(&args)
-	if args.CmdName == "" {
+	if args.JSON {
+		p.sendSchemas(cmd)
+		return
+	}
+	if page, err := strconv.Atoi(args.Topic); err == nil && args.Page == 0 {
+		args.Topic = ""
+		args.Page = page
+	}
+	if args.Page == 0 {
+		args.Page = 1
+	}
+	if args.Topic == "" {
 		cmdnames, err := p.cmdList()
 		if err != nil {
 			p.plugger.Logf("Cannot list available commands: %v", err)
@@ -149,18 +201,32 @@ func (p *helpPlugin) HandleCommand(cmd *mup.Command) {
 			p.plugger.Sendf(cmd, "No known commands available. Go load some plugins.")
 			return
 		}
-		p.plugger.Sendf(cmd, `Run "help <cmdname>" for details on: %s`, strings.Join(cmdnames, ", "))
+		p.sendPage(cmd, `Run "help <cmdname>" for details on: `, "help", cmdnames, args.Page)
 		return
 	}
 
-	infos, err := p.pluginsWith(args.CmdName)
+	infos, err := p.pluginsWith(args.Topic)
 	if err != nil {
 		p.plugger.Logf("Cannot list available commands: %v", err)
 		p.plugger.Sendf(cmd, "Cannot list available commands: %v", err)
 		return
 	}
 	if len(infos) == 0 {
-		p.plugger.Sendf(cmd, "Command %q not found.", args.CmdName)
+		usages, found, err := p.pluginCmdList(args.Topic)
+		if err != nil {
+			p.plugger.Logf("Cannot list available commands: %v", err)
+			p.plugger.Sendf(cmd, "Cannot list available commands: %v", err)
+			return
+		}
+		if !found {
+			p.plugger.Sendf(cmd, "Command %q not found.", args.Topic)
+			return
+		}
+		if len(usages) == 0 {
+			p.plugger.Sendf(cmd, "Plugin %q has no commands.", args.Topic)
+			return
+		}
+		p.sendPage(cmd, fmt.Sprintf("Commands of plugin %q: ", args.Topic), "help "+args.Topic, usages, args.Page)
 		return
 	}
 	command := &infos[0].Command
@@ -187,6 +253,71 @@ func (p *helpPlugin) HandleCommand(cmd *mup.Command) {
 	}
 }
 
+// sendSchemas sends the schemas of all available commands as a JSON
+// document, which is pasted when too long.
+func (p *helpPlugin) sendSchemas(cmd *mup.Command) {
+	schemas, err := mup.CommandSchemas(p.plugger.DB())
+	if err == nil && schemas == nil {
+		schemas = []mup.PluginSchema{}
+	}
+	var data []byte
+	if err == nil {
+		data, err = json.MarshalIndent(schemas, "", "\t")
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot list available commands: %v", err)
+		p.plugger.Sendf(cmd, "Cannot list available commands: %v", err)
+		return
+	}
+	p.plugger.SendLong(cmd, string(data))
+}
+
+// sendPage sends the requested page of the items list, prefixed by intro.
+// The more argument is the command that, followed by a page number,
+// displays other pages of the same list.
+func (p *helpPlugin) sendPage(cmd *mup.Command, intro, more string, items []string, page int) {
+	pages := paginate(items, p.config.PageSize)
+	if page < 1 || page > len(pages) {
+		if len(pages) == 1 {
+			p.plugger.Sendf(cmd, "Page %d not found. There is a single page.", page)
+		} else {
+			p.plugger.Sendf(cmd, "Page %d not found. There are %d pages.", page, len(pages))
+		}
+		return
+	}
+	text := intro + strings.Join(pages[page-1], ", ")
+	if page < len(pages) {
+		text += fmt.Sprintf(` (page %d of %d; "%s %d" for more)`, page, len(pages), more, page+1)
+	} else if len(pages) > 1 {
+		text += fmt.Sprintf(" (page %d of %d)", page, len(pages))
+	}
+	p.plugger.Sendf(cmd, "%s", text)
+}
+
+// paginate splits items in pages with up to size bytes once joined.
+// Every page holds at least one item, even if it alone exceeds size.
+func paginate(items []string, size int) [][]string {
+	var pages [][]string
+	var page []string
+	var length int
+	for _, item := range items {
+		if len(page) > 0 && length+len(", ")+len(item) > size {
+			pages = append(pages, page)
+			page = nil
+		}
+		if len(page) == 0 {
+			length = len(item)
+		} else {
+			length += len(", ") + len(item)
+		}
+		page = append(page, item)
+	}
+	if len(page) > 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
 type pluginInfo struct {
 	Name    string
 	Running bool
@@ -214,13 +345,15 @@ func (p *helpPlugin) pluginsWith(cmdname string) ([]pluginInfo, error) {
 
 		// Fetch the argument schema for the command.
 		var arows *sql.Rows
-		arows, err = tx.Query("SELECT argument,hint,type,flag FROM argumentschema WHERE plugin=? AND command=?", info.Name, cmdname)
+		arows, err = tx.Query("SELECT argument,hint,type,flag,enumvalues,short,defaultvalue FROM argumentschema WHERE plugin=? AND command=? ORDER BY rowid", info.Name, cmdname)
 		for err == nil && arows.Next() {
 			var arg schema.Arg
-			err = arows.Scan(&arg.Name, &arg.Hint, &arg.Type, &arg.Flag)
+			var values string
+			err = arows.Scan(&arg.Name, &arg.Hint, &arg.Type, &arg.Flag, &values, &arg.Short, &arg.Default)
 			if err != nil {
 				break
 			}
+			arg.Values = strings.Fields(values)
 			info.Command.Args = append(info.Command.Args, arg)
 		}
 		if arows != nil {
@@ -264,6 +397,30 @@ func (p *helpPlugin) pluginsWith(cmdname string) ([]pluginInfo, error) {
 	return infos, nil
 }
 
+// unknownHandled returns whether a running plugin that handles unknown
+// commands is enabled where msg was sent.
+func (p *helpPlugin) unknownHandled(msg *mup.Message) (bool, error) {
+	rows, err := p.plugger.DB().Query("SELECT target.account,target.channel,target.nick FROM pluginschema" +
+		" JOIN plugin ON plugin.name=pluginschema.plugin OR plugin.name LIKE pluginschema.plugin||'/%'" +
+		" JOIN target ON target.plugin=plugin.name WHERE pluginschema.unknowncommands")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	addr := msg.Address()
+	for rows.Next() {
+		var target mup.Address
+		err = rows.Scan(&target.Account, &target.Channel, &target.Nick)
+		if err != nil {
+			return false, err
+		}
+		if target.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 func (p *helpPlugin) cmdList() ([]string, error) {
 	db := p.plugger.DB()
 
@@ -279,7 +436,7 @@ func (p *helpPlugin) cmdList() ([]string, error) {
 		if err != nil {
 			return nil, err
 		}
-		if cmdname == "help" {
+		if cmdname == "help" || cmdname == "commands" {
 			continue
 		}
 		result = append(result, cmdname)
@@ -287,6 +444,65 @@ func (p *helpPlugin) cmdList() ([]string, error) {
 	return result, nil
 }
 
+// pluginCmdList returns the usage of all visible commands of the named
+// plugin, and whether the plugin is known at all.
+func (p *helpPlugin) pluginCmdList(plugin string) (usages []string, found bool, err error) {
+	tx, err := p.plugger.DB().Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot begin database transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT TRUE FROM pluginschema WHERE plugin=?", plugin).Scan(&found)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var commands []*schema.Command
+	crows, err := tx.Query("SELECT command FROM commandschema WHERE plugin=? AND hide=FALSE ORDER BY command", plugin)
+	if err != nil {
+		return nil, false, err
+	}
+	for crows.Next() {
+		var command schema.Command
+		err = crows.Scan(&command.Name)
+		if err != nil {
+			crows.Close()
+			return nil, false, err
+		}
+		commands = append(commands, &command)
+	}
+	crows.Close()
+
+	var buf bytes.Buffer
+	for _, command := range commands {
+		arows, err := tx.Query("SELECT argument,hint,type,flag,enumvalues,short,defaultvalue FROM argumentschema WHERE plugin=? AND command=? ORDER BY rowid", plugin, command.Name)
+		if err != nil {
+			return nil, false, err
+		}
+		for arows.Next() {
+			var arg schema.Arg
+			var values string
+			err = arows.Scan(&arg.Name, &arg.Hint, &arg.Type, &arg.Flag, &values, &arg.Short, &arg.Default)
+			if err != nil {
+				arows.Close()
+				return nil, false, err
+			}
+			arg.Values = strings.Fields(values)
+			command.Args = append(command.Args, arg)
+		}
+		arows.Close()
+
+		buf.Reset()
+		formatUsage(&buf, command)
+		usages = append(usages, buf.String())
+	}
+	return usages, true, nil
+}
+
 func formatUsage(buf *bytes.Buffer, command *schema.Command) {
 	buf.WriteString(command.Name)
 	for _, arg := range command.Args {
@@ -303,11 +519,16 @@ func formatUsage(buf *bytes.Buffer, command *schema.Command) {
 
 func formatArg(buf *bytes.Buffer, arg *schema.Arg) {
 	if strings.HasPrefix(arg.Name, "-") {
+		if arg.Short != "" {
+			buf.WriteString("-" + arg.Short + "|")
+		}
 		buf.WriteString(arg.Name)
 		if t := valueType(arg); t != schema.Bool {
 			buf.WriteString("=<")
 			if arg.Hint != "" {
 				buf.WriteString(arg.Hint)
+			} else if t == schema.Enum {
+				buf.WriteString(strings.Join(arg.Values, "|"))
 			} else {
 				buf.WriteString(string(t))
 			}
@@ -315,12 +536,21 @@ func formatArg(buf *bytes.Buffer, arg *schema.Arg) {
 		}
 	} else {
 		buf.WriteByte('<')
-		buf.WriteString(arg.Name)
+		if arg.Hint != "" {
+			buf.WriteString(arg.Hint)
+		} else {
+			buf.WriteString(arg.Name)
+		}
 		if arg.Flag&schema.Trailing != 0 {
 			buf.WriteString(" ...")
 		}
 		buf.WriteByte('>')
 	}
+	if arg.Default != "" {
+		buf.WriteString(" (default ")
+		buf.WriteString(arg.Default)
+		buf.WriteByte(')')
+	}
 }
 
 func valueType(arg *schema.Arg) schema.ValueType {
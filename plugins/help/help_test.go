@@ -2,6 +2,8 @@ package help_test
 
 import (
 	"database/sql"
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"gopkg.in/mup.v0"
@@ -96,6 +98,95 @@ var helpTests = []helpTest{{
 			Flag: schema.Trailing,
 		}},
 	}},
+}, {
+	send: "help cmdname",
+	recv: `PRIVMSG nick :cmdname [-mode=<fast|slow>] [-wait=<duration>] — Does nothing.`,
+	cmds: schema.Commands{{
+		Name: "cmdname",
+		Help: "Does nothing.",
+		Args: schema.Args{{
+			Name:   "-mode",
+			Type:   schema.Enum,
+			Values: []string{"fast", "slow"},
+		}, {
+			Name: "-wait",
+			Type: schema.Duration,
+		}},
+	}},
+}, {
+	send: "help cmdname",
+	recvAll: []string{
+		`PRIVMSG nick :cmdname [-p|-project=<name> (default mup)] [<count> (default 10)]`,
+		`PRIVMSG nick :Does nothing.`,
+	},
+	cmds: schema.Commands{{
+		Name: "cmdname",
+		Help: "Does nothing.",
+		Args: schema.Args{{
+			Name:    "-project",
+			Hint:    "name",
+			Short:   "p",
+			Default: "mup",
+		}, {
+			Name:    "count",
+			Type:    schema.Int,
+			Default: "10",
+		}},
+	}},
+}, {
+	send: "help cmdname",
+	recv: `PRIVMSG nick :cmdname <me|nick> [<text ...>] — Does nothing.`,
+	cmds: schema.Commands{{
+		Name: "cmdname",
+		Help: "Does nothing.",
+		Args: schema.Args{{
+			Name: "who",
+			Hint: "me|nick",
+			Flag: schema.Required,
+		}, {
+			Name: "text",
+			Flag: schema.Trailing,
+		}},
+	}},
+}, {
+	send:   "help",
+	recv:   `PRIVMSG nick :Run "help <cmdname>" for details on: cmd1, cmd2 (page 1 of 3; "help 2" for more)`,
+	cmds:   schema.Commands{{Name: "cmd1"}, {Name: "cmd2"}, {Name: "cmd3"}, {Name: "cmd4"}, {Name: "cmd5"}},
+	config: mup.Map{"pagesize": 10},
+}, {
+	send:   "help 3",
+	recv:   `PRIVMSG nick :Run "help <cmdname>" for details on: cmd5 (page 3 of 3)`,
+	cmds:   schema.Commands{{Name: "cmd1"}, {Name: "cmd2"}, {Name: "cmd3"}, {Name: "cmd4"}, {Name: "cmd5"}},
+	config: mup.Map{"pagesize": 10},
+}, {
+	send:   "help 4",
+	recv:   `PRIVMSG nick :Page 4 not found. There are 3 pages.`,
+	cmds:   schema.Commands{{Name: "cmd1"}, {Name: "cmd2"}, {Name: "cmd3"}, {Name: "cmd4"}, {Name: "cmd5"}},
+	config: mup.Map{"pagesize": 10},
+}, {
+	send: "help 2",
+	recv: `PRIVMSG nick :Page 2 not found. There is a single page.`,
+	cmds: schema.Commands{{Name: "cmd1"}},
+}, {
+	send: "help test",
+	recv: `PRIVMSG nick :Commands of plugin "test": cmd1 <hint>, cmd2 [-flag]`,
+	cmds: schema.Commands{
+		{Name: "cmd1", Args: schema.Args{{Name: "arg", Hint: "hint", Flag: schema.Required}}},
+		{Name: "cmd2", Args: schema.Args{{Name: "-flag", Type: schema.Bool}}},
+		{Name: "cmd3", Hide: true},
+	},
+}, {
+	send: "help test 2",
+	recv: `PRIVMSG nick :Commands of plugin "test": cmd2 [-flag] (page 2 of 2)`,
+	cmds: schema.Commands{
+		{Name: "cmd1", Args: schema.Args{{Name: "arg", Hint: "hint", Flag: schema.Required}}},
+		{Name: "cmd2", Args: schema.Args{{Name: "-flag", Type: schema.Bool}}},
+	},
+	config: mup.Map{"pagesize": 20},
+}, {
+	send: "help test",
+	recv: `PRIVMSG nick :Plugin "test" has no commands.`,
+	cmds: schema.Commands{{Name: "cmd1", Hide: true}},
 }, {
 	sendAll: []string{"foo", "foo"},
 	recvAll: []string{
@@ -115,6 +206,10 @@ var helpTests = []helpTest{{
 	send: "cmdname",
 	recv: `PRIVMSG nick :Plugin "test" is not running.`,
 	cmds: schema.Commands{{Name: "cmdname"}},
+}, {
+	send: "commands",
+	recv: `PRIVMSG nick :Run "help <cmdname>" for details on: cmdname`,
+	cmds: schema.Commands{{Name: "cmdname"}},
 }, {
 	send:   "[#chan] mup: foo",
 	recv:   `PRIVMSG #chan :nick: Command "foo" not found.`,
@@ -132,6 +227,95 @@ func (s *HelpSuite) TestHelp(c *C) {
 	}
 }
 
+func (s *HelpSuite) TestCommandsJSON(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	tester := mup.NewPluginTester("help")
+	tester.SetDB(db)
+	tester.SetConfig(mup.Map{"pastelines": 1000})
+
+	testPlugin.Commands = schema.Commands{{
+		Name: "cmdname",
+		Help: "Does nothing.",
+		Args: schema.Args{{
+			Name:   "-mode",
+			Type:   schema.Enum,
+			Values: []string{"fast", "slow"},
+		}},
+	}, {
+		Name: "hidden",
+		Hide: true,
+	}}
+	tester.AddSchema("test")
+
+	_, err = db.Exec("INSERT INTO account (name) VALUES ('test')")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO plugin (name) VALUES ('help')")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO target (plugin,account) VALUES ('help','test')")
+	c.Assert(err, IsNil)
+
+	tester.Start()
+	tester.Sendf("commands --json")
+	tester.Stop()
+
+	var lines []string
+	for _, line := range tester.RecvAll() {
+		c.Assert(strings.HasPrefix(line, "PRIVMSG nick :"), Equals, true)
+		lines = append(lines, strings.TrimPrefix(line, "PRIVMSG nick :"))
+	}
+	var schemas []mup.PluginSchema
+	err = json.Unmarshal([]byte(strings.Join(lines, "\n")), &schemas)
+	c.Assert(err, IsNil)
+	c.Assert(schemas, HasLen, 2)
+	c.Assert(schemas[0].Plugin, Equals, "help")
+	c.Assert(schemas[1], DeepEquals, mup.PluginSchema{
+		Plugin:   "test",
+		Commands: testPlugin.Commands[:1],
+	})
+}
+
+func (s *HelpSuite) TestUnknownHandled(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	tester := mup.NewPluginTester("help")
+	tester.SetDB(db)
+	tester.SetConfig(mup.Map{"boring": true})
+
+	testPlugin.Commands = nil
+	tester.AddSchema("test")
+
+	execAll := func(stmts ...string) {
+		for _, stmt := range stmts {
+			_, err := db.Exec(stmt)
+			c.Assert(err, IsNil)
+		}
+	}
+	execAll(
+		"INSERT INTO account (name) VALUES ('test')",
+		"INSERT INTO plugin (name) VALUES ('help')",
+		"INSERT INTO target (plugin,account) VALUES ('help','test')",
+		"INSERT INTO plugin (name) VALUES ('test/one')",
+		"INSERT INTO target (plugin,account,channel) VALUES ('test/one','test','#chan')",
+		"UPDATE pluginschema SET unknowncommands=TRUE WHERE plugin='test'",
+	)
+
+	tester.Start()
+	tester.Sendf("[#chan] mup: foo")
+	tester.Sendf("[#other] mup: bar")
+	tester.Sendf("baz")
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		`PRIVMSG #other :nick: Command "bar" not found.`,
+		`PRIVMSG nick :Command "baz" not found.`,
+	})
+}
+
 var testPlugin = mup.PluginSpec{Name: "test"}
 
 func init() {
@@ -0,0 +1,267 @@
+// Package incident implements a plugin announcing incidents reported by
+// PagerDuty or Opsgenie, and telling who is on call.
+package incident
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "incidentwatch",
+	Help: `Announces incidents being triggered, acknowledged, and resolved.
+
+	The "provider" configuration option selects either "pagerduty" (the default)
+	or "opsgenie", and the "token" option holds the respective API key. The
+	"services" option lists the PagerDuty service ids or the Opsgenie team names
+	to watch. When no services are listed, all incidents are announced.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "oncall",
+	Help: `Shows who is currently on call for the provided schedule.`,
+	Args: schema.Args{{
+		Name: "schedule",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+// provider fetches incidents and on-call details from an incident
+// management service.
+type provider interface {
+	defaultEndpoint() string
+
+	// incidents returns the recent incidents on the provided services,
+	// or on all services if none are provided.
+	incidents(p *incidentPlugin, services []string) ([]*incident, error)
+
+	// oncall returns who is currently on call for the named schedule.
+	oncall(p *incidentPlugin, schedule string) (*oncall, error)
+}
+
+var providers = map[string]func() provider{
+	"pagerduty": func() provider { return &pagerDuty{} },
+	"opsgenie":  func() provider { return &opsgenie{} },
+}
+
+type incidentStatus int
+
+const (
+	statusTriggered incidentStatus = iota + 1
+	statusAcknowledged
+	statusResolved
+)
+
+func (s incidentStatus) String() string {
+	switch s {
+	case statusTriggered:
+		return "triggered"
+	case statusAcknowledged:
+		return "acknowledged"
+	case statusResolved:
+		return "resolved"
+	}
+	return "unknown"
+}
+
+type incident struct {
+	Id      string
+	Number  string
+	Title   string
+	Service string
+	Status  incidentStatus
+	By      string
+	URL     string
+}
+
+type oncall struct {
+	Schedule string
+	People   []string
+	Until    time.Time
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+type incidentPlugin struct {
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	provider provider
+	commands chan *mup.Command
+	config   struct {
+		Provider  string
+		Token     string
+		Endpoint  string
+		Services  []string
+		PollDelay mup.DurationString
+	}
+}
+
+const defaultPollDelay = 1 * time.Minute
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &incidentPlugin{
+		plugger:  plugger,
+		commands: make(chan *mup.Command, 5),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Provider == "" {
+		p.config.Provider = "pagerduty"
+	}
+	newProvider, ok := providers[p.config.Provider]
+	if !ok {
+		plugger.Logf("Unknown incident provider %q; using pagerduty.", p.config.Provider)
+		p.config.Provider = "pagerduty"
+		newProvider = providers[p.config.Provider]
+	}
+	p.provider = newProvider()
+	if p.config.Endpoint == "" {
+		p.config.Endpoint = p.provider.defaultEndpoint()
+	}
+	if p.config.PollDelay.Duration == 0 {
+		p.config.PollDelay.Duration = defaultPollDelay
+	}
+	p.tomb.Go(p.loop)
+	p.tomb.Go(p.poll)
+	return p
+}
+
+func (p *incidentPlugin) Stop() error {
+	close(p.commands)
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+func (p *incidentPlugin) HandleCommand(cmd *mup.Command) {
+	select {
+	case p.commands <- cmd:
+	default:
+		p.plugger.Sendf(cmd, "The incident server seems a bit sluggish right now. Please try again soon.")
+	}
+}
+
+func (p *incidentPlugin) loop() error {
+	for cmd := range p.commands {
+		p.showOncall(cmd)
+	}
+	return nil
+}
+
+func (p *incidentPlugin) showOncall(cmd *mup.Command) {
+	var args struct{ Schedule string }
+	cmd.Args(&args)
+	oncall, err := p.provider.oncall(p, args.Schedule)
+	if err == errNotFound {
+		p.plugger.Sendf(cmd, "Schedule not found.")
+		return
+	}
+	if err != nil {
+		p.plugger.Sendf(cmd, "Oops: %v", err)
+		return
+	}
+	if len(oncall.People) == 0 {
+		p.plugger.Sendf(cmd, "Nobody is on call for %s right now.", oncall.Schedule)
+		return
+	}
+	until := ""
+	if !oncall.Until.IsZero() {
+		until = " until " + oncall.Until.UTC().Format("Mon 15:04 MST")
+	}
+	p.plugger.Sendf(cmd, "On call for %s: %s%s.", oncall.Schedule, strings.Join(oncall.People, ", "), until)
+}
+
+func (p *incidentPlugin) poll() error {
+	var known map[string]incidentStatus
+	for {
+		incidents, err := p.provider.incidents(p, p.config.Services)
+		if err == nil {
+			seen := make(map[string]incidentStatus, len(incidents))
+			for _, inc := range incidents {
+				seen[inc.Id] = inc.Status
+				if known == nil {
+					continue
+				}
+				old, ok := known[inc.Id]
+				if ok && old == inc.Status || !ok && inc.Status == statusResolved {
+					continue
+				}
+				p.announce(inc)
+			}
+			known = seen
+		}
+
+		select {
+		case <-time.After(p.config.PollDelay.Duration):
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (p *incidentPlugin) announce(inc *incident) {
+	by := ""
+	if inc.By != "" && inc.Status != statusTriggered {
+		by = " by " + inc.By
+	}
+	on := ""
+	if inc.Service != "" {
+		on = " on " + inc.Service
+	}
+	p.plugger.Broadcastf("Incident #%s %s%s%s: %s <%s>", inc.Number, inc.Status, by, on, inc.Title, inc.URL)
+}
+
+// request performs a GET request for path under the configured endpoint,
+// with the provided headers, and decodes the JSON response into result.
+func (p *incidentPlugin) request(path string, header http.Header, result interface{}) error {
+	url := strings.TrimRight(p.config.Endpoint, "/") + "/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		p.plugger.Logf("Cannot perform %s request: %v", p.config.Provider, err)
+		return fmt.Errorf("cannot perform %s request: %v", p.config.Provider, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err == nil && resp.StatusCode == 404 {
+		resp.Body.Close()
+		return errNotFound
+	}
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot perform %s request: %v", p.config.Provider, err)
+		return fmt.Errorf("cannot perform %s request: %v", p.config.Provider, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		p.plugger.Logf("Cannot read %s response: %v", p.config.Provider, err)
+		return fmt.Errorf("cannot read %s response: %v", p.config.Provider, err)
+	}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode %s response: %v\n-----\n%s\n-----", p.config.Provider, err, body)
+		return fmt.Errorf("cannot decode %s response: %v", p.config.Provider, err)
+	}
+	return nil
+}
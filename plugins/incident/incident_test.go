@@ -0,0 +1,186 @@
+package incident_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/incident"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+type pdServer struct {
+	mu       sync.Mutex
+	polls    [][]string
+	served   int
+	services []string
+	auth     string
+}
+
+func (s *pdServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = req.Header.Get("Authorization")
+	switch req.URL.Path {
+	case "/incidents":
+		s.services = req.URL.Query()["service_ids[]"]
+		poll := s.polls[s.served]
+		if s.served < len(s.polls)-1 {
+			s.served++
+		}
+		fmt.Fprintf(w, `{"incidents": [%s]}`, strings.Join(poll, ","))
+	case "/schedules":
+		if req.URL.Query().Get("query") == "Unknown" {
+			w.Write([]byte(`{"schedules": []}`))
+			return
+		}
+		w.Write([]byte(`{"schedules": [{"id": "S1", "name": "Primary (old)"}, {"id": "S2", "name": "Primary"}]}`))
+	case "/oncalls":
+		if id := req.URL.Query().Get("schedule_ids[]"); id != "S2" {
+			panic("unexpected schedule id: " + id)
+		}
+		w.Write([]byte(`{"oncalls": [
+			{"user": {"summary": "Jane"}, "end": "2026-10-19T09:00:00Z"},
+			{"user": {"summary": "Bob"}, "end": "2026-10-20T09:00:00Z"},
+			{"user": {"summary": "Jane"}, "end": "2026-10-19T09:00:00Z"}
+		]}`))
+	default:
+		panic("got unexpected request for " + req.URL.Path + " in test pdServer")
+	}
+}
+
+func pdIncident(id int, status, by string) string {
+	return fmt.Sprintf(`{"id": "P%d", "incident_number": %d, "title": "Disk full on db%d", "status": %q,
+		"html_url": "https://example.pagerduty.com/incidents/P%d", "service": {"summary": "Database"},
+		"last_status_change_by": {"summary": %q}}`, id, id, id, status, id, by)
+}
+
+func (s *S) TestPagerDuty(c *C) {
+	server := &pdServer{polls: [][]string{{
+		pdIncident(1, "triggered", "Database"),
+		pdIncident(2, "resolved", "Jane"),
+	}, {
+		pdIncident(1, "acknowledged", "Jane"),
+		pdIncident(2, "resolved", "Jane"),
+		pdIncident(3, "triggered", "Database"),
+		pdIncident(4, "resolved", "Bob"),
+	}, {
+		pdIncident(1, "resolved", "Jane"),
+		pdIncident(3, "triggered", "Database"),
+	}}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("incidentwatch")
+	tester.SetConfig(mup.Map{
+		"endpoint":  httpServer.URL,
+		"token":     "secret",
+		"services":  []string{"SVC1", "SVC2"},
+		"polldelay": "20ms",
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Incident #1 acknowledged by Jane on Database: Disk full on db1 <https://example.pagerduty.com/incidents/P1>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Incident #3 triggered on Database: Disk full on db3 <https://example.pagerduty.com/incidents/P3>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Incident #1 resolved by Jane on Database: Disk full on db1 <https://example.pagerduty.com/incidents/P1>")
+
+	tester.Sendf("[#chan] mup: oncall primary")
+	tester.Sendf("[#chan] mup: oncall Unknown")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: On call for Primary: Jane, Bob until Mon 09:00 UTC.")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: Schedule not found.")
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), HasLen, 0)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c.Assert(server.services, DeepEquals, []string{"SVC1", "SVC2"})
+	c.Assert(server.auth, Equals, "Token token=secret")
+}
+
+type ogServer struct {
+	mu     sync.Mutex
+	polls  []string
+	served int
+	query  string
+	auth   string
+}
+
+func (s *ogServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = req.Header.Get("Authorization")
+	switch {
+	case req.URL.Path == "/v2/alerts":
+		s.query = req.URL.Query().Get("query")
+		poll := s.polls[s.served]
+		if s.served < len(s.polls)-1 {
+			s.served++
+		}
+		fmt.Fprintf(w, `{"data": [%s]}`, poll)
+	case req.URL.Path == "/v2/schedules/Ops Team/on-calls":
+		w.Write([]byte(`{"data": {"_parent": {"name": "Ops Team"}, "onCallRecipients": ["jane@example.com"]}}`))
+	case strings.HasPrefix(req.URL.Path, "/v2/schedules/"):
+		w.WriteHeader(404)
+	default:
+		panic("got unexpected request for " + req.URL.Path + " in test ogServer")
+	}
+}
+
+func (s *S) TestOpsgenie(c *C) {
+	server := &ogServer{polls: []string{
+		``,
+		`{"id": "a1", "tinyId": "7", "message": "Queue is stuck", "status": "open", "acknowledged": false}`,
+		`{"id": "a1", "tinyId": "7", "message": "Queue is stuck", "status": "open", "acknowledged": true, "report": {"ackedBy": "jane@example.com"}}`,
+		`{"id": "a1", "tinyId": "7", "message": "Queue is stuck", "status": "closed", "acknowledged": true, "report": {"ackedBy": "jane@example.com", "closedBy": "bob@example.com"}}`,
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("incidentwatch")
+	tester.SetConfig(mup.Map{
+		"provider":  "opsgenie",
+		"endpoint":  httpServer.URL,
+		"token":     "secret",
+		"services":  []string{"ops"},
+		"polldelay": "20ms",
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Incident #7 triggered: Queue is stuck <https://app.opsgenie.com/alert/detail/a1/details>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Incident #7 acknowledged by jane@example.com: Queue is stuck <https://app.opsgenie.com/alert/detail/a1/details>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Incident #7 resolved by bob@example.com: Queue is stuck <https://app.opsgenie.com/alert/detail/a1/details>")
+
+	tester.Sendf("oncall Ops Team")
+	tester.Sendf("oncall Nobody")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :On call for Ops Team: jane@example.com.")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Schedule not found.")
+	tester.Stop()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c.Assert(server.query, Equals, `teams:"ops"`)
+	c.Assert(server.auth, Equals, "GenieKey secret")
+}
@@ -0,0 +1,96 @@
+package incident
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type opsgenie struct{}
+
+func (og *opsgenie) defaultEndpoint() string {
+	return "https://api.opsgenie.com/"
+}
+
+func (og *opsgenie) header(p *incidentPlugin) http.Header {
+	return http.Header{"Authorization": {"GenieKey " + p.config.Token}}
+}
+
+type ogAlert struct {
+	Id           string
+	TinyId       string
+	Message      string
+	Status       string
+	Acknowledged bool
+	Report       struct {
+		AckedBy  string
+		ClosedBy string
+	}
+}
+
+func (og *opsgenie) incidents(p *incidentPlugin, services []string) ([]*incident, error) {
+	query := url.Values{
+		"limit": {"100"},
+		"sort":  {"createdAt"},
+		"order": {"desc"},
+	}
+	if len(services) > 0 {
+		teams := make([]string, len(services))
+		for i, team := range services {
+			teams[i] = "teams:" + strconv.Quote(team)
+		}
+		query.Set("query", strings.Join(teams, " OR "))
+	}
+	var result struct {
+		Data []*ogAlert
+	}
+	err := p.request("/v2/alerts?"+query.Encode(), og.header(p), &result)
+	if err != nil {
+		return nil, err
+	}
+	incidents := make([]*incident, 0, len(result.Data))
+	for _, alert := range result.Data {
+		inc := &incident{
+			Id:     alert.Id,
+			Number: alert.TinyId,
+			Title:  alert.Message,
+			URL:    "https://app.opsgenie.com/alert/detail/" + alert.Id + "/details",
+		}
+		switch {
+		case alert.Status == "closed":
+			inc.Status = statusResolved
+			inc.By = alert.Report.ClosedBy
+		case alert.Acknowledged:
+			inc.Status = statusAcknowledged
+			inc.By = alert.Report.AckedBy
+		case alert.Status == "open":
+			inc.Status = statusTriggered
+		default:
+			continue
+		}
+		incidents = append(incidents, inc)
+	}
+	return incidents, nil
+}
+
+func (og *opsgenie) oncall(p *incidentPlugin, schedule string) (*oncall, error) {
+	var result struct {
+		Data struct {
+			Parent struct {
+				Name string
+			} `json:"_parent"`
+			OnCallRecipients []string
+		}
+	}
+	path := "/v2/schedules/" + url.PathEscape(schedule) + "/on-calls?scheduleIdentifierType=name&flat=true"
+	err := p.request(path, og.header(p), &result)
+	if err != nil {
+		return nil, err
+	}
+	name := result.Data.Parent.Name
+	if name == "" {
+		name = schedule
+	}
+	return &oncall{Schedule: name, People: result.Data.OnCallRecipients}, nil
+}
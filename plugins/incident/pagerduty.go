@@ -0,0 +1,140 @@
+package incident
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type pagerDuty struct{}
+
+func (pd *pagerDuty) defaultEndpoint() string {
+	return "https://api.pagerduty.com/"
+}
+
+func (pd *pagerDuty) header(p *incidentPlugin) http.Header {
+	return http.Header{
+		"Accept":        {"application/vnd.pagerduty+json;version=2"},
+		"Authorization": {"Token token=" + p.config.Token},
+	}
+}
+
+type pdRef struct {
+	Id      string
+	Summary string
+}
+
+type pdIncident struct {
+	Id                 string
+	IncidentNumber     int `json:"incident_number"`
+	Title              string
+	Status             string
+	HTMLURL            string `json:"html_url"`
+	Service            pdRef
+	LastStatusChangeBy pdRef `json:"last_status_change_by"`
+}
+
+// pdWindow is how far back incidents are looked up, so that recently
+// resolved incidents remain visible across polls.
+const pdWindow = 24 * time.Hour
+
+func (pd *pagerDuty) incidents(p *incidentPlugin, services []string) ([]*incident, error) {
+	query := url.Values{
+		"statuses[]": {"triggered", "acknowledged", "resolved"},
+		"since":      {time.Now().Add(-pdWindow).UTC().Format(time.RFC3339)},
+		"sort_by":    {"created_at:desc"},
+		"limit":      {"100"},
+	}
+	if len(services) > 0 {
+		query["service_ids[]"] = services
+	}
+	var result struct {
+		Incidents []*pdIncident
+	}
+	err := p.request("/incidents?"+query.Encode(), pd.header(p), &result)
+	if err != nil {
+		return nil, err
+	}
+	incidents := make([]*incident, 0, len(result.Incidents))
+	for _, pdi := range result.Incidents {
+		inc := &incident{
+			Id:      pdi.Id,
+			Number:  strconv.Itoa(pdi.IncidentNumber),
+			Title:   pdi.Title,
+			Service: pdi.Service.Summary,
+			By:      pdi.LastStatusChangeBy.Summary,
+			URL:     pdi.HTMLURL,
+		}
+		switch pdi.Status {
+		case "triggered":
+			inc.Status = statusTriggered
+		case "acknowledged":
+			inc.Status = statusAcknowledged
+		case "resolved":
+			inc.Status = statusResolved
+		default:
+			continue
+		}
+		incidents = append(incidents, inc)
+	}
+	return incidents, nil
+}
+
+func (pd *pagerDuty) oncall(p *incidentPlugin, schedule string) (*oncall, error) {
+	var schedules struct {
+		Schedules []struct {
+			Id   string
+			Name string
+		}
+	}
+	err := p.request("/schedules?query="+url.QueryEscape(schedule), pd.header(p), &schedules)
+	if err != nil {
+		return nil, err
+	}
+	if len(schedules.Schedules) == 0 {
+		return nil, errNotFound
+	}
+	found := schedules.Schedules[0]
+	for _, s := range schedules.Schedules {
+		if strings.EqualFold(s.Name, schedule) {
+			found = s
+			break
+		}
+	}
+
+	var oncalls struct {
+		Oncalls []struct {
+			User pdRef
+			End  time.Time
+		}
+	}
+	query := url.Values{
+		"schedule_ids[]": {found.Id},
+		"earliest":       {"true"},
+	}
+	err = p.request("/oncalls?"+query.Encode(), pd.header(p), &oncalls)
+	if err != nil {
+		return nil, err
+	}
+	result := &oncall{Schedule: found.Name}
+	for _, o := range oncalls.Oncalls {
+		if !containsString(result.People, o.User.Summary) {
+			result.People = append(result.People, o.User.Summary)
+		}
+		if !o.End.IsZero() && (result.Until.IsZero() || o.End.Before(result.Until)) {
+			result.Until = o.End
+		}
+	}
+	return result, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -33,18 +33,46 @@ var Plugins = []mup.PluginSpec{{
 	Start:    startBugData,
 	Commands: BugDataCommands,
 }, {
-	Name:  "lpbugwatch",
-	Help:  "Shows status changes on bugs for a selected Launchpad project.",
+	Name: "lpbugwatch",
+	Help: `Shows status changes on bugs for a selected Launchpad project.
+
+	Announcements of bugs being opened and changed may be customized via the "templates"
+	configuration option, mapping the "opened" and "changed" events to templates such as
+	"{{.Title}} <{{.URL}}>". Templates may refer to the bug .Id, .Title, .URL, .Project,
+	.Author, and .Notes holding tags and tasks.
+	`,
 	Start: startBugWatch,
 }, {
 	Name:  "lpmergewatch",
-	Help:  "Shows status changes on merges for a selected Launchpad project.",
+	Help:  "Shows status changes and review votes on merges for a selected Launchpad project.",
 	Start: startMergeWatch,
+}, {
+	Name: "lpquestions",
+	Help: `Reports Launchpad Answers questions via a command and shows changes on them.
+
+	The "question" command displays the details of the provided questions. When the
+	"project" configuration option is set, new questions and status changes on questions
+	of that project are also announced. These announcements may be customized via the
+	"templates" configuration option, mapping the "opened" and "changed" events to
+	templates that may refer to the question .Id, .Title, .URL, .Project, .Author, and .State.
+	`,
+	Start:    startQuestions,
+	Commands: QuestionCommands,
 }, {
 	Name:     "lpcontrib",
 	Help:     "Offers a command for listing people that signed the contributor agreement.",
 	Start:    startContribInfo,
 	Commands: ContribCommands,
+}, {
+	Name: "lppackage",
+	Help: `Offers a command for looking up versions of Ubuntu packages.
+
+	Versions are reported for all supported Ubuntu releases and pockets, and
+	are cached for the duration in the "cachetimeout" configuration option,
+	defaulting to ten minutes.
+	`,
+	Start:    startPackageInfo,
+	Commands: PackageCommands,
 }}
 
 var BugDataCommands = schema.Commands{{
@@ -61,6 +89,33 @@ var BugDataCommands = schema.Commands{{
 	}},
 }}
 
+var QuestionCommands = schema.Commands{{
+	Name: "question",
+	Help: `Displays details of the provided Launchpad Answers questions.
+
+	Questions may be provided by number or URL.
+	`,
+	Args: schema.Args{{
+		Name: "questions",
+		Flag: schema.Trailing | schema.Required,
+	}},
+}}
+
+var PackageCommands = schema.Commands{{
+	Name: "package",
+	Help: `Displays the versions of an Ubuntu source package.
+
+	The versions published in each release and pocket are listed, optionally
+	only for the provided release, as in "package hello jammy".
+	`,
+	Args: schema.Args{{
+		Name: "name",
+		Flag: schema.Required,
+	}, {
+		Name: "release",
+	}},
+}}
+
 var ContribCommands = schema.Commands{{
 	Name: "contrib",
 	Help: `Searches for contributors that have signed the contributor agreement. `,
@@ -76,8 +131,6 @@ func init() {
 	}
 }
 
-var httpClient = http.Client{Timeout: mup.NetworkTimeout}
-
 type pluginMode int
 
 const (
@@ -85,6 +138,8 @@ const (
 	bugWatch
 	mergeWatch
 	contribInfo
+	questionWatch
+	packageInfo
 )
 
 type lpPlugin struct {
@@ -94,6 +149,7 @@ type lpPlugin struct {
 	tomb     tomb.Tomb
 	plugger  *mup.Plugger
 	messages chan *lpMessage
+	ticker   *mup.Ticker
 	config   struct {
 		OAuthAccessToken string
 		OAuthSecretToken string
@@ -108,15 +164,28 @@ type lpPlugin struct {
 		PrefixNew       string
 		PrefixOld       string
 
+		// TrackTasks enables reporting status and importance
+		// changes on the tasks of watched bugs.
+		TrackTasks bool
+
 		JustShownTimeout mup.DurationString
 		PollDelay        mup.DurationString
+		CacheTimeout     mup.DurationString
 	}
 
 	overhear map[mup.Address]bool
 
+	// tasks holds the last known state of the tasks of watched bugs,
+	// by bug id and task target.
+	tasks map[int]map[string]lpTaskState
+
 	justShownList [30]justShownBug
 	justShownNext int
 
+	// packages caches the package versions last looked up, by
+	// package name. Only used by the loop goroutine.
+	packages map[string]*packageVersions
+
 	rand *rand.Rand
 }
 
@@ -131,6 +200,7 @@ const (
 	defaultBugListEndpoint  = "https://launchpad.net/"
 	defaultPollDelay        = 3 * time.Minute
 	defaultJustShownTimeout = 1 * time.Minute
+	defaultCacheTimeout     = 10 * time.Minute
 	defaultPrefixNew        = "Bug #%v opened"
 	defaultPrefixOld        = "Bug #%v changed"
 )
@@ -147,6 +217,12 @@ func startMergeWatch(plugger *mup.Plugger) mup.Stopper {
 func startContribInfo(plugger *mup.Plugger) mup.Stopper {
 	return startPlugin(contribInfo, plugger)
 }
+func startQuestions(plugger *mup.Plugger) mup.Stopper {
+	return startPlugin(questionWatch, plugger)
+}
+func startPackageInfo(plugger *mup.Plugger) mup.Stopper {
+	return startPlugin(packageInfo, plugger)
+}
 
 func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 	if mode == 0 {
@@ -157,6 +233,7 @@ func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 		plugger:  plugger,
 		messages: make(chan *lpMessage, 10),
 		overhear: make(map[mup.Address]bool),
+		packages: make(map[string]*packageVersions),
 		rand:     rand.New(rand.NewSource(time.Now().Unix())),
 	}
 	err := plugger.UnmarshalConfig(&p.config)
@@ -169,6 +246,9 @@ func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 	if p.config.JustShownTimeout.Duration == 0 {
 		p.config.JustShownTimeout.Duration = defaultJustShownTimeout
 	}
+	if p.config.CacheTimeout.Duration == 0 {
+		p.config.CacheTimeout.Duration = defaultCacheTimeout
+	}
 	if p.config.Endpoint == "" {
 		p.config.Endpoint = defaultEndpoint
 	}
@@ -198,12 +278,20 @@ func startPlugin(mode pluginMode, plugger *mup.Plugger) mup.Stopper {
 	}
 
 	switch p.mode {
-	case bugData, contribInfo:
+	case bugData, contribInfo, packageInfo:
 		p.tomb.Go(p.loop)
 	case bugWatch:
+		p.ticker = plugger.NewTicker(p.config.PollDelay.Duration)
 		p.tomb.Go(p.pollBugs)
 	case mergeWatch:
+		p.ticker = plugger.NewTicker(p.config.PollDelay.Duration)
 		p.tomb.Go(p.pollMerges)
+	case questionWatch:
+		p.tomb.Go(p.loop)
+		if p.config.Project != "" {
+			p.ticker = plugger.NewTicker(p.config.PollDelay.Duration)
+			p.tomb.Go(p.pollQuestions)
+		}
 	default:
 		panic("internal error: unknown launchpad plugin mode")
 	}
@@ -217,9 +305,10 @@ func (p *lpPlugin) Stop() error {
 }
 
 type lpMessage struct {
-	msg  *mup.Message
-	cmd  *mup.Command
-	bugs []int
+	msg       *mup.Message
+	cmd       *mup.Command
+	bugs      []int
+	questions []int
 }
 
 func (p *lpPlugin) HandleMessage(msg *mup.Message) {
@@ -230,22 +319,27 @@ func (p *lpPlugin) HandleMessage(msg *mup.Message) {
 	if len(bugs) == 0 {
 		return
 	}
-	p.handleMessage(&lpMessage{msg, nil, bugs}, false)
+	p.handleMessage(&lpMessage{msg, nil, bugs, nil}, false)
 }
 
 func (p *lpPlugin) HandleCommand(cmd *mup.Command) {
-	var bugs []int
-	if p.mode == bugData {
+	var bugs, questions []int
+	var err error
+	switch p.mode {
+	case bugData:
 		var args struct{ Bugs string }
-		var err error
 		cmd.Args(&args)
 		bugs, err = parseBugArgs(args.Bugs)
-		if err != nil {
-			p.plugger.Sendf(cmd, "Oops: %v", err)
-			return
-		}
+	case questionWatch:
+		var args struct{ Questions string }
+		cmd.Args(&args)
+		questions, err = parseQuestionArgs(args.Questions)
 	}
-	p.handleMessage(&lpMessage{cmd.Message, cmd, bugs}, true)
+	if err != nil {
+		p.plugger.Sendf(cmd, "Oops: %v", err)
+		return
+	}
+	p.handleMessage(&lpMessage{cmd.Message, cmd, bugs, questions}, true)
 }
 
 func (p *lpPlugin) handleMessage(lpmsg *lpMessage, reportError bool) {
@@ -271,16 +365,25 @@ func (p *lpPlugin) loop() error {
 }
 
 func (p *lpPlugin) handle(lpmsg *lpMessage) {
-	if p.mode == bugData {
+	switch p.mode {
+	case bugData:
 		overheard := lpmsg.msg.BotText == ""
 		addr := lpmsg.msg.Address()
 		for _, id := range lpmsg.bugs {
 			if overheard && p.justShown(addr, id) {
 				continue
 			}
-			p.showBug(lpmsg.msg, id, "")
+			p.showBug(lpmsg.msg, id, "", "")
 		}
-	} else {
+	case questionWatch:
+		for _, id := range lpmsg.questions {
+			p.showQuestion(lpmsg.msg, id)
+		}
+	case packageInfo:
+		var args struct{ Name, Release string }
+		lpmsg.cmd.Args(&args)
+		p.showPackage(lpmsg.msg, args.Name, args.Release)
+	default:
 		var args struct{ Text string }
 		lpmsg.cmd.Args(&args)
 		p.showContrib(lpmsg.msg, args.Text)
@@ -301,6 +404,7 @@ type lpBug struct {
 	Title     string   `json:"title"`
 	Tags      []string `json:"tags"`
 	TasksLink string   `json:"bug_tasks_collection_link"`
+	OwnerLink string   `json:"owner_link"`
 }
 
 type lpBugTasks struct {
@@ -310,10 +414,18 @@ type lpBugTasks struct {
 type lpBugEntry struct {
 	Target       string `json:"bug_target_display_name"`
 	Status       string `json:"status"`
+	Importance   string `json:"importance"`
 	AssigneeLink string `json:"assignee_link"`
 }
 
-func (p *lpPlugin) showBug(msg *mup.Message, bugId int, prefix string) {
+type lpTaskState struct {
+	status     string
+	importance string
+}
+
+// showBug reports the bug with the provided id to msg, or announces it
+// as the given event to all targets if msg is nil.
+func (p *lpPlugin) showBug(msg *mup.Message, bugId int, prefix, event string) {
 	var bug lpBug
 	var tasks lpBugTasks
 	err := p.request("/bugs/"+strconv.Itoa(bugId), &bug)
@@ -339,11 +451,25 @@ func (p *lpPlugin) showBug(msg *mup.Message, bugId int, prefix string) {
 	if !strings.Contains(prefix, "%v") || strings.Count(prefix, "%") > 1 {
 		prefix = "Bug #%v"
 	}
+	notes := p.formatNotes(&bug, &tasks)
 	format := prefix + ": %s%s <https://launchpad.net/bugs/%d>"
-	args := []interface{}{bugId, bug.Title, p.formatNotes(&bug, &tasks), bugId}
+	args := []interface{}{bugId, bug.Title, notes, bugId}
 	switch {
 	case msg == nil:
-		p.plugger.Broadcastf(format, args...)
+		var author string
+		if i := strings.Index(bug.OwnerLink, "~"); i > 0 {
+			author = bug.OwnerLink[i+1:]
+		}
+		p.plugger.Announce(&mup.Announcement{
+			Event:   event,
+			Text:    fmt.Sprintf(format, args...),
+			Id:      strconv.Itoa(bugId),
+			Title:   bug.Title,
+			URL:     fmt.Sprintf("https://launchpad.net/bugs/%d", bugId),
+			Project: p.config.Project,
+			Author:  author,
+			Notes:   strings.TrimSpace(notes),
+		})
 	case msg.BotText == "":
 		p.plugger.SendChannelf(msg, format, args...)
 		addr := msg.Address()
@@ -440,7 +566,7 @@ func (p *lpPlugin) request(url string, result interface{}) error {
 	if p.config.AuthCookie != "" {
 		req.Header.Add("Cookie", "lp="+p.config.AuthCookie)
 	}
-	resp, err := httpClient.Do(req)
+	resp, err := p.plugger.HTTPClient().Do(req)
 	if err == nil && resp.StatusCode == 404 {
 		resp.Body.Close()
 		return errNotFound
@@ -474,6 +600,7 @@ func (p *lpPlugin) request(url string, result interface{}) error {
 
 var bugChat = regexp.MustCompile(`(?i)(?:bugs?[ /]#?([0-9]+)|(?:^|\W)#([0-9]{5,}))`)
 var bugArg = regexp.MustCompile(`^(?i)(?:.*bugs?/)?#?([0-9]+)$`)
+var questionArg = regexp.MustCompile(`^(?i)(?:.*questions?/)?#?([0-9]+)$`)
 
 func parseBugChat(text string) []int {
 	var bugs []int
@@ -503,22 +630,32 @@ func containsInt(ns []int, n int) bool {
 }
 
 func parseBugArgs(text string) ([]int, error) {
-	var bugs []int
+	return parseIdArgs(text, bugArg, "bug")
+}
+
+func parseQuestionArgs(text string) ([]int, error) {
+	return parseIdArgs(text, questionArg, "question")
+}
+
+// parseIdArgs returns the distinct ids of the given kind in text, each
+// matched by exp with the id in its first group.
+func parseIdArgs(text string, exp *regexp.Regexp, kind string) ([]int, error) {
+	var ids []int
 	for _, s := range strings.Fields(text) {
-		match := bugArg.FindStringSubmatch(s)
+		match := exp.FindStringSubmatch(s)
 		if match == nil {
-			return nil, fmt.Errorf("cannot parse bug id from argument: %s", s)
+			return nil, fmt.Errorf("cannot parse %s id from argument: %s", kind, s)
 		}
 		s := match[1]
 		id, err := strconv.Atoi(s)
 		if err != nil {
-			panic("bug id not an int, which must never happen (regexp is broken)")
+			panic(kind + " id not an int, which must never happen (regexp is broken)")
 		}
-		if !containsInt(bugs, id) {
-			bugs = append(bugs, id)
+		if !containsInt(ids, id) {
+			ids = append(ids, id)
 		}
 	}
-	return bugs, nil
+	return ids, nil
 }
 
 func parseBugList(data string) []int {
@@ -535,11 +672,15 @@ func parseBugList(data string) []int {
 }
 
 func (p *lpPlugin) pollBugs() error {
+	defer p.ticker.Stop()
+	if p.config.TrackTasks {
+		p.loadTasks()
+	}
 	var oldBugs []int
 	var first = true
 	for {
 		select {
-		case <-time.After(p.config.PollDelay.Duration):
+		case <-p.ticker.C:
 		case <-p.tomb.Dying():
 			return nil
 		}
@@ -550,6 +691,12 @@ func (p *lpPlugin) pollBugs() error {
 			continue
 		}
 
+		if p.config.TrackTasks {
+			for _, bugId := range newBugs {
+				p.trackTasks(bugId)
+			}
+		}
+
 		if first {
 			first = false
 			oldBugs = newBugs
@@ -576,14 +723,14 @@ func (p *lpPlugin) pollBugs() error {
 			p.showManyBugs(showOldBugs, p.config.PrefixOld)
 		} else {
 			for _, bugId := range showOldBugs {
-				p.showBug(nil, bugId, p.config.PrefixOld)
+				p.showBug(nil, bugId, p.config.PrefixOld, "changed")
 			}
 		}
 		if len(showNewBugs) > 3 {
 			p.showManyBugs(showNewBugs, p.config.PrefixNew)
 		} else {
 			for _, bugId := range showNewBugs {
-				p.showBug(nil, bugId, p.config.PrefixNew)
+				p.showBug(nil, bugId, p.config.PrefixNew, "opened")
 			}
 		}
 		oldBugs = newBugs
@@ -591,6 +738,75 @@ func (p *lpPlugin) pollBugs() error {
 	return nil
 }
 
+// loadTasks loads the task states persisted by earlier runs, so that
+// changes made while the plugin was not running are also reported.
+func (p *lpPlugin) loadTasks() {
+	p.tasks = make(map[int]map[string]lpTaskState)
+	db := p.plugger.DB()
+	if db == nil {
+		return
+	}
+	rows, err := db.Query("SELECT bug,target,status,importance FROM bugtask WHERE plugin=?", p.plugger.Name())
+	if err != nil {
+		p.plugger.Logf("Cannot load bug task states: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bugId int
+		var target string
+		var state lpTaskState
+		if err := rows.Scan(&bugId, &target, &state.status, &state.importance); err != nil {
+			p.plugger.Logf("Cannot load bug task states: %v", err)
+			return
+		}
+		if p.tasks[bugId] == nil {
+			p.tasks[bugId] = make(map[string]lpTaskState)
+		}
+		p.tasks[bugId][target] = state
+	}
+}
+
+// trackTasks reports changes on the tasks of the given bug since their
+// state was last observed, and records their current state.
+func (p *lpPlugin) trackTasks(bugId int) {
+	var tasks lpBugTasks
+	if err := p.request("/bugs/"+strconv.Itoa(bugId)+"/bug_tasks", &tasks); err != nil {
+		return
+	}
+	known := p.tasks[bugId]
+	if known == nil {
+		known = make(map[string]lpTaskState)
+		p.tasks[bugId] = known
+	}
+	for _, entry := range tasks.Entries {
+		state := lpTaskState{entry.Status, entry.Importance}
+		old, ok := known[entry.Target]
+		if ok && old == state {
+			continue
+		}
+		known[entry.Target] = state
+		if db := p.plugger.DB(); db != nil {
+			_, err := db.Exec("INSERT OR REPLACE INTO bugtask (plugin,bug,target,status,importance) VALUES (?,?,?,?,?)",
+				p.plugger.Name(), bugId, entry.Target, state.status, state.importance)
+			if err != nil {
+				p.plugger.Logf("Cannot record bug task state: %v", err)
+			}
+		}
+		if !ok {
+			continue
+		}
+		var changes []string
+		if old.status != state.status {
+			changes = append(changes, old.status+" → "+state.status)
+		}
+		if old.importance != state.importance {
+			changes = append(changes, old.importance+" → "+state.importance)
+		}
+		p.plugger.Broadcastf("Bug #%d changed on %s: %s <https://launchpad.net/bugs/%d>", bugId, entry.Target, strings.Join(changes, ", "), bugId)
+	}
+}
+
 type lpMerges struct {
 	Entries []lpMergeEntry
 }
@@ -599,6 +815,20 @@ type lpMergeEntry struct {
 	SelfLink    string `json:"self_link"`
 	Status      string `json:"queue_status"`
 	Description string `json:"description"`
+
+	TargetBranchLink  string `json:"target_branch_link"`
+	TargetGitRepoLink string `json:"target_git_repository_link"`
+	TargetGitPath     string `json:"target_git_path"`
+	CommentsLink      string `json:"all_comments_collection_link"`
+}
+
+type lpComments struct {
+	Entries []lpCommentEntry
+}
+
+type lpCommentEntry struct {
+	AuthorLink string `json:"author_link"`
+	Vote       string `json:"vote"`
 }
 
 func (e *lpMergeEntry) Id() (id int, ok bool) {
@@ -621,12 +851,39 @@ func (e *lpMergeEntry) URL() (url string, ok bool) {
 	return "https://launchpad.net/" + e.SelfLink[i:], true
 }
 
+// Target returns the merge target in a form that may be used with bzr or git,
+// such as "lp:~user/project/trunk" or "lp:~user/project/+git/repo:master".
+func (e *lpMergeEntry) Target() (target string, ok bool) {
+	if i := strings.Index(e.TargetBranchLink, "~"); i >= 0 {
+		return "lp:" + e.TargetBranchLink[i:], true
+	}
+	if i := strings.Index(e.TargetGitRepoLink, "~"); i >= 0 {
+		target = "lp:" + e.TargetGitRepoLink[i:]
+		if e.TargetGitPath != "" {
+			target += ":" + strings.TrimPrefix(e.TargetGitPath, "refs/heads/")
+		}
+		return target, true
+	}
+	return "", false
+}
+
+// votesDone reports whether the merge proposal is closed for reviews.
+func (e *lpMergeEntry) votesDone() bool {
+	switch e.Status {
+	case "Merged", "Rejected", "Superseded":
+		return true
+	}
+	return false
+}
+
 func (p *lpPlugin) pollMerges() error {
+	defer p.ticker.Stop()
 	oldMerges := make(map[int]string)
+	oldVotes := make(map[int]map[string]string)
 	first := true
 	for {
 		select {
-		case <-time.After(p.config.PollDelay.Duration):
+		case <-p.ticker.C:
 		case <-p.tomb.Dying():
 			return nil
 		}
@@ -639,15 +896,56 @@ func (p *lpPlugin) pollMerges() error {
 
 		for _, merge := range newMerges.Entries {
 			id, ok := merge.Id()
-			if !ok || oldMerges[id] == merge.Status {
+			if !ok {
+				continue
+			}
+			url, urlOk := merge.URL()
+			on := ""
+			if target, ok := merge.Target(); ok {
+				on = " on " + target
+			}
+			if oldMerges[id] != merge.Status {
+				oldMerges[id] = merge.Status
+				if urlOk && !first {
+					p.plugger.Broadcastf("Merge proposal changed [%s]%s: %s <%s>", strings.ToLower(merge.Status), on, firstSentence(merge.Description), url)
+				}
+			}
+			if merge.CommentsLink == "" || merge.votesDone() {
 				continue
 			}
-			oldMerges[id] = merge.Status
-			url, ok := merge.URL()
-			if !ok || first {
+			var comments lpComments
+			if err := p.request(merge.CommentsLink, &comments); err != nil {
 				continue
 			}
-			p.plugger.Broadcastf("Merge proposal changed [%s]: %s <%s>", strings.ToLower(merge.Status), firstSentence(merge.Description), url)
+			votes := oldVotes[id]
+			if votes == nil {
+				votes = make(map[string]string)
+				oldVotes[id] = votes
+			}
+			// Only the latest vote of each reviewer counts.
+			var reviewers []string
+			latest := make(map[string]string)
+			for _, comment := range comments.Entries {
+				i := strings.LastIndex(comment.AuthorLink, "~")
+				if comment.Vote == "" || i < 0 {
+					continue
+				}
+				reviewer := comment.AuthorLink[i+1:]
+				if _, ok := latest[reviewer]; !ok {
+					reviewers = append(reviewers, reviewer)
+				}
+				latest[reviewer] = comment.Vote
+			}
+			for _, reviewer := range reviewers {
+				vote := latest[reviewer]
+				if votes[reviewer] == vote {
+					continue
+				}
+				votes[reviewer] = vote
+				if urlOk && !first {
+					p.plugger.Broadcastf("Merge proposal reviewed [%s] by %s%s: %s <%s>", strings.ToLower(vote), reviewer, on, firstSentence(merge.Description), url)
+				}
+			}
 		}
 		first = false
 	}
@@ -670,6 +968,116 @@ func firstSentence(s string) string {
 	return s
 }
 
+type lpQuestions struct {
+	Entries []lpQuestion `json:"entries"`
+}
+
+type lpQuestion struct {
+	Id           int    `json:"id"`
+	Title        string `json:"title"`
+	Status       string `json:"status"`
+	OwnerLink    string `json:"owner_link"`
+	AnswererLink string `json:"answerer_link"`
+	WebLink      string `json:"web_link"`
+}
+
+// lpUsername returns the username in a Launchpad person link such
+// as "https://api.launchpad.net/1.0/~joe", or the empty string.
+func lpUsername(link string) string {
+	if i := strings.LastIndex(link, "~"); i >= 0 {
+		return link[i+1:]
+	}
+	return ""
+}
+
+func (q *lpQuestion) text(format string, args ...interface{}) string {
+	text := fmt.Sprintf(format, args...)
+	if q.WebLink != "" {
+		text += " <" + q.WebLink + ">"
+	}
+	return text
+}
+
+func (p *lpPlugin) showQuestion(msg *mup.Message, id int) {
+	var q lpQuestion
+	err := p.request("/questions/"+strconv.Itoa(id), &q)
+	if err == errNotFound {
+		p.plugger.Sendf(msg, "Question not found.")
+		return
+	}
+	if err != nil {
+		p.plugger.Sendf(msg, "Oops: %v", err)
+		return
+	}
+	status := q.Status
+	if answerer := lpUsername(q.AnswererLink); answerer != "" {
+		status += " by " + answerer
+	}
+	p.plugger.Sendf(msg, "%s", q.text("Question #%d: %s <%s>", id, q.Title, status))
+}
+
+// questionStatuses holds all question statuses, so that searches report
+// closed questions as well as open ones.
+const questionStatuses = "&status=Open&status=Needs+information&status=Answered&status=Solved&status=Expired&status=Invalid"
+
+func (p *lpPlugin) pollQuestions() error {
+	defer p.ticker.Stop()
+	oldStatus := make(map[int]string)
+	lastId := 0
+	first := true
+	for {
+		select {
+		case <-p.ticker.C:
+		case <-p.tomb.Dying():
+			return nil
+		}
+
+		var questions lpQuestions
+		err := p.request("/"+p.config.Project+"?ws.op=searchQuestions&sort=recently+updated+first"+questionStatuses, &questions)
+		if err != nil {
+			continue
+		}
+
+		// Questions come most recently updated first, and are announced
+		// in the order the changes happened. Only questions created after
+		// the ones seen before are taken as new, as older ones may just
+		// be reappearing in the results.
+		seenId := lastId
+		for i := len(questions.Entries) - 1; i >= 0; i-- {
+			q := &questions.Entries[i]
+			old, known := oldStatus[q.Id]
+			oldStatus[q.Id] = q.Status
+			if q.Id > lastId {
+				lastId = q.Id
+			}
+			a := &mup.Announcement{
+				Id:      strconv.Itoa(q.Id),
+				Title:   q.Title,
+				URL:     q.WebLink,
+				Project: p.config.Project,
+				State:   q.Status,
+			}
+			switch {
+			case first:
+				continue
+			case !known && q.Id > seenId:
+				a.Event = "opened"
+				a.Author = lpUsername(q.OwnerLink)
+				a.Text = q.text("Question #%d opened: %s", q.Id, q.Title)
+			case known && old != q.Status:
+				a.Event = "changed"
+				a.Author = lpUsername(q.AnswererLink)
+				a.Text = q.text("Question #%d changed [%s]: %s", q.Id, strings.ToLower(q.Status), q.Title)
+			default:
+				continue
+			}
+			p.plugger.Announce(a)
+		}
+		first = false
+	}
+	return nil
+}
+
 type lpPersonList struct {
 	TotalSize int        `json:"total_size"`
 	Start     int        `json:"start"`
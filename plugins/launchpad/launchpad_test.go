@@ -33,6 +33,8 @@ type lpTest struct {
 	bugsForm url.Values
 	status   int
 	headers  map[string]mup.Map
+
+	taskChanges bool
 }
 
 var lpTests = []lpTest{
@@ -148,6 +150,22 @@ var lpTests = []lpTest{
 			"PRIVMSG #chan :Bug # is old: 111, 222, 444, 555",
 			"PRIVMSG #chan :Bug # is new: 666, 777, 888, 999",
 		},
+	}, {
+		// Tracking of bug task changes.
+		plugin: "lpbugwatch",
+		config: mup.Map{
+			"project":    "some-project",
+			"polldelay":  "50ms",
+			"tracktasks": true,
+		},
+		targets: []mup.Target{
+			{Account: "test", Channel: "#chan"},
+		},
+		bugsText:    [][]int{{111}},
+		taskChanges: true,
+		recv: []string{
+			"PRIVMSG #chan :Bug #111 changed on Some Project: New → In Progress, Undecided → High <https://launchpad.net/bugs/111>",
+		},
 	}, {
 		// Polling of merge changes.
 		plugin: "lpmergewatch",
@@ -164,6 +182,22 @@ var lpTests = []lpTest{
 			"PRIVMSG #chan :Merge proposal changed [approved]: Branch description. <https://launchpad.net/~user/+merge/111>",
 			"PRIVMSG #chan :Merge proposal changed [rejected]: Branch description with a very long first line that never ends and continues (...) <https://launchpad.net/~user/+merge/444>",
 		},
+	}, {
+		// Polling of merge review votes.
+		plugin: "lpmergewatch",
+		config: mup.Map{
+			"project":   "vote-project",
+			"polldelay": "50ms",
+		},
+		targets: []mup.Target{
+			{Account: "test", Channel: "#chan"},
+		},
+		recv: []string{
+			"PRIVMSG #chan :Merge proposal reviewed [needs fixing] by joe on lp:~user/vote-project/trunk: Vote me. <https://launchpad.net/~user/vote-project/+merge/555>",
+			"PRIVMSG #chan :Merge proposal changed [approved] on lp:~user/vote-project/trunk: Vote me. <https://launchpad.net/~user/vote-project/+merge/555>",
+			"PRIVMSG #chan :Merge proposal reviewed [approve] by joe on lp:~user/vote-project/trunk: Vote me. <https://launchpad.net/~user/vote-project/+merge/555>",
+			"PRIVMSG #chan :Merge proposal reviewed [approve] by ann on lp:~user/vote-project/trunk: Vote me. <https://launchpad.net/~user/vote-project/+merge/555>",
+		},
 	}, {
 		// OAuth authorization header.
 		plugin: "lpbugdata",
@@ -236,6 +270,73 @@ var lpTests = []lpTest{
 			"PRIVMSG nick : - Awesome Joe <https://launchpad.net/~wsome>",
 			"PRIVMSG nick : - Redacted Preferred <https://launchpad.net/~redpref> <redpref@email.com> <redpref@example.com>",
 		},
+	}, {
+		// Question ids are numeric.
+		plugin: "lpquestions",
+		send:   []string{"question foo"},
+		recv:   []string{"PRIVMSG nick :Oops: cannot parse question id from argument: foo"},
+	}, {
+		// Questions may be provided by number or URL.
+		plugin: "lpquestions",
+		send:   []string{"question #123 https://answers.launchpad.net/some-project/+question/124"},
+		recv: []string{
+			"PRIVMSG nick :Question #123: Title of 123 <Answered by ann> <https://answers.launchpad.net/some-project/+question/123>",
+			"PRIVMSG nick :Question #124: Title of 124 <Open> <https://answers.launchpad.net/some-project/+question/124>",
+		},
+	}, {
+		plugin: "lpquestions",
+		send:   []string{"question 404"},
+		recv:   []string{"PRIVMSG nick :Question not found."},
+	}, {
+		// New questions and status changes are announced.
+		plugin: "lpquestions",
+		config: mup.Map{
+			"project":   "some-project",
+			"polldelay": "50ms",
+		},
+		targets: []mup.Target{
+			{Account: "test", Channel: "#chan"},
+		},
+		recv: []string{
+			"PRIVMSG #chan :Question #111 changed [answered]: Title of 111 <https://answers.launchpad.net/some-project/+question/111>",
+			"PRIVMSG #chan :Question #444 opened: Title of 444 <https://answers.launchpad.net/some-project/+question/444>",
+			"PRIVMSG #chan :Question #333 opened: Title of 333 <https://answers.launchpad.net/some-project/+question/333>",
+		},
+	}, {
+		// Announcements may be customized via templates.
+		plugin: "lpquestions",
+		config: mup.Map{
+			"project":   "some-project",
+			"polldelay": "50ms",
+			"templates": mup.Map{
+				"opened":  "{{.Author}} asked: {{.Title}}",
+				"changed": "{{.Project}} question {{.Id}} is now {{.State}} by {{.Author}}",
+			},
+		},
+		targets: []mup.Target{
+			{Account: "test", Channel: "#chan"},
+		},
+		recv: []string{
+			"PRIVMSG #chan :some-project question 111 is now Answered by ann",
+			"PRIVMSG #chan :joe asked: Title of 444",
+			"PRIVMSG #chan :joe asked: Title of 333",
+		},
+	}, {
+		// Package versions across releases and pockets.
+		plugin: "lppackage",
+		send:   []string{"package hello"},
+		recv:   []string{"PRIVMSG nick :Package hello: 2.10-3 in noble, 2.10-2ubuntu4 in jammy and jammy-security/updates, 2.10-2ubuntu4.1 in jammy-proposed"},
+	}, {
+		plugin: "lppackage",
+		send:   []string{"package hello jammy", "package hello focal"},
+		recv: []string{
+			"PRIVMSG nick :Package hello: 2.10-2ubuntu4 in jammy and jammy-security/updates, 2.10-2ubuntu4.1 in jammy-proposed",
+			"PRIVMSG nick :Package hello is not published in focal.",
+		},
+	}, {
+		plugin: "lppackage",
+		send:   []string{"package unknown"},
+		recv:   []string{"PRIVMSG nick :Package not found."},
 	},
 }
 
@@ -253,8 +354,9 @@ func (s *S) TestLaunchpad(c *C) {
 	for i, test := range lpTests {
 		c.Logf("Testing message #%d: %s", i, test.send)
 		server := lpServer{
-			bugsText: test.bugsText,
-			status:   test.status,
+			bugsText:    test.bugsText,
+			status:      test.status,
+			taskChanges: test.taskChanges,
 		}
 		server.Start()
 		if test.config == nil {
@@ -268,7 +370,7 @@ func (s *S) TestLaunchpad(c *C) {
 		tester.Start()
 		tester.SendAll(test.send)
 		if test.config["polldelay"] != "" {
-			time.Sleep(250 * time.Millisecond)
+			tester.AdvanceTime(200 * time.Millisecond)
 		}
 		tester.Stop()
 		server.Stop()
@@ -289,6 +391,47 @@ func (s *S) TestLaunchpad(c *C) {
 	}
 }
 
+func (s *S) TestTrackTasksPersisted(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO bugtask (plugin,bug,target,status,importance) VALUES ('lpbugwatch',111,'Some Project','Triaged','Medium')")
+	c.Assert(err, IsNil)
+
+	server := lpServer{bugsText: [][]int{{111}}}
+	server.Start()
+	tester := mup.NewPluginTester("lpbugwatch")
+	tester.SetDB(db)
+	tester.SetConfig(mup.Map{
+		"endpoint":        server.URL(),
+		"buglistendpoint": server.URL(),
+		"project":         "some-project",
+		"polldelay":       "50ms",
+		"tracktasks":      true,
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+	tester.AdvanceTime(200 * time.Millisecond)
+	tester.Stop()
+	server.Stop()
+
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG #chan :Bug #111 changed on Some Project: Triaged → New, Medium → Undecided <https://launchpad.net/bugs/111>",
+	})
+
+	var states []string
+	rows, err := db.Query("SELECT bug,target,status,importance FROM bugtask ORDER BY target")
+	c.Assert(err, IsNil)
+	for rows.Next() {
+		var bug int
+		var target, status, importance string
+		c.Assert(rows.Scan(&bug, &target, &status, &importance), IsNil)
+		states = append(states, fmt.Sprintf("%d/%s/%s/%s", bug, target, status, importance))
+	}
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(states, DeepEquals, []string{"111/Other/Confirmed/Low", "111/Some Project/New/Undecided"})
+}
+
 func (s *S) TestJustShown(c *C) {
 	server := lpServer{}
 	server.Start()
@@ -324,6 +467,23 @@ func (s *S) TestJustShown(c *C) {
 	})
 }
 
+func (s *S) TestPackageCache(c *C) {
+	server := lpServer{}
+	server.Start()
+	defer server.Stop()
+	tester := mup.NewPluginTester("lppackage")
+	tester.SetConfig(mup.Map{"endpoint": server.URL()})
+	tester.Start()
+	tester.Sendf("package hello noble")
+	tester.Sendf("package hello jammy")
+	tester.Stop()
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG nick :Package hello: 2.10-3 in noble",
+		"PRIVMSG nick :Package hello: 2.10-2ubuntu4 in jammy and jammy-security/updates, 2.10-2ubuntu4.1 in jammy-proposed",
+	})
+	c.Assert(server.sourcesResp, Equals, 1)
+}
+
 type lpServer struct {
 	server *httptest.Server
 
@@ -337,6 +497,16 @@ type lpServer struct {
 
 	mergesResp int
 
+	questionsResp int
+
+	sourcesResp int
+
+	taskChanges bool
+	tasksResp   int
+
+	votesResp    int
+	commentsResp int
+
 	headers map[string]http.Header
 }
 
@@ -367,6 +537,16 @@ func (s *lpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		s.serveBugsText(w, req)
 	case strings.HasPrefix(req.URL.Path, "/some-project") && req.FormValue("ws.op") == "getMergeProposals":
 		s.serveMerges(w, req)
+	case strings.HasPrefix(req.URL.Path, "/some-project") && req.FormValue("ws.op") == "searchQuestions":
+		s.serveQuestions(w, req)
+	case req.URL.Path == "/ubuntu/+archive/primary" && req.FormValue("ws.op") == "getPublishedSources":
+		s.serveSources(w, req)
+	case strings.HasPrefix(req.URL.Path, "/questions/"):
+		s.serveQuestion(w, req)
+	case strings.HasPrefix(req.URL.Path, "/vote-project") && req.FormValue("ws.op") == "getMergeProposals":
+		s.serveVoteMerges(w, req)
+	case req.URL.Path == "/~user/vote-project/+merge/555/all_comments":
+		s.serveComments(w, req)
 	case strings.HasPrefix(req.URL.Path, "/people"):
 		s.servePeople(w, req)
 	default:
@@ -392,10 +572,15 @@ func (s *lpServer) serveBug(w http.ResponseWriter, req *http.Request) {
 	}
 	var res string
 	if tasks {
+		status, importance := "New", "Undecided"
+		if s.taskChanges && s.tasksResp > 0 {
+			status, importance = "In Progress", "High"
+		}
+		s.tasksResp++
 		res = fmt.Sprintf(`{"entries": [
-			{"status": "New", "bug_target_display_name": "Some Project"},
-			{"status": "Confirmed", "bug_target_display_name": "Other", "assignee_link": "foo/~joe"}
-		]}`)
+			{"status": %q, "importance": %q, "bug_target_display_name": "Some Project"},
+			{"status": "Confirmed", "importance": "Low", "bug_target_display_name": "Other", "assignee_link": "foo/~joe"}
+		]}`, status, importance)
 	} else if id == 123 {
 		res = fmt.Sprintf(`{
 			"title": "Title of %d",
@@ -447,6 +632,116 @@ func (s *lpServer) serveMerges(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte(`{"entries": [` + strings.Join(entries, ",") + `]}`))
 }
 
+func lpQuestionJSON(id int, status, answerer string) string {
+	res := fmt.Sprintf(`{"id": %d, "title": "Title of %d", "status": %q, "owner_link": "foo/~joe",
+		"web_link": "https://answers.launchpad.net/some-project/+question/%d"`, id, id, status, id)
+	if answerer != "" {
+		res += fmt.Sprintf(`, "answerer_link": "foo/~%s"`, answerer)
+	}
+	return res + "}"
+}
+
+func (s *lpServer) serveQuestion(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/questions/"))
+	if err != nil {
+		panic("invalid question URL: " + req.URL.Path)
+	}
+	if id == 404 {
+		w.WriteHeader(404)
+		return
+	}
+	if id == 123 {
+		w.Write([]byte(lpQuestionJSON(id, "Answered", "ann")))
+	} else {
+		w.Write([]byte(lpQuestionJSON(id, "Open", "")))
+	}
+}
+
+func (s *lpServer) serveQuestions(w http.ResponseWriter, req *http.Request) {
+	if len(req.Form["status"]) != 6 {
+		panic("questions search missing statuses: " + req.URL.RawQuery)
+	}
+	var entries []string
+	switch s.questionsResp {
+	case 0:
+		entries = []string{lpQuestionJSON(222, "Open", ""), lpQuestionJSON(111, "Open", "")}
+		s.questionsResp++
+	default:
+		// Questions are sorted by the most recent update, so question 333
+		// is announced after 444 even though it was created first.
+		// Question 100 was never seen but is old, and is not announced.
+		entries = []string{
+			lpQuestionJSON(333, "Open", ""),
+			lpQuestionJSON(444, "Open", ""),
+			lpQuestionJSON(222, "Open", ""),
+			lpQuestionJSON(100, "Solved", ""),
+			lpQuestionJSON(111, "Answered", "ann"),
+		}
+	}
+	w.Write([]byte(`{"entries": [` + strings.Join(entries, ",") + `]}`))
+}
+
+func (s *lpServer) serveSources(w http.ResponseWriter, req *http.Request) {
+	s.sourcesResp++
+	if req.FormValue("source_name") != "hello" {
+		w.Write([]byte(`{"entries": []}`))
+		return
+	}
+	source := func(version, series, pocket string) string {
+		return fmt.Sprintf(`{"source_package_version": %q, "distro_series_link": "%s/ubuntu/%s", "pocket": %q}`,
+			version, s.URL(), series, pocket)
+	}
+	w.Write([]byte(`{"entries": [` + strings.Join([]string{
+		source("2.10-3", "noble", "Release"),
+		source("2.10-2ubuntu4.1", "jammy", "Proposed"),
+		source("2.10-2ubuntu4", "jammy", "Updates"),
+		source("2.10-2ubuntu4", "jammy", "Security"),
+		source("2.10-2ubuntu4", "jammy", "Release"),
+	}, ",") + `]}`))
+}
+
+func (s *lpServer) serveVoteMerges(w http.ResponseWriter, req *http.Request) {
+	status := "Needs Review"
+	if s.votesResp > 1 {
+		status = "Approved"
+	}
+	if s.votesResp < 2 {
+		s.votesResp++
+	}
+	fmt.Fprintf(w, `{"entries": [{
+		"queue_status": %q,
+		"self_link": "http://foo/~user/vote-project/+merge/555",
+		"description": "Vote me.",
+		"target_branch_link": "http://foo/~user/vote-project/trunk",
+		"all_comments_collection_link": "%s/~user/vote-project/+merge/555/all_comments"
+	}, {
+		"queue_status": "Merged",
+		"self_link": "http://foo/~user/vote-project/+merge/666",
+		"description": "Merged already.",
+		"all_comments_collection_link": "%s/~user/vote-project/+merge/666/all_comments"
+	}]}`, status, s.URL(), s.URL())
+}
+
+func (s *lpServer) serveComments(w http.ResponseWriter, req *http.Request) {
+	e := []string{
+		`{"author_link": "http://foo/~joe", "vote": "Needs Fixing"}`,
+		`{"author_link": "http://foo/~bob"}`,
+		`{"author_link": "http://foo/~joe", "vote": "Approve"}`,
+		`{"author_link": "http://foo/~ann", "vote": "Approve"}`,
+	}
+	var entries []string
+	switch s.commentsResp {
+	case 0:
+		s.commentsResp++
+	case 1:
+		entries = e[:2]
+		s.commentsResp++
+	default:
+		entries = e
+	}
+	w.Write([]byte(`{"entries": [` + strings.Join(entries, ",") + `]}`))
+}
+
 func (s *lpServer) servePeople(w http.ResponseWriter, req *http.Request) {
 	path := strings.TrimPrefix(req.URL.Path, "/people/")
 	if user := strings.TrimSuffix(path, "/membership"); user != path {
@@ -0,0 +1,122 @@
+package launchpad
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+)
+
+type lpSources struct {
+	Entries []lpSource `json:"entries"`
+}
+
+type lpSource struct {
+	Version          string `json:"source_package_version"`
+	DistroSeriesLink string `json:"distro_series_link"`
+	Pocket           string `json:"pocket"`
+}
+
+func (s *lpSource) series() string {
+	return s.DistroSeriesLink[strings.LastIndex(s.DistroSeriesLink, "/")+1:]
+}
+
+// packageVersions holds the sources of a package published in Ubuntu
+// as last looked up.
+type packageVersions struct {
+	sources []lpSource
+	when    time.Time
+}
+
+// pocketOrder holds the archive pockets in the order they are reported.
+var pocketOrder = []string{"Release", "Security", "Updates", "Proposed", "Backports"}
+
+func (p *lpPlugin) packageSources(name string) ([]lpSource, error) {
+	if cached, ok := p.packages[name]; ok && time.Since(cached.when) < p.config.CacheTimeout.Duration {
+		return cached.sources, nil
+	}
+	var sources lpSources
+	err := p.request("/ubuntu/+archive/primary?ws.op=getPublishedSources&exact_match=true&status=Published&source_name="+url.QueryEscape(name), &sources)
+	if err != nil {
+		return nil, err
+	}
+	p.packages[name] = &packageVersions{sources.Entries, time.Now()}
+	return sources.Entries, nil
+}
+
+func (p *lpPlugin) showPackage(to mup.Addressable, name, release string) {
+	sources, err := p.packageSources(name)
+	if err != nil {
+		p.plugger.Sendf(to, "Oops: %v", err)
+		return
+	}
+
+	// Versions are grouped per release, with the pockets holding the
+	// same version of a release reported together as in "jammy-security/updates".
+	type version struct {
+		series  string
+		version string
+		pockets []string
+	}
+	var versions []*version
+	for _, pocket := range pocketOrder {
+	NextSource:
+		for i := range sources {
+			s := &sources[i]
+			series := s.series()
+			if s.Pocket != pocket || release != "" && series != release {
+				continue
+			}
+			for _, v := range versions {
+				if v.series == series && v.version == s.Version {
+					v.pockets = append(v.pockets, strings.ToLower(pocket))
+					continue NextSource
+				}
+			}
+			versions = append(versions, &version{series, s.Version, []string{strings.ToLower(pocket)}})
+		}
+	}
+	if len(versions) == 0 {
+		if release != "" {
+			p.plugger.Sendf(to, "Package %s is not published in %s.", name, release)
+		} else {
+			p.plugger.Sendf(to, "Package not found.")
+		}
+		return
+	}
+
+	// Releases are reported in the order the archive lists them, which
+	// is most recent publication first.
+	var order []string
+	for i := range sources {
+		if series := sources[i].series(); !containsString(order, series) {
+			order = append(order, series)
+		}
+	}
+	var parts []string
+	for _, series := range order {
+		for _, v := range versions {
+			if v.series != series {
+				continue
+			}
+			where := series
+			if v.pockets[0] != "release" {
+				where += "-" + strings.Join(v.pockets, "/")
+			} else if len(v.pockets) > 1 {
+				where += " and " + series + "-" + strings.Join(v.pockets[1:], "/")
+			}
+			parts = append(parts, v.version+" in "+where)
+		}
+	}
+	p.plugger.Sendf(to, "Package %s: %s", name, strings.Join(parts, ", "))
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
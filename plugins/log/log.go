@@ -39,9 +39,9 @@ func (p *logPlugin) HandleOutgoing(msg *mup.Message) {
 }
 
 // TODO These were copied from message.go. We need a reasonable way of not duplicating that.
-const messageColumns = "id,nonce,lane,time,account,channel,nick,user,host,command,param0,param1,param2,param3,text,bottext,bang,asnick"
-const messagePlacers = "?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?"
+const messageColumns = "id,nonce,lane,time,account,channel,nick,user,host,command,param0,param1,param2,param3,text,bottext,bang,asnick,attachment,buttons,priority,replyto,forwardfrom,threadid,tags,playback"
+const messagePlacers = "?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?"
 
 func messageRefs(m *mup.Message) []interface{} {
-	return []interface{}{&m.Id, &m.Nonce, &m.Lane, &m.Time, &m.Account, &m.Channel, &m.Nick, &m.User, &m.Host, &m.Command, &m.Param0, &m.Param1, &m.Param2, &m.Param3, &m.Text, &m.BotText, &m.Bang, &m.AsNick}
+	return []interface{}{&m.Id, &m.Nonce, &m.Lane, &m.Time, &m.Account, &m.Channel, &m.Nick, &m.User, &m.Host, &m.Command, &m.Param0, &m.Param1, &m.Param2, &m.Param3, &m.Text, &m.BotText, &m.Bang, &m.AsNick, &m.Attachment, &m.Buttons, &m.Priority, &m.ReplyTo, &m.ForwardFrom, &m.ThreadId, &m.Tags, &m.Playback}
 }
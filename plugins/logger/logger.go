@@ -0,0 +1,424 @@
+// Package logger implements a plugin that writes the messages observed in
+// channels to daily log files, and searches them on request.
+package logger
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "logger",
+	Help: `Writes channel messages to daily log files.
+
+	Logs are written under the configured directory, in one file per
+	account, channel, and day, such as "<dir>/<account>/<channel>/2006-01-02.log".
+	Lines follow the usual IRC client format, with times in the configured
+	timezone. Files of previous days are compressed with gzip, and removed
+	after "keepdays" days if that option is set.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "lastlog",
+	Help: `Shows the most recent lines logged in the channel that match pattern.
+
+	The pattern is matched case-insensitively anywhere in the line, and may
+	contain the * and ? wildcards.
+	`,
+	Args: schema.Args{{
+		Name: "pattern",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+const (
+	// lastlogLines is how many matching lines lastlog shows.
+	lastlogLines = 5
+
+	// lastlogDays is how many days of logs lastlog searches.
+	lastlogDays = 30
+
+	defaultBotNick = "mup"
+)
+
+type loggerPlugin struct {
+	mu      sync.Mutex
+	plugger *mup.Plugger
+	config  struct {
+		Dir      string
+		KeepDays int
+		Timezone string
+	}
+	location *time.Location
+	files    map[string]*logFile
+	botNicks map[string]string
+}
+
+// logFile is the log file open for a channel.
+type logFile struct {
+	day  string
+	file *os.File
+}
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &loggerPlugin{
+		plugger:  plugger,
+		location: time.Local,
+		files:    make(map[string]*logFile),
+		botNicks: make(map[string]string),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Timezone != "" {
+		p.location, err = time.LoadLocation(p.config.Timezone)
+		if err != nil {
+			plugger.Logf("Cannot load timezone %q: %v", p.config.Timezone, err)
+			p.location = time.Local
+		}
+	}
+	if p.config.Dir == "" {
+		plugger.Logf("Logger has no directory configured. Nothing will be logged.")
+	} else {
+		p.rotate(time.Now())
+	}
+	return p
+}
+
+func (p *loggerPlugin) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, lf := range p.files {
+		lf.file.Close()
+		delete(p.files, key)
+	}
+	return nil
+}
+
+func (p *loggerPlugin) HandleMessage(msg *mup.Message) {
+	if msg.AsNick != "" {
+		p.mu.Lock()
+		p.botNicks[msg.Account] = msg.AsNick
+		p.mu.Unlock()
+	}
+	p.log(msg, msg.Nick)
+}
+
+func (p *loggerPlugin) HandleOutgoing(msg *mup.Message) {
+	p.mu.Lock()
+	nick := p.botNicks[msg.Account]
+	p.mu.Unlock()
+	if nick == "" {
+		nick = defaultBotNick
+	}
+	p.log(msg, nick)
+}
+
+func (p *loggerPlugin) HandleCommand(cmd *mup.Command) {
+	switch cmd.Name() {
+	case "lastlog":
+		var args struct{ Pattern string }
+		cmd.Args(&args)
+		p.lastlog(cmd.Message, args.Pattern)
+	}
+}
+
+// logChannel returns the channel that msg should be logged under,
+// or the empty string if it's not logged.
+func logChannel(msg *mup.Message) string {
+	switch msg.Command {
+	case "", "PRIVMSG", "NOTICE", "TOPIC", "EDITMSG", "DELMSG":
+		return msg.Channel
+	case "JOIN", "PART", "KICK":
+		if msg.Param0 != "" {
+			return msg.Param0
+		}
+		return msg.Text
+	}
+	return ""
+}
+
+// formatLine returns the line logged for msg, sent by nick, without
+// the time prefix.
+func formatLine(msg *mup.Message, nick string) string {
+	switch msg.Command {
+	case "JOIN":
+		return fmt.Sprintf("-!- %s [%s@%s] has joined %s", nick, msg.User, msg.Host, logChannel(msg))
+	case "PART":
+		if msg.Param0 == "" {
+			return fmt.Sprintf("-!- %s [%s@%s] has left %s", nick, msg.User, msg.Host, msg.Text)
+		}
+		return fmt.Sprintf("-!- %s [%s@%s] has left %s [%s]", nick, msg.User, msg.Host, msg.Param0, msg.Text)
+	case "KICK":
+		return fmt.Sprintf("-!- %s was kicked from %s by %s [%s]", msg.Param1, msg.Param0, nick, msg.Text)
+	case "TOPIC":
+		return fmt.Sprintf("-!- %s changed the topic of %s to: %s", nick, msg.Channel, msg.Text)
+	case "NOTICE":
+		return fmt.Sprintf("-%s- %s", nick, msg.Text)
+	case "EDITMSG":
+		return fmt.Sprintf("-!- %s edited a message: %s", nick, msg.Text)
+	case "DELMSG":
+		return "-!- A message was deleted"
+	}
+	if strings.HasPrefix(msg.Text, "\x01ACTION ") {
+		return fmt.Sprintf(" * %s %s", nick, strings.TrimSuffix(msg.Text[8:], "\x01"))
+	}
+	return fmt.Sprintf("<%s> %s", nick, msg.Text)
+}
+
+// safeName returns name in a form that is safe to use as a single path
+// element.
+func safeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name[1:]
+	}
+	return name
+}
+
+func (p *loggerPlugin) channelDir(account, channel string) string {
+	return filepath.Join(p.config.Dir, safeName(account), safeName(strings.ToLower(channel)))
+}
+
+func (p *loggerPlugin) log(msg *mup.Message, nick string) {
+	channel := logChannel(msg)
+	if p.config.Dir == "" || channel == "" {
+		return
+	}
+	t := msg.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	t = t.In(p.location)
+	line := t.Format("15:04:05") + " " + formatLine(msg, nick) + "\n"
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	day := t.Format("2006-01-02")
+	key := msg.Account + " " + strings.ToLower(channel)
+	lf := p.files[key]
+	if lf != nil && lf.day != day {
+		p.rotate(t)
+		lf = p.files[key]
+	}
+	if lf == nil {
+		dir := p.channelDir(msg.Account, channel)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			p.plugger.Logf("Cannot create log directory: %v", err)
+			return
+		}
+		file, err := os.OpenFile(filepath.Join(dir, day+".log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			p.plugger.Logf("Cannot open log file: %v", err)
+			return
+		}
+		lf = &logFile{day: day, file: file}
+		p.files[key] = lf
+	}
+	if _, err := lf.file.WriteString(line); err != nil {
+		p.plugger.Logf("Cannot write to log file: %v", err)
+	}
+}
+
+// rotate compresses the log files of days before now, and removes the
+// ones older than the configured number of days to keep.
+func (p *loggerPlugin) rotate(now time.Time) {
+	today := now.In(p.location).Format("2006-01-02")
+	for key, lf := range p.files {
+		if lf.day < today {
+			lf.file.Close()
+			delete(p.files, key)
+		}
+	}
+	oldest := ""
+	if p.config.KeepDays > 0 {
+		oldest = now.In(p.location).AddDate(0, 0, -p.config.KeepDays).Format("2006-01-02")
+	}
+	paths, err := filepath.Glob(filepath.Join(p.config.Dir, "*", "*", "*.log*"))
+	if err != nil {
+		p.plugger.Logf("Cannot list log files: %v", err)
+		return
+	}
+	for _, path := range paths {
+		day := logDay(path)
+		switch {
+		case day == "":
+			continue
+		case day < oldest:
+			if err := os.Remove(path); err != nil {
+				p.plugger.Logf("Cannot remove old log file: %v", err)
+			}
+		case day < today && strings.HasSuffix(path, ".log"):
+			if err := compress(path); err != nil {
+				p.plugger.Logf("Cannot compress log file: %v", err)
+			}
+		}
+	}
+}
+
+var logFileExp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\.log(\.gz)?$`)
+
+// logDay returns the day of the log file at path, or the empty string
+// if path is not a log file.
+func logDay(path string) string {
+	m := logFileExp.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// compress replaces the file at path with a gzipped version of it.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// patternExp returns a regular expression that matches lines containing
+// pattern, with * and ? taken as wildcards.
+func patternExp(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.Replace(quoted, `\*`, `.*`, -1)
+	quoted = strings.Replace(quoted, `\?`, `.`, -1)
+	return regexp.MustCompile("(?i)" + quoted)
+}
+
+func (p *loggerPlugin) lastlog(msg *mup.Message, pattern string) {
+	if msg.Channel == "" {
+		p.plugger.Sendf(msg, "The lastlog command only works in channels.")
+		return
+	}
+	if p.config.Dir == "" {
+		p.plugger.Sendf(msg, "Channels are not being logged.")
+		return
+	}
+	lines, err := p.search(msg.Account, msg.Channel, patternExp(pattern))
+	if err != nil {
+		p.plugger.Logf("Cannot search logs: %v", err)
+		p.plugger.Sendf(msg, "Oops: cannot search logs: %v", err)
+		return
+	}
+	if len(lines) == 0 {
+		p.plugger.Sendf(msg, "Nothing logged matches %q.", pattern)
+		return
+	}
+	for _, line := range lines {
+		p.plugger.SendDirectf(msg, "%s", line)
+	}
+}
+
+// search returns the most recent lines logged in channel that match exp,
+// oldest first and prefixed by their day.
+func (p *loggerPlugin) search(account, channel string, exp *regexp.Regexp) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(p.channelDir(account, channel), "*.log*"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, path := range paths {
+		if logDay(path) != "" {
+			files = append(files, path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	if len(files) > lastlogDays {
+		files = files[:lastlogDays]
+	}
+
+	var found []string
+	for _, path := range files {
+		lines, err := readLines(path)
+		if err != nil {
+			return nil, err
+		}
+		day := logDay(path)
+		for i := len(lines) - 1; i >= 0 && len(found) < lastlogLines; i-- {
+			// Skip the time prefix so it doesn't match patterns.
+			text := lines[i]
+			if j := strings.Index(text, " "); j >= 0 {
+				text = text[j+1:]
+			}
+			if exp.MatchString(text) {
+				found = append(found, day+" "+lines[i])
+			}
+		}
+		if len(found) == lastlogLines {
+			break
+		}
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, nil
+}
+
+// readLines returns the lines in the log file at path, which is decompressed
+// if necessary.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
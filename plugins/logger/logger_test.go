@@ -0,0 +1,106 @@
+package logger_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/logger"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct {
+	dir string
+}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+	s.dir = c.MkDir()
+}
+
+func (s *S) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+func (s *S) startTester() *mup.PluginTester {
+	tester := mup.NewPluginTester("logger")
+	tester.SetConfig(map[string]interface{}{"dir": s.dir, "timezone": "UTC", "keepdays": 30})
+	tester.Start()
+	return tester
+}
+
+func (s *S) TestLog(c *C) {
+	tester := s.startTester()
+	tester.Sendf("[#Chan] mup: hello there")
+	tester.Sendf("[#chan] \x01ACTION waves\x01")
+	tester.Sendf("[,raw] :other!~other@host JOIN #chan")
+	tester.Sendf("[,raw] :other!~other@host NOTICE #chan :Notice.")
+	tester.Sendf("[,raw] :other!~other@host PART #chan :Bye")
+	tester.Sendf("Private messages are not logged.")
+	tester.SendOutgoing("[#chan] Hello back.")
+	tester.Sendf("[,raw] :nick!~user@host EDITMSG #chan 42 :mup: hello here")
+	tester.Sendf("[,raw] DELMSG #chan 42")
+	tester.Sendf("[#other] In another channel.")
+	tester.Stop()
+	c.Assert(tester.RecvAll(), HasLen, 0)
+
+	today := time.Now().UTC().Format("2006-01-02")
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "test", "#chan", today+".log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, ""+
+		"[0-9:]{8} <nick> mup: hello there\n"+
+		"[0-9:]{8}  \\* nick waves\n"+
+		"[0-9:]{8} -!- other \\[~other@host\\] has joined #chan\n"+
+		"[0-9:]{8} -other- Notice.\n"+
+		"[0-9:]{8} -!- other \\[~other@host\\] has left #chan \\[Bye\\]\n"+
+		"[0-9:]{8} <mup> Hello back.\n"+
+		"[0-9:]{8} -!- nick edited a message: mup: hello here\n"+
+		"[0-9:]{8} -!- A message was deleted\n")
+
+	data, err = ioutil.ReadFile(filepath.Join(s.dir, "test", "#other", today+".log"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, "[0-9:]{8} <nick> In another channel.\n")
+}
+
+func (s *S) TestRotateAndLastlog(c *C) {
+	chanDir := filepath.Join(s.dir, "test", "#chan")
+	c.Assert(os.MkdirAll(chanDir, 0755), IsNil)
+	ancient := filepath.Join(chanDir, "2000-01-01.log")
+	yesterday := filepath.Join(chanDir, time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")+".log")
+	c.Assert(ioutil.WriteFile(ancient, []byte("10:00:00 <nick> ancient foo\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(yesterday, []byte("10:00:00 <nick> old foo\n10:00:01 <nick> other\n"), 0644), IsNil)
+
+	tester := s.startTester()
+
+	_, err := os.Stat(ancient)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(yesterday)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(yesterday + ".gz")
+	c.Assert(err, IsNil)
+
+	tester.Sendf("[#chan] new FOO")
+	tester.Sendf("[#chan] mup: lastlog f?o")
+	tester.Sendf("[#chan] mup: lastlog 10:00")
+	tester.Sendf("[#chan] mup: lastlog ot*er")
+	tester.Sendf("lastlog foo")
+	tester.Stop()
+
+	day := filepath.Base(yesterday)[:10]
+	recv := tester.RecvAll()
+	c.Assert(recv, HasLen, 5)
+	c.Assert(recv[0], Equals, "PRIVMSG nick :"+day+" 10:00:00 <nick> old foo")
+	c.Assert(recv[1], Matches, "PRIVMSG nick :"+time.Now().UTC().Format("2006-01-02")+" [0-9:]{8} <nick> new FOO")
+	c.Assert(recv[2], Equals, `PRIVMSG #chan :nick: Nothing logged matches "10:00".`)
+	c.Assert(recv[3], Equals, "PRIVMSG nick :"+day+" 10:00:01 <nick> other")
+	c.Assert(recv[4], Equals, "PRIVMSG nick :The lastlog command only works in channels.")
+}
@@ -0,0 +1,11 @@
+package net
+
+type Resolver = resolver
+
+// SetResolver makes the plugin use r for all lookups, and returns a
+// function that restores the original resolver.
+func SetResolver(r Resolver) (restore func()) {
+	old := newResolver
+	newResolver = func(addr string) resolver { return r }
+	return func() { newResolver = old }
+}
@@ -0,0 +1,419 @@
+// Package net implements a plugin offering DNS, WHOIS, and GeoIP lookups.
+package net
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "net",
+	Help: `Offers commands for DNS, WHOIS, and GeoIP lookups.
+
+	The "commands" configuration option may list the subset of the "dig", "whois",
+	and "geoip" commands that are enabled, and may be set per target as well.
+	Lookups are made via the system resolver unless the "resolver" option holds the
+	"<host>:<port>" address of a DNS server. Output longer than the "pastelines"
+	option is pasted as usual.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "dig",
+	Help: `Looks up DNS records of a name.
+
+	The record type may be A, AAAA, CNAME, MX, NS, TXT, or PTR. Without a type,
+	both A and AAAA records are looked up, or the PTR records if the name is an
+	IP address.
+	`,
+	Args: schema.Args{{
+		Name: "name",
+		Flag: schema.Required,
+	}, {
+		Name: "type",
+	}},
+}, {
+	Name: "whois",
+	Help: "Looks up the WHOIS registration details of a domain.",
+	Args: schema.Args{{
+		Name: "domain",
+		Flag: schema.Required,
+	}},
+}, {
+	Name: "geoip",
+	Help: "Looks up the location and network of an IP address.",
+	Args: schema.Args{{
+		Name: "ip",
+		Flag: schema.Required,
+	}},
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+// resolver is implemented by *net.Resolver.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// newResolver returns the resolver used for lookups via the DNS server
+// at addr, or via the system resolver if addr is empty.
+var newResolver = func(addr string) resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+type netPlugin struct {
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	commands chan *mup.Command
+	resolver resolver
+	config   struct {
+		Commands      []string
+		Resolver      string
+		WhoisServer   string
+		GeoIPEndpoint string
+		Timeout       mup.DurationString
+	}
+}
+
+const (
+	defaultWhoisServer   = "whois.iana.org:43"
+	defaultGeoIPEndpoint = "http://ip-api.com/json/"
+	defaultTimeout       = 10 * time.Second
+
+	// maxReferrals limits the WHOIS servers followed after the first one.
+	maxReferrals = 2
+)
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &netPlugin{
+		plugger:  plugger,
+		commands: make(chan *mup.Command, 10),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.WhoisServer == "" {
+		p.config.WhoisServer = defaultWhoisServer
+	}
+	if p.config.GeoIPEndpoint == "" {
+		p.config.GeoIPEndpoint = defaultGeoIPEndpoint
+	}
+	if p.config.Timeout.Duration == 0 {
+		p.config.Timeout.Duration = defaultTimeout
+	}
+	p.resolver = newResolver(p.config.Resolver)
+	p.tomb.Go(p.loop)
+	return p
+}
+
+func (p *netPlugin) Stop() error {
+	close(p.commands)
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+func (p *netPlugin) HandleCommand(cmd *mup.Command) {
+	select {
+	case p.commands <- cmd:
+	default:
+		p.plugger.Logf("Command queue is full. Dropping message: %s", cmd.String())
+		p.plugger.Sendf(cmd, "Too many lookups in progress. Please try again soon.")
+	}
+}
+
+// enabled returns whether the command is enabled in the target it was
+// received from, which may list enabled commands in its configuration
+// to override the ones in the plugin configuration.
+func (p *netPlugin) enabled(cmd *mup.Command) bool {
+	var tconfig struct{ Commands []string }
+	target := p.plugger.Target(cmd.Message)
+	if err := target.UnmarshalConfig(&tconfig); err != nil {
+		p.plugger.Logf("%v", err)
+	}
+	commands := p.config.Commands
+	if tconfig.Commands != nil {
+		commands = tconfig.Commands
+	}
+	if commands == nil {
+		return true
+	}
+	for _, name := range commands {
+		if name == cmd.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *netPlugin) loop() error {
+	for cmd := range p.commands {
+		if !p.enabled(cmd) {
+			p.plugger.Sendf(cmd, "The %s command is not enabled here.", cmd.Name())
+			continue
+		}
+		// Commands queued when the plugin is stopped are still handled,
+		// so lookups are limited by the timeout alone.
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout.Duration)
+		var text string
+		var err error
+		switch cmd.Name() {
+		case "dig":
+			var args struct{ Name, Type string }
+			cmd.Args(&args)
+			text, err = p.dig(ctx, args.Name, strings.ToUpper(args.Type))
+		case "whois":
+			var args struct{ Domain string }
+			cmd.Args(&args)
+			text, err = p.whois(ctx, args.Domain)
+		case "geoip":
+			var args struct{ IP string }
+			cmd.Args(&args)
+			text, err = p.geoip(ctx, args.IP)
+		}
+		cancel()
+		if err != nil {
+			p.plugger.Sendf(cmd, "Oops: %v", err)
+		} else {
+			p.plugger.SendLong(cmd, text)
+		}
+	}
+	return nil
+}
+
+func (p *netPlugin) dig(ctx context.Context, name, rtype string) (string, error) {
+	if rtype == "" && net.ParseIP(name) != nil {
+		rtype = "PTR"
+	}
+	var records []string
+	var err error
+	switch rtype {
+	case "", "A", "AAAA":
+		// Without an explicit type both A and AAAA records are reported.
+		var addrs []net.IPAddr
+		addrs, err = p.resolver.LookupIPAddr(ctx, name)
+		for _, addr := range addrs {
+			is4 := addr.IP.To4() != nil
+			switch {
+			case is4 && rtype != "AAAA":
+				records = append(records, "A "+addr.IP.String())
+			case !is4 && rtype != "A":
+				records = append(records, "AAAA "+addr.IP.String())
+			}
+		}
+		if rtype == "" {
+			rtype = "address"
+		}
+	case "CNAME":
+		var cname string
+		cname, err = p.resolver.LookupCNAME(ctx, name)
+		records = append(records, "CNAME "+cname)
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = p.resolver.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			records = append(records, fmt.Sprintf("MX %d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		var nss []*net.NS
+		nss, err = p.resolver.LookupNS(ctx, name)
+		for _, ns := range nss {
+			records = append(records, "NS "+ns.Host)
+		}
+		sort.Strings(records)
+	case "TXT":
+		var txts []string
+		txts, err = p.resolver.LookupTXT(ctx, name)
+		for _, txt := range txts {
+			records = append(records, fmt.Sprintf("TXT %q", txt))
+		}
+	case "PTR":
+		var names []string
+		names, err = p.resolver.LookupAddr(ctx, name)
+		for _, host := range names {
+			records = append(records, "PTR "+host)
+		}
+	default:
+		return "", fmt.Errorf("unsupported record type: %s", rtype)
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return "", fmt.Errorf("no %s records found for %s", rtype, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no %s records found for %s", rtype, name)
+	}
+	for i, record := range records {
+		records[i] = name + " " + record
+	}
+	return strings.Join(records, "\n"), nil
+}
+
+// whois queries the configured WHOIS server about domain, following
+// the referrals to the servers that hold the registration details.
+func (p *netPlugin) whois(ctx context.Context, domain string) (string, error) {
+	server := p.config.WhoisServer
+	var text string
+	for i := 0; i <= maxReferrals; i++ {
+		response, err := whoisQuery(ctx, server, domain)
+		if err != nil {
+			return "", err
+		}
+		text = response
+		refer := whoisReferral(text)
+		if refer == "" || refer == server {
+			break
+		}
+		server = refer
+	}
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, ">>>") {
+			// Only legal notices follow.
+			break
+		}
+		if line == "" || line[0] == '%' || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "", fmt.Errorf("no WHOIS details found for %s", domain)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func whoisQuery(ctx context.Context, server, query string) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return "", fmt.Errorf("cannot connect to WHOIS server: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte(query + "\r\n")); err != nil {
+		return "", fmt.Errorf("cannot query WHOIS server: %v", err)
+	}
+	var buf strings.Builder
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		buf.WriteString(scanner.Text())
+		buf.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("cannot read WHOIS response: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// whoisReferral returns the address of the WHOIS server the response
+// text refers to, or the empty string if there is none.
+func whoisReferral(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		if key != "refer" && key != "whois" && key != "registrar whois server" {
+			continue
+		}
+		server := strings.TrimSpace(line[i+1:])
+		server = strings.TrimPrefix(server, "whois://")
+		if server == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server += ":43"
+		}
+		return server
+	}
+	return ""
+}
+
+type geoipResult struct {
+	Status     string `json:"status"`
+	Message    string `json:"message"`
+	Query      string `json:"query"`
+	Country    string `json:"country"`
+	RegionName string `json:"regionName"`
+	City       string `json:"city"`
+	ISP        string `json:"isp"`
+	AS         string `json:"as"`
+}
+
+func (p *netPlugin) geoip(ctx context.Context, ip string) (string, error) {
+	link := strings.TrimRight(p.config.GeoIPEndpoint, "/") + "/" + url.PathEscape(ip)
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot perform GeoIP request: %v", err)
+	}
+	resp, err := p.plugger.HTTPClient().Do(req.WithContext(ctx))
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot perform GeoIP request: %v", err)
+		return "", fmt.Errorf("cannot perform GeoIP request: %v", err)
+	}
+	defer resp.Body.Close()
+	var result geoipResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode GeoIP response: %v", err)
+		return "", fmt.Errorf("cannot decode GeoIP response: %v", err)
+	}
+	if result.Status != "success" {
+		return "", fmt.Errorf("cannot locate %s: %s", ip, result.Message)
+	}
+	var place []string
+	for _, s := range []string{result.City, result.RegionName, result.Country} {
+		if s != "" {
+			place = append(place, s)
+		}
+	}
+	text := result.Query + ": " + strings.Join(place, ", ")
+	if result.AS != "" {
+		text += " <" + result.AS + ">"
+	} else if result.ISP != "" {
+		text += " <" + result.ISP + ">"
+	}
+	return text, nil
+}
@@ -0,0 +1,217 @@
+package net_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mup.v0"
+	mupnet "gopkg.in/mup.v0/plugins/net"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct {
+	restore func()
+}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+	s.restore = mupnet.SetResolver(fakeResolver{})
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.restore()
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+type fakeResolver struct{}
+
+var notFound = &net.DNSError{Err: "no such host", IsNotFound: true}
+
+func (fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host != "example.com" {
+		return nil, notFound
+	}
+	return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("2606:2800:220:1::1")}}, nil
+}
+
+func (fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return "example.com.", nil
+}
+
+func (fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return []*net.MX{{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}}, nil
+}
+
+func (fakeResolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	return []*net.NS{{Host: "b.iana-servers.net."}, {Host: "a.iana-servers.net."}}, nil
+}
+
+func (fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	var txts []string
+	for i := 0; i < 6; i++ {
+		txts = append(txts, fmt.Sprintf("record %d", i))
+	}
+	return txts, nil
+}
+
+func (fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return []string{"example.com."}, nil
+}
+
+type netTest struct {
+	send    []string
+	recv    []string
+	config  mup.Map
+	targets []mup.Target
+}
+
+var netTests = []netTest{{
+	send: []string{"dig example.com"},
+	recv: []string{
+		"PRIVMSG nick :example.com A 93.184.216.34",
+		"PRIVMSG nick :example.com AAAA 2606:2800:220:1::1",
+	},
+}, {
+	send: []string{"dig example.com aaaa", "dig example.com A"},
+	recv: []string{
+		"PRIVMSG nick :example.com AAAA 2606:2800:220:1::1",
+		"PRIVMSG nick :example.com A 93.184.216.34",
+	},
+}, {
+	send: []string{"dig example.com MX", "dig example.com NS", "dig www.example.com CNAME", "dig 93.184.216.34"},
+	recv: []string{
+		"PRIVMSG nick :example.com MX 10 mx1.example.com.",
+		"PRIVMSG nick :example.com MX 20 mx2.example.com.",
+		"PRIVMSG nick :example.com NS a.iana-servers.net.",
+		"PRIVMSG nick :example.com NS b.iana-servers.net.",
+		"PRIVMSG nick :www.example.com CNAME example.com.",
+		"PRIVMSG nick :93.184.216.34 PTR example.com.",
+	},
+}, {
+	send: []string{"dig example.org", "dig example.com SRV"},
+	recv: []string{
+		"PRIVMSG nick :Oops: no address records found for example.org",
+		"PRIVMSG nick :Oops: unsupported record type: SRV",
+	},
+}, {
+	// Long output is truncated when there's no way to paste it.
+	send: []string{"dig example.com TXT"},
+	recv: []string{
+		`PRIVMSG nick :example.com TXT "record 0"`,
+		`PRIVMSG nick :example.com TXT "record 1"`,
+		`PRIVMSG nick :example.com TXT "record 2"`,
+		`PRIVMSG nick :example.com TXT "record 3"`,
+		"PRIVMSG nick :(2 more lines omitted)",
+	},
+}, {
+	send: []string{"geoip 8.8.8.8", "geoip foo"},
+	recv: []string{
+		"PRIVMSG nick :8.8.8.8: Ashburn, Virginia, United States <AS15169 Google LLC>",
+		"PRIVMSG nick :Oops: cannot locate foo: invalid query",
+	},
+}, {
+	send: []string{"whois example.com"},
+	recv: []string{
+		"PRIVMSG nick :Domain Name: EXAMPLE.COM",
+		"PRIVMSG nick :Registrar: RESERVED-Internet Assigned Numbers Authority",
+	},
+}, {
+	// Commands may be enabled in the plugin configuration.
+	config: mup.Map{"commands": []string{"dig"}},
+	send:   []string{"dig example.com A", "geoip 8.8.8.8"},
+	recv: []string{
+		"PRIVMSG nick :example.com A 93.184.216.34",
+		"PRIVMSG nick :The geoip command is not enabled here.",
+	},
+}, {
+	// And overridden per target.
+	config: mup.Map{"commands": []string{"dig"}},
+	targets: []mup.Target{
+		{Account: "test", Channel: "#ops", Config: `{"commands": ["geoip"]}`},
+		{Account: "test"},
+	},
+	send: []string{"[#ops] mup: geoip 8.8.8.8", "[#ops] mup: dig example.com A", "geoip 8.8.8.8"},
+	recv: []string{
+		"PRIVMSG #ops :nick: 8.8.8.8: Ashburn, Virginia, United States <AS15169 Google LLC>",
+		"PRIVMSG #ops :nick: The dig command is not enabled here.",
+		"PRIVMSG nick :The geoip command is not enabled here.",
+	},
+}}
+
+func (s *S) TestNet(c *C) {
+	geoip := httptest.NewServer(http.HandlerFunc(serveGeoIP))
+	defer geoip.Close()
+	whois := startWhoisServer(c)
+	defer whois.Close()
+
+	for i, test := range netTests {
+		c.Logf("Testing message #%d: %s", i, test.send)
+		if test.config == nil {
+			test.config = mup.Map{}
+		}
+		test.config["geoipendpoint"] = geoip.URL
+		test.config["whoisserver"] = whois.Addr().String()
+		tester := mup.NewPluginTester("net")
+		tester.SetConfig(test.config)
+		tester.SetTargets(test.targets)
+		tester.Start()
+		tester.SendAll(test.send)
+		tester.Stop()
+		c.Assert(tester.RecvAll(), DeepEquals, test.recv)
+	}
+}
+
+func serveGeoIP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/8.8.8.8" {
+		w.Write([]byte(`{"status": "fail", "message": "invalid query", "query": "foo"}`))
+		return
+	}
+	w.Write([]byte(`{"status": "success", "country": "United States", "regionName": "Virginia", "city": "Ashburn",
+		"isp": "Google LLC", "as": "AS15169 Google LLC", "query": "8.8.8.8"}`))
+}
+
+// startWhoisServer starts a WHOIS server that refers queries to another
+// server, as done by the IANA server, which then answers them.
+func startWhoisServer(c *C) net.Listener {
+	registry := serveWhois(c, nil, "   Domain Name: EXAMPLE.COM\r\n\r\n"+
+		"   Registrar: RESERVED-Internet Assigned Numbers Authority\r\n"+
+		">>> Last update of whois database: 2024-01-01T00:00:00Z <<<\r\n\r\n"+
+		"TERMS OF USE: ...\r\n")
+	return serveWhois(c, registry, "% IANA WHOIS server\r\n\r\ndomain: COM\r\nrefer: "+registry.Addr().String()+"\r\n")
+}
+
+func serveWhois(c *C, stop net.Listener, response string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		if stop != nil {
+			defer stop.Close()
+		}
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			query, _ := bufio.NewReader(conn).ReadString('\n')
+			if strings.TrimSpace(query) != "example.com" {
+				panic("got unexpected query in test WHOIS server: " + query)
+			}
+			conn.Write([]byte(response))
+			conn.Close()
+		}
+	}()
+	return l
+}
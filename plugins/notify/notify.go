@@ -0,0 +1,433 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "notify",
+	Help: `Starts an HTTP server that turns webhook notifications into messages.
+
+	Each entry in the "endpoints" configuration list has a "path" to serve,
+	a "kind" that defines the expected payload ("github", "gitlab", or
+	"alertmanager"), and an optional "secret" that the request must be
+	authenticated with. GitHub requests are validated via the signature in
+	the X-Hub-Signature-256 header, GitLab requests via the X-Gitlab-Token
+	header, and Alertmanager requests via an "Authorization: Bearer <secret>"
+	header.
+
+	Messages are broadcast to all plugin targets. A target may restrict the
+	endpoints it is notified about via its own "endpoints" list of paths.
+
+	The address to listen on may be changed via the "addr" configuration
+	option. If not provided the address 0.0.0.0:10457 is used.
+
+	Alertmanager silences may be managed with the silence command once the
+	"alertmanager" option holds the Alertmanager URL, which may include
+	credentials for basic authentication. Only people matching one of the
+	masks in the "silencers" list may use it. Masks holding a "!" or "@"
+	are matched against the full nick!user@host of the sender, and others
+	against the nick alone, with "*" and "?" as wildcards.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type notifyPlugin struct {
+	mu       sync.Mutex
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	listener net.Listener
+	commands chan *mup.Command
+	config   struct {
+		Addr      string
+		Endpoints []endpoint
+
+		Alertmanager string
+		Silencers    []string
+	}
+	targets []notifyTarget
+}
+
+type endpoint struct {
+	Path   string
+	Kind   string
+	Secret string
+}
+
+type notifyTarget struct {
+	mup.Target
+	endpoints map[string]bool
+}
+
+const defaultAddr = ":10457"
+
+var formatters = map[string]func(event string, data []byte) ([]string, error){
+	"github":       formatGitHub,
+	"gitlab":       formatGitLab,
+	"alertmanager": formatAlertmanager,
+}
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &notifyPlugin{
+		plugger:  plugger,
+		commands: make(chan *mup.Command, 5),
+	}
+	err := p.plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Addr == "" {
+		p.config.Addr = defaultAddr
+	}
+	for _, e := range p.config.Endpoints {
+		if formatters[e.Kind] == nil {
+			plugger.Logf("Endpoint %s has unknown kind %q.", e.Path, e.Kind)
+		}
+	}
+	for _, target := range plugger.Targets() {
+		var tconfig struct{ Endpoints []string }
+		err := target.UnmarshalConfig(&tconfig)
+		if err != nil {
+			plugger.Logf("%v", err)
+		}
+		t := notifyTarget{Target: target}
+		if len(tconfig.Endpoints) > 0 {
+			t.endpoints = make(map[string]bool)
+			for _, path := range tconfig.Endpoints {
+				t.endpoints[path] = true
+			}
+		}
+		p.targets = append(p.targets, t)
+	}
+	p.tomb.Go(p.loop)
+	p.tomb.Go(p.commandLoop)
+	return p
+}
+
+func (p *notifyPlugin) Stop() error {
+	close(p.commands)
+	p.tomb.Kill(nil)
+	p.mu.Lock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.mu.Unlock()
+	return p.tomb.Wait()
+}
+
+func (p *notifyPlugin) loop() error {
+	first := true
+	for p.tomb.Alive() {
+		l, err := net.Listen("tcp", p.config.Addr)
+		if err != nil {
+			if first {
+				first = false
+				p.plugger.Logf("Cannot listen on %s (%v). Will keep retrying.", p.config.Addr, err)
+			}
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		p.plugger.Logf("Listening on %s.", p.config.Addr)
+
+		p.mu.Lock()
+		p.listener = l
+		p.mu.Unlock()
+
+		server := &http.Server{
+			Addr:         p.config.Addr,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			Handler:      p,
+		}
+
+		err = server.Serve(l)
+		if p.tomb.Alive() {
+			p.tomb.Kill(err)
+		}
+		l.Close()
+	}
+	return nil
+}
+
+func (p *notifyPlugin) endpoint(path string) *endpoint {
+	for i := range p.config.Endpoints {
+		if p.config.Endpoints[i].Path == path {
+			return &p.config.Endpoints[i]
+		}
+	}
+	return nil
+}
+
+func (p *notifyPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e := p.endpoint(r.URL.Path)
+	if e == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "notifications must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(&io.LimitedReader{R: r.Body, N: 1 << 20})
+	if err != nil {
+		http.Error(w, "cannot read request body", http.StatusBadRequest)
+		return
+	}
+	if !authorized(e, r, data) {
+		p.plugger.Logf("Unauthorized request received on %s.", e.Path)
+		http.Error(w, "invalid secret", http.StatusUnauthorized)
+		return
+	}
+	format := formatters[e.Kind]
+	if format == nil {
+		http.Error(w, "endpoint has unknown kind", http.StatusInternalServerError)
+		return
+	}
+	var event string
+	switch e.Kind {
+	case "github":
+		event = r.Header.Get("X-GitHub-Event")
+	case "gitlab":
+		event = r.Header.Get("X-Gitlab-Event")
+	}
+	lines, err := format(event, data)
+	if err != nil {
+		p.plugger.Logf("Cannot parse %s payload received on %s: %v", e.Kind, e.Path, err)
+		http.Error(w, "cannot parse payload", http.StatusBadRequest)
+		return
+	}
+	for _, line := range lines {
+		p.broadcast(e.Path, line)
+	}
+}
+
+func (p *notifyPlugin) broadcast(path, text string) {
+	for _, t := range p.targets {
+		if !t.CanSend() || t.endpoints != nil && !t.endpoints[path] {
+			continue
+		}
+		p.plugger.Sendf(t, "%s", text)
+	}
+}
+
+func authorized(e *endpoint, r *http.Request, data []byte) bool {
+	if e.Secret == "" {
+		return true
+	}
+	switch e.Kind {
+	case "github":
+		signature := r.Header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") {
+			return false
+		}
+		got, err := hex.DecodeString(signature[len("sha256="):])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(e.Secret))
+		mac.Write(data)
+		return hmac.Equal(got, mac.Sum(nil))
+	case "gitlab":
+		return secretEqual(r.Header.Get("X-Gitlab-Token"), e.Secret)
+	default:
+		return secretEqual(r.Header.Get("Authorization"), "Bearer "+e.Secret)
+	}
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func firstLine(text string) string {
+	if i := strings.IndexAny(text, "\r\n"); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, singular)
+	}
+	return fmt.Sprintf("%d %s", n, plural)
+}
+
+type ghPayload struct {
+	Action     string
+	Ref        string
+	Compare    string
+	Commits    []struct{ Message string }
+	HeadCommit *struct{ Message string } `json:"head_commit"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	}
+	Sender struct{ Login string }
+	Issue  *struct {
+		Number  int
+		Title   string
+		HTMLURL string `json:"html_url"`
+	}
+	PullRequest *struct {
+		Number  int
+		Title   string
+		Merged  bool
+		HTMLURL string `json:"html_url"`
+	} `json:"pull_request"`
+}
+
+func formatGitHub(event string, data []byte) ([]string, error) {
+	var p ghPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	prefix := "[" + p.Repository.FullName + "] "
+	switch event {
+	case "push":
+		if len(p.Commits) == 0 {
+			return nil, nil
+		}
+		text := fmt.Sprintf("%s%s pushed %s to %s", prefix, p.Sender.Login, plural(len(p.Commits), "commit", "commits"), strings.TrimPrefix(p.Ref, "refs/heads/"))
+		if p.HeadCommit != nil {
+			text += ": " + firstLine(p.HeadCommit.Message)
+		}
+		if p.Compare != "" {
+			text += " <" + p.Compare + ">"
+		}
+		return []string{text}, nil
+	case "pull_request":
+		if p.PullRequest == nil {
+			return nil, nil
+		}
+		action := p.Action
+		if action == "closed" && p.PullRequest.Merged {
+			action = "merged"
+		}
+		switch action {
+		case "opened", "closed", "merged", "reopened":
+		default:
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s%s %s PR #%d: %s <%s>", prefix, p.Sender.Login, action, p.PullRequest.Number, p.PullRequest.Title, p.PullRequest.HTMLURL)}, nil
+	case "issues":
+		if p.Issue == nil {
+			return nil, nil
+		}
+		switch p.Action {
+		case "opened", "closed", "reopened":
+		default:
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s%s %s issue #%d: %s <%s>", prefix, p.Sender.Login, p.Action, p.Issue.Number, p.Issue.Title, p.Issue.HTMLURL)}, nil
+	}
+	return nil, nil
+}
+
+type glPayload struct {
+	ObjectKind string `json:"object_kind"`
+	Ref        string
+	UserName   string `json:"user_name"`
+	Commits    []struct{ Message string }
+	User       struct{ Username string }
+	Project    struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	}
+	ObjectAttributes struct {
+		IID    int `json:"iid"`
+		Title  string
+		URL    string
+		Action string
+	} `json:"object_attributes"`
+}
+
+var glActions = map[string]string{
+	"open":   "opened",
+	"close":  "closed",
+	"reopen": "reopened",
+	"merge":  "merged",
+}
+
+func formatGitLab(event string, data []byte) ([]string, error) {
+	var p glPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	prefix := "[" + p.Project.PathWithNamespace + "] "
+	attrs := &p.ObjectAttributes
+	switch p.ObjectKind {
+	case "push":
+		if len(p.Commits) == 0 {
+			return nil, nil
+		}
+		text := fmt.Sprintf("%s%s pushed %s to %s: %s", prefix, p.UserName, plural(len(p.Commits), "commit", "commits"), strings.TrimPrefix(p.Ref, "refs/heads/"), firstLine(p.Commits[len(p.Commits)-1].Message))
+		return []string{text}, nil
+	case "merge_request":
+		action, ok := glActions[attrs.Action]
+		if !ok {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s%s %s MR !%d: %s <%s>", prefix, p.User.Username, action, attrs.IID, attrs.Title, attrs.URL)}, nil
+	case "issue":
+		action, ok := glActions[attrs.Action]
+		if !ok {
+			return nil, nil
+		}
+		return []string{fmt.Sprintf("%s%s %s issue #%d: %s <%s>", prefix, p.User.Username, action, attrs.IID, attrs.Title, attrs.URL)}, nil
+	}
+	return nil, nil
+}
+
+type amPayload struct {
+	Alerts []struct {
+		Status      string
+		Labels      map[string]string
+		Annotations map[string]string
+	}
+}
+
+func formatAlertmanager(event string, data []byte) ([]string, error) {
+	var p amPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, alert := range p.Alerts {
+		text := fmt.Sprintf("[%s] %s", strings.ToUpper(alert.Status), alert.Labels["alertname"])
+		if summary := alert.Annotations["summary"]; summary != "" {
+			text += ": " + summary
+		} else {
+			var labels []string
+			for name, value := range alert.Labels {
+				if name != "alertname" {
+					labels = append(labels, name+"="+value)
+				}
+			}
+			sort.Strings(labels)
+			if len(labels) > 0 {
+				text += " (" + strings.Join(labels, ", ") + ")"
+			}
+		}
+		lines = append(lines, text)
+	}
+	return lines, nil
+}
@@ -0,0 +1,269 @@
+package notify_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/notify"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&NotifySuite{})
+
+type NotifySuite struct{}
+
+func (s *NotifySuite) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *NotifySuite) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+var endpoints = []mup.Map{
+	{"path": "/github", "kind": "github", "secret": "ghsecret"},
+	{"path": "/gitlab", "kind": "gitlab", "secret": "glsecret"},
+	{"path": "/alerts", "kind": "alertmanager", "secret": "amsecret"},
+	{"path": "/open", "kind": "alertmanager"},
+}
+
+type notifyTest struct {
+	path    string
+	header  map[string]string
+	payload string
+	status  int
+	recv    []string
+	targets []mup.Target
+}
+
+func ghSignature(payload string) string {
+	mac := hmac.New(sha256.New, []byte("ghsecret"))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+const ghPush = `{"ref": "refs/heads/main", "compare": "https://github.com/org/repo/compare/a...b",
+	"commits": [{"message": "One"}, {"message": "Two\n\nDetails."}], "head_commit": {"message": "Two\n\nDetails."},
+	"repository": {"full_name": "org/repo"}, "sender": {"login": "joe"}}`
+
+const ghPull = `{"action": "closed", "pull_request": {"number": 42, "title": "Fix it", "merged": true, "html_url": "https://github.com/org/repo/pull/42"},
+	"repository": {"full_name": "org/repo"}, "sender": {"login": "joe"}}`
+
+const glMerge = `{"object_kind": "merge_request", "user": {"username": "ann"}, "project": {"path_with_namespace": "group/proj"},
+	"object_attributes": {"iid": 7, "title": "Add feature", "url": "https://gitlab.com/group/proj/-/merge_requests/7", "action": "open"}}`
+
+const amAlerts = `{"alerts": [{"status": "firing", "labels": {"alertname": "HighLoad", "instance": "db1"}, "annotations": {"summary": "Load is high"}},
+	{"status": "resolved", "labels": {"alertname": "DiskFull", "instance": "db2", "mount": "/"}}]}`
+
+var notifyTests = []notifyTest{{
+	// Unknown endpoint.
+	path:    "/unknown",
+	payload: `{}`,
+	status:  http.StatusNotFound,
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// GitHub push.
+	path:    "/github",
+	header:  map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": ghSignature(ghPush)},
+	payload: ghPush,
+	status:  http.StatusOK,
+	recv:    []string{"PRIVMSG #chan :[org/repo] joe pushed 2 commits to main: Two <https://github.com/org/repo/compare/a...b>"},
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// GitHub merged pull request.
+	path:    "/github",
+	header:  map[string]string{"X-GitHub-Event": "pull_request", "X-Hub-Signature-256": ghSignature(ghPull)},
+	payload: ghPull,
+	status:  http.StatusOK,
+	recv:    []string{"PRIVMSG #chan :[org/repo] joe merged PR #42: Fix it <https://github.com/org/repo/pull/42>"},
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// GitHub bad signature.
+	path:    "/github",
+	header:  map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": ghSignature("other")},
+	payload: ghPush,
+	status:  http.StatusUnauthorized,
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// GitLab merge request.
+	path:    "/gitlab",
+	header:  map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": "glsecret"},
+	payload: glMerge,
+	status:  http.StatusOK,
+	recv:    []string{"PRIVMSG #chan :[group/proj] ann opened MR !7: Add feature <https://gitlab.com/group/proj/-/merge_requests/7>"},
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// GitLab bad token.
+	path:    "/gitlab",
+	header:  map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": "bad"},
+	payload: glMerge,
+	status:  http.StatusUnauthorized,
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// Alertmanager.
+	path:    "/alerts",
+	header:  map[string]string{"Authorization": "Bearer amsecret"},
+	payload: amAlerts,
+	status:  http.StatusOK,
+	recv: []string{
+		"PRIVMSG #chan :[FIRING] HighLoad: Load is high",
+		"PRIVMSG #chan :[RESOLVED] DiskFull (instance=db2, mount=/)",
+	},
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// Alertmanager without secret configured.
+	path:    "/open",
+	payload: amAlerts,
+	status:  http.StatusOK,
+	recv: []string{
+		"PRIVMSG #chan :[FIRING] HighLoad: Load is high",
+		"PRIVMSG #chan :[RESOLVED] DiskFull (instance=db2, mount=/)",
+	},
+	targets: []mup.Target{{Account: "test", Channel: "#chan"}},
+}, {
+	// Targets restricted to specific endpoints.
+	path:    "/gitlab",
+	header:  map[string]string{"X-Gitlab-Event": "Merge Request Hook", "X-Gitlab-Token": "glsecret"},
+	payload: glMerge,
+	status:  http.StatusOK,
+	recv:    []string{"[@other] PRIVMSG #gl :[group/proj] ann opened MR !7: Add feature <https://gitlab.com/group/proj/-/merge_requests/7>"},
+	targets: []mup.Target{
+		{Account: "test", Channel: "#gh", Config: `{"endpoints": ["/github"]}`},
+		{Account: "other", Channel: "#gl", Config: `{"endpoints": ["/gitlab"]}`},
+	},
+}}
+
+func (s *NotifySuite) TestNotify(c *C) {
+	transport := &http.Transport{DisableKeepAlives: true}
+	client := http.Client{Transport: transport}
+
+	for i, test := range notifyTests {
+		c.Logf("Testing payload #%d on %s", i, test.path)
+		tester := mup.NewPluginTester("notify")
+		tester.SetConfig(mup.Map{"addr": ":10646", "endpoints": endpoints})
+		tester.SetTargets(test.targets)
+		tester.Start()
+
+		for i := 0; i < 100; i++ {
+			conn, err := net.Dial("tcp", "localhost:10646")
+			if err == nil {
+				conn.Close()
+				break
+			}
+		}
+
+		req, err := http.NewRequest("POST", "http://localhost:10646"+test.path, bytes.NewBufferString(test.payload))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		resp, err := client.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, test.status)
+
+		tester.Stop()
+		c.Assert(tester.RecvAll(), DeepEquals, test.recv)
+	}
+}
+
+type amServer struct {
+	mu      sync.Mutex
+	posted  []map[string]interface{}
+	created time.Time
+}
+
+func (s *amServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.URL.Path != "/api/v2/silences" {
+		panic("got unexpected request for " + req.URL.Path + " in test amServer")
+	}
+	if req.Method == "POST" {
+		var silence map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&silence); err != nil {
+			panic(err)
+		}
+		s.posted = append(s.posted, silence)
+		w.Write([]byte(`{"silenceID": "a1b2"}`))
+		return
+	}
+	w.Write([]byte(`[
+		{"id": "a1b2", "status": {"state": "active"}, "createdBy": "nick", "comment": "Deploying.",
+		 "endsAt": "2026-10-19T09:30:00Z", "matchers": [
+			{"name": "alertname", "value": "HighLoad", "isEqual": true, "isRegex": false},
+			{"name": "instance", "value": "db.*", "isEqual": false, "isRegex": true}]},
+		{"id": "c3d4", "status": {"state": "expired"}, "createdBy": "bob", "comment": "Old.",
+		 "endsAt": "2026-10-01T09:30:00Z", "matchers": [{"name": "alertname", "value": "DiskFull", "isEqual": true}]}
+	]`))
+}
+
+func (s *NotifySuite) TestSilence(c *C) {
+	server := &amServer{}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("notify")
+	tester.SetConfig(mup.Map{
+		"addr":         ":10646",
+		"alertmanager": httpServer.URL + "/",
+		"silencers":    []string{"nick!~user@host"},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	tester.Sendf("[#chan] mup: silence list")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: Silence a1b2 for alertname=HighLoad instance!~db.* until Mon 09:30 UTC by nick: Deploying.")
+
+	tester.Sendf("[#chan] mup: silence add alertname=HighLoad instance=~db.* 2h -- Deploying.")
+	c.Assert(tester.Recv(), Matches, `PRIVMSG #chan :nick: Silence a1b2 added for alertname=HighLoad instance=~db\.\* until \w{3} \d\d:\d\d UTC\.`)
+
+	tester.Sendf("[#chan] mup: silence add alertname=HighLoad")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: Usage: silence add <matchers> <duration> [-- <comment>]")
+	tester.Sendf("[#chan] mup: silence add alertname=HighLoad soon")
+	c.Assert(tester.Recv(), Equals, `PRIVMSG #chan :nick: Cannot add silence: invalid duration "soon"`)
+	tester.Sendf("[#chan] mup: silence add HighLoad 1h")
+	c.Assert(tester.Recv(), Equals, `PRIVMSG #chan :nick: Cannot add silence: invalid matcher "HighLoad"`)
+	tester.Sendf("[#chan] mup: silence add alertname=HighLoad 60d")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: Cannot add silence: duration is longer than 30 days.")
+	tester.Sendf("[#chan] mup: silence expire a1b2")
+	c.Assert(tester.Recv(), Equals, `PRIVMSG #chan :nick: Unknown action "expire". Use "silence add <matchers> <duration>" or "silence list".`)
+
+	tester.Sendf("[,raw] :bob!~bob@host PRIVMSG #chan :mup: silence list")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :bob: You are not allowed to manage silences.")
+
+	c.Assert(tester.Stop(), IsNil)
+	c.Assert(tester.RecvAll(), HasLen, 0)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c.Assert(server.posted, HasLen, 1)
+	posted := server.posted[0]
+	c.Assert(posted["matchers"], DeepEquals, []interface{}{
+		map[string]interface{}{"name": "alertname", "value": "HighLoad", "isEqual": true, "isRegex": false},
+		map[string]interface{}{"name": "instance", "value": "db.*", "isEqual": true, "isRegex": true},
+	})
+	c.Assert(posted["createdBy"], Equals, "nick")
+	c.Assert(posted["comment"], Equals, "Deploying.")
+	startsAt, err := time.Parse(time.RFC3339, posted["startsAt"].(string))
+	c.Assert(err, IsNil)
+	endsAt, err := time.Parse(time.RFC3339, posted["endsAt"].(string))
+	c.Assert(err, IsNil)
+	c.Assert(endsAt.Sub(startsAt), Equals, 2*time.Hour)
+}
@@ -0,0 +1,293 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+)
+
+var Commands = schema.Commands{{
+	Name: "silence",
+	Help: `Manages Alertmanager silences.
+
+	"silence add <matchers> <duration> [-- <comment>]" silences the alerts
+	matching all the provided label matchers for the given duration
+	(e.g. "90m", "2h", or "1d"). Matchers are written as name=value,
+	name!=value, name=~regexp, or name!~regexp, and are separated by
+	spaces.
+
+	"silence list" shows the silences currently active.
+	`,
+	Args: schema.Args{{
+		Name: "action",
+		Flag: schema.Required,
+	}, {
+		Name: "args",
+		Flag: schema.Trailing,
+	}},
+}}
+
+// maxSilence is the longest duration a silence may be created for.
+const maxSilence = 30 * 24 * time.Hour
+
+type amMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+func (m amMatcher) String() string {
+	var op string
+	switch {
+	case m.IsEqual && m.IsRegex:
+		op = "=~"
+	case m.IsEqual:
+		op = "="
+	case m.IsRegex:
+		op = "!~"
+	default:
+		op = "!="
+	}
+	return m.Name + op + m.Value
+}
+
+type amSilence struct {
+	Id        string      `json:"id,omitempty"`
+	Matchers  []amMatcher `json:"matchers"`
+	StartsAt  time.Time   `json:"startsAt"`
+	EndsAt    time.Time   `json:"endsAt"`
+	CreatedBy string      `json:"createdBy"`
+	Comment   string      `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+var matcherExp = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)(=~|!~|!=|=)(.*)$`)
+
+func parseMatcher(s string) (amMatcher, error) {
+	m := matcherExp.FindStringSubmatch(s)
+	if m == nil {
+		return amMatcher{}, fmt.Errorf("invalid matcher %q", s)
+	}
+	matcher := amMatcher{
+		Name:    m[1],
+		Value:   strings.Trim(m[3], `"`),
+		IsEqual: m[2][0] == '=',
+		IsRegex: strings.HasSuffix(m[2], "~"),
+	}
+	if matcher.IsRegex {
+		if _, err := regexp.Compile(matcher.Value); err != nil {
+			return amMatcher{}, fmt.Errorf("invalid regexp in matcher %q: %v", s, err)
+		}
+	}
+	return matcher, nil
+}
+
+// parseSilenceDuration parses d as a time.Duration, also accepting a
+// whole number of days such as "2d".
+func parseSilenceDuration(d string) (time.Duration, error) {
+	if strings.HasSuffix(d, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(d, "d"))
+		if err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	duration, err := time.ParseDuration(d)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", d)
+	}
+	return duration, nil
+}
+
+func (p *notifyPlugin) HandleCommand(cmd *mup.Command) {
+	select {
+	case p.commands <- cmd:
+	default:
+		p.plugger.Sendf(cmd, "Alertmanager seems a bit sluggish right now. Please try again soon.")
+	}
+}
+
+func (p *notifyPlugin) commandLoop() error {
+	for cmd := range p.commands {
+		p.silence(cmd)
+	}
+	return nil
+}
+
+// silencer reports whether the sender of msg may manage silences.
+func (p *notifyPlugin) silencer(msg *mup.Message) bool {
+	if msg.Nick == "" {
+		return false
+	}
+	for _, mask := range p.config.Silencers {
+		if mup.MaskMatch(mask, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *notifyPlugin) silence(cmd *mup.Command) {
+	var args struct{ Action, Args string }
+	cmd.Args(&args)
+	if p.config.Alertmanager == "" {
+		p.plugger.Sendf(cmd, "Alertmanager URL is not configured.")
+		return
+	}
+	if !p.silencer(cmd.Message) {
+		p.plugger.Logf("Refused silence %s request from %s!%s@%s.", args.Action, cmd.Nick, cmd.User, cmd.Host)
+		p.plugger.Sendf(cmd, "You are not allowed to manage silences.")
+		return
+	}
+	switch args.Action {
+	case "add":
+		p.addSilence(cmd, args.Args)
+	case "list":
+		p.listSilences(cmd)
+	default:
+		p.plugger.Sendf(cmd, `Unknown action %q. Use "silence add <matchers> <duration>" or "silence list".`, args.Action)
+	}
+}
+
+func (p *notifyPlugin) addSilence(cmd *mup.Command, text string) {
+	comment := ""
+	if i := strings.Index(text, " -- "); i >= 0 {
+		comment = strings.TrimSpace(text[i+4:])
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		p.plugger.Sendf(cmd, "Usage: silence add <matchers> <duration> [-- <comment>]")
+		return
+	}
+	duration, err := parseSilenceDuration(fields[len(fields)-1])
+	if err != nil {
+		p.plugger.Sendf(cmd, "Cannot add silence: %v", err)
+		return
+	}
+	if duration > maxSilence {
+		p.plugger.Sendf(cmd, "Cannot add silence: duration is longer than %d days.", maxSilence/(24*time.Hour))
+		return
+	}
+	silence := &amSilence{
+		StartsAt:  time.Now().UTC(),
+		CreatedBy: cmd.Nick,
+		Comment:   comment,
+	}
+	silence.EndsAt = silence.StartsAt.Add(duration)
+	if silence.Comment == "" {
+		silence.Comment = "Silenced from chat by " + cmd.Nick + "."
+	}
+	for _, field := range fields[:len(fields)-1] {
+		matcher, err := parseMatcher(field)
+		if err != nil {
+			p.plugger.Sendf(cmd, "Cannot add silence: %v", err)
+			return
+		}
+		silence.Matchers = append(silence.Matchers, matcher)
+	}
+
+	var result struct {
+		SilenceID string `json:"silenceID"`
+	}
+	err = p.amRequest("POST", "/api/v2/silences", silence, &result)
+	if err != nil {
+		p.plugger.Sendf(cmd, "Cannot add silence: %v", err)
+		return
+	}
+	p.plugger.Logf("Silence %s added by %s!%s@%s for %s until %s.", result.SilenceID, cmd.Nick, cmd.User, cmd.Host,
+		matchersString(silence.Matchers), silence.EndsAt.Format(time.RFC3339))
+	p.plugger.Sendf(cmd, "Silence %s added for %s until %s.", result.SilenceID, matchersString(silence.Matchers), silence.EndsAt.Format("Mon 15:04 MST"))
+}
+
+func (p *notifyPlugin) listSilences(cmd *mup.Command) {
+	var silences []amSilence
+	err := p.amRequest("GET", "/api/v2/silences", nil, &silences)
+	if err != nil {
+		p.plugger.Sendf(cmd, "Cannot list silences: %v", err)
+		return
+	}
+	var active []amSilence
+	for _, s := range silences {
+		if s.Status != nil && s.Status.State == "active" {
+			active = append(active, s)
+		}
+	}
+	if len(active) == 0 {
+		p.plugger.Sendf(cmd, "There are no active silences.")
+		return
+	}
+	for _, s := range active {
+		p.plugger.Sendf(cmd, "Silence %s for %s until %s by %s: %s", s.Id, matchersString(s.Matchers), s.EndsAt.UTC().Format("Mon 15:04 MST"), s.CreatedBy, s.Comment)
+	}
+}
+
+func matchersString(matchers []amMatcher) string {
+	var parts []string
+	for _, m := range matchers {
+		parts = append(parts, m.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// amRequest performs a request for path under the configured Alertmanager
+// URL, sending body and decoding the JSON response into result.
+func (p *notifyPlugin) amRequest(method, path string, body, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("cannot encode Alertmanager request: %v", err)
+		}
+	}
+	url := strings.TrimRight(p.config.Alertmanager, "/") + path
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		p.plugger.Logf("Cannot perform Alertmanager request: %v", err)
+		return fmt.Errorf("cannot perform Alertmanager request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err != nil {
+		p.plugger.Logf("Cannot perform Alertmanager request: %v", err)
+		return fmt.Errorf("cannot perform Alertmanager request: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		p.plugger.Logf("Cannot read Alertmanager response: %v", err)
+		return fmt.Errorf("cannot read Alertmanager response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		// Errors are reported as a JSON string or plain text.
+		var reason string
+		if json.Unmarshal(data, &reason) != nil {
+			reason = strings.TrimSpace(string(data))
+		}
+		if reason == "" {
+			reason = resp.Status
+		}
+		p.plugger.Logf("Alertmanager request failed: %s", reason)
+		return fmt.Errorf("%s", reason)
+	}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode Alertmanager response: %v\n-----\n%s\n-----", err, data)
+		return fmt.Errorf("cannot decode Alertmanager response: %v", err)
+	}
+	return nil
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -101,8 +100,6 @@ func (p *playPlugin) loop() error {
 	return nil
 }
 
-var httpClient = http.Client{Timeout: time.Duration(10 * time.Second)}
-
 type compileResult struct {
 	Errors string
 	Events []compileEvent
@@ -180,7 +177,7 @@ func (p *playPlugin) play(cmd *mup.Command, action playAction, body string, resu
 	}
 
 	endpoint := p.config.Endpoint + path
-	resp, err := httpClient.Post(p.config.Endpoint+path, "application/x-www-form-urlencoded", bytes.NewBufferString(form.Encode()))
+	resp, err := p.plugger.HTTPClient().Post(p.config.Endpoint+path, "application/x-www-form-urlencoded", bytes.NewBufferString(form.Encode()))
 	if err == nil {
 		defer resp.Body.Close()
 	}
@@ -0,0 +1,96 @@
+package releasewatch
+
+import (
+	"net/url"
+	"strings"
+)
+
+type cratesRegistry struct{}
+
+func (cratesRegistry) defaultEndpoint() string {
+	return "https://crates.io/api/v1/"
+}
+
+func (cratesRegistry) latest(p *watchPlugin, endpoint, name string) (*release, error) {
+	var result struct {
+		Crate struct {
+			MaxStableVersion string `json:"max_stable_version"`
+			Repository       string `json:"repository"`
+		} `json:"crate"`
+	}
+	err := p.request(endpoint, "/crates/"+url.PathEscape(name), &result)
+	if err != nil {
+		return nil, err
+	}
+	r := &release{
+		Version: result.Crate.MaxStableVersion,
+		URL:     githubReleases(result.Crate.Repository),
+	}
+	if r.URL == "" {
+		r.URL = "https://crates.io/crates/" + name + "/" + r.Version
+	}
+	return r, nil
+}
+
+type pypiRegistry struct{}
+
+func (pypiRegistry) defaultEndpoint() string {
+	return "https://pypi.org/pypi/"
+}
+
+// pypiChangelogs holds the project URL labels commonly used for
+// changelogs on PyPI, in lower case.
+var pypiChangelogs = []string{"changelog", "change log", "changes", "release notes", "history"}
+
+func (pypiRegistry) latest(p *watchPlugin, endpoint, name string) (*release, error) {
+	var result struct {
+		Info struct {
+			Version     string            `json:"version"`
+			ProjectURLs map[string]string `json:"project_urls"`
+		} `json:"info"`
+	}
+	err := p.request(endpoint, "/"+url.PathEscape(name)+"/json", &result)
+	if err != nil {
+		return nil, err
+	}
+	r := &release{Version: result.Info.Version}
+	for label, link := range result.Info.ProjectURLs {
+		for _, changelog := range pypiChangelogs {
+			if strings.ToLower(label) == changelog {
+				r.URL = link
+			}
+		}
+	}
+	if r.URL == "" {
+		r.URL = "https://pypi.org/project/" + name + "/" + r.Version + "/"
+	}
+	return r, nil
+}
+
+type npmRegistry struct{}
+
+func (npmRegistry) defaultEndpoint() string {
+	return "https://registry.npmjs.org/"
+}
+
+func (npmRegistry) latest(p *watchPlugin, endpoint, name string) (*release, error) {
+	var result struct {
+		Version    string `json:"version"`
+		Repository struct {
+			URL string `json:"url"`
+		} `json:"repository"`
+	}
+	// Scoped packages keep the @ but have their slash escaped.
+	err := p.request(endpoint, "/"+strings.Replace(name, "/", "%2f", 1)+"/latest", &result)
+	if err != nil {
+		return nil, err
+	}
+	r := &release{
+		Version: result.Version,
+		URL:     githubReleases(result.Repository.URL),
+	}
+	if r.URL == "" {
+		r.URL = "https://www.npmjs.com/package/" + name + "/v/" + r.Version
+	}
+	return r, nil
+}
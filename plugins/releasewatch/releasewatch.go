@@ -0,0 +1,296 @@
+// Package releasewatch implements a plugin announcing new releases of
+// packages published on crates.io, PyPI, and npm.
+//
+// Each supported registry only knows how to fetch the latest stable
+// release of a package. Tracking of the last seen versions, version
+// filtering, and announcements are shared.
+package releasewatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "releasewatch",
+	Help: `Announces new releases of packages on crates.io, PyPI, and npm.
+
+	The "packages" configuration option holds a list of packages to watch, each
+	with a "registry" holding "crates", "pypi", or "npm", the package "name", and
+	an optional "only" setting of "major" or "minor" for announcing only releases
+	that change at least that part of the version. The "endpoints" option may map
+	registries to alternative API endpoints.
+
+	Announcements may be customized via the "templates" configuration option,
+	mapping the "released" event to a template that may refer to the package
+	.Project, the released version in .Id, the registry in .Branch, the link to
+	the changelog or release in .URL, and the "major", "minor", or "patch" level
+	of the release in .State.
+	`,
+	Start: start,
+}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+// registry fetches package releases from a package registry.
+type registry interface {
+	// defaultEndpoint returns the API endpoint used when the plugin
+	// configuration doesn't provide one.
+	defaultEndpoint() string
+
+	// latest returns the latest stable release of the named package.
+	latest(p *watchPlugin, endpoint, name string) (*release, error)
+}
+
+var registries = map[string]registry{
+	"crates": cratesRegistry{},
+	"pypi":   pypiRegistry{},
+	"npm":    npmRegistry{},
+}
+
+// registryNames holds the display names of registries in announcements.
+var registryNames = map[string]string{
+	"crates": "crates.io",
+	"pypi":   "PyPI",
+	"npm":    "npm",
+}
+
+type release struct {
+	Version string
+
+	// URL links to the changelog or release notes when the registry
+	// knows about them, or to the release page in the registry otherwise.
+	URL string
+}
+
+type watchPlugin struct {
+	tomb    tomb.Tomb
+	plugger *mup.Plugger
+	config  struct {
+		Endpoints map[string]string
+		PollDelay mup.DurationString
+		Packages  []struct {
+			Registry string
+			Name     string
+			Only     string
+		}
+	}
+
+	// versions holds the last seen version of each package, by
+	// registry and package name.
+	versions map[[2]string]string
+}
+
+const defaultPollDelay = 30 * time.Minute
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &watchPlugin{
+		plugger:  plugger,
+		versions: make(map[[2]string]string),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.PollDelay.Duration == 0 {
+		p.config.PollDelay.Duration = defaultPollDelay
+	}
+	p.loadVersions()
+	p.tomb.Go(p.loop)
+	return p
+}
+
+func (p *watchPlugin) Stop() error {
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+// loadVersions loads the versions recorded by earlier runs, so that
+// releases made while the plugin was not running are also announced.
+func (p *watchPlugin) loadVersions() {
+	db := p.plugger.DB()
+	if db == nil {
+		return
+	}
+	rows, err := db.Query("SELECT registry,package,version FROM packagerelease WHERE plugin=?", p.plugger.Name())
+	if err != nil {
+		p.plugger.Logf("Cannot load package versions: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var registry, name, version string
+		if err := rows.Scan(&registry, &name, &version); err != nil {
+			p.plugger.Logf("Cannot load package versions: %v", err)
+			return
+		}
+		p.versions[[2]string{registry, name}] = version
+	}
+}
+
+func (p *watchPlugin) recordVersion(registry, name, version string) {
+	p.versions[[2]string{registry, name}] = version
+	db := p.plugger.DB()
+	if db == nil {
+		return
+	}
+	_, err := db.Exec("INSERT OR REPLACE INTO packagerelease (plugin,registry,package,version) VALUES (?,?,?,?)",
+		p.plugger.Name(), registry, name, version)
+	if err != nil {
+		p.plugger.Logf("Cannot record package version: %v", err)
+	}
+}
+
+func (p *watchPlugin) loop() error {
+	for {
+		for _, pkg := range p.config.Packages {
+			reg, ok := registries[pkg.Registry]
+			if !ok {
+				p.plugger.Logf("Unknown registry for package %s: %q", pkg.Name, pkg.Registry)
+				continue
+			}
+			endpoint := p.config.Endpoints[pkg.Registry]
+			if endpoint == "" {
+				endpoint = reg.defaultEndpoint()
+			}
+			r, err := reg.latest(p, endpoint, pkg.Name)
+			if err != nil || r.Version == "" {
+				continue
+			}
+			old, known := p.versions[[2]string{pkg.Registry, pkg.Name}]
+			if old == r.Version {
+				continue
+			}
+			level, newer := versionChange(old, r.Version)
+			if known && !newer {
+				// Releases may be yanked, so the latest version going back
+				// is not recorded, and its return is not taken as news.
+				continue
+			}
+			p.recordVersion(pkg.Registry, pkg.Name, r.Version)
+			if known && wanted(pkg.Only, level) {
+				p.announce(pkg.Registry, pkg.Name, old, level, r)
+			}
+		}
+
+		select {
+		case <-time.After(p.config.PollDelay.Duration):
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (p *watchPlugin) announce(registry, name, old, level string, r *release) {
+	p.plugger.Announce(&mup.Announcement{
+		Event:   "released",
+		Text:    fmt.Sprintf("%s %s released on %s (was %s): %s", name, r.Version, registryNames[registry], old, r.URL),
+		Id:      r.Version,
+		Title:   name + " " + r.Version,
+		URL:     r.URL,
+		Project: name,
+		Branch:  registry,
+		State:   level,
+	})
+}
+
+// parseVersion returns the major, minor, and patch numbers of a semantic
+// version such as "v1.2.3-rc1", with missing numbers taken as zero.
+func parseVersion(version string) (v [3]int, ok bool) {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// versionChange returns the "major", "minor", or "patch" level of the
+// change from one version to another, and whether the change is an
+// upgrade. Versions that cannot be parsed are taken as a major upgrade.
+func versionChange(from, to string) (level string, newer bool) {
+	o, ok1 := parseVersion(from)
+	n, ok2 := parseVersion(to)
+	if !ok1 || !ok2 {
+		return "major", true
+	}
+	for i, level := range []string{"major", "minor", "patch"} {
+		if o[i] != n[i] {
+			return level, n[i] > o[i]
+		}
+	}
+	return "patch", false
+}
+
+// wanted returns whether a release at level is announced under the only
+// setting of a package.
+func wanted(only, level string) bool {
+	switch only {
+	case "major":
+		return level == "major"
+	case "minor":
+		return level != "patch"
+	}
+	return true
+}
+
+// request performs a GET request for path under endpoint and decodes
+// the JSON response into result.
+func (p *watchPlugin) request(endpoint, path string, result interface{}) error {
+	url := strings.TrimRight(endpoint, "/") + "/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		p.plugger.Logf("Cannot perform registry request: %v", err)
+		return fmt.Errorf("cannot perform registry request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot perform registry request: %v", err)
+		return fmt.Errorf("cannot perform registry request: %v", err)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode registry response: %v", err)
+		return fmt.Errorf("cannot decode registry response: %v", err)
+	}
+	return nil
+}
+
+// githubReleases returns the releases page of repo if it's hosted on
+// GitHub, or the empty string otherwise. Repository URLs as found in
+// package metadata, such as "git+https://github.com/org/repo.git", are
+// accepted.
+func githubReleases(repo string) string {
+	repo = strings.TrimPrefix(repo, "git+")
+	repo = strings.TrimSuffix(repo, ".git")
+	repo = strings.Replace(repo, "git://", "https://", 1)
+	if !strings.HasPrefix(repo, "https://github.com/") {
+		return ""
+	}
+	return strings.TrimRight(repo, "/") + "/releases"
+}
@@ -0,0 +1,146 @@
+package releasewatch_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/releasewatch"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+// registryServer serves all registries, with each package moving to
+// the next of its versions on every request.
+type registryServer struct {
+	mu       sync.Mutex
+	versions map[string][]string
+	served   map[string]int
+}
+
+func (s *registryServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := req.URL.EscapedPath()
+	versions, ok := s.versions[path]
+	if !ok {
+		panic("got unexpected request for " + path + " in test registryServer")
+	}
+	version := versions[s.served[path]]
+	if s.served[path] < len(versions)-1 {
+		s.served[path]++
+	}
+	switch path {
+	case "/crates/serde":
+		fmt.Fprintf(w, `{"crate": {"max_stable_version": %q, "repository": "https://github.com/serde-rs/serde"}}`, version)
+	case "/requests/json":
+		fmt.Fprintf(w, `{"info": {"version": %q, "project_urls": {"Homepage": "https://example.com", "Changelog": "https://example.com/changes"}}}`, version)
+	case "/pytest/json":
+		fmt.Fprintf(w, `{"info": {"version": %q}}`, version)
+	default:
+		fmt.Fprintf(w, `{"version": %q, "repository": {"type": "git", "url": "git+https://github.com/org/repo.git"}}`, version)
+	}
+}
+
+func (s *registryServer) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path, versions := range s.versions {
+		if s.served[path] < len(versions)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *S) TestWatch(c *C) {
+	server := &registryServer{
+		versions: map[string][]string{
+			"/crates/serde":        {"1.0.199", "1.0.200", "1.0.200"},
+			"/requests/json":       {"2.31.0", "2.30.0", "2.31.0", "2.32.0"},
+			"/pytest/json":         {"8.1.1", "8.2.0", "9.0.0"},
+			"/@scope%2fpkg/latest": {"1.0.0", "1.0.1", "1.1.0", "2.0.0"},
+		},
+		served: make(map[string]int),
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("releasewatch")
+	tester.SetConfig(mup.Map{
+		"endpoints": mup.Map{"crates": httpServer.URL, "pypi": httpServer.URL, "npm": httpServer.URL},
+		"polldelay": "20ms",
+		"packages": []mup.Map{
+			{"registry": "crates", "name": "serde"},
+			{"registry": "pypi", "name": "requests"},
+			{"registry": "pypi", "name": "pytest", "only": "major"},
+			{"registry": "npm", "name": "@scope/pkg", "only": "minor"},
+		},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :serde 1.0.200 released on crates.io (was 1.0.199): https://github.com/serde-rs/serde/releases")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :pytest 9.0.0 released on PyPI (was 8.2.0): https://pypi.org/project/pytest/9.0.0/")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :@scope/pkg 1.1.0 released on npm (was 1.0.1): https://github.com/org/repo/releases")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :requests 2.32.0 released on PyPI (was 2.31.0): https://example.com/changes")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :@scope/pkg 2.0.0 released on npm (was 1.1.0): https://github.com/org/repo/releases")
+
+	for !server.done() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tester.Stop()
+	c.Assert(tester.RecvAll(), HasLen, 0)
+}
+
+func (s *S) TestWatchPersisted(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO packagerelease (plugin,registry,package,version) VALUES ('releasewatch','crates','serde','1.0.198')")
+	c.Assert(err, IsNil)
+
+	server := &registryServer{
+		versions: map[string][]string{"/crates/serde": {"1.0.199"}},
+		served:   make(map[string]int),
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("releasewatch")
+	tester.SetDB(db)
+	tester.SetConfig(mup.Map{
+		"endpoints": mup.Map{"crates": httpServer.URL},
+		"packages":  []mup.Map{{"registry": "crates", "name": "serde"}},
+		"templates": mup.Map{"released": "{{.Project}} {{.Id}} ({{.State}}) is out on {{.Branch}}"},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :serde 1.0.199 (patch) is out on crates")
+	tester.Stop()
+
+	var version string
+	err = db.QueryRow("SELECT version FROM packagerelease WHERE plugin='releasewatch' AND package='serde'").Scan(&version)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, "1.0.199")
+}
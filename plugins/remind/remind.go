@@ -0,0 +1,331 @@
+package remind
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "remind",
+	Help: `Delivers reminders at a later time.
+
+	Reminders are stored in the database, so they are still delivered
+	after the bot is restarted. Reminders for a channel are only accepted
+	if the channel is one of the plugin targets.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "remind",
+	Help: `Schedules a reminder for yourself, for a channel, or for someone else.
+
+	The time may be provided as "in <duration>" or as "at [<YYYY-MM-DD>] <HH:MM>".
+	For example: "remind me in 2h to check the build", or "remind #chan at 15:00
+	to join the standup". Times are interpreted in the timezone configured
+	for the plugin, or in the bot's local timezone otherwise.
+	`,
+	Args: schema.Args{{
+		Name: "who",
+		Hint: "me|#channel|nick",
+		Flag: schema.Required,
+	}, {
+		Name: "spec",
+		Hint: "in <duration>|at <time> [to] <text>",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type remindPlugin struct {
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	location *time.Location
+	added    chan *reminder
+	config   struct {
+		Timezone string
+	}
+}
+
+type reminder struct {
+	Id      int64
+	Plugin  string
+	Time    time.Time
+	Account string
+	Channel string
+	Nick    string
+	Sender  string
+	Text    string
+}
+
+const reminderColumns = "id,plugin,time,account,channel,nick,sender,text"
+const reminderPlacers = "?,?,?,?,?,?,?,?"
+
+func (r *reminder) refs() []interface{} {
+	return []interface{}{&r.Id, &r.Plugin, &r.Time, &r.Account, &r.Channel, &r.Nick, &r.Sender, &r.Text}
+}
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &remindPlugin{
+		plugger:  plugger,
+		location: time.Local,
+		added:    make(chan *reminder),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Timezone != "" {
+		location, err := time.LoadLocation(p.config.Timezone)
+		if err != nil {
+			plugger.Logf("Cannot load timezone %q: %v", p.config.Timezone, err)
+		} else {
+			p.location = location
+		}
+	}
+	pending, err := p.loadReminders()
+	if err != nil {
+		plugger.Logf("Cannot load pending reminders: %v", err)
+	}
+	p.tomb.Go(func() error { return p.loop(pending) })
+	return p
+}
+
+func (p *remindPlugin) Stop() error {
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+func (p *remindPlugin) loadReminders() ([]*reminder, error) {
+	rows, err := p.plugger.DB().Query("SELECT "+reminderColumns+" FROM reminder WHERE plugin=? ORDER BY time", p.plugger.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pending []*reminder
+	for rows.Next() {
+		var r reminder
+		if err := rows.Scan(r.refs()...); err != nil {
+			return nil, err
+		}
+		pending = append(pending, &r)
+	}
+	return pending, rows.Err()
+}
+
+func (p *remindPlugin) loop(pending []*reminder) error {
+	for {
+		var due <-chan time.Time
+		if len(pending) > 0 {
+			due = time.After(pending[0].Time.Sub(time.Now()))
+		}
+		select {
+		case r := <-p.added:
+			i := sort.Search(len(pending), func(i int) bool { return pending[i].Time.After(r.Time) })
+			pending = append(pending, nil)
+			copy(pending[i+1:], pending[i:])
+			pending[i] = r
+		case <-due:
+			now := time.Now()
+			for len(pending) > 0 && !pending[0].Time.After(now) {
+				p.deliver(pending[0])
+				pending = pending[1:]
+			}
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (p *remindPlugin) deliver(r *reminder) {
+	to := mup.Address{Account: r.Account, Channel: r.Channel, Nick: r.Nick}
+	switch {
+	case r.Nick == "":
+		p.plugger.SendChannelf(to, "Reminder from %s: %s", r.Sender, r.Text)
+	case r.Nick == r.Sender:
+		p.plugger.Sendf(to, "Reminder: %s", r.Text)
+	default:
+		p.plugger.Sendf(to, "%s asked me to remind you: %s", r.Sender, r.Text)
+	}
+	_, err := p.plugger.DB().Exec("DELETE FROM reminder WHERE id=?", r.Id)
+	if err != nil {
+		p.plugger.Logf("Cannot delete delivered reminder %d: %v", r.Id, err)
+	}
+}
+
+func (p *remindPlugin) HandleCommand(cmd *mup.Command) {
+	var args struct{ Who, Spec string }
+	cmd.Args(&args)
+
+	// Times are relative to the timezone of the target, if set.
+	now := p.plugger.Localize(cmd, time.Now().In(p.location))
+	when, text, err := p.parseSpec(args.Spec, now)
+	if err != nil {
+		p.plugger.Sendf(cmd, "Oops: %v", err)
+		return
+	}
+
+	r := &reminder{
+		Plugin:  p.plugger.Name(),
+		Time:    when.UTC(),
+		Account: cmd.Account,
+		Channel: cmd.Channel,
+		Sender:  cmd.Nick,
+		Text:    text,
+	}
+	var whom string
+	switch {
+	case args.Who == "me":
+		r.Nick = cmd.Nick
+		whom = "you"
+	case args.Who[0] == '#' || args.Who[0] == '&':
+		if !p.isTarget(cmd.Account, args.Who) {
+			p.plugger.Sendf(cmd, "Oops: I'm not allowed to send reminders to %s.", args.Who)
+			return
+		}
+		r.Channel = args.Who
+		whom = args.Who
+	default:
+		r.Nick = args.Who
+		whom = args.Who
+	}
+
+	res, err := p.plugger.DB().Exec("INSERT INTO reminder (plugin,time,account,channel,nick,sender,text) VALUES (?,?,?,?,?,?,?)",
+		r.Plugin, r.Time, r.Account, r.Channel, r.Nick, r.Sender, r.Text)
+	if err == nil {
+		r.Id, err = res.LastInsertId()
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot insert reminder: %v", err)
+		p.plugger.Sendf(cmd, "Oops: cannot store reminder: %v", err)
+		return
+	}
+
+	select {
+	case p.added <- r:
+	case <-p.tomb.Dying():
+		return
+	}
+	p.plugger.Sendf(cmd, "Okay, I'll remind %s %s.", whom, p.formatWhen(cmd, when, now))
+}
+
+func (p *remindPlugin) isTarget(account, channel string) bool {
+	addr := mup.Address{Account: account, Channel: channel}
+	for _, target := range p.plugger.Targets() {
+		if target.Account != "" && target.Nick == "" && target.Address().Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatWhen returns when formatted for the target of the provided
+// address, taking the time zone of now as the one to present it in.
+func (p *remindPlugin) formatWhen(to mup.Addressable, when, now time.Time) string {
+	when = when.In(now.Location())
+	y1, m1, d1 := when.Date()
+	y2, m2, d2 := now.Date()
+	if y1 == y2 && m1 == m2 && d1 == d2 {
+		return "at " + p.plugger.FormatTime(to, when, "15:04:05")
+	}
+	return "on " + p.plugger.FormatTime(to, when, "Mon Jan 2 at 15:04")
+}
+
+var (
+	inExp = regexp.MustCompile(`(?i)^in\s+(\d+)\s*([a-z]+)\s+(.*)$`)
+	inGo  = regexp.MustCompile(`(?i)^in\s+(\S+)\s+(.*)$`)
+	atExp = regexp.MustCompile(`(?i)^at\s+(?:(\d{4}-\d{2}-\d{2})\s+)?(\d{1,2}):(\d{2})\s+(.*)$`)
+)
+
+var units = map[string]time.Duration{
+	"s":       time.Second,
+	"sec":     time.Second,
+	"secs":    time.Second,
+	"second":  time.Second,
+	"seconds": time.Second,
+	"m":       time.Minute,
+	"min":     time.Minute,
+	"mins":    time.Minute,
+	"minute":  time.Minute,
+	"minutes": time.Minute,
+	"h":       time.Hour,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"d":       24 * time.Hour,
+	"day":     24 * time.Hour,
+	"days":    24 * time.Hour,
+	"w":       7 * 24 * time.Hour,
+	"week":    7 * 24 * time.Hour,
+	"weeks":   7 * 24 * time.Hour,
+}
+
+// parseSpec parses the time and text of a reminder spec relative to now.
+func (p *remindPlugin) parseSpec(spec string, now time.Time) (when time.Time, text string, err error) {
+	spec = strings.TrimSpace(spec)
+	if m := inGo.FindStringSubmatch(spec); m != nil {
+		if d, err := time.ParseDuration(m[1]); err == nil {
+			when, text = now.Add(d), m[2]
+		}
+	}
+	if text == "" {
+		if m := inExp.FindStringSubmatch(spec); m != nil {
+			unit, ok := units[strings.ToLower(m[2])]
+			if !ok {
+				return when, "", fmt.Errorf("unknown time unit: %s", m[2])
+			}
+			n, _ := strconv.Atoi(m[1])
+			when, text = now.Add(time.Duration(n)*unit), m[3]
+		} else if m := atExp.FindStringSubmatch(spec); m != nil {
+			when, err = p.parseAt(m[1], m[2], m[3], now)
+			if err != nil {
+				return when, "", err
+			}
+			text = m[4]
+		} else {
+			return when, "", fmt.Errorf(`reminder must start with "in <duration>" or "at <time>"`)
+		}
+	}
+	if text == "to" || strings.HasPrefix(text, "to ") {
+		text = strings.TrimSpace(text[2:])
+	}
+	if text == "" {
+		return when, "", fmt.Errorf("missing reminder text")
+	}
+	if when.Before(now) {
+		return when, "", fmt.Errorf("reminder time is in the past")
+	}
+	return when, text, nil
+}
+
+func (p *remindPlugin) parseAt(date, hour, minute string, now time.Time) (time.Time, error) {
+	h, _ := strconv.Atoi(hour)
+	m, _ := strconv.Atoi(minute)
+	if h > 23 || m > 59 {
+		return time.Time{}, fmt.Errorf("invalid time of day: %s:%s", hour, minute)
+	}
+	location := now.Location()
+	if date == "" {
+		when := time.Date(now.Year(), now.Month(), now.Day(), h, m, 0, 0, location)
+		if !when.After(now) {
+			when = when.AddDate(0, 0, 1)
+		}
+		return when, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", date, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date: %s", date)
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, location), nil
+}
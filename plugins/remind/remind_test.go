@@ -0,0 +1,154 @@
+package remind_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/remind"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct {
+	db     *sql.DB
+	tester *mup.PluginTester
+}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	s.db = db
+
+	s.tester = mup.NewPluginTester("remind")
+	s.tester.SetDB(s.db)
+	s.tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.tester.Stop()
+	s.db.Close()
+
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+func (s *S) pending(c *C) int {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM reminder").Scan(&count)
+	c.Assert(err, IsNil)
+	return count
+}
+
+var remindTests = []struct {
+	send  string
+	reply string
+	recv  string
+}{{
+	send:  "remind me in 50ms to check the build",
+	reply: `PRIVMSG nick :Okay, I'll remind you at \d\d:\d\d:\d\d\.`,
+	recv:  "PRIVMSG nick :Reminder: check the build",
+}, {
+	send:  "[#chan] mup: remind me in 50ms check the build",
+	reply: `PRIVMSG #chan :nick: Okay, I'll remind you at \d\d:\d\d:\d\d\.`,
+	recv:  "PRIVMSG #chan :nick: Reminder: check the build",
+}, {
+	send:  "[#chan] mup: remind bob in 50ms to review the branch",
+	reply: `PRIVMSG #chan :nick: Okay, I'll remind bob at \d\d:\d\d:\d\d\.`,
+	recv:  "PRIVMSG #chan :bob: nick asked me to remind you: review the branch",
+}, {
+	send:  "remind #chan in 50ms to join the standup",
+	reply: `PRIVMSG nick :Okay, I'll remind #chan at \d\d:\d\d:\d\d\.`,
+	recv:  "PRIVMSG #chan :Reminder from nick: join the standup",
+}}
+
+func (s *S) TestRemind(c *C) {
+	s.tester.Start()
+	for i, test := range remindTests {
+		c.Logf("Testing message #%d: %s", i, test.send)
+		s.tester.Sendf(test.send)
+		c.Assert(s.tester.Recv(), Matches, test.reply)
+		c.Assert(s.tester.Recv(), Equals, test.recv)
+	}
+	s.tester.Stop()
+	c.Assert(s.pending(c), Equals, 0)
+}
+
+var errorTests = []struct {
+	send string
+	recv string
+}{{
+	send: "remind me tomorrow to do it",
+	recv: `PRIVMSG nick :Oops: reminder must start with "in <duration>" or "at <time>"`,
+}, {
+	send: "remind me in 2 fortnights to do it",
+	recv: "PRIVMSG nick :Oops: unknown time unit: fortnights",
+}, {
+	send: "remind me at 25:00 to do it",
+	recv: "PRIVMSG nick :Oops: invalid time of day: 25:00",
+}, {
+	send: "remind me at 2000-01-01 10:00 to do it",
+	recv: "PRIVMSG nick :Oops: reminder time is in the past",
+}, {
+	send: "remind me in 2h to",
+	recv: "PRIVMSG nick :Oops: missing reminder text",
+}, {
+	send: "remind #other in 2h to do it",
+	recv: "PRIVMSG nick :Oops: I'm not allowed to send reminders to #other.",
+}}
+
+func (s *S) TestErrors(c *C) {
+	s.tester.Start()
+	for i, test := range errorTests {
+		c.Logf("Testing message #%d: %s", i, test.send)
+		s.tester.Sendf(test.send)
+		c.Assert(s.tester.Recv(), Equals, test.recv)
+	}
+	s.tester.Stop()
+	c.Assert(s.pending(c), Equals, 0)
+}
+
+func (s *S) TestLater(c *C) {
+	s.tester.Start()
+	s.tester.Sendf("remind me in 2 hours to stretch")
+	c.Assert(s.tester.Recv(), Matches, `PRIVMSG nick :Okay, I'll remind you (at|on) .*\.`)
+	s.tester.Sendf("remind me at 2100-01-01 10:00 to celebrate")
+	c.Assert(s.tester.Recv(), Equals, "PRIVMSG nick :Okay, I'll remind you on Fri Jan 1 at 10:00.")
+	s.tester.Stop()
+	c.Assert(s.pending(c), Equals, 2)
+}
+
+func (s *S) TestTargetLocale(c *C) {
+	s.tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan", Timezone: "Asia/Tokyo", Locale: "de"}})
+	s.tester.Start()
+	s.tester.Sendf("[#chan] mup: remind me at 2100-01-01 10:00 to celebrate")
+	c.Assert(s.tester.Recv(), Equals, "PRIVMSG #chan :nick: Okay, I'll remind you on Fr Jan 1 at 10:00.")
+	s.tester.Stop()
+
+	var when time.Time
+	err := s.db.QueryRow("SELECT time FROM reminder").Scan(&when)
+	c.Assert(err, IsNil)
+	c.Assert(when.UTC(), Equals, time.Date(2100, 1, 1, 1, 0, 0, 0, time.UTC))
+}
+
+func (s *S) TestDeliverAfterRestart(c *C) {
+	past := time.Now().Add(-time.Minute).UTC()
+	_, err := s.db.Exec("INSERT INTO reminder (plugin,time,account,channel,nick,sender,text) VALUES ('remind',?,'test','','bob','alice','hello')", past)
+	c.Assert(err, IsNil)
+	_, err = s.db.Exec("INSERT INTO reminder (plugin,time,account,channel,nick,sender,text) VALUES ('other',?,'test','','bob','alice','ignored')", past)
+	c.Assert(err, IsNil)
+
+	s.tester.Start()
+	c.Assert(s.tester.Recv(), Equals, "PRIVMSG bob :alice asked me to remind you: hello")
+	s.tester.Stop()
+	c.Assert(s.tester.Recv(), Equals, "")
+	c.Assert(s.pending(c), Equals, 1)
+}
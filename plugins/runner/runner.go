@@ -0,0 +1,380 @@
+// Package runner implements a plugin that runs allowlisted local scripts
+// on request of authorized people, reporting their output into the chat.
+package runner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "runner",
+	Help: `Runs allowlisted local scripts via chat commands.
+
+	Scripts are listed in the "scripts" configuration option, each with
+	a "name" used in the run command, the "command" to execute and its
+	fixed "args", the working directory in "dir", and the "timeout" after
+	which the script is killed (one minute by default). Scripts are run
+	directly rather than via a shell.
+
+	The arguments people may provide are described in the "params" list
+	of the script, each with a "name", a "pattern" regular expression the
+	whole value must match, and whether it is "required". Values are
+	appended to the fixed arguments in order. When no pattern is given,
+	values must be made of letters, digits, and the characters "._/:=+@-",
+	and cannot start with a dash. Scripts without params take no
+	arguments.
+
+	Each script must name a "role" defined in the "roles" option, which
+	maps role names to the masks of the people holding them. Masks with a
+	"!" or "@" are matched against the full nick!user@host of the sender,
+	and others against the nick alone, with "*" and "?" as wildcards.
+	Scripts without a role, or with an unknown one, are never run.
+
+	The output of the script is sent back as it is produced, up to the
+	number of lines in the "lines" option (10 by default), with long
+	lines truncated. The script also gets the requester nick, channel,
+	and account in the MUP_NICK, MUP_CHANNEL, and MUP_ACCOUNT variables.
+	A script may not run again while it is still running.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "run",
+	Help: "Runs the named script with the provided arguments.",
+	Args: schema.Args{{
+		Name: "script",
+		Flag: schema.Required,
+	}, {
+		Name: "args",
+		Flag: schema.Trailing,
+	}},
+}, {
+	Name: "scripts",
+	Help: "Lists the scripts the sender may run.",
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+const (
+	defaultTimeout = time.Minute
+	defaultLines   = 10
+
+	// maxLineLen is the length after which output lines are truncated.
+	maxLineLen = 300
+)
+
+// defaultPattern is the pattern argument values must match when their
+// param has no pattern of its own.
+const defaultPattern = `[\w.:=+@][\w./:=+@-]*`
+
+type paramConfig struct {
+	Name     string
+	Pattern  string
+	Required bool
+}
+
+type scriptConfig struct {
+	Name    string
+	Command string
+	Args    []string
+	Params  []paramConfig
+	Dir     string
+	Timeout mup.DurationString
+	Role    string
+}
+
+type script struct {
+	scriptConfig
+	params []*regexp.Regexp
+}
+
+type runnerPlugin struct {
+	mu      sync.Mutex
+	tomb    tomb.Tomb
+	plugger *mup.Plugger
+	config  struct {
+		Scripts []scriptConfig
+		Roles   map[string][]string
+		Lines   int
+	}
+	scripts map[string]*script
+	running map[string]bool
+}
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &runnerPlugin{
+		plugger: plugger,
+		scripts: make(map[string]*script),
+		running: make(map[string]bool),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Lines <= 0 {
+		p.config.Lines = defaultLines
+	}
+	for _, sc := range p.config.Scripts {
+		s, err := p.compile(sc)
+		if err != nil {
+			// Leaving the script out can only refuse more requests.
+			plugger.Logf("Ignoring script %q: %v", sc.Name, err)
+			continue
+		}
+		p.scripts[s.Name] = s
+	}
+	p.tomb.Go(func() error {
+		<-p.tomb.Dying()
+		return nil
+	})
+	return p
+}
+
+func (p *runnerPlugin) compile(sc scriptConfig) (*script, error) {
+	if sc.Name == "" || sc.Command == "" {
+		return nil, fmt.Errorf("script must have both a name and a command")
+	}
+	if sc.Role == "" {
+		return nil, fmt.Errorf("script has no role")
+	}
+	if _, ok := p.config.Roles[sc.Role]; !ok {
+		return nil, fmt.Errorf("role %q is not defined", sc.Role)
+	}
+	if sc.Timeout.Duration <= 0 {
+		sc.Timeout.Duration = defaultTimeout
+	}
+	s := &script{scriptConfig: sc}
+	for i, param := range sc.Params {
+		if param.Required && i > 0 && !sc.Params[i-1].Required {
+			return nil, fmt.Errorf("required param %q follows an optional one", param.Name)
+		}
+		pattern := param.Pattern
+		if pattern == "" {
+			pattern = defaultPattern
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for param %q: %v", param.Name, err)
+		}
+		s.params = append(s.params, re)
+	}
+	return s, nil
+}
+
+func (p *runnerPlugin) Stop() error {
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+func (p *runnerPlugin) HandleCommand(cmd *mup.Command) {
+	switch cmd.Name() {
+	case "run":
+		p.run(cmd)
+	case "scripts":
+		p.list(cmd)
+	default:
+		p.plugger.Sendf(cmd, "I have a bug. Command %q exists and I don't know how to handle it.", cmd.Name())
+	}
+}
+
+// authorized reports whether the sender of msg holds the provided role.
+func (p *runnerPlugin) authorized(msg *mup.Message, role string) bool {
+	if msg.Nick == "" {
+		return false
+	}
+	for _, mask := range p.config.Roles[role] {
+		if mup.MaskMatch(mask, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *runnerPlugin) list(cmd *mup.Command) {
+	var names []string
+	for name, s := range p.scripts {
+		if p.authorized(cmd.Message, s.Role) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		p.plugger.Sendf(cmd, "There are no scripts you may run.")
+		return
+	}
+	sort.Strings(names)
+	p.plugger.Sendf(cmd, "Scripts you may run: %s.", strings.Join(names, ", "))
+}
+
+func (p *runnerPlugin) run(cmd *mup.Command) {
+	var args struct{ Script, Args string }
+	cmd.Args(&args)
+
+	// Unknown and unauthorized scripts are reported alike, so the
+	// configuration isn't disclosed to people that cannot use it.
+	s := p.scripts[args.Script]
+	if s == nil || !p.authorized(cmd.Message, s.Role) {
+		p.plugger.Logf("Refused to run script %q for %s!%s@%s.", args.Script, cmd.Nick, cmd.User, cmd.Host)
+		p.plugger.Sendf(cmd, "Cannot run script %q.", args.Script)
+		return
+	}
+
+	values := strings.Fields(args.Args)
+	if problem := s.check(values); problem != "" {
+		p.plugger.Sendf(cmd, "%s", problem)
+		return
+	}
+
+	p.mu.Lock()
+	if p.running[s.Name] {
+		p.mu.Unlock()
+		p.plugger.Sendf(cmd, "Script %q is already running.", s.Name)
+		return
+	}
+	p.running[s.Name] = true
+	p.mu.Unlock()
+
+	p.plugger.Logf("Running script %q with args %q for %s!%s@%s.", s.Name, values, cmd.Nick, cmd.User, cmd.Host)
+	p.tomb.Go(func() error {
+		p.execute(cmd, s, values)
+		p.mu.Lock()
+		delete(p.running, s.Name)
+		p.mu.Unlock()
+		return nil
+	})
+}
+
+// check returns a message explaining why values are not acceptable as
+// arguments for the script, or an empty string if they are.
+func (s *script) check(values []string) string {
+	if len(values) > len(s.Params) {
+		if len(s.Params) == 0 {
+			return fmt.Sprintf("Script %q takes no arguments.", s.Name)
+		}
+		return fmt.Sprintf("Too many arguments. Usage: run %s %s", s.Name, s.usage())
+	}
+	for i, param := range s.Params {
+		if i >= len(values) {
+			if param.Required {
+				return fmt.Sprintf("Missing arguments. Usage: run %s %s", s.Name, s.usage())
+			}
+			break
+		}
+		if !s.params[i].MatchString(values[i]) {
+			return fmt.Sprintf("Invalid value for %s: %q", param.Name, values[i])
+		}
+	}
+	return ""
+}
+
+func (s *script) usage() string {
+	var buf strings.Builder
+	for i, param := range s.Params {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		if param.Required {
+			buf.WriteString("<" + param.Name + ">")
+		} else {
+			buf.WriteString("[<" + param.Name + ">]")
+		}
+	}
+	return buf.String()
+}
+
+// execute runs the script with the provided values as arguments, and
+// reports its output and outcome back to the sender of cmd.
+func (p *runnerPlugin) execute(cmd *mup.Command, s *script, values []string) {
+	ctx, cancel := context.WithTimeout(p.tomb.Context(nil), s.Timeout.Duration)
+	defer cancel()
+
+	c := exec.CommandContext(ctx, s.Command, append(append([]string(nil), s.Args...), values...)...)
+	c.Dir = s.Dir
+	c.Env = append(os.Environ(),
+		"MUP_NICK="+cmd.Nick,
+		"MUP_CHANNEL="+cmd.Channel,
+		"MUP_ACCOUNT="+cmd.Account,
+	)
+	r, w := io.Pipe()
+	c.Stdout = w
+	c.Stderr = w
+
+	err := c.Start()
+	if err != nil {
+		w.Close()
+		p.plugger.Logf("Cannot start script %q: %v", s.Name, err)
+		p.plugger.Sendf(cmd, "Cannot start script %q: %v", s.Name, err)
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := c.Wait()
+		w.Close()
+		done <- err
+	}()
+
+	// The whole output is read even past the line limit, so that the
+	// script doesn't block writing to the pipe.
+	sent, omitted := 0, 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" {
+			continue
+		}
+		if sent == p.config.Lines {
+			omitted++
+			continue
+		}
+		sent++
+		if len(line) > maxLineLen {
+			cut := maxLineLen
+			for cut > 0 && line[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			line = line[:cut] + "…"
+		}
+		p.plugger.Sendf(cmd, "[%s] %s", s.Name, line)
+	}
+	if scanner.Err() != nil {
+		// Keep draining so Wait isn't stuck on a blocked writer.
+		io.Copy(ioutil.Discard, r)
+	}
+	err = <-done
+
+	if omitted > 0 {
+		p.plugger.Sendf(cmd, "[%s] (%d more lines omitted)", s.Name, omitted)
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		p.plugger.Logf("Script %q timed out after %v.", s.Name, s.Timeout.Duration)
+		p.plugger.Sendf(cmd, "Script %q timed out after %v.", s.Name, s.Timeout.Duration)
+	case !p.tomb.Alive():
+		p.plugger.Logf("Script %q interrupted as the plugin is stopping.", s.Name)
+	case err != nil:
+		p.plugger.Logf("Script %q failed: %v", s.Name, err)
+		p.plugger.Sendf(cmd, "Script %q failed: %v", s.Name, err)
+	default:
+		p.plugger.Logf("Script %q completed.", s.Name)
+		p.plugger.Sendf(cmd, "Script %q completed.", s.Name)
+	}
+}
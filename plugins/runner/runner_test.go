@@ -0,0 +1,169 @@
+package runner_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/runner"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+// The fixed --prod argument comes first, followed by the provided values.
+const deployScript = `#!/bin/sh
+echo "deploying $2 as $MUP_NICK on $MUP_CHANNEL from $(pwd)"
+echo
+echo "args: $*"
+`
+
+const chattyScript = `#!/bin/sh
+for i in 1 2 3 4 5; do echo "line $i"; done
+exit 3
+`
+
+const sleepScript = `#!/bin/sh
+exec sleep 10
+`
+
+type runnerTest struct {
+	send []string
+	recv []string
+}
+
+var runnerTests = []runnerTest{{
+	send: []string{"[#chan] mup: scripts"},
+	recv: []string{"PRIVMSG #chan :nick: Scripts you may run: chatty, deploy, sleep."},
+}, {
+	send: []string{"[#chan] mup: run unknown"},
+	recv: []string{"PRIVMSG #chan :nick: Cannot run script \"unknown\"."},
+}, {
+	// Defined with an unknown role, so never available.
+	send: []string{"[#chan] mup: run orphan"},
+	recv: []string{"PRIVMSG #chan :nick: Cannot run script \"orphan\"."},
+}, {
+	// The sender doesn't hold the admin role.
+	send: []string{"[#chan] mup: run reboot"},
+	recv: []string{"PRIVMSG #chan :nick: Cannot run script \"reboot\"."},
+}, {
+	send: []string{"[#chan] mup: run deploy"},
+	recv: []string{"PRIVMSG #chan :nick: Missing arguments. Usage: run deploy <service> [<version>]"},
+}, {
+	send: []string{"[#chan] mup: run deploy db"},
+	recv: []string{"PRIVMSG #chan :nick: Invalid value for service: \"db\""},
+}, {
+	send: []string{"[#chan] mup: run deploy web -rf"},
+	recv: []string{"PRIVMSG #chan :nick: Invalid value for version: \"-rf\""},
+}, {
+	send: []string{"[#chan] mup: run deploy web 1.2 extra"},
+	recv: []string{"PRIVMSG #chan :nick: Too many arguments. Usage: run deploy <service> [<version>]"},
+}, {
+	send: []string{"[#chan] mup: run chatty now"},
+	recv: []string{"PRIVMSG #chan :nick: Script \"chatty\" takes no arguments."},
+}, {
+	send: []string{"[#chan] mup: run deploy web 1.2"},
+	recv: []string{
+		"PRIVMSG #chan :nick: [deploy] deploying web as nick on #chan from DIR",
+		"PRIVMSG #chan :nick: [deploy] args: --prod web 1.2",
+		"PRIVMSG #chan :nick: Script \"deploy\" completed.",
+	},
+}, {
+	send: []string{"[#chan] mup: run chatty"},
+	recv: []string{
+		"PRIVMSG #chan :nick: [chatty] line 1",
+		"PRIVMSG #chan :nick: [chatty] line 2",
+		"PRIVMSG #chan :nick: [chatty] line 3",
+		"PRIVMSG #chan :nick: [chatty] (2 more lines omitted)",
+		"PRIVMSG #chan :nick: Script \"chatty\" failed: exit status 3",
+	},
+}, {
+	send: []string{"[#chan] mup: run sleep", "[#chan] mup: run sleep"},
+	recv: []string{
+		"PRIVMSG #chan :nick: Script \"sleep\" is already running.",
+		"PRIVMSG #chan :nick: Script \"sleep\" timed out after 200ms.",
+	},
+}}
+
+func (s *S) TestRunner(c *C) {
+	dir := c.MkDir()
+	script := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		c.Assert(ioutil.WriteFile(path, []byte(content), 0755), IsNil)
+		return path
+	}
+	deploy := script("deploy", deployScript)
+	chatty := script("chatty", chattyScript)
+	sleep := script("sleep", sleepScript)
+
+	for i, test := range runnerTests {
+		c.Logf("Testing message #%d: %s", i, test.send)
+		tester := mup.NewPluginTester("runner")
+		tester.SetConfig(mup.Map{
+			"lines": 3,
+			"roles": mup.Map{
+				"deployer": []string{"bob", "nick!~user@host"},
+				"admin":    []string{"*!*@admin.example.com"},
+			},
+			"scripts": []mup.Map{{
+				"name":    "deploy",
+				"command": deploy,
+				"args":    []string{"--prod"},
+				"dir":     dir,
+				"role":    "deployer",
+				"params": []mup.Map{
+					{"name": "service", "pattern": "web|api", "required": true},
+					{"name": "version"},
+				},
+			}, {
+				"name":    "chatty",
+				"command": chatty,
+				"role":    "deployer",
+			}, {
+				"name":    "sleep",
+				"command": sleep,
+				"timeout": "200ms",
+				"role":    "deployer",
+			}, {
+				"name":    "reboot",
+				"command": "/sbin/reboot",
+				"role":    "admin",
+			}, {
+				"name":    "orphan",
+				"command": deploy,
+				"role":    "unknown",
+			}},
+		})
+		tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+		tester.Start()
+		tester.SendAll(test.send)
+		var recv []string
+		for range test.recv {
+			recv = append(recv, tester.Recv())
+		}
+		c.Assert(tester.Stop(), IsNil)
+		recv = append(recv, tester.RecvAll()...)
+		var want []string
+		for _, line := range test.recv {
+			want = append(want, strings.Replace(line, "DIR", dir, 1))
+		}
+		c.Assert(recv, DeepEquals, want)
+	}
+}
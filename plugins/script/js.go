@@ -0,0 +1,144 @@
+package script
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dop251/goja"
+	"gopkg.in/mup.v0"
+)
+
+// jsVM runs a JavaScript script. The runtime offers no access to the
+// filesystem or the network unless such functions are explicitly set,
+// so the mup object is all scripts get from the outside world.
+type jsVM struct {
+	script   *script
+	runtime  *goja.Runtime
+	cmds     map[string]goja.Callable
+	handlers []goja.Callable
+}
+
+func loadJS(s *script, source string) (scriptVM, error) {
+	vm := &jsVM{
+		script:  s,
+		runtime: goja.New(),
+		cmds:    make(map[string]goja.Callable),
+	}
+	obj := vm.runtime.NewObject()
+	obj.Set("command", vm.jsCommand)
+	obj.Set("message", vm.jsMessage)
+	obj.Set("reply", vm.jsReply)
+	obj.Set("send", vm.jsSend)
+	obj.Set("config", vm.jsConfig)
+	obj.Set("get", vm.jsGet)
+	obj.Set("set", vm.jsSet)
+	vm.runtime.Set("mup", obj)
+
+	err := vm.call(func() error {
+		_, err := vm.runtime.RunScript(s.path, source)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// call runs f with the script timeout in place.
+func (vm *jsVM) call(f func() error) error {
+	timer := time.AfterFunc(vm.script.plugin.config.Timeout.Duration, func() {
+		vm.runtime.Interrupt("script timed out")
+	})
+	err := f()
+	timer.Stop()
+	vm.runtime.ClearInterrupt()
+	return err
+}
+
+func (vm *jsVM) commands() []string {
+	var names []string
+	for name := range vm.cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (vm *jsVM) command(name string, msg *mup.Message, args string) error {
+	fn, ok := vm.cmds[name]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", name)
+	}
+	return vm.call(func() error {
+		_, err := fn(goja.Undefined(), vm.runtime.ToValue(messageFields(msg)), vm.runtime.ToValue(args))
+		return err
+	})
+}
+
+func (vm *jsVM) message(msg *mup.Message) error {
+	for _, fn := range vm.handlers {
+		err := vm.call(func() error {
+			_, err := fn(goja.Undefined(), vm.runtime.ToValue(messageFields(msg)))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *jsVM) close() {
+	vm.runtime.Interrupt("script unloaded")
+}
+
+func (vm *jsVM) function(call goja.FunctionCall, i int) goja.Callable {
+	fn, ok := goja.AssertFunction(call.Argument(i))
+	if !ok {
+		panic(vm.runtime.NewTypeError("argument %d must be a function", i+1))
+	}
+	return fn
+}
+
+func (vm *jsVM) jsCommand(call goja.FunctionCall) goja.Value {
+	vm.cmds[call.Argument(0).String()] = vm.function(call, 1)
+	return goja.Undefined()
+}
+
+func (vm *jsVM) jsMessage(call goja.FunctionCall) goja.Value {
+	vm.handlers = append(vm.handlers, vm.function(call, 0))
+	return goja.Undefined()
+}
+
+func (vm *jsVM) jsReply(call goja.FunctionCall) goja.Value {
+	err := vm.script.reply(call.Argument(0).String())
+	if err != nil {
+		panic(vm.runtime.NewGoError(err))
+	}
+	return goja.Undefined()
+}
+
+func (vm *jsVM) jsSend(call goja.FunctionCall) goja.Value {
+	err := vm.script.send(call.Argument(0).String(), call.Argument(1).String(), call.Argument(2).String())
+	if err != nil {
+		panic(vm.runtime.NewGoError(err))
+	}
+	return goja.Undefined()
+}
+
+func (vm *jsVM) jsConfig(call goja.FunctionCall) goja.Value {
+	return vm.runtime.ToValue(vm.script.setting(call.Argument(0).String()))
+}
+
+func (vm *jsVM) jsGet(call goja.FunctionCall) goja.Value {
+	return vm.runtime.ToValue(vm.script.get(call.Argument(0).String()))
+}
+
+func (vm *jsVM) jsSet(call goja.FunctionCall) goja.Value {
+	err := vm.script.set(call.Argument(0).String(), call.Argument(1).Export())
+	if err != nil {
+		panic(vm.runtime.NewGoError(err))
+	}
+	return goja.Undefined()
+}
@@ -0,0 +1,217 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/yuin/gopher-lua"
+	"gopkg.in/mup.v0"
+)
+
+type luaVM struct {
+	script   *script
+	state    *lua.LState
+	cmds     map[string]*lua.LFunction
+	handlers []*lua.LFunction
+}
+
+// luaLibs are the standard libraries opened in the Lua sandbox. The io, os,
+// package, and debug libraries are left out on purpose.
+var luaLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// luaUnsafe holds the base library functions that could load code from
+// the filesystem, and are removed from the sandbox. The base library also
+// registers require and module, which are backed by the package library.
+var luaUnsafe = []string{"dofile", "loadfile", "load", "loadstring", "require", "module"}
+
+func loadLua(s *script, source string) (scriptVM, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range luaLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range luaUnsafe {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	vm := &luaVM{
+		script: s,
+		state:  L,
+		cmds:   make(map[string]*lua.LFunction),
+	}
+	L.SetGlobal("mup", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"command": vm.luaCommand,
+		"message": vm.luaMessage,
+		"reply":   vm.luaReply,
+		"send":    vm.luaSend,
+		"config":  vm.luaConfig,
+		"get":     vm.luaGet,
+		"set":     vm.luaSet,
+	}))
+
+	err := vm.call(func() error { return L.DoString(source) })
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+	return vm, nil
+}
+
+// call runs f with the script timeout in place.
+func (vm *luaVM) call(f func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), vm.script.plugin.config.Timeout.Duration)
+	defer cancel()
+	vm.state.SetContext(ctx)
+	defer vm.state.RemoveContext()
+	return f()
+}
+
+func (vm *luaVM) commands() []string {
+	var names []string
+	for name := range vm.cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (vm *luaVM) command(name string, msg *mup.Message, args string) error {
+	fn, ok := vm.cmds[name]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", name)
+	}
+	L := vm.state
+	return vm.call(func() error {
+		return L.CallByParam(lua.P{Fn: fn, Protect: true}, toLua(L, messageFields(msg)), lua.LString(args))
+	})
+}
+
+func (vm *luaVM) message(msg *mup.Message) error {
+	L := vm.state
+	for _, fn := range vm.handlers {
+		err := vm.call(func() error {
+			return L.CallByParam(lua.P{Fn: fn, Protect: true}, toLua(L, messageFields(msg)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *luaVM) close() {
+	vm.state.Close()
+}
+
+func (vm *luaVM) luaCommand(L *lua.LState) int {
+	vm.cmds[L.CheckString(1)] = L.CheckFunction(2)
+	return 0
+}
+
+func (vm *luaVM) luaMessage(L *lua.LState) int {
+	vm.handlers = append(vm.handlers, L.CheckFunction(1))
+	return 0
+}
+
+func (vm *luaVM) luaReply(L *lua.LState) int {
+	err := vm.script.reply(L.CheckString(1))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+func (vm *luaVM) luaSend(L *lua.LState) int {
+	err := vm.script.send(L.CheckString(1), L.CheckString(2), L.CheckString(3))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+func (vm *luaVM) luaConfig(L *lua.LState) int {
+	L.Push(toLua(L, vm.script.setting(L.CheckString(1))))
+	return 1
+}
+
+func (vm *luaVM) luaGet(L *lua.LState) int {
+	L.Push(toLua(L, vm.script.get(L.CheckString(1))))
+	return 1
+}
+
+func (vm *luaVM) luaSet(L *lua.LState) int {
+	err := vm.script.set(L.CheckString(1), fromLua(L.Get(2)))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// toLua converts a value decoded from JSON into a Lua value.
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch value := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(value)
+	case string:
+		return lua.LString(value)
+	case float64:
+		return lua.LNumber(value)
+	case int:
+		return lua.LNumber(value)
+	case int64:
+		return lua.LNumber(value)
+	case []interface{}:
+		table := L.NewTable()
+		for _, elem := range value {
+			table.Append(toLua(L, elem))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.NewTable()
+		for key, elem := range value {
+			table.RawSetString(key, toLua(L, elem))
+		}
+		return table
+	}
+	return lua.LString(fmt.Sprint(value))
+}
+
+// fromLua converts a Lua value into a value that may be encoded as JSON.
+// Tables with a sequence are converted into lists, and other tables into
+// maps keyed by the string form of their keys.
+func fromLua(value lua.LValue) interface{} {
+	switch value := value.(type) {
+	case lua.LBool:
+		return bool(value)
+	case lua.LNumber:
+		return float64(value)
+	case lua.LString:
+		return string(value)
+	case *lua.LTable:
+		if n := value.MaxN(); n > 0 {
+			list := make([]interface{}, n)
+			for i := 1; i <= n; i++ {
+				list[i-1] = fromLua(value.RawGetInt(i))
+			}
+			return list
+		}
+		m := make(map[string]interface{})
+		value.ForEach(func(key, elem lua.LValue) {
+			m[key.String()] = fromLua(elem)
+		})
+		return m
+	}
+	return nil
+}
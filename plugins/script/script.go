@@ -0,0 +1,407 @@
+package script
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "script",
+	Help: `Runs small Lua and JavaScript scripts as custom commands.
+
+	Scripts are loaded from the directory named by the "dir" setting,
+	~/.config/mup/scripts by default. Files ending in .lua are run with a
+	Lua interpreter and files ending in .js with a JavaScript one, each
+	in its own sandbox without access to the filesystem or the network.
+	Scripts are reloaded when they change on disk.
+
+	Scripts interact with the bot via the global "mup" object:
+
+	    mup.command(name, fn)      runs fn(msg, args) for the named command
+	    mup.message(fn)            runs fn(msg) for every message observed
+	    mup.reply(text)            replies to the message being handled
+	    mup.send(account, to, text) sends text to a #channel or nick
+	    mup.config(key)            returns a setting for the script
+	    mup.get(key)               returns a persistent state value
+	    mup.set(key, value)        stores a persistent state value
+
+	Messages are handed to scripts with the account, channel, nick, text,
+	and bottext fields. Settings for each script are provided under the
+	"scripts" setting, keyed by script name (the file name without its
+	extension).
+	`,
+	Start: start,
+}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+const (
+	defaultDir       = "~/.config/mup/scripts"
+	defaultPollDelay = 5 * time.Second
+	defaultTimeout   = 5 * time.Second
+)
+
+type scriptPlugin struct {
+	plugger *mup.Plugger
+	tomb    tomb.Tomb
+	config  struct {
+		Dir       string
+		PollDelay mup.DurationString
+		Timeout   mup.DurationString
+		Scripts   map[string]map[string]interface{}
+	}
+
+	mu      sync.Mutex
+	scripts map[string]*script
+	state   map[string]map[string]interface{}
+}
+
+// script is a single script file loaded in its own sandbox.
+type script struct {
+	plugin  *scriptPlugin
+	name    string
+	path    string
+	modTime time.Time
+
+	// mu serializes calls into the script interpreter, which is not
+	// safe for concurrent use.
+	mu  sync.Mutex
+	vm  scriptVM
+	msg *mup.Message
+}
+
+// scriptVM is implemented by each supported interpreter.
+type scriptVM interface {
+	// commands returns the names of the commands registered by the script.
+	commands() []string
+
+	// command runs the handler registered for the named command.
+	command(name string, msg *mup.Message, args string) error
+
+	// message runs the message handlers registered by the script.
+	message(msg *mup.Message) error
+
+	// close releases the resources held by the interpreter.
+	close()
+}
+
+// scriptLoaders maps script file extensions to the function that loads
+// the file into a new interpreter.
+var scriptLoaders = map[string]func(s *script, source string) (scriptVM, error){
+	".lua": loadLua,
+	".js":  loadJS,
+}
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &scriptPlugin{
+		plugger: plugger,
+		scripts: make(map[string]*script),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Dir == "" {
+		p.config.Dir = defaultDir
+	}
+	if strings.HasPrefix(p.config.Dir, "~/") {
+		p.config.Dir = filepath.Join(os.Getenv("HOME"), p.config.Dir[2:])
+	}
+	if p.config.PollDelay.Duration == 0 {
+		p.config.PollDelay.Duration = defaultPollDelay
+	}
+	if p.config.Timeout.Duration == 0 {
+		p.config.Timeout.Duration = defaultTimeout
+	}
+	err = p.loadState()
+	if err != nil {
+		plugger.Logf("Cannot load script state: %v", err)
+	}
+	p.reload()
+	p.tomb.Go(p.loop)
+	return p
+}
+
+func (p *scriptPlugin) Stop() error {
+	p.tomb.Kill(nil)
+	err := p.tomb.Wait()
+	p.mu.Lock()
+	for name, s := range p.scripts {
+		s.close()
+		delete(p.scripts, name)
+	}
+	p.mu.Unlock()
+	return err
+}
+
+func (p *scriptPlugin) loop() error {
+	for {
+		select {
+		case <-time.After(p.config.PollDelay.Duration):
+			p.reload()
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// reload loads scripts that were added or changed in the scripts directory
+// since the last time it was called, and drops the ones that were removed.
+func (p *scriptPlugin) reload() {
+	infos, err := ioutil.ReadDir(p.config.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		p.plugger.Logf("Cannot read scripts directory: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		load, ok := scriptLoaders[ext]
+		if !ok || info.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), ext)
+		if seen[name] {
+			p.plugger.Logf("Ignoring script %s: another script has the same name.", info.Name())
+			continue
+		}
+		seen[name] = true
+
+		path := filepath.Join(p.config.Dir, info.Name())
+		p.mu.Lock()
+		old := p.scripts[name]
+		p.mu.Unlock()
+		if old != nil && old.path == path && old.modTime.Equal(info.ModTime()) {
+			continue
+		}
+
+		s, err := p.load(name, path, info.ModTime(), load)
+		if err != nil {
+			p.plugger.Logf("Cannot load script %s: %v", info.Name(), err)
+			if old == nil {
+				continue
+			}
+			// Keep running the old version, but don't retry until it changes again.
+			old.modTime = info.ModTime()
+			continue
+		}
+		if old == nil {
+			p.plugger.Logf("Loaded script %s.", info.Name())
+		} else {
+			p.plugger.Logf("Reloaded script %s.", info.Name())
+		}
+		p.mu.Lock()
+		p.scripts[name] = s
+		p.mu.Unlock()
+		if old != nil {
+			old.close()
+		}
+	}
+
+	p.mu.Lock()
+	var removed []*script
+	for name, s := range p.scripts {
+		if !seen[name] {
+			removed = append(removed, s)
+			delete(p.scripts, name)
+		}
+	}
+	p.mu.Unlock()
+	for _, s := range removed {
+		p.plugger.Logf("Unloaded script %s.", filepath.Base(s.path))
+		s.close()
+	}
+}
+
+func (p *scriptPlugin) load(name, path string, modTime time.Time, load func(s *script, source string) (scriptVM, error)) (*script, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &script{plugin: p, name: name, path: path, modTime: modTime}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, err := load(s, string(data))
+	if err != nil {
+		return nil, err
+	}
+	s.vm = vm
+	return s, nil
+}
+
+// sortedScripts returns the loaded scripts ordered by name, so that
+// handlers run in a predictable order.
+func (p *scriptPlugin) sortedScripts() []*script {
+	p.mu.Lock()
+	scripts := make([]*script, 0, len(p.scripts))
+	for _, s := range p.scripts {
+		scripts = append(scripts, s)
+	}
+	p.mu.Unlock()
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].name < scripts[j].name })
+	return scripts
+}
+
+func (p *scriptPlugin) HandleMessage(msg *mup.Message) {
+	var cmdName, cmdArgs string
+	if msg.BotText != "" {
+		fields := strings.SplitN(strings.TrimSpace(msg.BotText), " ", 2)
+		cmdName = fields[0]
+		if len(fields) > 1 {
+			cmdArgs = strings.TrimSpace(fields[1])
+		}
+	}
+	for _, s := range p.sortedScripts() {
+		if cmdName != "" && s.hasCommand(cmdName) {
+			s.run(msg, func() error { return s.vm.command(cmdName, msg, cmdArgs) })
+		}
+		s.run(msg, func() error { return s.vm.message(msg) })
+	}
+}
+
+func (s *script) hasCommand(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vm == nil {
+		return false
+	}
+	for _, cmd := range s.vm.commands() {
+		if cmd == name {
+			return true
+		}
+	}
+	return false
+}
+
+// run calls f with msg as the message being handled by the script.
+func (s *script) run(msg *mup.Message, f func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vm == nil {
+		return
+	}
+	s.msg = msg
+	err := f()
+	s.msg = nil
+	if err != nil {
+		s.plugin.plugger.Logf("Script %s failed: %v", filepath.Base(s.path), err)
+	}
+}
+
+func (s *script) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vm != nil {
+		s.vm.close()
+		s.vm = nil
+	}
+}
+
+// The methods below implement the primitives offered to scripts via the
+// mup object. They are called by the interpreters with s.mu held.
+
+func (s *script) reply(text string) error {
+	if s.msg == nil {
+		return fmt.Errorf("no message to reply to")
+	}
+	return s.plugin.plugger.Sendf(s.msg, "%s", text)
+}
+
+func (s *script) send(account, to, text string) error {
+	msg := &mup.Message{Account: account, Text: text}
+	if strings.HasPrefix(to, "#") {
+		msg.Channel = to
+	} else {
+		msg.Nick = to
+	}
+	return s.plugin.plugger.Send(msg)
+}
+
+func (s *script) setting(key string) interface{} {
+	return s.plugin.config.Scripts[s.name][key]
+}
+
+func (s *script) get(key string) interface{} {
+	p := s.plugin
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state[s.name][key]
+}
+
+func (s *script) set(key string, value interface{}) error {
+	p := s.plugin
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state == nil {
+		p.state = make(map[string]map[string]interface{})
+	}
+	if p.state[s.name] == nil {
+		p.state[s.name] = make(map[string]interface{})
+	}
+	if value == nil {
+		delete(p.state[s.name], key)
+	} else {
+		p.state[s.name][key] = value
+	}
+	return p.saveState()
+}
+
+// loadState loads the state of all scripts, stored as a JSON document
+// keyed by script name in the plugin database entry.
+func (p *scriptPlugin) loadState() error {
+	db := p.plugger.DB()
+	if db == nil {
+		return nil
+	}
+	var state string
+	err := db.QueryRow("SELECT state FROM plugin WHERE name=?", p.plugger.Name()).Scan(&state)
+	if err == sql.ErrNoRows || err == nil && state == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(state), &p.state)
+}
+
+// saveState stores the state of all scripts. Must be called with p.mu held.
+func (p *scriptPlugin) saveState() error {
+	db := p.plugger.DB()
+	if db == nil {
+		return nil
+	}
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return fmt.Errorf("cannot marshal script state: %v", err)
+	}
+	_, err = db.Exec("UPDATE plugin SET state=? WHERE name=?", string(data), p.plugger.Name())
+	if err != nil {
+		return fmt.Errorf("cannot save script state: %v", err)
+	}
+	return nil
+}
+
+// messageFields returns the message fields made available to scripts.
+func messageFields(msg *mup.Message) map[string]interface{} {
+	return map[string]interface{}{
+		"account": msg.Account,
+		"channel": msg.Channel,
+		"nick":    msg.Nick,
+		"text":    msg.Text,
+		"bottext": msg.BotText,
+	}
+}
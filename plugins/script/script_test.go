@@ -0,0 +1,200 @@
+package script_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/script"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct {
+	dir string
+}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+	s.dir = c.MkDir()
+}
+
+func (s *S) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+func (s *S) write(c *C, name, content string) {
+	err := ioutil.WriteFile(filepath.Join(s.dir, name), []byte(content), 0644)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) startTester(db *sql.DB) *mup.PluginTester {
+	tester := mup.NewPluginTester("script")
+	tester.SetConfig(mup.Map{
+		"dir":       s.dir,
+		"polldelay": "20ms",
+		"timeout":   "200ms",
+		"scripts": mup.Map{
+			"greet": mup.Map{"greeting": "Hi"},
+			"hello": mup.Map{"greeting": "Hello"},
+		},
+	})
+	if db != nil {
+		tester.SetDB(db)
+	}
+	tester.Start()
+	return tester
+}
+
+const luaScript = `
+mup.command("greet", function(msg, args)
+	mup.reply(mup.config("greeting") .. ", " .. args .. "!")
+end)
+
+mup.message(function(msg)
+	if msg.text == "ping" then
+		mup.send(msg.account, msg.channel, "pong from " .. msg.nick)
+	end
+end)
+`
+
+const jsScript = `
+mup.command("hello", function(msg, args) {
+	mup.reply(mup.config("greeting") + ", " + args + "!");
+});
+
+mup.message(function(msg) {
+	if (msg.text == "ping") {
+		mup.send(msg.account, msg.channel, "js pong from " + msg.nick);
+	}
+});
+`
+
+func (s *S) TestCommands(c *C) {
+	s.write(c, "greet.lua", luaScript)
+	s.write(c, "hello.js", jsScript)
+	tester := s.startTester(nil)
+	defer tester.Stop()
+
+	tester.Sendf("greet Joe")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Hi, Joe!")
+	tester.Sendf("[#chan] mup: hello Ann")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: Hello, Ann!")
+	tester.Sendf("[#chan] ping")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :pong from nick")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :js pong from nick")
+	tester.Sendf("[#chan] greet Joe")
+	tester.Sendf("unknown")
+	c.Assert(tester.RecvAll(), HasLen, 0)
+}
+
+func (s *S) TestState(c *C) {
+	db, err := mup.OpenDB(c.MkDir())
+	c.Assert(err, IsNil)
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO plugin (name) VALUES ('script')")
+	c.Assert(err, IsNil)
+
+	s.write(c, "count.lua", `
+mup.command("count", function(msg, args)
+	local n = (mup.get("n") or 0) + 1
+	mup.set("n", n)
+	mup.reply(tostring(n))
+end)
+`)
+	s.write(c, "jscount.js", `
+mup.command("jscount", function(msg, args) {
+	var n = (mup.get("n") || 0) + 1;
+	mup.set("n", n);
+	mup.reply(String(n));
+});
+`)
+
+	tester := s.startTester(db)
+	tester.Sendf("count")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :1")
+	tester.Sendf("jscount")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :1")
+	tester.Stop()
+
+	tester = s.startTester(db)
+	tester.Sendf("count")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :2")
+	tester.Sendf("jscount")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :2")
+	tester.Stop()
+}
+
+func (s *S) TestSandbox(c *C) {
+	s.write(c, "escape.lua", `
+mup.command("escape", function(msg, args)
+	mup.reply(tostring(io) .. " " .. tostring(os) .. " " .. tostring(dofile) .. " " .. tostring(require))
+end)
+`)
+	s.write(c, "loop.js", `
+mup.command("loop", function(msg, args) { for (;;) {} });
+mup.command("alive", function(msg, args) { mup.reply("alive"); });
+`)
+	tester := s.startTester(nil)
+	defer tester.Stop()
+
+	tester.Sendf("escape")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :nil nil nil nil")
+
+	// The runaway script is interrupted and keeps working afterwards.
+	tester.Sendf("loop")
+	tester.Sendf("alive")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :alive")
+}
+
+func (s *S) TestReload(c *C) {
+	tester := s.startTester(nil)
+	defer tester.Stop()
+
+	path := filepath.Join(s.dir, "greet.lua")
+	s.write(c, "greet.lua", `mup.command("greet", function(msg, args) mup.reply("one") end)`)
+	s.waitReply(c, tester, "greet", "PRIVMSG nick :one")
+
+	// Ensure the modification time changes even on coarse filesystems.
+	s.write(c, "greet.lua", `mup.command("greet", function(msg, args) mup.reply("two") end)`)
+	future := time.Now().Add(time.Minute)
+	c.Assert(os.Chtimes(path, future, future), IsNil)
+	s.waitReply(c, tester, "greet", "PRIVMSG nick :two")
+
+	// A broken script leaves the previous version running.
+	s.write(c, "greet.lua", `mup.command("greet", function(`)
+	future = future.Add(time.Minute)
+	c.Assert(os.Chtimes(path, future, future), IsNil)
+	time.Sleep(100 * time.Millisecond)
+	tester.Sendf("greet")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :two")
+
+	c.Assert(os.Remove(path), IsNil)
+	time.Sleep(100 * time.Millisecond)
+	tester.Sendf("greet")
+	c.Assert(tester.RecvAll(), HasLen, 0)
+}
+
+// waitReply sends text until the reply is observed, as scripts are
+// reloaded in the background.
+func (s *S) waitReply(c *C, tester *mup.PluginTester, text, reply string) {
+	var replies []string
+	for i := 0; i < 50; i++ {
+		tester.Sendf("%s", text)
+		time.Sleep(20 * time.Millisecond)
+		replies = tester.RecvAll()
+		if len(replies) > 0 && replies[len(replies)-1] == reply {
+			return
+		}
+	}
+	c.Fatalf("Reply not observed: %q; last replies: %q", reply, replies)
+}
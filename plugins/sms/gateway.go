@@ -0,0 +1,131 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// gateway describes an SMS provider the plugin may deliver messages via.
+type gateway struct {
+	// endpoint and originator are the defaults for the respective
+	// plugin options, if the provider has any.
+	endpoint   string
+	originator string
+
+	// send delivers content to the mobile number via the provider. An
+	// error is returned if the request could not be made or the response
+	// was not understood, while messages refused by the provider are
+	// reported via the result.
+	send func(p *smsPlugin, mobile, content string) (*sendResult, error)
+}
+
+type sendResult struct {
+	// accepted reports whether the provider accepted the message for
+	// delivery, and reason explains why not otherwise.
+	accepted bool
+	reason   string
+
+	// info holds provider-specific details for the logs.
+	info string
+
+	// id identifies the message in status callbacks, for providers
+	// that send them.
+	id string
+}
+
+var gateways = map[string]*gateway{
+	"aql": {
+		endpoint:   "https://gw.aql.com/sms/sms_gw.php",
+		originator: "+447766404142",
+		send:       sendAQL,
+	},
+	"twilio": {
+		endpoint: "https://api.twilio.com/2010-04-01",
+		send:     sendTwilio,
+	},
+	"vonage": {
+		endpoint: "https://rest.nexmo.com/sms/json",
+		send:     sendVonage,
+	},
+}
+
+func sendAQL(p *smsPlugin, mobile, content string) (*sendResult, error) {
+	// This API is documented at http://aql.com/sms/integrated/sms-api
+	form := url.Values{
+		"username":    []string{p.config.User},
+		"password":    []string{p.config.Password},
+		"destination": []string{mobile},
+		"originator":  []string{p.config.Originator},
+		"message":     []string{content},
+	}
+	resp, err := p.plugger.HTTPClient().PostForm(p.config.Endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Response format is "<status code>:<credits used> <description>".
+	// For example: "2:0 Authentication error"
+	i := bytes.IndexByte(data, ':')
+	j := bytes.IndexByte(data, ' ')
+	if i <= 0 || j <= i {
+		return nil, fmt.Errorf("AQL response not recognized.")
+	}
+	status := data[:i]
+	credits := data[i+1 : j]
+	info := data[j+1:]
+	return &sendResult{
+		accepted: len(status) == 1 && (status[0] == '0' || status[0] == '1'),
+		reason:   string(info),
+		info:     fmt.Sprintf("status=%s credits=%s info=%s", status, credits, info),
+	}, nil
+}
+
+func sendVonage(p *smsPlugin, mobile, content string) (*sendResult, error) {
+	// This API is documented at https://developer.vonage.com/en/api/sms
+	form := url.Values{
+		"api_key":    []string{p.config.User},
+		"api_secret": []string{p.config.Password},
+		"from":       []string{strings.TrimPrefix(p.config.Originator, "+")},
+		"to":         []string{strings.TrimPrefix(mobile, "+")},
+		"text":       []string{content},
+	}
+	resp, err := p.plugger.HTTPClient().PostForm(p.config.Endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Messages []struct {
+			Status    string `json:"status"`
+			MessageId string `json:"message-id"`
+			ErrorText string `json:"error-text"`
+		} `json:"messages"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode Vonage response (%s): %v", resp.Status, err)
+	}
+	if len(result.Messages) == 0 {
+		return nil, fmt.Errorf("Vonage response has no message status (%s)", resp.Status)
+	}
+	// Long messages are split into parts, each with its own status.
+	var ids []string
+	for _, m := range result.Messages {
+		if m.Status != "0" {
+			return &sendResult{reason: m.ErrorText, info: fmt.Sprintf("status=%s error=%s", m.Status, m.ErrorText)}, nil
+		}
+		ids = append(ids, m.MessageId)
+	}
+	return &sendResult{accepted: true, info: "ids=" + strings.Join(ids, ",")}, nil
+}
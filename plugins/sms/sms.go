@@ -0,0 +1,495 @@
+// Package sms implements a plugin that sends SMS messages to people in the
+// directory and brings the SMS messages they send back into the chat, via
+// one of several gateway providers.
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "sms",
+	Help: `Integrates the bot with an SMS delivery gateway.
+
+	The gateway is selected via the "provider" configuration option,
+	which may be "aql" (the default), "twilio", or "vonage". The
+	"user" and "password" options hold the gateway credentials: the
+	username and password for AQL, the account SID and auth token for
+	Twilio, and the API key and secret for Vonage. The "originator"
+	option holds the number messages are sent from, and is required
+	except for AQL, which defaults to its shared number in the UK
+	(+447766404142). The "endpoint" option overrides the gateway URL.
+
+	The configured directory is queried for a person with the
+	provided IRC nick ("mozillaNickname" in LDAP) and a phone ("mobile")
+	in international format (+NN...). The message sender must also be
+	registered in the directory with the IRC nick in use.
+
+	The plugin also allows people to send SMS messages into IRC on
+	one of the configured plugin targets. The message must be
+	addressed to the gateway number and have the format
+	"<keyword> <nick or channel> <message>", where the keyword is
+	reserved with the gateway and informed via the "keyword" option.
+
+	Incoming SMS messages first go to a custom HTTP server at the
+	"proxy" URL, which receives messages pushed from the gateway via
+	HTTP and stores them until the plugin pulls the message and
+	forwards it to the appropriate account. The role of that proxy
+	is offering an increased availability to reduce the chances of
+	the gateway HTTP requests ever getting lost.
+
+	With the Twilio provider, the plugin may instead receive messages
+	directly from Twilio by setting the "url" option to the public URL
+	of an HTTP server the plugin starts on the "addr" address (":10458"
+	by default). The Twilio number must be set to call that URL with
+	the "/sms" path for incoming messages, which are authenticated via
+	the Twilio signature. Incoming messages that do not start with a
+	channel name are taken as replies to the last message sent to that
+	number from the chat, within a day, and delivered to its sender.
+	Otherwise they use the same format above, without the keyword.
+	The delivery status of messages sent is also reported back to
+	their sender once Twilio informs it at the "/status" path.
+
+	WhatsApp messages may be sent via Twilio with the whatsapp command
+	when the "whatsapp" option holds the WhatsApp sender number, and
+	replies to them are received as incoming SMS messages are.
+	`,
+	Start:    start,
+	Commands: Commands,
+}
+
+// AQLPlugin is the sms plugin under its original name, from when AQL was
+// the only provider supported. Its configuration may still use the
+// AQL-prefixed option names.
+var AQLPlugin = mup.PluginSpec{
+	Name:     "aql",
+	Help:     "Obsolete name of the sms plugin, defaulting to the AQL provider.",
+	Start:    start,
+	Commands: Commands,
+}
+
+var Commands = schema.Commands{{
+	Name: "sms",
+	Help: `Sends an SMS message.
+
+	The configured directory is queried for a person with the
+	provided IRC nick ("mozillaNickname" in LDAP) and a phone ("mobile")
+	in international format (+NN...). The message sender must also be
+	registered in the directory with the IRC nick in use.
+	`,
+	Args: schema.Args{{
+		Name: "nick",
+		Flag: schema.Required,
+	}, {
+		Name: "message",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}, {
+	Name: "whatsapp",
+	Help: `Sends a WhatsApp message.
+
+	The recipient is found in the configured directory as done for
+	the sms command. This requires the twilio provider and the
+	"whatsapp" option to be set in the plugin configuration.
+	`,
+	Args: schema.Args{{
+		Name: "nick",
+		Flag: schema.Required,
+	}, {
+		Name: "message",
+		Flag: schema.Required | schema.Trailing,
+	}},
+}}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+	mup.RegisterPlugin(&AQLPlugin)
+}
+
+type smsPlugin struct {
+	mu       sync.Mutex
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	commands chan *mup.Command
+	smses    chan *smsMessage
+	err      error
+	gateway  *gateway
+	listener net.Listener
+	replies  map[string]*route
+	statuses map[string]*route
+	config   struct {
+		Directory string
+		LDAP      string // Obsolete alias for Directory.
+
+		Provider   string
+		User       string
+		Password   string
+		Endpoint   string
+		Originator string
+
+		Proxy     string
+		Keyword   string
+		PollDelay mup.DurationString
+
+		// Twilio webhooks and WhatsApp.
+		URL      string
+		Addr     string
+		WhatsApp string
+
+		// Obsolete aliases for the options above.
+		AQLUser     string
+		AQLPass     string
+		AQLEndpoint string
+		AQLProxy    string
+		AQLKeyword  string
+	}
+}
+
+const (
+	defaultHandleTimeout = 500 * time.Millisecond
+	defaultPollDelay     = 10 * time.Second
+	defaultProvider      = "aql"
+)
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &smsPlugin{
+		plugger:  plugger,
+		commands: make(chan *mup.Command, 5),
+		smses:    make(chan *smsMessage),
+		replies:  make(map[string]*route),
+		statuses: make(map[string]*route),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	c := &p.config
+	if c.PollDelay.Duration == 0 {
+		c.PollDelay.Duration = defaultPollDelay
+	}
+	if c.Directory == "" {
+		c.Directory = c.LDAP
+	}
+	for _, alias := range []struct{ value, obsolete *string }{
+		{&c.User, &c.AQLUser},
+		{&c.Password, &c.AQLPass},
+		{&c.Endpoint, &c.AQLEndpoint},
+		{&c.Proxy, &c.AQLProxy},
+		{&c.Keyword, &c.AQLKeyword},
+	} {
+		if *alias.value == "" {
+			*alias.value = *alias.obsolete
+		}
+	}
+	if c.Provider == "" {
+		c.Provider = defaultProvider
+	}
+	p.gateway = gateways[c.Provider]
+	if p.gateway == nil {
+		p.err = fmt.Errorf("unknown SMS provider %q", c.Provider)
+		plugger.Logf("Plugin configuration error: %v.", p.err)
+	} else {
+		if c.Endpoint == "" {
+			c.Endpoint = p.gateway.endpoint
+		}
+		if c.Originator == "" {
+			c.Originator = p.gateway.originator
+		}
+	}
+	if c.Addr == "" {
+		c.Addr = defaultTwilioAddr
+	}
+	p.tomb.Go(p.loop)
+	if c.Provider == "twilio" && c.URL != "" {
+		p.tomb.Go(p.serve)
+	}
+	return p
+}
+
+func (p *smsPlugin) Stop() error {
+	close(p.commands)
+	p.tomb.Kill(nil)
+	p.mu.Lock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.mu.Unlock()
+	return p.tomb.Wait()
+}
+
+func (p *smsPlugin) HandleCommand(cmd *mup.Command) {
+	select {
+	case p.commands <- cmd:
+	default:
+		p.plugger.Sendf(cmd, "The server seems a bit sluggish right now. Please try again soon.")
+	}
+}
+
+func (p *smsPlugin) loop() error {
+	if p.config.Proxy != "" {
+		p.tomb.Go(p.poll)
+	}
+	for {
+		select {
+		case cmd, ok := <-p.commands:
+			if !ok {
+				return nil
+			}
+			if dir := p.directory(cmd); dir != nil {
+				p.handle(dir, cmd)
+				dir.Close()
+			}
+		case sms := <-p.smses:
+			if dir := p.directory(nil); dir != nil {
+				p.receiveSMS(dir, sms)
+				dir.Close()
+			}
+		}
+	}
+}
+
+func (p *smsPlugin) directory(cmd *mup.Command) mup.Directory {
+	dir, err := p.plugger.Directory(p.config.Directory)
+	if err != nil {
+		p.plugger.Logf("Plugin configuration error: %s.", err)
+		if cmd != nil {
+			p.plugger.Sendf(cmd, "Plugin configuration error: %s.", err)
+		}
+	}
+	return dir
+}
+
+func (p *smsPlugin) handle(dir mup.Directory, cmd *mup.Command) {
+	if p.err != nil {
+		p.plugger.Sendf(cmd, "Plugin configuration error: %v.", p.err)
+		return
+	}
+	whatsapp := cmd.Name() == "whatsapp"
+	if whatsapp && (p.config.Provider != "twilio" || p.config.WhatsApp == "") {
+		p.plugger.Sendf(cmd, "WhatsApp messages require the twilio provider and a whatsapp number in the plugin configuration.")
+		return
+	}
+	var args struct{ Nick, Message string }
+	cmd.Args(&args)
+	results, err := dir.Search(mup.DirNick, args.Nick, mup.DirNick, "mobile")
+	if err != nil {
+		p.plugger.Logf("Cannot search directory: %v", err)
+		p.plugger.Sendf(cmd, "Cannot search directory: %v", err)
+		return
+	}
+	if len(results) == 0 {
+		p.plugger.Logf("Cannot find requested IRC nick in directory: %q", args.Nick)
+		p.plugger.Sendf(cmd, "Cannot find anyone with that IRC nick in the directory. :-(")
+		return
+	}
+	receiver := results[0]
+	mobile := receiver.Value("mobile")
+	if mobile == "" {
+		p.plugger.Sendf(cmd, "Person doesn't have a mobile phone in the directory.")
+	} else if !strings.HasPrefix(mobile, "+") {
+		p.plugger.Sendf(cmd, "This person's mobile number is not in international format (+NN...): %s", mobile)
+	} else {
+		r := &route{addr: cmd.Address(), nick: args.Nick, whatsapp: whatsapp, time: time.Now()}
+		err := p.sendSMS(cmd, r, args.Message, receiver)
+		if err != nil {
+			p.plugger.Logf("Error sending %s to %s (%s): %v", r.kind(), args.Nick, mobile, err)
+			p.plugger.Sendf(cmd, "Error sending %s to %s (%s): %v", r.kind(), args.Nick, mobile, err)
+		}
+	}
+}
+
+func isChannel(name string) bool {
+	return name != "" && (name[0] == '#' || name[0] == '&') && !strings.ContainsAny(name, " ,\x07")
+}
+
+func (p *smsPlugin) sendSMS(cmd *mup.Command, r *route, message string, receiver mup.DirEntry) error {
+	var content string
+	if cmd.Channel != "" {
+		content = fmt.Sprintf("%s %s> %s", cmd.Channel, cmd.Nick, message)
+	} else {
+		content = fmt.Sprintf("%s> %s", cmd.Nick, message)
+	}
+	if p.config.Originator == "" {
+		return fmt.Errorf("no originator number configured")
+	}
+
+	mobile := trimPhone(receiver.Value("mobile"))
+	var result *sendResult
+	var err error
+	if r.whatsapp {
+		result, err = sendWhatsApp(p, mobile, content)
+	} else {
+		result, err = p.gateway.send(p, mobile, content)
+	}
+	if err != nil {
+		return err
+	}
+	p.plugger.Logf("%s delivery result: provider=%s from=%s to=%s mobile=%s accepted=%v %s", r.kind(), p.config.Provider, cmd.Nick, r.nick, mobile, result.accepted, result.info)
+	if result.accepted {
+		p.track(mobile, result.id, r)
+		p.plugger.Sendf(cmd, "%s is on the way!", r.kind())
+	} else {
+		p.plugger.Sendf(cmd, "%s delivery failed: %s", r.kind(), result.reason)
+	}
+	return nil
+}
+
+func trimPhone(number string) string {
+	buf := make([]byte, len(number)+1)
+	buf[0] = '+'
+	j := 1
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			buf[j] = byte(c)
+			j++
+		}
+		if c == '/' {
+			break
+		}
+	}
+	buf = buf[:j]
+	if bytes.HasPrefix(buf, []byte("+440")) {
+		copy(buf[3:], buf[4:])
+		buf = buf[:len(buf)-1]
+	}
+	return string(buf)
+}
+
+type smsMessage struct {
+	Key     int    `json:"key"`
+	Message string `json:"message"`
+	Sender  string `json:"sender"`
+	Time    string `json:"time"`
+
+	// proxied reports whether the message was retrieved from the proxy,
+	// and must be deleted from it once handled. Otherwise it was pushed
+	// by Twilio, and whatsapp reports whether it came via WhatsApp.
+	proxied  bool
+	whatsapp bool
+}
+
+func (p *smsPlugin) poll() error {
+	form := url.Values{
+		"keyword": []string{p.config.Keyword},
+	}
+	for {
+		select {
+		case <-p.tomb.Dying():
+			return nil
+		case <-time.After(p.config.PollDelay.Duration):
+		}
+		resp, err := p.plugger.HTTPClient().Get(p.config.Proxy + "/retrieve?" + form.Encode())
+		if err != nil {
+			p.plugger.Logf("Cannot retrieve SMSes from proxy: %v", err)
+			continue
+		}
+		var smses []smsMessage
+		err = json.NewDecoder(resp.Body).Decode(&smses)
+		resp.Body.Close()
+		if err != nil {
+			p.plugger.Logf("Cannot decode proxy response: %v", err)
+			continue
+		}
+		for i := range smses {
+			smses[i].Sender = "+" + smses[i].Sender
+			smses[i].proxied = true
+			select {
+			case p.smses <- &smses[i]:
+			case <-p.tomb.Dying():
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (p *smsPlugin) receiveSMS(dir mup.Directory, sms *smsMessage) {
+	label, command := "SMS", "sms"
+	if sms.whatsapp {
+		label, command = "WhatsApp", "whatsapp"
+	}
+
+	query := strings.TrimSpace(sms.Message)
+	fields := strings.SplitN(query, " ", 2)
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	var reply *route
+	if !sms.proxied && !isChannel(fields[0]) {
+		reply = p.replyRoute(trimPhone(sms.Sender))
+	}
+	if query == "" || reply == nil && (len(fields) != 2 || len(fields[0]) == 0 || len(fields[1]) == 0) {
+		p.plugger.Logf("Received invalid %s message text: %q", label, sms.Message)
+		return
+	}
+
+	sender := sms.Sender
+	results, err := dir.Search("mobile", trimPhone(sms.Sender), mup.DirNick)
+	if err != nil {
+		p.plugger.Logf("Cannot search directory for SMS sender: %v", err)
+	} else if len(results) > 0 {
+		nick := results[0].Value(mup.DirNick)
+		if nick != "" {
+			sender = nick
+		}
+	}
+	if reply != nil {
+		p.plugger.Logf("[%s] Delivering %s reply from %s (%s) to %s: %s\n", reply.addr.Account, label, sender, sms.Sender, reply.addr.Nick, query)
+		p.plugger.Sendf(reply.addr, "[%s] <%s> %s", label, sender, query)
+		return
+	}
+	target := fields[0]
+	text := fields[1]
+	msg := &mup.Message{Text: fmt.Sprintf("[%s] <%s> %s", label, sender, text)}
+	isChan := isChannel(target)
+	if isChan {
+		msg.Channel = target
+	} else {
+		msg.Nick = target
+	}
+	for _, target := range p.plugger.Targets() {
+		a := target.Address()
+		if (a.Nick != "" || a.Channel != "") && (a.Nick != msg.Nick || a.Channel != msg.Channel) {
+			continue
+		}
+		msg.Account = a.Account
+		p.plugger.Logf("[%s] Delivering %s from %s (%s) to %s: %s\n", msg.Account, label, sender, sms.Sender, target, text)
+		err = p.plugger.Send(msg)
+		if err == nil && !strings.HasPrefix(sender, "+") {
+			p.plugger.Sendf(msg, "Answer with: !%s %s <your message>", command, sender)
+		}
+	}
+	if sms.proxied {
+		p.tomb.Go(func() error {
+			_ = p.deleteSMS(sms)
+			return nil
+		})
+	}
+}
+
+func (p *smsPlugin) deleteSMS(sms *smsMessage) error {
+	form := url.Values{
+		"keyword": []string{p.config.Keyword},
+		"keys":    []string{strconv.Itoa(sms.Key)},
+	}
+	resp, err := p.plugger.HTTPClient().PostForm(p.config.Proxy+"/delete", form)
+	if err != nil {
+		p.plugger.Logf("Cannot delete SMS message %d: %v", sms.Key, err)
+		return err
+	}
+	p.plugger.Logf("Delete accepted for %v.", sms.Key)
+	resp.Body.Close()
+	return nil
+}
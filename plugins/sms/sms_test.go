@@ -0,0 +1,507 @@
+package sms_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/ldap"
+	_ "gopkg.in/mup.v0/plugins/sms"
+
+	. "gopkg.in/check.v1"
+	"sort"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+type smsTest struct {
+	plugin       string
+	send         []string
+	recv         []string
+	fail         bool
+	config       mup.Map
+	targets      []mup.Target
+	messages     []aqlMessage
+	endpointForm url.Values
+	endpointAuth string
+	retrieveForm url.Values
+	deletedKeys  []int
+}
+
+var smsTests = []smsTest{{
+	send:   []string{"sms noldap Hey there"},
+	recv:   []string{`PRIVMSG nick :Plugin configuration error: directory "unknown" not found.`},
+	config: mup.Map{"ldap": "unknown"},
+}, {
+	send: []string{"sms notfound Hey there"},
+	recv: []string{"PRIVMSG nick :Cannot find anyone with that IRC nick in the directory. :-("},
+}, {
+	send: []string{"sms tesla Fail please"},
+	recv: []string{"PRIVMSG nick :SMS delivery failed: Error message from endpoint."},
+	fail: true,
+}, {
+	send: []string{"[#chan] sms tesla Ignore me."},
+}, {
+	send: []string{"[#chan] mup: sms tesla Hey there"},
+	recv: []string{"PRIVMSG #chan :nick: SMS is on the way!"},
+	config: mup.Map{
+		"aqluser": "myuser",
+		"aqlpass": "mypass",
+	},
+	endpointForm: url.Values{
+		"destination": {"+11223344"},
+		"message":     {"#chan nick> Hey there"},
+		"originator":  {"+447766404142"},
+		"username":    {"myuser"},
+		"password":    {"mypass"},
+	},
+}, {
+	send: []string{"sms tésla Hey there"},
+	recv: []string{"PRIVMSG nick :SMS is on the way!"},
+	config: mup.Map{
+		"aqluser": "myuser",
+		"aqlpass": "mypass",
+	},
+	endpointForm: url.Values{
+		"destination": {"+11223344"},
+		"message":     {"nick> Hey there"},
+		"originator":  {"+447766404142"},
+		"username":    {"myuser"},
+		"password":    {"mypass"},
+	},
+}, {
+	recv: []string{
+		"[@one] PRIVMSG nick :[SMS] <++99> A",
+		"[@three] PRIVMSG nick :[SMS] <++99> A",
+		"[@two] PRIVMSG #chan :[SMS] <tesla> B",
+		"[@two] PRIVMSG #chan :Answer with: !sms tesla <your message>",
+		"[@three] PRIVMSG #chan :[SMS] <tesla> B",
+		"[@three] PRIVMSG #chan :Answer with: !sms tesla <your message>",
+	},
+	config: mup.Map{
+		"aqlkeyword": "yo",
+		"polldelay":  "100ms",
+	},
+	targets: []mup.Target{
+		{Account: "one", Nick: "nick"},
+		{Account: "two", Channel: "#chan"},
+		{Account: "three"},
+	},
+	messages: []aqlMessage{
+		{Key: 12, Message: "nick A", Sender: "+99"},
+		{Key: 34, Message: "#chan B", Sender: "+55"},
+	},
+	retrieveForm: url.Values{
+		"keyword": {"yo"},
+	},
+	deletedKeys: []int{12, 34},
+}, {
+	plugin: "sms",
+	send:   []string{"sms tesla Hey there"},
+	recv:   []string{`PRIVMSG nick :Plugin configuration error: unknown SMS provider "bogus".`},
+	config: mup.Map{"provider": "bogus"},
+}, {
+	plugin: "sms",
+	send:   []string{"sms tesla Hey there"},
+	recv:   []string{"PRIVMSG nick :Error sending SMS to tesla (+11 (22) 33-44): no originator number configured"},
+	config: mup.Map{"provider": "twilio"},
+}, {
+	plugin: "sms",
+	send:   []string{"[#chan] mup: sms tesla Hey there"},
+	recv:   []string{"PRIVMSG #chan :nick: SMS is on the way!"},
+	config: mup.Map{
+		"provider":   "twilio",
+		"user":       "AC123",
+		"password":   "mytoken",
+		"originator": "+15550001",
+	},
+	endpointForm: url.Values{
+		"To":   {"+11223344"},
+		"From": {"+15550001"},
+		"Body": {"#chan nick> Hey there"},
+	},
+	endpointAuth: "AC123:mytoken",
+}, {
+	plugin: "sms",
+	send:   []string{"sms tesla Fail please"},
+	recv:   []string{"PRIVMSG nick :SMS delivery failed: The 'To' number is not valid."},
+	fail:   true,
+	config: mup.Map{
+		"provider":   "twilio",
+		"user":       "AC123",
+		"originator": "+15550001",
+	},
+}, {
+	plugin: "sms",
+	send:   []string{"sms tesla Hey there"},
+	recv:   []string{"PRIVMSG nick :SMS is on the way!"},
+	config: mup.Map{
+		"provider":   "vonage",
+		"user":       "mykey",
+		"password":   "mysecret",
+		"originator": "+15550001",
+	},
+	endpointForm: url.Values{
+		"api_key":    {"mykey"},
+		"api_secret": {"mysecret"},
+		"from":       {"15550001"},
+		"to":         {"11223344"},
+		"text":       {"nick> Hey there"},
+	},
+}, {
+	plugin: "sms",
+	send:   []string{"whatsapp tesla Hey there"},
+	recv:   []string{"PRIVMSG nick :WhatsApp message is on the way!"},
+	config: mup.Map{
+		"provider":   "twilio",
+		"user":       "AC123",
+		"originator": "+15550001",
+		"whatsapp":   "+15550002",
+	},
+	endpointForm: url.Values{
+		"To":   {"whatsapp:+11223344"},
+		"From": {"whatsapp:+15550002"},
+		"Body": {"nick> Hey there"},
+	},
+}, {
+	plugin: "sms",
+	send:   []string{"whatsapp tesla Hey there"},
+	recv:   []string{"PRIVMSG nick :WhatsApp messages require the twilio provider and a whatsapp number in the plugin configuration."},
+	config: mup.Map{
+		"provider":   "vonage",
+		"originator": "+15550001",
+	},
+}, {
+	plugin: "sms",
+	send:   []string{"sms tesla Fail please"},
+	recv:   []string{"PRIVMSG nick :SMS delivery failed: Bad Credentials"},
+	fail:   true,
+	config: mup.Map{
+		"provider":   "vonage",
+		"originator": "+15550001",
+	},
+}, {
+	plugin: "sms",
+	recv:   []string{"[@one] PRIVMSG nick :[SMS] <++99> A"},
+	config: mup.Map{
+		"provider":  "vonage",
+		"keyword":   "yo",
+		"polldelay": "100ms",
+	},
+	targets: []mup.Target{
+		{Account: "one", Nick: "nick"},
+	},
+	messages: []aqlMessage{
+		{Key: 12, Message: "nick A", Sender: "+99"},
+	},
+	retrieveForm: url.Values{
+		"keyword": {"yo"},
+	},
+	deletedKeys: []int{12},
+}}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+func (s *S) TestSMS(c *C) {
+	for i, test := range smsTests {
+		c.Logf("Running test %d with messages: %v", i, test.send)
+
+		server := &aqlServer{
+			fail:     test.fail,
+			messages: test.messages,
+		}
+		server.Start()
+
+		if test.config == nil {
+			test.config = mup.Map{}
+		}
+		if test.config["ldap"] == nil {
+			test.config["ldap"] = "test"
+		}
+		if test.plugin == "" {
+			test.plugin = "aql"
+			test.config["aqlendpoint"] = server.URL() + "/endpoint"
+			test.config["aqlproxy"] = server.URL() + "/proxy"
+		} else {
+			test.config["endpoint"] = server.URL() + "/" + fmt.Sprint(test.config["provider"])
+			test.config["proxy"] = server.URL() + "/proxy"
+		}
+
+		tester := mup.NewPluginTester(test.plugin)
+		tester.SetConfig(test.config)
+		tester.SetTargets(test.targets)
+		tester.SetLDAP("test", ldapConn{})
+		tester.Start()
+		tester.SendAll(test.send)
+
+		if test.messages != nil {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		c.Check(tester.Stop(), IsNil)
+		c.Check(tester.RecvAll(), DeepEquals, test.recv)
+
+		server.Stop()
+
+		if test.endpointForm != nil {
+			c.Assert(server.endpointForm, DeepEquals, test.endpointForm)
+		}
+		if test.endpointAuth != "" {
+			c.Assert(server.endpointAuth, Equals, test.endpointAuth)
+		}
+		if test.retrieveForm != nil {
+			c.Assert(server.retrieveForm, DeepEquals, test.retrieveForm)
+		}
+		if test.deletedKeys != nil {
+			c.Assert(server.deletedKeys, DeepEquals, test.deletedKeys)
+		}
+
+		if c.Failed() {
+			c.FailNow()
+		}
+	}
+}
+
+func (s *S) TestTwilioWebhook(c *C) {
+	server := &aqlServer{}
+	server.Start()
+	defer server.Stop()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	addr := l.Addr().String()
+	l.Close()
+
+	tester := mup.NewPluginTester("sms")
+	tester.SetConfig(mup.Map{
+		"ldap":       "test",
+		"provider":   "twilio",
+		"user":       "AC123",
+		"password":   "mytoken",
+		"originator": "+15550001",
+		"endpoint":   server.URL() + "/twilio",
+		"url":        "https://mup.example.com/twilio/",
+		"addr":       addr,
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.SetLDAP("test", ldapConn{})
+	tester.Start()
+
+	post := func(path string, form url.Values, token string) int {
+		mac := hmac.New(sha1.New, []byte(token))
+		mac.Write([]byte("https://mup.example.com/twilio" + path))
+		var keys []string
+		for key := range form {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			mac.Write([]byte(key + form.Get(key)))
+		}
+		req, err := http.NewRequest("POST", "http://"+addr+path, strings.NewReader(form.Encode()))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Twilio-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+		for i := 0; ; i++ {
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil && i < 20 {
+				time.Sleep(50 * time.Millisecond)
+				req.Body = ioutil.NopCloser(strings.NewReader(form.Encode()))
+				continue
+			}
+			c.Assert(err, IsNil)
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+	}
+
+	tester.Sendf("[#chan] mup: sms tesla Are you there?")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: SMS is on the way!")
+	c.Assert(server.endpointForm.Get("StatusCallback"), Equals, "https://mup.example.com/twilio/status")
+
+	reply := url.Values{"From": {"+11223344"}, "Body": {"I am!"}}
+	c.Assert(post("/sms", reply, "wrong"), Equals, http.StatusUnauthorized)
+	c.Assert(post("/sms", reply, "mytoken"), Equals, http.StatusOK)
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: [SMS] <tesla> I am!")
+
+	other := url.Values{"From": {"whatsapp:+99"}, "Body": {"#chan Hello"}}
+	c.Assert(post("/sms", other, "mytoken"), Equals, http.StatusOK)
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :[WhatsApp] <+99> Hello")
+
+	status := url.Values{"MessageSid": {"SM123"}, "MessageStatus": {"sent"}}
+	c.Assert(post("/status", status, "mytoken"), Equals, http.StatusOK)
+	status = url.Values{"MessageSid": {"SM123"}, "MessageStatus": {"undelivered"}, "ErrorCode": {"30003"}}
+	c.Assert(post("/status", status, "mytoken"), Equals, http.StatusOK)
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :nick: SMS to tesla was not delivered (Twilio error 30003).")
+
+	c.Assert(tester.Stop(), IsNil)
+	c.Assert(tester.RecvAll(), HasLen, 0)
+}
+
+type ldapConn struct{}
+
+var nikolaTesla = ldap.Result{
+	Attrs: []ldap.Attr{
+		{Name: "mozillaNickname", Values: []string{"tesla"}},
+		{Name: "cn", Values: []string{"Nikola Tesla"}},
+		{Name: "mail", Values: []string{"tesla@example.com"}},
+		{Name: "mobile", Values: []string{"+11 (22) 33-44", "+55"}},
+	},
+}
+
+func ldapResult(nick, name string) ldap.Result {
+	return ldap.Result{Attrs: []ldap.Attr{
+		{Name: "mozillaNickname", Values: []string{nick}},
+		{Name: "cn", Values: []string{name}},
+		{Name: "mail", Values: []string{nick + "@example.com"}},
+	}}
+}
+
+var ldapResults = map[string][]ldap.Result{
+	`(mozillaNickname=tesla)`:      {nikolaTesla},
+	`(mozillaNickname=t\c3\a9sla)`: {nikolaTesla},
+	"(mobile=*5*5*)":               {nikolaTesla},
+	"(mobile=*1*1*2*2*3*3*4*4*)":   {nikolaTesla},
+}
+
+func (l ldapConn) Search(s *ldap.Search) ([]ldap.Result, error) {
+	if strings.Contains(s.Filter, "=slow)") {
+		time.Sleep(150 * time.Millisecond)
+	}
+	return ldapResults[s.Filter], nil
+}
+
+func (l ldapConn) Close() error { return nil }
+
+type aqlServer struct {
+	fail     bool
+	messages []aqlMessage
+
+	endpointForm url.Values
+	endpointAuth string
+	retrieveForm url.Values
+	deletedKeys  []int
+
+	server *httptest.Server
+}
+
+type aqlMessage struct {
+	Key     int    `json:"key"`
+	Message string `json:"message"`
+	Sender  string `json:"sender"`
+	Time    string `json:"time"`
+}
+
+func (s *aqlServer) Start() {
+	s.server = httptest.NewServer(s)
+}
+
+func (s *aqlServer) Stop() {
+	s.server.Close()
+}
+
+func (s *aqlServer) URL() string {
+	return s.server.URL
+}
+
+func (s *aqlServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	switch req.URL.Path {
+	case "/endpoint":
+		s.serveGateway(w, req)
+	case "/twilio/Accounts/AC123/Messages.json":
+		s.serveTwilio(w, req)
+	case "/vonage":
+		s.serveVonage(w, req)
+	case "/proxy/retrieve":
+		s.serveRetrieve(w, req)
+	case "/proxy/delete":
+		s.serveDelete(w, req)
+	default:
+		panic("Got unexpected request for " + req.URL.Path + " in test aqlServer")
+	}
+}
+
+func (s *aqlServer) serveGateway(w http.ResponseWriter, req *http.Request) {
+	s.endpointForm = req.Form
+	if s.fail {
+		w.Write([]byte("2:0 Error message from endpoint."))
+		return
+	}
+	w.Write([]byte("1:1 Okay."))
+}
+
+func (s *aqlServer) serveTwilio(w http.ResponseWriter, req *http.Request) {
+	s.endpointForm = req.PostForm
+	if user, pass, ok := req.BasicAuth(); ok {
+		s.endpointAuth = user + ":" + pass
+	}
+	if s.fail {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code": 21211, "message": "The 'To' number is not valid.", "status": 400}`))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{"sid": "SM123", "status": "queued"}`))
+}
+
+func (s *aqlServer) serveVonage(w http.ResponseWriter, req *http.Request) {
+	s.endpointForm = req.PostForm
+	if s.fail {
+		w.Write([]byte(`{"message-count": "1", "messages": [{"status": "4", "error-text": "Bad Credentials"}]}`))
+		return
+	}
+	w.Write([]byte(`{"message-count": "1", "messages": [{"status": "0", "message-id": "M123"}]}`))
+}
+
+func (s *aqlServer) serveRetrieve(w http.ResponseWriter, req *http.Request) {
+	s.retrieveForm = req.Form
+	data, err := json.Marshal(s.messages)
+	if err != nil {
+		panic("cannot marshal SMS messages inside the fake proxy: " + err.Error())
+	}
+	w.Write(data)
+}
+
+func (s *aqlServer) serveDelete(w http.ResponseWriter, req *http.Request) {
+	keys := strings.Split(req.FormValue("keys"), ",")
+	sort.Strings(keys)
+	for _, keyStr := range keys {
+		key, err := strconv.Atoi(keyStr)
+		if err != nil {
+			panic("cannot convert deleted key to int in proxy: " + keyStr)
+		}
+		s.deletedKeys = append(s.deletedKeys, key)
+		for i, sms := range s.messages {
+			if sms.Key == key {
+				copy(s.messages[i:], s.messages[i+1:])
+				s.messages = s.messages[:len(s.messages)-1]
+				break
+			}
+		}
+	}
+}
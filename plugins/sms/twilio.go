@@ -0,0 +1,271 @@
+package sms
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+)
+
+const (
+	defaultTwilioAddr = ":10458"
+	whatsappPrefix    = "whatsapp:"
+)
+
+// routeExpiry is how long replies to a message sent from the chat are
+// routed back to whoever sent it, and how long its delivery status is
+// waited for.
+const routeExpiry = 24 * time.Hour
+
+// route holds the origin of a message sent from the chat, so that replies
+// and delivery status updates may be sent back to it.
+type route struct {
+	addr     mup.Address
+	nick     string
+	whatsapp bool
+	time     time.Time
+}
+
+// kind returns how the messages sent via the route are named for people.
+func (r *route) kind() string {
+	if r.whatsapp {
+		return "WhatsApp message"
+	}
+	return "SMS"
+}
+
+func sendTwilio(p *smsPlugin, mobile, content string) (*sendResult, error) {
+	return twilioSend(p, p.config.Originator, mobile, content)
+}
+
+func sendWhatsApp(p *smsPlugin, mobile, content string) (*sendResult, error) {
+	return twilioSend(p, whatsappPrefix+p.config.WhatsApp, whatsappPrefix+mobile, content)
+}
+
+func twilioSend(p *smsPlugin, from, to, content string) (*sendResult, error) {
+	// This API is documented at https://www.twilio.com/docs/messaging/api/message-resource
+	form := url.Values{
+		"To":   []string{to},
+		"From": []string{from},
+		"Body": []string{content},
+	}
+	if p.config.URL != "" {
+		form.Set("StatusCallback", strings.TrimSuffix(p.config.URL, "/")+"/status")
+	}
+	endpoint := p.config.Endpoint + "/Accounts/" + url.PathEscape(p.config.User) + "/Messages.json"
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(p.config.User, p.config.Password)
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Sid     string `json:"sid"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+
+		// A string such as "queued" on success, and the HTTP
+		// status code on errors.
+		Status interface{} `json:"status"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode Twilio response (%s): %v", resp.Status, err)
+	}
+	if resp.StatusCode >= 300 {
+		reason := result.Message
+		if reason == "" {
+			reason = resp.Status
+		}
+		return &sendResult{reason: reason, info: fmt.Sprintf("code=%d message=%s", result.Code, result.Message)}, nil
+	}
+	return &sendResult{accepted: true, id: result.Sid, info: fmt.Sprintf("sid=%s status=%v", result.Sid, result.Status)}, nil
+}
+
+// track records the route of a message accepted for delivery, so that
+// replies from mobile and status updates for the message id reach it.
+func (p *smsPlugin) track(mobile, id string, r *route) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, old := range p.replies {
+		if r.time.Sub(old.time) > routeExpiry {
+			delete(p.replies, key)
+		}
+	}
+	for key, old := range p.statuses {
+		if r.time.Sub(old.time) > routeExpiry {
+			delete(p.statuses, key)
+		}
+	}
+	p.replies[mobile] = r
+	if id != "" && p.config.URL != "" {
+		p.statuses[id] = r
+	}
+}
+
+// replyRoute returns the route of the last message sent to mobile from
+// the chat, if recent enough, or nil otherwise.
+func (p *smsPlugin) replyRoute(mobile string) *route {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := p.replies[mobile]
+	if r == nil || time.Since(r.time) > routeExpiry {
+		return nil
+	}
+	return r
+}
+
+func (p *smsPlugin) serve() error {
+	first := true
+	for p.tomb.Alive() {
+		l, err := net.Listen("tcp", p.config.Addr)
+		if err != nil {
+			if first {
+				first = false
+				p.plugger.Logf("Cannot listen on %s (%v). Will keep retrying.", p.config.Addr, err)
+			}
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		p.plugger.Logf("Listening on %s.", p.config.Addr)
+
+		p.mu.Lock()
+		p.listener = l
+		p.mu.Unlock()
+
+		server := &http.Server{
+			Addr:         p.config.Addr,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			Handler:      p,
+		}
+
+		err = server.Serve(l)
+		if p.tomb.Alive() {
+			p.tomb.Kill(err)
+		}
+		l.Close()
+	}
+	return nil
+}
+
+// ServeHTTP handles the webhooks Twilio calls for incoming messages, at
+// /sms, and for status updates of the messages sent, at /status.
+func (p *smsPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/sms" && r.URL.Path != "/status" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "webhooks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "cannot parse request form", http.StatusBadRequest)
+		return
+	}
+	if !p.authorized(r) {
+		p.plugger.Logf("Unauthorized request received on %s.", r.URL.Path)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/status" {
+		p.handleStatus(r.PostForm)
+		return
+	}
+	from := r.PostForm.Get("From")
+	sms := &smsMessage{
+		Message:  r.PostForm.Get("Body"),
+		Sender:   strings.TrimPrefix(from, whatsappPrefix),
+		whatsapp: strings.HasPrefix(from, whatsappPrefix),
+	}
+	select {
+	case p.smses <- sms:
+	case <-p.tomb.Dying():
+		http.Error(w, "plugin is stopping", http.StatusServiceUnavailable)
+		return
+	}
+	// Replies are sent via the API instead, so the webhook response
+	// does not depend on how long it takes to deliver the message.
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte("<Response></Response>"))
+}
+
+// authorized reports whether r holds a valid X-Twilio-Signature header
+// for the configured public URL, as documented at
+// https://www.twilio.com/docs/usage/webhooks/webhooks-security
+func (p *smsPlugin) authorized(r *http.Request) bool {
+	if p.config.Password == "" {
+		return true
+	}
+	got, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Twilio-Signature"))
+	if err != nil {
+		return false
+	}
+	u := strings.TrimSuffix(p.config.URL, "/") + r.URL.RequestURI()
+	return subtle.ConstantTimeCompare(got, twilioSignature(p.config.Password, u, r.PostForm)) == 1
+}
+
+func twilioSignature(token, u string, form url.Values) []byte {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(u))
+	for _, key := range keys {
+		for _, value := range form[key] {
+			mac.Write([]byte(key))
+			mac.Write([]byte(value))
+		}
+	}
+	return mac.Sum(nil)
+}
+
+// handleStatus reports to the sender of a message the final delivery status
+// Twilio informed for it, and stops tracking the message.
+func (p *smsPlugin) handleStatus(form url.Values) {
+	id := form.Get("MessageSid")
+	status := form.Get("MessageStatus")
+	switch status {
+	case "delivered", "read", "undelivered", "failed":
+	default:
+		return
+	}
+	p.mu.Lock()
+	r := p.statuses[id]
+	delete(p.statuses, id)
+	p.mu.Unlock()
+	if r == nil {
+		return
+	}
+	p.plugger.Logf("%s %s to %s is %s (error code %q).", r.kind(), id, r.nick, status, form.Get("ErrorCode"))
+	switch status {
+	case "delivered", "read":
+		p.plugger.Sendf(r.addr, "%s to %s was delivered.", r.kind(), r.nick)
+	default:
+		if code := form.Get("ErrorCode"); code != "" {
+			p.plugger.Sendf(r.addr, "%s to %s was not delivered (Twilio error %s).", r.kind(), r.nick, code)
+		} else {
+			p.plugger.Sendf(r.addr, "%s to %s was not delivered.", r.kind(), r.nick)
+		}
+	}
+}
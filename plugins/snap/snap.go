@@ -0,0 +1,318 @@
+// Package snap implements a plugin announcing failed snap builds on
+// Launchpad and new snap revisions released to the store.
+package snap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "snapwatch",
+	Help: `Announces failed snap builds and new revisions released to the store.
+
+	The "snaps" configuration option holds a list of snaps to watch, each with
+	a "name" as published in the store, an optional "recipe" holding the
+	Launchpad snap recipe that builds it in the "<owner>/<recipe>" form, and
+	an optional "channels" list such as ["latest/stable", "2.0/edge"]. Failed
+	builds are only announced for snaps with a recipe, and when no channels
+	are listed, releases to all channels are announced.
+
+	Announcements may be customized via the "templates" configuration option,
+	mapping the "failed" and "released" events to templates that may refer to
+	the build or revision .Id, and to the snap .Title, .URL, .Project, .Branch
+	holding the architecture or channel, and .State holding the build state
+	or released version.
+	`,
+	Start: start,
+}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type snapPlugin struct {
+	tomb    tomb.Tomb
+	plugger *mup.Plugger
+	config  struct {
+		Endpoint      string
+		StoreEndpoint string
+		PollDelay     mup.DurationString
+		Snaps         []struct {
+			Name     string
+			Recipe   string
+			Channels []string
+		}
+	}
+}
+
+const (
+	defaultEndpoint      = "https://api.launchpad.net/devel/"
+	defaultStoreEndpoint = "https://api.snapcraft.io/"
+	defaultPollDelay     = 3 * time.Minute
+)
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &snapPlugin{plugger: plugger}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Endpoint == "" {
+		p.config.Endpoint = defaultEndpoint
+	}
+	if p.config.StoreEndpoint == "" {
+		p.config.StoreEndpoint = defaultStoreEndpoint
+	}
+	if p.config.PollDelay.Duration == 0 {
+		p.config.PollDelay.Duration = defaultPollDelay
+	}
+	for i := range p.config.Snaps {
+		for j, channel := range p.config.Snaps[i].Channels {
+			p.config.Snaps[i].Channels[j] = fullChannel(channel)
+		}
+	}
+	p.tomb.Go(p.loop)
+	return p
+}
+
+func (p *snapPlugin) Stop() error {
+	p.tomb.Kill(nil)
+	return p.tomb.Wait()
+}
+
+// fullChannel returns channel with the track made explicit, so that
+// "stable" and "latest/stable" are taken as the same channel.
+func fullChannel(channel string) string {
+	if !strings.Contains(channel, "/") {
+		return "latest/" + channel
+	}
+	return channel
+}
+
+type revisionKey struct {
+	snap    string
+	channel string
+	arch    string
+}
+
+func (p *snapPlugin) loop() error {
+	lastBuild := make(map[string]int)
+	revisions := make(map[revisionKey]int)
+	first := true
+	for {
+		for _, snap := range p.config.Snaps {
+			if snap.Recipe != "" {
+				p.pollBuilds(snap.Name, snap.Recipe, lastBuild, first)
+			}
+			p.pollStore(snap.Name, snap.Channels, revisions, first)
+		}
+		first = false
+
+		select {
+		case <-time.After(p.config.PollDelay.Duration):
+		case <-p.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+type lpBuilds struct {
+	Entries []lpBuild `json:"entries"`
+}
+
+type lpBuild struct {
+	SelfLink   string `json:"self_link"`
+	WebLink    string `json:"web_link"`
+	ArchTag    string `json:"arch_tag"`
+	BuildState string `json:"buildstate"`
+}
+
+// id returns the build number at the end of the build link, or zero.
+func (b *lpBuild) id() int {
+	i := strings.LastIndex(b.SelfLink, "/+build/")
+	if i < 0 {
+		return 0
+	}
+	id, _ := strconv.Atoi(b.SelfLink[i+len("/+build/"):])
+	return id
+}
+
+// failedStates holds the Launchpad states of builds that completed without
+// producing a snap for reasons other than being cancelled or superseded.
+var failedStates = map[string]bool{
+	"Failed to build":  true,
+	"Dependency wait":  true,
+	"Chroot problem":   true,
+	"Failed to upload": true,
+}
+
+func (p *snapPlugin) pollBuilds(name, recipe string, lastBuild map[string]int, first bool) {
+	owner, recipeName := recipe, name
+	if i := strings.Index(recipe, "/"); i >= 0 {
+		owner, recipeName = recipe[:i], recipe[i+1:]
+	}
+	path := "/~" + strings.TrimPrefix(owner, "~") + "/+snap/" + recipeName + "/completed_builds"
+	var builds lpBuilds
+	err := p.request(p.config.Endpoint, path, nil, &builds)
+	if err != nil {
+		return
+	}
+
+	// Builds come most recent first.
+	last := lastBuild[name]
+	for i := len(builds.Entries) - 1; i >= 0; i-- {
+		b := &builds.Entries[i]
+		id := b.id()
+		if id <= last {
+			continue
+		}
+		if id > lastBuild[name] {
+			lastBuild[name] = id
+		}
+		if first || !failedStates[b.BuildState] {
+			continue
+		}
+		p.plugger.Announce(&mup.Announcement{
+			Event:   "failed",
+			Text:    fmt.Sprintf("Snap %s build #%d on %s failed: %s <%s>", name, id, b.ArchTag, b.BuildState, b.WebLink),
+			Id:      strconv.Itoa(id),
+			Title:   name,
+			URL:     b.WebLink,
+			Project: name,
+			Branch:  b.ArchTag,
+			State:   b.BuildState,
+		})
+	}
+}
+
+type storeInfo struct {
+	ChannelMap []struct {
+		Channel struct {
+			Architecture string `json:"architecture"`
+			Name         string `json:"name"`
+			Track        string `json:"track"`
+			Risk         string `json:"risk"`
+		} `json:"channel"`
+		Revision int    `json:"revision"`
+		Version  string `json:"version"`
+	} `json:"channel-map"`
+}
+
+// storeRelease holds the revisions of a snap version that were
+// released to a channel since the last poll.
+type storeRelease struct {
+	channel string
+	version string
+	parts   []string
+	ids     []string
+}
+
+func (p *snapPlugin) pollStore(name string, channels []string, revisions map[revisionKey]int, first bool) {
+	var info storeInfo
+	header := http.Header{"Snap-Device-Series": {"16"}}
+	err := p.request(p.config.StoreEndpoint, "/v2/snaps/info/"+url.PathEscape(name), header, &info)
+	if err != nil {
+		return
+	}
+
+	// The store reports each architecture of a channel separately, so
+	// releases are grouped per channel and version to announce at once
+	// the revisions that were released together.
+	var releases []*storeRelease
+	for _, entry := range info.ChannelMap {
+		channel := entry.Channel.Track + "/" + entry.Channel.Risk
+		if len(channels) > 0 && !contains(channels, channel) {
+			continue
+		}
+		key := revisionKey{name, channel, entry.Channel.Architecture}
+		if revisions[key] == entry.Revision {
+			continue
+		}
+		revisions[key] = entry.Revision
+		if first {
+			continue
+		}
+		var release *storeRelease
+		for _, r := range releases {
+			if r.channel == channel && r.version == entry.Version {
+				release = r
+				break
+			}
+		}
+		if release == nil {
+			release = &storeRelease{channel: channel, version: entry.Version}
+			releases = append(releases, release)
+		}
+		id := strconv.Itoa(entry.Revision)
+		release.parts = append(release.parts, "r"+id+" on "+entry.Channel.Architecture)
+		release.ids = append(release.ids, id)
+	}
+
+	link := "https://snapcraft.io/" + name
+	for _, r := range releases {
+		p.plugger.Announce(&mup.Announcement{
+			Event:   "released",
+			Text:    fmt.Sprintf("Snap %s %s released to %s: %s <%s>", name, r.version, r.channel, strings.Join(r.parts, ", "), link),
+			Id:      strings.Join(r.ids, ","),
+			Title:   name,
+			URL:     link,
+			Project: name,
+			Branch:  r.channel,
+			State:   r.version,
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// request performs a GET request for path under endpoint, with the
+// provided headers, and decodes the JSON response into result.
+func (p *snapPlugin) request(endpoint, path string, header http.Header, result interface{}) error {
+	url := strings.TrimRight(endpoint, "/") + "/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		p.plugger.Logf("Cannot perform snap request: %v", err)
+		return fmt.Errorf("cannot perform snap request: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := p.plugger.HTTPClient().Do(req)
+	if err == nil && resp.StatusCode != 200 {
+		resp.Body.Close()
+		err = fmt.Errorf("%s", resp.Status)
+	}
+	if err != nil {
+		p.plugger.Logf("Cannot perform snap request: %v", err)
+		return fmt.Errorf("cannot perform snap request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		p.plugger.Logf("Cannot read snap response: %v", err)
+		return fmt.Errorf("cannot read snap response: %v", err)
+	}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		p.plugger.Logf("Cannot decode snap response: %v\n-----\n%s\n-----", err, body)
+		return fmt.Errorf("cannot decode snap response: %v", err)
+	}
+	return nil
+}
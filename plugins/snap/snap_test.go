@@ -0,0 +1,158 @@
+package snap_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/snap"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+// snapServer serves both the Launchpad builds and the store channel map,
+// moving to the next of its responses on every store request.
+type snapServer struct {
+	mu       sync.Mutex
+	builds   []string
+	channels []string
+	served   int
+	series   string
+}
+
+func (s *snapServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch req.URL.Path {
+	case "/~team/+snap/foo-recipe/completed_builds":
+		w.Write([]byte(`{"entries": [` + s.builds[s.served] + `]}`))
+	case "/v2/snaps/info/foo":
+		s.series = req.Header.Get("Snap-Device-Series")
+		w.Write([]byte(`{"channel-map": [` + s.channels[s.served] + `]}`))
+		if s.served < len(s.channels)-1 {
+			s.served++
+		}
+	default:
+		panic("got unexpected request for " + req.URL.Path + " in test snapServer")
+	}
+}
+
+func (s *snapServer) done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.served == len(s.channels)-1
+}
+
+func build(id int, arch, state string) string {
+	return fmt.Sprintf(`{"self_link": "https://api.launchpad.net/devel/~team/+snap/foo-recipe/+build/%d",
+		"web_link": "https://launchpad.net/~team/+snap/foo-recipe/+build/%d", "arch_tag": %q, "buildstate": %q}`,
+		id, id, arch, state)
+}
+
+func channel(track, risk, arch string, revision int, version string) string {
+	return fmt.Sprintf(`{"channel": {"architecture": %q, "name": %q, "track": %q, "risk": %q}, "revision": %d, "version": %q}`,
+		arch, risk, track, risk, revision, version)
+}
+
+func join(entries ...string) string {
+	return strings.Join(entries, ",")
+}
+
+func newSnapServer() *snapServer {
+	return &snapServer{
+		builds: []string{
+			join(build(2, "amd64", "Failed to build"), build(1, "arm64", "Successfully built")),
+			join(build(4, "arm64", "Chroot problem"), build(3, "amd64", "Successfully built"), build(2, "amd64", "Failed to build")),
+			join(build(5, "amd64", "Cancelled"), build(4, "arm64", "Chroot problem")),
+		},
+		channels: []string{
+			join(channel("latest", "stable", "amd64", 10, "1.0"), channel("latest", "edge", "amd64", 11, "1.1")),
+			join(
+				channel("latest", "stable", "amd64", 10, "1.0"),
+				channel("latest", "edge", "amd64", 12, "1.2"),
+				channel("latest", "edge", "arm64", 13, "1.2"),
+				channel("2.0", "beta", "amd64", 14, "2.0~beta1"),
+			),
+			join(
+				channel("latest", "stable", "amd64", 12, "1.2"),
+				channel("latest", "edge", "amd64", 12, "1.2"),
+				channel("latest", "edge", "arm64", 13, "1.2"),
+				channel("2.0", "beta", "amd64", 14, "2.0~beta1"),
+			),
+		},
+	}
+}
+
+func (s *S) TestWatch(c *C) {
+	server := newSnapServer()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("snapwatch")
+	tester.SetConfig(mup.Map{
+		"endpoint":      httpServer.URL,
+		"storeendpoint": httpServer.URL,
+		"polldelay":     "20ms",
+		"snaps":         []mup.Map{{"name": "foo", "recipe": "~team/foo-recipe"}},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Snap foo build #4 on arm64 failed: Chroot problem <https://launchpad.net/~team/+snap/foo-recipe/+build/4>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Snap foo 1.2 released to latest/edge: r12 on amd64, r13 on arm64 <https://snapcraft.io/foo>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Snap foo 2.0~beta1 released to 2.0/beta: r14 on amd64 <https://snapcraft.io/foo>")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Snap foo 1.2 released to latest/stable: r12 on amd64 <https://snapcraft.io/foo>")
+
+	for !server.done() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tester.Stop()
+	c.Assert(tester.RecvAll(), HasLen, 0)
+	c.Assert(server.series, Equals, "16")
+}
+
+func (s *S) TestWatchChannels(c *C) {
+	server := newSnapServer()
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	tester := mup.NewPluginTester("snapwatch")
+	tester.SetConfig(mup.Map{
+		"endpoint":      httpServer.URL,
+		"storeendpoint": httpServer.URL,
+		"polldelay":     "20ms",
+		"snaps":         []mup.Map{{"name": "foo", "channels": []string{"stable"}}},
+		"templates":     mup.Map{"released": "{{.Project}} {{.State}} is out on {{.Branch}}"},
+	})
+	tester.SetTargets([]mup.Target{{Account: "test", Channel: "#chan"}})
+	tester.Start()
+
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :foo 1.2 is out on latest/stable")
+
+	for !server.done() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tester.Stop()
+	c.Assert(tester.RecvAll(), HasLen, 0)
+}
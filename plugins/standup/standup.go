@@ -0,0 +1,310 @@
+// Package standup implements a plugin that records meetings held in
+// channels and produces their minutes, in the spirit of MeetBot.
+package standup
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mup.v0"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "standup",
+	Help: `Records meetings held in channels and posts their minutes.
+
+	A meeting starts with "#startmeeting [<title>]" in one of the plugin target
+	channels, and ends with "#endmeeting". In between, the following lines are
+	recorded in the minutes:
+
+	    #topic <topic>         Starts a new topic (chairs only).
+	    #info <text>           Records information under the current topic.
+	    #agreed <text>         Records an agreement (chairs only).
+	    #action <nick> <text>  Records an action item for someone.
+	    #link <url> [<text>]   Records a link under the current topic.
+	    #chair <nick> ...      Adds meeting chairs (chairs only).
+
+	The person starting the meeting is its first chair, and only chairs may
+	end it. The minutes are built from the messages received in the channel
+	during the meeting, so meetings survive restarts of the bot. They are
+	stored in the database and posted to the channel when the meeting ends,
+	using a paste link when they are long.
+	`,
+	Start: start,
+}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type standupPlugin struct {
+	plugger *mup.Plugger
+	config  struct {
+		// Timezone defines the location used for times in the minutes,
+		// unless the plugin target defines its own.
+		Timezone string
+	}
+	location *time.Location
+}
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &standupPlugin{
+		plugger:  plugger,
+		location: time.Local,
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.Timezone != "" {
+		p.location, err = time.LoadLocation(p.config.Timezone)
+		if err != nil {
+			plugger.Logf("Cannot load timezone %q: %v", p.config.Timezone, err)
+			p.location = time.Local
+		}
+	}
+	return p
+}
+
+// targetLocation returns the timezone of the plugin target that contains
+// the address of msg, falling back to the one in the plugin configuration.
+func (p *standupPlugin) targetLocation(msg *mup.Message) *time.Location {
+	return p.plugger.Localize(msg, time.Now().In(p.location)).Location()
+}
+
+func (p *standupPlugin) Stop() error {
+	return nil
+}
+
+// meeting holds the details of a meeting as recorded in the meeting table.
+type meeting struct {
+	id        int64
+	title     string
+	chair     string
+	startId   int64
+	startTime time.Time
+}
+
+func (p *standupPlugin) HandleMessage(msg *mup.Message) {
+	if msg.Command != "PRIVMSG" || msg.Channel == "" || msg.BotText != "" || !strings.HasPrefix(msg.Text, "#") {
+		return
+	}
+	command, arg := meetingCommand(msg.Text)
+	switch command {
+	case "#startmeeting":
+		p.startMeeting(msg, arg)
+	case "#endmeeting":
+		p.endMeeting(msg)
+	}
+}
+
+func meetingCommand(text string) (command, arg string) {
+	fields := strings.SplitN(strings.TrimSpace(text), " ", 2)
+	command = strings.ToLower(fields[0])
+	if len(fields) > 1 {
+		arg = strings.TrimSpace(fields[1])
+	}
+	return command, arg
+}
+
+func (p *standupPlugin) openMeeting(msg *mup.Message) (*meeting, error) {
+	var m meeting
+	row := p.plugger.DB().QueryRow("SELECT id,title,chair,startid,starttime FROM meeting "+
+		"WHERE plugin=? AND account=? AND channel=? AND endid=0", p.plugger.Name(), msg.Account, msg.Channel)
+	err := row.Scan(&m.id, &m.title, &m.chair, &m.startId, &m.startTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot query meeting table: %v", err)
+	}
+	return &m, nil
+}
+
+func (p *standupPlugin) startMeeting(msg *mup.Message, title string) {
+	m, err := p.openMeeting(msg)
+	if err != nil {
+		p.plugger.Logf("%v", err)
+		p.plugger.Sendf(msg, "Oops: %v", err)
+		return
+	}
+	if m != nil {
+		p.plugger.Sendf(msg, "A meeting is already in progress, started by %s at %s.", m.chair, p.plugger.FormatTime(msg, m.startTime.In(p.location), "15:04"))
+		return
+	}
+	if title == "" {
+		title = "Meeting"
+	}
+	_, err = p.plugger.DB().Exec("INSERT INTO meeting (plugin,account,channel,title,chair,startid,starttime) VALUES (?,?,?,?,?,?,?)",
+		p.plugger.Name(), msg.Account, msg.Channel, title, msg.Nick, msg.Id, msg.Time)
+	if err != nil {
+		p.plugger.Logf("Cannot insert meeting: %v", err)
+		p.plugger.Sendf(msg, "Oops: cannot record meeting: %v", err)
+		return
+	}
+	p.plugger.SendChannelf(msg, "Meeting started: %s. Chair: %s. Useful commands: #topic #info #agreed #action #link #chair #endmeeting", title, msg.Nick)
+}
+
+func (p *standupPlugin) endMeeting(msg *mup.Message) {
+	m, err := p.openMeeting(msg)
+	if err != nil {
+		p.plugger.Logf("%v", err)
+		p.plugger.Sendf(msg, "Oops: %v", err)
+		return
+	}
+	if m == nil {
+		p.plugger.Sendf(msg, "There's no meeting in progress.")
+		return
+	}
+	transcript, err := p.transcript(msg, m)
+	if err != nil {
+		p.plugger.Logf("%v", err)
+		p.plugger.Sendf(msg, "Oops: %v", err)
+		return
+	}
+	minutes := newMinutes(m)
+	for _, line := range transcript {
+		minutes.add(line)
+	}
+	if !minutes.chairs[msg.Nick] {
+		p.plugger.Sendf(msg, "Only the meeting chairs may end it: %s.", strings.Join(minutes.chairSeq, ", "))
+		return
+	}
+	text := minutes.format(msg.Time, p.targetLocation(msg))
+	_, err = p.plugger.DB().Exec("UPDATE meeting SET endid=?,endtime=?,minutes=? WHERE id=?", msg.Id, msg.Time, text, m.id)
+	if err != nil {
+		p.plugger.Logf("Cannot update meeting: %v", err)
+		p.plugger.Sendf(msg, "Oops: cannot record meeting: %v", err)
+		return
+	}
+	a := msg.Address()
+	a.Nick = ""
+	p.plugger.SendLong(a, text)
+}
+
+// transcript returns the messages received in the meeting channel since
+// the meeting started and up to msg, inclusive.
+func (p *standupPlugin) transcript(msg *mup.Message, m *meeting) ([]*mup.Message, error) {
+	rows, err := p.plugger.DB().Query("SELECT nick,text,time FROM message "+
+		"WHERE lane=1 AND account=? AND channel=? AND command='PRIVMSG' AND id>? AND id<=? ORDER BY id",
+		msg.Account, msg.Channel, m.startId, msg.Id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query meeting transcript: %v", err)
+	}
+	defer rows.Close()
+	var transcript []*mup.Message
+	for rows.Next() {
+		var line mup.Message
+		if err := rows.Scan(&line.Nick, &line.Text, &line.Time); err != nil {
+			return nil, fmt.Errorf("cannot parse meeting transcript: %v", err)
+		}
+		transcript = append(transcript, &line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query meeting transcript: %v", err)
+	}
+	return transcript, nil
+}
+
+type minutesTopic struct {
+	title string
+	items []string
+}
+
+type minutes struct {
+	meeting   *meeting
+	chairs    map[string]bool
+	chairSeq  []string
+	attendees map[string]int
+	topics    []*minutesTopic
+	actions   []string
+}
+
+func newMinutes(m *meeting) *minutes {
+	return &minutes{
+		meeting:   m,
+		chairs:    map[string]bool{m.chair: true},
+		chairSeq:  []string{m.chair},
+		attendees: map[string]int{m.chair: 1},
+		topics:    []*minutesTopic{{}},
+	}
+}
+
+func (mn *minutes) add(line *mup.Message) {
+	mn.attendees[line.Nick]++
+	command, arg := meetingCommand(line.Text)
+	if arg == "" {
+		return
+	}
+	topic := mn.topics[len(mn.topics)-1]
+	chair := mn.chairs[line.Nick]
+	switch command {
+	case "#topic":
+		if chair {
+			mn.topics = append(mn.topics, &minutesTopic{title: arg})
+		}
+	case "#info":
+		topic.items = append(topic.items, arg)
+	case "#link":
+		topic.items = append(topic.items, "LINK: "+arg)
+	case "#agreed":
+		if chair {
+			topic.items = append(topic.items, "AGREED: "+arg)
+		}
+	case "#action":
+		topic.items = append(topic.items, "ACTION: "+arg)
+		mn.actions = append(mn.actions, arg)
+	case "#chair":
+		if chair {
+			for _, nick := range strings.Fields(arg) {
+				if !mn.chairs[nick] {
+					mn.chairs[nick] = true
+					mn.chairSeq = append(mn.chairSeq, nick)
+				}
+			}
+		}
+	}
+}
+
+func (mn *minutes) format(end time.Time, location *time.Location) string {
+	var buf bytes.Buffer
+	start := mn.meeting.startTime.In(location)
+	fmt.Fprintf(&buf, "Meeting ended: %s. Started at %s and ended at %s. Chairs: %s.\n",
+		mn.meeting.title, start.Format("2006-01-02 15:04"), end.In(location).Format("15:04"), strings.Join(mn.chairSeq, ", "))
+
+	nicks := make([]string, 0, len(mn.attendees))
+	for nick := range mn.attendees {
+		nicks = append(nicks, nick)
+	}
+	sort.Slice(nicks, func(i, j int) bool {
+		ci, cj := mn.attendees[nicks[i]], mn.attendees[nicks[j]]
+		return ci > cj || ci == cj && nicks[i] < nicks[j]
+	})
+	for i, nick := range nicks {
+		nicks[i] = fmt.Sprintf("%s (%d)", nick, mn.attendees[nick])
+	}
+	fmt.Fprintf(&buf, "Attendees: %s\n", strings.Join(nicks, ", "))
+
+	for _, topic := range mn.topics {
+		if topic.title == "" && len(topic.items) == 0 {
+			continue
+		}
+		if topic.title != "" {
+			fmt.Fprintf(&buf, "Topic: %s\n", topic.title)
+		}
+		for _, item := range topic.items {
+			fmt.Fprintf(&buf, "  * %s\n", item)
+		}
+	}
+	if len(mn.actions) > 0 {
+		buf.WriteString("Action items:\n")
+		for _, action := range mn.actions {
+			fmt.Fprintf(&buf, "  * %s\n", action)
+		}
+	}
+	return buf.String()
+}
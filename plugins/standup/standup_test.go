@@ -0,0 +1,78 @@
+package standup_test
+
+import (
+	"testing"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/standup"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+func say(tester *mup.IntegrationTester, nick, text string) {
+	tester.Sendf("[,raw] :%s!~%s@host PRIVMSG #chan :%s", nick, nick, text)
+}
+
+func (s *S) TestMeeting(c *C) {
+	tester := mup.NewIntegrationTester("standup")
+	tester.SetConfig("standup", mup.Map{"timezone": "UTC", "pastelines": 20})
+	c.Assert(tester.Start(), IsNil)
+	defer tester.Stop()
+
+	say(tester, "bob", "#endmeeting")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :bob: There's no meeting in progress.")
+
+	say(tester, "alice", "#startmeeting Weekly sync")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Meeting started: Weekly sync. Chair: alice. Useful commands: #topic #info #agreed #action #link #chair #endmeeting")
+
+	say(tester, "bob", "#startmeeting Other")
+	c.Assert(tester.Recv(), Matches, "PRIVMSG #chan :bob: A meeting is already in progress, started by alice at [0-9]{2}:[0-9]{2}.")
+
+	say(tester, "bob", "hello")
+	say(tester, "alice", "#topic Release")
+	say(tester, "bob", "#info RC is out")
+	say(tester, "bob", "#agreed ship it")
+	say(tester, "bob", "#topic Ignored")
+	say(tester, "alice", "#chair bob")
+	say(tester, "bob", "#agreed Ship on Friday")
+	say(tester, "carol", "#link https://example.com/notes Notes")
+	say(tester, "bob", "#action carol to write the announcement")
+	say(tester, "carol", "#endmeeting")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :carol: Only the meeting chairs may end it: alice, bob.")
+
+	say(tester, "bob", "#endmeeting")
+	c.Assert(tester.Recv(), Matches, `PRIVMSG #chan :Meeting ended: Weekly sync. Started at [-0-9]{10} [0-9:]{5} and ended at [0-9:]{5}. Chairs: alice, bob.`)
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Attendees: bob (8), alice (3), carol (2)")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Topic: Release")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :  * RC is out")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :  * AGREED: Ship on Friday")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :  * LINK: https://example.com/notes Notes")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :  * ACTION: carol to write the announcement")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :Action items:")
+	c.Assert(tester.Recv(), Equals, "PRIVMSG #chan :  * carol to write the announcement")
+
+	var title, minutes string
+	err := tester.DB().QueryRow("SELECT title,minutes FROM meeting WHERE endid>0").Scan(&title, &minutes)
+	c.Assert(err, IsNil)
+	c.Assert(title, Equals, "Weekly sync")
+	c.Assert(minutes, Matches, `(?s)Meeting ended: Weekly sync\..*Action items:\n  \* carol to write the announcement\n`)
+
+	say(tester, "alice", "#startmeeting")
+	c.Assert(tester.Recv(), Matches, "PRIVMSG #chan :Meeting started: Meeting. Chair: alice. .*")
+}
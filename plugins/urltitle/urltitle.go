@@ -0,0 +1,293 @@
+// Package urltitle implements a plugin that overhears URLs in conversations
+// and reports the title of the pages they point to.
+package urltitle
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/mup.v0"
+	"gopkg.in/tomb.v2"
+)
+
+var Plugin = mup.PluginSpec{
+	Name: "urltitle",
+	Help: `Reports the title of web pages mentioned in conversations.
+
+	URLs are only looked up in channels where the "overhear" configuration option
+	is true, either for the whole plugin or for the specific plugin target. Only
+	HTML pages are considered, and at most "maxsize" bytes of each are read.
+	YouTube videos and tweets are reported with their author.
+
+	Addresses in private networks are not fetched unless "allowprivate" is true.
+	`,
+	Start: start,
+}
+
+func init() {
+	mup.RegisterPlugin(&Plugin)
+}
+
+type urlPlugin struct {
+	tomb     tomb.Tomb
+	plugger  *mup.Plugger
+	messages chan *mup.Message
+	client   *http.Client
+	config   struct {
+		Overhear     bool
+		MaxSize      int64
+		MaxURLs      int
+		Timeout      mup.DurationString
+		AllowPrivate bool
+
+		YouTubeEndpoint string
+		TwitterEndpoint string
+	}
+
+	overhear map[mup.Address]bool
+}
+
+const (
+	defaultMaxSize         = 512 * 1024
+	defaultMaxURLs         = 3
+	defaultTimeout         = 5 * time.Second
+	defaultYouTubeEndpoint = "https://www.youtube.com/oembed"
+	defaultTwitterEndpoint = "https://publish.twitter.com/oembed"
+
+	maxTitleLen = 200
+)
+
+func start(plugger *mup.Plugger) mup.Stopper {
+	p := &urlPlugin{
+		plugger:  plugger,
+		messages: make(chan *mup.Message, 10),
+		overhear: make(map[mup.Address]bool),
+	}
+	err := plugger.UnmarshalConfig(&p.config)
+	if err != nil {
+		plugger.Logf("%v", err)
+	}
+	if p.config.MaxSize == 0 {
+		p.config.MaxSize = defaultMaxSize
+	}
+	if p.config.MaxURLs == 0 {
+		p.config.MaxURLs = defaultMaxURLs
+	}
+	if p.config.Timeout.Duration == 0 {
+		p.config.Timeout.Duration = defaultTimeout
+	}
+	if p.config.YouTubeEndpoint == "" {
+		p.config.YouTubeEndpoint = defaultYouTubeEndpoint
+	}
+	if p.config.TwitterEndpoint == "" {
+		p.config.TwitterEndpoint = defaultTwitterEndpoint
+	}
+	dialer := &net.Dialer{Timeout: p.config.Timeout.Duration}
+	if !p.config.AllowPrivate {
+		dialer.Control = refusePrivate
+	}
+	p.client = &http.Client{
+		Timeout:   p.config.Timeout.Duration,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+
+	targets := plugger.Targets()
+	for i := range targets {
+		var tconfig struct{ Overhear bool }
+		target := &targets[i]
+		err := target.UnmarshalConfig(&tconfig)
+		if err != nil {
+			plugger.Logf("%v", err)
+		}
+		if p.config.Overhear || tconfig.Overhear {
+			p.overhear[target.Address()] = true
+		}
+	}
+
+	p.tomb.Go(p.loop)
+	return p
+}
+
+func (p *urlPlugin) Stop() error {
+	close(p.messages)
+	return p.tomb.Wait()
+}
+
+func (p *urlPlugin) HandleMessage(msg *mup.Message) {
+	if msg.BotText != "" || !p.overhear[p.plugger.Target(msg).Address()] || !strings.Contains(msg.Text, "://") {
+		return
+	}
+	select {
+	case p.messages <- msg:
+	default:
+		p.plugger.Logf("Message queue is full. Dropping message: %s", msg.String())
+	}
+}
+
+func (p *urlPlugin) loop() error {
+	for msg := range p.messages {
+		for _, u := range p.parseURLs(msg.Text) {
+			title, err := p.title(u)
+			if err != nil {
+				p.plugger.Logf("Cannot obtain title of %s: %v", u, err)
+				continue
+			}
+			if title != "" {
+				p.plugger.SendChannelf(msg, "%s", title)
+			}
+		}
+	}
+	return nil
+}
+
+var urlExp = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+
+func (p *urlPlugin) parseURLs(text string) []*url.URL {
+	var urls []*url.URL
+	seen := make(map[string]bool)
+	for _, s := range urlExp.FindAllString(text, -1) {
+		s = strings.TrimRight(s, ".,;:!?)]}'")
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		urls = append(urls, u)
+		if len(urls) == p.config.MaxURLs {
+			break
+		}
+	}
+	return urls
+}
+
+func (p *urlPlugin) title(u *url.URL) (string, error) {
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	switch host {
+	case "youtube.com", "m.youtube.com", "youtu.be":
+		return p.oembed(p.config.YouTubeEndpoint, u, "YouTube")
+	case "twitter.com", "mobile.twitter.com", "x.com":
+		if strings.Contains(u.Path, "/status/") {
+			return p.oembed(p.config.TwitterEndpoint, u, "Tweet")
+		}
+	}
+	return p.pageTitle(u)
+}
+
+var titleExp = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+func (p *urlPlugin) pageTitle(u *url.URL) (string, error) {
+	resp, err := p.get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return "", nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, p.config.MaxSize))
+	if err != nil {
+		return "", err
+	}
+	m := titleExp.FindSubmatch(data)
+	if m == nil {
+		return "", nil
+	}
+	title := cleanText(string(m[1]))
+	if title == "" {
+		return "", nil
+	}
+	return "Title: " + title, nil
+}
+
+var tagExp = regexp.MustCompile(`(?s)<[^>]*>`)
+var tweetExp = regexp.MustCompile(`(?is)<p[^>]*>(.*?)</p>`)
+
+func (p *urlPlugin) oembed(endpoint string, u *url.URL, kind string) (string, error) {
+	resp, err := p.get(endpoint + "?format=json&url=" + url.QueryEscape(u.String()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Title      string `json:"title"`
+		AuthorName string `json:"author_name"`
+		HTML       string `json:"html"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, p.config.MaxSize)).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode oEmbed response: %v", err)
+	}
+	text := result.Title
+	if m := tweetExp.FindStringSubmatch(result.HTML); m != nil && text == "" {
+		text = m[1]
+	}
+	text = cleanText(text)
+	if text == "" {
+		return "", nil
+	}
+	if result.AuthorName != "" {
+		return fmt.Sprintf("%s by %s: %s", kind, cleanText(result.AuthorName), text), nil
+	}
+	return fmt.Sprintf("%s: %s", kind, text), nil
+}
+
+func (p *urlPlugin) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "mup")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/json;q=0.9,*/*;q=0.1")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+// cleanText strips tags and entities from s and collapses its whitespace.
+func cleanText(s string) string {
+	s = html.UnescapeString(tagExp.ReplaceAllString(s, " "))
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > maxTitleLen {
+		cut := maxTitleLen
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		s = s[:cut] + "…"
+	}
+	return s
+}
+
+// refusePrivate prevents connections to loopback, private, and link-local
+// addresses, so that the bot can't be used to probe its own network.
+func refusePrivate(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to connect to private address %s", host)
+	}
+	return nil
+}
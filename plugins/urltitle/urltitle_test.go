@@ -0,0 +1,139 @@
+package urltitle_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mup.v0"
+	_ "gopkg.in/mup.v0/plugins/urltitle"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (s *S) SetUpSuite(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *S) TearDownSuite(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+type urlTest struct {
+	config  mup.Map
+	targets []mup.Target
+	send    []string
+	recv    []string
+}
+
+var urlTests = []urlTest{{
+	// Not overhearing by default.
+	send: []string{"[#chan] see URL/page"},
+	recv: []string(nil),
+}, {
+	// Overhearing enabled for the plugin.
+	config: mup.Map{"overhear": true},
+	send:   []string{"[#chan] see URL/page."},
+	recv:   []string{"PRIVMSG #chan :Title: The Page & Friends"},
+}, {
+	// Overhearing enabled for a single channel.
+	targets: []mup.Target{
+		{Account: "test", Channel: "#chan", Config: `{"overhear": true}`},
+		{Account: "test", Channel: "#other"},
+	},
+	send: []string{"[#other] see URL/page", "[#chan] see URL/page"},
+	recv: []string{"PRIVMSG #chan :Title: The Page & Friends"},
+}, {
+	// Commands aren't overheard, and neither are non-HTML pages
+	// or titles beyond the size limit.
+	config: mup.Map{"overhear": true, "maxsize": 100},
+	send:   []string{"[#chan] mup: URL/page", "[#chan] URL/image", "[#chan] URL/big URL/page URL/page"},
+	recv:   []string{"PRIVMSG #chan :Title: The Page & Friends"},
+}, {
+	// Failures are only logged.
+	config: mup.Map{"overhear": true},
+	send:   []string{"[#chan] URL/missing"},
+	recv:   []string(nil),
+}, {
+	// YouTube and Twitter are special cased.
+	config: mup.Map{"overhear": true},
+	send: []string{
+		"[#chan] https://www.youtube.com/watch?v=abc",
+		"[#chan] https://twitter.com/someone/status/123",
+	},
+	recv: []string{
+		"PRIVMSG #chan :YouTube by Some Channel: A video about things",
+		"PRIVMSG #chan :Tweet by Someone: Hello world & everyone",
+	},
+}, {
+	// Private addresses are refused unless allowed.
+	config: mup.Map{"overhear": true, "allowprivate": false},
+	send:   []string{"[#chan] URL/page"},
+	recv:   []string(nil),
+}}
+
+func (s *S) TestURLTitle(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(serve))
+	defer server.Close()
+
+	for i, test := range urlTests {
+		c.Logf("Test #%d: %s", i, test.send)
+		config := mup.Map{
+			"allowprivate":    true,
+			"youtubeendpoint": server.URL + "/youtube",
+			"twitterendpoint": server.URL + "/twitter",
+		}
+		for k, v := range test.config {
+			config[k] = v
+		}
+		targets := test.targets
+		if targets == nil {
+			targets = []mup.Target{{Account: "test"}}
+		}
+		tester := mup.NewPluginTester("urltitle")
+		tester.SetConfig(config)
+		tester.SetTargets(targets)
+		tester.Start()
+		for _, send := range test.send {
+			tester.Sendf("%s", strings.Replace(send, "URL", server.URL, -1))
+		}
+		tester.Stop()
+		c.Assert(tester.RecvAll(), DeepEquals, test.recv)
+	}
+}
+
+func serve(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/page":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<html><head>\n<title>\n  The Page &amp; Friends\n</title></head><body></body></html>")
+	case "/big":
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head>%s<title>Too far</title></head></html>", strings.Repeat(" ", 200))
+	case "/image":
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprintf(w, "<title>Not a page</title>")
+	case "/youtube":
+		if req.FormValue("url") != "https://www.youtube.com/watch?v=abc" {
+			panic("unexpected YouTube URL: " + req.FormValue("url"))
+		}
+		fmt.Fprintf(w, `{"title": "A video about things", "author_name": "Some Channel"}`)
+	case "/twitter":
+		if req.FormValue("url") != "https://twitter.com/someone/status/123" {
+			panic("unexpected Twitter URL: " + req.FormValue("url"))
+		}
+		fmt.Fprintf(w, `{"author_name": "Someone", "html": "<blockquote><p lang=\"en\">Hello <a href=\"#\">world</a> &amp; everyone</p>&mdash; Someone</blockquote>"}`)
+	default:
+		w.WriteHeader(404)
+	}
+}
@@ -1,6 +1,10 @@
 package webhook
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -26,6 +30,15 @@ var Plugin = mup.PluginSpec{
 	in the plugin configuration. The message is only received by mup if the
 	message origin matches one of the plugin targets.
 
+	Rather than a token, requests may be authenticated with an HMAC-SHA256
+	signature of the request body computed with the "secret" string in the
+	plugin configuration, and provided in the X-Hub-Signature-256 header as
+	"sha256=<hex signature>". Requests with a bad signature are rejected even
+	if their token is valid.
+
+	When the "allow" configuration list is provided, only requests from the
+	IP addresses or networks (e.g. "10.0.0.0/8") in it are accepted.
+
 	The address to listen on may be changed via the "addr" configuration
 	option. If not provided the address 0.0.0.0:10456 is used.
 	`,
@@ -43,9 +56,12 @@ type webhookPlugin struct {
 	listener net.Listener
 	config   struct {
 		Tokens []string
+		Secret string
+		Allow  []string
 		Nick   string
 		Addr   string
 	}
+	allow []*net.IPNet
 }
 
 const defaultAddr = ":10456"
@@ -64,6 +80,22 @@ func start(plugger *mup.Plugger) mup.Stopper {
 	if p.config.Addr == "" {
 		p.config.Addr = defaultAddr
 	}
+	for _, allow := range p.config.Allow {
+		if !strings.Contains(allow, "/") {
+			if strings.Contains(allow, ":") {
+				allow += "/128"
+			} else {
+				allow += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(allow)
+		if err != nil {
+			// Leaving the entry out can only reject more requests.
+			plugger.Logf("Invalid address in allow list: %v", err)
+			continue
+		}
+		p.allow = append(p.allow, ipnet)
+	}
 	p.tomb.Go(p.loop)
 	return p
 }
@@ -126,14 +158,59 @@ type payloadMessage struct {
 
 func (p *webhookPlugin) hasToken(token string) bool {
 	for _, t := range p.config.Tokens {
-		if token == t {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether requests from the remote address addr are
+// accepted, as defined by the allow list in the plugin configuration.
+func (p *webhookPlugin) allowed(addr string) bool {
+	if len(p.config.Allow) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, ipnet := range p.allow {
+		if ipnet.Contains(ip) {
 			return true
 		}
 	}
 	return false
 }
 
+// signed reports whether the request has a signature header, and whether
+// that signature is valid for the provided payload data.
+func (p *webhookPlugin) signed(r *http.Request, data []byte) (present, valid bool) {
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if signature == "" {
+		return false, false
+	}
+	if p.config.Secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return true, false
+	}
+	got, err := hex.DecodeString(signature[len("sha256="):])
+	if err != nil {
+		return true, false
+	}
+	mac := hmac.New(sha256.New, []byte(p.config.Secret))
+	mac.Write(data)
+	return true, hmac.Equal(got, mac.Sum(nil))
+}
+
 func (p *webhookPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.allowed(r.RemoteAddr) {
+		p.plugger.Logf("Rejected request from %s: address not in allow list", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"success:": false, "message": "address not allowed"}`))
+		return
+	}
+
 	contentType := r.Header.Get("Content-Type")
 	payloadData, err := ioutil.ReadAll(&io.LimitedReader{R: r.Body, N: 16385})
 	if len(payloadData) == 0 || r.Method != "POST" || contentType != "application/json" {
@@ -157,7 +234,14 @@ func (p *webhookPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !p.hasToken(pmsg.Token) {
+	signed, valid := p.signed(r, payloadData)
+	if signed && !valid {
+		p.plugger.Logf("Invalid signature received from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"success:": false, "message": "invalid signature"}`))
+		return
+	}
+	if !valid && !p.hasToken(pmsg.Token) {
 		p.plugger.Logf("Invalid token received: %s", pmsg.Token)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(`{"success:": false, "message": "invalid token"}`))
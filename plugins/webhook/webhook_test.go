@@ -2,6 +2,9 @@ package webhook_test
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"net"
 	"net/http"
 	"testing"
@@ -33,6 +36,9 @@ type webhookTest struct {
 	message string
 	config  mup.Map
 	targets []mup.Target
+
+	// The secret to sign the payload with, if any.
+	sign string
 }
 
 var webhookTests = []webhookTest{{
@@ -82,6 +88,38 @@ var webhookTests = []webhookTest{{
 	message: ``,
 	config:  mup.Map{"tokens": []string{"secret"}},
 	targets: []mup.Target{{Account: "test"}},
+}, {
+	// Signed with the right secret.
+	payload: `{"user_name": "nick", "text": "Hello"}`,
+	message: `:nick!~user@webhook PRIVMSG mup :Hello`,
+	config:  mup.Map{"secret": "secret"},
+	targets: []mup.Target{{Account: "test"}},
+	sign:    "secret",
+}, {
+	// Signed with the wrong secret, even if the token is good.
+	payload: `{"token": "secret", "user_name": "nick", "text": "Hello"}`,
+	message: ``,
+	config:  mup.Map{"tokens": []string{"secret"}, "secret": "secret"},
+	targets: []mup.Target{{Account: "test"}},
+	sign:    "bad",
+}, {
+	// Signed without a secret configured.
+	payload: `{"user_name": "nick", "text": "Hello"}`,
+	message: ``,
+	targets: []mup.Target{{Account: "test"}},
+	sign:    "secret",
+}, {
+	// From an allowed address.
+	payload: `{"token": "secret", "user_name": "nick", "text": "Hello"}`,
+	message: `:nick!~user@webhook PRIVMSG mup :Hello`,
+	config:  mup.Map{"tokens": []string{"secret"}, "allow": []string{"10.0.0.1", "127.0.0.0/8"}},
+	targets: []mup.Target{{Account: "test"}},
+}, {
+	// From an address not allowed.
+	payload: `{"token": "secret", "user_name": "nick", "text": "Hello"}`,
+	message: ``,
+	config:  mup.Map{"tokens": []string{"secret"}, "allow": []string{"10.0.0.0/8", "bad"}},
+	targets: []mup.Target{{Account: "test"}},
 }}
 
 func (s *WebHookSuite) TestIn(c *C) {
@@ -107,7 +145,15 @@ func (s *WebHookSuite) TestIn(c *C) {
 			}
 		}
 
-		resp, err := client.Post("http://localhost:10645/", "application/json", bytes.NewBufferString(test.payload))
+		req, err := http.NewRequest("POST", "http://localhost:10645/", bytes.NewBufferString(test.payload))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		if test.sign != "" {
+			mac := hmac.New(sha256.New, []byte(test.sign))
+			mac.Write([]byte(test.payload))
+			req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := client.Do(req)
 		c.Assert(err, IsNil)
 		resp.Body.Close()
 
@@ -2,8 +2,10 @@ package mup
 
 import (
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -12,14 +14,13 @@ import (
 	"time"
 
 	"gopkg.in/mup.v0"
-	"gopkg.in/mup.v0/ldap"
 	"gopkg.in/mup.v0/schema"
 	"gopkg.in/tomb.v2"
 )
 
 var Plugin = mup.PluginSpec{
 	Name:     "wolframalpha",
-	Help:     "Exposes the infer command for querying the WolframAlpha engine.",
+	Help:     "Exposes the infer and ask commands for querying the WolframAlpha engine.",
 	Start:    start,
 	Commands: Commands,
 }
@@ -38,13 +39,34 @@ var Commands = schema.Commands{{
 		Name: "query",
 		Flag: schema.Required | schema.Trailing,
 	}},
+}, {
+	Name: "ask",
+	Help: `Asks the WolframAlpha engine a question in conversation mode.
+
+	Questions asked shortly after a previous answer continue the same
+	conversation, so they may refer to what was said before. Each nick
+	has its own conversation in each channel. If -new is provided, a new
+	conversation is started even if one is still ongoing.
+	`,
+	Args: schema.Args{{
+		Name: "-new",
+		Type: schema.Bool,
+	}, {
+		Name: "query",
+		Flag: schema.Required | schema.Trailing,
+	}},
 }}
 
 func init() {
 	mup.RegisterPlugin(&Plugin)
 }
 
-var defaultEndpoint = "http://api.wolframalpha.com/v2/query"
+var (
+	defaultEndpoint             = "http://api.wolframalpha.com/v2/query"
+	defaultConversationEndpoint = "http://api.wolframalpha.com/v1/conversation.jsp"
+)
+
+const defaultConversationTimeout = 5 * time.Minute
 
 type locEntry struct {
 	loc  string
@@ -57,24 +79,70 @@ type alphaPlugin struct {
 	commands chan *mup.Command
 	newLoc   map[string]locEntry
 	oldLoc   map[string]locEntry
+	convs    map[convKey]*conversation
 	config   struct {
-		AppID    string
-		Endpoint string
-		LDAP     string
+		AppID     string
+		Endpoint  string
+		Directory string
+		LDAP      string // Obsolete alias for Directory.
+
+		// Units is either "metric" or "imperial". By default
+		// WolframAlpha picks units based on the caller location.
+		Units string
+
+		// Pods lists the ids or titles of the result pods to display,
+		// in place of the primary results picked by WolframAlpha.
+		Pods []string
+
+		// Images enables sending the image of a result pod, such as
+		// a plot, when no pod has any text to display.
+		Images bool
+
+		ConversationEndpoint string
+		ConversationTimeout  mup.DurationString
 	}
 }
 
+type convKey struct {
+	account, channel, nick string
+}
+
+type conversation struct {
+	id       string
+	host     string
+	s        string
+	lastUsed time.Time
+}
+
 func start(plugger *mup.Plugger) mup.Stopper {
 	p := &alphaPlugin{
 		plugger:  plugger,
 		commands: make(chan *mup.Command, 5),
 		newLoc:   make(map[string]locEntry),
 		oldLoc:   make(map[string]locEntry),
+		convs:    make(map[convKey]*conversation),
 	}
 	err := plugger.UnmarshalConfig(&p.config)
 	if err != nil {
 		plugger.Logf("%v", err)
 	}
+	switch p.config.Units {
+	case "", "metric":
+	case "imperial", "nonmetric":
+		p.config.Units = "nonmetric"
+	default:
+		plugger.Logf("Ignoring unknown units setting: %q", p.config.Units)
+		p.config.Units = ""
+	}
+	if p.config.ConversationEndpoint == "" {
+		p.config.ConversationEndpoint = defaultConversationEndpoint
+	}
+	if p.config.ConversationTimeout.Duration == 0 {
+		p.config.ConversationTimeout.Duration = defaultConversationTimeout
+	}
+	if p.config.Directory == "" {
+		p.config.Directory = p.config.LDAP
+	}
 	if p.config.Endpoint == "" {
 		p.config.Endpoint = defaultEndpoint
 	}
@@ -101,13 +169,15 @@ func (p *alphaPlugin) loop() error {
 		if !ok {
 			break
 		}
-		p.handle(cmd)
+		if cmd.Name() == "ask" {
+			p.ask(cmd)
+		} else {
+			p.handle(cmd)
+		}
 	}
 	return nil
 }
 
-var httpClient = http.Client{Timeout: time.Duration(10 * time.Second)}
-
 type xmlResult struct {
 	Success bool     `xml:"success,attr"`
 	Error   string   `xml:"error>msg"`
@@ -122,16 +192,22 @@ type xmlPod struct {
 }
 
 type xmlSubPod struct {
-	Title string `xml:"title,attr"`
-	Text  string `xml:"plaintext"`
+	Title string  `xml:"title,attr"`
+	Text  string  `xml:"plaintext"`
+	Img   *xmlImg `xml:"img"`
+}
+
+type xmlImg struct {
+	Src string `xml:"src,attr"`
+	Alt string `xml:"alt,attr"`
 }
 
 const locCacheLen = 100
 const locCacheExpire = 24 * time.Hour
 
-func (p *alphaPlugin) ldapLocation(cmd *mup.Command) string {
-	if p.config.LDAP == "" {
-		p.plugger.Debugf("No LDAP server configured.")
+func (p *alphaPlugin) dirLocation(cmd *mup.Command) string {
+	if p.config.Directory == "" {
+		p.plugger.Debugf("No directory configured.")
 		return ""
 	}
 
@@ -150,33 +226,30 @@ func (p *alphaPlugin) ldapLocation(cmd *mup.Command) string {
 		return entry.loc
 	}
 
-	// Not in the cache. Get a connection to look it up.
-	conn, err := p.plugger.LDAP(p.config.LDAP)
+	// Not in the cache. Get the directory to look it up.
+	dir, err := p.plugger.Directory(p.config.Directory)
 	if err != nil {
 		p.plugger.Logf("Plugin configuration error: %s.", err)
 		p.plugger.Sendf(cmd, "Plugin configuration error: %s.", err)
 		return ""
 	}
-	defer conn.Close()
+	defer dir.Close()
 
 	// Search for the nick in use, and take city, state, and country.
-	search := &ldap.Search{
-		Filter: fmt.Sprintf("(mozillaNickname=%s)", ldap.EscapeFilter(cmd.Nick)),
-		Attrs:  []string{"c", "l", "st"},
-	}
+	attrs := []string{"c", "l", "st"}
 	loc := ""
-	results, err := conn.Search(search)
+	results, err := dir.Search(mup.DirNick, cmd.Nick, attrs...)
 	if err != nil {
-		p.plugger.Logf("Cannot search LDAP server: %v", err)
+		p.plugger.Logf("Cannot search directory: %v", err)
 		return ""
 	}
 
 	// Assemble the string as "city, state, country".
 	if len(results) == 0 {
-		p.plugger.Logf("Cannot find requested IRC nick in LDAP server: %q", cmd.Nick)
+		p.plugger.Logf("Cannot find requested IRC nick in directory: %q", cmd.Nick)
 	} else {
 		r := results[0]
-		for _, name := range search.Attrs {
+		for _, name := range attrs {
 			if s := r.Value(name); s != "" {
 				loc = s
 				break
@@ -212,7 +285,13 @@ func (p *alphaPlugin) handle(cmd *mup.Command) {
 		"podtimeout":    {"2"},
 		"format":        {"plaintext"},
 	}
-	if loc := p.ldapLocation(cmd); loc != "" {
+	if p.config.Images {
+		form["format"] = []string{"plaintext,image"}
+	}
+	if p.config.Units != "" {
+		form["units"] = []string{p.config.Units}
+	}
+	if loc := p.dirLocation(cmd); loc != "" {
 		form["location"] = []string{loc}
 	} else if cmd.Host != "" {
 		form["ip"] = []string{cmd.Host}
@@ -224,7 +303,7 @@ func (p *alphaPlugin) handle(cmd *mup.Command) {
 	}
 	req.URL.RawQuery = form.Encode()
 
-	resp, err := httpClient.Do(req)
+	resp, err := p.plugger.HTTPClient().Do(req)
 	if err == nil {
 		defer resp.Body.Close()
 	}
@@ -259,15 +338,22 @@ func (p *alphaPlugin) handle(cmd *mup.Command) {
 	p.plugger.Debugf("WolframAlpha result:\n%s", data)
 
 	var replied bool
+	var image *xmlImg
+	var imageTitle string
 	var buf bytes.Buffer
 	if result.Success {
 		buf.Grow(256)
 	}
+	whitelist := len(p.config.Pods) > 0 && !args.All
 	for _, pod := range result.Pods {
 		if pod.Id == "Input" || pod.Id == "Illustration" {
 			continue
 		}
-		if !args.All && buf.Len() > 0 && !pod.Primary {
+		if whitelist {
+			if !p.podAllowed(&pod) {
+				continue
+			}
+		} else if !args.All && buf.Len() > 0 && !pod.Primary {
 			break
 		}
 		mark := buf.Len()
@@ -275,6 +361,10 @@ func (p *alphaPlugin) handle(cmd *mup.Command) {
 		for _, subpod := range pod.SubPods {
 			text := strip(subpod.Text)
 			if text == "" {
+				if p.config.Images && image == nil && subpod.Img != nil && subpod.Img.Src != "" {
+					image = subpod.Img
+					imageTitle = pod.Title
+				}
 				continue
 			}
 			if first {
@@ -311,6 +401,10 @@ func (p *alphaPlugin) handle(cmd *mup.Command) {
 		p.send(cmd, buf.String())
 		replied = true
 	}
+	if !replied && image != nil {
+		p.sendImage(cmd, imageTitle, image)
+		replied = true
+	}
 	if !replied {
 		if result.Success {
 			p.plugger.Logf("Unrecognized WolframAlpha result:\n%s", data)
@@ -319,6 +413,164 @@ func (p *alphaPlugin) handle(cmd *mup.Command) {
 	}
 }
 
+// maxImageSize is the largest pod image that is fetched to be uploaded.
+const maxImageSize = 4 << 20
+
+// sendImage fetches the pod image and sends it via the paste mechanism,
+// so it's displayed as a photo where the transport supports it. If that
+// isn't possible, the temporary WolframAlpha link to it is sent instead.
+func (p *alphaPlugin) sendImage(cmd *mup.Command, title string, img *xmlImg) {
+	caption := "Image"
+	if title != "" && title != "Result" && title != "Results" {
+		caption = title
+	}
+	data, mimeType, err := p.fetchImage(img.Src)
+	if err == nil {
+		err = p.plugger.SendImage(cmd, caption+":", data, mimeType)
+	} else {
+		p.plugger.Logf("Cannot fetch WolframAlpha image: %v", err)
+	}
+	if err != nil {
+		p.plugger.Sendf(cmd, "%s: %s", caption, img.Src)
+	}
+}
+
+func (p *alphaPlugin) fetchImage(url string) (data []byte, mimeType string, err error) {
+	resp, err := p.plugger.HTTPClient().Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("%s", resp.Status)
+	}
+	mimeType = resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, "", fmt.Errorf("unexpected content type %q", mimeType)
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxImageSize {
+		return nil, "", fmt.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+	return data, mimeType, nil
+}
+
+func (p *alphaPlugin) podAllowed(pod *xmlPod) bool {
+	for _, name := range p.config.Pods {
+		if strings.EqualFold(name, pod.Id) || strings.EqualFold(name, pod.Title) {
+			return true
+		}
+	}
+	return false
+}
+
+type convResult struct {
+	Result         string `json:"result"`
+	ConversationID string `json:"conversationID"`
+	Host           string `json:"host"`
+	S              string `json:"s"`
+	Error          string `json:"error"`
+}
+
+func (p *alphaPlugin) ask(cmd *mup.Command) {
+	var args struct {
+		Query string
+		New   bool
+	}
+	cmd.Args(&args)
+
+	// Forget conversations that went quiet.
+	now := time.Now()
+	for key, conv := range p.convs {
+		if now.Sub(conv.lastUsed) > p.config.ConversationTimeout.Duration {
+			delete(p.convs, key)
+		}
+	}
+
+	key := convKey{cmd.Account, cmd.Channel, cmd.Nick}
+	conv := p.convs[key]
+	if args.New {
+		conv = nil
+	}
+
+	endpoint, err := url.Parse(p.config.ConversationEndpoint)
+	if err != nil {
+		p.plugger.Logf("Invalid conversation endpoint: %v", err)
+		p.plugger.Sendf(cmd, "Plugin configuration error: invalid conversation endpoint.")
+		return
+	}
+	form := url.Values{
+		"appid": {p.config.AppID},
+		"i":     {args.Query},
+	}
+	if p.config.Units != "" {
+		form["units"] = []string{p.config.Units}
+	}
+	if conv != nil {
+		// Follow-up questions go to the host that holds the conversation.
+		endpoint.Host = conv.host
+		endpoint.Path = "/api/" + strings.TrimPrefix(endpoint.Path, "/")
+		form["conversationid"] = []string{conv.id}
+		if conv.s != "" {
+			form["s"] = []string{conv.s}
+		}
+	}
+	endpoint.RawQuery = form.Encode()
+
+	var result convResult
+	err = p.getJSON(endpoint.String(), &result)
+	if err != nil {
+		p.plugger.Logf("Error on conversation request to WolframAlpha: %v", err)
+		p.plugger.Sendf(cmd, "WolframAlpha request failed. Please try again soon.")
+		return
+	}
+	if result.Error != "" {
+		delete(p.convs, key)
+		p.plugger.Logf("WolframAlpha reported an error: %s", result.Error)
+		p.plugger.Sendf(cmd, "WolframAlpha reported an error: %s", result.Error)
+		return
+	}
+
+	if result.ConversationID != "" {
+		host := result.Host
+		if host == "" && conv != nil {
+			host = conv.host
+		}
+		p.convs[key] = &conversation{
+			id:       result.ConversationID,
+			host:     host,
+			s:        result.S,
+			lastUsed: now,
+		}
+	} else {
+		delete(p.convs, key)
+	}
+	if text := strings.TrimSpace(result.Result); text != "" {
+		p.plugger.Sendf(cmd, "%s", text)
+	} else {
+		p.plugger.Sendf(cmd, "Cannot infer much out of this. :-(")
+	}
+}
+
+func (p *alphaPlugin) getJSON(url string, result interface{}) error {
+	resp, err := p.plugger.HTTPClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
 var bars = regexp.MustCompile(` \|[| ]* `)
 var newlines = regexp.MustCompile(`(?m),?\s*\n[\s\n,]*`)
 
@@ -1,11 +1,14 @@
 package mup_test
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"gopkg.in/mup.v0"
 	"gopkg.in/mup.v0/ldap"
@@ -252,9 +255,45 @@ var inferTests = []inferTest{{
 		"format": {"plaintext"},
 	},
 }, {
-	// Bad LDAP connection name
+	// Units configuration.
+	send:   "infer the query",
+	recv:   "PRIVMSG nick :the result.",
+	result: "<queryresult success='true'><pod><subpod><plaintext>the result</plaintext></subpod></pod></queryresult>",
+	config: mup.Map{
+		"units": "imperial",
+	},
+	form: url.Values{
+		"ip":     {"host"},
+		"input":  {"the query"},
+		"format": {"plaintext"},
+		"units":  {"nonmetric"},
+	},
+}, {
+	// Pod whitelist.
 	send: "infer the query",
-	recv: "PRIVMSG nick :Plugin configuration error: LDAP connection \"unknown\" not found.",
+	recv: "PRIVMSG nick :Wanted: wanted one — wanted two.",
+	result: `
+		 <queryresult success='true'>
+	         <pod id="Result" primary="true"><subpod><plaintext>unhelpful</plaintext></subpod></pod>
+	         <pod id="Other" title="Wanted"><subpod><plaintext>wanted one</plaintext></subpod></pod>
+	         <pod id="Skipped"><subpod><plaintext>skipped</plaintext></subpod></pod>
+	         <pod id="WantedId"><subpod><plaintext>wanted two</plaintext></subpod></pod>
+		 </queryresult>`,
+	config: mup.Map{
+		"pods": []string{"wanted", "WantedId"},
+	},
+}, {
+	// Pod whitelist is ignored with -all.
+	send:   "infer -all the query",
+	recv:   "PRIVMSG nick :unhelpful — Wanted: wanted one.",
+	result: "<queryresult success='true'><pod id='Result'><subpod><plaintext>unhelpful</plaintext></subpod></pod><pod title='Wanted'><subpod><plaintext>wanted one</plaintext></subpod></pod></queryresult>",
+	config: mup.Map{
+		"pods": []string{"wanted"},
+	},
+}, {
+	// Bad directory name
+	send: "infer the query",
+	recv: "PRIVMSG nick :Plugin configuration error: directory \"unknown\" not found.",
 	config: mup.Map{
 		"ldap": "unknown",
 	},
@@ -324,6 +363,155 @@ func (s *S) TestInfer(c *C) {
 	}
 }
 
+const plotResult = `
+	<queryresult success='true'>
+	<pod id="Input"><subpod><plaintext>plot sin(x)</plaintext><img src="URL/input.gif"/></subpod></pod>
+	<pod id="Plot" title="Plot"><subpod><plaintext></plaintext><img src="URL/plot.gif" alt="plot"/></subpod></pod>
+	</queryresult>`
+
+func (s *S) TestInferImage(c *C) {
+	server := &alphaServer{}
+	server.Start()
+	defer server.Stop()
+	server.result = strings.Replace(plotResult, "URL", server.URL(), -1)
+
+	// Images are only considered when enabled.
+	tester := mup.NewPluginTester("wolframalpha")
+	tester.SetConfig(mup.Map{"endpoint": server.URL()})
+	tester.Start()
+	tester.Sendf("infer plot sin(x)")
+	c.Assert(tester.Stop(), IsNil)
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Cannot infer much out of this. :-(")
+	c.Assert(server.form["format"], DeepEquals, []string{"plaintext"})
+
+	// The image is uploaded and sent as an attachment.
+	tester = mup.NewPluginTester("wolframalpha")
+	tester.SetConfig(mup.Map{"endpoint": server.URL(), "images": true, "pasteurl": server.URL() + "/paste"})
+	tester.Start()
+	tester.Sendf("[#chan] mup: infer plot sin(x)")
+	c.Assert(tester.Stop(), IsNil)
+	msgs := tester.RecvMessages()
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(msgs[0].Text, Equals, "nick: Plot: https://paste.example.com/plot")
+	c.Assert(msgs[0].Attachment, Equals, mup.Attachment{
+		Kind:     "photo",
+		Id:       "https://paste.example.com/plot",
+		MimeType: "image/gif",
+		Size:     int64(len(plotImage)),
+	})
+	c.Assert(server.form["format"], DeepEquals, []string{"plaintext,image"})
+	c.Assert(server.pasted, Equals, plotImage)
+	c.Assert(server.pasteType, Equals, "image/gif")
+
+	// Without a paste service the image is linked directly.
+	tester = mup.NewPluginTester("wolframalpha")
+	tester.SetConfig(mup.Map{"endpoint": server.URL(), "images": true})
+	tester.Start()
+	tester.Sendf("infer plot sin(x)")
+	c.Assert(tester.Stop(), IsNil)
+	c.Assert(tester.Recv(), Equals, "PRIVMSG nick :Plot: "+server.URL()+"/plot.gif")
+}
+
+type askTest struct {
+	send   string
+	recv   string
+	path   string
+	form   url.Values
+	result string
+	wait   time.Duration
+}
+
+var askTests = []askTest{{
+	send:   "ask How far is Paris?",
+	recv:   "PRIVMSG nick :Far enough.",
+	path:   "/v1/conversation.jsp",
+	form:   url.Values{"i": {"How far is Paris?"}, "units": {"metric"}},
+	result: `{"result": "Far enough.", "conversationID": "conv1", "host": "HOST", "s": "3"}`,
+}, {
+	send:   "ask And London?",
+	recv:   "PRIVMSG nick :Closer.",
+	path:   "/api/v1/conversation.jsp",
+	form:   url.Values{"i": {"And London?"}, "units": {"metric"}, "conversationid": {"conv1"}, "s": {"3"}},
+	result: `{"result": "Closer.", "conversationID": "conv2", "host": "HOST"}`,
+}, {
+	send:   "[#chan] mup: ask And Rome?",
+	recv:   "PRIVMSG #chan :nick: Which Rome?",
+	path:   "/v1/conversation.jsp",
+	form:   url.Values{"i": {"And Rome?"}, "units": {"metric"}},
+	result: `{"result": "Which Rome?", "conversationID": "conv3", "host": "HOST"}`,
+}, {
+	send:   "ask -new What?",
+	recv:   "PRIVMSG nick :What what?",
+	path:   "/v1/conversation.jsp",
+	form:   url.Values{"i": {"What?"}, "units": {"metric"}},
+	result: `{"result": "What what?", "conversationID": "conv4", "host": "HOST"}`,
+}, {
+	send:   "ask And Berlin?",
+	recv:   "PRIVMSG nick :Conversation timed out.",
+	path:   "/v1/conversation.jsp",
+	form:   url.Values{"i": {"And Berlin?"}, "units": {"metric"}},
+	result: `{"result": "Conversation timed out."}`,
+	wait:   200 * time.Millisecond,
+}, {
+	send:   "ask Hmm?",
+	recv:   "PRIVMSG nick :WolframAlpha reported an error: No result is available",
+	path:   "/v1/conversation.jsp",
+	form:   url.Values{"i": {"Hmm?"}, "units": {"metric"}},
+	result: `{"error": "No result is available"}`,
+}}
+
+type convServer struct {
+	mu     sync.Mutex
+	path   string
+	form   url.Values
+	result string
+}
+
+func (s *convServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = req.URL.Path
+	s.form = req.Form
+	w.Write([]byte(strings.Replace(s.result, "HOST", req.Host, -1)))
+}
+
+func (s *S) TestAsk(c *C) {
+	conv := &convServer{}
+	server := httptest.NewServer(conv)
+	defer server.Close()
+
+	tester := mup.NewPluginTester("wolframalpha")
+	tester.SetConfig(mup.Map{
+		"appid":                "theid",
+		"units":                "metric",
+		"conversationendpoint": server.URL + "/v1/conversation.jsp",
+		"conversationtimeout":  "100ms",
+	})
+	tester.Start()
+	defer tester.Stop()
+
+	for i, test := range askTests {
+		c.Logf("Running test %d with message: %v", i, test.send)
+		if test.wait > 0 {
+			time.Sleep(test.wait)
+		}
+		conv.mu.Lock()
+		conv.result = test.result
+		conv.mu.Unlock()
+
+		tester.Sendf("%s", test.send)
+		c.Assert(tester.Recv(), Equals, test.recv)
+
+		conv.mu.Lock()
+		c.Assert(conv.path, Equals, test.path)
+		c.Assert(conv.form["appid"], DeepEquals, []string{"theid"})
+		delete(conv.form, "appid")
+		c.Assert(conv.form, DeepEquals, test.form)
+		conv.mu.Unlock()
+	}
+}
+
 type ldapConn struct {
 	nick   string
 	result ldap.Result
@@ -353,6 +541,9 @@ type alphaServer struct {
 	status int
 	form   url.Values
 
+	pasted    string
+	pasteType string
+
 	server *httptest.Server
 }
 
@@ -368,7 +559,21 @@ func (s *alphaServer) URL() string {
 	return s.server.URL
 }
 
+const plotImage = "GIF89a plot"
+
 func (s *alphaServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/plot.gif":
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte(plotImage))
+		return
+	case "/paste":
+		data, _ := ioutil.ReadAll(req.Body)
+		s.pasted = string(data)
+		s.pasteType = req.Header.Get("Content-Type")
+		w.Write([]byte("https://paste.example.com/plot\n"))
+		return
+	}
 	req.ParseForm()
 	if req.URL.Path != "/" {
 		panic("Got unexpected request for " + req.URL.Path + " in test alphaServer")
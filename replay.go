@@ -0,0 +1,201 @@
+package mup
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/mup.v0/schema"
+)
+
+// ReplayOptions defines the stored messages that Replay feeds through
+// a plugin.
+type ReplayOptions struct {
+	// Plugin is the name of the plugin, with its label if any, as
+	// defined in the plugin table.
+	Plugin string
+
+	// From and To limit the replay to the messages received within
+	// that period. The period is open-ended on the sides left zero.
+	From, To time.Time
+
+	// Account and Channel limit the replay to the messages observed in
+	// the given account and channel, if set.
+	Account, Channel string
+
+	// Wait defines how long to wait after each message for replies the
+	// plugin sends asynchronously. Replies sent later are reported at
+	// the end, without the message they refer to.
+	Wait time.Duration
+
+	// SecretKey decrypts the plugin configuration if it was encrypted
+	// in the database. See Config.SecretKey.
+	SecretKey []byte
+}
+
+// Replay feeds the incoming messages stored in db and selected by opts
+// through a sandboxed instance of the plugin, as configured in db, and
+// writes to w each message the plugin observed followed by the messages
+// the plugin sent in response. Messages are only fed to the plugin if it
+// targets the account and channel they were received in.
+//
+// Nothing is actually sent, and the plugin works on a snapshot of db
+// taken via BackupDB, so any changes it makes to the database are
+// discarded. This is useful for debugging changes to a plugin, such as
+// in the expressions it overhears, against real traffic.
+func Replay(db *sql.DB, opts *ReplayOptions, w io.Writer) error {
+	if _, ok := registeredPlugins[pluginKey(opts.Plugin)]; !ok {
+		return fmt.Errorf("plugin %q not registered", pluginKey(opts.Plugin))
+	}
+
+	var info pluginInfo
+	err := db.QueryRow("SELECT "+pluginColumns+" FROM plugin WHERE name=?", opts.Plugin).Scan(info.refs()...)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("plugin %q not found in the database", opts.Plugin)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot fetch plugin information from database: %v", err)
+	}
+	config, err := decryptSecret(opts.SecretKey, string(info.Config))
+	if err != nil {
+		return fmt.Errorf("plugin %q has unusable secrets: %v", opts.Plugin, err)
+	}
+	targets, err := replayTargets(db, opts.Plugin)
+	if err != nil {
+		return err
+	}
+
+	tmpdir, err := ioutil.TempDir("", "mup-replay-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := BackupDB(db, filepath.Join(tmpdir, dbName)); err != nil {
+		return err
+	}
+	sandbox, err := OpenDB(tmpdir)
+	if err != nil {
+		return fmt.Errorf("cannot open database snapshot: %v", err)
+	}
+	defer sandbox.Close()
+
+	msgs, err := replayMessages(db, opts)
+	if err != nil {
+		return err
+	}
+
+	t := NewPluginTester(opts.Plugin)
+	t.state.info.Name = opts.Plugin
+	t.SetDB(sandbox)
+	t.state.plugger.setConfig([]byte(config))
+	t.SetTargets(targets)
+	if err := t.Start(); err != nil {
+		return fmt.Errorf("cannot start plugin %q: %v", opts.Plugin, err)
+	}
+
+	handled := 0
+	for _, msg := range msgs {
+		if t.state.plugger.Target(msg).Account == "" {
+			continue
+		}
+		handled++
+		cmdName := schema.CommandName(msg.BotText)
+		err := t.state.safeHandle(msg, cmdName, cmdName == "" || t.state.spec.Commands.Command(cmdName) != nil, 0)
+		if err != nil {
+			t.Stop()
+			return err
+		}
+		if opts.Wait > 0 {
+			time.Sleep(opts.Wait)
+		}
+		fmt.Fprintf(w, "%s [%s] %s\n", msg.Time.Local().Format("2006-01-02 15:04:05"), msg.Account, msg.String())
+		writeReplies(w, msg.Account, t.RecvMessages())
+	}
+	err = t.Stop()
+	if replies := t.RecvMessages(); len(replies) > 0 {
+		fmt.Fprintf(w, "Replies sent after the last message:\n")
+		writeReplies(w, "", replies)
+	}
+	fmt.Fprintf(w, "Replayed %d of %d messages through plugin %q.\n", handled, len(msgs), opts.Plugin)
+	if err != nil {
+		return fmt.Errorf("plugin %q failed to stop: %v", opts.Plugin, err)
+	}
+	return nil
+}
+
+// writeReplies writes to w the replies sent by a replayed plugin, with
+// their account unless it's the one of the message they reply to.
+func writeReplies(w io.Writer, account string, replies []*Message) {
+	for _, reply := range replies {
+		if reply.Account != account {
+			fmt.Fprintf(w, "\t-> [%s] %s\n", reply.Account, reply.String())
+		} else {
+			fmt.Fprintf(w, "\t-> %s\n", reply.String())
+		}
+	}
+}
+
+func replayTargets(db *sql.DB, plugin string) ([]Target, error) {
+	rows, err := db.Query("SELECT "+targetColumns+" FROM target WHERE plugin=?", plugin)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch target information from database: %v", err)
+	}
+	defer rows.Close()
+	var targets []Target
+	for rows.Next() {
+		var t Target
+		if err := rows.Scan(t.refs()...); err != nil {
+			return nil, fmt.Errorf("cannot parse database target information: %v", err)
+		}
+		targets = append(targets, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot fetch target information from database: %v", err)
+	}
+	return targets, nil
+}
+
+func replayMessages(db *sql.DB, opts *ReplayOptions) ([]*Message, error) {
+	query := "SELECT " + messageColumns + " FROM message WHERE lane=1"
+	var args []interface{}
+	if !opts.From.IsZero() {
+		query += " AND time>=?"
+		args = append(args, opts.From)
+	}
+	if !opts.To.IsZero() {
+		query += " AND time<?"
+		args = append(args, opts.To)
+	}
+	if opts.Account != "" {
+		query += " AND account=?"
+		args = append(args, opts.Account)
+	}
+	if opts.Channel != "" {
+		query += " AND channel=?"
+		args = append(args, opts.Channel)
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch messages from database: %v", err)
+	}
+	defer rows.Close()
+	var msgs []*Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(msg.refs(0)...); err != nil {
+			return nil, fmt.Errorf("cannot parse database message: %v", err)
+		}
+		if msg.Command == cmdPong {
+			continue
+		}
+		msgs = append(msgs, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot fetch messages from database: %v", err)
+	}
+	return msgs, nil
+}
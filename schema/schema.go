@@ -5,25 +5,41 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
 type Commands []Command
 
 type Command struct {
-	Name string
-	Help string
-	Args Args
-	Hide bool
+	Name string `json:"name"`
+	Help string `json:"help,omitempty"`
+	Args Args   `json:"args,omitempty"`
+	Hide bool   `json:"hide,omitempty"`
+
+	// Cooldown is the minimum time between runs of the command by the
+	// same user, and by anyone in the same channel. Runs during the
+	// cooldown are refused by mup before reaching the plugin.
+	Cooldown time.Duration `json:"cooldown,omitempty"`
 }
 
 type Args []Arg
 
 type Arg struct {
-	Name string
-	Hint string
-	Type ValueType
-	Flag int
+	Name string    `json:"name"`
+	Hint string    `json:"hint,omitempty"`
+	Type ValueType `json:"type,omitempty"`
+	Flag int       `json:"flag,omitempty"`
+
+	// Values holds the values accepted by Enum arguments.
+	Values []string `json:"values,omitempty"`
+
+	// Short holds an optional single letter alias for options, so that
+	// "-p" may be used in place of "-project" when Short is "p".
+	Short string `json:"short,omitempty"`
+
+	// Default holds the value the argument takes when not provided.
+	Default string `json:"default,omitempty"`
 }
 
 const (
@@ -34,9 +50,12 @@ const (
 type ValueType string
 
 var (
-	String ValueType = "string"
-	Bool   ValueType = "bool"
-	Int    ValueType = "int"
+	String   ValueType = "string"
+	Bool     ValueType = "bool"
+	Int      ValueType = "int"
+	Float    ValueType = "float"
+	Duration ValueType = "duration"
+	Enum     ValueType = "enum"
 )
 
 func valueType(arg *Arg) ValueType {
@@ -56,11 +75,33 @@ func parseValue(t ValueType, s string) (interface{}, error) {
 	case Int:
 		s, err := strconv.Atoi(s)
 		return s, err
+	case Float:
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err
+	case Duration:
+		d, err := time.ParseDuration(s)
+		return d, err
 	}
 	panic("internal error: unknown value type: " + string(t))
 }
 
+// valueHint returns how the value of arg is presented to users.
+func valueHint(arg *Arg) string {
+	if valueType(arg) == Enum {
+		return strings.Join(arg.Values, "|")
+	}
+	return string(valueType(arg))
+}
+
 func parseArg(arg *Arg, s string) (interface{}, error) {
+	if valueType(arg) == Enum {
+		for _, value := range arg.Values {
+			if s == value {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid value for argument %s: %q (expected %s)", arg.Name, s, strings.Join(arg.Values, ", "))
+	}
 	value, err := parseValue(valueType(arg), s)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse value as %s: %q", valueType(arg), s)
@@ -112,17 +153,18 @@ func (c *Command) Parse(text string) (interface{}, error) {
 
 	var opts map[string]interface{}
 
+	// Options may be provided as "-name", "-name=value", or "-name value",
+	// also with two dashes as in "--name", or via their short alias.
+	// A lone "--" ends the options.
 	for p.peekByte('-') {
 		mark := p.i
 		p.skipArgRunes()
 		name := text[mark:p.i]
-		var arg *Arg
-		for i := range c.Args {
-			if c.Args[i].Name == name {
-				arg = &c.Args[i]
-				break
-			}
+		if name == "--" {
+			p.skipSpaces()
+			break
 		}
+		arg := c.option(name)
 		if arg == nil {
 			return nil, fmt.Errorf("unknown argument: %s", text[mark:p.i])
 		}
@@ -140,8 +182,15 @@ func (c *Command) Parse(text string) (interface{}, error) {
 			}
 		} else if arg.Type == "" || arg.Type == Bool {
 			value = true
+		} else if p.skipSpaces(); p.i < len(text) && !p.peekByte('-') {
+			mark := p.i
+			p.skipNonSpaces()
+			value, err = parseArg(arg, text[mark:p.i])
+			if err != nil {
+				return nil, err
+			}
 		} else {
-			return nil, fmt.Errorf("missing value for argument: %s=%s", arg.Name, arg.Type)
+			return nil, fmt.Errorf("missing value for argument: %s=%s", arg.Name, valueHint(arg))
 		}
 		opts[arg.Name[1:]] = value
 		p.skipSpaces()
@@ -151,7 +200,7 @@ func (c *Command) Parse(text string) (interface{}, error) {
 	for i := range c.Args {
 		arg := &c.Args[i]
 		if strings.HasPrefix(arg.Name, "-") {
-			if arg.Flag&Required != 0 && opts[arg.Name[1:]] == nil {
+			if arg.Flag&Required != 0 && arg.Default == "" && opts[arg.Name[1:]] == nil {
 				missing = append(missing, arg.Name)
 			}
 			continue
@@ -173,7 +222,7 @@ func (c *Command) Parse(text string) (interface{}, error) {
 			if err != nil {
 				return nil, err
 			}
-		} else if arg.Flag&Required != 0 {
+		} else if arg.Flag&Required != 0 && arg.Default == "" {
 			missing = append(missing, arg.Name)
 		}
 		p.skipSpaces()
@@ -183,12 +232,47 @@ func (c *Command) Parse(text string) (interface{}, error) {
 		return nil, fmt.Errorf("missing input for argument%s: %s", plural(len(missing), "", "s"), strings.Join(missing, ", "))
 	}
 
+	for i := range c.Args {
+		arg := &c.Args[i]
+		key := strings.TrimPrefix(arg.Name, "-")
+		if arg.Default == "" || opts[key] != nil {
+			continue
+		}
+		value, err := parseArg(arg, arg.Default)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default for argument %s: %v", arg.Name, err)
+		}
+		if len(opts) == 0 {
+			opts = make(map[string]interface{})
+		}
+		opts[key] = value
+	}
+
 	if p.i < len(text) {
 		return nil, fmt.Errorf("unexpected input: %s", text[p.i:])
 	}
 	return opts, nil
 }
 
+// option returns the option argument with the provided name, which may
+// be prefixed by one or two dashes, or by one dash for short aliases.
+func (c *Command) option(name string) *Arg {
+	long := name
+	if strings.HasPrefix(long, "--") {
+		long = long[1:]
+	}
+	for i := range c.Args {
+		arg := &c.Args[i]
+		if !strings.HasPrefix(arg.Name, "-") {
+			continue
+		}
+		if arg.Name == long || arg.Short != "" && name == "-"+arg.Short {
+			return arg
+		}
+	}
+	return nil
+}
+
 func plural(n int, singular, plural string) string {
 	if n > 1 {
 		return plural
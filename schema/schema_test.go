@@ -3,6 +3,7 @@ package schema_test
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"gopkg.in/mup.v0/schema"
 
@@ -96,6 +97,41 @@ var commands = schema.Commands{{
 	}, {
 		Name: "árg1",
 	}},
+}, {
+	Name: "cmd8",
+	Help: help("cmd8"),
+	Args: schema.Args{{
+		Name:    "-project",
+		Type:    schema.String,
+		Short:   "p",
+		Default: "mup",
+	}, {
+		Name:  "-verbose",
+		Type:  schema.Bool,
+		Short: "v",
+	}, {
+		Name:    "count",
+		Type:    schema.Int,
+		Flag:    schema.Required,
+		Default: "10",
+	}, {
+		Name: "text",
+		Flag: schema.Trailing,
+	}},
+}, {
+	Name: "cmd7",
+	Help: help("cmd7"),
+	Args: schema.Args{{
+		Name:   "-mode",
+		Type:   schema.Enum,
+		Values: []string{"fast", "slow"},
+	}, {
+		Name: "-wait",
+		Type: schema.Duration,
+	}, {
+		Name: "ratio",
+		Type: schema.Float,
+	}},
 }}
 
 func help(name string) string {
@@ -200,6 +236,55 @@ var parseTests = []struct {
 		opts: map[string]interface{}{"boolB": true},
 	},
 
+	// Float, duration, and enum types.
+	{
+		text: "cmd7 -mode=slow -wait=1m30s 0.5",
+		opts: map[string]interface{}{
+			"mode":  "slow",
+			"wait":  90 * time.Second,
+			"ratio": 0.5,
+		},
+	}, {
+		text:  "cmd7 -mode=medium",
+		error: `invalid value for argument -mode: "medium" \(expected fast, slow\)`,
+	}, {
+		text:  "cmd7 -mode",
+		error: `missing value for argument: -mode=fast\|slow`,
+	}, {
+		text:  "cmd7 -wait=soon",
+		error: `cannot parse value as duration: "soon"`,
+	}, {
+		text:  "cmd7 half",
+		error: `cannot parse value as float: "half"`,
+	},
+
+	// GNU-style options, short aliases, and defaults.
+	{
+		text: "cmd8",
+		opts: map[string]interface{}{"project": "mup", "count": 10},
+	}, {
+		text: "cmd8 --project foo 123",
+		opts: map[string]interface{}{"project": "foo", "count": 123},
+	}, {
+		text: "cmd8 --project=foo -v 123 some text",
+		opts: map[string]interface{}{"project": "foo", "verbose": true, "count": 123, "text": "some text"},
+	}, {
+		text: "cmd8 -p foo --verbose",
+		opts: map[string]interface{}{"project": "foo", "verbose": true, "count": 10},
+	}, {
+		text: "cmd8 -- 5 -v",
+		opts: map[string]interface{}{"project": "mup", "count": 5, "text": "-v"},
+	}, {
+		text:  "cmd8 -p",
+		error: "missing value for argument: -project=string",
+	}, {
+		text:  "cmd8 -p -v",
+		error: "missing value for argument: -project=string",
+	}, {
+		text:  "cmd8 -x",
+		error: "unknown argument: -x",
+	},
+
 	// UTF-8 handling.
 	{
 		text: "çmd6 -árg0=vál0 vál1",
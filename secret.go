@@ -0,0 +1,149 @@
+package mup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// secretPrefix marks values in the database that were encrypted with
+// the secret key. Values without it are taken as plaintext, so secrets
+// may be encrypted at any time via RotateSecretKey.
+const secretPrefix = "enc:v1:"
+
+// SecretKeySize is the size in bytes of the keys used to encrypt secrets.
+const SecretKeySize = 32
+
+// secretColumns lists the database columns that may hold secrets,
+// as table and column names.
+var secretColumns = [][2]string{
+	{"account", "password"},
+	{"account", "config"},
+	{"ldap", "bindpass"},
+	{"plugin", "config"},
+}
+
+// ParseSecretKey parses a secret key encoded in hexadecimal or base64.
+func ParseSecretKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(key) != SecretKeySize {
+		return nil, fmt.Errorf("secret key must have %d bytes encoded in hexadecimal or base64", SecretKeySize)
+	}
+	return key, nil
+}
+
+func secretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret returns text encrypted with key, or text itself if key is nil.
+func encryptSecret(key []byte, text string) (string, error) {
+	if key == nil || text == "" {
+		return text, nil
+	}
+	aead, err := secretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("cannot encrypt secret: %v", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret returns text decrypted with key. Plaintext values are
+// returned unchanged.
+func decryptSecret(key []byte, text string) (string, error) {
+	if !strings.HasPrefix(text, secretPrefix) {
+		return text, nil
+	}
+	if key == nil {
+		return "", fmt.Errorf("cannot decrypt secret: no secret key configured")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(text[len(secretPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret: %v", err)
+	}
+	aead, err := secretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("cannot decrypt secret: value too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret: wrong key or corrupted value")
+	}
+	return string(plain), nil
+}
+
+// RotateSecretKey re-encrypts all secrets in the database so that they're
+// encrypted with newKey rather than oldKey. Secrets still held in plaintext
+// are encrypted as well, and a nil newKey stores all secrets in plaintext.
+// Either all secrets are rotated or none are.
+func RotateSecretKey(db *sql.DB, oldKey, newKey []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot begin database transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, tc := range secretColumns {
+		table, column := tc[0], tc[1]
+		rows, err := tx.Query("SELECT rowid," + column + " FROM " + table)
+		if err != nil {
+			return fmt.Errorf("cannot query %s secrets: %v", table, err)
+		}
+		var rowids []int64
+		var values []string
+		for rows.Next() {
+			var rowid int64
+			var value string
+			if err := rows.Scan(&rowid, &value); err != nil {
+				rows.Close()
+				return fmt.Errorf("cannot query %s secrets: %v", table, err)
+			}
+			rowids = append(rowids, rowid)
+			values = append(values, value)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("cannot query %s secrets: %v", table, err)
+		}
+		for i, value := range values {
+			plain, err := decryptSecret(oldKey, value)
+			if err != nil {
+				return fmt.Errorf("%s %s of row %d: %v", table, column, rowids[i], err)
+			}
+			sealed, err := encryptSecret(newKey, plain)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("UPDATE "+table+" SET "+column+"=? WHERE rowid=?", sealed, rowids[i])
+			if err != nil {
+				return fmt.Errorf("cannot update %s secrets: %v", table, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit secrets: %v", err)
+	}
+	return nil
+}
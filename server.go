@@ -2,6 +2,8 @@ package mup
 
 import (
 	"database/sql"
+	"fmt"
+	"os"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -27,6 +29,94 @@ type Config struct {
 	// this server is responsible for. Defaults to all if nil. Set to
 	// an empty list for handling no plugins in this server.
 	Plugins []string
+
+	// HandlerTimeout defines how long a plugin may take to handle a
+	// single message before it's considered hung, in which case it is
+	// marked as unhealthy and restarted. Defaults to one minute.
+	// Set to -1 to disable.
+	HandlerTimeout time.Duration
+
+	// StopTimeout defines how long Stop waits for plugins to handle
+	// the incoming messages queued so far, and for accounts to deliver
+	// the pending outgoing messages, before terminating them. Stop does
+	// not wait at all if StopTimeout is zero.
+	StopTimeout time.Duration
+
+	// HTTPAddr defines the address the embedded HTTP server listens
+	// on, serving the server status at /healthz, the metrics reported
+	// by plugins at /metrics, the command schemas at /commands, the
+	// events recorded by plugins at /events, and the message content
+	// at /stream when StreamToken is set.
+	// The HTTP server is disabled if HTTPAddr is empty.
+	HTTPAddr string
+
+	// StreamToken defines the bearer token that clients must provide in
+	// the Authorization header to stream messages from /stream, as in
+	// "Authorization: Bearer <token>". Streams expose the content of all
+	// messages, including private ones, so they are disabled while
+	// StreamToken is empty.
+	StreamToken string
+
+	// HTTPURL defines the public URL at which the embedded HTTP server
+	// is reachable, used to build links to content it serves, such as
+	// long outputs pasted by plugins via Plugger.SendLong.
+	HTTPURL string
+
+	// HTTPClient defines the settings of the HTTP clients offered to
+	// plugins via Plugger.HTTPClient for performing outbound requests.
+	HTTPClient HTTPClientConfig
+
+	// LeaseTimeout enables coordination between servers configured to
+	// handle the same accounts. When it is non-zero, each account is only
+	// handled by the server holding its lease in the database. Leases are
+	// renewed on every refresh and expire after LeaseTimeout, at which
+	// point another server takes over the account. LeaseTimeout must thus
+	// be comfortably longer than Refresh. Leases are released when the
+	// server is stopped.
+	LeaseTimeout time.Duration
+
+	// Instance identifies this server in account leases. It must be
+	// unique among all servers sharing the database. Defaults to the
+	// host name and process id.
+	Instance string
+
+	// Sharding enables spreading the accounts and plugins this server
+	// is responsible for, as defined by Accounts and Plugins, across all
+	// servers with sharding enabled that share the database. Each one
+	// is assigned to a server whose Accounts or Plugins setting includes
+	// it. Servers register themselves on every refresh, and the accounts
+	// and plugins of servers that stop refreshing for LeaseTimeout are
+	// reassigned to the remaining ones. Sharding requires LeaseTimeout
+	// to be set.
+	Sharding bool
+
+	// Retention defines how long incoming and outgoing messages are
+	// kept in the message table, and events in the event table. Older
+	// ones are regularly removed. Both are kept forever if Retention
+	// is zero.
+	Retention time.Duration
+
+	// BackupDir enables automatic backups of the database, written
+	// into the directory every BackupInterval via BackupDB. Backups
+	// are named after the time they were taken, as in
+	// mup-20240131-150405.db. Only one of the servers sharing the
+	// database needs to take backups.
+	BackupDir string
+
+	// BackupInterval defines how often automatic backups are taken.
+	// Defaults to daily.
+	BackupInterval time.Duration
+
+	// BackupKeep defines how many automatic backups are kept in
+	// BackupDir, with older ones being removed. All backups are kept
+	// if BackupKeep is zero.
+	BackupKeep int
+
+	// SecretKey defines the key used to decrypt account passwords, LDAP
+	// bind passwords, and account and plugin configurations that were
+	// encrypted in the database via RotateSecretKey. Values stored in
+	// plaintext are used as they are.
+	SecretKey []byte
 }
 
 // A Server handles some or all of the duties of a mup instance.
@@ -46,8 +136,14 @@ type Config struct {
 // same MongoDB server and database.
 //
 type Server struct {
+	config         Config
 	accountManager *accountManager
 	pluginManager  *pluginManager
+	httpServer     *httpServer
+	pruneStop      chan struct{}
+	pruneDone      chan struct{}
+	backupStop     chan struct{}
+	backupDone     chan struct{}
 }
 
 // Start starts a mup server that handles some or all of the duties
@@ -60,28 +156,115 @@ func Start(config *Config) (*Server, error) {
 	if configCopy.Refresh == 0 {
 		configCopy.Refresh = 3 * time.Second
 	}
+	if configCopy.HandlerTimeout == 0 {
+		configCopy.HandlerTimeout = time.Minute
+	}
+	if configCopy.BackupInterval == 0 {
+		configCopy.BackupInterval = 24 * time.Hour
+	}
+	if configCopy.Sharding && configCopy.LeaseTimeout <= 0 {
+		return nil, fmt.Errorf("sharding requires a lease timeout")
+	}
+	if configCopy.Instance == "" {
+		hostname, _ := os.Hostname()
+		configCopy.Instance = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	st.config = configCopy
 	st.accountManager, err = startAccountManager(configCopy)
 	if err != nil {
 		return nil, err
 	}
-	st.pluginManager, err = startPluginManager(configCopy)
+	st.pluginManager, err = startPluginManager(configCopy, st.accountManager.Status)
 	if err != nil {
 		st.accountManager.Stop()
 		return nil, err
 	}
+	if configCopy.HTTPAddr != "" {
+		st.httpServer = startHTTPServer(configCopy.HTTPAddr, &st)
+	}
+	if configCopy.Retention > 0 {
+		st.pruneStop = make(chan struct{})
+		st.pruneDone = make(chan struct{})
+		go st.pruneLoop()
+	}
+	if configCopy.BackupDir != "" {
+		st.backupStop = make(chan struct{})
+		st.backupDone = make(chan struct{})
+		go st.backupLoop()
+	}
 	return &st, nil
 }
 
+// drainDelay defines how often Stop checks whether queued messages were
+// handled while draining. See Config.StopTimeout.
+const drainDelay = 50 * time.Millisecond
+
 // Stop synchronously terminates all activities of the mup server.
+//
+// If the server was configured with a StopTimeout, plugins are first
+// given a chance to handle the incoming messages queued so far, and
+// accounts to deliver the replies, before they are terminated.
 func (st *Server) Stop() error {
+	if st.httpServer != nil {
+		st.httpServer.Stop()
+	}
+	if st.pruneStop != nil {
+		close(st.pruneStop)
+		<-st.pruneDone
+	}
+	if st.backupStop != nil {
+		close(st.backupStop)
+		<-st.backupDone
+	}
+	var deadline time.Time
+	if st.config.StopTimeout > 0 {
+		deadline = time.Now().Add(st.config.StopTimeout)
+		st.pluginManager.drain(deadline)
+	}
 	err1 := st.pluginManager.Stop()
+	if st.config.StopTimeout > 0 {
+		st.accountManager.drain(deadline)
+	}
 	err2 := st.accountManager.Stop()
+	if st.config.Sharding {
+		unregisterInstance(st.config.DB, st.config.Instance)
+	}
 	if err2 != nil {
 		return err2
 	}
 	return err1
 }
 
+// pruneDelay defines how often messages older than the configured
+// retention are removed from the database.
+var pruneDelay = time.Hour
+
+func (st *Server) pruneLoop() {
+	defer close(st.pruneDone)
+	for {
+		st.prune()
+		select {
+		case <-time.After(pruneDelay):
+		case <-st.pruneStop:
+			return
+		}
+	}
+}
+
+// prune removes the messages and events older than the configured retention.
+func (st *Server) prune() {
+	for _, table := range []string{"message", "event"} {
+		result, err := st.config.DB.Exec("DELETE FROM "+table+" WHERE time<?", time.Now().Add(-st.config.Retention))
+		if err != nil {
+			logf("Cannot remove old %ss: %v", table, err)
+			continue
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			debugf("Removed %d %ss older than %v.", n, table, st.config.Retention)
+		}
+	}
+}
+
 // RefreshAccounts reloads from the database all information about
 // the IRC accounts this server is responsible for, and acts on any
 // changes (joins/departs channels, changes nicks, etc).
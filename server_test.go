@@ -1,14 +1,22 @@
 package mup_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"database/sql"
+	"golang.org/x/net/websocket"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mup.v0"
 	"gopkg.in/mup.v0/ldap"
+	_ "gopkg.in/mup.v0/plugins/bridge"
 	_ "gopkg.in/mup.v0/plugins/help"
 	"gopkg.in/mup.v0/schema"
 	"sync"
@@ -94,6 +102,7 @@ func (s *ServerSuite) RestartServer(c *C) {
 }
 
 func (s *ServerSuite) ReadUser(c *C) {
+	s.ReadLine(c, "CAP LS 302")
 	s.ReadLine(c, "PASS password")
 	s.ReadLine(c, "NICK mup")
 	s.ReadLine(c, "USER mup 0 0 :Mup Pet")
@@ -205,6 +214,27 @@ func (s *ServerSuite) TestIdentifyNickInUse(c *C) {
 	s.Roundtrip(c)
 }
 
+func (s *ServerSuite) TestNickRegain(c *C) {
+	s.StopServer(c)
+
+	_, err := s.db.Exec(`UPDATE account SET identity='nickpass', config='{"regain": "regain", "nickdelay": "1h"}' WHERE name='one'`)
+	c.Assert(err, IsNil)
+
+	s.RestartServer(c)
+
+	s.SendLine(c, ":n.net 433 * mup :Nickname is already in use.")
+	s.ReadLine(c, "NICK mup_")
+	s.SendLine(c, ":n.net 001 mup_ :Welcome!")
+
+	s.ReadLine(c, "PRIVMSG nickserv :IDENTIFY mup nickpass")
+	s.ReadLine(c, "PRIVMSG nickserv :REGAIN mup nickpass")
+	s.Roundtrip(c)
+
+	// The next attempt only happens after the configured delay.
+	s.server.RefreshAccounts()
+	s.Roundtrip(c)
+}
+
 func (s *ServerSuite) TestPingPong(c *C) {
 	s.SendLine(c, "PING :foo")
 	s.ReadLine(c, "PONG :foo")
@@ -289,6 +319,524 @@ func (s *ServerSuite) TestJoinChannel(c *C) {
 	s.ReadLine(c, "JOIN #c5")
 }
 
+func (s *ServerSuite) TestJoinGating(c *C) {
+	defer mup.SetJoinTimeout(time.Second)()
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		"INSERT INTO channel (account,name) VALUES ('one','#c1')",
+		"INSERT INTO channel (account,name) VALUES ('one','#c2')",
+		"INSERT INTO channel (account,name) VALUES ('one','#c3')",
+	)
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN #c1,#c2,#c3")
+
+	// Messages to channels still being joined are held, others are not.
+	execSQL(c, s.db,
+		"INSERT INTO message (lane,account,channel,text) VALUES (2,'one','#c1','One.')",
+		"INSERT INTO message (lane,account,channel,text) VALUES (2,'one','#c2','Two.')",
+		"INSERT INTO message (lane,account,channel,text) VALUES (2,'one','#c3','Three.')",
+		"INSERT INTO message (lane,account,nick,text) VALUES (2,'one','someone','Direct.')",
+	)
+	s.ReadLine(c, "PRIVMSG someone :Direct.")
+
+	// Held messages are not taken as sent while later ones are.
+	msgId := func(text string) int64 {
+		var id int64
+		err := s.db.QueryRow("SELECT id FROM message WHERE lane=2 AND text=?", text).Scan(&id)
+		c.Assert(err, IsNil)
+		return id
+	}
+	checkLastId := func(want int64) {
+		var lastId int64
+		waitFor(func() bool {
+			err := s.db.QueryRow("SELECT lastid FROM account WHERE name='one'").Scan(&lastId)
+			c.Assert(err, IsNil)
+			return lastId == want
+		})
+		c.Assert(lastId, Equals, want)
+	}
+	s.Roundtrip(c)
+	checkLastId(msgId("One.") - 1)
+
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #C1")
+	s.ReadLine(c, "PRIVMSG #c1 :One.")
+	s.Roundtrip(c)
+	checkLastId(msgId("Two.") - 1)
+
+	s.SendLine(c, ":n.net 474 mup #c2 :Cannot join channel (+b)")
+	s.Roundtrip(c)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Cannot join channel "#c2": Cannot join channel \(\+b\). Dropping 1 held messages.*`)
+	checkLastId(msgId("Three.") - 1)
+
+	// Unconfirmed joins time out and the held messages are sent anyway.
+	s.ReadLine(c, "PRIVMSG #c3 :Three.")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Server did not confirm joining channel "#c3". Sending 1 held messages anyway.*`)
+	s.Roundtrip(c)
+	checkLastId(msgId("Direct."))
+}
+
+func (s *ServerSuite) TestISupport(c *C) {
+	s.SendWelcome(c)
+	s.SendLine(c, ":n.net 005 mup NETWORK=Net NICKLEN=5 CHANTYPES=#+ :are supported by this server")
+	s.SendLine(c, ":n.net 005 mup PREFIX=(ov)@+ LINELEN=300 TOPICLEN=x :are supported by this server")
+	s.Roundtrip(c)
+
+	execSQL(c, s.db,
+		"INSERT INTO channel (account,name) VALUES ('one','#c1')",
+		"INSERT INTO channel (account,name) VALUES ('one','+c2')",
+		"INSERT INTO channel (account,name) VALUES ('one','&c3')",
+		"UPDATE account SET nick='longnick' WHERE name='one'",
+	)
+	s.server.RefreshAccounts()
+	s.ReadLine(c, "JOIN #c1,+c2")
+	s.ReadLine(c, "NICK longn")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Server does not support channel name "&c3". Not joining it.*`)
+
+	status := s.server.Status()
+	c.Assert(status.Accounts, HasLen, 1)
+	c.Assert(status.Accounts[0].Support, DeepEquals, &mup.ServerSupport{
+		Network:       "Net",
+		NickLen:       5,
+		LineLen:       300,
+		ChanTypes:     "#+",
+		PrefixModes:   "ov",
+		PrefixSymbols: "@+",
+	})
+
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN +c2")
+	text := strings.Repeat("word ", 40) + "end"
+	execSQL(c, s.db, "INSERT INTO message (lane,account,channel,text) VALUES (2,'one','+c2','"+text+"')")
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG +c2 :"+strings.Repeat("word ", 36)+"word")
+	s.ReadLine(c, "PRIVMSG +c2 :word word word end")
+}
+
+func (s *ServerSuite) TestPriority(c *C) {
+	s.SendWelcome(c)
+
+	// A single statement so that the tail sees all messages at once.
+	execSQL(c, s.db, "INSERT INTO message (lane,account,nick,text,priority) VALUES "+
+		"(2,'one','someone','Low 1.',-1),(2,'one','someone','Low 2.',-1),"+
+		"(2,'one','someone','Normal.',0),(2,'one','someone','High.',1)")
+	s.ReadLine(c, "PRIVMSG someone :High.")
+	s.ReadLine(c, "PRIVMSG someone :Normal.")
+	s.ReadLine(c, "PRIVMSG someone :Low 1.")
+	s.ReadLine(c, "PRIVMSG someone :Low 2.")
+
+	// Lower priority messages are not starved by a burst of higher ones.
+	execSQL(c, s.db, "INSERT INTO message (lane,account,nick,text,priority) VALUES "+
+		"(2,'one','someone','Low.',-1),(2,'one','someone','High 1.',1),(2,'one','someone','High 2.',1),"+
+		"(2,'one','someone','High 3.',1),(2,'one','someone','High 4.',1),(2,'one','someone','High 5.',1)")
+	s.ReadLine(c, "PRIVMSG someone :High 1.")
+	s.ReadLine(c, "PRIVMSG someone :High 2.")
+	s.ReadLine(c, "PRIVMSG someone :High 3.")
+	s.ReadLine(c, "PRIVMSG someone :High 4.")
+	s.ReadLine(c, "PRIVMSG someone :Low.")
+	s.ReadLine(c, "PRIVMSG someone :High 5.")
+}
+
+func (s *ServerSuite) TestLeases(c *C) {
+	s.StopServer(c)
+
+	_, err := s.db.Exec("INSERT INTO lease (account,holder,expires) VALUES ('one','other',?)", time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+
+	s.config.LeaseTimeout = time.Minute
+	s.config.Instance = "this"
+	s.server, err = mup.Start(s.config)
+	c.Assert(err, IsNil)
+
+	// The account is leased by another server.
+	s.server.RefreshAccounts()
+	c.Assert(s.server.Status().Accounts, HasLen, 0)
+
+	// Once the lease expires, this server takes over.
+	_, err = s.db.Exec("UPDATE lease SET expires=? WHERE account='one'", time.Now().Add(-time.Second))
+	c.Assert(err, IsNil)
+	n := s.NextLineServer()
+	s.server.RefreshAccounts()
+	s.lserver = s.LineServer(n)
+	s.ReadUser(c)
+
+	var holder string
+	var expires time.Time
+	err = s.db.QueryRow("SELECT holder,expires FROM lease WHERE account='one'").Scan(&holder, &expires)
+	c.Assert(err, IsNil)
+	c.Assert(holder, Equals, "this")
+	c.Assert(expires.After(time.Now().Add(50*time.Second)), Equals, true)
+
+	// Expiry times are stored in UTC, as done for instances.
+	var stored string
+	err = s.db.QueryRow("SELECT CAST(expires AS TEXT) FROM lease WHERE account='one'").Scan(&stored)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasSuffix(stored, "+00:00"), Equals, true, Commentf("Stored expiry: %s", stored))
+
+	// Leases are released when the server stops.
+	s.StopServer(c)
+	var count int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM lease").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 0)
+}
+
+func (s *ServerSuite) TestSharding(c *C) {
+	s.StopServer(c)
+
+	// Pick another instance name that is assigned the account.
+	other := "other"
+	for i := 0; mup.ShardOwner("one", []string{other, "this"}) != other; i++ {
+		other = fmt.Sprintf("other%d", i)
+	}
+	_, err := s.db.Exec("INSERT INTO instance (name,role,expires) VALUES (?,'account',?)", other, time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+
+	s.config.LeaseTimeout = time.Minute
+	s.config.Instance = "this"
+	s.config.Sharding = true
+	s.server, err = mup.Start(s.config)
+	c.Assert(err, IsNil)
+
+	s.server.RefreshAccounts()
+	c.Assert(s.server.Status().Accounts, HasLen, 0)
+
+	// Once the other instance dies, its accounts are reassigned.
+	_, err = s.db.Exec("UPDATE instance SET expires=? WHERE name=?", time.Now().Add(-time.Second), other)
+	c.Assert(err, IsNil)
+	n := s.NextLineServer()
+	s.server.RefreshAccounts()
+	s.lserver = s.LineServer(n)
+	s.ReadUser(c)
+
+	// The instance is unregistered when the server stops.
+	s.StopServer(c)
+	var names []string
+	rows, err := s.db.Query("SELECT name FROM instance ORDER BY name")
+	c.Assert(err, IsNil)
+	for rows.Next() {
+		var name string
+		c.Assert(rows.Scan(&name), IsNil)
+		names = append(names, name)
+	}
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(names, DeepEquals, []string{other})
+}
+
+func (s *ServerSuite) TestShardingRoles(c *C) {
+	s.StopServer(c)
+
+	// Pick another instance name that would be assigned the account
+	// if it handled accounts at all.
+	other := "other"
+	for i := 0; mup.ShardOwner("one", []string{other, "this"}) != other; i++ {
+		other = fmt.Sprintf("other%d", i)
+	}
+
+	config := *s.config
+	config.LeaseTimeout = time.Minute
+	config.Sharding = true
+	config.Instance = other
+	config.Accounts = []string{}
+	otherServer, err := mup.Start(&config)
+	c.Assert(err, IsNil)
+	defer otherServer.Stop()
+
+	// An instance that handles only some accounts is not assigned
+	// the others either.
+	_, err = s.db.Exec("INSERT INTO instance (name,role,filter,expires) VALUES ('picky','account','two',?)", time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+
+	s.config.LeaseTimeout = time.Minute
+	s.config.Sharding = true
+	s.config.Instance = "this"
+	s.config.Plugins = []string{}
+	s.RestartServer(c)
+
+	c.Assert(s.server.Status().Accounts, HasLen, 1)
+
+	type registration struct{ name, role string }
+	var regs []registration
+	rows, err := s.db.Query("SELECT name,role FROM instance ORDER BY name,role")
+	c.Assert(err, IsNil)
+	for rows.Next() {
+		var reg registration
+		c.Assert(rows.Scan(&reg.name, &reg.role), IsNil)
+		regs = append(regs, reg)
+	}
+	c.Assert(rows.Close(), IsNil)
+	c.Assert(regs, DeepEquals, []registration{{other, "plugin"}, {"picky", "account"}, {"this", "account"}})
+}
+
+func (s *ServerSuite) TestShardOwner(c *C) {
+	instances := []string{"a", "b", "c"}
+	counts := make(map[string]int)
+	moved := 0
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("name%d", i)
+		owner := mup.ShardOwner(name, instances)
+		counts[owner]++
+		// Removing an instance only moves the names assigned to it.
+		if newOwner := mup.ShardOwner(name, []string{"a", "c"}); newOwner != owner {
+			c.Assert(owner, Equals, "b")
+			moved++
+		}
+	}
+	c.Assert(moved, Equals, counts["b"])
+	for _, instance := range instances {
+		c.Assert(counts[instance] > 50, Equals, true, Commentf("counts: %v", counts))
+	}
+}
+
+func (s *ServerSuite) TestRetention(c *C) {
+	s.StopServer(c)
+
+	_, err := s.db.Exec("INSERT INTO message (lane,time,account,nick,text) VALUES (1,?,'one','nick','Old.'),(1,?,'one','nick','New.')",
+		time.Now().Add(-3*time.Hour), time.Now().Add(-time.Hour))
+	c.Assert(err, IsNil)
+
+	s.config.Retention = 2 * time.Hour
+	s.RestartServer(c)
+
+	var texts []string
+	waitFor(func() bool {
+		texts = nil
+		rows, err := s.db.Query("SELECT text FROM message ORDER BY id")
+		c.Assert(err, IsNil)
+		for rows.Next() {
+			var text string
+			c.Assert(rows.Scan(&text), IsNil)
+			texts = append(texts, text)
+		}
+		c.Assert(rows.Close(), IsNil)
+		return len(texts) == 1
+	})
+	c.Assert(texts, DeepEquals, []string{"New."})
+}
+
+func (s *ServerSuite) TestAutomaticBackup(c *C) {
+	s.StopServer(c)
+
+	dir := c.MkDir()
+	for _, name := range []string{"mup-20200101-000000.db", "mup-20200102-000000.db", "other.db"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), nil, 0600), IsNil)
+	}
+
+	s.config.BackupDir = dir
+	s.config.BackupKeep = 2
+	defer func() {
+		s.config.BackupDir = ""
+		s.config.BackupKeep = 0
+	}()
+	s.RestartServer(c)
+
+	var names []string
+	waitFor(func() bool {
+		infos, err := ioutil.ReadDir(dir)
+		c.Assert(err, IsNil)
+		names = nil
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return len(names) == 3 && names[0] == "mup-20200102-000000.db"
+	})
+	c.Assert(names[1], Matches, `mup-\d{8}-\d{6}\.db`)
+	c.Assert(names[2], Equals, "other.db")
+
+	backup, err := sql.Open("sqlite3", filepath.Join(dir, names[1]))
+	c.Assert(err, IsNil)
+	defer backup.Close()
+	var n int
+	c.Assert(backup.QueryRow("SELECT COUNT(*) FROM account WHERE name='one'").Scan(&n), IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *ServerSuite) TestStatus(c *C) {
+	s.StopServer(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('echoA')`,
+		`INSERT INTO plugin (name) VALUES ('unknown')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+	)
+	s.config.HTTPAddr = "localhost:10647"
+	defer func() { s.config.HTTPAddr = "" }()
+
+	s.RestartServer(c)
+
+	waitFor(func() bool { return len(s.server.Status().Accounts) == 1 })
+	status := s.server.Status()
+	c.Assert(status.Accounts, DeepEquals, []mup.AccountStatus{{Name: "one", ConfigNick: "mup"}})
+	c.Assert(status.Healthy(), Equals, false)
+
+	s.SendWelcome(c)
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c1")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN :#C2")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #c3")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 PART #c3")
+	s.SendLine(c, ":other!~other@10.0.0.2 JOIN #c4")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A1")
+
+	status = s.server.Status()
+	c.Assert(status.Accounts, HasLen, 1)
+	account := status.Accounts[0]
+	c.Assert(account.LastMessage.After(time.Now().Add(-5*time.Second)), Equals, true)
+	account.LastMessage = time.Time{}
+	c.Assert(account, DeepEquals, mup.AccountStatus{
+		Name:       "one",
+		Connected:  true,
+		Nick:       "mup",
+		ConfigNick: "mup",
+		Channels:   []string{"#c1", "#c2"},
+	})
+	c.Assert(status.Plugins, HasLen, 2)
+	c.Assert(status.Plugins[0].Name, Equals, "echoA")
+	c.Assert(status.Plugins[0].Running, Equals, true)
+	c.Assert(status.Plugins[0].LastId > 0, Equals, true)
+	c.Assert(status.Plugins[1], DeepEquals, mup.PluginStatus{
+		Name:      "unknown",
+		LastError: `plugin "unknown" not registered`,
+	})
+	c.Assert(status.Healthy(), Equals, false)
+
+	resp, err := http.Get("http://localhost:10647/healthz")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	var doc struct {
+		Accounts []struct{ Name string }
+		Plugins  []struct{ Name string }
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&doc), IsNil)
+	c.Assert(doc.Accounts, HasLen, 1)
+	c.Assert(doc.Plugins, HasLen, 2)
+
+	execSQL(c, s.db, `DELETE FROM plugin WHERE name='unknown'`)
+	s.server.RefreshPlugins()
+	c.Assert(s.server.Status().Healthy(), Equals, true)
+
+	resp, err = http.Get("http://localhost:10647/healthz")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ServerSuite) TestCommands(c *C) {
+	s.config.HTTPAddr = "localhost:10647"
+	defer func() { s.config.HTTPAddr = "" }()
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('echoA')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+	)
+	s.server.RefreshPlugins()
+
+	resp, err := http.Get("http://localhost:10647/commands")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/json")
+
+	var schemas []mup.PluginSchema
+	c.Assert(json.NewDecoder(resp.Body).Decode(&schemas), IsNil)
+	var found bool
+	for _, ps := range schemas {
+		if ps.Plugin == "echoA" {
+			found = true
+			c.Assert(ps.Commands, DeepEquals, schema.Commands{{
+				Name: "echoAcmd",
+				Args: schema.Args{{Name: "text", Flag: schema.Trailing | schema.Required}},
+			}})
+		}
+	}
+	c.Assert(found, Equals, true)
+}
+
+func streamDial(url, origin, token string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		config.Header.Set("Authorization", "Bearer "+token)
+	}
+	return websocket.DialConfig(config)
+}
+
+func streamGet(c *C, url, token string) int {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	// Connections must not outlive the server being restarted.
+	req.Close = true
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (s *ServerSuite) TestStream(c *C) {
+	s.config.HTTPAddr = "localhost:10647"
+	defer func() { s.config.HTTPAddr = "" }()
+	s.RestartServer(c)
+
+	// Streams are disabled without a token.
+	c.Assert(streamGet(c, "http://localhost:10647/stream", ""), Equals, http.StatusNotFound)
+
+	s.config.StreamToken = "s3cr3t"
+	defer func() { s.config.StreamToken = "" }()
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	c.Assert(streamGet(c, "http://localhost:10647/stream", ""), Equals, http.StatusUnauthorized)
+	c.Assert(streamGet(c, "http://localhost:10647/stream", "wrong"), Equals, http.StatusUnauthorized)
+	c.Assert(streamGet(c, "http://localhost:10647/stream?direction=sideways", "s3cr3t"), Equals, http.StatusBadRequest)
+
+	_, err := streamDial("ws://localhost:10647/stream", "http://localhost:10647/", "")
+	c.Assert(err, NotNil)
+
+	ws, err := streamDial("ws://localhost:10647/stream?account=one&channel=%23chan", "http://localhost:10647/", "s3cr3t")
+	c.Assert(err, IsNil)
+	defer ws.Close()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #other :Ignored.")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: Hello.")
+	execSQL(c, s.db, "INSERT INTO message (lane,account,channel,text) VALUES (2,'one','#chan','Hello back.')")
+	s.ReadLine(c, "PRIVMSG #chan :Hello back.")
+
+	type streamMessage struct {
+		Direction, Account, Channel, Nick, Command, Text, BotText string
+	}
+	var msgs []streamMessage
+	for i := 0; i < 2; i++ {
+		var msg streamMessage
+		ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+		c.Assert(websocket.JSON.Receive(ws, &msg), IsNil)
+		msgs = append(msgs, msg)
+	}
+	c.Assert(msgs, DeepEquals, []streamMessage{{
+		Direction: "incoming",
+		Account:   "one",
+		Channel:   "#chan",
+		Nick:      "nick",
+		Command:   "PRIVMSG",
+		Text:      "mup: Hello.",
+		BotText:   "Hello.",
+	}, {
+		Direction: "outgoing",
+		Account:   "one",
+		Channel:   "#chan",
+		Command:   "PRIVMSG",
+		Text:      "Hello back.",
+	}})
+
+	_, err = streamDial("ws://localhost:10647/stream", "http://example.com/", "s3cr3t")
+	c.Assert(err, NotNil)
+}
+
 func waitFor(condition func() bool) {
 	now := time.Now()
 	end := now.Add(1 * time.Second)
@@ -342,47 +890,149 @@ func (s *ServerSuite) TestIncoming(c *C) {
 	})
 }
 
-func execSQL(c *C, db *sql.DB, stmts ...string) {
-	tx, err := db.Begin()
-	c.Assert(err, IsNil)
-	defer tx.Rollback()
-	for _, stmt := range stmts {
-		_, err := tx.Exec(stmt)
-		c.Assert(err, IsNil)
-	}
-	tx.Commit()
+func (s *ServerSuite) TestCapabilities(c *C) {
+	s.SendLine(c, ":n.net CAP * LS * :multi-prefix server-time")
+	s.SendLine(c, ":n.net CAP * LS :sasl=PLAIN account-tag")
+	s.ReadLine(c, "CAP REQ :server-time account-tag")
+	s.SendLine(c, ":n.net CAP * ACK :server-time account-tag")
+	s.ReadLine(c, "CAP END")
+	s.SendWelcome(c)
+
+	s.SendLine(c, "@time=2024-01-31T15:04:05.000Z;account=joe :nick!~user@host PRIVMSG mup :Hello mup!")
+	s.Roundtrip(c)
+	time.Sleep(100 * time.Millisecond)
+
+	var msg mup.Message
+	row := s.db.QueryRow("SELECT time,text,tags FROM message WHERE lane=1 AND command='PRIVMSG'")
+	c.Assert(row.Scan(&msg.Time, &msg.Text, &msg.Tags), IsNil)
+	c.Assert(msg.Time.Equal(time.Date(2024, 1, 31, 15, 4, 5, 0, time.UTC)), Equals, true)
+	c.Assert(msg.Text, Equals, "Hello mup!")
+	c.Assert(msg.Tags, DeepEquals, mup.Tags{"time": "2024-01-31T15:04:05.000Z", "account": "joe"})
 }
 
-func (s *ServerSuite) TestOutgoing(c *C) {
-	// Stop default server to test the behavior of outgoing messages on start up.
-	s.StopServer(c)
+func (s *ServerSuite) TestCapabilitiesNone(c *C) {
+	s.SendLine(c, ":n.net CAP * LS :multi-prefix")
+	s.ReadLine(c, "CAP END")
+	s.SendWelcome(c)
+	s.Roundtrip(c)
+}
 
+func (s *ServerSuite) TestPlayback(c *C) {
+	s.StopServer(c)
 	execSQL(c, s.db,
-		"INSERT INTO channel (account,name) VALUES ('one','#test')",
-		"INSERT INTO message (lane,account,nick,text,command) VALUES (2,'one','someone','Implicit PRIVMSG.','')",
-		"INSERT INTO message (lane,account,nick,text,command) VALUES (2,'one','someone','Explicit PRIVMSG.','PRIVMSG')",
-		"INSERT INTO message (lane,account,nick,text,command) VALUES (2,'one','someone','Explicit NOTICE.','NOTICE')",
+		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "A."}')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
 	)
-
-	c.Logf("Restarting server to handle outgoing messages...")
 	s.RestartServer(c)
 	s.SendWelcome(c)
 
-	// The initial JOINs are sent before any messages.
-	s.ReadLine(c, "JOIN #test")
-
-	// Then the messages and their PINGs asking for confirmation, handled by ReadLine.
-	s.ReadLine(c, "PRIVMSG someone :Implicit PRIVMSG.")
-	s.ReadLine(c, "PRIVMSG someone :Explicit PRIVMSG.")
-	s.ReadLine(c, "NOTICE someone :Explicit NOTICE.")
-
-	// Ensure the confirmations are received before restarting.
-	s.Roundtrip(c)
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	s.SendLine(c, ":n.net BATCH +pb znc.in/playback mup")
+	s.SendLine(c, "@batch=pb;time="+now+" :nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.SendLine(c, ":n.net BATCH -pb")
+	s.SendLine(c, "@time=2024-01-31T15:04:05.000Z :nick!~user@host PRIVMSG mup :echoAcmd A2")
+	s.SendLine(c, "@time="+now+" :nick!~user@host PRIVMSG mup :echoAcmd A3")
 
-	// This must be ignored. Different account.
-	execSQL(c, s.db, "INSERT INTO message (lane,account,nick,text) VALUES (2,'two','someone','Ignore me.')")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A3")
 
-	// Send another message with the server running.
+	rows, err := s.db.Query("SELECT text,playback FROM message WHERE lane=1 AND command='PRIVMSG' ORDER BY id")
+	c.Assert(err, IsNil)
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var text string
+		var playback bool
+		c.Assert(rows.Scan(&text, &playback), IsNil)
+		got = append(got, fmt.Sprintf("%s %v", text, playback))
+	}
+	c.Assert(rows.Err(), IsNil)
+	c.Assert(got, DeepEquals, []string{"echoAcmd A1 true", "echoAcmd A2 true", "echoAcmd A3 false"})
+}
+
+func (s *ServerSuite) TestPlaybackDrop(c *C) {
+	s.StopServer(c)
+	execSQL(c, s.db, `UPDATE account SET config='{"playback": "drop"}' WHERE name='one'`)
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.SendLine(c, "@time=2024-01-31T15:04:05.000Z :nick!~user@host PRIVMSG mup :Old")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :New")
+	s.Roundtrip(c)
+	time.Sleep(100 * time.Millisecond)
+
+	var text string
+	err := s.db.QueryRow("SELECT group_concat(text) FROM message WHERE lane=1 AND command='PRIVMSG'").Scan(&text)
+	c.Assert(err, IsNil)
+	c.Assert(text, Equals, "New")
+}
+
+func (s *ServerSuite) TestIncomingFlood(c *C) {
+	s.SendWelcome(c)
+	for i := 0; i < 250; i++ {
+		s.SendLine(c, fmt.Sprintf(":nick%d!~user@host JOIN #chan", i))
+	}
+	s.Roundtrip(c)
+
+	var nicks []string
+	waitFor(func() bool {
+		nicks = nil
+		rows, err := s.db.Query("SELECT nick FROM message WHERE lane=1 AND command='JOIN' ORDER BY id")
+		c.Assert(err, IsNil)
+		defer rows.Close()
+		for rows.Next() {
+			var nick string
+			c.Assert(rows.Scan(&nick), IsNil)
+			nicks = append(nicks, nick)
+		}
+		return len(nicks) == 250
+	})
+	c.Assert(nicks, HasLen, 250)
+	for i, nick := range nicks {
+		c.Assert(nick, Equals, fmt.Sprintf("nick%d", i))
+	}
+}
+
+func execSQL(c *C, db *sql.DB, stmts ...string) {
+	tx, err := db.Begin()
+	c.Assert(err, IsNil)
+	defer tx.Rollback()
+	for _, stmt := range stmts {
+		_, err := tx.Exec(stmt)
+		c.Assert(err, IsNil)
+	}
+	tx.Commit()
+}
+
+func (s *ServerSuite) TestOutgoing(c *C) {
+	// Stop default server to test the behavior of outgoing messages on start up.
+	s.StopServer(c)
+
+	execSQL(c, s.db,
+		"INSERT INTO channel (account,name) VALUES ('one','#test')",
+		"INSERT INTO message (lane,account,nick,text,command) VALUES (2,'one','someone','Implicit PRIVMSG.','')",
+		"INSERT INTO message (lane,account,nick,text,command) VALUES (2,'one','someone','Explicit PRIVMSG.','PRIVMSG')",
+		"INSERT INTO message (lane,account,nick,text,command) VALUES (2,'one','someone','Explicit NOTICE.','NOTICE')",
+	)
+
+	c.Logf("Restarting server to handle outgoing messages...")
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	// The initial JOINs are sent before any messages.
+	s.ReadLine(c, "JOIN #test")
+
+	// Then the messages and their PINGs asking for confirmation, handled by ReadLine.
+	s.ReadLine(c, "PRIVMSG someone :Implicit PRIVMSG.")
+	s.ReadLine(c, "PRIVMSG someone :Explicit PRIVMSG.")
+	s.ReadLine(c, "NOTICE someone :Explicit NOTICE.")
+
+	// Ensure the confirmations are received before restarting.
+	s.Roundtrip(c)
+
+	// This must be ignored. Different account.
+	execSQL(c, s.db, "INSERT INTO message (lane,account,nick,text) VALUES (2,'two','someone','Ignore me.')")
+
+	// Send another message with the server running.
 	execSQL(c, s.db, "INSERT INTO message (lane,account,nick,text) VALUES (2,'one','someone','Hello again!')")
 
 	// Do not use the s.ReadLine helper as the message won't be confirmed.
@@ -409,120 +1059,709 @@ func (s *ServerSuite) TestPlugin(c *C) {
 	s.RestartServer(c)
 	s.SendWelcome(c)
 
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B1")
-	s.Roundtrip(c)
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B1")
+	s.Roundtrip(c)
+
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B2")
+
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A1")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A.A1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A2")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A.A2")
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('echoB','{"prefix": "B."}')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoB','one')`,
+	)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A3")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A3")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B3")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B3")
+
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A3")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A.A3")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B3")
+	s.ReadLine(c, "PRIVMSG nick :[msg] B.B3")
+	s.Roundtrip(c)
+
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAcmd A3")
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAmsg A3")
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBcmd B3")
+	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBmsg B3")
+
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A3")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A.A3")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B3")
+	s.ReadLine(c, "PRIVMSG nick :[msg] B.B3")
+
+	// Ensure the outgoing handler is being properly called.
+	log := c.GetTestLog()
+	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] \[cmd\] A\.A2\n.*`)
+	c.Assert(log, Matches, `(?s).*\[echoB\] \[out\] \[cmd\] A\.A3\n.*`)
+}
+
+type logEntry struct {
+	level   mup.LogLevel
+	fields  mup.LogFields
+	message string
+}
+
+type structuredLogger struct {
+	entries []logEntry
+}
+
+func (l *structuredLogger) Log(level mup.LogLevel, fields mup.LogFields, message string) {
+	l.entries = append(l.entries, logEntry{level, fields, message})
+}
+
+func (s *ServerSuite) TestStopDrain(c *C) {
+	s.StopServer(c)
+	s.config.StopTimeout = 5 * time.Second
+	defer func() { s.config.StopTimeout = 0 }()
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('echoA')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+	)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	waitFor(func() bool {
+		var n int
+		err := s.db.QueryRow("SELECT COUNT(*) FROM message WHERE lane=1 AND text='echoAcmd A1'").Scan(&n)
+		c.Assert(err, IsNil)
+		return n == 1
+	})
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- s.server.Stop()
+	}()
+
+	// The reply is still delivered, and Stop waits for its confirmation.
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG nick :[cmd] A1")
+	ping := s.lserver.ReadLine()
+	c.Assert(ping, Matches, "PING :sent:.*")
+	select {
+	case <-stopped:
+		c.Fatalf("Server stopped before outgoing message was confirmed.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.lserver.SendLine("PONG " + ping[5:])
+	c.Assert(s.lserver.ReadLine(), Equals, "QUIT :brb")
+	s.lserver.Close()
+	s.lserver = nil
+
+	select {
+	case err := <-stopped:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("Server did not stop.")
+	}
+	s.server = nil
+}
+
+func (s *ServerSuite) TestLogLevels(c *C) {
+	s.StopServer(c)
+
+	logger := &structuredLogger{}
+	mup.SetStructuredLogger(logger)
+	mup.SetDebug(false)
+
+	execSQL(c, s.db,
+		`UPDATE account SET loglevel='quiet' WHERE name='one'`,
+		`INSERT INTO plugin (name,loglevel) VALUES ('echoA','debug')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+	)
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A1")
+	s.StopServer(c)
+	mup.SetStructuredLogger(nil)
+
+	var found bool
+	for _, entry := range logger.entries {
+		c.Assert(entry.fields.Account == "one" && entry.fields.Plugin == "", Equals, false, Commentf("%#v", entry))
+		if entry.message == "Running command: echoAcmd" {
+			c.Assert(entry.level, Equals, mup.LogDebug)
+			c.Assert(entry.fields, Equals, mup.LogFields{Account: "one", Plugin: "echoA", Command: "echoAcmd"})
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+}
+
+func (s *ServerSuite) TestParseLogLevel(c *C) {
+	for _, name := range []string{"", "quiet", "info", "debug"} {
+		level, err := mup.ParseLogLevel(name)
+		c.Assert(err, IsNil)
+		c.Assert(level.String(), Equals, name)
+	}
+	_, err := mup.ParseLogLevel("loud")
+	c.Assert(err, ErrorMatches, `unknown log level: "loud"`)
+}
+
+func (s *ServerSuite) TestPluginTarget(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "A."}')`,
+		`INSERT INTO plugin (name,config) VALUES ('echoB','{"prefix": "B."}')`,
+		`INSERT INTO plugin (name,config) VALUES ('echoC','{"prefix": "C."}')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('echoA','one','#chan1')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('echoB','one','#chan2')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoC','one')`,
+	)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoAcmd A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoAcmd A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoBcmd B1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoBcmd B2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoCcmd C1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoCcmd C2")
+
+	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] A.A1")
+	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] B.B2")
+	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] C.C1")
+	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] C.C2")
+}
+
+func (s *ServerSuite) TestPluginIgnore(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('echoA')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+		`INSERT INTO ignored (account,mask) VALUES ('one','Spammer')`,
+		`INSERT INTO ignored (account,mask) VALUES ('other','nick')`,
+		`INSERT INTO ignored (channel,mask) VALUES ('#quiet','*!*@*.bad.host')`,
+	)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":spammer!~user@host PRIVMSG #chan :mup: echoAcmd A1")
+	s.SendLine(c, ":nick!~user@x.bad.host PRIVMSG #quiet :mup: echoAcmd A2")
+	s.SendLine(c, ":nick!~user@x.bad.host PRIVMSG #chan :mup: echoAcmd A3")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #quiet :mup: echoAcmd A4")
+
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] A3")
+	s.ReadLine(c, "PRIVMSG #quiet :nick: [cmd] A4")
+}
+
+type dropMiddleware struct{}
+
+func (dropMiddleware) FilterIncoming(msg *mup.Message) bool {
+	return !strings.Contains(msg.Text, "drop")
+}
+
+func (dropMiddleware) FilterOutgoing(msg *mup.Message) bool {
+	return !strings.Contains(msg.Text, "hide")
+}
+
+func init() {
+	mup.RegisterMiddleware(&mup.MiddlewareSpec{
+		Name:  "testdrop",
+		Start: func(config []byte) (mup.Middleware, error) { return dropMiddleware{}, nil },
+	})
+}
+
+func (s *ServerSuite) TestPluginMiddleware(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "<secret1> "}')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+		`INSERT INTO middleware (name,position) VALUES ('testdrop',3)`,
+		`INSERT INTO middleware (name,position) VALUES ('stripcolors',1)`,
+		`INSERT INTO middleware (name,position,config) VALUES ('redact',2,'{"patterns": ["secret[0-9]+"]}')`,
+		`INSERT INTO middleware (name,position,config) VALUES ('redact/bad',4,'{"patterns": ["("]}')`,
+	)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: \x02echoAcmd\x02 \x0304,12A1\x03")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd drop")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd hide")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd secret42")
+
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] <[redacted]> A1")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] <[redacted]> [redacted]")
+}
+
+func (s *ServerSuite) TestBangPrefix(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('echoA')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+		`INSERT INTO channel (account,name,bang) VALUES ('one','#other','?')`,
+		`UPDATE account SET bang='%' WHERE name='one'`,
+	)
+	s.server.RefreshAccounts()
+	s.server.RefreshPlugins()
+	s.ReadLine(c, "JOIN #other")
+	s.SendLine(c, ":mup!~mup@10.0.0.1 JOIN #other")
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :!echoAcmd A1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :%echoAcmd A2")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #other :%echoAcmd A3")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #other :?echoAcmd A4")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :%echoAcmd A5")
+
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] A2")
+	s.ReadLine(c, "PRIVMSG #other :nick: [cmd] A4")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A5")
+}
+
+func (s *ServerSuite) TestPluginThrottle(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('echoA')`,
+		`INSERT INTO target (plugin,account,config) VALUES ('echoA','one','{"throttle": 2, "throttlewindow": "1m"}')`,
+	)
+	s.server.RefreshPlugins()
+
+	for i := 1; i <= 4; i++ {
+		s.SendLine(c, fmt.Sprintf(":nick!~user@host PRIVMSG mup :echoAcmd A%d", i))
+	}
+	s.SendLine(c, ":other!~user@host PRIVMSG mup :echoAcmd B1")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A5")
+
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A1")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A2")
+	s.ReadLine(c, "PRIVMSG nick :Easy there. Please wait 1m0s before running more commands.")
+	s.ReadLine(c, "PRIVMSG other :[cmd] B1")
+	s.ReadLine(c, "PRIVMSG nick :[msg] A5")
+}
+
+func (s *ServerSuite) TestPluginDedup(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO account (name,kind) VALUES ('two','bridged')`,
+		`INSERT INTO plugin (name) VALUES ('echoA')`,
+		`INSERT INTO target (plugin,account,channel,config) VALUES ('echoA','one','#chan','{"dedup": "1m"}')`,
+		`INSERT INTO target (plugin,account,channel,config) VALUES ('echoA','two','#chan','{"dedup": "1m"}')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('echoA','two','#other')`,
+	)
+	s.server.RefreshPlugins()
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd A1")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] A1")
+
+	// The same message bridged via account two is suppressed, unless
+	// it arrives via a target that has no deduplication configured.
+	for _, channel := range []string{"#chan", "#other", "#chan"} {
+		_, err := s.db.Exec("INSERT INTO message (lane,account,channel,nick,text,bottext,asnick,time) VALUES (1,'two',?,'nick','mup: echoAcmd A1','echoAcmd A1','mup',?)", channel, time.Now())
+		c.Assert(err, IsNil)
+	}
+	_, err := s.db.Exec("INSERT INTO message (lane,account,channel,nick,text,bottext,asnick,time) VALUES (1,'two','#chan','nick','mup: echoAcmd A2','echoAcmd A2','mup',?)", time.Now())
+	c.Assert(err, IsNil)
+
+	var texts []string
+	waitFor(func() bool {
+		texts = nil
+		rows, err := s.db.Query("SELECT channel,text FROM message WHERE lane=2 AND account='two' ORDER BY id")
+		c.Assert(err, IsNil)
+		defer rows.Close()
+		for rows.Next() {
+			var channel, text string
+			c.Assert(rows.Scan(&channel, &text), IsNil)
+			texts = append(texts, channel+" "+text)
+		}
+		return len(texts) == 2
+	})
+	c.Assert(texts, DeepEquals, []string{"#other nick: [cmd] A1", "#chan nick: [cmd] A2"})
+}
+
+func (s *ServerSuite) TestPluginUpdates(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "A."}')`,
+		`INSERT INTO plugin (name,config) VALUES ('echoB','{"prefix": "B."}')`,
+		`INSERT INTO plugin (name,config) VALUES ('echoC','{"prefix": "C."}')`,
+		`INSERT INTO plugin (name,config) VALUES ('echoD','{"prefix": "D."}')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoB','one')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('echoC','one','#chan')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('echoD','one','none')`,
+	)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	execSQL(c, s.db,
+		`DELETE FROM plugin WHERE name='echoA'`,
+		`UPDATE plugin SET config='{"prefix": "D2."}' WHERE name='echoD'`,
+		`UPDATE target SET channel='none' WHERE plugin='echoC'`,
+		`UPDATE target SET channel='#chan' WHERE plugin='echoD'`,
+	)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	time.Sleep(500 * time.Millisecond)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd A")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoBcmd B")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoCcmd C")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoDcmd D")
+
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] B.B")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] D2.D")
+}
+
+var testValidSpec = mup.PluginSpec{
+	Name:     "testvalid",
+	Start:    pluginStart,
+	Commands: pluginCommands("testvalidcmd"),
+	ConfigSchema: struct {
+		Prefix      string
+		ShowCmdName bool
+	}{},
+	Validate: func(p *mup.Plugger) error {
+		var config struct{ Prefix string }
+		p.UnmarshalConfig(&config)
+		if config.Prefix == "bad" {
+			return fmt.Errorf("bad prefix")
+		}
+		return nil
+	},
+}
+
+func init() {
+	mup.RegisterPlugin(&testValidSpec)
+}
+
+func (s *ServerSuite) TestPluginValidation(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('testvalid','{"prefix": "V.", "pastelines": 3}')`,
+		`INSERT INTO target (plugin,account) VALUES ('testvalid','one')`,
+	)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testvalidcmd A")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] V.A")
+
+	execSQL(c, s.db, `UPDATE plugin SET config='{"prefx": "X."}' WHERE name='testvalid'`)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testvalidcmd B")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] V.B")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Plugin "testvalid" has an invalid configuration: invalid config: json: unknown field "prefx". Keeping the running instance.*`)
+
+	execSQL(c, s.db, `UPDATE plugin SET config='{"prefix": "bad"}' WHERE name='testvalid'`)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testvalidcmd C")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] V.C")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Plugin "testvalid" has an invalid configuration: bad prefix. Keeping the running instance.*`)
+
+	execSQL(c, s.db, `UPDATE plugin SET config='{"prefix": "W."}' WHERE name='testvalid'`)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testvalidcmd D")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] W.D")
+}
+
+var testUpdateSpec = mup.PluginSpec{
+	Name:     "testupdate",
+	Start:    testUpdateStart,
+	Commands: pluginCommands("testupdatecmd"),
+}
+
+func init() {
+	mup.RegisterPlugin(&testUpdateSpec)
+}
+
+type testUpdatePlugin struct {
+	testPlugin
+	started int
+}
+
+func testUpdateStart(plugger *mup.Plugger) mup.Stopper {
+	p := &testUpdatePlugin{}
+	p.UpdateConfig(plugger)
+	return p
+}
+
+func (p *testUpdatePlugin) UpdateConfig(plugger *mup.Plugger) error {
+	p.plugger = plugger
+	p.started++
+	p.config.Prefix = ""
+	plugger.UnmarshalConfig(&p.config)
+	if p.config.Prefix == "restart." {
+		return fmt.Errorf("cannot take prefix in place")
+	}
+	p.config.Prefix = fmt.Sprintf("%s%d.", p.config.Prefix, p.started)
+	return nil
+}
+
+func (s *ServerSuite) TestPluginUpdateConfig(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('testupdate','{"prefix": "A."}')`,
+		`INSERT INTO target (plugin,account) VALUES ('testupdate','one')`,
+	)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testupdatecmd x")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.1.x")
+
+	execSQL(c, s.db,
+		`UPDATE plugin SET config='{"prefix": "B."}' WHERE name='testupdate'`,
+		`UPDATE target SET channel='#chan' WHERE plugin='testupdate'`,
+	)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testupdatecmd x")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: testupdatecmd y")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] B.2.y")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Plugin "testupdate" config or targets changed. Updated it in place.*`)
+
+	execSQL(c, s.db, `UPDATE plugin SET config='{"prefix": "restart."}' WHERE name='testupdate'`)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: testupdatecmd z")
+	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] restart.z")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*cannot take prefix in place\n.*Stopping and restarting it.*`)
+}
+
+func (s *ServerSuite) TestSecretKey(c *C) {
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "A."}')`,
+		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
+	)
+
+	key, err := mup.ParseSecretKey(strings.Repeat("ab", mup.SecretKeySize))
+	c.Assert(err, IsNil)
+	err = mup.RotateSecretKey(s.db, nil, key)
+	c.Assert(err, IsNil)
+
+	var password, config string
+	err = s.db.QueryRow("SELECT password FROM account WHERE name='one'").Scan(&password)
+	c.Assert(err, IsNil)
+	err = s.db.QueryRow("SELECT config FROM plugin WHERE name='echoA'").Scan(&config)
+	c.Assert(err, IsNil)
+	c.Assert(password, Matches, "enc:v1:.+")
+	c.Assert(config, Matches, "enc:v1:.+")
+
+	err = mup.RotateSecretKey(s.db, nil, key)
+	c.Assert(err, ErrorMatches, "account password of row 1: cannot decrypt secret: no secret key configured")
+
+	s.config.SecretKey = key
+	s.RestartServer(c)
+	s.SendWelcome(c)
+	s.server.RefreshPlugins()
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd x")
+	s.ReadLine(c, "PRIVMSG nick :[cmd] A.x")
+
+	other, err := mup.ParseSecretKey(base64.StdEncoding.EncodeToString(make([]byte, mup.SecretKeySize)))
+	c.Assert(err, IsNil)
+	err = mup.RotateSecretKey(s.db, other, nil)
+	c.Assert(err, ErrorMatches, "account password of row 1: cannot decrypt secret: wrong key or corrupted value")
+	err = mup.RotateSecretKey(s.db, key, nil)
+	c.Assert(err, IsNil)
+	err = s.db.QueryRow("SELECT config FROM plugin WHERE name='echoA'").Scan(&config)
+	c.Assert(err, IsNil)
+	c.Assert(config, Equals, `{"prefix": "A."}`)
+}
 
-	s.server.RefreshPlugins()
+var testSessionSpec = mup.PluginSpec{
+	Name:  "testsession",
+	Start: testSessionStart,
+}
 
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B2")
+func init() {
+	mup.RegisterPlugin(&testSessionSpec)
+}
 
-	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A1")
-	s.ReadLine(c, "PRIVMSG nick :[msg] A.A1")
-	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A2")
-	s.ReadLine(c, "PRIVMSG nick :[msg] A.A2")
+type testSessionPlugin struct {
+	plugger *mup.Plugger
+}
 
-	execSQL(c, s.db,
-		`INSERT INTO plugin (name,config) VALUES ('echoB','{"prefix": "B."}')`,
-		`INSERT INTO target (plugin,account) VALUES ('echoB','one')`,
-	)
-	s.server.RefreshPlugins()
+func testSessionStart(plugger *mup.Plugger) mup.Stopper {
+	return &testSessionPlugin{plugger}
+}
 
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAcmd A3")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoAmsg A3")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBcmd B3")
-	s.SendLine(c, ":nick!~user@host PRIVMSG mup :echoBmsg B3")
+func (p *testSessionPlugin) Stop() error {
+	return nil
+}
 
-	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A3")
-	s.ReadLine(c, "PRIVMSG nick :[msg] A.A3")
-	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B3")
-	s.ReadLine(c, "PRIVMSG nick :[msg] B.B3")
-	s.Roundtrip(c)
+func (p *testSessionPlugin) HandleMessage(msg *mup.Message) {
+	switch msg.Command {
+	case "NICK":
+		nicks, err := p.plugger.PreviousNicks(mup.Address{Account: msg.Account, Nick: msg.Text})
+		if err != nil {
+			p.plugger.Broadcastf("Oops: %v", err)
+		} else {
+			p.plugger.Broadcastf("%s was %s", msg.Text, strings.Join(nicks, ", "))
+		}
+	case "QUIT":
+		p.plugger.Broadcastf("%s quit: %s", msg.Nick, msg.Text)
+	case "AWAY", "301":
+		nick := msg.Nick
+		if msg.Command == "301" {
+			nick = msg.Param1
+		}
+		presence, err := p.plugger.Presence(msg.Account, nick)
+		if err != nil {
+			p.plugger.Broadcastf("Oops: %v", err)
+		} else if presence.Away {
+			p.plugger.Broadcastf("%s is online=%v, away: %s", nick, presence.Online, presence.AwayMessage)
+		} else {
+			p.plugger.Broadcastf("%s is online=%v, back", nick, presence.Online)
+		}
+	}
+}
 
-	s.RestartServer(c)
+func (s *ServerSuite) TestPluginSession(c *C) {
 	s.SendWelcome(c)
 
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAcmd A3")
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoAmsg A3")
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBcmd B3")
-	s.lserver.SendLine(":nick!~user@host PRIVMSG mup :echoBmsg B3")
-
-	s.ReadLine(c, "PRIVMSG nick :[cmd] A.A3")
-	s.ReadLine(c, "PRIVMSG nick :[msg] A.A3")
-	s.ReadLine(c, "PRIVMSG nick :[cmd] B.B3")
-	s.ReadLine(c, "PRIVMSG nick :[msg] B.B3")
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('testsession')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('testsession','one','#chan')`,
+	)
+	s.server.RefreshPlugins()
 
-	// Ensure the outgoing handler is being properly called.
-	log := c.GetTestLog()
-	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] \[cmd\] A\.A2\n.*`)
-	c.Assert(log, Matches, `(?s).*\[echoB\] \[out\] \[cmd\] A\.A3\n.*`)
+	s.SendLine(c, ":alice!~alice@host PRIVMSG #chan :hi")
+	s.SendLine(c, ":alice!~alice@host NICK alice_away")
+	s.ReadLine(c, "PRIVMSG #chan :alice_away was alice")
+	s.SendLine(c, ":alice_away!~alice@host NICK :alice2")
+	s.ReadLine(c, "PRIVMSG #chan :alice2 was alice_away, alice")
+	s.SendLine(c, ":alice2!~alice@host QUIT :Bye")
+	s.ReadLine(c, "PRIVMSG #chan :alice2 quit: Bye")
+	s.SendLine(c, ":alice!~alice@host JOIN #chan")
+	s.SendLine(c, ":alice!~alice@host NICK bob")
+	s.ReadLine(c, "PRIVMSG #chan :bob was alice")
+
+	var quit string
+	err := s.db.QueryRow("SELECT quit FROM session WHERE account='one' AND nick='alice2' AND NOT active").Scan(&quit)
+	c.Assert(err, IsNil)
+	c.Assert(quit, Equals, "Bye")
 }
 
-func (s *ServerSuite) TestPluginTarget(c *C) {
+func (s *ServerSuite) TestPluginPresence(c *C) {
 	s.SendWelcome(c)
 
 	execSQL(c, s.db,
-		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "A."}')`,
-		`INSERT INTO plugin (name,config) VALUES ('echoB','{"prefix": "B."}')`,
-		`INSERT INTO plugin (name,config) VALUES ('echoC','{"prefix": "C."}')`,
-		`INSERT INTO target (plugin,account,channel) VALUES ('echoA','one','#chan1')`,
-		`INSERT INTO target (plugin,account,channel) VALUES ('echoB','one','#chan2')`,
-		`INSERT INTO target (plugin,account) VALUES ('echoC','one')`,
+		`INSERT INTO plugin (name) VALUES ('testsession')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('testsession','one','#chan')`,
 	)
 	s.server.RefreshPlugins()
 
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoAcmd A1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoAcmd A2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoBcmd B1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoBcmd B2")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan1 :mup: echoCcmd C1")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan2 :mup: echoCcmd C2")
-
-	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] A.A1")
-	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] B.B2")
-	s.ReadLine(c, "PRIVMSG #chan1 :nick: [cmd] C.C1")
-	s.ReadLine(c, "PRIVMSG #chan2 :nick: [cmd] C.C2")
+	s.SendLine(c, ":alice!~alice@host PRIVMSG #chan :hi")
+	s.SendLine(c, ":alice!~alice@host AWAY :Gone fishing")
+	s.ReadLine(c, "PRIVMSG #chan :alice is online=true, away: Gone fishing")
+	s.SendLine(c, ":alice!~alice@host NICK alice_")
+	s.ReadLine(c, "PRIVMSG #chan :alice_ was alice")
+	s.SendLine(c, ":n.net 301 mup alice_ :Still fishing")
+	s.ReadLine(c, "PRIVMSG #chan :alice_ is online=true, away: Still fishing")
+	s.SendLine(c, ":alice_!~alice@host AWAY")
+	s.ReadLine(c, "PRIVMSG #chan :alice_ is online=true, back")
+	s.SendLine(c, ":n.net 301 mup bob :Out")
+	s.ReadLine(c, "PRIVMSG #chan :bob is online=true, away: Out")
+
+	var awaySince, lastSeen time.Time
+	err := s.db.QueryRow("SELECT awaytime,lastseen FROM session WHERE account='one' AND nick='alice' AND NOT active").Scan(&awaySince, &lastSeen)
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(awaySince) < time.Minute, Equals, true)
+	c.Assert(time.Since(lastSeen) < time.Minute, Equals, true)
 }
 
-func (s *ServerSuite) TestPluginUpdates(c *C) {
+func (s *ServerSuite) TestPluginJoin(c *C) {
 	s.SendWelcome(c)
 
 	execSQL(c, s.db,
-		`INSERT INTO plugin (name,config) VALUES ('echoA','{"prefix": "A."}')`,
-		`INSERT INTO plugin (name,config) VALUES ('echoB','{"prefix": "B."}')`,
-		`INSERT INTO plugin (name,config) VALUES ('echoC','{"prefix": "C."}')`,
-		`INSERT INTO plugin (name,config) VALUES ('echoD','{"prefix": "D."}')`,
-		`INSERT INTO target (plugin,account) VALUES ('echoA','one')`,
-		`INSERT INTO target (plugin,account) VALUES ('echoB','one')`,
-		`INSERT INTO target (plugin,account,channel) VALUES ('echoC','one','#chan')`,
-		`INSERT INTO target (plugin,account,channel) VALUES ('echoD','one','none')`,
+		`INSERT INTO plugin (name,config) VALUES ('bridge','{"joins": true}')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('bridge','one','#chan')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('bridge','one','#other')`,
 	)
 	s.server.RefreshPlugins()
-	s.Roundtrip(c)
+
+	s.SendLine(c, ":alice!~alice@host JOIN #chan")
+	s.ReadLine(c, "PRIVMSG #other :* alice joined #chan")
+	s.SendLine(c, ":alice!~alice@host JOIN #unknown")
+	s.SendLine(c, ":alice!~alice@host PART #chan :Bye")
+	s.ReadLine(c, "PRIVMSG #other :* alice left #chan")
+}
+
+var testDeliverySpec = mup.PluginSpec{
+	Name:  "testdelivery",
+	Start: testDeliveryStart,
+}
+
+func init() {
+	mup.RegisterPlugin(&testDeliverySpec)
+}
+
+type testDeliveryPlugin struct {
+	plugger *mup.Plugger
+	probes  int
+}
+
+func testDeliveryStart(plugger *mup.Plugger) mup.Stopper {
+	return &testDeliveryPlugin{plugger: plugger}
+}
+
+func (p *testDeliveryPlugin) Stop() error {
+	return nil
+}
+
+func (p *testDeliveryPlugin) HandleMessage(msg *mup.Message) {
+	if !strings.HasPrefix(msg.BotText, "send ") {
+		return
+	}
+	p.probes++
+	probe := &mup.Message{Account: msg.Account, Text: "Probe.", Nonce: fmt.Sprintf("probe%d", p.probes)}
+	if target := msg.BotText[5:]; strings.HasPrefix(target, "#") {
+		probe.Channel = target
+	} else {
+		probe.Nick = target
+	}
+	p.plugger.Send(probe)
+}
+
+func (p *testDeliveryPlugin) HandleDelivery(d *mup.Delivery) {
+	if strings.HasPrefix(d.Nonce, "probe") {
+		p.plugger.Broadcastf("%s %s %s", d.Nonce, d.Status, d.Error)
+	}
+}
+
+func (s *ServerSuite) TestPluginDelivery(c *C) {
+	s.SendWelcome(c)
 
 	execSQL(c, s.db,
-		`DELETE FROM plugin WHERE name='echoA'`,
-		`UPDATE plugin SET config='{"prefix": "D2."}' WHERE name='echoD'`,
-		`UPDATE target SET channel='none' WHERE plugin='echoC'`,
-		`UPDATE target SET channel='#chan' WHERE plugin='echoD'`,
+		`INSERT INTO plugin (name) VALUES ('testdelivery')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('testdelivery','one','#chan')`,
 	)
 	s.server.RefreshPlugins()
-	s.Roundtrip(c)
-
-	time.Sleep(500 * time.Millisecond)
-
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoAcmd A")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoBcmd B")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoCcmd C")
-	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: echoDcmd D")
 
-	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] B.B")
-	s.ReadLine(c, "PRIVMSG #chan :nick: [cmd] D2.D")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: send someone")
+	s.ReadLine(c, "PRIVMSG someone :Probe.")
+	s.ReadLine(c, "PRIVMSG #chan :probe1 sent")
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: send #closed")
+	c.Assert(s.lserver.ReadLine(), Equals, "PRIVMSG #closed :Probe.")
+	ping := s.lserver.ReadLine()
+	c.Assert(ping, Matches, "PING :sent:.*")
+	s.SendLine(c, ":n.net 404 mup #closed :Cannot send to channel")
+	s.SendLine(c, "PONG "+ping[5:])
+	s.ReadLine(c, "PRIVMSG #chan :probe2 failed Cannot send to channel")
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Cannot deliver message [0-9]+: Cannot send to channel.*`)
 }
 
 var testLDAPSpec = mup.PluginSpec{
@@ -604,7 +1843,7 @@ func (s *ServerSuite) TestLDAP(c *C) {
 	s.ReadLine(c, "PRIVMSG nick :LDAP works fine.")
 
 	execSQL(c, s.db,
-		`INSERT INTO ldap (name,url) VALUES ('test3','the-url3')`,
+		`INSERT INTO ldap (name,url,poolsize,idletimeout,starttls,cacert,cachettl,cachesize) VALUES ('test3','the-url3',2,60,1,'the-cacert',30,10)`,
 		`UPDATE ldap SET url='the-url4' WHERE name='test1'`,
 		`DELETE FROM ldap WHERE name='test2'`,
 	)
@@ -626,7 +1865,7 @@ func (s *ServerSuite) TestLDAP(c *C) {
 	c.Assert(dials["the-url1"], DeepEquals, &ldap.Config{URL: "the-url1", BaseDN: "the-basedn", BindDN: "the-binddn", BindPass: "the-bindpass"})
 	c.Assert(dials["the-url2"], DeepEquals, &ldap.Config{URL: "the-url2"})
 	c.Assert(dials["the-url4"], DeepEquals, &ldap.Config{URL: "the-url4", BaseDN: "the-basedn", BindDN: "the-binddn", BindPass: "the-bindpass"})
-	c.Assert(dials["the-url3"], DeepEquals, &ldap.Config{URL: "the-url3"})
+	c.Assert(dials["the-url3"], DeepEquals, &ldap.Config{URL: "the-url3", PoolSize: 2, IdleTimeout: time.Minute, StartTLS: true, CACert: "the-cacert", CacheTTL: 30 * time.Second, CacheSize: 10})
 
 	c.Assert(dialn, Equals, 4)
 }
@@ -679,6 +1918,75 @@ func (s *ServerSuite) TestDatabase(c *C) {
 	s.ReadLine(c, "PRIVMSG nick :Number of accounts found: 1 (err=<nil>)")
 }
 
+var testCrashSpec = mup.PluginSpec{
+	Name:     "testcrash",
+	Start:    testCrashStart,
+	Commands: schema.Commands{{Name: "crash"}, {Name: "hang"}, {Name: "alive"}},
+}
+
+func init() {
+	mup.RegisterPlugin(&testCrashSpec)
+}
+
+type testCrashPlugin struct {
+	plugger *mup.Plugger
+	stop    chan struct{}
+}
+
+func testCrashStart(plugger *mup.Plugger) mup.Stopper {
+	return &testCrashPlugin{plugger, make(chan struct{})}
+}
+
+func (p *testCrashPlugin) Stop() error {
+	close(p.stop)
+	return nil
+}
+
+func (p *testCrashPlugin) HandleCommand(cmd *mup.Command) {
+	switch cmd.Name() {
+	case "crash":
+		panic("boom")
+	case "hang":
+		<-p.stop
+	case "alive":
+		p.plugger.Sendf(cmd, "Still alive.")
+	}
+}
+
+func (s *ServerSuite) TestPluginCrash(c *C) {
+	s.StopServer(c)
+	s.config.HandlerTimeout = 200 * time.Millisecond
+	defer func() { s.config.HandlerTimeout = 0 }()
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('testcrash')`,
+		`INSERT INTO target (plugin,account) VALUES ('testcrash','one')`,
+	)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :crash")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :alive")
+	s.ReadLine(c, "PRIVMSG nick :Still alive.")
+
+	status := s.server.Status()
+	c.Assert(status.Plugins, HasLen, 1)
+	c.Assert(status.Plugins[0].Running, Equals, true)
+	c.Assert(status.Plugins[0].LastError, Equals, "panic handling message: boom")
+	c.Assert(status.Plugins[0].Restarts, Equals, 1)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :hang")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :alive")
+	s.ReadLine(c, "PRIVMSG nick :Still alive.")
+
+	status = s.server.Status()
+	c.Assert(status.Plugins[0].Running, Equals, true)
+	c.Assert(status.Plugins[0].LastError, Equals, "timed out handling message after 200ms")
+	c.Assert(status.Plugins[0].Restarts, Equals, 2)
+}
+
 func (s *ServerSuite) TestHelp(c *C) {
 	s.SendWelcome(c)
 
@@ -689,7 +1997,8 @@ func (s *ServerSuite) TestHelp(c *C) {
 	s.server.RefreshPlugins()
 
 	s.SendLine(c, ":nick!~user@host PRIVMSG mup :help help")
-	s.ReadLine(c, "PRIVMSG nick :help [<cmdname>] — Displays available commands or details for a specific command.")
+	s.ReadLine(c, "PRIVMSG nick :help [<cmdname|plugin|page>] [<page>] — Displays available commands or details for a specific command.")
+	s.ReadLine(c, `PRIVMSG nick :When a plugin name is provided only the commands of that plugin are listed. Long command lists are split in pages, which may be selected with a page number as in "help 2" or "help <plugin> 2".`)
 
 	s.SendLine(c, ":nick!~user@host PRIVMSG mup :testdb")
 	s.ReadLine(c, `PRIVMSG nick :Plugin "testdb" is not running.`)
@@ -705,6 +2014,207 @@ func (s *ServerSuite) TestHelp(c *C) {
 	s.ReadLine(c, `PRIVMSG nick :Plugin "testdb" is not enabled here.`)
 }
 
+var testUnknownSpec = mup.PluginSpec{
+	Name:  "testunknown",
+	Start: testUnknownStart,
+}
+
+func init() {
+	mup.RegisterPlugin(&testUnknownSpec)
+}
+
+type testUnknownPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testUnknownStart(plugger *mup.Plugger) mup.Stopper {
+	return &testUnknownPlugin{plugger}
+}
+
+func (p *testUnknownPlugin) Stop() error {
+	return nil
+}
+
+func (p *testUnknownPlugin) HandleUnknownCommand(msg *mup.Message, cmdName string) {
+	p.plugger.Sendf(msg, "Looking up %s.", cmdName)
+}
+
+func (s *ServerSuite) TestUnknownCommand(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('help', '{"boring": true}')`,
+		`INSERT INTO plugin (name) VALUES ('testdb')`,
+		`INSERT INTO plugin (name) VALUES ('testunknown')`,
+		`INSERT INTO target (plugin,account) VALUES ('help','one')`,
+		`INSERT INTO target (plugin,account) VALUES ('testdb','one')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('testunknown','one','#chan')`,
+	)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	// The help plugin stays quiet where the unknown command is handled,
+	// and known commands are not handled as unknown.
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: foo")
+	s.SendLine(c, ":nick!~user@host PRIVMSG #chan :mup: testdb")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :foo")
+	s.ReadLine(c, "PRIVMSG #chan :nick: Looking up foo.")
+	s.ReadLine(c, "PRIVMSG #chan :nick: Number of accounts found: 1 (err=<nil>)")
+	s.ReadLine(c, `PRIVMSG nick :Command "foo" not found.`)
+}
+
+var testEventsSpec = mup.PluginSpec{
+	Name:  "testevents",
+	Start: testEventsStart,
+	Commands: schema.Commands{{
+		Name: "publish",
+		Args: schema.Args{{Name: "topic", Flag: schema.Required}, {Name: "text", Flag: schema.Trailing}},
+	}, {
+		Name: "record",
+		Args: schema.Args{{Name: "topic", Flag: schema.Required}, {Name: "text", Flag: schema.Trailing}},
+	}},
+}
+
+func init() {
+	mup.RegisterPlugin(&testEventsSpec)
+}
+
+type testEventsPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testEventsStart(plugger *mup.Plugger) mup.Stopper {
+	var config struct{ Subscribe []string }
+	plugger.UnmarshalConfig(&config)
+	for _, topic := range config.Subscribe {
+		plugger.Subscribe(topic)
+	}
+	return &testEventsPlugin{plugger}
+}
+
+func (p *testEventsPlugin) Stop() error {
+	return nil
+}
+
+type testEventPayload struct {
+	Nick string
+	Text string
+}
+
+func (p *testEventsPlugin) HandleCommand(cmd *mup.Command) {
+	var args struct{ Topic, Text string }
+	cmd.Args(&args)
+	payload := &testEventPayload{Nick: cmd.Nick, Text: args.Text}
+	var err error
+	if cmd.Name() == "record" {
+		err = p.plugger.Event(args.Topic, payload)
+	} else {
+		err = p.plugger.Publish(args.Topic, payload)
+	}
+	if err != nil {
+		p.plugger.Sendf(cmd, "Cannot publish: %v", err)
+	}
+}
+
+func (p *testEventsPlugin) HandleEvent(ev *mup.Event) {
+	var payload testEventPayload
+	if err := ev.Payload(&payload); err != nil {
+		panic(err)
+	}
+	to := mup.Address{Account: "one", Nick: payload.Nick}
+	p.plugger.Sendf(to, "[%s] Got %s from %s: %s", p.plugger.Name(), ev.Topic, ev.Plugin, payload.Text)
+}
+
+func (s *ServerSuite) TestEvents(c *C) {
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('testevents/pub')`,
+		`INSERT INTO plugin (name,config) VALUES ('testevents/all', '{"subscribe": ["news.*"]}')`,
+		`INSERT INTO plugin (name,config) VALUES ('testevents/sports', '{"subscribe": ["news.sports"]}')`,
+		`INSERT INTO target (plugin,account) VALUES ('testevents/pub','one')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('testevents/all','one','#all')`,
+		`INSERT INTO target (plugin,account,channel) VALUES ('testevents/sports','one','#sports')`,
+	)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :publish news.weather Sunny.")
+	s.ReadLine(c, "PRIVMSG nick :[testevents/all] Got news.weather from testevents/pub: Sunny.")
+
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :publish other Ignored.")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :publish news.sports Goal!")
+	// Subscribers are handed events in no particular order.
+	var lines []string
+	for len(lines) < 2 {
+		line := s.lserver.ReadLine()
+		if strings.HasPrefix(line, "PING :sent:") {
+			s.lserver.SendLine("PONG " + line[5:])
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	c.Assert(lines, DeepEquals, []string{
+		"PRIVMSG nick :[testevents/all] Got news.sports from testevents/pub: Goal!",
+		"PRIVMSG nick :[testevents/sports] Got news.sports from testevents/pub: Goal!",
+	})
+}
+
+func (s *ServerSuite) TestEventsHTTP(c *C) {
+	s.config.HTTPAddr = "localhost:10647"
+	defer func() { s.config.HTTPAddr = "" }()
+	s.RestartServer(c)
+	s.SendWelcome(c)
+
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name,config) VALUES ('testevents', '{"subscribe": ["news.weather"]}')`,
+		`INSERT INTO target (plugin,account) VALUES ('testevents','one')`,
+	)
+	s.server.RefreshPlugins()
+	s.Roundtrip(c)
+
+	// Only the recorded events are served, and the one delivered
+	// confirms both were handled.
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :record news.sports Goal!")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :publish news.sports Ignored.")
+	s.SendLine(c, ":nick!~user@host PRIVMSG mup :record news.weather Sunny.")
+	s.ReadLine(c, "PRIVMSG nick :[testevents] Got news.weather from testevents: Sunny.")
+
+	type eventDoc struct {
+		Id      int64
+		Plugin  string
+		Topic   string
+		Payload testEventPayload
+	}
+	// Idle connections to servers of earlier tests must not be reused.
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(query string) []eventDoc {
+		resp, err := client.Get("http://localhost:10647/events" + query)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Type"), Equals, "application/json")
+		var docs []eventDoc
+		c.Assert(json.NewDecoder(resp.Body).Decode(&docs), IsNil)
+		return docs
+	}
+
+	docs := get("?topic=news.*")
+	c.Assert(docs, HasLen, 2)
+	c.Assert(docs[0], Equals, eventDoc{Id: docs[0].Id, Plugin: "testevents", Topic: "news.sports", Payload: testEventPayload{"nick", "Goal!"}})
+	c.Assert(docs[1], Equals, eventDoc{Id: docs[0].Id + 1, Plugin: "testevents", Topic: "news.weather", Payload: testEventPayload{"nick", "Sunny."}})
+
+	c.Assert(get("?topic=news.weather"), DeepEquals, docs[1:])
+	c.Assert(get(fmt.Sprintf("?after=%d", docs[0].Id)), DeepEquals, docs[1:])
+	c.Assert(get("?plugin=other"), HasLen, 0)
+
+	resp, err := client.Get("http://localhost:10647/events?after=bad")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
 func (s *ServerSuite) TestPluginSelection(c *C) {
 	s.StopServer(c)
 
@@ -733,7 +2243,8 @@ func (s *ServerSuite) TestPluginSelection(c *C) {
 	s.Roundtrip(c)
 
 	s.SendLine(c, ":nick!~user@host PRIVMSG mup :help help")
-	s.ReadLine(c, "PRIVMSG nick :help [<cmdname>] — Displays available commands or details for a specific command.")
+	s.ReadLine(c, "PRIVMSG nick :help [<cmdname|plugin|page>] [<page>] — Displays available commands or details for a specific command.")
+	s.ReadLine(c, `PRIVMSG nick :When a plugin name is provided only the commands of that plugin are listed. Long command lists are split in pages, which may be selected with a page number as in "help 2" or "help <plugin> 2".`)
 
 	rows, err := s.db.Query("SELECT plugin FROM pluginschema")
 	c.Assert(err, IsNil)
@@ -0,0 +1,182 @@
+package mup
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// maxNickChain limits how many nick changes PreviousNicks follows.
+const maxNickChain = 100
+
+// trackSession records in the session table what msg reveals about the
+// presence of its sender in the account. A session starts when a nick is
+// first observed, and ends when the nick quits or changes, in which case
+// a new session is started for the new nick pointing to the previous one.
+// The away status announced by the nick is recorded in its session, and
+// carried over when it changes.
+func trackSession(tx *sql.Tx, msg *Message) error {
+	if msg.Playback {
+		// Old news.
+		return nil
+	}
+	if msg.Command == cmdAwayReply && msg.Param1 != "" {
+		// As in ":server 301 mup nick :Gone fishing", in reply to a
+		// message sent to an away nick.
+		return trackAway(tx, &Message{Account: msg.Account, Nick: msg.Param1, Text: msg.Text, Time: msg.Time})
+	}
+	if msg.Nick == "" {
+		return nil
+	}
+	switch msg.Command {
+	case cmdPrivMsg, cmdNotice, cmdJoin:
+		_, err := activeSession(tx, msg)
+		return err
+	case cmdAway:
+		return trackAway(tx, msg)
+	case cmdNick:
+		if msg.Text == "" || msg.Text == msg.Nick {
+			return nil
+		}
+		id, err := activeSession(tx, msg)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE session SET active=0,endtime=? WHERE id=? OR account=? AND nick=? AND active",
+			msg.Time, id, msg.Account, msg.Text)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO session (account,nick,user,host,previd,starttime,lastseen,away,awaytime) "+
+				"SELECT account,?,user,host,id,?,?,away,awaytime FROM session WHERE id=?",
+				msg.Text, msg.Time, msg.Time, id)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot record nick change: %v", err)
+		}
+	case cmdQuit:
+		_, err := tx.Exec("UPDATE session SET active=0,endtime=?,quit=? WHERE account=? AND nick=? AND active",
+			msg.Time, msg.Text, msg.Account, msg.Nick)
+		if err != nil {
+			return fmt.Errorf("cannot record quit: %v", err)
+		}
+	}
+	return nil
+}
+
+// trackAway records the away status announced by the sender of msg, which
+// is back if the message has no text.
+func trackAway(tx *sql.Tx, msg *Message) error {
+	id, err := activeSession(tx, msg)
+	if err != nil {
+		return err
+	}
+	if msg.Text == "" {
+		_, err = tx.Exec("UPDATE session SET away='',awaytime=0 WHERE id=?", id)
+	} else {
+		// Repeated replies do not reset how long the nick has been away.
+		_, err = tx.Exec("UPDATE session SET awaytime=CASE WHEN away='' THEN ? ELSE awaytime END,away=? WHERE id=?",
+			msg.Time, msg.Text, id)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot record away status: %v", err)
+	}
+	return nil
+}
+
+// activeSession returns the id of the active session for the sender of msg,
+// starting one if necessary, and records the sender as last seen at the
+// time of msg.
+func activeSession(tx *sql.Tx, msg *Message) (id int64, err error) {
+	err = tx.QueryRow("SELECT id FROM session WHERE account=? AND nick=? AND active", msg.Account, msg.Nick).Scan(&id)
+	if err == nil {
+		_, err = tx.Exec("UPDATE session SET lastseen=? WHERE id=?", msg.Time, id)
+	} else if err == sql.ErrNoRows {
+		var res sql.Result
+		res, err = tx.Exec("INSERT INTO session (account,nick,user,host,starttime,lastseen) VALUES (?,?,?,?,?,?)",
+			msg.Account, msg.Nick, msg.User, msg.Host, msg.Time, msg.Time)
+		if err == nil {
+			id, err = res.LastInsertId()
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot record session: %v", err)
+	}
+	return id, nil
+}
+
+// PreviousNicks returns the nicks used, most recent first, by whoever now
+// holds the nick in the provided address, as observed via nick changes in
+// the address account since they connected.
+func (p *Plugger) PreviousNicks(a Addressable) ([]string, error) {
+	if p.db == nil {
+		return nil, fmt.Errorf("plugin has no database")
+	}
+	addr := a.Address()
+	var id int64
+	err := p.db.QueryRow("SELECT previd FROM session WHERE account=? AND nick=? AND active", addr.Account, addr.Nick).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	var nicks []string
+	for err == nil && id != 0 && len(nicks) < maxNickChain {
+		var nick string
+		err = p.db.QueryRow("SELECT nick,previd FROM session WHERE id=?", id).Scan(&nick, &id)
+		if err == nil {
+			nicks = append(nicks, nick)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot query previous nicks: %v", err)
+	}
+	return nicks, nil
+}
+
+// Presence describes what is known about the presence of a nick in an
+// account, as observed by the bot.
+type Presence struct {
+	// Online reports whether the nick is believed to be connected, as it
+	// was seen in the account and did not quit or change nicks since.
+	Online bool
+
+	// Away reports whether the nick announced being away, with the
+	// provided AwayMessage, as noticed via IRC away notifications or via
+	// the away reply to a message sent to it. AwayTime is when the bot
+	// first noticed it.
+	Away        bool
+	AwayMessage string
+	AwayTime    time.Time
+
+	// LastSeen is when the nick was last observed sending a message,
+	// joining a channel, or changing its presence. On transports such as
+	// Telegram, which hide the last-seen status from bots, this is the
+	// only evidence of presence available.
+	LastSeen time.Time
+}
+
+// Presence returns what is known about the presence of nick in account,
+// or nil if the nick was never observed there.
+func (p *Plugger) Presence(account, nick string) (*Presence, error) {
+	if p.db == nil {
+		return nil, fmt.Errorf("plugin has no database")
+	}
+	var presence Presence
+	var start, end time.Time
+	err := p.db.QueryRow("SELECT active,away,awaytime,starttime,endtime,lastseen FROM session WHERE account=? AND nick=? ORDER BY id DESC LIMIT 1", account, nick).
+		Scan(&presence.Online, &presence.AwayMessage, &presence.AwayTime, &start, &end, &presence.LastSeen)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot query presence: %v", err)
+	}
+	presence.Away = presence.AwayMessage != ""
+	if !presence.Away {
+		presence.AwayTime = time.Time{}
+	}
+	// Sessions recorded before the last-seen time was tracked.
+	for _, t := range []time.Time{start, end} {
+		if t.After(presence.LastSeen) {
+			presence.LastSeen = t
+		}
+	}
+	return &presence, nil
+}
@@ -0,0 +1,103 @@
+package mup
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"time"
+)
+
+// shardInstance is a live server registered for handling accounts or
+// plugins. Filter holds the names it is configured to handle, as in
+// Config.Accounts and Config.Plugins, and is nil if it handles all.
+type shardInstance struct {
+	name   string
+	filter []string
+}
+
+// registerInstance records in the database that the server with the
+// provided configuration is alive and handling the given role, either
+// "account" or "plugin", with the provided filter. It returns all
+// servers with sharding enabled that are alive and registered for
+// that same role, sorted by name.
+//
+// Registrations expire after the configured LeaseTimeout, so servers
+// that die without unregistering have their accounts and plugins
+// reassigned once that time passes.
+func registerInstance(db *sql.DB, config Config, role string, filter []string) ([]shardInstance, error) {
+	now := time.Now().UTC()
+	var dbfilter sql.NullString
+	if filter != nil {
+		dbfilter = sql.NullString{String: strings.Join(filter, "\n"), Valid: true}
+	}
+	_, err := db.Exec("INSERT OR REPLACE INTO instance (name,role,filter,expires) VALUES (?,?,?,?)", config.Instance, role, dbfilter, now.Add(config.LeaseTimeout))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT name,filter,expires FROM instance WHERE role=?", role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var instances []shardInstance
+	for rows.Next() {
+		var instance shardInstance
+		var expires time.Time
+		if err := rows.Scan(&instance.name, &dbfilter, &expires); err != nil {
+			return nil, err
+		}
+		if !expires.After(now) {
+			continue
+		}
+		if dbfilter.Valid {
+			instance.filter = strings.Split(dbfilter.String, "\n")
+		}
+		instances = append(instances, instance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].name < instances[j].name })
+	return instances, nil
+}
+
+// unregisterInstance removes the named server from the instance
+// registry, so that its accounts and plugins are reassigned right away.
+func unregisterInstance(db *sql.DB, instance string) {
+	_, err := db.Exec("DELETE FROM instance WHERE name=?", instance)
+	if err != nil {
+		logf("Cannot unregister instance %q: %v", instance, err)
+	}
+}
+
+// instanceOwner returns which of instances is responsible for the
+// account or plugin with the provided name, considering only the
+// instances whose filter is accepted by the handles function.
+func instanceOwner(name string, instances []shardInstance, handles func(filter []string, name string) bool) string {
+	var names []string
+	for _, instance := range instances {
+		if handles(instance.filter, name) {
+			names = append(names, instance.name)
+		}
+	}
+	return shardOwner(name, names)
+}
+
+// shardOwner returns which of instances is responsible for the account
+// or plugin with the provided name. Assignments are made via rendezvous
+// hashing, so when an instance comes or goes only the names assigned to
+// that instance change hands.
+func shardOwner(name string, instances []string) string {
+	var owner string
+	var best uint64
+	for _, instance := range instances {
+		sum := sha1.Sum([]byte(instance + "\x00" + name))
+		weight := binary.BigEndian.Uint64(sum[:8])
+		if owner == "" || weight > best {
+			owner, best = instance, weight
+		}
+	}
+	return owner
+}
@@ -2,9 +2,13 @@ package mup
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/tomb.v2"
@@ -18,11 +22,13 @@ type signalClient struct {
 
 	dying   <-chan struct{}
 	info    accountInfo
+	bangs   *bangPrefixes
 	tomb    tomb.Tomb
 	signalR *signalReader
 	signalW *signalWriter
 
 	cliMutex sync.Mutex
+	receipts signalReceipts
 
 	requests chan interface{}
 
@@ -40,6 +46,7 @@ func startSignalClient(info *accountInfo, incoming chan *Message) accountClient
 		accountName: info.Name,
 
 		info:     *info,
+		bangs:    newBangPrefixes("/", info),
 		requests: make(chan interface{}, 1),
 		incoming: incoming,
 		outgoing: make(chan *Message),
@@ -88,23 +95,90 @@ func (c *signalClient) UpdateInfo(info *accountInfo) {
 }
 
 func (c *signalClient) die() {
-	logf("[%s] Cleaning Signal connection resources", c.accountName)
+	accountLogf(c.accountName, "Cleaning Signal connection resources")
 
 	if c.signalW != nil {
 		err := c.signalW.Stop()
 		if err != nil {
-			logf("[%s] Signal writer failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "Signal writer failure: %s", err)
 		}
 	}
 	if c.signalR != nil {
 		err := c.signalR.Stop()
 		if err != nil {
-			logf("[%s] Signal reader failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "Signal reader failure: %s", err)
 		}
 	}
 
 	c.tomb.Kill(nil)
-	logf("[%s] Signal client terminated (%v)", c.accountName, c.tomb.Err())
+	accountLogf(c.accountName, "Signal client terminated (%v)", c.tomb.Err())
+}
+
+// signalConfig holds the Signal-specific settings that may be provided
+// in the account configuration document.
+type signalConfig struct {
+	// Spool is the directory received attachments are moved into.
+	// Attachments are not downloaded when it is empty.
+	Spool string `json:"spool"`
+
+	// DataDir is the signal-cli data directory, under which attachments
+	// are initially downloaded. Defaults to ~/.local/share/signal-cli.
+	DataDir string `json:"datadir"`
+
+	// Receipts delays confirming a sent message until a delivery or
+	// read receipt for it is received, instead of confirming it as soon
+	// as signal-cli returns.
+	Receipts bool `json:"receipts"`
+
+	// Daemon runs a single long-lived signal-cli process in JSON-RPC
+	// mode for both receiving and sending, instead of running a new
+	// signal-cli process for every receive cycle and every message sent.
+	Daemon bool `json:"daemon"`
+
+	// Multiline defines how received messages with several lines are
+	// delivered, as documented for the same Telegram option.
+	Multiline string `json:"multiline"`
+}
+
+func (c *signalClient) config() signalConfig {
+	var config signalConfig
+	if c.info.Config != "" {
+		err := json.Unmarshal([]byte(c.info.Config), &config)
+		if err != nil {
+			accountLogf(c.accountName, "Cannot parse account configuration: %v", err)
+		}
+	}
+	if config.DataDir == "" {
+		config.DataDir = filepath.Join(os.Getenv("HOME"), ".local", "share", "signal-cli")
+	}
+	if !validMultiline(config.Multiline) {
+		accountLogf(c.accountName, "Unknown multiline mode %q; delivering messages whole.", config.Multiline)
+		config.Multiline = multilineKeep
+	}
+	return config
+}
+
+// signalRestartNeeded returns whether the reader and writer must be restarted
+// for the changes between the old and new account information to apply.
+func signalRestartNeeded(old, new *accountInfo) bool {
+	return old.Identity != new.Identity || old.Nick != new.Nick || old.Config != new.Config
+}
+
+func (c *signalClient) startReaderWriter() {
+	config := c.config()
+	c.signalR = startSignalReader(&c.cliMutex, c.accountName, c.info.Identity, c.info.Nick, config, c.bangs, &c.receipts)
+	c.signalW = startSignalWriter(&c.cliMutex, c.accountName, c.info.Identity, config, &c.receipts, c.signalR)
+}
+
+func (c *signalClient) stopReaderWriter() {
+	err := c.signalW.Stop()
+	if err != nil {
+		accountLogf(c.accountName, "Signal writer failure: %s", err)
+	}
+	err = c.signalR.Stop()
+	if err != nil {
+		accountLogf(c.accountName, "Signal reader failure: %s", err)
+	}
 }
 
 func (c *signalClient) run() error {
@@ -115,8 +189,7 @@ func (c *signalClient) run() error {
 		return nil
 	}
 
-	c.signalR = startSignalReader(&c.cliMutex, c.accountName, c.info.Identity, c.info.Nick)
-	c.signalW = startSignalWriter(&c.cliMutex, c.accountName, c.info.Identity, c.signalR)
+	c.startReaderWriter()
 
 	var inMsg, outMsg *Message
 	var inRecv, outRecv <-chan *Message
@@ -152,7 +225,25 @@ func (c *signalClient) run() error {
 		case req := <-c.requests:
 			switch r := req.(type) {
 			case ireqUpdateInfo:
+				old := c.info
 				c.info = *r
+				c.bangs.update(&c.info)
+				if !signalRestartNeeded(&old, &c.info) {
+					break
+				}
+				if c.info.Identity == "" || c.info.Identity[0] != '+' {
+					c.tomb.Killf("account identity is not a phone number: %q", c.info.Identity)
+					break
+				}
+				accountLogf(c.accountName, "Signal account settings changed. Restarting reader and writer.")
+				c.stopReaderWriter()
+				c.startReaderWriter()
+				if inMsg == nil {
+					inRecv = c.signalR.Incoming
+				}
+				if outMsg != nil {
+					outSend = c.signalW.Outgoing
+				}
 			}
 
 		case <-c.dying:
@@ -175,12 +266,19 @@ func (c *signalClient) run() error {
 // ---------------------------------------------------------------------------
 // signalWriter
 
+// signalCommandTimeout defines how long a signal-cli command used to send a
+// message may run before it's killed. signal-cli is slow to start, so it's
+// granted a few times the usual network timeout.
+var signalCommandTimeout = 4 * NetworkTimeout
+
 // An signalWriter reads messages from the Outgoing channel and sends it to the server.
 type signalWriter struct {
 	cliMutex *sync.Mutex
 
 	accountName string
 	identity    string
+	config      signalConfig
+	receipts    *signalReceipts
 	r           *signalReader
 	tomb        tomb.Tomb
 
@@ -188,11 +286,13 @@ type signalWriter struct {
 	Outgoing chan *Message
 }
 
-func startSignalWriter(cliMutex *sync.Mutex, accountName, identity string, r *signalReader) *signalWriter {
+func startSignalWriter(cliMutex *sync.Mutex, accountName, identity string, config signalConfig, receipts *signalReceipts, r *signalReader) *signalWriter {
 	w := &signalWriter{
 		cliMutex:    cliMutex,
 		accountName: accountName,
 		identity:    identity,
+		config:      config,
+		receipts:    receipts,
 		r:           r,
 		Outgoing:    make(chan *Message, 1),
 	}
@@ -206,7 +306,7 @@ func (w *signalWriter) Err() error {
 }
 
 func (w *signalWriter) Stop() error {
-	debugf("[%s] Requesting writer to stop...", w.accountName)
+	accountDebugf(w.accountName, "Requesting writer to stop...")
 	w.tomb.Kill(errStop)
 	err := w.tomb.Wait()
 	if err != errStop {
@@ -229,7 +329,7 @@ func (w *signalWriter) Sendf(format string, args ...interface{}) error {
 }
 
 func (w *signalWriter) die() {
-	debugf("[%s] Writer is dead (%v)", w.accountName, w.tomb.Err())
+	accountDebugf(w.accountName, "Writer is dead (%v)", w.tomb.Err())
 }
 
 func outputErr(output []byte, err error) error {
@@ -264,8 +364,10 @@ loop:
 			continue
 		}
 
-		logf("[%s] Sending: %s", w.accountName, msg.String())
+		accountLogf(w.accountName, "Sending: %s", msg.String())
 
+		// Signal has no equivalent to IRC formatting codes.
+		text := StripFormatting(msg.Text)
 		recipient := msg.Channel
 		if recipient != "" && recipient[0] == '@' {
 			recipient = recipient[1:]
@@ -273,26 +375,54 @@ loop:
 			recipient = recipient[1:]
 		}
 
-		var cmd *exec.Cmd
-		if recipient[0] == '+' {
-			cmd = exec.Command("signal-cli", "-u", w.identity, "send", recipient)
+		var timestamp int64
+		var err error
+		if recipient == "" {
+			err = fmt.Errorf("invalid Signal recipient: %q", msg.Channel)
+		} else if w.r.rpc != nil {
+			timestamp, err = signalSend(w.r.rpc, w.Dying, recipient, text)
+			if _, refused := err.(*jsonRPCError); err != nil && !refused {
+				w.tomb.Killf("cannot send message via signal-cli daemon: %v", err)
+				break
+			}
 		} else {
-			cmd = exec.Command("signal-cli", "-u", w.identity, "send", "-g", recipient)
+			ctx, cancel := context.WithTimeout(w.tomb.Context(nil), signalCommandTimeout)
+			var cmd *exec.Cmd
+			if recipient[0] == '+' {
+				cmd = exec.CommandContext(ctx, "signal-cli", "-u", w.identity, "send", recipient)
+			} else {
+				cmd = exec.CommandContext(ctx, "signal-cli", "-u", w.identity, "send", "-g", recipient)
+			}
+			cmd.Stdin = bytes.NewBufferString(text)
+
+			w.cliMutex.Lock()
+			output, cerr := cmd.CombinedOutput()
+			w.cliMutex.Unlock()
+			cancel()
+			if cerr != nil && !signalPermanent(cerr) {
+				w.tomb.Killf("cannot run signal-cli command for sending: %v", outputErr(output, cerr))
+				break
+			}
+			if cerr != nil {
+				err = outputErr(output, cerr)
+			} else {
+				timestamp, _ = signalSentTimestamp(output)
+			}
 		}
-		cmd.Stdin = bytes.NewBufferString(msg.Text)
 
-		// TODO Kill command if it hangs.
-		w.cliMutex.Lock()
-		output, err := cmd.CombinedOutput()
-		w.cliMutex.Unlock()
-		if err != nil {
-			w.tomb.Killf("cannot run signal-cli command for sending: %v", outputErr(output, err))
-			break
+		if w.config.Receipts && err == nil {
+			// The reader confirms the message once a receipt arrives.
+			if timestamp > 0 {
+				w.receipts.add(timestamp, msg.Id)
+				continue
+			}
+			accountLogf(w.accountName, "Cannot find timestamp of sent message; confirming without receipt.")
 		}
 
-		// Notify the account manager that the message was delivered.
+		// Notify the account manager that the message was delivered,
+		// or that it never will be so it isn't retried.
 		select {
-		case w.r.Incoming <- ParseIncoming(w.accountName, "mup", "/", "PONG :sent:"+strconv.FormatInt(msg.Id, 16)):
+		case w.r.Incoming <- deliveryPong(w.accountName, msg.Id, err):
 		case <-w.Dying:
 		case <-w.r.Dying:
 			break
@@ -302,6 +432,71 @@ loop:
 	return nil
 }
 
+// signalSentTimestamp returns the timestamp signal-cli reports for a sent
+// message, which is printed on a line of its own.
+func signalSentTimestamp(output []byte) (timestamp int64, ok bool) {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		timestamp, err := strconv.ParseInt(strings.TrimSpace(lines[i]), 10, 64)
+		if err == nil && timestamp > 0 {
+			return timestamp, true
+		}
+	}
+	return 0, false
+}
+
+// signalPermanent returns whether err reports a signal-cli failure that
+// retrying won't fix, as signalled by its exit status: 1 for invalid
+// requests such as unknown recipients, and 4 for untrusted identities.
+func signalPermanent(err error) bool {
+	eerr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	code := eerr.ExitCode()
+	return code == 1 || code == 4
+}
+
+// signalReceipts tracks sent messages that are awaiting a delivery or read
+// receipt, indexed by the timestamp that identifies them in Signal.
+type signalReceipts struct {
+	mu        sync.Mutex
+	pending   map[int64]int64
+	confirmed int64
+}
+
+func (rs *signalReceipts) add(timestamp, id int64) {
+	rs.mu.Lock()
+	if rs.pending == nil {
+		rs.pending = make(map[int64]int64)
+	}
+	rs.pending[timestamp] = id
+	rs.mu.Unlock()
+}
+
+// confirm returns the id of the message sent with the provided timestamp,
+// if one is pending. Messages sent before it are implicitly confirmed, and
+// a receipt for a message older than one already confirmed is ignored so
+// the account's last sent id never moves backwards.
+func (rs *signalReceipts) confirm(timestamp int64) (id int64, ok bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	id, ok = rs.pending[timestamp]
+	if !ok {
+		return 0, false
+	}
+	for t, pendingId := range rs.pending {
+		if pendingId <= id {
+			delete(rs.pending, t)
+		}
+	}
+	if id <= rs.confirmed {
+		return 0, false
+	}
+	rs.confirmed = id
+	return id, true
+}
+
 type signalResultStatus struct {
 	Ok          bool   `json:"ok"`
 	ErrorCode   int    `json:"error_code"`
@@ -328,21 +523,31 @@ type signalReader struct {
 	accountName string
 	identity    string
 	activeNick  string
+	config      signalConfig
+	bangs       *bangPrefixes
+	receipts    *signalReceipts
+	rpc         *jsonRPC
 	tomb        tomb.Tomb
 
 	Dying    <-chan struct{}
 	Incoming chan *Message
 }
 
-func startSignalReader(cliMutex *sync.Mutex, accountName, identity, nick string) *signalReader {
+func startSignalReader(cliMutex *sync.Mutex, accountName, identity, nick string, config signalConfig, bangs *bangPrefixes, receipts *signalReceipts) *signalReader {
 	r := &signalReader{
 		cliMutex:    cliMutex,
 		accountName: accountName,
 		identity:    identity,
 		activeNick:  nick,
+		config:      config,
+		bangs:       bangs,
+		receipts:    receipts,
 		Incoming:    make(chan *Message, 1),
 	}
 	r.Dying = r.tomb.Dying()
+	if config.Daemon {
+		r.rpc = newJSONRPC("signal-cli daemon", r.Dying)
+	}
 	r.tomb.Go(r.loop)
 	return r
 }
@@ -352,7 +557,7 @@ func (r *signalReader) Err() error {
 }
 
 func (r *signalReader) Stop() error {
-	debugf("[%s] Requesting Signal reader to stop...", r.accountName)
+	accountDebugf(r.accountName, "Requesting Signal reader to stop...")
 	r.tomb.Kill(errStop)
 	err := r.tomb.Wait()
 	if err != errStop {
@@ -362,7 +567,7 @@ func (r *signalReader) Stop() error {
 }
 
 func (r *signalReader) die() {
-	debugf("[%s] Reader is dead (%v)", r.accountName, r.tomb.Err())
+	accountDebugf(r.accountName, "Reader is dead (%v)", r.tomb.Err())
 }
 
 type signalUpdate struct {
@@ -371,18 +576,24 @@ type signalUpdate struct {
 }
 
 type signalEnvelope struct {
-	Source       string            `json:"source"`
-	SourceDevice int               `json:"sourceDevice"`
-	Timestamp    int64             `json:"timestamp"`
-	IsReceipt    bool              `json:"isReceipt"`
-	DataMessage  signalMessage     `json:"dataMessage"`
-	SyncMessage  signalSyncMessage `json:"syncMessage"`
-	// syncMessage
+	Source         string               `json:"source"`
+	SourceDevice   int                  `json:"sourceDevice"`
+	Timestamp      int64                `json:"timestamp"`
+	IsReceipt      bool                 `json:"isReceipt"`
+	DataMessage    signalMessage        `json:"dataMessage"`
+	SyncMessage    signalSyncMessage    `json:"syncMessage"`
+	ReceiptMessage signalReceiptMessage `json:"receiptMessage"`
 	// callMessage
-	// receiptMessage
 	// relay
 }
 
+type signalReceiptMessage struct {
+	When       int64   `json:"when"`
+	IsDelivery bool    `json:"isDelivery"`
+	IsRead     bool    `json:"isRead"`
+	Timestamps []int64 `json:"timestamps"`
+}
+
 type signalSyncMessage struct {
 	SentMessage signalMessage `json:sentMessage`
 	// blockedNumbers
@@ -391,14 +602,21 @@ type signalSyncMessage struct {
 }
 
 type signalMessage struct {
-	Timestamp   int64           `json:"timestamp"`
-	Message     string          `json:"message"`
-	Destination string          `json:"destination"`
-	GroupInfo   signalGroupInfo `json:"groupInfo"`
-	// attachments
+	Timestamp   int64              `json:"timestamp"`
+	Message     string             `json:"message"`
+	Destination string             `json:"destination"`
+	GroupInfo   signalGroupInfo    `json:"groupInfo"`
+	Attachments []signalAttachment `json:"attachments"`
 	// expiresInSeconds
 }
 
+type signalAttachment struct {
+	Id          string `json:"id"`
+	ContentType string `json:"contentType"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+}
+
 type signalGroupInfo struct {
 	GroupID string `json:"groupId"`
 	// members
@@ -409,6 +627,10 @@ type signalGroupInfo struct {
 func (r *signalReader) loop() error {
 	defer r.die()
 
+	if r.rpc != nil {
+		return r.daemonLoop()
+	}
+
 	var err error
 	var cmd *exec.Cmd
 	var out io.ReadCloser
@@ -435,10 +657,14 @@ func (r *signalReader) loop() error {
 		// This way we don't need to worry about cleanin up on every breakpoint.
 		cleanup()
 
-		cmd = exec.Command("signal-cli", "-u", r.identity, "receive", "--json", "--ignore-attachments")
+		if r.config.Spool != "" {
+			cmd = exec.Command("signal-cli", "-u", r.identity, "receive", "--json")
+		} else {
+			cmd = exec.Command("signal-cli", "-u", r.identity, "receive", "--json", "--ignore-attachments")
+		}
 		out, err = cmd.StdoutPipe()
 		if err != nil {
-			logf("[%s] Cannot open signal-cli output pipe: %v", r.accountName, err)
+			accountLogf(r.accountName, "Cannot open signal-cli output pipe: %v", err)
 			continue
 		}
 
@@ -446,79 +672,246 @@ func (r *signalReader) loop() error {
 		err := cmd.Start()
 		if err != nil {
 			r.cliMutex.Unlock()
-			logf("[%s] Cannot start signal-cli command for receiving: %v", r.accountName, err)
+			accountLogf(r.accountName, "Cannot start signal-cli command for receiving: %v", err)
 			continue
 		}
 		decoder := json.NewDecoder(out)
 		for {
-			var update signalUpdate
 			var data json.RawMessage
 			err = decoder.Decode(&data)
 			if err == io.EOF {
 				break
 			}
 			if err == nil {
-				err = json.Unmarshal(data, &update)
+				err = r.handle(data)
 			}
 			if err != nil {
 				// Something unusual must be wrong.
-				r.tomb.Killf("cannot decode signal-cli payload: %v", err)
+				r.tomb.Kill(err)
 				break
 			}
+		}
+		r.cliMutex.Unlock()
 
-			envelope := update.Envelope
-			source := envelope.Source
-			if source == "" {
-				source = "system"
-			}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
 
-			sync := false
-			message := envelope.DataMessage
-			if message.Timestamp == 0 && envelope.SyncMessage.SentMessage.Timestamp > 0 {
-				sync = true
-				message = envelope.SyncMessage.SentMessage
-			}
+// handle delivers the messages resulting from a single signal-cli payload.
+func (r *signalReader) handle(data json.RawMessage) error {
+	var update signalUpdate
+	err := json.Unmarshal(data, &update)
+	if err != nil {
+		return fmt.Errorf("cannot decode signal-cli payload: %v", err)
+	}
 
-			text := message.Message
-			group := message.GroupInfo.GroupID
+	envelope := update.Envelope
+	source := envelope.Source
+	if source == "" {
+		source = "system"
+	}
 
-			var channel string
-			if sync {
-				channel = "#" + r.identity
-			} else if group != "" {
-				channel = "#" + group
-			} else {
-				channel = "@" + source
-			}
+	sync := false
+	message := envelope.DataMessage
+	if message.Timestamp == 0 && envelope.SyncMessage.SentMessage.Timestamp > 0 {
+		sync = true
+		message = envelope.SyncMessage.SentMessage
+	}
 
-			var msgs []*Message
+	text := message.Message
+	group := message.GroupInfo.GroupID
 
-			line := fmt.Sprintf(":%s!~user@signal SIGNALDATA :%s", source, data)
-			logf("[%s] Received: %s", r.accountName, line)
-			msgs = append(msgs, ParseIncoming(r.accountName, r.activeNick, "/", line))
+	var channel string
+	if sync {
+		channel = "#" + r.identity
+	} else if group != "" {
+		channel = "#" + group
+	} else {
+		channel = "@" + source
+	}
 
-			if text != "" {
-				line = fmt.Sprintf(":%s!~user@signal PRIVMSG %s :%s", source, channel, text)
-				logf("[%s] Received: %s", r.accountName, line)
-				msgs = append(msgs, ParseIncoming(r.accountName, r.activeNick, "/", line))
-			}
+	var msgs []*Message
 
-			for _, msg := range msgs {
-				timestamp := message.Timestamp
-				if timestamp == 0 {
-					timestamp = envelope.Timestamp
-				}
-				msg.Time = time.Unix(0, timestamp*1e6)
+	line := fmt.Sprintf(":%s!~user@signal SIGNALDATA :%s", source, data)
+	accountLogf(r.accountName, "Received: %s", line)
+	msgs = append(msgs, r.bangs.parseIncoming(r.accountName, r.activeNick, line))
 
-				select {
-				case r.Incoming <- msg:
-				case <-r.Dying:
-				}
-			}
+	if text != "" {
+		prefix := fmt.Sprintf(":%s!~user@signal PRIVMSG %s :", source, channel)
+		accountLogf(r.accountName, "Received: %s%s", prefix, text)
+		msgs = append(msgs, parseMultiline(r.config.Multiline, r.accountName, r.activeNick, r.bangs, prefix, text, Attachment{})...)
+	}
+
+	if r.config.Spool != "" {
+		for _, attachment := range message.Attachments {
+			line = fmt.Sprintf(":%s!~user@signal PRIVMSG %s :", source, channel)
+			msg := r.bangs.parseIncoming(r.accountName, r.activeNick, line)
+			msg.Attachment = r.spool(attachment)
+			accountLogf(r.accountName, "Received attachment: %s", msg.Attachment.Path)
+			msgs = append(msgs, msg)
 		}
-		r.cliMutex.Unlock()
+	}
 
-		time.Sleep(100 * time.Millisecond)
+	if envelope.IsReceipt || envelope.ReceiptMessage.IsDelivery || envelope.ReceiptMessage.IsRead {
+		msgs = append(msgs, r.receipt(envelope)...)
+	}
+
+	for _, msg := range msgs {
+		timestamp := message.Timestamp
+		if timestamp == 0 {
+			timestamp = envelope.Timestamp
+		}
+		msg.Time = time.Unix(0, timestamp*1e6)
+
+		select {
+		case r.Incoming <- msg:
+		case <-r.Dying:
+		}
 	}
 	return nil
 }
+
+// spool moves the downloaded attachment file from the signal-cli data
+// directory into the configured spool directory.
+func (r *signalReader) spool(attachment signalAttachment) Attachment {
+	kind := "document"
+	switch {
+	case strings.HasPrefix(attachment.ContentType, "image/"):
+		kind = "photo"
+	case strings.HasPrefix(attachment.ContentType, "audio/"):
+		kind = "audio"
+	case strings.HasPrefix(attachment.ContentType, "video/"):
+		kind = "video"
+	}
+	result := Attachment{
+		Kind:     kind,
+		Id:       attachment.Id,
+		Name:     attachment.Filename,
+		MimeType: attachment.ContentType,
+		Size:     attachment.Size,
+	}
+
+	name := filepath.Base(attachment.Id)
+	if attachment.Filename != "" {
+		name += "-" + filepath.Base(attachment.Filename)
+	}
+	source := filepath.Join(r.config.DataDir, "attachments", filepath.Base(attachment.Id))
+	target := filepath.Join(r.config.Spool, name)
+	err := os.MkdirAll(r.config.Spool, 0700)
+	if err == nil {
+		err = os.Rename(source, target)
+	}
+	if err != nil {
+		accountLogf(r.accountName, "Cannot move attachment into spool directory: %v", err)
+		return result
+	}
+	result.Path = target
+	return result
+}
+
+// receipt returns the messages confirming delivery of the sent messages
+// referenced by the receipt envelope.
+func (r *signalReader) receipt(envelope signalEnvelope) []*Message {
+	timestamps := envelope.ReceiptMessage.Timestamps
+	if len(timestamps) == 0 && envelope.IsReceipt {
+		// Older signal-cli releases report the sent message
+		// timestamp as the timestamp of the envelope itself.
+		timestamps = []int64{envelope.Timestamp}
+	}
+	var msgs []*Message
+	for _, timestamp := range timestamps {
+		accountDebugf(r.accountName, "Received receipt from %s for message sent at %d", envelope.Source, timestamp)
+		if !r.config.Receipts {
+			continue
+		}
+		if id, ok := r.receipts.confirm(timestamp); ok {
+			msgs = append(msgs, deliveryPong(r.accountName, id, nil))
+		}
+	}
+	return msgs
+}
+
+// daemonLoop runs signal-cli in JSON-RPC mode, delivering received messages
+// as they arrive and dispatching the responses to requests made via r.rpc.
+func (r *signalReader) daemonLoop() error {
+	args := []string{"-u", r.identity, "jsonRpc"}
+	if r.config.Spool == "" {
+		args = append(args, "--ignore-attachments")
+	}
+	cmd := exec.Command("signal-cli", args...)
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("cannot open signal-cli input pipe: %v", err)
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cannot open signal-cli output pipe: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("cannot start signal-cli daemon: %v", err)
+	}
+	defer func() {
+		input.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	r.tomb.Go(func() error {
+		// Interrupt the decoder below when stopping.
+		<-r.Dying
+		cmd.Process.Kill()
+		return nil
+	})
+
+	accountLogf(r.accountName, "Started signal-cli daemon.")
+	r.rpc.start(input)
+
+	decoder := json.NewDecoder(output)
+	for {
+		var data json.RawMessage
+		err := decoder.Decode(&data)
+		if !r.tomb.Alive() {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("signal-cli daemon terminated unexpectedly")
+		}
+		var msg jsonRPCMessage
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot decode signal-cli payload: %v", err)
+		}
+		switch {
+		case msg.Method == "receive":
+			err = r.handle(msg.Params)
+			if err != nil {
+				return err
+			}
+		case msg.Id != nil:
+			r.rpc.dispatch(&msg)
+		default:
+			accountDebugf(r.accountName, "Ignoring signal-cli payload: %s", data)
+		}
+	}
+	panic("unreachable")
+}
+
+// signalSend sends text via the signal-cli daemon to the recipient, either a
+// phone number or a group id, and returns the timestamp that identifies the
+// sent message.
+func signalSend(rpc *jsonRPC, dying <-chan struct{}, recipient, text string) (timestamp int64, err error) {
+	params := map[string]interface{}{"message": text}
+	if recipient[0] == '+' {
+		params["recipient"] = []string{recipient}
+	} else {
+		params["groupId"] = recipient
+	}
+	var result struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	err = rpc.call(dying, "send", params, &result)
+	return result.Timestamp, err
+}
@@ -426,3 +426,222 @@ func (s *SignalSuite) TestOutgoing(c *C) {
 		{"Hello again!", "signal-cli", "-u", "+55555", "send", "+12345"},
 	})
 }
+
+func (s *SignalSuite) TestOutgoingFailure(c *C) {
+	s.FakeCLI(c, `test "$3" = send && test "$4" = +999 && { echo "Unregistered user: +999"; exit 1; }; exit 0`)
+
+	// Ensure messages are only inserted after plugin has been loaded.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@+999','nick','Rejected.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@+12345','nick','Hello there.')`,
+	)
+	var lastId int64
+	err := s.db.QueryRow("SELECT MAX(id) FROM message WHERE lane=2").Scan(&lastId)
+	c.Assert(err, IsNil)
+
+	// Messages refused by signal-cli are reported as failed, and the
+	// account moves on without retrying them.
+	s.AssertCLI(c, "send", [][]string{
+		{"Rejected.", "signal-cli", "-u", "+55555", "send", "+999"},
+		{"Hello there.", "signal-cli", "-u", "+55555", "send", "+12345"},
+	})
+	var gotId int64
+	for i := 0; i < 100; i++ {
+		err = s.db.QueryRow("SELECT lastid FROM account WHERE name='one'").Scan(&gotId)
+		c.Assert(err, IsNil)
+		if gotId == lastId {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(gotId, Equals, lastId)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Cannot deliver message \d+: Unregistered user: \+999\n.*`)
+}
+
+func (s *SignalSuite) waitReceive(c *C, args ...string) {
+	want := append([]string{"", "signal-cli", "-u", "+55555", "receive"}, args...)
+	for i := 0; i < 100; i++ {
+		calls := s.CLI(c, "receive")
+		if len(calls) > 0 && fmt.Sprint(calls[len(calls)-1]) == fmt.Sprint(want) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Fatalf("signal-cli never called with: %q", want)
+}
+
+func (s *SignalSuite) TestAttachments(c *C) {
+	spool := c.MkDir()
+	datadir := c.MkDir()
+	err := os.MkdirAll(filepath.Join(datadir, "attachments"), 0700)
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(datadir, "attachments", "A1B2"), []byte("cat"), 0600)
+	c.Assert(err, IsNil)
+
+	config, err := json.Marshal(mup.Map{"spool": spool, "datadir": datadir})
+	c.Assert(err, IsNil)
+	_, err = s.db.Exec(`UPDATE account SET config=? WHERE name='one'`, string(config))
+	c.Assert(err, IsNil)
+	s.server.RefreshAccounts()
+
+	// Attachments must only be delivered to the restarted reader.
+	s.waitReceive(c, "--json")
+
+	update := `{"envelope":{"source":"+12345","timestamp":1586383094999,"dataMessage":{` +
+		`"timestamp":1586383094999,"message":"","attachments":[` +
+		`{"contentType":"image/jpeg","filename":"cat.jpg","id":"A1B2","size":3}]}}}`
+	s.FakeCLI(c, `test "$3" = receive || exit 0`, update)
+
+	var msg mup.Message
+	for i := 0; i < 100; i++ {
+		err = s.db.QueryRow("SELECT nick,command,channel,text,attachment FROM message WHERE attachment!=''").Scan(
+			&msg.Nick, &msg.Command, &msg.Channel, &msg.Text, &msg.Attachment)
+		if err != sql.ErrNoRows {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(err, IsNil)
+
+	path := filepath.Join(spool, "A1B2-cat.jpg")
+	c.Assert(msg, DeepEquals, mup.Message{
+		Nick:    "+12345",
+		Command: "PRIVMSG",
+		Channel: "@+12345",
+		Attachment: mup.Attachment{
+			Kind:     "photo",
+			Id:       "A1B2",
+			Name:     "cat.jpg",
+			MimeType: "image/jpeg",
+			Size:     3,
+			Path:     path,
+		},
+	})
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "cat")
+	_, err = os.Stat(filepath.Join(datadir, "attachments", "A1B2"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *SignalSuite) TestReceipts(c *C) {
+	execSQL(c, s.db, `UPDATE account SET config='{"receipts": true}' WHERE name='one'`)
+	s.server.RefreshAccounts()
+
+	s.FakeCLI(c, `test "$3" = send && echo 1586383095000; exit 0`)
+
+	var lastId int64
+	err := s.db.QueryRow("SELECT lastid FROM account WHERE name='one'").Scan(&lastId)
+	c.Assert(err, IsNil)
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@+12345','nick','Hello there.')`,
+	)
+	var sentId int64
+	err = s.db.QueryRow("SELECT id FROM message WHERE lane=2").Scan(&sentId)
+	c.Assert(err, IsNil)
+
+	s.AssertCLI(c, "send", [][]string{
+		{"Hello there.", "signal-cli", "-u", "+55555", "send", "+12345"},
+	})
+
+	// The message is only confirmed once the receipt arrives.
+	time.Sleep(200 * time.Millisecond)
+	var gotId int64
+	err = s.db.QueryRow("SELECT lastid FROM account WHERE name='one'").Scan(&gotId)
+	c.Assert(err, IsNil)
+	c.Assert(gotId, Equals, lastId)
+
+	update := `{"envelope":{"source":"+12345","timestamp":1586383096000,"receiptMessage":{` +
+		`"when":1586383096000,"isDelivery":true,"isRead":false,"timestamps":[1586383095000]}}}`
+	s.FakeCLI(c, `test "$3" = receive || exit 0`, update)
+
+	for i := 0; i < 100; i++ {
+		err = s.db.QueryRow("SELECT lastid FROM account WHERE name='one'").Scan(&gotId)
+		c.Assert(err, IsNil)
+		if gotId == sentId {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(gotId, Equals, sentId)
+}
+
+// FakeDaemon installs a fake signal-cli that acts as a JSON-RPC daemon,
+// printing the provided notifications and then responding to every
+// request read with a successful result. Requests are logged to rpc.txt.
+func (s *SignalSuite) FakeDaemon(c *C, notifications ...string) {
+	script := "#!/bin/bash\ntest \"$3\" = jsonRpc || exit 0\n" +
+		"{ echo -n ';'; echo -n $(basename $0); printf \";%s\" \"$@\"; echo; } >> $(dirname $0)/calls.txt\n"
+	for _, notification := range notifications {
+		script += "cat <<__OUTPUT_END__\n" + notification + "\n__OUTPUT_END__\n"
+	}
+	script += "while read -r line; do\n" +
+		"echo \"$line\" >> $(dirname $0)/rpc.txt\n" +
+		"id=${line##*\\\"id\\\":}; id=${id%\\}}\n" +
+		"echo \"{\\\"jsonrpc\\\":\\\"2.0\\\",\\\"result\\\":{\\\"timestamp\\\":1586383095000},\\\"id\\\":$id}\"\n" +
+		"done\n"
+	filename := filepath.Join(s.bindir, "signal-cli")
+	err := ioutil.WriteFile(filename+".tmp", []byte(script), 0755)
+	c.Assert(err, IsNil)
+	err = os.Rename(filename+".tmp", filename)
+	c.Assert(err, IsNil)
+}
+
+func (s *SignalSuite) TestDaemon(c *C) {
+	rpcfile := filepath.Join(s.bindir, "rpc.txt")
+	defer os.Remove(rpcfile)
+
+	var buf bytes.Buffer
+	err := json.Compact(&buf, []byte(signalIncomingTests[0].update))
+	c.Assert(err, IsNil)
+	notification := `{"jsonrpc":"2.0","method":"receive","params":` + buf.String() + `}`
+	s.FakeDaemon(c, notification)
+
+	execSQL(c, s.db, `UPDATE account SET config='{"daemon": true}' WHERE name='one'`)
+	s.server.RefreshAccounts()
+
+	var text string
+	for i := 0; i < 100; i++ {
+		err = s.db.QueryRow("SELECT text FROM message WHERE command='PRIVMSG'").Scan(&text)
+		if err != sql.ErrNoRows {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(err, IsNil)
+	c.Assert(text, Equals, "Hello mup!")
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@+12345','nick','Hello there.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','#AABBCCDD==','nick','Group chat.')`,
+	)
+	var sentId int64
+	err = s.db.QueryRow("SELECT id FROM message WHERE lane=2 ORDER BY id DESC").Scan(&sentId)
+	c.Assert(err, IsNil)
+
+	var lastId int64
+	for i := 0; i < 100; i++ {
+		err = s.db.QueryRow("SELECT lastid FROM account WHERE name='one'").Scan(&lastId)
+		c.Assert(err, IsNil)
+		if lastId == sentId {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(lastId, Equals, sentId)
+
+	data, err := ioutil.ReadFile(rpcfile)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, ""+
+		`{"jsonrpc":"2.0","method":"send","params":{"message":"Hello there.","recipient":["+12345"]},"id":1}`+"\n"+
+		`{"jsonrpc":"2.0","method":"send","params":{"groupId":"AABBCCDD==","message":"Group chat."},"id":2}`+"\n")
+
+	// A single process serves both receiving and sending.
+	s.AssertCLI(c, "jsonRpc", [][]string{
+		{"", "signal-cli", "-u", "+55555", "jsonRpc", "--ignore-attachments"},
+	})
+}
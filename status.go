@@ -0,0 +1,96 @@
+package mup
+
+import (
+	"sort"
+	"time"
+)
+
+// Status holds the state of the accounts and plugins a server is responsible for.
+type Status struct {
+	Accounts []AccountStatus `json:"accounts"`
+	Plugins  []PluginStatus  `json:"plugins"`
+}
+
+// AccountStatus holds the state of an account handled by a server.
+type AccountStatus struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+
+	// Connected reports whether the account client is running and,
+	// for IRC accounts, whether it has completed authentication.
+	Connected bool `json:"connected"`
+
+	// Nick is the nick the account is currently using, if known.
+	Nick string `json:"nick,omitempty"`
+
+	// ConfigNick is the nick the account is configured to use. It differs
+	// from Nick while the nick is taken, and IRC accounts try to regain it.
+	ConfigNick string `json:"confignick,omitempty"`
+
+	// Channels holds the channels the account has joined, for the
+	// account kinds that report joins.
+	Channels []string `json:"channels,omitempty"`
+
+	// LastMessage is when a message was last received from the account,
+	// including protocol chatter such as replies to keep-alive pings.
+	LastMessage time.Time `json:"lastmessage"`
+
+	// Support holds the features advertised by IRC servers.
+	Support *ServerSupport `json:"support,omitempty"`
+}
+
+// accountStaleTimeout is how long an IRC account may go without
+// receiving any messages before it's considered unhealthy. IRC clients
+// ping the server every third of NetworkTimeout, so a much longer
+// silence means the connection is wedged.
+var accountStaleTimeout = 3 * NetworkTimeout
+
+// Healthy returns whether the account is connected and, for IRC accounts,
+// whether it has received messages recently.
+func (s *AccountStatus) Healthy() bool {
+	if !s.Connected {
+		return false
+	}
+	if s.Kind == "irc" || s.Kind == "" {
+		return time.Since(s.LastMessage) < accountStaleTimeout
+	}
+	return true
+}
+
+// PluginStatus holds the state of a plugin handled by a server.
+type PluginStatus struct {
+	Name      string `json:"name"`
+	Running   bool   `json:"running"`
+	LastError string `json:"lasterror,omitempty"`
+	LastId    int64  `json:"lastid"`
+
+	// Restarts is how many times the plugin was restarted after
+	// panicking or hanging while handling a message.
+	Restarts int `json:"restarts,omitempty"`
+}
+
+// Healthy returns whether all accounts and plugins in the status are healthy.
+func (s *Status) Healthy() bool {
+	for i := range s.Accounts {
+		if !s.Accounts[i].Healthy() {
+			return false
+		}
+	}
+	for i := range s.Plugins {
+		if !s.Plugins[i].Running {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the current state of all accounts and plugins the
+// server is responsible for, sorted by name.
+func (st *Server) Status() *Status {
+	status := &Status{
+		Accounts: st.accountManager.Status(),
+		Plugins:  st.pluginManager.Status(),
+	}
+	sort.Slice(status.Plugins, func(i, j int) bool { return status.Plugins[i].Name < status.Plugins[j].Name })
+	return status
+}
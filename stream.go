@@ -0,0 +1,238 @@
+package mup
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// streamPollDelay is how often message streams look for new messages.
+const streamPollDelay = 100 * time.Millisecond
+
+// streamBatch is the maximum number of messages retrieved at once.
+const streamBatch = 100
+
+// streamMessage is the JSON document sent over message streams.
+type streamMessage struct {
+	Id         int64       `json:"id"`
+	Time       time.Time   `json:"time"`
+	Direction  string      `json:"direction"`
+	Account    string      `json:"account"`
+	Channel    string      `json:"channel,omitempty"`
+	Nick       string      `json:"nick,omitempty"`
+	User       string      `json:"user,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	Command    string      `json:"command"`
+	Text       string      `json:"text,omitempty"`
+	BotText    string      `json:"bottext,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+func newStreamMessage(msg *Message) *streamMessage {
+	smsg := &streamMessage{
+		Id:        msg.Id,
+		Time:      msg.Time,
+		Direction: "incoming",
+		Account:   msg.Account,
+		Channel:   msg.Channel,
+		Nick:      msg.Nick,
+		User:      msg.User,
+		Host:      msg.Host,
+		Command:   msg.Command,
+		Text:      msg.Text,
+		BotText:   msg.BotText,
+	}
+	// Outgoing messages are handed back to plugins without a bot nick
+	// once they are sent.
+	if msg.AsNick == "" {
+		smsg.Direction = "outgoing"
+	}
+	if smsg.Command == "" {
+		smsg.Command = cmdPrivMsg
+	}
+	if msg.Attachment.Kind != "" {
+		smsg.Attachment = &msg.Attachment
+	}
+	return smsg
+}
+
+// streamFilter holds the options of a message stream, as provided
+// in the query string of its URL.
+type streamFilter struct {
+	accounts  []string
+	channels  []string
+	direction string
+	after     int64
+}
+
+func parseStreamFilter(query url.Values) (*streamFilter, error) {
+	f := &streamFilter{
+		accounts:  query["account"],
+		channels:  query["channel"],
+		direction: query.Get("direction"),
+		after:     -1,
+	}
+	if f.direction != "" && f.direction != "incoming" && f.direction != "outgoing" {
+		return nil, fmt.Errorf("direction must be incoming or outgoing, got %q", f.direction)
+	}
+	if after := query.Get("after"); after != "" {
+		id, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid message id in after parameter: %q", after)
+		}
+		f.after = id
+	}
+	return f, nil
+}
+
+// fetch returns the messages matching the filter with ids above lastId.
+func (f *streamFilter) fetch(db *sql.DB, lastId int64) ([]*Message, error) {
+	query := "SELECT " + messageColumns + " FROM message WHERE id>? AND lane=1"
+	args := []interface{}{lastId}
+	for _, in := range []struct {
+		column string
+		values []string
+	}{{"account", f.accounts}, {"channel", f.channels}} {
+		if len(in.values) == 0 {
+			continue
+		}
+		query += " AND " + in.column + " IN (" + strings.TrimSuffix(strings.Repeat("?,", len(in.values)), ",") + ")"
+		for _, value := range in.values {
+			args = append(args, value)
+		}
+	}
+	switch f.direction {
+	case "incoming":
+		query += " AND asnick!=''"
+	case "outgoing":
+		query += " AND asnick=''"
+	}
+	query += " ORDER BY id LIMIT " + strconv.Itoa(streamBatch)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(msg.refs(0)...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, rows.Close()
+}
+
+// streamHandler returns the handler of WebSocket connections that stream
+// messages as they flow in and out of the bot, as JSON documents.
+// The stream may be filtered by providing one or more account and channel
+// parameters, and a direction of either incoming or outgoing. Messages
+// are streamed from the time the connection is established, unless the
+// after parameter holds the id of the last message seen by the client.
+// Clients must authenticate with the configured StreamToken.
+// Streams end when dying is closed.
+func (st *Server) streamHandler(dying <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if st.config.StreamToken == "" {
+			http.Error(w, "message streaming is disabled", http.StatusNotFound)
+			return
+		}
+		if !checkStreamToken(r, st.config.StreamToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing stream token", http.StatusUnauthorized)
+			return
+		}
+		filter, err := parseStreamFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		server := websocket.Server{
+			Handshake: checkStreamOrigin,
+			Handler:   func(ws *websocket.Conn) { st.serveStream(ws, filter, dying) },
+		}
+		server.ServeHTTP(w, r)
+	})
+}
+
+// checkStreamToken reports whether r holds token as its bearer token.
+func checkStreamToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) == 1
+}
+
+// checkStreamOrigin refuses connections established by web pages served
+// from other hosts, so that these can't read the message flow via the
+// browsers of people with access to the HTTP server.
+func checkStreamOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("origin %q not allowed", origin)
+	}
+	return nil
+}
+
+func (st *Server) serveStream(ws *websocket.Conn, filter *streamFilter, dying <-chan struct{}) {
+	defer ws.Close()
+
+	lastId := filter.after
+	if lastId < 0 {
+		var err error
+		lastId, err = latestMsgId(st.config.DB)
+		if err != nil {
+			logf("Cannot stream messages: %v", err)
+			return
+		}
+	}
+
+	// The HTTP server timeouts do not apply to long lived streams.
+	ws.SetDeadline(time.Time{})
+
+	// Nothing is expected from the client, but reading is necessary
+	// to notice when the connection is closed.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+
+	for {
+		msgs, err := filter.fetch(st.config.DB, lastId)
+		if err != nil {
+			logf("Cannot stream messages: %v", err)
+			return
+		}
+		for _, msg := range msgs {
+			ws.SetWriteDeadline(time.Now().Add(NetworkTimeout))
+			if err := websocket.JSON.Send(ws, newStreamMessage(msg)); err != nil {
+				return
+			}
+			lastId = msg.Id
+		}
+		if len(msgs) == streamBatch {
+			continue
+		}
+		select {
+		case <-time.After(streamPollDelay):
+		case <-closed:
+			return
+		case <-dying:
+			return
+		}
+	}
+}
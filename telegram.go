@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 
+	"gopkg.in/mup.v0/schema"
 	"gopkg.in/tomb.v2"
 )
 
@@ -20,10 +22,13 @@ type tgClient struct {
 
 	dying <-chan struct{}
 	info  accountInfo
+	bangs *bangPrefixes
 	tomb  tomb.Tomb
 	tgR   *tgReader
 	tgW   *tgWriter
 
+	commands []tgBotCommand
+
 	requests chan interface{}
 
 	incoming chan *Message
@@ -40,6 +45,8 @@ func startTgClient(info *accountInfo, incoming chan *Message) accountClient {
 		accountName: info.Name,
 
 		info:     *info,
+		bangs:    newBangPrefixes("/", info),
+		commands: tgBotCommands(info.Commands),
 		requests: make(chan interface{}, 1),
 		incoming: incoming,
 		outgoing: make(chan *Message),
@@ -88,45 +95,120 @@ func (c *tgClient) UpdateInfo(info *accountInfo) {
 }
 
 func (c *tgClient) die() {
-	logf("[%s] Cleaning Telegram connection resources", c.accountName)
+	accountLogf(c.accountName, "Cleaning Telegram connection resources")
+	c.stopReaderWriter()
+	c.tomb.Kill(nil)
+	accountLogf(c.accountName, "Telegram client terminated (%v)", c.tomb.Err())
+}
+
+// tgConfig holds the Telegram-specific settings that may be provided
+// in the account configuration document.
+type tgConfig struct {
+	// PollTimeout is how long each getUpdates request waits for
+	// updates to arrive before returning an empty result.
+	PollTimeout DurationString `json:"polltimeout"`
+
+	// PollLimit is the maximum number of updates retrieved at once.
+	PollLimit int `json:"polllimit"`
+
+	// ParseMode is the Telegram formatting mode for outgoing messages,
+	// such as "MarkdownV2" or "HTML". Messages are sent as plain text
+	// when it is empty.
+	ParseMode string `json:"parsemode"`
+
+	// Multiline defines how received messages with several lines are
+	// delivered: "split" delivers each line as a separate message, and
+	// "first" considers only the first line as the message text, with
+	// the remaining lines attached as a "text" attachment. By default
+	// the whole text is delivered in a single message.
+	Multiline string `json:"multiline"`
+}
+
+const tgDefaultPollTimeout = 3 * time.Second
+
+func (c *tgClient) config() tgConfig {
+	var config tgConfig
+	if c.info.Config != "" {
+		err := json.Unmarshal([]byte(c.info.Config), &config)
+		if err != nil {
+			accountLogf(c.accountName, "Cannot parse account configuration: %v", err)
+		}
+	}
+	if config.PollTimeout.Duration <= 0 {
+		config.PollTimeout.Duration = tgDefaultPollTimeout
+	}
+	if !validMultiline(config.Multiline) {
+		accountLogf(c.accountName, "Unknown multiline mode %q; delivering messages whole.", config.Multiline)
+		config.Multiline = multilineKeep
+	}
+	return config
+}
+
+// tgRestartNeeded returns whether the reader and writer must be restarted
+// for the changes between the old and new account information to apply.
+func tgRestartNeeded(old, new *accountInfo) bool {
+	return old.Host != new.Host || old.Password != new.Password || old.Config != new.Config
+}
+
+func (c *tgClient) startReaderWriter(lastUpdateId int64) {
+	apiPrefix := tgBotPrefix
+	if c.info.Host != "" {
+		apiPrefix = "http://" + c.info.Host + "/bot"
+	}
+
+	config := c.config()
+	c.tgR = startTgReader(c.accountName, apiPrefix, c.info.Password, config, c.bangs, lastUpdateId)
+	c.tgW = startTgWriter(c.accountName, apiPrefix, c.info.Password, config, c.tgR)
+	if len(c.commands) > 0 {
+		c.tgW.SetCommands(c.commands)
+	}
+}
 
+func (c *tgClient) stopReaderWriter() {
 	if c.tgW != nil {
 		err := c.tgW.Stop()
 		if err != nil {
-			logf("[%s] Telegram writer failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "Telegram writer failure: %s", err)
 		}
 	}
 	if c.tgR != nil {
 		err := c.tgR.Stop()
 		if err != nil {
-			logf("[%s] Telegram reader failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "Telegram reader failure: %s", err)
 		}
 	}
-
-	c.tomb.Kill(nil)
-	logf("[%s] Telegram client terminated (%v)", c.accountName, c.tomb.Err())
 }
 
 func (c *tgClient) run() error {
 	defer c.die()
 
-	apiPrefix := tgBotPrefix
-	if c.info.Host != "" {
-		apiPrefix = "http://" + c.info.Host + "/bot"
-	}
-
-	c.tgR = startTgReader(c.accountName, apiPrefix, c.info.Password)
-	c.tgW = startTgWriter(c.accountName, apiPrefix, c.info.Password, c.tgR)
+	c.startReaderWriter(0)
 
 	var inMsg, outMsg *Message
 	var inRecv, outRecv <-chan *Message
 	var inSend, outSend chan<- *Message
 
+	// Messages left behind by a reader and writer that were restarted.
+	var inBacklog, outBacklog []*Message
+
 	inRecv = c.tgR.Incoming
 	outRecv = c.outgoing
 
 	quitting := false
 	for {
+		if inMsg == nil && len(inBacklog) > 0 {
+			inMsg = inBacklog[0]
+			inBacklog = inBacklog[1:]
+			inRecv = nil
+			inSend = c.incoming
+		}
+		if outMsg == nil && len(outBacklog) > 0 {
+			outMsg = outBacklog[0]
+			outBacklog = outBacklog[1:]
+			outRecv = nil
+			outSend = c.tgW.Outgoing
+		}
+
 		select {
 		case inMsg = <-inRecv:
 			inRecv = nil
@@ -152,8 +234,54 @@ func (c *tgClient) run() error {
 		case req := <-c.requests:
 			switch r := req.(type) {
 			case ireqUpdateInfo:
-				// TODO Restart if API key changes.
+				old := c.info
 				c.info = *r
+				c.bangs.update(&c.info)
+				commands := tgBotCommands(c.info.Commands)
+				changed := !reflect.DeepEqual(commands, c.commands)
+				c.commands = commands
+				if !tgRestartNeeded(&old, &c.info) {
+					if changed {
+						c.tgW.SetCommands(commands)
+					}
+					break
+				}
+				accountLogf(c.accountName, "Telegram account settings changed. Restarting reader and writer.")
+				c.stopReaderWriter()
+				// Updates already counted in lastUpdateId and delivery
+				// reports may be left buffered, and outgoing messages
+				// not yet taken by the writer must still be sent.
+				select {
+				case msg := <-c.tgR.Incoming:
+					inBacklog = append(inBacklog, msg)
+				default:
+				}
+				if c.tgW.unreported != nil {
+					inBacklog = append(inBacklog, c.tgW.unreported)
+				}
+				select {
+				case msg := <-c.tgW.Outgoing:
+					outBacklog = append(outBacklog, msg)
+					if outMsg != nil {
+						outBacklog = append(outBacklog, outMsg)
+						outMsg = nil
+						outRecv = c.outgoing
+						outSend = nil
+					}
+				default:
+				}
+				// Updates pending for the same bot must not be consumed twice.
+				var lastUpdateId int64
+				if old.Password == c.info.Password {
+					lastUpdateId = c.tgR.lastUpdateId
+				}
+				c.startReaderWriter(lastUpdateId)
+				if inMsg == nil {
+					inRecv = c.tgR.Incoming
+				}
+				if outMsg != nil {
+					outSend = c.tgW.Outgoing
+				}
 			}
 
 		case <-c.dying:
@@ -181,19 +309,28 @@ type tgWriter struct {
 	accountName string
 	apiPrefix   string
 	apiKey      string
+	config      tgConfig
 	r           *tgReader
 	tomb        tomb.Tomb
 
+	commands chan []tgBotCommand
+
+	// unreported holds the delivery report that couldn't be handed
+	// to the reader because the writer was stopped.
+	unreported *Message
+
 	Dying    <-chan struct{}
 	Outgoing chan *Message
 }
 
-func startTgWriter(accountName, apiPrefix, apiKey string, r *tgReader) *tgWriter {
+func startTgWriter(accountName, apiPrefix, apiKey string, config tgConfig, r *tgReader) *tgWriter {
 	w := &tgWriter{
 		accountName: accountName,
 		apiPrefix:   apiPrefix,
 		apiKey:      apiKey,
+		config:      config,
 		r:           r,
+		commands:    make(chan []tgBotCommand, 1),
 		Outgoing:    make(chan *Message, 1),
 	}
 	w.Dying = w.tomb.Dying()
@@ -206,7 +343,7 @@ func (w *tgWriter) Err() error {
 }
 
 func (w *tgWriter) Stop() error {
-	debugf("[%s] Requesting writer to stop...", w.accountName)
+	accountDebugf(w.accountName, "Requesting writer to stop...")
 	w.tomb.Kill(errStop)
 	err := w.tomb.Wait()
 	if err != errStop {
@@ -228,8 +365,19 @@ func (w *tgWriter) Sendf(format string, args ...interface{}) error {
 	return w.Send(ParseOutgoing(w.accountName, fmt.Sprintf(format, args...)))
 }
 
+// SetCommands requests the writer to replace the bot commands offered
+// to users by the provided ones. A pending request not yet handled by
+// the writer is dropped in favor of the new one.
+func (w *tgWriter) SetCommands(commands []tgBotCommand) {
+	select {
+	case <-w.commands:
+	default:
+	}
+	w.commands <- commands
+}
+
 func (w *tgWriter) die() {
-	debugf("[%s] Writer is dead (%v)", w.accountName, w.tomb.Err())
+	accountDebugf(w.accountName, "Writer is dead (%v)", w.tomb.Err())
 }
 
 func (w *tgWriter) loop() error {
@@ -240,19 +388,22 @@ loop:
 		var msg *Message
 		select {
 		case msg = <-w.Outgoing:
+		case commands := <-w.commands:
+			w.setCommands(commands)
+			continue
 		case <-w.Dying:
 			break loop
 		}
 		switch msg.Command {
 		case cmdQuit:
 			break loop
-		case "", cmdPrivMsg, cmdNotice:
+		case "", cmdPrivMsg, cmdNotice, cmdReact:
 			break
 		default:
 			continue
 		}
 
-		logf("[%s] Sending: %s", w.accountName, msg.String())
+		accountLogf(w.accountName, "Sending: %s", msg.String())
 
 		var err error
 		var chatId int64
@@ -263,44 +414,202 @@ loop:
 			}
 		}
 		if chatId == 0 || err != nil {
-			logf("[%s] Outgoing Telegram message with invalid channel: %q", w.accountName, msg.Channel)
-			continue
+			err = fmt.Errorf("invalid Telegram channel: %q", msg.Channel)
+		} else {
+			method, params := "sendMessage", w.messageParams(chatId, msg)
+			switch {
+			case msg.Command == cmdReact:
+				method, params = "setMessageReaction", tgReactionParams(chatId, msg)
+			case msg.Attachment.Kind == "photo" && msg.Attachment.Id != "":
+				method, params = "sendPhoto", tgPhotoParams(params, msg)
+			}
+			var resp *http.Response
+			resp, err = httpClient.PostForm(w.apiPrefix+w.apiKey+"/"+method, params)
+			if err != nil {
+				w.tomb.Kill(err)
+				break
+			}
+			decoder := json.NewDecoder(resp.Body)
+
+			var result tgResultStatus
+			err = decoder.Decode(&result)
+			resp.Body.Close()
+			if err != nil {
+				w.tomb.Kill(err)
+				break
+			}
+			err = result.err()
+			if err != nil && !result.permanent() {
+				w.tomb.Killf("on %s: %v", method, err)
+				break
+			}
 		}
 
-		params := url.Values{
-			"chat_id":                  []string{strconv.FormatInt(chatId, 10)},
-			"text":                     []string{msg.Text},
-			"disable_web_page_preview": []string{"true"},
-		}
-		resp, err := httpClient.PostForm(w.apiPrefix+w.apiKey+"/sendMessage", params)
-		if err != nil {
-			w.tomb.Kill(err)
+		// Notify the account manager that the message was delivered,
+		// or that it never will be so it isn't retried.
+		pong := deliveryPong(w.accountName, msg.Id, err)
+		select {
+		case w.r.Incoming <- pong:
+		case <-w.Dying:
+			w.unreported = pong
+			break loop
+		case <-w.r.Dying:
 			break
 		}
-		decoder := json.NewDecoder(resp.Body)
+	}
 
-		var result tgResultStatus
-		err = decoder.Decode(&result)
-		resp.Body.Close()
-		if err != nil {
-			w.tomb.Kill(err)
-			break
+	return nil
+}
+
+// messageParams returns the sendMessage parameters for delivering msg
+// to the chat with the provided id.
+func (w *tgWriter) messageParams(chatId int64, msg *Message) url.Values {
+	text, parseMode := tgFormat(msg.Text, w.config.ParseMode)
+	params := url.Values{
+		"chat_id":                  []string{strconv.FormatInt(chatId, 10)},
+		"text":                     []string{text},
+		"disable_web_page_preview": []string{"true"},
+	}
+	if parseMode != "" {
+		params.Set("parse_mode", parseMode)
+	}
+	if len(msg.Buttons) > 0 {
+		params.Set("reply_markup", tgReplyMarkup(msg.Buttons))
+	}
+	if msg.ThreadId != "" {
+		// Deliver the message even if the one replied to is gone.
+		params.Set("reply_to_message_id", msg.ThreadId)
+		params.Set("allow_sending_without_reply", "true")
+	}
+	return params
+}
+
+// tgPhotoParams turns the sendMessage parameters for msg into those for
+// sending its photo attachment with the message text as the caption. The
+// attachment id is either a Telegram file id or a URL to fetch the photo
+// from, as accepted by sendPhoto.
+func tgPhotoParams(params url.Values, msg *Message) url.Values {
+	params.Set("photo", msg.Attachment.Id)
+	params.Set("caption", params.Get("text"))
+	params.Del("text")
+	params.Del("disable_web_page_preview")
+	return params
+}
+
+// tgReactionParams returns the setMessageReaction parameters for reacting
+// with the emoji in the text of msg to the message with id in Param0.
+func tgReactionParams(chatId int64, msg *Message) url.Values {
+	reaction := []struct {
+		Type  string `json:"type"`
+		Emoji string `json:"emoji"`
+	}{{"emoji", msg.Text}}
+	data, err := json.Marshal(reaction)
+	if err != nil {
+		panic(err)
+	}
+	return url.Values{
+		"chat_id":    []string{strconv.FormatInt(chatId, 10)},
+		"message_id": []string{msg.Param0},
+		"reaction":   []string{string(data)},
+	}
+}
+
+// tgReplyMarkup returns the inline keyboard for the provided buttons
+// as expected in the reply_markup parameter.
+func tgReplyMarkup(buttons Buttons) string {
+	type tgButton struct {
+		Text         string `json:"text"`
+		CallbackData string `json:"callback_data"`
+	}
+	var keyboard struct {
+		InlineKeyboard [][]tgButton `json:"inline_keyboard"`
+	}
+	for _, row := range buttons {
+		var tgrow []tgButton
+		for _, button := range row {
+			tgrow = append(tgrow, tgButton{button.Text, button.Data})
 		}
-		if err = result.err(); err != nil {
-			w.tomb.Killf("on sendMessage: %v", err)
-			break
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, tgrow)
+	}
+	data, err := json.Marshal(&keyboard)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// tgBotCommand is a command offered for completion by Telegram clients.
+type tgBotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// tgBotCommands returns the commands in cmds that Telegram accepts as
+// bot commands, described by the first line of their help text.
+func tgBotCommands(cmds []schema.Command) []tgBotCommand {
+	var result []tgBotCommand
+	for _, cmd := range cmds {
+		if !tgValidCommand(cmd.Name) || len(result) == tgMaxCommands {
+			continue
+		}
+		description := strings.TrimSpace(cmd.Help)
+		if i := strings.Index(description, "\n"); i >= 0 {
+			description = strings.TrimSpace(description[:i])
+		}
+		if description == "" {
+			description = cmd.Name
+		}
+		if runes := []rune(description); len(runes) > tgMaxCommandDescription {
+			description = string(runes[:tgMaxCommandDescription-3]) + "..."
 		}
+		result = append(result, tgBotCommand{cmd.Name, description})
+	}
+	return result
+}
 
-		// Notify the account manager that the message was delivered.
-		select {
-		case w.r.Incoming <- ParseIncoming(w.accountName, "mup", "/", "PONG :sent:"+strconv.FormatInt(msg.Id, 16)):
-		case <-w.Dying:
-		case <-w.r.Dying:
-			break
+const (
+	tgMaxCommands           = 100
+	tgMaxCommandDescription = 256
+)
+
+// tgValidCommand returns whether name is valid as a Telegram bot command,
+// which holds up to 32 lowercase letters, digits, and underscores.
+func tgValidCommand(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// setCommands replaces the bot commands offered to users. Failures are
+// logged rather than stopping the writer, as messages may still be sent.
+func (w *tgWriter) setCommands(commands []tgBotCommand) {
+	if commands == nil {
+		commands = []tgBotCommand{}
+	}
+	data, err := json.Marshal(commands)
+	if err != nil {
+		panic(err)
+	}
+	accountLogf(w.accountName, "Setting %d Telegram bot commands.", len(commands))
+	params := url.Values{"commands": []string{string(data)}}
+	resp, err := httpClient.PostForm(w.apiPrefix+w.apiKey+"/setMyCommands", params)
+	if err == nil {
+		var result tgResultStatus
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err == nil {
+			err = result.err()
+		}
+	}
+	if err != nil {
+		accountLogf(w.accountName, "Cannot set Telegram bot commands: %v", err)
+	}
 }
 
 type tgResultStatus struct {
@@ -319,6 +628,12 @@ func (result *tgResultStatus) err() error {
 	return fmt.Errorf("error code %d - %s", result.ErrorCode, result.Description)
 }
 
+// permanent returns whether the request failed in a way that retrying it
+// won't fix, such as when the bot was blocked or removed from the chat.
+func (result *tgResultStatus) permanent() bool {
+	return result.ErrorCode == 400 || result.ErrorCode == 403
+}
+
 // ---------------------------------------------------------------------------
 // tgReader
 
@@ -328,18 +643,30 @@ type tgReader struct {
 	apiPrefix   string
 	apiKey      string
 	activeNick  string
+	config      tgConfig
+	bangs       *bangPrefixes
+	client      http.Client
 	tomb        tomb.Tomb
 
+	lastUpdateId int64
+
 	Dying    <-chan struct{}
 	Incoming chan *Message
 }
 
-func startTgReader(accountName, apiPrefix, apiKey string) *tgReader {
+func startTgReader(accountName, apiPrefix, apiKey string, config tgConfig, bangs *bangPrefixes, lastUpdateId int64) *tgReader {
 	r := &tgReader{
 		accountName: accountName,
 		apiPrefix:   apiPrefix,
 		apiKey:      apiKey,
+		config:      config,
+		bangs:       bangs,
 		Incoming:    make(chan *Message, 1),
+
+		// Long polls must not be interrupted by the usual network timeout.
+		client: http.Client{Timeout: config.PollTimeout.Duration + NetworkTimeout},
+
+		lastUpdateId: lastUpdateId,
 	}
 	r.Dying = r.tomb.Dying()
 	r.tomb.Go(r.loop)
@@ -351,7 +678,7 @@ func (r *tgReader) Err() error {
 }
 
 func (r *tgReader) Stop() error {
-	debugf("[%s] Requesting Telegram reader to stop...", r.accountName)
+	accountDebugf(r.accountName, "Requesting Telegram reader to stop...")
 	r.tomb.Kill(errStop)
 	err := r.tomb.Wait()
 	if err != errStop {
@@ -361,7 +688,7 @@ func (r *tgReader) Stop() error {
 }
 
 func (r *tgReader) die() {
-	debugf("[%s] Reader is dead (%v)", r.accountName, r.tomb.Err())
+	accountDebugf(r.accountName, "Reader is dead (%v)", r.tomb.Err())
 }
 
 var httpClient = http.Client{Timeout: NetworkTimeout}
@@ -372,8 +699,26 @@ type tgUpdate struct {
 }
 
 type tgUpdateResult struct {
-	UpdateId int64           `json:"update_id"`
-	Message  tgUpdateMessage `json:"message"`
+	UpdateId      int64            `json:"update_id"`
+	Message       tgUpdateMessage  `json:"message"`
+	EditedMessage *tgUpdateMessage `json:"edited_message"`
+	CallbackQuery *tgCallbackQuery `json:"callback_query"`
+
+	// Bots only learn about deleted messages in chats of business
+	// accounts they're connected to.
+	DeletedMessages *tgDeletedMessages `json:"deleted_business_messages"`
+}
+
+type tgDeletedMessages struct {
+	Chat       tgUpdateChat `json:"chat"`
+	MessageIds []int64      `json:"message_ids"`
+}
+
+type tgCallbackQuery struct {
+	Id      string          `json:"id"`
+	From    tgUpdateFrom    `json:"from"`
+	Message tgUpdateMessage `json:"message"`
+	Data    string          `json:"data"`
 }
 
 type tgUpdateMessage struct {
@@ -382,6 +727,48 @@ type tgUpdateMessage struct {
 	Chat      tgUpdateChat `json:"chat"`
 	Date      uint64       `json:"date"`
 	Text      string       `json:"text"`
+	Caption   string       `json:"caption"`
+
+	ReplyToMessage *tgUpdateMessage `json:"reply_to_message"`
+	ForwardFrom    *tgUpdateFrom    `json:"forward_from"`
+
+	Photo    []tgFile `json:"photo"`
+	Document *tgFile  `json:"document"`
+	Sticker  *tgFile  `json:"sticker"`
+}
+
+// tgFile holds the fields common to the photo sizes, documents,
+// and stickers that may be sent in a message.
+type tgFile struct {
+	FileId   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	FileSize int64  `json:"file_size"`
+	Emoji    string `json:"emoji"`
+}
+
+// text returns the text of the message, or the caption of the file sent
+// in it.
+func (m *tgUpdateMessage) text() string {
+	if m.Text == "" {
+		return m.Caption
+	}
+	return m.Text
+}
+
+// attachment returns the descriptor for the file sent in the message, if any.
+func (m *tgUpdateMessage) attachment() Attachment {
+	switch {
+	case len(m.Photo) > 0:
+		// Photos come in several sizes, with the largest one last.
+		photo := m.Photo[len(m.Photo)-1]
+		return Attachment{Kind: "photo", Id: photo.FileId, MimeType: "image/jpeg", Size: photo.FileSize}
+	case m.Document != nil:
+		return Attachment{Kind: "document", Id: m.Document.FileId, Name: m.Document.FileName, MimeType: m.Document.MimeType, Size: m.Document.FileSize}
+	case m.Sticker != nil:
+		return Attachment{Kind: "sticker", Id: m.Sticker.FileId, Name: m.Sticker.Emoji, Size: m.Sticker.FileSize}
+	}
+	return Attachment{}
 }
 
 type tgUpdateFrom struct {
@@ -427,32 +814,149 @@ func (r *tgReader) updateNick() error {
 		return err
 	}
 	r.activeNick = strings.TrimSuffix(result.Result.Username, "bot")
-	logf("[%s] Using retrieved Telegram bot nick: %s", r.accountName, r.activeNick)
+	accountLogf(r.accountName, "Using retrieved Telegram bot nick: %s", r.activeNick)
 	return nil
 }
 
+// tgChannel returns the channel name that represents the provided chat.
+func tgChannel(chat *tgUpdateChat) string {
+	channelPrefix := '#'
+	channelTitle := chat.Title
+	if chat.Username != "" {
+		channelPrefix = '@'
+		channelTitle = chat.Username
+	} else {
+		buf := make([]byte, 0, len(channelTitle))
+		for _, r := range chat.Title {
+			if unicode.IsLetter(r) || unicode.IsNumber(r) {
+				buf = append(buf, string(r)...)
+			} else {
+				buf = append(buf, '_')
+			}
+		}
+		channelTitle = string(buf)
+	}
+	return fmt.Sprintf("%c%s:%d", channelPrefix, channelTitle, chat.Id)
+}
+
+func (r *tgReader) messages(m *tgUpdateMessage) []*Message {
+	prefix := fmt.Sprintf(":%s!~user@telegram PRIVMSG %s :", m.From.Username, tgChannel(&m.Chat))
+	accountLogf(r.accountName, "Received: %s%s", prefix, m.text())
+	attachment := m.attachment()
+	if attachment.Kind != "" {
+		accountLogf(r.accountName, "Received %s attachment: %s", attachment.Kind, attachment.Id)
+	}
+	msgs := parseMultiline(r.config.Multiline, r.accountName, r.activeNick, r.bangs, prefix, m.text(), attachment)
+	// Replying to a message sent by the bot addresses it, as if the
+	// reply was prefixed by the bot nick.
+	toBot := m.ReplyToMessage != nil && strings.TrimSuffix(m.ReplyToMessage.From.Username, "bot") == r.activeNick
+	for _, msg := range msgs {
+		msg.Param0 = strconv.FormatInt(m.MessageId, 10)
+		msg.ThreadId = msg.Param0
+		setReferences(msg, m)
+		if toBot && msg.BotText == "" {
+			msg.BotText = botText(msg.Text, msg.AsNick, msg.Bang, true)
+		}
+	}
+	return msgs
+}
+
+// setReferences sets the fields of msg that refer to other messages and
+// people, as defined in the Telegram message m.
+func setReferences(msg *Message, m *tgUpdateMessage) {
+	if reply := m.ReplyToMessage; reply != nil {
+		msg.ReplyTo = strconv.FormatInt(reply.MessageId, 10)
+	}
+	if from := m.ForwardFrom; from != nil {
+		msg.ForwardFrom = from.Username
+		if msg.ForwardFrom == "" {
+			msg.ForwardFrom = strings.TrimSpace(from.FirstName + " " + from.LastName)
+		}
+	}
+}
+
+// editMessage returns the message that represents the edit of a message
+// sent earlier. Edits are delivered in full, irrespective of the multiline
+// setting, and are never taken as commands.
+func (r *tgReader) editMessage(m *tgUpdateMessage) *Message {
+	line := fmt.Sprintf(":%s!~user@telegram %s %s %d :%s", m.From.Username, cmdEditMsg, tgChannel(&m.Chat), m.MessageId, m.text())
+	accountLogf(r.accountName, "Received: %s", line)
+	msg := r.bangs.parseIncoming(r.accountName, r.activeNick, line)
+	msg.Attachment = m.attachment()
+	setReferences(msg, m)
+	return msg
+}
+
+// deleteMessages returns the messages that represent the deletion of
+// messages sent earlier. Telegram does not report who deleted them.
+func (r *tgReader) deleteMessages(d *tgDeletedMessages) []*Message {
+	var msgs []*Message
+	for _, id := range d.MessageIds {
+		line := fmt.Sprintf("%s %s %d", cmdDeleteMsg, tgChannel(&d.Chat), id)
+		accountLogf(r.accountName, "Received: %s", line)
+		msgs = append(msgs, r.bangs.parseIncoming(r.accountName, r.activeNick, line))
+	}
+	return msgs
+}
+
+// callbackMessage returns the message that represents a button being
+// pressed, after acknowledging the callback query.
+func (r *tgReader) callbackMessage(q *tgCallbackQuery) *Message {
+	line := fmt.Sprintf(":%s!~user@telegram %s %s :%s", q.From.Username, cmdCallback, tgChannel(&q.Message.Chat), q.Data)
+	accountLogf(r.accountName, "Received: %s", line)
+	msg := r.bangs.parseIncoming(r.accountName, r.activeNick, line)
+	msg.Channel = msg.Param0
+	msg.Param0 = q.Id
+
+	// Stop the client from showing progress on the pressed button.
+	params := url.Values{"callback_query_id": []string{q.Id}}
+	resp, err := httpClient.PostForm(r.apiPrefix+r.apiKey+"/answerCallbackQuery", params)
+	if err == nil {
+		var result tgResultStatus
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err == nil {
+			err = result.err()
+		}
+	}
+	if err != nil {
+		accountLogf(r.accountName, "Cannot answer Telegram callback query: %v", err)
+	}
+	return msg
+}
+
 func (r *tgReader) loop() error {
 	defer r.die()
 
 	err := r.updateNick()
 	if err != nil {
-		logf("[%s] Cannot retrieve Telegram bot information: %v", r.accountName, err)
+		accountLogf(r.accountName, "Cannot retrieve Telegram bot information: %v", err)
 		r.tomb.Killf("cannot retrieve bot information: %v", err)
 		return nil
 	}
 
-	var lastUpdateId int64
-
 	for r.tomb.Alive() {
 		params := url.Values{
-			"offset":  []string{strconv.FormatInt(lastUpdateId+1, 10)},
-			"timeout": []string{"3"},
+			"offset":  []string{strconv.FormatInt(r.lastUpdateId+1, 10)},
+			"timeout": []string{strconv.Itoa(int(r.config.PollTimeout.Seconds()))},
+		}
+		if r.config.PollLimit > 0 {
+			params.Set("limit", strconv.Itoa(r.config.PollLimit))
 		}
-		resp, err := httpClient.PostForm(r.apiPrefix+r.apiKey+"/getUpdates", params)
+		req, err := http.NewRequest("POST", r.apiPrefix+r.apiKey+"/getUpdates", strings.NewReader(params.Encode()))
 		if err != nil {
 			r.tomb.Kill(err)
 			break
 		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		// Stopping the reader interrupts an ongoing long poll.
+		resp, err := r.client.Do(req.WithContext(r.tomb.Context(nil)))
+		if err != nil {
+			if r.tomb.Alive() {
+				r.tomb.Kill(err)
+			}
+			break
+		}
 
 		decoder := json.NewDecoder(resp.Body)
 
@@ -469,32 +973,26 @@ func (r *tgReader) loop() error {
 		}
 
 		for _, result := range update.Result {
-			lastUpdateId = result.UpdateId
-			from := result.Message.From
-			chat := result.Message.Chat
-			channelPrefix := '#'
-			channelTitle := chat.Title
-			if chat.Username != "" {
-				channelPrefix = '@'
-				channelTitle = chat.Username
-			} else {
-				buf := make([]byte, 0, len(channelTitle))
-				for _, r := range chat.Title {
-					if unicode.IsLetter(r) || unicode.IsNumber(r) {
-						buf = append(buf, string(r)...)
-					} else {
-						buf = append(buf, '_')
-					}
-				}
-				channelTitle = string(buf)
+			var msgs []*Message
+			switch {
+			case result.CallbackQuery != nil:
+				msgs = []*Message{r.callbackMessage(result.CallbackQuery)}
+			case result.EditedMessage != nil:
+				msgs = []*Message{r.editMessage(result.EditedMessage)}
+			case result.DeletedMessages != nil:
+				msgs = r.deleteMessages(result.DeletedMessages)
+			default:
+				msgs = r.messages(&result.Message)
 			}
-			line := fmt.Sprintf(":%s!~user@telegram PRIVMSG %c%s:%d :%s", from.Username, channelPrefix, channelTitle, chat.Id, result.Message.Text)
-			logf("[%s] Received: %s", r.accountName, line)
-			msg := ParseIncoming(r.accountName, r.activeNick, "/", line)
-			select {
-			case r.Incoming <- msg:
-			case <-r.Dying:
+			for _, msg := range msgs {
+				select {
+				case r.Incoming <- msg:
+				case <-r.Dying:
+					// The update is requested again by the next reader.
+					return nil
+				}
 			}
+			r.lastUpdateId = result.UpdateId
 		}
 	}
 	return nil
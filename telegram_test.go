@@ -14,6 +14,7 @@ import (
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/mup.v0"
+	"gopkg.in/mup.v0/schema"
 )
 
 type TelegramSuite struct {
@@ -75,6 +76,215 @@ func (s *TelegramSuite) TestPasswordAsKey(c *C) {
 	c.Assert(s.tgserver.LastAPIKey(), Equals, "<apikey>")
 }
 
+func (s *TelegramSuite) TestPollParams(c *C) {
+	params := s.tgserver.LastUpdateParams()
+	for params == nil {
+		time.Sleep(10 * time.Millisecond)
+		params = s.tgserver.LastUpdateParams()
+	}
+	c.Assert(params.Get("timeout"), Equals, "3")
+	c.Assert(params.Get("limit"), Equals, "")
+}
+
+func (s *TelegramSuite) TestUpdateInfoRestart(c *C) {
+	s.SendUpdates(c, `{"update_id": 12, "message": {"from": {"username": "bob"}, "chat": {"id": 56, "username": "bob"}, "text": "Hi"}}`)
+	for i := 0; i < 50 && s.tgserver.LastUpdateOffset() != 13; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	execSQL(c, s.db, `UPDATE account SET config='{"polltimeout": "5s", "polllimit": 10}' WHERE name='one'`)
+	s.server.RefreshAccounts()
+
+	// The same bot continues from where it was.
+	for i := 0; i < 50; i++ {
+		if s.tgserver.LastUpdateParams().Get("limit") == "10" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	params := s.tgserver.LastUpdateParams()
+	c.Assert(params.Get("timeout"), Equals, "5")
+	c.Assert(params.Get("limit"), Equals, "10")
+	c.Assert(params.Get("offset"), Equals, "13")
+
+	// A different bot starts afresh.
+	execSQL(c, s.db, `UPDATE account SET password='<newkey>' WHERE name='one'`)
+	s.server.RefreshAccounts()
+	for i := 0; i < 50; i++ {
+		if s.tgserver.LastAPIKey() == "<newkey>" && s.tgserver.LastUpdateParams() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.tgserver.LastAPIKey(), Equals, "<newkey>")
+	c.Assert(s.tgserver.LastUpdateOffset(), Equals, 1)
+
+	// Outgoing messages go through the new writer.
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@bob:56','bob','Hello again!')`)
+	s.RecvMessage(c, 56, "Hello again!")
+}
+
+func (s *TelegramSuite) TestUpdateInfoRestartBuffered(c *C) {
+	s.server.Stop()
+
+	// Nothing takes the incoming messages for now, so the second
+	// update is left buffered in the reader once it's counted.
+	incoming := make(chan *mup.Message)
+	client := mup.StartTgClient("one", s.tgserver.Host(), "<apikey>", incoming)
+	defer client.Stop()
+
+	s.SendUpdates(c,
+		`{"update_id": 12, "message": {"from": {"username": "bob"}, "chat": {"id": 56, "username": "bob"}, "text": "One"}}`,
+		`{"update_id": 13, "message": {"from": {"username": "bob"}, "chat": {"id": 56, "username": "bob"}, "text": "Two"}}`,
+	)
+	for i := 0; i < 50 && s.tgserver.LastUpdateOffset() != 14; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.tgserver.LastUpdateOffset(), Equals, 14)
+
+	client.SetConfig(`{"polltimeout": "5s"}`)
+	for i := 0; i < 50 && s.tgserver.LastUpdateParams().Get("timeout") != "5"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.tgserver.LastUpdateParams().Get("offset"), Equals, "14")
+
+	// Both updates are still delivered after the restart.
+	for _, text := range []string{"One", "Two"} {
+		select {
+		case msg := <-incoming:
+			c.Assert(msg.Text, Equals, text)
+		case <-time.After(3 * time.Second):
+			c.Fatalf("Message %q was not delivered", text)
+		}
+	}
+}
+
+func (s *TelegramSuite) TestParseMode(c *C) {
+	// Ensure messages are only inserted after the account has been loaded.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@bob:56','bob','*Plain*')`)
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.text, Equals, "*Plain*")
+	c.Assert(msg.parseMode, Equals, "")
+
+	execSQL(c, s.db, `UPDATE account SET config='{"parsemode": "MarkdownV2"}' WHERE name='one'`)
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@bob:56','bob','*Bold*')`)
+	msg, err = s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.text, Equals, "*Bold*")
+	c.Assert(msg.parseMode, Equals, "MarkdownV2")
+}
+
+func (s *TelegramSuite) TestFormatting(c *C) {
+	// Ensure messages are only inserted after the account has been loaded.
+	s.server.RefreshAccounts()
+
+	text := mup.Bold("Bold "+mup.Italic("both")) + " <plain> & " + mup.Colored(mup.ColorRed, mup.Underline("red"))
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@bob:56','bob','`+text+`')`)
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.text, Equals, "<b>Bold </b><b><i>both</i></b> &lt;plain&gt; &amp; <u>red</u>")
+	c.Assert(msg.parseMode, Equals, "HTML")
+
+	execSQL(c, s.db, `UPDATE account SET config='{"parsemode": "MarkdownV2"}' WHERE name='one'`)
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@bob:56','bob','`+text+`')`)
+	msg, err = s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.text, Equals, "*Bold **_both_* <plain> & __red__")
+	c.Assert(msg.parseMode, Equals, "MarkdownV2")
+}
+
+func (s *TelegramSuite) TestButtons(c *C) {
+	// Ensure messages are only inserted after the account has been loaded.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text,buttons) VALUES (2,'one','@bob:56','bob','Deploy?','[[{"text":"Yes","data":"approve 42"},{"text":"No","data":"reject 42"}]]')`)
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.text, Equals, "Deploy?")
+	c.Assert(msg.replyMarkup, Equals, `{"inline_keyboard":[[{"text":"Yes","callback_data":"approve 42"},{"text":"No","callback_data":"reject 42"}]]}`)
+}
+
+func (s *TelegramSuite) TestThread(c *C) {
+	// Ensure messages are only inserted after the account has been loaded.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text,threadid) VALUES (2,'one','#Group_Chat:-78','bob','Replied.','34')`)
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.text, Equals, "Replied.")
+	c.Assert(msg.replyTo, Equals, "34")
+}
+
+func (s *TelegramSuite) TestPhoto(c *C) {
+	// Ensure messages are only inserted after the account has been loaded.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,nick,text,attachment) VALUES (2,'one','#Group_Chat:-78','bob','Plot: https://mup.example.com/paste/ab12','{"kind":"photo","id":"https://mup.example.com/paste/ab12","mimetype":"image/gif"}')`)
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.chat_id, Equals, "-78")
+	c.Assert(msg.photo, Equals, "https://mup.example.com/paste/ab12")
+	c.Assert(msg.text, Equals, "Plot: https://mup.example.com/paste/ab12")
+}
+
+func (s *TelegramSuite) TestReact(c *C) {
+	// Ensure messages are only inserted after the account has been loaded.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db, `INSERT INTO message (lane,account,channel,command,param0,text) VALUES (2,'one','#Group_Chat:-78','REACT','34','👍')`)
+	msg, err := s.tgserver.RecvMessage()
+	c.Assert(err, IsNil)
+	c.Assert(msg.chat_id, Equals, "-78")
+	c.Assert(msg.messageId, Equals, "34")
+	c.Assert(msg.reaction, Equals, `[{"type":"emoji","emoji":"👍"}]`)
+}
+
+func init() {
+	mup.RegisterPlugin(&mup.PluginSpec{
+		Name:  "tgcommands",
+		Help:  "Tests the advertising of commands to Telegram.",
+		Start: pluginStart,
+		Commands: schema.Commands{
+			{Name: "hello", Help: "Says hello.\n\nReplies with a greeting."},
+			{Name: "nohelp"},
+			{Name: "Invalid-Name"},
+			{Name: "secret", Hide: true},
+		},
+	})
+}
+
+func (s *TelegramSuite) TestCommands(c *C) {
+	execSQL(c, s.db,
+		`INSERT INTO plugin (name) VALUES ('tgcommands')`,
+		`INSERT INTO target (plugin,account) VALUES ('tgcommands','one')`,
+	)
+	s.server.RefreshPlugins()
+	s.server.RefreshAccounts()
+
+	var commands string
+	for i := 0; i < 50 && commands == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		commands = s.tgserver.Commands()
+	}
+	c.Assert(commands, Equals, `[{"command":"hello","description":"Says hello."},{"command":"nohelp","description":"nohelp"}]`)
+
+	// Commands are cleared once no plugins target the account.
+	execSQL(c, s.db, `DELETE FROM target`)
+	s.server.RefreshAccounts()
+	for i := 0; i < 50 && commands != "[]"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		commands = s.tgserver.Commands()
+	}
+	c.Assert(commands, Equals, "[]")
+}
+
 func (s *TelegramSuite) TestQuit(c *C) {
 	err := s.server.Stop()
 	c.Assert(err, IsNil)
@@ -111,27 +321,148 @@ var telegramIncomingTests = []struct {
 			"text": "Hello mup!"
 		}
 	}`,
+	mup.Message{
+		Account:  "one",
+		Lane:     1,
+		Nick:     "bob",
+		User:     "~user",
+		Host:     "telegram",
+		Command:  "PRIVMSG",
+		Channel:  "@bob:56",
+		Param0:   "34",
+		ThreadId: "34",
+		Text:     "Hello mup!",
+		BotText:  "Hello mup!",
+		Bang:     "/",
+		AsNick:   "joe",
+	},
+}, {
+	`{
+		"update_id": 13,
+		"message": {
+			"message_id": 34,
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": -78, "title": "Group Chat"},
+			"text": "Hello there!"
+		}
+	}`,
+	mup.Message{
+		Account:  "one",
+		Lane:     1,
+		Nick:     "bob",
+		User:     "~user",
+		Host:     "telegram",
+		Command:  "PRIVMSG",
+		Channel:  "#Group_Chat:-78",
+		Param0:   "34",
+		ThreadId: "34",
+		Text:     "Hello there!",
+		Bang:     "/",
+		AsNick:   "joe",
+	},
+}, {
+	`{
+		"update_id": 14,
+		"message": {
+			"message_id": 35,
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": 56, "username": "bob"},
+			"photo": [{"file_id": "small", "file_size": 10}, {"file_id": "large", "file_size": 100}]
+		}
+	}`,
+	mup.Message{
+		Account:    "one",
+		Lane:       1,
+		Nick:       "bob",
+		User:       "~user",
+		Host:       "telegram",
+		Command:    "PRIVMSG",
+		Channel:    "@bob:56",
+		Param0:     "35",
+		ThreadId:   "35",
+		Bang:       "/",
+		AsNick:     "joe",
+		Attachment: mup.Attachment{Kind: "photo", Id: "large", MimeType: "image/jpeg", Size: 100},
+	},
+}, {
+	`{
+		"update_id": 15,
+		"message": {
+			"message_id": 36,
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": 56, "username": "bob"},
+			"document": {"file_id": "doc", "file_name": "notes.txt", "mime_type": "text/plain", "file_size": 42}
+		}
+	}`,
+	mup.Message{
+		Account:    "one",
+		Lane:       1,
+		Nick:       "bob",
+		User:       "~user",
+		Host:       "telegram",
+		Command:    "PRIVMSG",
+		Channel:    "@bob:56",
+		Param0:     "36",
+		ThreadId:   "36",
+		Bang:       "/",
+		AsNick:     "joe",
+		Attachment: mup.Attachment{Kind: "document", Id: "doc", Name: "notes.txt", MimeType: "text/plain", Size: 42},
+	},
+}, {
+	`{
+		"update_id": 16,
+		"message": {
+			"message_id": 37,
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": 56, "username": "bob"},
+			"sticker": {"file_id": "stk", "emoji": "👍"}
+		}
+	}`,
+	mup.Message{
+		Account:    "one",
+		Lane:       1,
+		Nick:       "bob",
+		User:       "~user",
+		Host:       "telegram",
+		Command:    "PRIVMSG",
+		Channel:    "@bob:56",
+		Param0:     "37",
+		ThreadId:   "37",
+		Bang:       "/",
+		AsNick:     "joe",
+		Attachment: mup.Attachment{Kind: "sticker", Id: "stk", Name: "👍"},
+	},
+}, {
+	`{
+		"update_id": 17,
+		"callback_query": {
+			"id": "q1",
+			"from": {"id": 56, "username": "bob"},
+			"message": {"message_id": 38, "chat": {"id": -78, "title": "Group Chat"}, "text": "Deploy?"},
+			"data": "approve 42"
+		}
+	}`,
 	mup.Message{
 		Account: "one",
 		Lane:    1,
 		Nick:    "bob",
 		User:    "~user",
 		Host:    "telegram",
-		Command: "PRIVMSG",
-		Channel: "@bob:56",
-		Text:    "Hello mup!",
-		BotText: "Hello mup!",
+		Command: "CALLBACK",
+		Channel: "#Group_Chat:-78",
+		Param0:  "q1",
+		Text:    "approve 42",
 		Bang:    "/",
 		AsNick:  "joe",
 	},
 }, {
 	`{
-		"update_id": 13,
-		"message": {
+		"update_id": 18,
+		"edited_message": {
 			"message_id": 34,
 			"from": {"id": 56, "username": "bob"},
 			"chat": {"id": -78, "title": "Group Chat"},
-			"text": "Hello there!"
+			"text": "Hello here!"
 		}
 	}`,
 	mup.Message{
@@ -140,12 +471,88 @@ var telegramIncomingTests = []struct {
 		Nick:    "bob",
 		User:    "~user",
 		Host:    "telegram",
-		Command: "PRIVMSG",
+		Command: "EDITMSG",
 		Channel: "#Group_Chat:-78",
-		Text:    "Hello there!",
+		Param0:  "34",
+		Text:    "Hello here!",
 		Bang:    "/",
 		AsNick:  "joe",
 	},
+}, {
+	`{
+		"update_id": 19,
+		"deleted_business_messages": {
+			"business_connection_id": "c1",
+			"chat": {"id": 56, "username": "bob"},
+			"message_ids": [35, 36]
+		}
+	}`,
+	mup.Message{
+		Account: "one",
+		Lane:    1,
+		Command: "DELMSG",
+		Channel: "@bob:56",
+		Param0:  "36",
+		Bang:    "/",
+		AsNick:  "joe",
+	},
+}, {
+	`{
+		"update_id": 20,
+		"message": {
+			"message_id": 39,
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": -78, "title": "Group Chat"},
+			"reply_to_message": {"message_id": 38, "from": {"id": 90, "username": "joebot"}, "chat": {"id": -78, "title": "Group Chat"}},
+			"text": "/echo yes"
+		}
+	}`,
+	mup.Message{
+		Account:  "one",
+		Lane:     1,
+		Nick:     "bob",
+		User:     "~user",
+		Host:     "telegram",
+		Command:  "PRIVMSG",
+		Channel:  "#Group_Chat:-78",
+		Param0:   "39",
+		ThreadId: "39",
+		Text:     "/echo yes",
+		BotText:  "echo yes",
+		Bang:     "/",
+		AsNick:   "joe",
+		ReplyTo:  "38",
+	},
+}, {
+	`{
+		"update_id": 21,
+		"message": {
+			"message_id": 40,
+			"from": {"id": 56, "username": "bob"},
+			"chat": {"id": -78, "title": "Group Chat"},
+			"forward_from": {"id": 57, "first_name": "Alice", "last_name": "Smith"},
+			"reply_to_message": {"message_id": 39, "from": {"id": 56, "username": "bob"}, "chat": {"id": -78, "title": "Group Chat"}},
+			"document": {"file_id": "doc", "file_name": "notes.txt", "mime_type": "text/plain", "file_size": 42},
+			"caption": "Some notes."
+		}
+	}`,
+	mup.Message{
+		Account:     "one",
+		Lane:        1,
+		Nick:        "bob",
+		User:        "~user",
+		Host:        "telegram",
+		Command:     "PRIVMSG",
+		Channel:     "#Group_Chat:-78",
+		Param0:      "40",
+		ThreadId:    "40",
+		Text:        "Some notes.",
+		Bang:        "/",
+		AsNick:      "joe",
+		Attachment:  mup.Attachment{Kind: "document", Id: "doc", Name: "notes.txt", MimeType: "text/plain", Size: 42},
+		ReplyTo:     "39",
+		ForwardFrom: "Alice Smith",
+	},
 }}
 
 func (s *TelegramSuite) TestIncoming(c *C) {
@@ -157,9 +564,9 @@ func (s *TelegramSuite) TestIncoming(c *C) {
 		var msg mup.Message
 		var err error
 		for i := 0; i < 10; i++ {
-			row := s.db.QueryRow("SELECT id,lane,account,nick,user,host,command,channel,text,bottext,bang,asnick,time FROM message ORDER BY id DESC")
+			row := s.db.QueryRow("SELECT id,lane,account,nick,user,host,command,channel,param0,text,bottext,bang,asnick,attachment,replyto,forwardfrom,threadid,time FROM message ORDER BY id DESC")
 			err = row.Scan(&msg.Id, &msg.Lane, &msg.Account, &msg.Nick, &msg.User, &msg.Host, &msg.Command,
-				&msg.Channel, &msg.Text, &msg.BotText, &msg.Bang, &msg.AsNick, &msg.Time)
+				&msg.Channel, &msg.Param0, &msg.Text, &msg.BotText, &msg.Bang, &msg.AsNick, &msg.Attachment, &msg.ReplyTo, &msg.ForwardFrom, &msg.ThreadId, &msg.Time)
 			if err == nil && msg.Id != lastId {
 				break
 			}
@@ -189,6 +596,43 @@ func (s *TelegramSuite) TestIncoming(c *C) {
 		c.Assert(err, IsNil)
 		c.Assert(s.tgserver.LastUpdateOffset(), Equals, update.Id+1)
 	}
+	c.Assert(s.tgserver.AnsweredQueries(), DeepEquals, []string{"q1"})
+}
+
+func (s *TelegramSuite) recentTexts(c *C, n int) []string {
+	var texts []string
+	for i := 0; i < 20; i++ {
+		texts = nil
+		rows, err := s.db.Query("SELECT bottext,attachment FROM message WHERE lane=1 ORDER BY id DESC LIMIT ?", n)
+		c.Assert(err, IsNil)
+		for rows.Next() {
+			var bottext string
+			var attachment mup.Attachment
+			c.Assert(rows.Scan(&bottext, &attachment), IsNil)
+			texts = append([]string{bottext + "|" + attachment.Text}, texts...)
+		}
+		c.Assert(rows.Close(), IsNil)
+		if len(texts) == n {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return texts
+}
+
+func (s *TelegramSuite) TestMultiline(c *C) {
+	execSQL(c, s.db, `UPDATE account SET config='{"multiline": "split"}' WHERE name='one'`)
+	s.server.RefreshAccounts()
+	s.SendUpdates(c, `{"update_id": 12, "message": {"from": {"username": "bob"}, "chat": {"id": 56, "username": "bob"}, "text": "/echo a\r\n\n/echo b"}}`)
+	c.Assert(s.recentTexts(c, 2), DeepEquals, []string{"echo a|", "echo b|"})
+
+	execSQL(c, s.db, `UPDATE account SET config='{"multiline": "first"}' WHERE name='one'`)
+	s.server.RefreshAccounts()
+	s.SendUpdates(c, `{"update_id": 13, "message": {"from": {"username": "bob"}, "chat": {"id": 56, "username": "bob"}, "text": "/paste\nline one\nline two"}}`)
+	for i := 0; i < 50 && s.tgserver.LastUpdateOffset() != 14; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.recentTexts(c, 3), DeepEquals, []string{"echo a|", "echo b|", "paste|line one\nline two"})
 }
 
 func (s *TelegramSuite) TestOutgoing(c *C) {
@@ -229,29 +673,72 @@ func (s *TelegramSuite) TestOutgoing(c *C) {
 	s.RecvMessage(c, 56, "Hello again!")
 }
 
+func (s *TelegramSuite) TestForbiddenSend(c *C) {
+	s.server.RefreshAccounts()
+	s.tgserver.ForbidSend()
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@nick:56','nick','Blocked.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@nick:56','nick','After.')`,
+	)
+
+	// The refused message is not retried, and the account moves on.
+	s.RecvMessage(c, 56, "After.")
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(c.GetTestLog(), Matches, `(?s).*Cannot deliver message [0-9]+: error code 403 - Forbidden: bot was blocked by the user.*`)
+}
+
+func (s *TelegramSuite) TestInvalidChannelSend(c *C) {
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@nick','nick','Invalid.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@nick:56','nick','After.')`,
+	)
+
+	// Messages to invalid channels are reported as failed, and the
+	// account moves on.
+	s.RecvMessage(c, 56, "After.")
+	failed := `Cannot deliver message 1: invalid Telegram channel: "@nick"`
+	waitFor(func() bool { return strings.Contains(c.GetTestLog(), failed) })
+	c.Assert(strings.Contains(c.GetTestLog(), failed), Equals, true)
+}
+
 type tgServer struct {
 	server *httptest.Server
 
-	updates  chan string
+	updates  chan []string
 	messages chan tgMessage
 	failSend chan bool
+	forbid   chan bool
 
 	mu               sync.Mutex
 	lastAPIKey       string
 	lastUpdateOffset int
+	lastUpdateParams url.Values
+	pendingUpdates   []string
+	answeredQueries  []string
+	commands         string
 }
 
 type tgMessage struct {
 	text, chat_id  string
 	disablePreview bool
+	parseMode      string
+	replyMarkup    string
+	replyTo        string
+	messageId      string
+	reaction       string
+	photo          string
 }
 
 func (s *tgServer) Start() {
 	*s = tgServer{
 		server:   httptest.NewServer(s),
-		updates:  make(chan string),
+		updates:  make(chan []string),
 		messages: make(chan tgMessage, 10),
 		failSend: make(chan bool, 10),
+		forbid:   make(chan bool, 10),
 	}
 }
 
@@ -268,15 +755,32 @@ func (s *tgServer) Host() string {
 }
 
 func (s *tgServer) SendUpdates(update ...string) error {
-	json := fmt.Sprintf(`{"ok": true, "result": [` + strings.Join(update, ", ") + `]}`)
 	select {
-	case s.updates <- json:
+	case s.updates <- update:
 		return nil
 	case <-time.After(500 * time.Millisecond):
 	}
 	return fmt.Errorf("Telegram client did not attempt to receive updates")
 }
 
+// ackUpdates drops the pending updates older than offset.
+// Must be called with the mutex held.
+func (s *tgServer) ackUpdates(offset int) {
+	var pending []string
+	for _, update := range s.pendingUpdates {
+		var result struct {
+			UpdateId int `json:"update_id"`
+		}
+		if err := json.Unmarshal([]byte(update), &result); err != nil {
+			panic("invalid update sent by test: " + update)
+		}
+		if result.UpdateId >= offset {
+			pending = append(pending, update)
+		}
+	}
+	s.pendingUpdates = pending
+}
+
 func (s *tgServer) RecvMessage() (tgMessage, error) {
 	select {
 	case msg := <-s.messages:
@@ -294,12 +798,38 @@ func (s *tgServer) FailSend() {
 	}
 }
 
+func (s *tgServer) ForbidSend() {
+	select {
+	case s.forbid <- true:
+	default:
+		panic("Trying to enqueue too many refusals without the client receiving any of them.")
+	}
+}
+
 func (s *tgServer) LastUpdateOffset() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.lastUpdateOffset
 }
 
+func (s *tgServer) LastUpdateParams() url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastUpdateParams
+}
+
+func (s *tgServer) AnsweredQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.answeredQueries
+}
+
+func (s *tgServer) Commands() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
 func (s *tgServer) LastAPIKey() string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -321,6 +851,10 @@ func (s *tgServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch method := tokens[2]; method {
 
 	case "getUpdates":
+		s.mu.Lock()
+		s.lastUpdateParams = req.Form
+		s.mu.Unlock()
+
 		offset := req.Form.Get("offset")
 		if offset != "" {
 			n, err := strconv.Atoi(offset)
@@ -329,26 +863,45 @@ func (s *tgServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 			s.mu.Lock()
 			s.lastUpdateOffset = n
+			s.ackUpdates(n)
 			s.mu.Unlock()
 		}
 
-		select {
-		case json := <-s.updates:
-			w.Write([]byte(json))
-		case <-time.After(50 * time.Millisecond):
-			fmt.Fprintf(w, `{"ok": true, "result": []}`)
+		// As done by Telegram, updates are provided again until
+		// acknowledged by a later offset, so none are lost when
+		// the client gives up on a request.
+		s.mu.Lock()
+		pending := s.pendingUpdates
+		s.mu.Unlock()
+		if len(pending) == 0 {
+			select {
+			case update := <-s.updates:
+				s.mu.Lock()
+				s.pendingUpdates = append(s.pendingUpdates, update...)
+				pending = s.pendingUpdates
+				s.mu.Unlock()
+			case <-req.Context().Done():
+			case <-time.After(50 * time.Millisecond):
+			}
 		}
+		fmt.Fprintf(w, `{"ok": true, "result": [%s]}`, strings.Join(pending, ", "))
 
 	case "sendMessage":
 		select {
 		case <-s.failSend:
 			fmt.Fprintf(w, `{"ok": false, "description": "failure requested by test suite"}`)
+		case <-s.forbid:
+			fmt.Fprintf(w, `{"ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user"}`)
+			return
 		default:
 		}
 		msg := tgMessage{
 			text:           req.Form.Get("text"),
 			chat_id:        req.Form.Get("chat_id"),
 			disablePreview: req.Form.Get("disable_web_page_preview") == "true",
+			parseMode:      req.Form.Get("parse_mode"),
+			replyMarkup:    req.Form.Get("reply_markup"),
+			replyTo:        req.Form.Get("reply_to_message_id"),
 		}
 		select {
 		case s.messages <- msg:
@@ -357,6 +910,47 @@ func (s *tgServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			panic("Client is sending messages much faster than test suite is trying to receive them")
 		}
 
+	case "sendPhoto":
+		msg := tgMessage{
+			text:        req.Form.Get("caption"),
+			chat_id:     req.Form.Get("chat_id"),
+			parseMode:   req.Form.Get("parse_mode"),
+			replyMarkup: req.Form.Get("reply_markup"),
+			replyTo:     req.Form.Get("reply_to_message_id"),
+			photo:       req.Form.Get("photo"),
+		}
+		select {
+		case s.messages <- msg:
+			fmt.Fprintf(w, `{"ok": true, "result": {}}`)
+		case <-time.After(100 * time.Millisecond):
+			panic("Client is sending photos much faster than test suite is trying to receive them")
+		}
+
+	case "setMessageReaction":
+		msg := tgMessage{
+			chat_id:   req.Form.Get("chat_id"),
+			messageId: req.Form.Get("message_id"),
+			reaction:  req.Form.Get("reaction"),
+		}
+		select {
+		case s.messages <- msg:
+			fmt.Fprintf(w, `{"ok": true, "result": true}`)
+		case <-time.After(100 * time.Millisecond):
+			panic("Client is sending reactions much faster than test suite is trying to receive them")
+		}
+
+	case "answerCallbackQuery":
+		s.mu.Lock()
+		s.answeredQueries = append(s.answeredQueries, req.Form.Get("callback_query_id"))
+		s.mu.Unlock()
+		fmt.Fprintf(w, `{"ok": true, "result": true}`)
+
+	case "setMyCommands":
+		s.mu.Lock()
+		s.commands = req.Form.Get("commands")
+		s.mu.Unlock()
+		fmt.Fprintf(w, `{"ok": true, "result": true}`)
+
 	case "getMe":
 		fmt.Fprintf(w, `{"ok": true, "result": {"username": "joebot"}}`)
 
@@ -1,6 +1,7 @@
 package mup
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -20,8 +21,11 @@ type PluginTester struct {
 	stopped  bool
 	state    pluginState
 	replies  []string
+	messages []*Message
 	incoming []string
+	events   []*Event
 	ldaps    map[string]ldap.Conn
+	clock    testClock
 }
 
 // NewPluginTester creates a new tester for interacting with an internally
@@ -35,37 +39,55 @@ func NewPluginTester(pluginName string) *PluginTester {
 	t.cond.L = &t.mu
 	t.ldaps = make(map[string]ldap.Conn)
 	t.state.spec = spec
+	t.state.cooldown = newCooldownFilter()
 	t.state.plugger = newPlugger(pluginName, t.sendMessage, t.handleMessage, t.ldap)
+	t.state.plugger.setPublisher(t.publishEvent)
+	t.state.plugger.clock = &t.clock
+	t.clock.now = time.Now()
 	return t
 }
 
-func (t *PluginTester) sendMessage(msg *Message) error {
+func (t *PluginTester) sendMessage(ctx context.Context, msg *Message) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.stopped {
 		panic("plugin attempted to send message after being stopped")
 	}
-	msgstr := msg.String()
-	if msg.Account != "test" {
-		msgstr = "[@" + msg.Account + "] " + msgstr
-	}
-	t.replies = append(t.replies, msgstr)
+	t.replies = append(t.replies, testerString(msg))
+	copy := *msg
+	t.messages = append(t.messages, &copy)
 	t.cond.Signal()
-	t.state.handle(msg, "")
+	t.state.handle(msg, "", true)
 	return nil
 }
 
-func (t *PluginTester) handleMessage(msg *Message) error {
+func (t *PluginTester) handleMessage(ctx context.Context, msg *Message) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.stopped {
 		panic("plugin attempted to enqueue incoming message after being stopped")
 	}
-	msgstr := msg.String()
+	t.incoming = append(t.incoming, testerString(msg))
+	t.cond.Signal()
+	return nil
+}
+
+// testerString formats msg as a raw IRC protocol message, prefixed by the
+// account name under brackets unless it's the default "test" account.
+func testerString(msg *Message) string {
 	if msg.Account != "test" {
-		msgstr = "[@" + msg.Account + "] " + msgstr
+		return "[@" + msg.Account + "] " + msg.String()
+	}
+	return msg.String()
+}
+
+func (t *PluginTester) publishEvent(ev *Event) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		panic("plugin attempted to publish event after being stopped")
 	}
-	t.incoming = append(t.incoming, msgstr)
+	t.events = append(t.events, ev)
 	t.cond.Signal()
 	return nil
 }
@@ -80,6 +102,106 @@ func (t *PluginTester) ldap(name string) (ldap.Conn, error) {
 	return nil, fmt.Errorf("LDAP connection %q not found", name)
 }
 
+// AdvanceTime moves the virtual clock of the plugin being tested forward
+// by d, delivering in order all ticks due meanwhile on the tickers created
+// via Plugger.NewTicker. AdvanceTime only returns once each of these ticks
+// was received by the plugin, or the respective ticker was stopped.
+func (t *PluginTester) AdvanceTime(d time.Duration) {
+	t.clock.advance(d)
+}
+
+// TriggerPoll delivers a tick right away on all tickers created via
+// Plugger.NewTicker, without moving the virtual clock forward. TriggerPoll
+// only returns once the ticks were received by the plugin, or the
+// respective tickers were stopped.
+func (t *PluginTester) TriggerPoll() {
+	t.clock.trigger()
+}
+
+// testClock is the virtual clock that drives tickers created by plugins
+// running under a PluginTester.
+type testClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*testTicker
+}
+
+type testTicker struct {
+	c      chan time.Time
+	done   chan struct{}
+	period time.Duration
+	next   time.Time
+}
+
+func (c *testClock) newTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	tt := &testTicker{
+		c:      make(chan time.Time),
+		done:   make(chan struct{}),
+		period: d,
+	}
+	c.mu.Lock()
+	tt.next = c.now.Add(d)
+	c.tickers = append(c.tickers, tt)
+	c.mu.Unlock()
+	stop := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, other := range c.tickers {
+			if other == tt {
+				c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+				close(tt.done)
+				break
+			}
+		}
+	}
+	return &Ticker{C: tt.c, stop: stop}
+}
+
+func (tt *testTicker) tick(now time.Time) {
+	select {
+	case tt.c <- now:
+	case <-tt.done:
+	}
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var due *testTicker
+		for _, tt := range c.tickers {
+			if !tt.next.After(end) && (due == nil || tt.next.Before(due.next)) {
+				due = tt
+			}
+		}
+		if due == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = due.next
+		due.next = due.next.Add(due.period)
+		now := c.now
+		c.mu.Unlock()
+		due.tick(now)
+	}
+}
+
+func (c *testClock) trigger() {
+	c.mu.Lock()
+	tickers := append([]*testTicker(nil), c.tickers...)
+	now := c.now
+	c.mu.Unlock()
+	for _, tt := range tickers {
+		tt.tick(now)
+	}
+}
+
 // Plugger returns the plugger that is provided to the plugin.
 func (t *PluginTester) Plugger() *Plugger {
 	return t.state.plugger
@@ -94,6 +216,9 @@ func (t *PluginTester) Start() error {
 	}
 	var err error
 	t.state.plugin = t.state.spec.Start(t.state.plugger)
+	if d, ok := t.state.plugin.(dynamicSpecer); ok {
+		t.state.spec = d.dynamicSpec()
+	}
 	return err
 }
 
@@ -104,7 +229,7 @@ func (t *PluginTester) SetDB(db *sql.DB) {
 	if t.state.plugin != nil {
 		panic("PluginTester.SetDB called after Start")
 	}
-	t.state.plugger.setDatabase(db)
+	t.state.plugger.setDatabase(db, newStmtCache(db))
 
 	t.mu.Unlock()
 	defer t.mu.Lock()
@@ -165,6 +290,17 @@ func (t *PluginTester) SetTargets(targets []Target) {
 	t.state.plugger.setTargets(targets)
 }
 
+// SetAccountStatus sets the account state reported to the plugin being
+// tested via Plugger.AccountStatus.
+func (t *PluginTester) SetAccountStatus(status []AccountStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state.plugin != nil {
+		panic("PluginTester.SetAccountStatus called after Start")
+	}
+	t.state.plugger.setAccountStatus(func() []AccountStatus { return status })
+}
+
 // SetLDAP makes the provided LDAP connection available to the plugin.
 func (t *PluginTester) SetLDAP(name string, conn ldap.Conn) {
 	t.mu.Lock()
@@ -191,7 +327,10 @@ func (t *PluginTester) Stop() error {
 	if stopped {
 		return nil
 	}
-	err := t.state.plugin.Stop()
+	err := t.state.stop()
+	if stmts := t.state.plugger.stmts; stmts != nil {
+		stmts.close()
+	}
 	t.mu.Lock()
 	t.stopped = true
 	t.cond.Broadcast()
@@ -221,6 +360,7 @@ func (t *PluginTester) Recv() string {
 	reply := t.replies[0]
 	copy(t.replies, t.replies[1:])
 	t.replies = t.replies[0 : len(t.replies)-1]
+	t.messages = t.messages[1:]
 	return reply
 }
 
@@ -235,10 +375,25 @@ func (t *PluginTester) RecvAll() []string {
 	t.mu.Lock()
 	replies := t.replies
 	t.replies = nil
+	t.messages = nil
 	t.mu.Unlock()
 	return replies
 }
 
+// RecvMessages receives all currently pending messages dispatched by the plugin
+// being tested, as RecvAll does, but without formatting them. This allows
+// asserting on the individual message fields, such as Channel and Command.
+//
+// RecvMessages may be used after the tester is stopped.
+func (t *PluginTester) RecvMessages() []*Message {
+	t.mu.Lock()
+	messages := t.messages
+	t.replies = nil
+	t.messages = nil
+	t.mu.Unlock()
+	return messages
+}
+
 // RecvIncoming receives the next message enqueued as incoming by the plugin being tested.
 // If no message is currently pending, RecvIncoming waits up to a few seconds for a
 // message to arrive. If no messages arrive even then, an empty string is returned.
@@ -280,6 +435,57 @@ func (t *PluginTester) RecvAllIncoming() []string {
 	return incoming
 }
 
+// RecvEvent receives the next event published by the plugin being tested.
+// If no event is currently pending, RecvEvent waits up to a few seconds for
+// one to be published. If no events are published even then, nil is returned.
+//
+// Events published by the plugin are not delivered back to it, even if it
+// subscribed to their topic.
+//
+// RecvEvent may be used after the tester is stopped.
+func (t *PluginTester) RecvEvent() *Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timeout := time.Now().Add(3 * time.Second)
+	for !t.stopped && len(t.events) == 0 && time.Now().Before(timeout) {
+		t.cond.Wait()
+	}
+	if len(t.events) == 0 {
+		return nil
+	}
+	ev := t.events[0]
+	t.events = t.events[1:]
+	return ev
+}
+
+// RecvAllEvents receives all currently pending events published by the
+// plugin being tested.
+//
+// RecvAllEvents may be used after the tester is stopped.
+func (t *PluginTester) RecvAllEvents() []*Event {
+	t.mu.Lock()
+	events := t.events
+	t.events = nil
+	t.mu.Unlock()
+	return events
+}
+
+// Publish delivers to the plugin being tested an event with the provided
+// topic and payload, as if published by a plugin named "test". The event
+// is only delivered if the plugin subscribed to the topic.
+func (t *PluginTester) Publish(topic string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		panic("cannot marshal provided payload: " + err.Error())
+	}
+	if !t.state.plugger.subscribed(topic) {
+		return
+	}
+	if handler, ok := t.state.plugin.(EventHandler); ok {
+		handler.HandleEvent(&Event{Topic: topic, Plugin: "test", Time: time.Now(), payload: data})
+	}
+}
+
 // Sendf formats a PRIVMSG coming from "nick!~user@host" and delivers to the plugin
 // being tested for handling as a message, as a command, or both, depending on the
 // plugin specification and implementation.
@@ -296,23 +502,50 @@ func (t *PluginTester) RecvAllIncoming() []string {
 // are currently setup, as it doesn't make sense to test the plugin with a message
 // that it cannot observe.
 func (t *PluginTester) Sendf(format string, args ...interface{}) {
-	account, message := parseSendfText(fmt.Sprintf(format, args...))
-	msg := ParseIncoming(account, "mup", "!", message)
-	t.state.handle(msg, schema.CommandName(msg.BotText))
+	account, target, raw, text := parseSendfText(fmt.Sprintf(format, args...))
+	if !raw {
+		if target == "" {
+			target = "mup"
+		}
+		text = ":nick!~user@host PRIVMSG " + target + " :" + text
+	}
+	msg := ParseIncoming(account, "mup", "!", text)
+	if d, ok := t.state.plugin.(dynamicSpecer); ok {
+		t.state.spec = d.dynamicSpec()
+	}
+	cmdName := schema.CommandName(msg.BotText)
+	t.state.handle(msg, cmdName, cmdName == "" || t.state.spec.Commands.Command(cmdName) != nil)
+}
+
+// SendOutgoing formats a PRIVMSG sent by the bot to "nick" and delivers it to
+// the plugin being tested as an outgoing message, as if some plugin had sent it.
+// Only plugins that implement OutgoingHandler observe these messages.
+//
+// The formatted message may be prefixed by "[<target>@<account>,<option>] " with
+// the same semantics as in Sendf, with the raw option causing the message text to
+// be taken as a raw outgoing IRC protocol message (e.g. "NOTICE #chan :text").
+func (t *PluginTester) SendOutgoing(format string, args ...interface{}) {
+	account, target, raw, text := parseSendfText(fmt.Sprintf(format, args...))
+	if !raw {
+		if target == "" {
+			target = "nick"
+		}
+		text = "PRIVMSG " + target + " :" + text
+	}
+	t.state.handle(ParseOutgoing(account, text), "", true)
 }
 
-func parseSendfText(text string) (account, message string) {
+func parseSendfText(text string) (account, target string, raw bool, message string) {
 	account = "test"
 
 	close := strings.Index(text, "] ")
 	if !strings.HasPrefix(text, "[") || close < 0 {
-		return account, ":nick!~user@host PRIVMSG mup :" + text
+		return account, "", false, text
 	}
 
 	prefix := text[1:close]
 	text = text[close+2:]
 
-	raw := false
 	comma := strings.Index(prefix, ",")
 	if comma >= 0 {
 		for _, option := range strings.Split(prefix[comma+1:], ",") {
@@ -333,18 +566,10 @@ func parseSendfText(text string) (account, message string) {
 		prefix = prefix[:at]
 	}
 
-	if raw {
-		if prefix != "" {
-			panic("Sendf prefix cannot contain both a target and the raw option")
-		}
-		return account, text
-	}
-
-	target := "mup"
-	if prefix != "" {
-		target = prefix
+	if raw && prefix != "" {
+		panic("Sendf prefix cannot contain both a target and the raw option")
 	}
-	return account, ":nick!~user@host PRIVMSG " + target + " :" + text
+	return account, prefix, raw, text
 }
 
 // SendAll sends each entry in text as an individual message to the bot.
@@ -2,6 +2,7 @@ package mup_test
 
 import (
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 	"gopkg.in/mup.v0"
@@ -76,6 +77,43 @@ func (s *TesterSuite) TestSendfRaw(c *C) {
 	tester.Stop()
 }
 
+func (s *TesterSuite) TestSendOutgoing(c *C) {
+	tester := mup.NewPluginTester("echoA")
+	tester.Start()
+	tester.SendOutgoing("<%s>", "private")
+	tester.SendOutgoing("[#chan@acct] <channel>")
+	tester.SendOutgoing("[,raw] NOTICE #chan :<raw>")
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), HasLen, 0)
+	log := c.GetTestLog()
+	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] <private>.*`)
+	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] <channel>.*`)
+	c.Assert(log, Matches, `(?s).*\[echoA\] \[out\] <raw>.*`)
+}
+
+func (s *TesterSuite) TestRecvMessages(c *C) {
+	tester := mup.NewPluginTester("echoA")
+	tester.Start()
+	tester.Sendf("echoAcmd private")
+	tester.Sendf("[#chan@acct] mup: echoAcmd channel")
+	tester.Stop()
+
+	msgs := tester.RecvMessages()
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[0].Account, Equals, "test")
+	c.Assert(msgs[0].Channel, Equals, "")
+	c.Assert(msgs[0].Nick, Equals, "nick")
+	c.Assert(msgs[0].Text, Equals, "[cmd] private")
+	c.Assert(msgs[1].Account, Equals, "acct")
+	c.Assert(msgs[1].Channel, Equals, "#chan")
+	c.Assert(msgs[1].Nick, Equals, "nick")
+	c.Assert(msgs[1].Text, Equals, "nick: [cmd] channel")
+
+	c.Assert(tester.RecvAll(), HasLen, 0)
+	c.Assert(tester.RecvMessages(), HasLen, 0)
+}
+
 func (s *TesterSuite) TestUnknownPlugin(c *C) {
 	c.Assert(func() { mup.NewPluginTester("unknown").Start() }, PanicMatches, `plugin "unknown" not registered`)
 }
@@ -170,3 +208,151 @@ func (s *TesterSuite) TestSetLDAP(c *C) {
 	_, err = tester.Plugger().LDAP("unknown")
 	c.Assert(err, ErrorMatches, `LDAP connection "unknown" not found`)
 }
+
+func (s *TesterSuite) TestEvents(c *C) {
+	tester := mup.NewPluginTester("testevents")
+	tester.SetConfig(mup.Map{"subscribe": []string{"news.*"}})
+	tester.Start()
+	tester.Sendf("publish news.weather Sunny.")
+	ev := tester.RecvEvent()
+	c.Assert(ev, NotNil)
+	c.Assert(ev.Topic, Equals, "news.weather")
+	c.Assert(ev.Plugin, Equals, "testevents")
+	var payload testEventPayload
+	c.Assert(ev.Payload(&payload), IsNil)
+	c.Assert(payload, Equals, testEventPayload{Nick: "nick", Text: "Sunny."})
+
+	tester.Publish("news.sports", &testEventPayload{Nick: "nick", Text: "Goal!"})
+	tester.Publish("other", &testEventPayload{Nick: "nick", Text: "Ignored."})
+	tester.Stop()
+	c.Assert(tester.RecvAll(), DeepEquals, []string{"[@one] PRIVMSG nick :[testevents] Got news.sports from test: Goal!"})
+	c.Assert(tester.RecvAllEvents(), HasLen, 0)
+}
+
+func init() {
+	mup.RegisterPlugin(&mup.PluginSpec{
+		Name:  "testcontext",
+		Start: testContextStart,
+	})
+}
+
+type testContextPlugin struct {
+	plugger *mup.Plugger
+}
+
+func testContextStart(plugger *mup.Plugger) mup.Stopper {
+	return &testContextPlugin{plugger}
+}
+
+func (p *testContextPlugin) Stop() error {
+	// The context is cancelled before Stop is called.
+	return p.plugger.Context().Err()
+}
+
+func (s *TesterSuite) TestStopCancelsContext(c *C) {
+	tester := mup.NewPluginTester("testcontext")
+	tester.Start()
+	c.Assert(tester.Stop(), ErrorMatches, "context canceled")
+}
+
+func init() {
+	mup.RegisterPlugin(&mup.PluginSpec{
+		Name:  "testticker",
+		Start: testTickerStart,
+	})
+}
+
+type testTickerPlugin struct {
+	plugger *mup.Plugger
+	ticker  *mup.Ticker
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func testTickerStart(plugger *mup.Plugger) mup.Stopper {
+	p := &testTickerPlugin{
+		plugger: plugger,
+		ticker:  plugger.NewTicker(time.Minute),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *testTickerPlugin) loop() {
+	defer close(p.stopped)
+	defer p.ticker.Stop()
+	var start time.Time
+	for n := 1; ; n++ {
+		select {
+		case now := <-p.ticker.C:
+			if start.IsZero() {
+				start = now
+			}
+			p.plugger.Sendf(mup.Address{Account: "test", Nick: "nick"}, "Tick #%d at +%s.", n, now.Sub(start))
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *testTickerPlugin) Stop() error {
+	close(p.done)
+	<-p.stopped
+	return nil
+}
+
+func (s *TesterSuite) TestAdvanceTime(c *C) {
+	tester := mup.NewPluginTester("testticker")
+	tester.Start()
+	tester.AdvanceTime(150 * time.Second)
+	tester.TriggerPoll()
+	tester.AdvanceTime(30 * time.Second)
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), DeepEquals, []string{
+		"PRIVMSG nick :Tick #1 at +0s.",
+		"PRIVMSG nick :Tick #2 at +1m0s.",
+		"PRIVMSG nick :Tick #3 at +1m30s.",
+		"PRIVMSG nick :Tick #4 at +2m0s.",
+	})
+}
+
+var _ = Suite(&IntegrationSuite{})
+
+type IntegrationSuite struct{}
+
+func (s *IntegrationSuite) SetUpTest(c *C) {
+	mup.SetLogger(c)
+	mup.SetDebug(true)
+}
+
+func (s *IntegrationSuite) TearDownTest(c *C) {
+	mup.SetLogger(nil)
+	mup.SetDebug(false)
+}
+
+func (s *IntegrationSuite) TestDispatch(c *C) {
+	tester := mup.NewIntegrationTester("help", "echoA", "echoB")
+	tester.SetTargets("echoA", []mup.Target{{Account: "other"}})
+	tester.SetConfig("echoB", mup.Map{"prefix": "B."})
+	tester.Start()
+
+	tester.Sendf("echoAcmd one")
+	c.Assert(tester.Recv(), Equals, `PRIVMSG nick :Plugin "echoA" is not enabled here.`)
+
+	tester.Sendf("[@other] echoAcmd two")
+	c.Assert(tester.Recv(), Equals, "[@other] PRIVMSG nick :[cmd] two")
+
+	tester.Sendf("[#chan] mup: echoBcmd three")
+	tester.Sendf("[@other] echoBcmd four")
+	tester.Stop()
+
+	c.Assert(tester.RecvAll(), DeepEquals, []string{"PRIVMSG #chan :nick: [cmd] B.three"})
+	c.Assert(tester.Recv(), Equals, "")
+
+	// Outgoing messages are observed by outgoing handlers, as usual.
+	log := c.GetTestLog()
+	c.Assert(log, Matches, `(?s).*\[echoB\] \[out\] Plugin "echoA" is not enabled here\..*`)
+}
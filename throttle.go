@@ -0,0 +1,111 @@
+package mup
+
+import (
+	"strings"
+	"time"
+)
+
+// throttleConfig holds the settings read from a target's configuration
+// document that control command rate limiting for that target.
+type throttleConfig struct {
+	// Throttle is the number of commands a single user may run
+	// within the throttle window.
+	Throttle int `json:"throttle"`
+
+	// ThrottleWindow is the period over which commands are counted.
+	// Defaults to one minute.
+	ThrottleWindow DurationString `json:"throttlewindow"`
+}
+
+const defaultThrottleWindow = time.Minute
+
+type throttleLimit struct {
+	count  int
+	window time.Duration
+}
+
+type throttleKey struct {
+	account string
+	nick    string
+}
+
+type throttleEntry struct {
+	// times holds when recently accepted commands were run, oldest first.
+	times []time.Time
+
+	// notified reports whether the user was told about being throttled
+	// since the last accepted command.
+	notified bool
+}
+
+// throttleFilter limits how often each user may run commands handled by
+// a single plugin, according to the limits set in its targets.
+type throttleFilter struct {
+	limits  map[Address]throttleLimit
+	longest time.Duration
+	recent  map[throttleKey]*throttleEntry
+}
+
+func newThrottleFilter(targets []Target) *throttleFilter {
+	var f *throttleFilter
+	for _, target := range targets {
+		var config throttleConfig
+		if target.UnmarshalConfig(&config) != nil || config.Throttle <= 0 {
+			continue
+		}
+		if f == nil {
+			f = &throttleFilter{
+				limits: make(map[Address]throttleLimit),
+				recent: make(map[throttleKey]*throttleEntry),
+			}
+		}
+		window := config.ThrottleWindow.Duration
+		if window <= 0 {
+			window = defaultThrottleWindow
+		}
+		f.limits[target.Address()] = throttleLimit{config.Throttle, window}
+		if window > f.longest {
+			f.longest = window
+		}
+	}
+	return f
+}
+
+// allow reports whether the user that sent msg via the provided target may
+// run another command now. When the command is refused, wait holds how long
+// until the user may run commands again, and notify reports whether the user
+// should be told about it, which happens only once while throttled.
+func (f *throttleFilter) allow(target Target, msg *Message) (ok bool, wait time.Duration, notify bool) {
+	if f == nil {
+		return true, 0, false
+	}
+	limit, ok := f.limits[target.Address()]
+	if !ok {
+		return true, 0, false
+	}
+	for key, entry := range f.recent {
+		if msg.Time.Sub(entry.times[len(entry.times)-1]) > f.longest {
+			delete(f.recent, key)
+		}
+	}
+	key := throttleKey{msg.Account, strings.ToLower(msg.Nick)}
+	entry := f.recent[key]
+	if entry == nil {
+		entry = &throttleEntry{}
+		f.recent[key] = entry
+	}
+	i := 0
+	for i < len(entry.times) && msg.Time.Sub(entry.times[i]) >= limit.window {
+		i++
+	}
+	entry.times = entry.times[i:]
+	if len(entry.times) >= limit.count {
+		notify = !entry.notified
+		entry.notified = true
+		wait = limit.window - msg.Time.Sub(entry.times[len(entry.times)-limit.count])
+		return false, wait, notify
+	}
+	entry.times = append(entry.times, msg.Time)
+	entry.notified = false
+	return true, 0, false
+}
@@ -3,12 +3,12 @@ package mup
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"gopkg.in/tomb.v2"
-	"strconv"
 )
 
 type webhookClient struct {
@@ -84,23 +84,23 @@ func (c *webhookClient) UpdateInfo(info *accountInfo) {
 }
 
 func (c *webhookClient) die() {
-	logf("[%s] Cleaning WebHook connection resources", c.accountName)
+	accountLogf(c.accountName, "Cleaning WebHook connection resources")
 
 	if c.webhookW != nil {
 		err := c.webhookW.Stop()
 		if err != nil {
-			logf("[%s] WebHook writer failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "WebHook writer failure: %s", err)
 		}
 	}
 	if c.webhookR != nil {
 		err := c.webhookR.Stop()
 		if err != nil {
-			logf("[%s] WebHook reader failure: %s", c.accountName, err)
+			accountLogf(c.accountName, "WebHook reader failure: %s", err)
 		}
 	}
 
 	c.tomb.Kill(nil)
-	logf("[%s] WebHook client terminated (%v)", c.accountName, c.tomb.Err())
+	accountLogf(c.accountName, "WebHook client terminated (%v)", c.tomb.Err())
 }
 
 func (c *webhookClient) run() error {
@@ -211,7 +211,7 @@ func (w *webhookWriter) Err() error {
 }
 
 func (w *webhookWriter) Stop() error {
-	debugf("[%s] Requesting writer to stop...", w.accountName)
+	accountDebugf(w.accountName, "Requesting writer to stop...")
 	w.tomb.Kill(errStop)
 	err := w.tomb.Wait()
 	if err != errStop {
@@ -234,7 +234,7 @@ func (w *webhookWriter) Sendf(format string, args ...interface{}) error {
 }
 
 func (w *webhookWriter) die() {
-	debugf("[%s] Writer is dead (%v)", w.accountName, w.tomb.Err())
+	accountDebugf(w.accountName, "Writer is dead (%v)", w.tomb.Err())
 }
 
 type webhookPayload struct {
@@ -263,7 +263,7 @@ loop:
 			continue
 		}
 
-		logf("[%s] Sending: %s", w.accountName, msg.String())
+		accountLogf(w.accountName, "Sending: %s", msg.String())
 
 		payload := webhookPayload{
 			Channel:   msg.Channel,
@@ -288,23 +288,30 @@ loop:
 			w.tomb.Kill(err)
 			break
 		}
-		decoder := json.NewDecoder(resp.Body)
-
-		var result webhookResultStatus
-		err = decoder.Decode(&result)
-		resp.Body.Close()
-		if err != nil {
-			w.tomb.Kill(err)
-			break
-		}
-		if err = result.err(); err != nil {
-			w.tomb.Kill(err)
-			break
+		if webhookRejected(resp.StatusCode) {
+			// The message itself was refused, so retrying won't help.
+			resp.Body.Close()
+			err = fmt.Errorf("server returned %s", resp.Status)
+		} else {
+			decoder := json.NewDecoder(resp.Body)
+
+			var result webhookResultStatus
+			err = decoder.Decode(&result)
+			resp.Body.Close()
+			if err != nil {
+				w.tomb.Kill(err)
+				break
+			}
+			if err = result.err(); err != nil {
+				w.tomb.Kill(err)
+				break
+			}
 		}
 
-		// Notify the account manager that the message was delivered.
+		// Notify the account manager that the message was delivered,
+		// or that it never will be so it isn't retried.
 		select {
-		case w.r.Incoming <- ParseIncoming(w.accountName, "mup", "/", "PONG :sent:"+strconv.FormatInt(msg.Id, 16)):
+		case w.r.Incoming <- deliveryPong(w.accountName, msg.Id, err):
 		case <-w.Dying:
 		case <-w.r.Dying:
 			break
@@ -314,6 +321,13 @@ loop:
 	return nil
 }
 
+// webhookRejected returns whether the HTTP status code of a response
+// reports that the server refused the request as sent, rather than
+// failing to handle it for a reason that may go away.
+func webhookRejected(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
+
 type webhookResultStatus struct {
 	Success   bool   `json:"success"`
 	ErrorCode string `json:"error"`
@@ -358,7 +372,7 @@ func (r *webhookReader) Err() error {
 }
 
 func (r *webhookReader) Stop() error {
-	debugf("[%s] Requesting WebHook reader to stop...", r.accountName)
+	accountDebugf(r.accountName, "Requesting WebHook reader to stop...")
 	r.tomb.Kill(errStop)
 	err := r.tomb.Wait()
 	if err != errStop {
@@ -368,7 +382,7 @@ func (r *webhookReader) Stop() error {
 }
 
 func (r *webhookReader) die() {
-	debugf("[%s] Reader is dead (%v)", r.accountName, r.tomb.Err())
+	accountDebugf(r.accountName, "Reader is dead (%v)", r.tomb.Err())
 }
 
 func (r *webhookReader) loop() error {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -118,14 +119,27 @@ func (s *WebHookSuite) TestOutgoing(c *C) {
 
 	// Should be delivered again due to the missing confirmation.
 	s.RecvMessage(c, "@nick", "Hello again!")
+
+	// Messages refused by the server are reported as failed, and the
+	// account moves on without retrying them.
+	s.whserver.RejectSend()
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,nick,text) VALUES (2,'one','nick','Rejected.')`,
+		`INSERT INTO message (lane,account,nick,text) VALUES (2,'one','nick','Accepted.')`,
+	)
+	s.RecvMessage(c, "@nick", "Accepted.")
+	failed := regexp.MustCompile(`Cannot deliver message \d+: server returned 400 Bad Request\n`)
+	waitFor(func() bool { return failed.MatchString(c.GetTestLog()) })
+	c.Assert(failed.MatchString(c.GetTestLog()), Equals, true)
 }
 
 type webhookServer struct {
 	server *httptest.Server
 
-	updates  chan string
-	messages chan webhookMessage
-	failSend chan bool
+	updates    chan string
+	messages   chan webhookMessage
+	failSend   chan bool
+	rejectSend chan bool
 }
 
 type webhookMessage struct {
@@ -136,10 +150,11 @@ type webhookMessage struct {
 
 func (s *webhookServer) Start() {
 	*s = webhookServer{
-		server:   httptest.NewServer(s),
-		updates:  make(chan string),
-		messages: make(chan webhookMessage, 10),
-		failSend: make(chan bool, 10),
+		server:     httptest.NewServer(s),
+		updates:    make(chan string),
+		messages:   make(chan webhookMessage, 10),
+		failSend:   make(chan bool, 10),
+		rejectSend: make(chan bool, 10),
 	}
 }
 
@@ -182,6 +197,14 @@ func (s *webhookServer) FailSend() {
 	}
 }
 
+func (s *webhookServer) RejectSend() {
+	select {
+	case s.rejectSend <- true:
+	default:
+		panic("Trying to enqueue too many rejections without the client receiving any of them.")
+	}
+}
+
 func (s *webhookServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	req.ParseForm()
 
@@ -192,6 +215,9 @@ func (s *webhookServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	select {
 	case <-s.failSend:
 		fmt.Fprintf(w, `{"success": false, "error": "error-something-wrong"}`)
+	case <-s.rejectSend:
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
 	default:
 	}
 	var msg webhookMessage
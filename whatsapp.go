@@ -0,0 +1,525 @@
+package mup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// whatsappClient implements WhatsApp accounts on top of an external bridge
+// program, such as a thin wrapper around the whatsmeow library, which owns
+// the WhatsApp session. The program is started with the account identity as
+// its only argument and speaks JSON-RPC 2.0 over its standard input and
+// output, one document per line:
+//
+//	-> {"jsonrpc":"2.0","method":"send","params":{"chat":"<jid>","text":"..."},"id":1}
+//	<- {"jsonrpc":"2.0","result":{},"id":1}
+//	<- {"jsonrpc":"2.0","method":"message","params":{"id":"...","chat":"<jid>","sender":"<jid>","text":"...","timestamp":1586383094}}
+//
+// Group chats are mapped to channels named after the group JID user part,
+// as in "#120363012345678901", and private chats to the sender's phone
+// number, as in "@+5511999999999".
+type whatsappClient struct {
+	accountName string
+
+	dying <-chan struct{}
+	info  accountInfo
+	bangs *bangPrefixes
+	tomb  tomb.Tomb
+	waR   *waReader
+	waW   *waWriter
+
+	requests chan interface{}
+
+	incoming chan *Message
+	outgoing chan *Message
+}
+
+func (c *whatsappClient) AccountName() string     { return c.accountName }
+func (c *whatsappClient) Dying() <-chan struct{}  { return c.dying }
+func (c *whatsappClient) Outgoing() chan *Message { return c.outgoing }
+func (c *whatsappClient) LastId() int64           { return c.info.LastId }
+
+func startWhatsAppClient(info *accountInfo, incoming chan *Message) accountClient {
+	c := &whatsappClient{
+		accountName: info.Name,
+
+		info:     *info,
+		bangs:    newBangPrefixes("/", info),
+		requests: make(chan interface{}, 1),
+		incoming: incoming,
+		outgoing: make(chan *Message),
+	}
+	c.dying = c.tomb.Dying()
+	c.tomb.Go(c.run)
+	return c
+}
+
+func (c *whatsappClient) Alive() bool {
+	return c.tomb.Alive()
+}
+
+func (c *whatsappClient) Stop() error {
+	// Try to disconnect gracefully.
+	timeout := time.After(NetworkTimeout)
+	select {
+	case c.outgoing <- &Message{Command: cmdQuit}:
+		select {
+		case <-c.dying:
+		case <-timeout:
+		}
+	case <-c.dying:
+	case <-timeout:
+	}
+	c.tomb.Kill(errStop)
+	err := c.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+// UpdateInfo updates the account information. Everything but
+// the account name may be updated.
+func (c *whatsappClient) UpdateInfo(info *accountInfo) {
+	if info.Name != c.accountName {
+		panic("cannot change the account name")
+	}
+	// Make a copy as its use will continue after returning to the caller.
+	infoCopy := *info
+	select {
+	case c.requests <- ireqUpdateInfo(&infoCopy):
+	case <-c.dying:
+	}
+}
+
+// waConfig holds the WhatsApp-specific settings that may be provided
+// in the account configuration document.
+type waConfig struct {
+	// Command is the bridge program run for the account.
+	Command string `json:"command"`
+}
+
+const waDefaultCommand = "mup-whatsapp"
+
+func (c *whatsappClient) config() waConfig {
+	var config waConfig
+	if c.info.Config != "" {
+		err := json.Unmarshal([]byte(c.info.Config), &config)
+		if err != nil {
+			accountLogf(c.accountName, "Cannot parse account configuration: %v", err)
+		}
+	}
+	if config.Command == "" {
+		config.Command = waDefaultCommand
+	}
+	return config
+}
+
+// waRestartNeeded returns whether the reader and writer must be restarted
+// for the changes between the old and new account information to apply.
+func waRestartNeeded(old, new *accountInfo) bool {
+	return old.Identity != new.Identity || old.Nick != new.Nick || old.Config != new.Config
+}
+
+func (c *whatsappClient) startReaderWriter() {
+	config := c.config()
+	c.waR = startWaReader(c.accountName, c.info.Identity, c.info.Nick, config, c.bangs)
+	c.waW = startWaWriter(c.accountName, c.waR)
+}
+
+func (c *whatsappClient) stopReaderWriter() {
+	err := c.waW.Stop()
+	if err != nil {
+		accountLogf(c.accountName, "WhatsApp writer failure: %s", err)
+	}
+	err = c.waR.Stop()
+	if err != nil {
+		accountLogf(c.accountName, "WhatsApp reader failure: %s", err)
+	}
+}
+
+func (c *whatsappClient) die() {
+	accountLogf(c.accountName, "Cleaning WhatsApp connection resources")
+
+	if c.waW != nil {
+		c.stopReaderWriter()
+	}
+
+	c.tomb.Kill(nil)
+	accountLogf(c.accountName, "WhatsApp client terminated (%v)", c.tomb.Err())
+}
+
+func (c *whatsappClient) run() error {
+	defer c.die()
+
+	if c.info.Identity == "" || c.info.Identity[0] != '+' {
+		c.tomb.Killf("account identity is not a phone number: %q", c.info.Identity)
+		return nil
+	}
+
+	c.startReaderWriter()
+
+	var inMsg, outMsg *Message
+	var inRecv, outRecv <-chan *Message
+	var inSend, outSend chan<- *Message
+
+	inRecv = c.waR.Incoming
+	outRecv = c.outgoing
+
+	quitting := false
+	for {
+		select {
+		case inMsg = <-inRecv:
+			inRecv = nil
+			inSend = c.incoming
+
+		case inSend <- inMsg:
+			inMsg = nil
+			inRecv = c.waR.Incoming
+			inSend = nil
+
+		case outMsg = <-outRecv:
+			if outMsg.Command == cmdQuit {
+				quitting = true
+			}
+			outRecv = nil
+			outSend = c.waW.Outgoing
+
+		case outSend <- outMsg:
+			outMsg = nil
+			outRecv = c.outgoing
+			outSend = nil
+
+		case req := <-c.requests:
+			switch r := req.(type) {
+			case ireqUpdateInfo:
+				old := c.info
+				c.info = *r
+				c.bangs.update(&c.info)
+				if !waRestartNeeded(&old, &c.info) {
+					break
+				}
+				if c.info.Identity == "" || c.info.Identity[0] != '+' {
+					c.tomb.Killf("account identity is not a phone number: %q", c.info.Identity)
+					break
+				}
+				accountLogf(c.accountName, "WhatsApp account settings changed. Restarting reader and writer.")
+				c.stopReaderWriter()
+				c.startReaderWriter()
+				if inMsg == nil {
+					inRecv = c.waR.Incoming
+				}
+				if outMsg != nil {
+					outSend = c.waW.Outgoing
+				}
+			}
+
+		case <-c.dying:
+			return c.tomb.Err()
+		case <-c.waR.Dying:
+			if quitting {
+				return errStop
+			}
+			return c.waR.Err()
+		case <-c.waW.Dying:
+			if quitting {
+				return errStop
+			}
+			return c.waW.Err()
+		}
+	}
+	panic("unreachable")
+}
+
+// waNick returns the nick used for the WhatsApp user with the provided JID,
+// which is the user's phone number in international format.
+func waNick(jid string) string {
+	user := jid
+	if i := strings.IndexByte(user, '@'); i >= 0 {
+		user = user[:i]
+	}
+	// Drop the device and agent suffixes, as in "5511999999999.0:12".
+	if i := strings.IndexAny(user, ".:"); i >= 0 {
+		user = user[:i]
+	}
+	return "+" + user
+}
+
+// waChannel returns the channel name for the WhatsApp chat with the provided JID.
+func waChannel(chat string) string {
+	if strings.HasSuffix(chat, "@g.us") {
+		return "#" + strings.TrimSuffix(chat, "@g.us")
+	}
+	return "@" + waNick(chat)
+}
+
+// waChat returns the JID of the WhatsApp chat for the provided channel name.
+func waChat(channel string) (string, error) {
+	switch {
+	case strings.HasPrefix(channel, "#") && len(channel) > 1:
+		return channel[1:] + "@g.us", nil
+	case strings.HasPrefix(channel, "@+") && len(channel) > 2:
+		return channel[2:] + "@s.whatsapp.net", nil
+	}
+	return "", fmt.Errorf("invalid WhatsApp channel: %q", channel)
+}
+
+// ---------------------------------------------------------------------------
+// waWriter
+
+// A waWriter reads messages from the Outgoing channel and sends them via the bridge.
+type waWriter struct {
+	accountName string
+	r           *waReader
+	tomb        tomb.Tomb
+
+	Dying    <-chan struct{}
+	Outgoing chan *Message
+}
+
+func startWaWriter(accountName string, r *waReader) *waWriter {
+	w := &waWriter{
+		accountName: accountName,
+		r:           r,
+		Outgoing:    make(chan *Message, 1),
+	}
+	w.Dying = w.tomb.Dying()
+	w.tomb.Go(w.loop)
+	return w
+}
+
+func (w *waWriter) Err() error {
+	return w.tomb.Err()
+}
+
+func (w *waWriter) Stop() error {
+	accountDebugf(w.accountName, "Requesting writer to stop...")
+	w.tomb.Kill(errStop)
+	err := w.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+func (w *waWriter) die() {
+	accountDebugf(w.accountName, "Writer is dead (%v)", w.tomb.Err())
+}
+
+type waSendParams struct {
+	Chat string `json:"chat"`
+	Text string `json:"text"`
+}
+
+func (w *waWriter) loop() error {
+	defer w.die()
+
+loop:
+	for {
+		var msg *Message
+		select {
+		case msg = <-w.Outgoing:
+		case <-w.Dying:
+			break loop
+		}
+		switch msg.Command {
+		case cmdQuit:
+			break loop
+		case "", cmdPrivMsg, cmdNotice:
+			break
+		default:
+			continue
+		}
+
+		accountLogf(w.accountName, "Sending: %s", msg.String())
+
+		chat, err := waChat(msg.Channel)
+		if err == nil {
+			err = w.r.rpc.call(w.Dying, "send", &waSendParams{Chat: chat, Text: StripFormatting(msg.Text)}, nil)
+			if err == errStop {
+				break
+			}
+			if _, refused := err.(*jsonRPCError); err != nil && !refused {
+				w.tomb.Killf("cannot send message via WhatsApp bridge: %v", err)
+				break
+			}
+		}
+
+		// Notify the account manager that the message was delivered,
+		// or that it never will be so it isn't retried.
+		select {
+		case w.r.Incoming <- deliveryPong(w.accountName, msg.Id, err):
+		case <-w.Dying:
+		case <-w.r.Dying:
+		}
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// waReader
+
+// A waReader runs the bridge program and injects the messages it reports
+// in the Incoming channel.
+type waReader struct {
+	accountName string
+	identity    string
+	activeNick  string
+	config      waConfig
+	bangs       *bangPrefixes
+	rpc         *jsonRPC
+	tomb        tomb.Tomb
+
+	Dying    <-chan struct{}
+	Incoming chan *Message
+}
+
+func startWaReader(accountName, identity, nick string, config waConfig, bangs *bangPrefixes) *waReader {
+	r := &waReader{
+		accountName: accountName,
+		identity:    identity,
+		activeNick:  nick,
+		config:      config,
+		bangs:       bangs,
+		Incoming:    make(chan *Message, 1),
+	}
+	r.Dying = r.tomb.Dying()
+	r.rpc = newJSONRPC("WhatsApp bridge", r.Dying)
+	r.tomb.Go(r.loop)
+	return r
+}
+
+func (r *waReader) Err() error {
+	return r.tomb.Err()
+}
+
+func (r *waReader) Stop() error {
+	accountDebugf(r.accountName, "Requesting WhatsApp reader to stop...")
+	r.tomb.Kill(errStop)
+	err := r.tomb.Wait()
+	if err != errStop {
+		return err
+	}
+	return nil
+}
+
+func (r *waReader) die() {
+	accountDebugf(r.accountName, "Reader is dead (%v)", r.tomb.Err())
+}
+
+type waMessage struct {
+	Id        string `json:"id"`
+	Chat      string `json:"chat"`
+	Sender    string `json:"sender"`
+	PushName  string `json:"pushName"`
+	Text      string `json:"text"`
+	Timestamp int64  `json:"timestamp"`
+	FromMe    bool   `json:"fromMe"`
+}
+
+func (r *waReader) loop() error {
+	defer r.die()
+
+	cmd := exec.Command(r.config.Command, r.identity)
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("cannot open WhatsApp bridge input pipe: %v", err)
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cannot open WhatsApp bridge output pipe: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("cannot start WhatsApp bridge: %v", err)
+	}
+	defer func() {
+		input.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	r.tomb.Go(func() error {
+		// Interrupt the decoder below when stopping.
+		<-r.Dying
+		cmd.Process.Kill()
+		return nil
+	})
+
+	accountLogf(r.accountName, "Started WhatsApp bridge: %s", r.config.Command)
+	r.rpc.start(input)
+
+	decoder := json.NewDecoder(output)
+	for {
+		var data json.RawMessage
+		err := decoder.Decode(&data)
+		if !r.tomb.Alive() {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("WhatsApp bridge terminated unexpectedly")
+		}
+		var msg jsonRPCMessage
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot decode WhatsApp bridge payload: %v", err)
+		}
+		switch {
+		case msg.Method == "message":
+			err = r.handle(msg.Params)
+			if err != nil {
+				return err
+			}
+		case msg.Id != nil:
+			r.rpc.dispatch(&msg)
+		default:
+			accountDebugf(r.accountName, "Ignoring WhatsApp bridge payload: %s", data)
+		}
+	}
+	panic("unreachable")
+}
+
+// handle delivers the messages resulting from a single message notification.
+func (r *waReader) handle(data json.RawMessage) error {
+	var wamsg waMessage
+	err := json.Unmarshal(data, &wamsg)
+	if err != nil {
+		return fmt.Errorf("cannot decode WhatsApp message: %v", err)
+	}
+	if wamsg.FromMe {
+		return nil
+	}
+
+	nick := waNick(wamsg.Sender)
+
+	var msgs []*Message
+
+	line := fmt.Sprintf(":%s!~user@whatsapp WHATSAPPDATA :%s", nick, data)
+	accountLogf(r.accountName, "Received: %s", line)
+	msgs = append(msgs, r.bangs.parseIncoming(r.accountName, r.activeNick, line))
+
+	if wamsg.Text != "" {
+		line = fmt.Sprintf(":%s!~user@whatsapp PRIVMSG %s :%s", nick, waChannel(wamsg.Chat), wamsg.Text)
+		accountLogf(r.accountName, "Received: %s", line)
+		msgs = append(msgs, r.bangs.parseIncoming(r.accountName, r.activeNick, line))
+	}
+
+	for _, msg := range msgs {
+		if wamsg.Timestamp > 0 {
+			msg.Time = time.Unix(wamsg.Timestamp, 0)
+		}
+		select {
+		case r.Incoming <- msg:
+		case <-r.Dying:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package mup_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/mup.v0"
+)
+
+type WhatsAppSuite struct {
+	config *mup.Config
+	server *mup.Server
+
+	dbdir string
+	db    *sql.DB
+
+	bindir string
+}
+
+var _ = Suite(&WhatsAppSuite{})
+
+func (s *WhatsAppSuite) SetUpTest(c *C) {
+	mup.SetDebug(true)
+	mup.SetLogger(c)
+
+	s.bindir = c.MkDir()
+	s.dbdir = c.MkDir()
+
+	var err error
+	s.db, err = mup.OpenDB(s.dbdir)
+	c.Assert(err, IsNil)
+
+	s.config = &mup.Config{
+		DB:      s.db,
+		Refresh: -1, // Manual refreshing for testing.
+	}
+}
+
+func (s *WhatsAppSuite) TearDownTest(c *C) {
+	mup.SetDebug(false)
+	mup.SetLogger(nil)
+
+	if s.server != nil {
+		s.server.Stop()
+		s.server = nil
+	}
+
+	s.db.Close()
+	s.db = nil
+}
+
+// Start installs a fake WhatsApp bridge that prints the provided
+// notifications and then responds to every request read with an empty
+// result, and starts the server with an account using it. Requests
+// are logged to rpc.txt and the bridge arguments to args.txt.
+func (s *WhatsAppSuite) Start(c *C, notifications ...string) {
+	script := "#!/bin/bash\necho \"$@\" > $(dirname $0)/args.txt\n"
+	for _, notification := range notifications {
+		script += "cat <<__OUTPUT_END__\n" + notification + "\n__OUTPUT_END__\n"
+	}
+	script += "while read -r line; do\n" +
+		"echo \"$line\" >> $(dirname $0)/rpc.txt\n" +
+		"id=${line##*\\\"id\\\":}; id=${id%\\}}\n" +
+		"echo \"{\\\"jsonrpc\\\":\\\"2.0\\\",\\\"result\\\":{},\\\"id\\\":$id}\"\n" +
+		"done\n"
+	command := filepath.Join(s.bindir, "fake-whatsapp")
+	err := ioutil.WriteFile(command, []byte(script), 0755)
+	c.Assert(err, IsNil)
+
+	_, err = s.db.Exec(`INSERT INTO account (name,kind,identity,config) VALUES ('one','whatsapp','+55555',?)`,
+		`{"command": "`+command+`"}`)
+	c.Assert(err, IsNil)
+
+	s.server, err = mup.Start(s.config)
+	c.Assert(err, IsNil)
+}
+
+func (s *WhatsAppSuite) ReadFile(c *C, name string, want string) string {
+	var data []byte
+	var err error
+	for i := 0; i < 100; i++ {
+		data, err = ioutil.ReadFile(filepath.Join(s.bindir, name))
+		if err == nil && len(data) >= len(want) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !os.IsNotExist(err) {
+		c.Assert(err, IsNil)
+	}
+	return string(data)
+}
+
+var whatsappIncomingTests = []struct {
+	notification string
+	message      mup.Message
+}{{
+	`{"jsonrpc":"2.0","method":"message","params":{"id":"3EB0A1","chat":"12345@s.whatsapp.net",` +
+		`"sender":"12345@s.whatsapp.net","pushName":"Joe","text":"Hello mup!","timestamp":1586383094}}`,
+	mup.Message{
+		Account: "one",
+		Lane:    1,
+		Nick:    "+12345",
+		User:    "~user",
+		Host:    "whatsapp",
+		Command: "PRIVMSG",
+		Channel: "@+12345",
+		Text:    "Hello mup!",
+		BotText: "Hello mup!",
+		Bang:    "/",
+		AsNick:  "mup",
+		Time:    time.Date(2020, 4, 8, 21, 58, 14, 0, time.UTC),
+	},
+}, {
+	`{"jsonrpc":"2.0","method":"message","params":{"id":"3EB0A2","chat":"120363012345@g.us",` +
+		`"sender":"12345:7@s.whatsapp.net","text":"Hello group!","timestamp":1586383094}}`,
+	mup.Message{
+		Account: "one",
+		Lane:    1,
+		Nick:    "+12345",
+		User:    "~user",
+		Host:    "whatsapp",
+		Command: "PRIVMSG",
+		Channel: "#120363012345",
+		Text:    "Hello group!",
+		Bang:    "/",
+		AsNick:  "mup",
+		Time:    time.Date(2020, 4, 8, 21, 58, 14, 0, time.UTC),
+	},
+}}
+
+func (s *WhatsAppSuite) TestIncoming(c *C) {
+	var notifications []string
+	for _, test := range whatsappIncomingTests {
+		notifications = append(notifications, test.notification)
+	}
+	// Messages sent by the account itself are dropped.
+	notifications = append(notifications, `{"jsonrpc":"2.0","method":"message","params":{"id":"3EB0A3",`+
+		`"chat":"12345@s.whatsapp.net","sender":"55555@s.whatsapp.net","text":"Mine.","fromMe":true}}`)
+	s.Start(c, notifications...)
+
+	c.Assert(s.ReadFile(c, "args.txt", "+55555"), Equals, "+55555\n")
+
+	var msgs []mup.Message
+	for i := 0; i < 100; i++ {
+		msgs = nil
+		rows, err := s.db.Query("SELECT lane,account,nick,user,host,command,channel,text,bottext,bang,asnick,time FROM message WHERE command='PRIVMSG' ORDER BY id")
+		c.Assert(err, IsNil)
+		for rows.Next() {
+			var msg mup.Message
+			err = rows.Scan(&msg.Lane, &msg.Account, &msg.Nick, &msg.User, &msg.Host, &msg.Command,
+				&msg.Channel, &msg.Text, &msg.BotText, &msg.Bang, &msg.AsNick, &msg.Time)
+			c.Assert(err, IsNil)
+			msgs = append(msgs, msg)
+		}
+		c.Assert(rows.Close(), IsNil)
+		if len(msgs) >= len(whatsappIncomingTests) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(msgs, HasLen, len(whatsappIncomingTests))
+
+	for i, test := range whatsappIncomingTests {
+		c.Assert(msgs[i].Time.UTC().String(), Equals, test.message.Time.String())
+		msgs[i].Time = time.Time{}
+		test.message.Time = time.Time{}
+		c.Assert(msgs[i], DeepEquals, test.message)
+	}
+
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM message WHERE command='WHATSAPPDATA'").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, len(whatsappIncomingTests))
+}
+
+func (s *WhatsAppSuite) TestOutgoing(c *C) {
+	s.Start(c)
+
+	// Ensure messages are only inserted after the account is running.
+	s.server.RefreshAccounts()
+
+	execSQL(c, s.db,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@+12345','nick','Hello there.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','@nick','nick','Invalid chat.')`,
+		`INSERT INTO message (lane,account,channel,nick,text) VALUES (2,'one','#120363012345','nick','Group chat.')`,
+	)
+
+	// Messages to invalid channels are reported as failed, and the
+	// account moves on.
+	want := `{"jsonrpc":"2.0","method":"send","params":{"chat":"12345@s.whatsapp.net","text":"Hello there."},"id":1}` + "\n" +
+		`{"jsonrpc":"2.0","method":"send","params":{"chat":"120363012345@g.us","text":"Group chat."},"id":2}` + "\n"
+	c.Assert(s.ReadFile(c, "rpc.txt", want), Equals, want)
+	failed := `Cannot deliver message 2: invalid WhatsApp channel: "@nick"`
+	waitFor(func() bool { return strings.Contains(c.GetTestLog(), failed) })
+	c.Assert(strings.Contains(c.GetTestLog(), failed), Equals, true)
+}